@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/client"
+)
+
+// checkTimeout bounds the connectivity test
+const checkTimeout = time.Minute
+
+// runCheck implements -check: it tests the tunnel through each configured
+// resolver, prints what works and returns the exit code, 0 if the server
+// is reachable through any resolver.
+func runCheck(config *client.Config) int {
+	resolver, err := client.NewResolver(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create resolver: %v\n", err)
+		return 1
+	}
+	defer resolver.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	d := resolver.Diagnose(ctx)
+	printDiagnosis(os.Stdout, config.ServerDomain, d)
+	if !d.OK() {
+		return 1
+	}
+	return 0
+}
+
+// printDiagnosis writes a diagnosis in a human-readable form.
+func printDiagnosis(w io.Writer, domain string, d *client.Diagnosis) {
+	fmt.Fprintf(w, "Server domain: %s (%d bytes of payload per query)\n\n", domain, d.QueryPayload)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "RESOLVER\tRESULT\tLATENCY\tEDNS SIZE\tMAX RESPONSE\n")
+	for _, r := range d.Resolvers {
+		if r.Err != nil {
+			fmt.Fprintf(tw, "%s\tfailed: %v\t-\t-\t-\n", r.Resolver, r.Err)
+			continue
+		}
+		edns := "none"
+		if r.EDNSSize > 0 {
+			edns = fmt.Sprint(r.EDNSSize)
+		}
+		fmt.Fprintf(tw, "%s\tok\t%s\t%s\t%d bytes\n", r.Resolver, r.Latency.Round(time.Millisecond), edns, r.MaxResponse)
+	}
+	tw.Flush()
+
+	if !d.OK() {
+		fmt.Fprintf(w, "\nNo resolver delivered the test query to the server. Check that the domain is delegated to the server, that the server runs and that both sides use the same key.\n")
+	}
+}
@@ -4,20 +4,32 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
 
+	"github.com/AliRezaBeigy/dns-as-doh/internal/alert"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/audit"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/client"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dnssec"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/listener"
+	"github.com/AliRezaBeigy/dns-as-doh/pkg/config"
 	"github.com/AliRezaBeigy/dns-as-doh/pkg/service"
 )
 
+// serviceOnlyFlags are flags not written to the service config file.
+var serviceOnlyFlags = []string{"config", "instance", "install", "uninstall", "service", "firewall", "gen-key", "out", "bundle", "version", "check"}
+
 var (
 	version = "dev"
 	commit  = "none"
@@ -25,25 +37,92 @@ var (
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		os.Exit(runStatus(os.Args[2:]))
+	}
+	simulate := len(os.Args) > 1 && os.Args[1] == "simulate"
+	if simulate {
+		os.Args = slices.Delete(os.Args, 1, 2)
+	}
+
 	// Parse flags
 	var (
 		listenAddr   = flag.String("listen", "127.0.0.1:53", "Address to listen for DNS queries")
+		listeners    = flag.String("listeners", "", "Extra listen addresses with their own route, for applications that should resolve names another way: comma-separated addr=tunnel, addr=tunnel@name (asking for a server upstream of that name), addr=direct (the resolvers, bypassing the tunnel) or addr=direct@resolver+resolver (e.g. 127.0.0.1:5301=direct@9.9.9.9:53)")
 		serverDomain = flag.String("domain", "", "Server domain (e.g., t.example.com)")
-		resolvers    = flag.String("resolvers", "8.8.8.8:53,1.1.1.1:53,9.9.9.9:53", "Comma-separated list of public DNS resolvers")
+		resolvers    = flag.String("resolvers", "8.8.8.8:53,1.1.1.1:53,9.9.9.9:53", "Comma-separated list of public DNS resolvers (UDP: 8.8.8.8:53, DoH: https://dns.google/dns-query, DoT: 1.1.1.1:853 or tls://dns.quad9.net)")
 		keyHex       = flag.String("key", "", "Encryption key (64 hex characters)")
 		keyFile      = flag.String("key-file", "", "File containing the encryption key")
+		keyID        = flag.Uint("key-id", 0, "Key ID of a per-client key issued by the server (0 for the shared key)")
+		insecureKey  = flag.Bool("insecure-key-perms", false, "Allow a key file readable by group or others")
+		handshake    = flag.Bool("handshake", false, "Establish per-session keys with an X25519 handshake for forward secrecy")
+		sessionFile  = flag.String("session-file", "", "File to keep the -handshake session in, so a restarted client resumes it without a new handshake")
 		timeout      = flag.Duration("timeout", client.DefaultConfig().Timeout, "Query timeout")
+		healthCheck  = flag.Duration("health-interval", client.DefaultHealthCheckInterval, "How often to probe resolvers; failing resolvers are avoided with exponential backoff (0 disables probing)")
+		strategy     = flag.String("resolver-strategy", "parallel", "How queries are spread over resolvers: parallel (all at once), race (best two), sequential (failover), weighted (random, favouring healthy ones), hedged (best, then second best if slow)")
+		sendJitter   = flag.Duration("send-jitter", 0, "With the parallel and race strategies, send to resolvers after the best one at random offsets up to this long instead of all at once (0 disables)")
+		tunnelConc   = flag.Int("tunnel-concurrency", client.DefaultTunnelConcurrency, "Maximum tunnel exchanges in flight at once; DNS lookups waiting for one go ahead of SOCKS stream data (0 disables the limit)")
+		drainTimeout = flag.Duration("drain-timeout", client.DefaultDrainTimeout, "How long to wait for in-flight queries on shutdown")
+		cacheSize    = flag.Int("cache-size", client.DefaultCacheSize, "Number of DNS responses to cache (0 disables caching)")
+		stealth      = flag.String("stealth", "off", "Shape tunnel query names to resemble ordinary hostnames (off, low, medium, high)")
+		random0x20   = flag.Bool("0x20", false, "Send tunnel query names in random case (DNS 0x20) for more entropy per name")
+		dnssecFlag   = flag.Bool("dnssec", false, "Validate DNSSEC locally and set AD only on validated answers")
+		anchorFile   = flag.String("trust-anchor-file", "", "File of DS or DNSKEY trust anchors for -dnssec (default: the root zone keys)")
+		anchorState  = flag.String("trust-anchor-state", "", "File to keep trust anchor state in, so -dnssec follows key rollovers (RFC 5011)")
+		history      = flag.String("resolver-history", "", "File to keep per-network resolver performance in, so resolvers that worked on a network are preferred on returning to it")
+		directDoms   = flag.String("direct-domains", "", "Comma-separated domains resolved directly against -direct-resolvers instead of through the tunnel, subdomains included (e.g., local,corp.example)")
+		directRules  = flag.String("direct-rules", "", "File of split DNS rules, one domain and optionally its own resolvers per line, resolved directly like -direct-domains")
+		directRes    = flag.String("direct-resolvers", "", "Comma-separated plain resolvers, such as the LAN's, for direct domains (default: -resolvers)")
+		directPTR    = flag.Bool("direct-private-ptr", false, "Resolve reverse lookups of RFC 1918 private addresses directly like -direct-domains")
+		fallback     = flag.Int("direct-fallback", 0, "After this many tunnel failures in a row, resolve queries directly in cleartext against -resolvers until the tunnel works again (0 never falls back)")
+		profileFile  = flag.String("profiles", "", "File of network profiles overriding resolvers, resolver strategy, stealth level, direct domains and direct resolvers on the networks they match (see README)")
+		socksAddr    = flag.String("socks", "", "Address for a local SOCKS5 proxy tunneling TCP connections through the server (e.g. 127.0.0.1:1080; the server needs -streams)")
+		dohAddr      = flag.String("doh", "", "Address for a local DNS over HTTPS endpoint answering at /dns-query (and JSON at /resolve), for browsers and systems configured for DoH (e.g. 127.0.0.1:8443)")
+		dohCert      = flag.String("doh-cert", "", "Certificate file for -doh to serve HTTPS with (without -doh-cert and -doh-key it serves plain HTTP)")
+		dohKey       = flag.String("doh-key", "", "Private key file of -doh-cert")
+		dohAllow     = flag.String("doh-allow", "", "Comma-separated client addresses and networks allowed to use -doh (default: loopback only)")
+		dotAddr      = flag.String("dot", "", "Address for a local DNS over TLS endpoint, for systems configured for an encrypted resolver such as Android Private DNS or systemd-resolved (e.g. 127.0.0.1:853)")
+		dotCert      = flag.String("dot-cert", "", "Certificate file for -dot to serve (default: a self-signed certificate, whose pin is logged)")
+		dotKey       = flag.String("dot-key", "", "Private key file of -dot-cert")
+		dotAllow     = flag.String("dot-allow", "", "Comma-separated client addresses and networks allowed to use -dot (default: loopback only)")
+		exportIface  = flag.String("export-interface", "", "Serve plain DNS (port 53) and DoH (port 8053) on the addresses of a bridge interface, such as docker0 or virbr0, to its containers and VMs")
+		powerPolicy  = flag.String("power-policy", client.DefaultPowerPolicy.String(), "When to send fewer background queries to save battery and data: battery, metered (comma-separated), always or never")
+		startChecks  = flag.Bool("startup-checks", true, "Check at startup that a resolver answers for the server domain, and exit with an explanation if not")
+		pathDiscover = flag.Bool("path-discovery", true, "Probe each resolver at startup for the longest query names and largest responses that get through intact, and fragment messages to fit")
+		maxCodec     = flag.String("codec", "binary", "Densest encoding of query names path discovery tries: base32, base64 (needs names kept in case) or binary (needs any byte kept)")
+		compress     = flag.Bool("compress", true, "Compress DNS messages before encryption when the server supports it, so large responses need fewer queries")
+		traceLog     = flag.Bool("trace-log", false, "Log every tunneled query with the trace ID the server logs it with, for debugging (logs query names)")
+		traceSample  = flag.Int("trace-log-sample", 1, "With -trace-log, log only 1 in N successful queries (failures are always logged)")
+		upstreamHint = flag.String("upstream-hint", "", "Name of the server upstream (from the server's -named-upstreams) to resolve tunneled queries with")
+		alertHook    = flag.String("alert-webhook", "", "URL to post alerts to: the tunnel going down, responses failing to decrypt, the key refused")
+		alertFormat  = flag.String("alert-format", alert.FormatGeneric, "Body format of -alert-webhook: generic (JSON), slack or discord")
+		alertEvery   = flag.Duration("alert-interval", alert.DefaultInterval, "Minimum time between two alerts of the same kind")
+		check        = flag.Bool("check", false, "Send test queries to the server through each resolver, report latency and the largest response that gets through, and exit")
+		configFile   = flag.String("config", "", "Config file with options (TOML, keys are flag names)")
 		showVersion  = flag.Bool("version", false, "Show version information")
 		genKey       = flag.Bool("gen-key", false, "Generate a new encryption key")
+		keyOut       = flag.String("out", "", "With -gen-key, write the key to this file (mode 0600)")
+		bundleDir    = flag.String("bundle", "", "With -gen-key, write the key and matching client.toml and server.toml to this directory (requires -domain)")
 		installSvc   = flag.Bool("install", false, "Install as system service")
 		uninstallSvc = flag.Bool("uninstall", false, "Uninstall system service")
 		runSvc       = flag.Bool("service", false, "Run as system service")
+		instance     = flag.String("instance", "", "Service instance name, for running several named services")
+		auditFile    = flag.String("audit-log", "", "File to append administrative actions to")
+		ctrlSocket   = flag.String("control-socket", "", "Control socket for the status command (default: per instance under /run or the user's runtime directory; \"off\" disables it)")
 	)
 
+	var simulateOpts *simulateOptions
+	if simulate {
+		simulateOpts = simulateFlags(flag.CommandLine)
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "DNS-as-DoH Client - DNS tunnel client\n\n")
 		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s status [-instance name] [-json]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s simulate [-input file] [-concurrency n] [-type type] [-json] [options]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -52,11 +131,37 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  # Run client\n")
 		fmt.Fprintf(os.Stderr, "  %s -domain t.example.com -key <hex-key>\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Install as service (Windows/Linux)\n")
-		fmt.Fprintf(os.Stderr, "  %s -install -domain t.example.com -key <hex-key>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -install -domain t.example.com -key <hex-key>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Test the tunnel through each resolver\n")
+		fmt.Fprintf(os.Stderr, "  %s -check -domain t.example.com -key <hex-key>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Replay the lookups of a browser capture through the tunnel\n")
+		fmt.Fprintf(os.Stderr, "  %s simulate -input capture.har -concurrency 20 -domain t.example.com -key <hex-key>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Show the state of the running client\n")
+		fmt.Fprintf(os.Stderr, "  %s status\n", os.Args[0])
 	}
 
 	flag.Parse()
 
+	// Resolve the service name of this instance
+	serviceName, err := service.InstanceName("dns-as-doh-client", *instance)
+	if err != nil {
+		log.Fatalf("Invalid instance: %v", err)
+	}
+
+	// Named instances default to their own config file
+	if *configFile == "" && *instance != "" {
+		*configFile = service.InstanceConfigPath(serviceName)
+	}
+
+	// Load config file, command line flags take precedence
+	var loader *config.Loader
+	if *configFile != "" {
+		loader = config.NewLoader(flag.CommandLine, *configFile, "config")
+		if err := loader.Load(); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
 	// Handle version
 	if *showVersion {
 		fmt.Printf("dns-as-doh-client %s (%s) built %s\n", version, commit, date)
@@ -69,14 +174,68 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to generate key: %v", err)
 		}
-		fmt.Printf("Generated encryption key:\n%s\n", hex.EncodeToString(key))
-		fmt.Println("\nSave this key securely and use it on both client and server.")
+		provision := &config.Provision{
+			Domain:    *serverDomain,
+			Key:       hex.EncodeToString(key),
+			Resolvers: splitList(*resolvers),
+		}
+
+		if *bundleDir != "" {
+			if *serverDomain == "" {
+				log.Fatalf("-bundle requires -domain")
+			}
+			if err := os.MkdirAll(*bundleDir, 0700); err != nil {
+				log.Fatalf("Failed to create bundle directory: %v", err)
+			}
+			if err := crypto.WriteKeyFile(filepath.Join(*bundleDir, config.BundleKeyFile), key); err != nil {
+				log.Fatalf("Failed to write key: %v", err)
+			}
+			if err := provision.WriteBundle(*bundleDir); err != nil {
+				log.Fatalf("Failed to write bundle: %v", err)
+			}
+			fmt.Printf("Generated key, %s and %s written to %s\n", config.BundleClientFile, config.BundleServerFile, *bundleDir)
+			fmt.Println("\nCopy the key and client.toml securely to the client (adjusting key-file if the path differs) and run each side with -config.")
+			return
+		}
+
+		if *keyOut != "" {
+			if err := crypto.WriteKeyFile(*keyOut, key); err != nil {
+				log.Fatalf("Failed to write key: %v", err)
+			}
+			fmt.Printf("Generated encryption key written to %s\n", *keyOut)
+			fmt.Println("\nCopy this file securely and use it with -key-file on both client and server.")
+			if provision.KeyFile, err = filepath.Abs(*keyOut); err != nil {
+				log.Fatalf("Failed to resolve key path: %v", err)
+			}
+		} else {
+			fmt.Printf("Generated encryption key:\n%s\n", hex.EncodeToString(key))
+			fmt.Println("\nSave this key securely and use it on both client and server.")
+		}
+
+		// Print a client config ready to paste into a file
+		if *serverDomain != "" {
+			fmt.Printf("\nClient config:\n\n%s", config.Format("", provision.ClientOptions()))
+		}
 		return
 	}
 
 	// Handle service installation/uninstallation
 	if *installSvc {
-		if err := service.Install("dns-as-doh-client", "DNS-as-DoH Client", os.Args[1:]); err != nil {
+		// Keep the options, including the key, in a private config file
+		// rather than on the service command line
+		configPath := service.GetConfigPath(serviceName)
+		if err := config.Write(configPath, flag.CommandLine, "Generated by -install for service "+serviceName, serviceOnlyFlags...); err != nil {
+			log.Fatalf("Failed to write service config: %v", err)
+		}
+		fmt.Printf("Config written to %s\n", configPath)
+
+		// Files the client writes, which the service sandbox must allow
+		writable := []string{*anchorState, *history, *auditFile}
+		if *ctrlSocket != "off" {
+			writable = append(writable, *ctrlSocket)
+		}
+		if err := service.Install(serviceName, service.InstanceDisplayName("DNS-as-DoH Client", *instance),
+			service.InstanceArgs(configPath, *instance), writable); err != nil {
 			log.Fatalf("Failed to install service: %v", err)
 		}
 		fmt.Println("Service installed successfully")
@@ -84,77 +243,238 @@ func main() {
 	}
 
 	if *uninstallSvc {
-		if err := service.Uninstall("dns-as-doh-client"); err != nil {
+		if err := service.Uninstall(serviceName); err != nil {
 			log.Fatalf("Failed to uninstall service: %v", err)
 		}
 		fmt.Println("Service uninstalled successfully")
 		return
 	}
 
-	// Validate required arguments
-	if *serverDomain == "" {
-		log.Fatal("Server domain is required (-domain)")
-	}
+	// buildConfig builds the client configuration from the flags
+	buildConfig := func() (*client.Config, error) {
+		// Validate required arguments
+		if *serverDomain == "" {
+			return nil, fmt.Errorf("server domain is required (-domain)")
+		}
+
+		// Load encryption key
+		var key []byte
+		var err error
 
-	// Load encryption key
-	var key []byte
-	var err error
+		if *keyFile != "" {
+			key, err = crypto.ReadKeyFile(*keyFile, *insecureKey)
+			if err != nil {
+				return nil, err
+			}
+		} else if *keyHex != "" {
+			key, err = hex.DecodeString(*keyHex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key format: %w", err)
+			}
+		} else {
+			return nil, fmt.Errorf("encryption key is required (-key or -key-file)")
+		}
 
-	if *keyFile != "" {
-		keyData, err := os.ReadFile(*keyFile)
+		if len(key) != crypto.KeySize {
+			return nil, fmt.Errorf("key must be %d bytes (%d hex characters)", crypto.KeySize, crypto.KeySize*2)
+		}
+
+		if *keyID > 0xffff {
+			return nil, fmt.Errorf("key ID must be between 0 and 65535")
+		}
+
+		stealthLevel, err := dns.ParseStealthLevel(*stealth)
 		if err != nil {
-			log.Fatalf("Failed to read key file: %v", err)
+			return nil, err
 		}
-		key, err = hex.DecodeString(strings.TrimSpace(string(keyData)))
+
+		codec, err := dns.ParseCodec(*maxCodec)
 		if err != nil {
-			log.Fatalf("Invalid key in file: %v", err)
+			return nil, err
 		}
-	} else if *keyHex != "" {
-		key, err = hex.DecodeString(*keyHex)
+
+		resolverStrategy, err := client.ParseStrategy(*strategy)
 		if err != nil {
-			log.Fatalf("Invalid key format: %v", err)
+			return nil, err
 		}
-	} else {
-		log.Fatal("Encryption key is required (-key or -key-file)")
+
+		power, err := client.ParsePowerPolicy(*powerPolicy)
+		if err != nil {
+			return nil, err
+		}
+
+		extraListeners, err := client.ParseListeners(*listeners)
+		if err != nil {
+			return nil, err
+		}
+
+		var directDomains []dns.Name
+		for _, item := range strings.Split(*directDoms, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			domain, err := dns.ParseName(strings.TrimPrefix(item, "*."))
+			if err != nil || len(domain) == 0 {
+				return nil, fmt.Errorf("invalid direct domain %q", item)
+			}
+			directDomains = append(directDomains, domain)
+		}
+
+		var rules []client.DirectRule
+		if *directRules != "" {
+			if rules, err = client.ReadDirectRules(*directRules); err != nil {
+				return nil, err
+			}
+		}
+
+		var directResolvers []string
+		if *directRes != "" {
+			directResolvers = splitList(*directRes)
+		}
+
+		var profiles []client.NetworkProfile
+		if *profileFile != "" {
+			if profiles, err = client.ReadProfiles(*profileFile); err != nil {
+				return nil, err
+			}
+		}
+
+		if *upstreamHint != "" {
+			if err := dns.CheckUpstreamName(*upstreamHint); err != nil {
+				return nil, fmt.Errorf("invalid upstream hint: %w", err)
+			}
+		}
+
+		dohAllowlist, err := listener.ParseAllowlist(*dohAllow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -doh-allow: %w", err)
+		}
+
+		dotAllowlist, err := listener.ParseAllowlist(*dotAllow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -dot-allow: %w", err)
+		}
+
+		var anchors []dnssec.TrustAnchor
+		if *anchorFile != "" {
+			anchors, err = dnssec.LoadTrustAnchors(*anchorFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load trust anchors: %w", err)
+			}
+		}
+
+		// Parse resolvers
+		resolverList := splitList(*resolvers)
+
+		return &client.Config{
+			ListenAddr:          *listenAddr,
+			ServerDomain:        *serverDomain,
+			Resolvers:           resolverList,
+			SharedSecret:        key,
+			KeyID:               uint16(*keyID),
+			Timeout:             *timeout,
+			HealthCheckInterval: *healthCheck,
+			ResolverStrategy:    resolverStrategy,
+			SendJitter:          *sendJitter,
+			MaxConcurrent:       100,
+			TunnelConcurrency:   *tunnelConc,
+			CacheSize:           *cacheSize,
+			Handshake:           *handshake,
+			SessionFile:         *sessionFile,
+			DrainTimeout:        *drainTimeout,
+			StealthLevel:        stealthLevel,
+			CaseRandomization:   *random0x20,
+			DNSSEC:              *dnssecFlag,
+			TrustAnchors:        anchors,
+			TrustAnchorState:    *anchorState,
+			ResolverHistory:     *history,
+			DirectDomains:       directDomains,
+			DirectRules:         rules,
+			DirectResolvers:     directResolvers,
+			DirectPrivatePTR:    *directPTR,
+			DirectFallback:      *fallback,
+			Profiles:            profiles,
+			SocksAddr:           *socksAddr,
+			DoHAddr:             *dohAddr,
+			DoHCert:             *dohCert,
+			DoHKey:              *dohKey,
+			DoHAllow:            dohAllowlist,
+			DoTAddr:             *dotAddr,
+			DoTCert:             *dotCert,
+			DoTKey:              *dotKey,
+			DoTAllow:            dotAllowlist,
+			ExportInterface:     *exportIface,
+			StartupChecks:       *startChecks,
+			PowerPolicy:         power,
+			PathDiscovery:       *pathDiscover,
+			MaxCodec:            codec,
+			Compression:         *compress,
+			TraceLog:            *traceLog,
+			TraceLogSample:      *traceSample,
+			UpstreamHint:        *upstreamHint,
+			Listeners:           extraListeners,
+			AlertWebhook:        *alertHook,
+			AlertFormat:         *alertFormat,
+			AlertInterval:       *alertEvery,
+		}, nil
+	}
+
+	// Create config
+	config, err := buildConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	if len(key) != crypto.KeySize {
-		log.Fatalf("Key must be %d bytes (%d hex characters)", crypto.KeySize, crypto.KeySize*2)
+	if *check {
+		os.Exit(runCheck(config))
+	}
+	if simulate {
+		os.Exit(runSimulate(config, simulateOpts))
 	}
 
-	// Parse resolvers
-	resolverList := strings.Split(*resolvers, ",")
-	for i, r := range resolverList {
-		resolverList[i] = strings.TrimSpace(r)
+	// reload re-reads the config file and rebuilds the configuration
+	reload := func() (*client.Config, error) {
+		if loader != nil {
+			if err := loader.Load(); err != nil {
+				return nil, err
+			}
+		}
+		return buildConfig()
 	}
 
-	// Create config
-	config := &client.Config{
-		ListenAddr:    *listenAddr,
-		ServerDomain:  *serverDomain,
-		Resolvers:     resolverList,
-		SharedSecret:  key,
-		Timeout:       *timeout,
-		MaxConcurrent: 100,
+	// Open audit log
+	auditLog, err := openAuditLog(*auditFile)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+
+	// Control socket for the status command
+	controlPath := *ctrlSocket
+	switch controlPath {
+	case "":
+		controlPath = service.ControlSocketPath(serviceName)
+	case "off":
+		controlPath = ""
 	}
 
 	// Run as service or standalone
 	if *runSvc {
-		if err := service.Run("dns-as-doh-client", func() error {
-			return runClient(config)
+		if err := service.Run(serviceName, func() error {
+			return runClient(config, reload, auditLog, controlPath)
 		}, func() {
 			// Stop handler - will be handled by signal
 		}); err != nil {
 			log.Fatalf("Service error: %v", err)
 		}
 	} else {
-		if err := runClient(config); err != nil {
+		if err := runClient(config, reload, auditLog, controlPath); err != nil {
 			log.Fatalf("Client error: %v", err)
 		}
 	}
 }
 
-func runClient(config *client.Config) error {
+func runClient(config *client.Config, reload func() (*client.Config, error), auditLog *audit.Log, controlPath string) error {
 	// Create resolver
 	resolver, err := client.NewResolver(config)
 	if err != nil {
@@ -166,18 +486,62 @@ func runClient(config *client.Config) error {
 		return fmt.Errorf("failed to start resolver: %w", err)
 	}
 
+	// A client without a control socket still resolves, so failing to
+	// create one isn't fatal
+	if controlPath != "" {
+		control, err := client.NewControlServer(resolver, controlPath)
+		if err != nil {
+			log.Printf("Status command unavailable: %v", err)
+		} else {
+			defer control.Close()
+		}
+	}
+
 	log.Println("DNS tunnel client started")
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal, reloading the configuration on SIGHUP
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	sig := <-sigCh
+	for sig == syscall.SIGHUP {
+		newConfig, err := reload()
+		if err != nil {
+			log.Printf("Reload failed: %v", err)
+		} else {
+			resolver.Reload(newConfig)
+			_ = auditLog.Record("SIGHUP", audit.ActionConfigReload, "")
+			config = newConfig
+			log.Println("Configuration reloaded")
+		}
+		sig = <-sigCh
+	}
 	log.Printf("Received signal %v, shutting down...", sig)
 
-	// Stop resolver
-	resolver.Stop()
+	// Stop accepting queries and let in-flight ones finish
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	if err := resolver.Shutdown(ctx); err != nil {
+		log.Printf("Drain timeout exceeded, in-flight queries aborted")
+	}
 
 	log.Println("Client stopped")
 	return nil
 }
+
+// openAuditLog opens the audit log, or returns nil if no path is set.
+func openAuditLog(path string) (*audit.Log, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return audit.Open(path)
+}
+
+// splitList splits a comma-separated flag value, trimming spaces.
+func splitList(s string) []string {
+	list := strings.Split(s, ",")
+	for i, item := range list {
+		list[i] = strings.TrimSpace(item)
+	}
+	return list
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/client"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// simulateOptions are the options of the simulate command, on top of the
+// client's.
+type simulateOptions struct {
+	input       *string
+	concurrency *int
+	rrType      *string
+	asJSON      *bool
+}
+
+// simulateFlags registers the options of the simulate command.
+func simulateFlags(fs *flag.FlagSet) *simulateOptions {
+	return &simulateOptions{
+		input:       fs.String("input", "-", "File of lookups to replay: a HAR capture or a text list of names, each optionally followed by a type (- for standard input)"),
+		concurrency: fs.Int("concurrency", 10, "Number of lookups in flight at a time"),
+		rrType:      fs.String("type", "A", "Type of lookups the input doesn't give one for"),
+		asJSON:      fs.Bool("json", false, "Print the report as JSON"),
+	}
+}
+
+// runSimulate implements the simulate command: it replays the lookups of
+// the input through the tunnel, prints the report and returns the exit
+// code, 0 if every lookup was answered. Interrupting it reports the
+// lookups replayed so far.
+func runSimulate(config *client.Config, opts *simulateOptions) int {
+	defaultType, err := dns.ParseType(*opts.rrType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -type: %v\n", err)
+		return 1
+	}
+
+	in := os.Stdin
+	if *opts.input != "-" {
+		f, err := os.Open(*opts.input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open lookups: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	lookups, err := client.ReadLookups(in, defaultType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if len(lookups) == 0 {
+		fmt.Fprintf(os.Stderr, "No lookups to replay\n")
+		return 1
+	}
+
+	resolver, err := client.NewResolver(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create resolver: %v\n", err)
+		return 1
+	}
+	defer resolver.Stop()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if config.PathDiscovery {
+		discoverCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		err := resolver.DiscoverPaths(discoverCtx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Path discovery failed: %v\n", err)
+		}
+	}
+
+	report := resolver.Simulate(ctx, lookups, *opts.concurrency)
+	if *opts.asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		printSimulation(os.Stdout, *opts.concurrency, report)
+	}
+
+	if report.Failed > 0 || report.Lookups < len(lookups) {
+		return 1
+	}
+	return 0
+}
+
+// printSimulation writes a simulation report in a human-readable form.
+func printSimulation(w io.Writer, concurrency int, s *client.SimulationReport) {
+	fmt.Fprintf(w, "Lookups:     %d (concurrency %d)\n", s.Lookups, concurrency)
+	fmt.Fprintf(w, "Answered:    %d\n", s.Answered)
+	fmt.Fprintf(w, "Failed:      %d\n", s.Failed)
+	fmt.Fprintf(w, "Duration:    %s\n", s.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "Throughput:  %.1f lookups/s\n", s.Throughput())
+	if s.Answered > 0 {
+		fmt.Fprintf(w, "Latency:     p50 %s, p95 %s, p99 %s\n",
+			s.P50.Round(time.Millisecond), s.P95.Round(time.Millisecond), s.P99.Round(time.Millisecond))
+	}
+
+	printCounts(w, "RCODE", s.Rcodes)
+	printCounts(w, "FAILURE", s.Failures)
+}
+
+// printCounts writes a table of counts, largest first.
+func printCounts(w io.Writer, heading string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b string) int {
+		return cmp.Or(counts[b]-counts[a], strings.Compare(a, b))
+	})
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tCOUNT\n", heading)
+	for _, key := range keys {
+		fmt.Fprintf(tw, "%s\t%d\n", key, counts[key])
+	}
+	tw.Flush()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/client"
+	"github.com/AliRezaBeigy/dns-as-doh/pkg/service"
+)
+
+// runStatus implements the status command: it prints the state of the
+// running client and returns the exit code, 0 if the tunnel is healthy.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	instance := fs.String("instance", "", "Service instance name of the client")
+	socket := fs.String("control-socket", "", "Control socket of the client (default: that of the instance)")
+	asJSON := fs.Bool("json", false, "Print the status as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n  %s status [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints tunnel health, resolver latencies, cache use and recent errors of the running client.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	path, err := controlSocketPath(*socket, *instance)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid instance: %v\n", err)
+		return 1
+	}
+
+	status, err := client.QueryStatus(context.Background(), path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status)
+	} else {
+		printStatus(os.Stdout, status, time.Now())
+	}
+
+	if !status.Healthy() {
+		return 1
+	}
+	return 0
+}
+
+// controlSocketPath returns the control socket path: the one given, or the
+// default of the instance's service.
+func controlSocketPath(path, instance string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	serviceName, err := service.InstanceName("dns-as-doh-client", instance)
+	if err != nil {
+		return "", err
+	}
+	return service.ControlSocketPath(serviceName), nil
+}
+
+// printStatus writes the status in a human-readable form.
+func printStatus(w io.Writer, s *client.Status, now time.Time) {
+	ago := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return now.Sub(t).Round(time.Second).String() + " ago"
+	}
+
+	health := "healthy"
+	if s.KeyRejected != "" {
+		health = "key rejected"
+	} else if !s.Healthy() {
+		health = "failing"
+	}
+	fmt.Fprintf(w, "Tunnel:   %s (last success %s, last failure %s)\n", health, ago(s.LastSuccess), ago(s.LastFailure))
+	fmt.Fprintf(w, "Server:   %s\n", s.ServerDomain)
+	fmt.Fprintf(w, "Uptime:   %s\n", now.Sub(s.Started).Round(time.Second))
+	if s.KeyRejected != "" {
+		fmt.Fprintf(w, "Key:      refused by the server (%s); get a new key from its operator\n", s.KeyRejected)
+	}
+	if s.DirectFallback {
+		fmt.Fprintf(w, "Fallback: resolving directly in cleartext until the tunnel works again (%d queries so far)\n", s.DirectQueries)
+	}
+	if s.Session {
+		fmt.Fprintf(w, "Session:  established\n")
+	}
+	fmt.Fprintf(w, "Queries:  %d through the tunnel, %d failed\n", s.TunnelQueries, s.TunnelFailures)
+	fmt.Fprintf(w, "Streams:  %d open\n", s.Streams)
+	if s.PowerSaving {
+		fmt.Fprintf(w, "Power:    saving, background queries are less frequent\n")
+	}
+	if c := s.Cache; c != nil {
+		hitRate := 0.0
+		if lookups := c.Hits + c.Misses; lookups > 0 {
+			hitRate = 100 * float64(c.Hits) / float64(lookups)
+		}
+		fmt.Fprintf(w, "Cache:    %d of %d entries, %d hits, %d misses (%.0f%% hit rate)\n", c.Entries, c.Size, c.Hits, c.Misses, hitRate)
+	} else {
+		fmt.Fprintf(w, "Cache:    disabled\n")
+	}
+
+	fmt.Fprintf(w, "\nResolvers:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  ADDRESS\tLATENCY\tQUERIES\tFAILURES\tSTATE\n")
+	for _, r := range s.Resolvers {
+		state := "ok"
+		if r.Quarantined {
+			state = "quarantined"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%d\t%d\t%s\n", r.Address, r.Latency.Round(time.Millisecond), r.Queries, r.Failures, state)
+	}
+	tw.Flush()
+
+	if len(s.RecentErrors) > 0 {
+		fmt.Fprintf(w, "\nRecent errors:\n")
+		for i := len(s.RecentErrors) - 1; i >= 0; i-- {
+			e := s.RecentErrors[i]
+			fmt.Fprintf(w, "  %s  %s\n", e.Time.Local().Format(time.DateTime), e.Message)
+		}
+	}
+}
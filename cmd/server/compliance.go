@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/server"
+)
+
+// runCompliance implements the compliance command: it checks that the
+// server at an address answers like an ordinary authoritative server,
+// prints a report and returns the exit code, 0 if every check passed.
+func runCompliance(args []string) int {
+	fs := flag.NewFlagSet("compliance", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:53", "Address of the server to check")
+	domain := fs.String("domain", "", "Domain the server is authoritative for (e.g., t.example.com)")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout of each query")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n  %s compliance -domain t.example.com [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Checks that the server handles EDNS, unknown types, name case and truncation like an ordinary authoritative server.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if *domain == "" {
+		fmt.Fprintf(os.Stderr, "Domain is required (-domain)\n")
+		return 1
+	}
+
+	report, err := server.CheckCompliance(context.Background(), *addr, *domain, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	printCompliance(os.Stdout, *addr, report)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// printCompliance writes a compliance report in a human-readable form.
+func printCompliance(w io.Writer, addr string, r *server.ComplianceReport) {
+	fmt.Fprintf(w, "Server: %s\n\n", addr)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "CHECK\tRESULT\n")
+	failed := 0
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			fmt.Fprintf(tw, "%s\tfailed: %v\n", c.Name, c.Err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tok\n", c.Name)
+	}
+	tw.Flush()
+
+	if failed > 0 {
+		fmt.Fprintf(w, "\n%d of %d checks failed. Resolvers and scanners may tell the server apart from an ordinary authoritative server.\n", failed, len(r.Checks))
+	}
+}
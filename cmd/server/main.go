@@ -4,20 +4,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/AliRezaBeigy/dns-as-doh/internal/alert"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/audit"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/listener"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/server"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+	"github.com/AliRezaBeigy/dns-as-doh/pkg/config"
 	"github.com/AliRezaBeigy/dns-as-doh/pkg/service"
 )
 
+// serviceOnlyFlags are flags not written to the service config file.
+var serviceOnlyFlags = []string{"config", "instance", "install", "uninstall", "service", "firewall", "gen-key", "out", "bundle", "version"}
+
 var (
 	version = "dev"
 	commit  = "none"
@@ -25,27 +41,105 @@ var (
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "compliance" {
+		os.Exit(runCompliance(os.Args[2:]))
+	}
+
 	// Parse flags
 	var (
 		listenAddr   = flag.String("listen", ":53", "Address to listen for DNS queries")
 		domain       = flag.String("domain", "", "Domain this server is authoritative for (e.g., t.example.com)")
-		upstream     = flag.String("upstream", "8.8.8.8:53", "Upstream DNS resolver (UDP: 8.8.8.8:53, DoH: https://dns.google/dns-query, DoT: dns.google:853)")
+		upstream     = flag.String("upstream", "8.8.8.8:53", "Upstream DNS resolver (UDP: 8.8.8.8:53, DoH: https://dns.google/dns-query, DoH JSON: https://dns.google/resolve, DoT: dns.google:853, or iterative to resolve from the root servers); a comma-separated list makes a pool, the first preferred")
 		keyHex       = flag.String("key", "", "Encryption key (64 hex characters)")
 		keyFile      = flag.String("key-file", "", "File containing the encryption key")
+		prevKeyFiles = flag.String("previous-key-files", "", "Comma-separated key files still accepted during key rotation, newest first")
+		revocations  = flag.String("revocation-file", "", "File of revoked client key IDs, one per line, re-read when it changes")
+		clientKeys   = flag.String("client-keys-file", "", "File of per-client keys, one \"<key ID> <hex key> [until=<date>] [hours=<HH:MM-HH:MM>]\" per line")
+		insecureKey  = flag.Bool("insecure-key-perms", false, "Allow a key file readable by group or others")
 		maxUDPSize   = flag.Int("mtu", 1232, "Maximum UDP payload size")
+		acceptNoEDNS = flag.Bool("accept-no-edns", false, "Accept tunnel queries without EDNS, from stubs and resolvers that strip it, fragmenting replies to them over UDP to fit 512 bytes")
 		responseTTL  = flag.Uint("ttl", 60, "Response TTL in seconds")
-		rateLimit    = flag.Int("rate-limit", 100, "Per-IP rate limit (queries per second)")
+		zoneFile     = flag.String("zone-file", "", "File of static A, AAAA, NS, SOA and TXT records for names in the domain, in zone file format")
+		negativeTTL  = flag.Uint("negative-ttl", server.DefaultNegativeTTL, "TTL in seconds of NXDOMAIN answers for names in the zone that aren't tunnel queries")
+		rateLimit    = flag.Int("rate-limit", 100, "Queries per second from each client network (0 disables)")
+		rateBurst    = flag.Int("rate-burst", 0, "Queries a client network may send at once (0 allows one second's worth)")
+		rateV4Prefix = flag.Int("rate-limit-ipv4-prefix", server.DefaultRateLimitIPv4Prefix, "Prefix length grouping IPv4 clients into networks for the rate limits, e.g. 24 for clients behind CGNAT")
+		rateV6Prefix = flag.Int("rate-limit-ipv6-prefix", server.DefaultRateLimitIPv6Prefix, "Prefix length grouping IPv6 clients into networks for the rate limits")
+		failureLimit = flag.Int("failure-rate-limit", server.DefaultFailureRateLimit, "Queries per second that fail to decrypt or aren't tunnel traffic a client network may send before all its queries are dropped (0 disables)")
+		maxClients   = flag.Int("max-clients", server.DefaultMaxClients, "Maximum number of clients tracked at once; new clients are refused beyond it")
+		maxGorout    = flag.Int("max-goroutines", server.DefaultMaxGoroutines, "Number of goroutines above which queries are shed until the load drops (0 disables)")
+		maxMemory    = flag.Int("max-memory", server.DefaultMaxMemory>>20, "Estimated MiB held by queued fragments, queries, streams and sessions above which queries are shed until the load drops (0 disables)")
+		clientConc   = flag.Int("max-client-concurrent", server.DefaultMaxClientConcurrent, "Queries one client may have resolving at once (0 disables)")
+		maxQPS       = flag.Int("max-qps", 0, "Tunnel queries per second accepted from all clients together (0 disables)")
+		overLimit    = flag.String("over-limit", server.OverLimitServFail, "What to do with queries over -max-client-concurrent or -max-qps: servfail (asks the client to retry) or drop")
+		rrlLimit     = flag.Int("rrl-limit", server.DefaultRRLLimit, "Error responses per second to a UDP client network (0 disables response rate limiting)")
+		rrlAmp       = flag.Int("rrl-amplification", server.DefaultRRLAmplification, "Ratio of response to query bytes per second a UDP client network may receive for non-tunnel queries beyond 1232 bytes (0 disables)")
+		rrlSlip      = flag.Int("rrl-slip", server.DefaultRRLSlip, "Answer every Nth rate limited response truncated instead of dropping it (0 drops all)")
+		challenge    = flag.Int("challenge-errors", server.DefaultChallengeThreshold, "Error responses per minute after which UDP client networks without valid tunnel traffic must retry over TCP (0 disables)")
+		cookies      = flag.Bool("cookies", true, "Answer DNS cookies (RFC 7873), letting sources with a valid server cookie skip source validation")
+		cookieSecret = flag.String("cookie-secret", "", "Hex secret of at least 16 bytes server cookies are derived from, shared by instances behind one address (default: random)")
+		drainTimeout = flag.Duration("drain-timeout", server.DefaultDrainTimeout, "How long to wait for in-flight queries on shutdown")
+		clusterAddr  = flag.String("cluster-listen", "", "UDP address to share replay and session state with other server instances on (e.g. :5353)")
+		clusterPeers = flag.String("cluster-peers", "", "Comma-separated cluster addresses of the other server instances")
+		clusterKey   = flag.String("cluster-key-file", "", "File containing the key cluster instances share state with, distinct from the client keys (required with -cluster-listen)")
+		instLabel    = flag.String("instance-label", "", "Label of a subdomain delegated to this instance alone (e.g. ns1-a), sent to clients so their sessions stick to it")
+		streams      = flag.Bool("streams", false, "Let clients tunnel TCP connections, e.g. from the client's SOCKS5 proxy")
+		streamsPriv  = flag.Bool("streams-private", false, "Let streams reach loopback, private and link-local addresses")
+		maintenance  = flag.Bool("maintenance", false, "Start in maintenance mode: refuse new sessions and streams but keep serving existing ones and the zone's records (SIGUSR1 toggles it)")
+		stateFile    = flag.String("state-file", "", "File to keep sessions, client accounting and revocations in across restarts (default: memory only)")
+		stateBackend = flag.String("state-backend", storage.BackendFile, "How the state file is kept: file (a journal loaded into memory) or bolt (a bbolt database written on each change)")
+		listenTCP    = flag.Bool("tcp", true, "Also serve DNS over TCP on the listen address")
+		fallbacks    = flag.String("fallback-upstream", "", "Comma-separated fallback upstreams, tried in order when the upstream fails")
+		upStrategy   = flag.String("upstream-strategy", server.UpstreamFailover, "How queries are spread over the upstream pool and fallbacks: failover (in order) or balance (in turn)")
+		upHealth     = flag.Duration("upstream-health-interval", server.DefaultUpstreamHealthInterval, "How often each upstream of a pool is probed, so those that are down are tried last (0 disables)")
+		failoverRc   = flag.String("failover-rcodes", "", "Comma-separated upstream rcodes treated as failures (e.g., REFUSED,NXDOMAIN)")
+		forwardEDNS  = flag.String("forward-edns-options", "", "Comma-separated EDNS options of tunneled queries forwarded upstream (e.g., ECS,COOKIE); all others are stripped")
+		upstreamEDNS = flag.String("upstream-edns-size", "", "UDP payload size tunneled queries advertise upstream, instead of the client's: a size for all upstreams and/or upstream=size pairs, comma-separated (e.g., 1232,9.9.9.9:53=4096)")
+		upstream0x20 = flag.Bool("upstream-0x20", false, "Send query names to UDP and iterative upstreams in random case (DNS 0x20) and reject answers that don't echo it")
+		qnameMin     = flag.Bool("qname-minimization", true, "With -upstream iterative, send each zone only the labels it needs (RFC 9156)")
+		rootHints    = flag.String("root-hints", "", "Comma-separated root server addresses for -upstream iterative (default: the IANA root servers)")
+		rawPassthru  = flag.Bool("raw-passthrough", false, "Relay upstream responses byte for byte, preserving DNSSEC signatures and unknown record types")
+		compress     = flag.Bool("compress", true, "Compress replies to clients that support it when that makes them smaller")
+		traceLog     = flag.Bool("trace-log", false, "Log every tunneled query that carries a client's trace ID, for debugging with the client's -trace-log (logs query names)")
+		traceSample  = flag.Int("trace-log-sample", 1, "With -trace-log, log only 1 in N successful queries (failures are always logged)")
+		latSample    = flag.Int("latency-sample", 1, "Record the latency of only 1 in N successful upstream queries for the upstream latency statistics")
+		namedUp      = flag.String("named-upstreams", "", "Comma-separated name=upstream pairs (same formats as -upstream) clients may ask for per query, subject to their key's upstreams= policy (e.g., eu=https://dns.example.eu/dns-query)")
+		upRoutes     = flag.String("upstream-routes", "", "File routing domains to their own upstreams, one \"domain upstream\" line each (same formats as -upstream), e.g. for split-horizon names")
+		blocklists   = flag.String("blocklist", "", "Comma-separated files of names to block, in hosts-file or domain-list format, re-read when they change")
+		allowlists   = flag.String("allowlist", "", "Comma-separated files of names never blocked (same formats as -blocklist)")
+		sinkhole     = flag.String("blocklist-sinkhole", "", "Comma-separated addresses to answer A and AAAA queries for blocked names with, instead of NXDOMAIN (e.g., 0.0.0.0,::)")
+		consensusUp  = flag.String("consensus-upstream", "", "Second upstream (same format as -fallback-upstream) asked every query; answers are only relayed if both upstreams agree or one validated its answer with DNSSEC")
+		auditUp      = flag.String("audit-upstream", "", "Independent upstream (same format as -fallback-upstream) to re-resolve a sample of answered queries against, flagging upstreams that censor or poison answers")
+		auditSample  = flag.Int("audit-sample", server.DefaultAuditSample, "With -audit-upstream, re-resolve 1 in N answered queries")
+		topReports   = flag.Bool("top-reports", false, "Count queries per domain and traffic per client for daily reports of the busiest, served by the admin API (keeps query domains in memory)")
+		topN         = flag.Int("top-n", server.DefaultTopN, "Number of domains and clients in each top report list")
+		topFile      = flag.String("top-report-file", "", "With -top-reports, file to append each day's report to as a line of JSON")
+		alertHook    = flag.String("alert-webhook", "", "URL to post alerts to: key mismatches, exceeded rate and client limits, upstream outages")
+		alertFormat  = flag.String("alert-format", alert.FormatGeneric, "Body format of -alert-webhook: generic (JSON), slack or discord")
+		alertEvery   = flag.Duration("alert-interval", alert.DefaultInterval, "Minimum time between two alerts of the same kind")
+		startChecks  = flag.Bool("startup-checks", true, "Check at startup that the upstream answers, and exit with an explanation if not")
+		configFile   = flag.String("config", "", "Config file with options (TOML, keys are flag names)")
 		showVersion  = flag.Bool("version", false, "Show version information")
 		genKey       = flag.Bool("gen-key", false, "Generate a new encryption key")
+		keyOut       = flag.String("out", "", "With -gen-key, write the key to this file (mode 0600)")
+		bundleDir    = flag.String("bundle", "", "With -gen-key, write the key and matching client.toml and server.toml to this directory (requires -domain)")
 		installSvc   = flag.Bool("install", false, "Install as system service")
+		firewall     = flag.Bool("firewall", false, "With -install, add inbound firewall rules for the listen port (Windows)")
 		uninstallSvc = flag.Bool("uninstall", false, "Uninstall system service")
 		runSvc       = flag.Bool("service", false, "Run as system service")
+		instance     = flag.String("instance", "", "Service instance name, for running several named services")
+		auditFile    = flag.String("audit-log", "", "File to append administrative actions to")
+		adminAddr    = flag.String("admin-addr", "", "Address for the admin HTTP API (e.g. 127.0.0.1:8053; empty disables it)")
+		adminToken   = flag.String("admin-token", "", "Bearer token required by the admin API (default: the DNS_AS_DOH_TOKEN environment variable)")
+		adminAllow   = flag.String("admin-allow", "", "Comma-separated client addresses and networks allowed to use the admin API (default: loopback only)")
 	)
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "DNS-as-DoH Server - DNS tunnel server\n\n")
 		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s compliance -domain t.example.com [-addr 127.0.0.1:53]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nUpstream resolver formats:\n")
@@ -59,6 +153,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s -domain t.example.com -key <hex-key>\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Run server with DoH upstream\n")
 		fmt.Fprintf(os.Stderr, "  %s -domain t.example.com -key <hex-key> -upstream https://dns.google/dns-query\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Check that the running server answers like an authoritative server\n")
+		fmt.Fprintf(os.Stderr, "  %s compliance -domain t.example.com\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "DNS Zone Setup:\n")
 		fmt.Fprintf(os.Stderr, "  A     tns.example.com  → <server-ip>\n")
 		fmt.Fprintf(os.Stderr, "  AAAA  tns.example.com  → <server-ipv6>\n")
@@ -67,6 +163,26 @@ func main() {
 
 	flag.Parse()
 
+	// Resolve the service name of this instance
+	serviceName, err := service.InstanceName("dns-as-doh-server", *instance)
+	if err != nil {
+		log.Fatalf("Invalid instance: %v", err)
+	}
+
+	// Named instances default to their own config file
+	if *configFile == "" && *instance != "" {
+		*configFile = service.InstanceConfigPath(serviceName)
+	}
+
+	// Load config file, command line flags take precedence
+	var loader *config.Loader
+	if *configFile != "" {
+		loader = config.NewLoader(flag.CommandLine, *configFile, "config")
+		if err := loader.Load(); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
 	// Handle version
 	if *showVersion {
 		fmt.Printf("dns-as-doh-server %s (%s) built %s\n", version, commit, date)
@@ -79,118 +195,531 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to generate key: %v", err)
 		}
-		fmt.Printf("Generated encryption key:\n%s\n", hex.EncodeToString(key))
-		fmt.Println("\nSave this key securely and use it on both client and server.")
+		provision := &config.Provision{
+			Domain:   *domain,
+			Key:      hex.EncodeToString(key),
+			Upstream: *upstream,
+		}
+
+		if *bundleDir != "" {
+			if *domain == "" {
+				log.Fatalf("-bundle requires -domain")
+			}
+			if err := os.MkdirAll(*bundleDir, 0700); err != nil {
+				log.Fatalf("Failed to create bundle directory: %v", err)
+			}
+			if err := crypto.WriteKeyFile(filepath.Join(*bundleDir, config.BundleKeyFile), key); err != nil {
+				log.Fatalf("Failed to write key: %v", err)
+			}
+			if err := provision.WriteBundle(*bundleDir); err != nil {
+				log.Fatalf("Failed to write bundle: %v", err)
+			}
+			fmt.Printf("Generated key, %s and %s written to %s\n", config.BundleClientFile, config.BundleServerFile, *bundleDir)
+			fmt.Println("\nCopy the key and client.toml securely to the client (adjusting key-file if the path differs) and run each side with -config.")
+			return
+		}
+
+		if *keyOut != "" {
+			if err := crypto.WriteKeyFile(*keyOut, key); err != nil {
+				log.Fatalf("Failed to write key: %v", err)
+			}
+			fmt.Printf("Generated encryption key written to %s\n", *keyOut)
+			fmt.Println("\nCopy this file securely and use it with -key-file on both client and server.")
+			if provision.KeyFile, err = filepath.Abs(*keyOut); err != nil {
+				log.Fatalf("Failed to resolve key path: %v", err)
+			}
+		} else {
+			fmt.Printf("Generated encryption key:\n%s\n", hex.EncodeToString(key))
+			fmt.Println("\nSave this key securely and use it on both client and server.")
+		}
+
+		// Print a client config ready to paste into a file
+		if *domain != "" {
+			fmt.Printf("\nClient config:\n\n%s", config.Format("", provision.ClientOptions()))
+		}
 		return
 	}
 
 	// Handle service installation/uninstallation
 	if *installSvc {
-		if err := service.Install("dns-as-doh-server", "DNS-as-DoH Server", os.Args[1:]); err != nil {
+		// Keep the options, including the key, in a private config file
+		// rather than on the service command line
+		configPath := service.GetConfigPath(serviceName)
+		if err := config.Write(configPath, flag.CommandLine, "Generated by -install for service "+serviceName, serviceOnlyFlags...); err != nil {
+			log.Fatalf("Failed to write service config: %v", err)
+		}
+		fmt.Printf("Config written to %s\n", configPath)
+
+		// Files the server writes, which the service sandbox must allow
+		writable := []string{*stateFile, *topFile, *auditFile}
+		if err := service.Install(serviceName, service.InstanceDisplayName("DNS-as-DoH Server", *instance),
+			service.InstanceArgs(configPath, *instance), writable); err != nil {
 			log.Fatalf("Failed to install service: %v", err)
 		}
 		fmt.Println("Service installed successfully")
+
+		if *firewall {
+			if err := addFirewallRules(serviceName, *listenAddr, *listenTCP); err != nil {
+				log.Fatalf("Failed to add firewall rules: %v", err)
+			}
+			fmt.Println("Firewall rules added")
+		}
 		return
 	}
 
 	if *uninstallSvc {
-		if err := service.Uninstall("dns-as-doh-server"); err != nil {
+		if err := service.Uninstall(serviceName); err != nil {
 			log.Fatalf("Failed to uninstall service: %v", err)
 		}
 		fmt.Println("Service uninstalled successfully")
 		return
 	}
 
-	// Validate required arguments
-	if *domain == "" {
-		log.Fatal("Domain is required (-domain)")
-	}
+	// buildConfig builds the server configuration from the flags
+	buildConfig := func() (*server.Config, error) {
+		// Validate required arguments
+		if *domain == "" {
+			return nil, fmt.Errorf("domain is required (-domain)")
+		}
 
-	// Load encryption key
-	var key []byte
-	var err error
+		// Load encryption key
+		var key []byte
+		var err error
 
-	if *keyFile != "" {
-		keyData, err := os.ReadFile(*keyFile)
-		if err != nil {
-			log.Fatalf("Failed to read key file: %v", err)
+		if *keyFile != "" {
+			key, err = crypto.ReadKeyFile(*keyFile, *insecureKey)
+			if err != nil {
+				return nil, err
+			}
+		} else if *keyHex != "" {
+			key, err = hex.DecodeString(*keyHex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key format: %w", err)
+			}
+		} else {
+			return nil, fmt.Errorf("encryption key is required (-key or -key-file)")
 		}
-		key, err = hex.DecodeString(strings.TrimSpace(string(keyData)))
+
+		if len(key) != crypto.KeySize {
+			return nil, fmt.Errorf("key must be %d bytes (%d hex characters)", crypto.KeySize, crypto.KeySize*2)
+		}
+
+		// Load keys still accepted during rotation
+		var previousKeys [][]byte
+		for _, path := range strings.Split(*prevKeyFiles, ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			prev, err := crypto.ReadKeyFile(path, *insecureKey)
+			if err != nil {
+				return nil, err
+			}
+			if len(prev) != crypto.KeySize {
+				return nil, fmt.Errorf("key in %s must be %d bytes (%d hex characters)", path, crypto.KeySize, crypto.KeySize*2)
+			}
+			previousKeys = append(previousKeys, prev)
+		}
+
+		// Load per-client keys
+		var clientKeyMap map[uint16][]crypto.ClientKey
+		if *clientKeys != "" {
+			clientKeyMap, err = crypto.ReadClientKeysFile(*clientKeys, *insecureKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Load static zone records
+		var zoneRecords []dns.RR
+		if *zoneFile != "" {
+			zoneRecords, err = server.LoadZoneFile(*zoneFile, *domain)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Parse upstream configuration; upstreams after the first are
+		// tried before the fallbacks
+		var pool []string
+		for _, u := range strings.Split(*upstream, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				pool = append(pool, u)
+			}
+		}
+		if len(pool) == 0 {
+			return nil, fmt.Errorf("upstream is required")
+		}
+		upstreamAddr, upstreamType, err := server.ParseUpstreamConfig(pool[0])
 		if err != nil {
-			log.Fatalf("Invalid key in file: %v", err)
+			return nil, fmt.Errorf("invalid upstream configuration: %w", err)
 		}
-	} else if *keyHex != "" {
-		key, err = hex.DecodeString(*keyHex)
+
+		var rootHintList []string
+		for _, h := range strings.Split(*rootHints, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				rootHintList = append(rootHintList, h)
+			}
+		}
+
+		// Parse failover policy
+		fallbackUpstreams := pool[1:]
+		for _, fb := range strings.Split(*fallbacks, ",") {
+			if fb = strings.TrimSpace(fb); fb != "" {
+				fallbackUpstreams = append(fallbackUpstreams, fb)
+			}
+		}
+
+		var blocklistFiles, allowlistFiles []string
+		for _, path := range strings.Split(*blocklists, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				blocklistFiles = append(blocklistFiles, path)
+			}
+		}
+		for _, path := range strings.Split(*allowlists, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				allowlistFiles = append(allowlistFiles, path)
+			}
+		}
+		var sinkholeAddrs []netip.Addr
+		for _, s := range strings.Split(*sinkhole, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blocklist sinkhole: %w", err)
+			}
+			sinkholeAddrs = append(sinkholeAddrs, addr.Unmap())
+		}
+
+		var peerList []string
+		for _, p := range strings.Split(*clusterPeers, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				peerList = append(peerList, p)
+			}
+		}
+		if *clusterAddr != "" && len(peerList) == 0 {
+			return nil, fmt.Errorf("-cluster-listen requires -cluster-peers")
+		}
+		var clusterSecret []byte
+		if *clusterKey != "" {
+			clusterSecret, err = crypto.ReadKeyFile(*clusterKey, *insecureKey)
+			if err != nil {
+				return nil, err
+			}
+		} else if *clusterAddr != "" {
+			return nil, fmt.Errorf("-cluster-listen requires -cluster-key-file")
+		}
+
+		var failoverRcodes []uint16
+		for _, s := range strings.Split(*failoverRc, ",") {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			rcode, err := dns.ParseRcode(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid failover rcode: %w", err)
+			}
+			failoverRcodes = append(failoverRcodes, rcode)
+		}
+
+		namedUpstreams, err := server.ParseNamedUpstreams(*namedUp)
 		if err != nil {
-			log.Fatalf("Invalid key format: %v", err)
+			return nil, err
 		}
-	} else {
-		log.Fatal("Encryption key is required (-key or -key-file)")
+
+		var upstreamRoutes map[string]string
+		if *upRoutes != "" {
+			if upstreamRoutes, err = server.LoadUpstreamRoutes(*upRoutes); err != nil {
+				return nil, err
+			}
+		}
+
+		var cookieKey []byte
+		if *cookieSecret != "" {
+			if cookieKey, err = hex.DecodeString(*cookieSecret); err != nil {
+				return nil, fmt.Errorf("invalid cookie secret: %w", err)
+			}
+			if len(cookieKey) < server.CookieSecretSize {
+				return nil, fmt.Errorf("cookie secret must be at least %d bytes", server.CookieSecretSize)
+			}
+		}
+
+		var forwardOptions []uint16
+		for _, s := range strings.Split(*forwardEDNS, ",") {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			code, err := dns.ParseEDNSOption(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid forwarded EDNS option: %w", err)
+			}
+			forwardOptions = append(forwardOptions, code)
+		}
+
+		var upstreamEDNSSize uint16
+		upstreamEDNSSizes := map[string]uint16{}
+		for _, s := range strings.Split(*upstreamEDNS, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			upstream, sizeStr := "", s
+			if i := strings.LastIndex(s, "="); i >= 0 {
+				upstream, sizeStr = s[:i], s[i+1:]
+			}
+			size, err := strconv.ParseUint(sizeStr, 10, 16)
+			if err != nil || size < dns.EDNSMinUDPSize {
+				return nil, fmt.Errorf("invalid upstream EDNS size %q", s)
+			}
+			if upstream == "" {
+				upstreamEDNSSize = uint16(size)
+			} else {
+				upstreamEDNSSizes[upstream] = uint16(size)
+			}
+		}
+
+		return &server.Config{
+			ListenAddr:             *listenAddr,
+			Domain:                 *domain,
+			SharedSecret:           key,
+			PreviousSecrets:        previousKeys,
+			ClientKeys:             clientKeyMap,
+			RevocationFile:         *revocations,
+			UpstreamResolver:       upstreamAddr,
+			UpstreamType:           upstreamType,
+			MaxUDPSize:             *maxUDPSize,
+			AcceptNoEDNS:           *acceptNoEDNS,
+			ResponseTTL:            uint32(*responseTTL),
+			NegativeTTL:            uint32(*negativeTTL),
+			ZoneRecords:            zoneRecords,
+			MaxConcurrent:          1000,
+			MaxClientConcurrent:    *clientConc,
+			MaxQPS:                 *maxQPS,
+			OverLimitAction:        *overLimit,
+			RateLimit:              *rateLimit,
+			RateBurst:              *rateBurst,
+			RateLimitIPv4Prefix:    *rateV4Prefix,
+			RateLimitIPv6Prefix:    *rateV6Prefix,
+			FailureRateLimit:       *failureLimit,
+			MaxClients:             *maxClients,
+			MaxGoroutines:          *maxGorout,
+			MaxMemory:              int64(*maxMemory) << 20,
+			RRLLimit:               *rrlLimit,
+			RRLAmplification:       *rrlAmp,
+			RRLSlip:                *rrlSlip,
+			ChallengeThreshold:     *challenge,
+			Cookies:                *cookies,
+			CookieSecret:           cookieKey,
+			ListenTCP:              *listenTCP,
+			DrainTimeout:           *drainTimeout,
+			InstanceLabel:          *instLabel,
+			AllowStreams:           *streams,
+			StreamAllowPrivate:     *streamsPriv,
+			Maintenance:            *maintenance,
+			StateFile:              *stateFile,
+			StateBackend:           *stateBackend,
+			ClusterListen:          *clusterAddr,
+			ClusterPeers:           peerList,
+			ClusterSecret:          clusterSecret,
+			FallbackUpstreams:      fallbackUpstreams,
+			UpstreamStrategy:       *upStrategy,
+			UpstreamHealthInterval: *upHealth,
+			FailoverRcodes:         failoverRcodes,
+			ConsensusUpstream:      strings.TrimSpace(*consensusUp),
+			NamedUpstreams:         namedUpstreams,
+			UpstreamRoutes:         upstreamRoutes,
+			Blocklists:             blocklistFiles,
+			Allowlists:             allowlistFiles,
+			BlocklistSinkhole:      sinkholeAddrs,
+			ForwardEDNSOptions:     forwardOptions,
+			UpstreamEDNSSize:       upstreamEDNSSize,
+			UpstreamEDNSSizes:      upstreamEDNSSizes,
+			Upstream0x20:           *upstream0x20,
+			QNameMinimization:      *qnameMin,
+			RootHints:              rootHintList,
+			RawPassthrough:         *rawPassthru,
+			Compression:            *compress,
+			TraceLog:               *traceLog,
+			TraceLogSample:         *traceSample,
+			LatencySample:          *latSample,
+			AuditUpstream:          *auditUp,
+			AuditSample:            *auditSample,
+			TopReports:             *topReports,
+			TopN:                   *topN,
+			TopReportFile:          *topFile,
+			AlertWebhook:           *alertHook,
+			AlertFormat:            *alertFormat,
+			AlertInterval:          *alertEvery,
+			StartupChecks:          *startChecks,
+		}, nil
 	}
 
-	if len(key) != crypto.KeySize {
-		log.Fatalf("Key must be %d bytes (%d hex characters)", crypto.KeySize, crypto.KeySize*2)
+	// Create config
+	config, err := buildConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Parse upstream configuration
-	upstreamAddr, upstreamType, err := server.ParseUpstreamConfig(*upstream)
+	// reload re-reads the config file and rebuilds the configuration
+	reload := func() (*server.Config, error) {
+		if loader != nil {
+			if err := loader.Load(); err != nil {
+				return nil, err
+			}
+		}
+		return buildConfig()
+	}
+
+	// Open audit log
+	auditLog, err := openAuditLog(*auditFile)
 	if err != nil {
-		log.Fatalf("Invalid upstream configuration: %v", err)
+		log.Fatalf("Failed to open audit log: %v", err)
 	}
+	defer auditLog.Close()
 
-	// Create config
-	config := &server.Config{
-		ListenAddr:       *listenAddr,
-		Domain:           *domain,
-		SharedSecret:     key,
-		UpstreamResolver: upstreamAddr,
-		UpstreamType:     upstreamType,
-		MaxUDPSize:       *maxUDPSize,
-		ResponseTTL:      uint32(*responseTTL),
-		MaxConcurrent:    1000,
-		RateLimit:        *rateLimit,
+	// Admin API
+	var admin *listener.Config
+	if *adminAddr != "" {
+		allow, err := listener.ParseAllowlist(*adminAllow)
+		if err != nil {
+			log.Fatalf("Invalid admin allowlist: %v", err)
+		}
+		admin = &listener.Config{Addr: *adminAddr, Allow: allow, Token: *adminToken}
 	}
 
 	// Run as service or standalone
 	if *runSvc {
-		if err := service.Run("dns-as-doh-server", func() error {
-			return runServer(config)
+		if err := service.Run(serviceName, func() error {
+			return runServer(config, reload, auditLog, admin)
 		}, func() {
 			// Stop handler - will be handled by signal
 		}); err != nil {
 			log.Fatalf("Service error: %v", err)
 		}
 	} else {
-		if err := runServer(config); err != nil {
+		if err := runServer(config, reload, auditLog, admin); err != nil {
 			log.Fatalf("Server error: %v", err)
 		}
 	}
 }
 
-func runServer(config *server.Config) error {
+func runServer(config *server.Config, reload func() (*server.Config, error), auditLog *audit.Log, admin *listener.Config) error {
 	// Create handler
 	handler, err := server.NewHandler(config)
 	if err != nil {
 		return fmt.Errorf("failed to create handler: %w", err)
 	}
 
+	// applyReload reloads the configuration on behalf of principal and
+	// records what changed in the audit log
+	var reloadMu sync.Mutex
+	applyReload := func(principal string) error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		newConfig, err := reload()
+		if err == nil {
+			err = handler.Reload(newConfig)
+		}
+		if err != nil {
+			return err
+		}
+
+		_ = auditLog.Record(principal, audit.ActionConfigReload, "")
+		if !bytes.Equal(newConfig.SharedSecret, config.SharedSecret) ||
+			len(newConfig.PreviousSecrets) != len(config.PreviousSecrets) {
+			_ = auditLog.Record(principal, audit.ActionKeyRotate,
+				fmt.Sprintf("%d previous keys accepted", len(newConfig.PreviousSecrets)))
+		}
+		for id := range config.ClientKeys {
+			if _, ok := newConfig.ClientKeys[id]; !ok {
+				_ = auditLog.Record(principal, audit.ActionClientRevoke, fmt.Sprintf("key ID %d", id))
+			}
+		}
+		config = newConfig
+		log.Println("Configuration reloaded")
+		return nil
+	}
+
 	// Start handler
 	if err := handler.Start(); err != nil {
 		return fmt.Errorf("failed to start handler: %w", err)
 	}
 
+	var adminServer *server.AdminServer
+	if admin != nil {
+		adminServer, err = server.NewAdminServer(handler, admin, applyReload, auditLog)
+		if err == nil {
+			err = adminServer.Start()
+		}
+		if err != nil {
+			handler.Stop()
+			return err
+		}
+	}
+
 	log.Println("DNS tunnel server started")
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal, reloading the configuration on SIGHUP and
+	// toggling maintenance mode on the maintenance signal
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, maintenanceSignals...)...)
 
 	sig := <-sigCh
+	for sig == syscall.SIGHUP || isMaintenanceSignal(sig) {
+		if isMaintenanceSignal(sig) {
+			on := !handler.Maintenance()
+			handler.SetMaintenance(on)
+			_ = auditLog.Record(sig.String(), audit.ActionMaintenance, strconv.FormatBool(on))
+		} else if err := applyReload("SIGHUP"); err != nil {
+			log.Printf("Reload failed: %v", err)
+		}
+		sig = <-sigCh
+	}
 	log.Printf("Received signal %v, shutting down...", sig)
 
-	// Stop handler
-	handler.Stop()
+	if adminServer != nil {
+		_ = adminServer.Close()
+	}
+
+	// Stop accepting queries and let in-flight ones finish
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		log.Printf("Drain timeout exceeded, in-flight queries aborted")
+	}
 
 	log.Println("Server stopped")
 	return nil
 }
+
+// isMaintenanceSignal reports whether sig toggles maintenance mode.
+func isMaintenanceSignal(sig os.Signal) bool {
+	for _, s := range maintenanceSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+// openAuditLog opens the audit log, or returns nil if no path is set.
+func openAuditLog(path string) (*audit.Log, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return audit.Open(path)
+}
+
+// addFirewallRules opens the port of listenAddr in the system firewall.
+func addFirewallRules(name, listenAddr string, tcp bool) error {
+	_, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid listen port: %w", err)
+	}
+	return service.AddFirewallRules(name, port, tcp)
+}
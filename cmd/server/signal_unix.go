@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// maintenanceSignals toggle maintenance mode.
+var maintenanceSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// maintenanceSignals toggle maintenance mode. Windows has no user signals;
+// use the -maintenance option and a reload instead.
+var maintenanceSignals []os.Signal
@@ -3,6 +3,7 @@ module github.com/AliRezaBeigy/dns-as-doh
 go 1.24
 
 require (
+	go.etcd.io/bbolt v1.3.10
 	golang.org/x/crypto v0.17.0
 	golang.org/x/sys v0.15.0
 )
@@ -0,0 +1,184 @@
+// Package alert posts operational events, such as the tunnel going down or
+// upstreams failing, to a webhook: a Slack or Discord incoming webhook, or
+// any endpoint accepting JSON.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert events
+const (
+	EventTunnelDown     = "tunnel_down"
+	EventKeyMismatch    = "key_mismatch"
+	EventKeyRejected    = "key_rejected"
+	EventQuotaExceeded  = "quota_exceeded"
+	EventUpstreamOutage = "upstream_outage"
+	EventAnswerMismatch = "answer_mismatch"
+)
+
+// Webhook formats
+const (
+	FormatGeneric = "generic"
+	FormatSlack   = "slack"
+	FormatDiscord = "discord"
+)
+
+// DefaultInterval is the default minimum time between two alerts of the
+// same event.
+const DefaultInterval = 5 * time.Minute
+
+// sendTimeout bounds a webhook request
+const sendTimeout = 10 * time.Second
+
+var ErrUnknownFormat = errors.New("unknown webhook format")
+
+// Alert is the JSON body posted to generic webhooks.
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+
+	// Suppressed is the number of alerts of the event not sent since the
+	// previous one
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// text formats the alert as a chat message.
+func (a *Alert) text() string {
+	s := fmt.Sprintf("%s: %s: %s", a.Source, strings.ReplaceAll(a.Event, "_", " "), a.Message)
+	if a.Suppressed > 0 {
+		s += fmt.Sprintf(" (%d similar alerts suppressed)", a.Suppressed)
+	}
+	return s
+}
+
+// Notifier posts alerts to a webhook, at most one per event every
+// interval; alerts in between are counted and reported with the next one.
+// Alerts are sent in the background. A nil *Notifier sends nothing.
+type Notifier struct {
+	url      string
+	format   string
+	source   string
+	interval time.Duration
+	client   *http.Client
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+	wg         sync.WaitGroup
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// New creates a notifier posting alerts from source, e.g. "server
+// t.example.com", to the webhook at rawURL in format.
+func New(rawURL, format, source string, interval time.Duration) (*Notifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+	}
+	switch format {
+	case FormatGeneric, FormatSlack, FormatDiscord:
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownFormat, format)
+	}
+
+	return &Notifier{
+		url:        rawURL,
+		format:     format,
+		source:     source,
+		interval:   interval,
+		client:     &http.Client{Timeout: sendTimeout},
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		now:        time.Now,
+	}, nil
+}
+
+// Notify sends an alert for event unless one was sent less than the
+// interval ago.
+func (n *Notifier) Notify(event, message string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	now := n.now()
+	if last, ok := n.last[event]; ok && now.Sub(last) < n.interval {
+		n.suppressed[event]++
+		n.mu.Unlock()
+		return
+	}
+	a := &Alert{
+		Time:       now.UTC(),
+		Source:     n.source,
+		Event:      event,
+		Message:    message,
+		Suppressed: n.suppressed[event],
+	}
+	n.last[event] = now
+	delete(n.suppressed, event)
+	n.wg.Add(1)
+	n.mu.Unlock()
+
+	go func() {
+		defer n.wg.Done()
+		if err := n.send(a); err != nil {
+			log.Printf("Failed to send %s alert: %v", event, err)
+		}
+	}()
+}
+
+// send posts an alert to the webhook.
+func (n *Notifier) send(a *Alert) error {
+	var body any = a
+	switch n.format {
+	case FormatSlack:
+		body = map[string]string{"text": a.text()}
+	case FormatDiscord:
+		body = map[string]string{"content": a.text()}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close waits for alerts being sent.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.wg.Wait()
+}
@@ -0,0 +1,118 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhook records the bodies posted to it.
+type webhook struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newWebhook(t *testing.T) *webhook {
+	w := &webhook{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		w.mu.Lock()
+		w.bodies = append(w.bodies, string(data))
+		w.mu.Unlock()
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+func (w *webhook) received() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.bodies...)
+}
+
+func TestNotifyRateLimit(t *testing.T) {
+	w := newWebhook(t)
+	n, err := New(w.URL, FormatGeneric, "server t.example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	n.Notify(EventUpstreamOutage, "all upstreams failed")
+	n.Notify(EventUpstreamOutage, "all upstreams failed")
+	n.Notify(EventUpstreamOutage, "all upstreams failed")
+	n.Notify(EventKeyMismatch, "decryption failed")
+	n.Close()
+	if got := len(w.received()); got != 2 {
+		t.Fatalf("Alerts sent: got %d, want 2", got)
+	}
+
+	// The next alert after the interval reports the suppressed ones
+	now = now.Add(time.Minute)
+	n.Notify(EventUpstreamOutage, "all upstreams failed")
+	n.Close()
+	bodies := w.received()
+	if len(bodies) != 3 {
+		t.Fatalf("Alerts sent: got %d, want 3", len(bodies))
+	}
+	var a Alert
+	if err := json.Unmarshal([]byte(bodies[2]), &a); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	want := Alert{Time: now, Source: "server t.example.com", Event: EventUpstreamOutage, Message: "all upstreams failed", Suppressed: 2}
+	if a != want {
+		t.Errorf("Alert: got %+v, want %+v", a, want)
+	}
+}
+
+func TestNotifyFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{FormatSlack, `{"text":"client: tunnel down: no reply"}`},
+		{FormatDiscord, `{"content":"client: tunnel down: no reply"}`},
+	}
+	for _, tt := range tests {
+		w := newWebhook(t)
+		n, err := New(w.URL, tt.format, "client", time.Minute)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		n.Notify(EventTunnelDown, "no reply")
+		n.Close()
+		if got := w.received(); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s body: got %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New("ftp://example.com/hook", FormatGeneric, "client", time.Minute); err == nil {
+		t.Error("New() with an ftp URL succeeded")
+	}
+	if _, err := New("https://example.com/hook", "teams", "client", time.Minute); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("New() error = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestNotifierNil(t *testing.T) {
+	var n *Notifier
+	n.Notify(EventTunnelDown, "no reply")
+	n.Close()
+}
+
+func TestAlertText(t *testing.T) {
+	a := &Alert{Source: "server", Event: EventQuotaExceeded, Message: "rate limit", Suppressed: 3}
+	if got := a.text(); !strings.Contains(got, "quota exceeded") || !strings.HasSuffix(got, "(3 similar alerts suppressed)") {
+		t.Errorf("text() = %q", got)
+	}
+}
@@ -0,0 +1,107 @@
+// Package audit records administrative actions in an append-only log kept
+// separate from query logs.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Administrative actions
+const (
+	ActionKeyRotate      = "key_rotate"
+	ActionResolverChange = "resolver_change"
+	ActionCacheFlush     = "cache_flush"
+	ActionClientRevoke   = "client_revoke"
+	ActionConfigReload   = "config_reload"
+	ActionMaintenance    = "maintenance"
+	ActionRateLimit      = "rate_limit"
+)
+
+var ErrClosed = errors.New("audit log is closed")
+
+// Entry is a single audit log record.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Log is an append-only audit log writing one JSON entry per line.
+// A nil *Log discards all entries.
+type Log struct {
+	w      io.Writer
+	closer io.Closer
+	mu     sync.Mutex
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// Open opens the audit log at path, creating it if needed. Entries are
+// always appended.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l := New(f)
+	l.closer = f
+	return l, nil
+}
+
+// New creates an audit log writing to w.
+func New(w io.Writer) *Log {
+	return &Log{w: w, now: time.Now}
+}
+
+// Record appends an entry for an action performed by principal.
+func (l *Log) Record(principal, action, detail string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil {
+		return ErrClosed
+	}
+
+	data, err := json.Marshal(Entry{
+		Time:      l.now().UTC(),
+		Principal: principal,
+		Action:    action,
+		Detail:    detail,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+	return nil
+}
+
+// Close closes the underlying file, if any.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w = nil
+	if l.closer != nil {
+		return l.closer.Close()
+	}
+	return nil
+}
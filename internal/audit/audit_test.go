@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.now = func() time.Time { return fixed }
+
+	if err := l.Record("admin", ActionCacheFlush, ""); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	if err := l.Record("sighup", ActionConfigReload, "server.yaml"); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	var entries []Entry
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Entries: got %d, want 2", len(entries))
+	}
+	want := Entry{Time: fixed, Principal: "sighup", Action: ActionConfigReload, Detail: "server.yaml"}
+	if entries[1] != want {
+		t.Errorf("Entry: got %+v, want %+v", entries[1], want)
+	}
+}
+
+func TestOpenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		if err := l.Record("admin", ActionKeyRotate, ""); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+		t.Errorf("Lines: got %d, want 2", lines)
+	}
+}
+
+func TestClosedAndNilLog(t *testing.T) {
+	l := New(&bytes.Buffer{})
+	l.Close()
+	if err := l.Record("admin", ActionCacheFlush, ""); err != ErrClosed {
+		t.Errorf("Record() after Close: got %v, want %v", err, ErrClosed)
+	}
+
+	var nilLog *Log
+	if err := nilLog.Record("admin", ActionCacheFlush, ""); err != nil {
+		t.Errorf("Record() on nil log: got %v", err)
+	}
+}
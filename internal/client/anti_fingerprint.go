@@ -1,8 +1,10 @@
 package client
 
 import (
-	"crypto/rand"
+	"io"
 	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
 )
 
 // Anti-fingerprinting constants
@@ -21,6 +23,7 @@ type AntiFingerprinting struct {
 	minDelay time.Duration
 	maxDelay time.Duration
 	enabled  bool
+	random   io.Reader
 }
 
 // AntiFingerConfig holds anti-fingerprinting configuration.
@@ -39,6 +42,10 @@ type AntiFingerConfig struct {
 
 	// DummyInterval is the interval between dummy queries
 	DummyInterval time.Duration
+
+	// Random is the source of the randomness, clock.Random if nil; tests
+	// and simulations set a seeded one to get the same choices each run
+	Random io.Reader
 }
 
 // DefaultAntiFingerConfig returns the default anti-fingerprinting config.
@@ -67,6 +74,7 @@ func NewAntiFingerprinting(config *AntiFingerConfig) *AntiFingerprinting {
 		minDelay: config.MinDelay,
 		maxDelay: config.MaxDelay,
 		enabled:  config.Enabled,
+		random:   clock.RandomOr(config.Random),
 	}
 	return af
 }
@@ -77,9 +85,7 @@ func (af *AntiFingerprinting) GetRandomDelay() time.Duration {
 		return 0
 	}
 
-	diff := af.maxDelay - af.minDelay
-	randVal := randomUint64() % uint64(diff)
-	return af.minDelay + time.Duration(randVal)
+	return af.minDelay + clock.Duration(af.random, af.maxDelay-af.minDelay)
 }
 
 // GetRandomPadding returns random bytes for size obfuscation.
@@ -88,36 +94,30 @@ func (af *AntiFingerprinting) GetRandomPadding(min, max int) []byte {
 		return nil
 	}
 
-	var randByte [1]byte
-	_, _ = rand.Read(randByte[:])
-	size := min + int(randByte[0])%(max-min+1)
+	size := min + int(af.randomByte())%(max-min+1)
 
 	padding := make([]byte, size)
-	_, _ = rand.Read(padding)
+	_, _ = io.ReadFull(af.random, padding)
 	return padding
 }
 
-// randomUint64 generates a random uint64.
-func randomUint64() uint64 {
-	var buf [8]byte
-	_, _ = rand.Read(buf[:])
-	return uint64(buf[0])<<56 | uint64(buf[1])<<48 |
-		uint64(buf[2])<<40 | uint64(buf[3])<<32 |
-		uint64(buf[4])<<24 | uint64(buf[5])<<16 |
-		uint64(buf[6])<<8 | uint64(buf[7])
+// randomByte returns a random byte.
+func (af *AntiFingerprinting) randomByte() byte {
+	var buf [1]byte
+	_, _ = io.ReadFull(af.random, buf[:])
+	return buf[0]
 }
 
 // RandomizeQueryType randomly selects a query type.
 // This helps avoid patterns of always using TXT queries.
-func RandomizeQueryType() uint16 {
-	var buf [1]byte
-	_, _ = rand.Read(buf[:])
+func (af *AntiFingerprinting) RandomizeQueryType() uint16 {
+	b := af.randomByte()
 
 	// 80% TXT, 10% A, 10% AAAA
 	switch {
-	case buf[0] < 205: // ~80%
+	case b < 205: // ~80%
 		return 16 // TXT
-	case buf[0] < 230: // ~10%
+	case b < 230: // ~10%
 		return 1 // A
 	default: // ~10%
 		return 28 // AAAA
@@ -130,24 +130,19 @@ func (af *AntiFingerprinting) ShouldSendDummy() bool {
 		return false
 	}
 
-	var buf [1]byte
-	_, _ = rand.Read(buf[:])
-
 	// 5% chance to send dummy
-	return buf[0] < 13
+	return af.randomByte() < 13
 }
 
 // ObfuscateSize pads data to a random size within bounds.
-func ObfuscateSize(data []byte, minSize, maxSize int) []byte {
+func (af *AntiFingerprinting) ObfuscateSize(data []byte, minSize, maxSize int) []byte {
 	if len(data) >= maxSize {
 		return data
 	}
 
 	targetSize := minSize
 	if maxSize > minSize {
-		var buf [1]byte
-		_, _ = rand.Read(buf[:])
-		targetSize = minSize + int(buf[0])%(maxSize-minSize+1)
+		targetSize = minSize + int(af.randomByte())%(maxSize-minSize+1)
 	}
 
 	if len(data) >= targetSize {
@@ -157,18 +152,15 @@ func ObfuscateSize(data []byte, minSize, maxSize int) []byte {
 	result := make([]byte, targetSize)
 	copy(result, data)
 	// Fill rest with random data
-	_, _ = rand.Read(result[len(data):])
+	_, _ = io.ReadFull(af.random, result[len(data):])
 	return result
 }
 
 // VaryTTL returns a randomized TTL value within realistic bounds.
-func VaryTTL(baseTTL uint32) uint32 {
-	var buf [2]byte
-	_, _ = rand.Read(buf[:])
-
+func (af *AntiFingerprinting) VaryTTL(baseTTL uint32) uint32 {
 	// Vary by ±20%
-	variance := (uint32(buf[0])<<8 | uint32(buf[1])) % (baseTTL / 5)
-	if buf[0]&1 == 0 {
+	variance := uint32(clock.Uint64N(af.random, uint64(baseTTL/5)))
+	if af.randomByte()&1 == 0 {
 		return baseTTL + variance
 	}
 	if baseTTL > variance {
@@ -178,8 +170,6 @@ func VaryTTL(baseTTL uint32) uint32 {
 }
 
 // VaryResponseDelay adds realistic response delay (10-100ms).
-func VaryResponseDelay() time.Duration {
-	var buf [1]byte
-	_, _ = rand.Read(buf[:])
-	return 10*time.Millisecond + time.Duration(buf[0])*time.Millisecond*90/255
+func (af *AntiFingerprinting) VaryResponseDelay() time.Duration {
+	return 10*time.Millisecond + time.Duration(af.randomByte())*time.Millisecond*90/255
 }
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Cache constants
+const (
+	// DefaultCacheSize is the default number of cached responses
+	DefaultCacheSize = 4096
+
+	// maxCacheTTL caps how long a response is cached
+	maxCacheTTL = 24 * time.Hour
+)
+
+// cacheKey identifies a cached response by the question and the query
+// flags that change the answer: DO, which asks for DNSSEC records, and CD,
+// which accepts answers that fail validation.
+type cacheKey struct {
+	name  string
+	qtype uint16
+	class uint16
+	do    bool
+	cd    bool
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key      cacheKey
+	response *dns.Message
+	stored   time.Time
+	expires  time.Time
+}
+
+// Cache is an LRU cache of DNS responses that honors record TTLs.
+type Cache struct {
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+	mu      sync.Mutex
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewCache creates a cache holding up to size responses.
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// newCacheKey returns the cache key for a query with one question.
+func newCacheKey(query *dns.Message) cacheKey {
+	q := &query.Question[0]
+	return cacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		class: q.Class,
+		do:    query.DO(),
+		cd:    query.Flags&flagCD != 0,
+	}
+}
+
+// Get returns a cached response for the query with TTLs reduced by the
+// time spent in the cache. The response ID and question match the query,
+// and it is rebuilt as the query asks for it, like a stub response.
+func (c *Cache) Get(query *dns.Message) (*dns.Message, bool) {
+	if len(query.Question) != 1 {
+		return nil, false
+	}
+	key := newCacheKey(query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	now := c.now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.hits++
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	resp := &dns.Message{
+		Flags:      entry.response.Flags,
+		Answer:     agedRRs(entry.response.Answer, elapsed),
+		Authority:  agedRRs(entry.response.Authority, elapsed),
+		Additional: agedRRs(entry.response.Additional, elapsed),
+	}
+	return stubResponse(query, resp), true
+}
+
+// Put caches the response to the query. Only successful and NXDOMAIN
+// responses that are not truncated and carry at least one record are cached.
+// Negative responses are cached for the lower of the SOA record's TTL and
+// MINIMUM field (RFC 2308 section 5), and not at all without one.
+func (c *Cache) Put(query, response *dns.Message) {
+	if len(query.Question) != 1 {
+		return
+	}
+	if rcode := response.Rcode(); rcode != dns.RcodeNoError && rcode != dns.RcodeNameError {
+		return
+	}
+	if response.Flags&0x0200 != 0 { // TC
+		return
+	}
+
+	ttl, ok := minTTL(response)
+	if isNegative(response) {
+		ttl, ok = negativeTTL(response)
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := c.now()
+	lifetime := time.Duration(ttl) * time.Second
+	if lifetime > maxCacheTTL {
+		lifetime = maxCacheTTL
+	}
+
+	key := newCacheKey(query)
+	entry := &cacheEntry{
+		key:      key,
+		response: response,
+		stored:   now,
+		expires:  now.Add(lifetime),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns the number of cached responses.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// CacheStats describes the use of a cache.
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// Stats returns the number of cached responses, the cache size and how
+// many lookups found a response.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: c.lru.Len(), Size: c.size, Hits: c.hits, Misses: c.misses}
+}
+
+// minTTL returns the lowest TTL of the response records, ignoring OPT.
+func minTTL(response *dns.Message) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{response.Answer, response.Authority, response.Additional} {
+		for _, rr := range section {
+			if rr.Type == dns.RRTypeOPT {
+				continue
+			}
+			if !found || rr.TTL < ttl {
+				ttl = rr.TTL
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// isNegative reports whether the response is NXDOMAIN or has no answers.
+func isNegative(response *dns.Message) bool {
+	return response.Rcode() == dns.RcodeNameError || len(response.Answer) == 0
+}
+
+// negativeTTL returns the negative caching TTL of the response: the lower
+// of its SOA record's TTL and MINIMUM field.
+func negativeTTL(response *dns.Message) (uint32, bool) {
+	for _, rr := range response.Authority {
+		if rr.Type != dns.RRTypeSOA {
+			continue
+		}
+		soa, err := dns.DecodeSOAData(rr.Data)
+		if err != nil {
+			continue
+		}
+		return min(rr.TTL, soa.Minimum), true
+	}
+	return 0, false
+}
+
+// agedRRs returns a copy of the records with elapsed seconds subtracted
+// from their TTLs.
+func agedRRs(rrs []dns.RR, elapsed uint32) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	aged := make([]dns.RR, len(rrs))
+	copy(aged, rrs)
+	for i := range aged {
+		if aged[i].Type == dns.RRTypeOPT {
+			continue
+		}
+		if aged[i].TTL > elapsed {
+			aged[i].TTL -= elapsed
+		} else {
+			aged[i].TTL = 0
+		}
+	}
+	return aged
+}
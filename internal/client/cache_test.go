@@ -0,0 +1,242 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// newCacheTestResponse creates a response to query with one A record.
+func newCacheTestResponse(query *dns.Message, ttl uint32) *dns.Message {
+	resp := dns.CreateResponse(query)
+	resp.Answer = []dns.RR{{
+		Name:  query.Question[0].Name,
+		Type:  dns.RRTypeA,
+		Class: dns.ClassIN,
+		TTL:   ttl,
+		Data:  []byte{192, 0, 2, 1},
+	}}
+	return resp
+}
+
+func newCacheTestQuery(t *testing.T, name string, id uint16) *dns.Message {
+	t.Helper()
+	n, err := dns.ParseName(name)
+	if err != nil {
+		t.Fatalf("ParseName(%q) error = %v", name, err)
+	}
+	return dns.CreateQuery(n, dns.RRTypeA, id)
+}
+
+func TestCacheTTL(t *testing.T) {
+	cache := NewCache(10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	query := newCacheTestQuery(t, "cdn.example.com", 1)
+	cache.Put(query, newCacheTestResponse(query, 60))
+
+	// Lookups are case-insensitive and take the query's ID and question
+	now = now.Add(20 * time.Second)
+	repeat := newCacheTestQuery(t, "CDN.Example.com", 2)
+	resp, ok := cache.Get(repeat)
+	if !ok {
+		t.Fatal("Expected cache hit")
+	}
+	if resp.ID != 2 {
+		t.Errorf("ID: got %d, want 2", resp.ID)
+	}
+	if string(resp.Question[0].Name[0]) != "CDN" {
+		t.Errorf("Question not taken from query: got %s", resp.Question[0].Name)
+	}
+	if resp.Answer[0].TTL != 40 {
+		t.Errorf("TTL: got %d, want 40", resp.Answer[0].TTL)
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, ok := cache.Get(query); ok {
+		t.Error("Expected miss after TTL expiry")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Expired entry not removed: got %d entries", cache.Len())
+	}
+	if got, want := cache.Stats(), (CacheStats{Size: 10, Hits: 1, Misses: 1}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	cache := NewCache(2)
+
+	a := newCacheTestQuery(t, "a.example.com", 1)
+	b := newCacheTestQuery(t, "b.example.com", 2)
+	c := newCacheTestQuery(t, "c.example.com", 3)
+
+	cache.Put(a, newCacheTestResponse(a, 60))
+	cache.Put(b, newCacheTestResponse(b, 60))
+
+	// Touch a so b becomes the least recently used
+	if _, ok := cache.Get(a); !ok {
+		t.Fatal("Expected hit for a")
+	}
+	cache.Put(c, newCacheTestResponse(c, 60))
+
+	if _, ok := cache.Get(b); ok {
+		t.Error("Least recently used entry should be evicted")
+	}
+	if _, ok := cache.Get(a); !ok {
+		t.Error("Recently used entry should be kept")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Len: got %d, want 2", cache.Len())
+	}
+}
+
+func TestCacheSkipsUncacheable(t *testing.T) {
+	query := newCacheTestQuery(t, "example.com", 1)
+
+	servfail := dns.CreateResponse(query)
+	servfail.SetRcode(dns.RcodeServerFail)
+
+	truncated := newCacheTestResponse(query, 60)
+	truncated.Flags |= 0x0200
+
+	tests := []struct {
+		name     string
+		response *dns.Message
+	}{
+		{name: "servfail", response: servfail},
+		{name: "truncated", response: truncated},
+		{name: "zero ttl", response: newCacheTestResponse(query, 0)},
+		{name: "no records", response: dns.CreateResponse(query)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewCache(10)
+			cache.Put(query, tt.response)
+			if _, ok := cache.Get(query); ok {
+				t.Error("Response should not be cached")
+			}
+		})
+	}
+}
+
+func TestCacheIgnoresOPTTTL(t *testing.T) {
+	cache := NewCache(10)
+	query := newCacheTestQuery(t, "example.com", 1)
+	query.AddEDNS0(dns.MaxEDNSSize)
+
+	resp := newCacheTestResponse(query, 60)
+	resp.AddEDNS0(dns.MaxEDNSSize)
+	cache.Put(query, resp)
+
+	got, ok := cache.Get(query)
+	if !ok {
+		t.Fatal("Expected cache hit")
+	}
+	if got.GetEDNS0Size() != dns.MaxEDNSSize {
+		t.Errorf("OPT record changed: got size %d", got.GetEDNS0Size())
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	query := newCacheTestQuery(t, "missing.example.com", 1)
+	zone, _ := dns.ParseName("example.com")
+
+	// newNegative creates a response to query with an SOA record
+	newNegative := func(rcode uint16, ttl, minimum uint32) *dns.Message {
+		resp := dns.CreateResponse(query)
+		resp.SetRcode(rcode)
+		resp.Authority = []dns.RR{{
+			Name: zone, Type: dns.RRTypeSOA, Class: dns.ClassIN, TTL: ttl,
+			Data: dns.EncodeSOAData(dns.SOA{MName: zone, RName: zone, Serial: 1, Minimum: minimum}),
+		}}
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		response *dns.Message
+		wantTTL  time.Duration // 0 if not cached
+	}{
+		{name: "nxdomain minimum", response: newNegative(dns.RcodeNameError, 3600, 300), wantTTL: 300 * time.Second},
+		{name: "nxdomain soa ttl", response: newNegative(dns.RcodeNameError, 60, 900), wantTTL: 60 * time.Second},
+		{name: "nodata", response: newNegative(dns.RcodeNoError, 3600, 120), wantTTL: 120 * time.Second},
+		{name: "zero minimum", response: newNegative(dns.RcodeNameError, 3600, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewCache(10)
+			now := time.Now()
+			cache.now = func() time.Time { return now }
+			cache.Put(query, tt.response)
+
+			if _, ok := cache.Get(query); ok != (tt.wantTTL > 0) {
+				t.Fatalf("Cached = %v, want %v", ok, tt.wantTTL > 0)
+			}
+			if tt.wantTTL == 0 {
+				return
+			}
+			now = now.Add(tt.wantTTL - time.Second)
+			if _, ok := cache.Get(query); !ok {
+				t.Error("Expired before its negative TTL")
+			}
+			now = now.Add(time.Second)
+			if _, ok := cache.Get(query); ok {
+				t.Error("Still cached after its negative TTL")
+			}
+		})
+	}
+
+	// Negative responses without an SOA record aren't cached
+	cache := NewCache(10)
+	nxdomain := newCacheTestResponse(query, 60)
+	nxdomain.SetRcode(dns.RcodeNameError)
+	nxdomain.Authority, nxdomain.Answer = nxdomain.Answer, nil
+	cache.Put(query, nxdomain)
+	if _, ok := cache.Get(query); ok {
+		t.Error("Negative response without SOA cached")
+	}
+}
+
+func TestCacheQueryFlags(t *testing.T) {
+	cache := NewCache(10)
+	query := newCacheTestQuery(t, "example.com", 1)
+	query.SetEDNS0(dns.MaxEDNSSize, true)
+
+	// A DNSSEC-aware stub's response with signatures and AD
+	resp := newCacheTestResponse(query, 60)
+	resp.Flags |= flagAD
+	resp.Answer = append(resp.Answer, dns.RR{Name: query.Question[0].Name, Type: dns.RRTypeRRSIG, Class: dns.ClassIN, TTL: 60, Data: make([]byte, 20)})
+	resp.SetEDNS0(dns.MaxEDNSSize, true)
+	cache.Put(query, resp)
+
+	if _, ok := cache.Get(query); !ok {
+		t.Fatal("Expected a hit for the same flags")
+	}
+
+	plain := newCacheTestQuery(t, "example.com", 2)
+	if _, ok := cache.Get(plain); ok {
+		t.Error("A query without DO got the response cached for DO")
+	}
+	checking := newCacheTestQuery(t, "example.com", 3)
+	checking.Flags |= flagCD
+	checking.SetEDNS0(dns.MaxEDNSSize, true)
+	if _, ok := cache.Get(checking); ok {
+		t.Error("A query with CD got the response cached without it")
+	}
+
+	// Responses are rebuilt for the query that gets them
+	cache.Put(plain, resp)
+	got, ok := cache.Get(plain)
+	if !ok {
+		t.Fatal("Expected a hit for the plain query")
+	}
+	if got.Flags&flagAD != 0 || len(got.Answer) != 1 || got.GetEDNS0Size() != 0 {
+		t.Errorf("Response to a plain query has AD %v, %d answers and EDNS size %d, want none of the DNSSEC records",
+			got.Flags&flagAD != 0, len(got.Answer), got.GetEDNS0Size())
+	}
+}
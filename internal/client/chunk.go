@@ -0,0 +1,157 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Chunk size adaptation constants
+const (
+	// chunkLosses is how many full response fragments in a row must get
+	// lost through a resolver before responses through it are shrunk
+	chunkLosses = 2
+
+	// chunkShrink is the fraction of its size a response limit shrinks to
+	chunkShrink = 0.75
+
+	// chunkGrowInterval is how long full response fragments must get
+	// through a resolver at a shrunk limit before the limit grows again
+	chunkGrowInterval = 5 * time.Minute
+
+	// chunkGrowStep is by how many bytes a shrunk limit grows at a time
+	chunkGrowStep = 8 * pathResponseStep
+
+	// defaultChunkResponse is the response size servers default to, in
+	// bytes, shrunk from when neither path discovery nor a received
+	// response showed the size in use
+	defaultChunkResponse = 1232
+)
+
+// chunkState adapts the size of response fragments to their loss, like
+// path MTU discovery does for packets: responses through a resolver that
+// loses full fragments are shrunk, and grown back once they get through.
+// The server is told the smallest limit of all resolvers, since it
+// doesn't know which one a query comes through.
+type chunkState struct {
+	ceiling   int // response limit path discovery found, 0 if unknown
+	largest   int // size of the largest full fragment received, in bytes
+	resolvers map[string]*chunkLimit
+	mu        sync.Mutex
+}
+
+// chunkLimit is the adapted response limit through one resolver.
+type chunkLimit struct {
+	limit   int       // largest response to ask for in bytes, 0 if not shrunk
+	from    int       // the limit before the first shrink, grown back to
+	losses  int       // full fragments lost in a row
+	changed time.Time // when the limit last changed
+}
+
+// resetChunks forgets the adapted limits, for a path whose discovery found
+// responses of up to ceiling bytes get through, 0 if unknown.
+func (r *Resolver) resetChunks(ceiling int) {
+	r.chunks.mu.Lock()
+	defer r.chunks.mu.Unlock()
+	r.chunks.ceiling = ceiling
+	r.chunks.largest = 0
+	r.chunks.resolvers = nil
+}
+
+// observeChunk notes the outcome of a query through resolver for a full
+// response fragment: truncated or timed out, it counts as lost; queries
+// canceled once another resolver answered, or failed for reasons other
+// than size, don't count. A changed limit is announced to the server.
+func (r *Resolver) observeChunk(resolver string, resp []byte, err error) {
+	var netErr net.Error
+	var lost bool
+	switch {
+	case err == nil:
+		lost = len(resp) > 2 && resp[2]&0x02 != 0 // TC
+	case errors.As(err, &netErr) && netErr.Timeout():
+		lost = true
+	default:
+		return
+	}
+
+	c := &r.chunks
+	c.mu.Lock()
+	now := time.Now()
+	l := c.resolvers[resolver]
+	if l == nil {
+		if !lost {
+			c.largest = max(c.largest, len(resp))
+			c.mu.Unlock()
+			return
+		}
+		if c.resolvers == nil {
+			c.resolvers = make(map[string]*chunkLimit)
+		}
+		l = &chunkLimit{}
+		c.resolvers[resolver] = l
+	}
+
+	changed := false
+	if lost {
+		l.losses++
+		if from := c.limitOf(l); l.losses >= chunkLosses && from > minPathResponse {
+			if l.from == 0 {
+				l.from = from
+			}
+			l.limit = max(int(float64(from)*chunkShrink), minPathResponse)
+			l.losses = 0
+			l.changed = now
+			changed = true
+		}
+	} else {
+		c.largest = max(c.largest, len(resp))
+		l.losses = 0
+		if l.limit > 0 && l.limit < l.from && now.Sub(l.changed) >= chunkGrowInterval {
+			l.limit = min(l.limit+chunkGrowStep, l.from)
+			l.changed = now
+			changed = true
+		}
+	}
+	limit := l.limit
+	effective := c.effective(r.transport.Load().resolvers)
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	log.Printf("Chunk size: responses through %s limited to %d bytes", resolver, limit)
+	if effective > 0 {
+		r.paths.responseLimit.Store(int32(effective))
+		r.paths.announced.Store(0)
+		r.ensurePathAnnounced()
+	}
+}
+
+// limitOf returns the response limit through a resolver: its adapted
+// limit, else the one path discovery found, else the size of the largest
+// full fragment received.
+func (c *chunkState) limitOf(l *chunkLimit) int {
+	switch {
+	case l.limit > 0:
+		return l.limit
+	case c.ceiling > 0:
+		return c.ceiling
+	case c.largest > 0:
+		return c.largest
+	}
+	return defaultChunkResponse
+}
+
+// effective returns the response limit to announce: the smallest limit
+// of resolvers, or the one path discovery found if none was shrunk.
+func (c *chunkState) effective(resolvers []string) int {
+	limit := c.ceiling
+	for _, resolver := range resolvers {
+		if l := c.resolvers[resolver]; l != nil && l.limit > 0 && (limit == 0 || l.limit < limit) {
+			limit = l.limit
+		}
+	}
+	return limit
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"testing"
+)
+
+func TestChunkAdaptation(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.Resolvers = []string{"192.0.2.1:53", "192.0.2.2:53"}
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Stop()
+	r.paths.announcing.Store(true) // no announcement probes
+	a, b := config.Resolvers[0], config.Resolvers[1]
+	limit := func() int { return int(r.paths.responseLimit.Load()) }
+
+	// Responses are shrunk from the largest full fragment received, after
+	// consecutive losses through a resolver
+	r.observeChunk(a, make([]byte, 1000), nil)
+	r.observeChunk(a, nil, context.DeadlineExceeded)
+	if limit() != 0 {
+		t.Fatalf("Limit after one loss = %d, want 0", limit())
+	}
+	r.observeChunk(a, nil, context.DeadlineExceeded)
+	if limit() != 750 {
+		t.Fatalf("Limit after two losses = %d, want 750", limit())
+	}
+
+	// Queries canceled once another resolver answered don't count
+	r.observeChunk(a, nil, context.Canceled)
+	r.observeChunk(a, nil, context.Canceled)
+	if limit() != 750 {
+		t.Errorf("Limit after cancellations = %d, want 750", limit())
+	}
+
+	// Truncated responses count as lost, and the server gets the smallest
+	// limit of all resolvers
+	truncated := []byte{0, 0, 0x02, 0}
+	for range 4 {
+		r.observeChunk(b, truncated, nil)
+	}
+	if limit() != 562 {
+		t.Fatalf("Limit after four truncations = %d, want 562", limit())
+	}
+
+	// Limits grow back once responses get through for a while
+	r.observeChunk(b, make([]byte, 500), nil)
+	if limit() != 562 {
+		t.Errorf("Limit grew right after the shrink: %d", limit())
+	}
+	r.chunks.resolvers[b].changed = r.chunks.resolvers[b].changed.Add(-chunkGrowInterval)
+	r.observeChunk(b, make([]byte, 500), nil)
+	if want := 562 + chunkGrowStep; limit() != want {
+		t.Errorf("Limit after growing = %d, want %d", limit(), want)
+	}
+	for range 10 {
+		r.chunks.resolvers[b].changed = r.chunks.resolvers[b].changed.Add(-chunkGrowInterval)
+		r.observeChunk(b, make([]byte, 500), nil)
+	}
+	if limit() != 750 {
+		t.Errorf("Limit after growing back = %d, want 750, the other resolver's", limit())
+	}
+	if got := r.chunks.resolvers[b].limit; got != 1000 {
+		t.Errorf("Limit through %s grew to %d, want 1000", b, got)
+	}
+
+	// Path discovery starts over from what it found
+	r.resetChunks(1200)
+	r.observeChunk(a, nil, context.DeadlineExceeded)
+	r.observeChunk(a, nil, context.DeadlineExceeded)
+	if limit() != 900 {
+		t.Errorf("Limit after discovery and two losses = %d, want 900", limit())
+	}
+}
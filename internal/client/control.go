@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// controlTimeout bounds a control request
+const controlTimeout = 5 * time.Second
+
+var ErrControlInUse = errors.New("control socket is in use by another client")
+
+// ControlServer serves the status of a running resolver on a local Unix
+// domain socket, which only the user running the client can connect to.
+type ControlServer struct {
+	path   string
+	ln     net.Listener
+	server *http.Server
+}
+
+// NewControlServer listens on the control socket at path and serves the
+// resolver's status. A socket left behind by a client that exited is
+// replaced.
+func NewControlServer(r *Resolver, path string) (*ControlServer, error) {
+	// Only replace a stale socket, not one a running client serves
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrControlInUse, path)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("failed to create control socket: %s exists and isn't a socket", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	// systemd creates the runtime directory of an installed service, but
+	// not of one run by hand
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to restrict control socket %s: %w", path, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(r.Status()); err != nil {
+			log.Printf("Failed to write status: %v", err)
+		}
+	})
+
+	c := &ControlServer{
+		path:   path,
+		ln:     ln,
+		server: &http.Server{Handler: mux, ReadHeaderTimeout: controlTimeout},
+	}
+	go func() {
+		if err := c.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Control socket error: %v", err)
+		}
+	}()
+	return c, nil
+}
+
+// Close stops serving and removes the control socket.
+func (c *ControlServer) Close() error {
+	err := c.server.Close()
+	_ = os.Remove(c.path)
+	return err
+}
+
+// QueryStatus asks the client serving the control socket at path for its
+// status.
+func QueryStatus(ctx context.Context, path string) (*Status, error) {
+	httpClient := &http.Client{
+		Timeout: controlTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	defer httpClient.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://control/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the client at %s (is it running, and as this user?): %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("client returned status %s", resp.Status)
+	}
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlServer(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.transport.Load().Close()
+
+	r.status.record(nil)
+	r.status.record(errors.New("all resolvers failed"))
+
+	// Socket paths are limited to about 100 bytes, too short for t.TempDir
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatalf("MkdirTemp() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "client.sock")
+
+	control, err := NewControlServer(r, path)
+	if err != nil {
+		t.Fatalf("NewControlServer() error = %v", err)
+	}
+	if _, err := NewControlServer(r, path); !errors.Is(err, ErrControlInUse) {
+		t.Errorf("Second NewControlServer() error = %v, want %v", err, ErrControlInUse)
+	}
+
+	status, err := QueryStatus(context.Background(), path)
+	if err != nil {
+		t.Fatalf("QueryStatus() error = %v", err)
+	}
+	if status.ServerDomain != "t.example.com" || status.TunnelQueries != 2 || status.TunnelFailures != 1 {
+		t.Errorf("QueryStatus() = %+v", status)
+	}
+	if status.Healthy() {
+		t.Error("Healthy() = true after a failed exchange")
+	}
+	if len(status.Resolvers) != len(config.Resolvers) || status.Cache == nil {
+		t.Errorf("QueryStatus() resolvers = %v, cache = %v", status.Resolvers, status.Cache)
+	}
+	if len(status.RecentErrors) != 1 || status.RecentErrors[0].Message != "all resolvers failed" {
+		t.Errorf("QueryStatus() recent errors = %v", status.RecentErrors)
+	}
+
+	if err := control.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Control socket not removed")
+	}
+
+	// Other files aren't replaced
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := NewControlServer(r, path); err == nil {
+		t.Error("NewControlServer() replaced a regular file")
+	}
+	os.Remove(path)
+
+	// A socket left behind is replaced
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	control, err = NewControlServer(r, path)
+	if err != nil {
+		t.Fatalf("NewControlServer() over a stale socket error = %v", err)
+	}
+	control.Close()
+}
+
+func TestStatusRecentErrors(t *testing.T) {
+	var tracker statusTracker
+	for i := 0; i < recentErrorCount+5; i++ {
+		tracker.recordError(errors.New("error"))
+	}
+	if len(tracker.errors) != recentErrorCount {
+		t.Errorf("Kept %d errors, want %d", len(tracker.errors), recentErrorCount)
+	}
+}
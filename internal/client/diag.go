@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// probeSizes are the DNS response sizes Diagnose tries, in bytes: the
+// classic limit, the DNS flag day default, a full Ethernet frame and the
+// usual EDNS maximum.
+var probeSizes = []int{512, 1232, 1452, dns.MaxEDNSSize}
+
+var ErrProbeCutShort = errors.New("probe reply cut short")
+
+// ResolverDiagnosis is what Diagnose found out about one resolver.
+type ResolverDiagnosis struct {
+	Resolver string
+
+	// Err is why the server couldn't be reached through the resolver, nil
+	// if it was
+	Err error
+
+	// Latency is the round trip of a minimal probe
+	Latency time.Duration
+
+	// EDNSSize is the UDP payload size the resolver advertises in its
+	// response, 0 without EDNS
+	EDNSSize uint16
+
+	// MaxResponse is the size of the largest tunnel response, in bytes,
+	// that arrived intact
+	MaxResponse int
+}
+
+// Diagnosis is the result of Diagnose.
+type Diagnosis struct {
+	// QueryPayload is the number of bytes of payload a single query name
+	// carries under the server domain
+	QueryPayload int
+
+	// Resolvers are the findings of each resolver, in configured order
+	Resolvers []ResolverDiagnosis
+}
+
+// OK reports whether the server could be reached through any resolver.
+func (d *Diagnosis) OK() bool {
+	for _, r := range d.Resolvers {
+		if r.Err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Diagnose sends test queries, authenticated with the pre-shared key, to
+// the server through each resolver in parallel. It measures the round trip
+// and finds the largest response that survives each path, trying the
+// sizes in probeSizes until one fails. The resolver needn't be started.
+func (r *Resolver) Diagnose(ctx context.Context) *Diagnosis {
+	transport := r.transport.Load()
+	d := &Diagnosis{
+		QueryPayload: dns.QueryFragmentSize(r.domain),
+		Resolvers:    make([]ResolverDiagnosis, len(r.config.Resolvers)),
+	}
+
+	var wg sync.WaitGroup
+	for i, resolver := range r.config.Resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Resolvers[i] = r.diagnoseResolver(ctx, transport, resolver)
+		}()
+	}
+	wg.Wait()
+	return d
+}
+
+// diagnoseResolver probes the server through one resolver.
+func (r *Resolver) diagnoseResolver(ctx context.Context, transport *Transport, resolver string) ResolverDiagnosis {
+	result := ResolverDiagnosis{Resolver: resolver}
+
+	start := time.Now()
+	resp, size, err := r.probe(ctx, transport, resolver, 0, 0)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Latency = time.Since(start)
+	result.EDNSSize = resp.GetEDNS0Size()
+	result.MaxResponse = size
+
+	for _, target := range probeSizes {
+		_, size, err := r.probe(ctx, transport, resolver, max(r.encoding().carrier.FragmentSize(target, r.domain)-crypto.Overhead, 0), 0)
+		if err != nil {
+			break
+		}
+		result.MaxResponse = max(result.MaxResponse, size)
+	}
+	return result
+}
+
+// probe sends a probe asking for a reply of size bytes to the server
+// through resolver, and returns the response and its size. The probe
+// announces the response limit and carrier path discovery found, and is
+// padded to carry length bytes of fragment data to test longer query names.
+func (r *Resolver) probe(ctx context.Context, transport *Transport, resolver string, size, length int) (*dns.Message, int, error) {
+	return r.probeWith(ctx, transport, resolver, r.encoding(), size, length)
+}
+
+// probeWith is like probe but writes the probe and its reply in enc. It
+// still announces the carrier path discovery found.
+func (r *Resolver) probeWith(ctx context.Context, transport *Transport, resolver string, enc encoding, size, length int) (*dns.Message, int, error) {
+	msg := binary.BigEndian.AppendUint16(nil, uint16(size))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(r.paths.responseLimit.Load()))
+	msg = append(msg, byte(r.paths.carrier.Load()))
+	if pad := length - crypto.Overhead - len(msg); pad > 0 {
+		msg = append(msg, make([]byte, pad)...)
+	}
+	encrypted, err := r.cipher.Encrypt(msg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encrypt probe: %w", err)
+	}
+
+	id := uint16(atomic.AddUint32(&r.fragmentID, 1))
+	query, err := r.tunnelQuery(r.domain, enc, &dns.Fragment{Flags: dns.FragmentFlagProbe, ID: id, Total: 1, Data: encrypted})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	data, err := transport.queryResolver(ctx, resolver, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := dns.ParseMessage(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse tunnel response: %w", err)
+	}
+	if resp.Flags&0x0200 != 0 { // TC
+		return nil, 0, fmt.Errorf("%w: truncated at %d bytes", ErrProbeCutShort, len(data))
+	}
+	reply, err := replyFragment(resp, r.domain, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	plaintext, err := r.cipher.DecryptWithoutTimestamp(reply.Data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decrypt response: %w", err)
+	}
+	if len(plaintext) != size {
+		return nil, 0, ErrProbeCutShort
+	}
+	return resp, len(data), nil
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dnssec"
+)
+
+const (
+	flagAD     = 0x0020 // Authenticated Data
+	flagCD     = 0x0010 // Checking Disabled
+	ednsFlagDO = 0x8000 // DNSSEC OK, in the OPT record TTL
+)
+
+// newValidator returns a DNSSEC validator looking up keys through the
+// tunnel, or nil if validation is disabled. With trust anchor state, it
+// starts from the managed anchors.
+func (r *Resolver) newValidator(config *Config) *dnssec.Validator {
+	if !config.DNSSEC {
+		return nil
+	}
+	if r.anchors != nil {
+		return dnssec.NewValidator(r.anchors.TrustAnchors(), r.lookupDNSSEC)
+	}
+	return dnssec.NewValidator(configAnchors(config), r.lookupDNSSEC)
+}
+
+// configAnchors returns the configured trust anchors, or the root zone
+// keys if none are.
+func configAnchors(config *Config) []dnssec.TrustAnchor {
+	if len(config.TrustAnchors) == 0 {
+		return dnssec.DefaultTrustAnchors()
+	}
+	return config.TrustAnchors
+}
+
+// newAnchorManager loads the trust anchor state, seeded with the
+// configured anchors.
+func (r *Resolver) newAnchorManager(config *Config) (*dnssec.AnchorManager, error) {
+	m, err := dnssec.NewAnchorManager(config.TrustAnchorState, configAnchors(config), r.lookupDNSSEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trust anchor state: %w", err)
+	}
+	return m, nil
+}
+
+// refreshTrustAnchors keeps the managed trust anchors current, handing
+// them to the validator after each refresh.
+func (r *Resolver) refreshTrustAnchors() {
+	defer r.wg.Done()
+
+	for {
+		next, err := r.anchors.Refresh(r.ctx)
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Trust anchor refresh failed: %v", err)
+			r.status.recordError(fmt.Errorf("trust anchor refresh failed: %w", err))
+		}
+		if v := r.validator.Load(); v != nil {
+			v.SetTrustAnchors(r.anchors.TrustAnchors())
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// lookupDNSSEC sends a query with DNSSEC records requested and checking
+// disabled through the tunnel, for the keys and delegations validation
+// needs.
+func (r *Resolver) lookupDNSSEC(ctx context.Context, name dns.Name, rrType uint16) (*dns.Message, error) {
+	query := dns.CreateQuery(name, rrType, dns.GenerateQueryID())
+	query.Flags |= flagCD
+	query.SetEDNS0(dns.MaxEDNSSize, true)
+
+	resp, _, err := r.processTunneledQuery(ctx, query)
+	return resp, err
+}
+
+// resolveValidatedQuery resolves a query with a locally validated
+// response, from the cache if it holds one, and returns the response as
+// the stub asked for it.
+func (r *Resolver) resolveValidatedQuery(ctx context.Context, v *dnssec.Validator, query *dns.Message) ([]byte, error) {
+	response, ok := r.cachedResponse(query)
+	if !ok {
+		var err error
+		response, err = r.resolveValidated(ctx, v, query)
+		if err != nil {
+			return nil, fmt.Errorf("validated query failed: %w", err)
+		}
+	}
+
+	data, err := stubResponse(query, response).Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return data, nil
+}
+
+// resolveValidated sends the query through the tunnel with DNSSEC records
+// requested and validates the response. Bogus responses are an error
+// unless the stub disabled checking, and are never cached.
+func (r *Resolver) resolveValidated(ctx context.Context, v *dnssec.Validator, query *dns.Message) (*dns.Message, error) {
+	inner := *query
+	inner.Flags |= flagCD
+	inner.Additional = nil
+	inner.SetEDNS0(dns.MaxEDNSSize, true)
+
+	response, _, err := r.processTunneledQuery(ctx, &inner)
+	if err != nil {
+		return nil, err
+	}
+
+	security, err := v.Validate(ctx, response)
+	response.Flags &^= flagAD
+	switch security {
+	case dnssec.Secure:
+		response.Flags |= flagAD
+	case dnssec.Bogus:
+		if query.Flags&flagCD == 0 {
+			return nil, fmt.Errorf("DNSSEC validation of %s failed: %w", query.Question[0].Name, err)
+		}
+		return response, nil
+	}
+
+	if cache := r.cache.Load(); cache != nil {
+		cache.Put(query, response)
+	}
+	return response, nil
+}
+
+// stubResponse returns the response as the stub asked for it: without the
+// AD flag unless the stub set DO or AD (RFC 6840 Section 5.7), without
+// DNSSEC records and the DO flag unless it set DO, and without EDNS if the
+// query had none.
+func stubResponse(query, response *dns.Message) *dns.Message {
+	resp := *response
+	resp.ID = query.ID
+	resp.Question = query.Question
+
+	do := query.DO()
+	if !do && query.Flags&flagAD == 0 {
+		resp.Flags &^= flagAD
+	}
+
+	hasEDNS := query.GetEDNS0Size() != 0
+	filter := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch {
+			case rr.Type == dns.RRTypeOPT:
+				if !hasEDNS {
+					continue
+				}
+				if !do {
+					rr.TTL &^= ednsFlagDO
+				}
+			case !do && isDNSSECType(rr.Type) && rr.Type != query.Question[0].Type:
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Authority = filter(resp.Authority)
+	resp.Additional = filter(resp.Additional)
+	return &resp
+}
+
+// unvalidatedResponse returns a response the client didn't validate as the
+// stub asked for it, without the AD flag whatever the resolver set, so AD
+// only ever marks answers the client validated.
+func unvalidatedResponse(query *dns.Message, data []byte) ([]byte, error) {
+	resp, err := dns.ParseMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	resp.Flags &^= flagAD
+	return stubResponse(query, resp).Marshal()
+}
+
+// isDNSSECType reports whether records of the type are only returned to
+// queries with the DO flag.
+func isDNSSECType(rrType uint16) bool {
+	return rrType == dns.RRTypeRRSIG || rrType == dns.RRTypeNSEC || rrType == dns.RRTypeNSEC3
+}
+
+// validatorString describes the DNSSEC configuration for logging.
+func validatorString(config *Config) string {
+	if !config.DNSSEC {
+		return "disabled"
+	}
+	anchors := "root trust anchors"
+	if len(config.TrustAnchors) > 0 {
+		anchors = fmt.Sprintf("%d trust anchors", len(config.TrustAnchors))
+	}
+	if config.TrustAnchorState != "" {
+		anchors += ", RFC 5011 updates in " + config.TrustAnchorState
+	}
+	return anchors
+}
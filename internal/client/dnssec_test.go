@@ -0,0 +1,65 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestStubResponse(t *testing.T) {
+	query := newCacheTestQuery(t, "www.example.com", 1)
+	validated := newCacheTestResponse(query, 300)
+	validated.Flags |= flagAD
+	validated.Answer = append(validated.Answer, dns.RR{Name: query.Question[0].Name, Type: dns.RRTypeRRSIG, Class: dns.ClassIN, TTL: 300})
+	validated.Authority = []dns.RR{{Name: query.Question[0].Name, Type: dns.RRTypeNSEC3, Class: dns.ClassIN, TTL: 300}}
+	validated.SetEDNS0(dns.MaxEDNSSize, true)
+
+	tests := []struct {
+		name    string
+		edns    bool
+		do      bool
+		ad      bool
+		wantAD  bool
+		wantRRs int
+		wantOPT bool
+	}{
+		{"plain query", false, false, false, false, 1, false},
+		{"AD query", false, false, true, true, 1, false},
+		{"EDNS query", true, false, false, false, 1, true},
+		{"DO query", true, true, false, true, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newCacheTestQuery(t, "www.example.com", 7)
+			if tt.edns {
+				stub.SetEDNS0(1232, tt.do)
+			}
+			if tt.ad {
+				stub.Flags |= flagAD
+			}
+
+			resp := stubResponse(stub, validated)
+			if resp.ID != 7 {
+				t.Errorf("ID = %d, want 7", resp.ID)
+			}
+			if got := resp.Flags&flagAD != 0; got != tt.wantAD {
+				t.Errorf("AD = %v, want %v", got, tt.wantAD)
+			}
+			if got := len(resp.Answer) + len(resp.Authority); got != tt.wantRRs {
+				t.Errorf("Got %d records, want %d", got, tt.wantRRs)
+			}
+			if got := resp.GetEDNS0Size() != 0; got != tt.wantOPT {
+				t.Errorf("OPT present = %v, want %v", got, tt.wantOPT)
+			}
+			if resp.DO() != tt.do {
+				t.Errorf("DO = %v, want %v", resp.DO(), tt.do)
+			}
+		})
+	}
+
+	// The validated response is left intact for the cache
+	if len(validated.Answer) != 2 || !validated.DO() {
+		t.Error("stubResponse() modified the validated response")
+	}
+}
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	acl "github.com/AliRezaBeigy/dns-as-doh/internal/listener"
+)
+
+const (
+	// dohPath is the path DoH clients send queries to (RFC 8484 Section 3)
+	dohPath = "/dns-query"
+
+	// dohMaxMessage is the largest DNS message a DoH request may carry
+	dohMaxMessage = 65535
+
+	// dohReadTimeout bounds reading a DoH request's headers
+	dohReadTimeout = 10 * time.Second
+
+	// dohJSONPath is the path of JSON dialect queries, as Google Public
+	// DNS serves them
+	dohJSONPath = "/resolve"
+)
+
+// listenDoH opens the local DoH listener, serving HTTPS if a certificate
+// is configured and plain HTTP otherwise. Only clients in DoHAllow, or on
+// loopback if it is empty, may connect.
+func (r *Resolver) listenDoH() (net.Listener, *http.Server, error) {
+	if (r.config.DoHCert == "") != (r.config.DoHKey == "") {
+		return nil, nil, errors.New("the DoH listener needs both a certificate and a key, or neither")
+	}
+
+	server := &http.Server{
+		Handler:           r.dohHandler(),
+		ReadHeaderTimeout: dohReadTimeout,
+		BaseContext:       func(net.Listener) context.Context { return r.ctx },
+	}
+	if r.config.DoHCert != "" {
+		cert, err := tls.LoadX509KeyPair(r.config.DoHCert, r.config.DoHKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load DoH certificate: %w", err)
+		}
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	lc := &acl.Config{Addr: r.config.DoHAddr, Allow: r.config.DoHAllow}
+	ln, err := lc.Listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ln, server, nil
+}
+
+// serveDoH serves DoH requests on ln until the server is closed.
+func (r *Resolver) serveDoH(ln net.Listener, server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("DoH listener error: %v", err)
+	}
+}
+
+// dohScheme returns the URL scheme of the DoH listener.
+func (r *Resolver) dohScheme() string {
+	if r.config.DoHCert != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// dohHandler returns the handler of RFC 8484 DNS queries: GET requests
+// carry the query base64url encoded in the dns parameter, POST requests
+// in the body as application/dns-message. Queries in the JSON dialect, with
+// name and type parameters, are answered at /resolve like Google Public
+// DNS and at /dns-query like Cloudflare.
+func (r *Resolver) dohHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+dohJSONPath, r.handleJSONQuery)
+	mux.HandleFunc("GET "+dohPath, func(w http.ResponseWriter, req *http.Request) {
+		if !req.URL.Query().Has("dns") && req.URL.Query().Has("name") {
+			r.handleJSONQuery(w, req)
+			return
+		}
+		param := strings.TrimRight(req.URL.Query().Get("dns"), "=")
+		data, err := base64.RawURLEncoding.DecodeString(param)
+		if err != nil || len(data) == 0 {
+			http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+		if len(data) > dohMaxMessage {
+			http.Error(w, "query too large", http.StatusRequestURITooLong)
+			return
+		}
+		r.handleDoHQuery(w, req, data)
+	})
+	mux.HandleFunc("POST "+dohPath, func(w http.ResponseWriter, req *http.Request) {
+		if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != dohContentType {
+			http.Error(w, "content type must be "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, dohMaxMessage))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "failed to read query", http.StatusBadRequest)
+			return
+		}
+		r.handleDoHQuery(w, req, data)
+	})
+	return mux
+}
+
+// handleDoHQuery resolves a query received over DoH like one received on
+// the listen address and writes the response. Responses may be cached by
+// HTTP caches for as long as their lowest TTL.
+func (r *Resolver) handleDoHQuery(w http.ResponseWriter, req *http.Request, data []byte) {
+	query, err := dns.ParseMessage(data)
+	if err != nil || query.IsResponse() {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	response, err := r.respond(req.Context(), query, data)
+	if err != nil {
+		if req.Context().Err() == nil {
+			http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if resp, err := dns.ParseMessage(response); err == nil {
+		setCacheControl(w, resp)
+	}
+	_, _ = w.Write(response)
+}
+
+// handleJSONQuery resolves a query in the JSON dialect of DoH, the name
+// and type (A by default, a mnemonic or number) parameters, like
+// handleDoHQuery and writes the response as application/dns-json. cd=1
+// sets the CD bit, so answers failing DNSSEC validation are returned.
+func (r *Resolver) handleJSONQuery(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	name, err := dns.ParseName(params.Get("name"))
+	if err != nil || params.Get("name") == "" {
+		http.Error(w, "missing or invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.RRTypeA
+	if t := params.Get("type"); t != "" {
+		if qtype, err = dns.ParseType(t); err != nil {
+			http.Error(w, "invalid type parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := dns.CreateQuery(name, qtype, 0)
+	if cd := params.Get("cd"); cd == "1" || cd == "true" {
+		query.Flags |= flagCD
+	}
+	query.AddEDNS0(dns.MaxEDNSSize)
+	data, err := query.Marshal()
+	if err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	// respond already turns resolution failures into SERVFAIL; what's left
+	// is an error response it couldn't marshal, or one that doesn't parse.
+	// Neither needs the wire format, so answer SERVFAIL in JSON.
+	var resp *dns.Message
+	response, err := r.respond(req.Context(), query, data)
+	if err == nil {
+		resp, err = dns.ParseMessage(response)
+	}
+	if err != nil {
+		if req.Context().Err() != nil {
+			return
+		}
+		log.Printf("DoH JSON query for %s: %v", dns.FormatName(name), err)
+		resp = dns.CreateResponse(query)
+		resp.SetRcode(dns.RcodeServerFail)
+	}
+
+	w.Header().Set("Content-Type", dns.JSONContentType)
+	setCacheControl(w, resp)
+	_ = json.NewEncoder(w).Encode(dns.ToJSON(resp))
+}
+
+// setCacheControl lets HTTP caches keep a response for as long as its
+// lowest TTL.
+func setCacheControl(w http.ResponseWriter, resp *dns.Message) {
+	if ttl, ok := minTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+}
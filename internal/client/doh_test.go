@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestDoHHandler(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.DirectDomains = []dns.Name{mustParseName(t, "example.com")}
+	config.DirectResolvers = []string{startEchoResolver(t)}
+
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Stop()
+	handler := r.dohHandler()
+
+	query, _ := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 7).Marshal()
+	twoQuestions := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 8)
+	twoQuestions.Question = append(twoQuestions.Question, twoQuestions.Question[0])
+	twoData, _ := twoQuestions.Marshal()
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		wantStatus  int
+		wantRcode   uint16
+		wantID      uint16
+	}{
+		{"GET", http.MethodGet, dohPath + "?dns=" + base64.RawURLEncoding.EncodeToString(query), "", nil, http.StatusOK, dns.RcodeNoError, 7},
+		{"GET padded", http.MethodGet, dohPath + "?dns=" + base64.URLEncoding.EncodeToString(query), "", nil, http.StatusOK, dns.RcodeNoError, 7},
+		{"POST", http.MethodPost, dohPath, dohContentType, query, http.StatusOK, dns.RcodeNoError, 7},
+		{"two questions", http.MethodPost, dohPath, dohContentType, twoData, http.StatusOK, dns.RcodeFormatError, 8},
+		{"missing parameter", http.MethodGet, dohPath, "", nil, http.StatusBadRequest, 0, 0},
+		{"invalid parameter", http.MethodGet, dohPath + "?dns=!!", "", nil, http.StatusBadRequest, 0, 0},
+		{"wrong content type", http.MethodPost, dohPath, "application/json", query, http.StatusUnsupportedMediaType, 0, 0},
+		{"not a query", http.MethodPost, dohPath, dohContentType, []byte{1, 2, 3}, http.StatusBadRequest, 0, 0},
+		{"too large", http.MethodPost, dohPath, dohContentType, make([]byte, dohMaxMessage+1), http.StatusRequestEntityTooLarge, 0, 0},
+		{"wrong method", http.MethodPut, dohPath, dohContentType, query, http.StatusMethodNotAllowed, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != dohContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, dohContentType)
+			}
+			resp, err := dns.ParseMessage(rec.Body.Bytes())
+			if err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if resp.ID != tt.wantID || resp.Rcode() != tt.wantRcode {
+				t.Errorf("response ID %d rcode %d, want %d, %d", resp.ID, resp.Rcode(), tt.wantID, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func TestDoHListener(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1:0"
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.PathDiscovery = false
+	config.HealthCheckInterval = 0
+	config.DirectDomains = []dns.Name{mustParseName(t, "example.com")}
+	config.DirectResolvers = []string{startEchoResolver(t)}
+	config.DoHAddr = "127.0.0.1:0"
+
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer r.Stop()
+
+	query, _ := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 9).Marshal()
+	resp, err := http.Post("http://"+r.dohLn.Addr().String()+dohPath, dohContentType, bytes.NewReader(query))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s (%s)", resp.Status, body)
+	}
+	if msg, err := dns.ParseMessage(body); err != nil || msg.ID != 9 {
+		t.Errorf("response = %v, %v", msg, err)
+	}
+
+	// Both or neither of the certificate and key are needed
+	config.DoHCert = "cert.pem"
+	if _, _, err := r.listenDoH(); err == nil {
+		t.Error("listenDoH() with a certificate but no key succeeded")
+	}
+}
+
+func TestDoHJSON(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.DirectDomains = []dns.Name{mustParseName(t, "example.com")}
+	config.DirectResolvers = []string{startEchoResolver(t)}
+
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Stop()
+	handler := r.dohHandler()
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantType   uint16
+	}{
+		{"Google style", dohJSONPath + "?name=www.example.com&type=AAAA", http.StatusOK, dns.RRTypeAAAA},
+		{"Cloudflare style", dohPath + "?name=www.example.com&type=28", http.StatusOK, dns.RRTypeAAAA},
+		{"default type", dohJSONPath + "?name=www.example.com", http.StatusOK, dns.RRTypeA},
+		{"missing name", dohJSONPath + "?type=A", http.StatusBadRequest, 0},
+		{"invalid type", dohJSONPath + "?name=www.example.com&type=BOGUS", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != dns.JSONContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, dns.JSONContentType)
+			}
+			var resp dns.JSONMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if resp.Status != dns.RcodeNoError || len(resp.Question) != 1 ||
+				resp.Question[0].Name != "www.example.com." || resp.Question[0].Type != tt.wantType {
+				t.Errorf("response = %+v", resp)
+			}
+		})
+	}
+}
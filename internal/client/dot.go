@@ -0,0 +1,279 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	acl "github.com/AliRezaBeigy/dns-as-doh/internal/listener"
+)
+
+const (
+	// dotIdleTimeout is how long an idle DoT connection is kept open
+	// (RFC 7766 Section 6.2.3 suggests at least a few seconds)
+	dotIdleTimeout = 10 * time.Second
+
+	// dotCertLifetime is how long a self-signed DoT certificate is valid
+	dotCertLifetime = 365 * 24 * time.Hour
+)
+
+// dotServer is the local DNS over TLS endpoint.
+type dotServer struct {
+	ln     net.Listener
+	pin    string // SPKI pin of a self-signed certificate, "" otherwise
+	conns  map[net.Conn]struct{}
+	connMu sync.Mutex
+}
+
+// listenDoT opens the local DoT listener with the configured certificate,
+// or a self-signed one if none is configured. Only clients in DoTAllow,
+// or on loopback if it is empty, may connect.
+func (r *Resolver) listenDoT() (*dotServer, error) {
+	s := &dotServer{conns: make(map[net.Conn]struct{})}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case r.config.DoTCert != "" && r.config.DoTKey != "":
+		cert, err = tls.LoadX509KeyPair(r.config.DoTCert, r.config.DoTKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load DoT certificate: %w", err)
+		}
+	case r.config.DoTCert != "" || r.config.DoTKey != "":
+		return nil, errors.New("the DoT listener needs both a certificate and a key, or neither")
+	default:
+		cert, err = selfSignedCert(r.config.DoTAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DoT certificate: %w", err)
+		}
+		s.pin = spkiPin(cert.Leaf)
+	}
+
+	lc := &acl.Config{Addr: r.config.DoTAddr, Allow: r.config.DoTAllow}
+	ln, err := lc.Listen()
+	if err != nil {
+		return nil, err
+	}
+	s.ln = tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	return s, nil
+}
+
+// selfSignedCert returns a self-signed certificate for localhost, the
+// loopback addresses and the host of addr.
+func selfSignedCert(addr string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "dns-as-doh client"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(dotCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if ip == nil && host != "" && host != "localhost" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// spkiPin returns the SPKI pin of a certificate (RFC 7858 Section 4.2):
+// the base64 SHA-256 digest of its public key, as stub resolvers that pin
+// DoT servers take it.
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// acceptDoTLoop accepts DoT connections until the listener is closed.
+func (r *Resolver) acceptDoTLoop() {
+	defer r.wg.Done()
+
+	for {
+		conn, err := r.dot.ln.Accept()
+		if err != nil {
+			if r.ctx.Err() != nil || r.draining.Load() {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			log.Printf("DoT accept error: %v", err)
+			return
+		}
+		if !r.dot.track(conn) {
+			conn.Close()
+			return
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer r.dot.untrack(conn)
+
+			r.serveDoT(conn)
+		}()
+	}
+}
+
+// serveDoT answers length-prefixed DNS queries on a DoT connection until
+// it is closed or idle. Queries are resolved concurrently and answered as
+// they complete, so a slow one doesn't hold up those behind it (RFC 7766
+// Section 6.2.1.1).
+func (r *Resolver) serveDoT(conn net.Conn) {
+	var (
+		inflight sync.WaitGroup
+		writeMu  sync.Mutex
+	)
+	defer inflight.Wait()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+		if r.draining.Load() {
+			return
+		}
+
+		data, err := readStreamMessage(conn)
+		if err != nil {
+			return
+		}
+		query, err := dns.ParseMessage(data)
+		if err != nil || query.IsResponse() {
+			return
+		}
+
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+
+			response, err := r.respond(r.ctx, query, data)
+			if err != nil {
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_ = conn.SetWriteDeadline(time.Now().Add(r.config.Timeout))
+			if err := writeStreamMessage(conn, response); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// track registers an open connection so it can be woken and closed. It
+// returns false if the resolver is already stopping.
+func (s *dotServer) track(conn net.Conn) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.conns == nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack closes and unregisters a connection.
+func (s *dotServer) untrack(conn net.Conn) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	conn.Close()
+	delete(s.conns, conn)
+}
+
+// drain closes the listener and wakes connections waiting for a query, so
+// they close once their in-flight queries are answered.
+func (s *dotServer) drain() {
+	s.ln.Close()
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+}
+
+// close closes the listener and all connections.
+func (s *dotServer) close() {
+	s.ln.Close()
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// readStreamMessage reads a length-prefixed DNS message.
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeStreamMessage writes a length-prefixed DNS message.
+func writeStreamMessage(w io.Writer, data []byte) error {
+	if len(data) > math.MaxUint16 {
+		return io.ErrShortWrite
+	}
+
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(data)))
+	copy(buf[2:], data)
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestDoTListener(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenAddr = "127.0.0.1:0"
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.PathDiscovery = false
+	config.HealthCheckInterval = 0
+	config.DirectDomains = []dns.Name{mustParseName(t, "example.com")}
+	config.DirectResolvers = []string{startEchoResolver(t)}
+	config.DoTAddr = "127.0.0.1:0"
+
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer r.Stop()
+	if r.dot.pin == "" {
+		t.Error("No pin for the self-signed certificate")
+	}
+
+	// The self-signed certificate is for the loopback address, and its
+	// key matches the logged pin
+	conn, err := tls.Dial("tcp", r.dot.ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			cert := cs.PeerCertificates[0]
+			if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+				t.Errorf("VerifyHostname() error = %v", err)
+			}
+			if pin := spkiPin(cert); pin != r.dot.pin {
+				t.Errorf("Certificate pin = %s, want %s", pin, r.dot.pin)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	// Pipelined queries are all answered, in any order, and a query with
+	// two questions gets FORMERR
+	twoQuestions := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 3)
+	twoQuestions.Question = append(twoQuestions.Question, twoQuestions.Question[0])
+	queries := []*dns.Message{
+		dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 1),
+		dns.CreateQuery(mustParseName(t, "mail.example.com"), dns.RRTypeAAAA, 2),
+		twoQuestions,
+	}
+	for _, q := range queries {
+		data, _ := q.Marshal()
+		if err := writeStreamMessage(conn, data); err != nil {
+			t.Fatalf("write error = %v", err)
+		}
+	}
+	rcodes := make(map[uint16]uint16)
+	for range queries {
+		data, err := readStreamMessage(conn)
+		if err != nil {
+			t.Fatalf("read error = %v", err)
+		}
+		resp, err := dns.ParseMessage(data)
+		if err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		rcodes[resp.ID] = resp.Rcode()
+	}
+	want := map[uint16]uint16{1: dns.RcodeNoError, 2: dns.RcodeNoError, 3: dns.RcodeFormatError}
+	for id, rcode := range want {
+		if got, ok := rcodes[id]; !ok || got != rcode {
+			t.Errorf("Response to query %d: rcode %d (answered %v), want %d", id, got, ok, rcode)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	acl "github.com/AliRezaBeigy/dns-as-doh/internal/listener"
+)
+
+const (
+	// exportDNSPort is the port plain DNS is exported on
+	exportDNSPort = 53
+
+	// exportDoHPort is the port the DoH endpoint is exported on
+	exportDoHPort = 8053
+)
+
+// interfaceNetworks returns the addresses of an interface and the
+// networks they are in, except link-local ones, which guests can't reach
+// without a zone.
+func interfaceNetworks(name string) ([]netip.Prefix, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []netip.Prefix
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		networks = append(networks, netip.PrefixFrom(ip.Unmap(), ones))
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", name)
+	}
+	return networks, nil
+}
+
+// listenExport opens a plain DNS listener on dnsPort and a plain HTTP DoH
+// listener on dohPort at each address of ExportInterface, such as a
+// container or VM bridge, so guests that get the host's bridge address as
+// their resolver resolve through the tunnel. Only clients on the bridge's
+// networks are answered.
+func (r *Resolver) listenExport(dnsPort, dohPort int) ([]*listener, []net.Listener, error) {
+	networks, err := interfaceNetworks(r.config.ExportInterface)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to export to %s: %w", r.config.ExportInterface, err)
+	}
+
+	masked := make([]netip.Prefix, len(networks))
+	for i, n := range networks {
+		masked[i] = n.Masked()
+	}
+
+	var (
+		listeners []*listener
+		httpLns   []net.Listener
+	)
+	closeAll := func() {
+		for _, l := range listeners {
+			l.close()
+		}
+		for _, ln := range httpLns {
+			ln.Close()
+		}
+	}
+
+	for _, n := range networks {
+		addr := netip.AddrPortFrom(n.Addr(), uint16(dnsPort))
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, &listener{
+			conn:  conn,
+			route: RouteTunnel,
+			acl:   &acl.Config{Allow: masked},
+		})
+
+		lc := &acl.Config{Addr: net.JoinHostPort(n.Addr().String(), strconv.Itoa(dohPort)), Allow: masked}
+		ln, err := lc.Listen()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		httpLns = append(httpLns, ln)
+	}
+	return listeners, httpLns, nil
+}
+
+// exportHandler returns the handler of the exported DoH endpoint: DoH
+// queries at /dns-query and /resolve, and /resolv.conf naming the address the guest
+// connected to as its nameserver, for guests to provision themselves
+// with, e.g. curl http://172.17.0.1:8053/resolv.conf >/etc/resolv.conf.
+func (r *Resolver) exportHandler() http.Handler {
+	mux := http.NewServeMux()
+	doh := r.dohHandler()
+	mux.Handle(dohPath, doh)
+	mux.Handle(dohJSONPath, doh)
+	mux.HandleFunc("GET /resolv.conf", func(w http.ResponseWriter, req *http.Request) {
+		local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok {
+			http.Error(w, "unknown local address", http.StatusInternalServerError)
+			return
+		}
+		ap, err := netip.ParseAddrPort(local.String())
+		if err != nil {
+			http.Error(w, "unknown local address", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "# Resolve through the DNS tunnel client on the host\nnameserver %s\n", ap.Addr().Unmap())
+	})
+	return mux
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListenExport(t *testing.T) {
+	networks, err := interfaceNetworks("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	if !slices.Contains(networks, netip.MustParsePrefix("127.0.0.1/8")) {
+		t.Fatalf("interfaceNetworks(lo) = %v, want 127.0.0.1/8", networks)
+	}
+	if _, err := interfaceNetworks("no-such-interface"); err == nil {
+		t.Error("interfaceNetworks() of a missing interface succeeded")
+	}
+
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.ExportInterface = "lo"
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Stop()
+
+	listeners, lns, err := r.listenExport(0, 0)
+	if err != nil {
+		t.Fatalf("listenExport() error = %v", err)
+	}
+	if len(listeners) != len(networks) || len(lns) != len(networks) {
+		t.Fatalf("listenExport() opened %d DNS and %d DoH listeners, want %d", len(listeners), len(lns), len(networks))
+	}
+	for i, l := range listeners {
+		defer l.close()
+		defer lns[i].Close()
+		if l.route != RouteTunnel {
+			t.Errorf("exported listener route = %s, want %s", l.route, RouteTunnel)
+		}
+	}
+
+	acl := listeners[0].acl
+	if !acl.Allowed(&net.UDPAddr{IP: net.IPv4(127, 1, 2, 3)}) {
+		t.Error("a client on the bridge network is refused")
+	}
+	if acl.Allowed(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}) {
+		t.Error("a client off the bridge network is allowed")
+	}
+}
+
+func TestExportResolvConf(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Stop()
+
+	req := httptest.NewRequest(http.MethodGet, "/resolv.conf", nil)
+	local := &net.TCPAddr{IP: net.IPv4(172, 17, 0, 1), Port: exportDoHPort}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	rec := httptest.NewRecorder()
+	r.exportHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "nameserver 172.17.0.1\n") {
+		t.Errorf("resolv.conf = %q, want nameserver 172.17.0.1", rec.Body)
+	}
+}
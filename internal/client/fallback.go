@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// fallbackProbeInterval is how often the tunnel is probed while queries
+// are resolved directly
+const fallbackProbeInterval = 15 * time.Second
+
+// directFallback tracks whether queries fall back to direct resolution
+// because the tunnel is down.
+type directFallback struct {
+	after    atomic.Int32  // transport failures in a row that start it, 0 never
+	failures atomic.Int32  // transport failures in a row
+	active   atomic.Bool   // queries are resolved directly
+	queries  atomic.Uint64 // queries resolved directly since it started
+}
+
+// recordTunnel records the outcome of a tunnel exchange for the direct
+// fallback: after the configured number of transport failures in a row,
+// queries are resolved directly, in cleartext, until a probe gets through
+// the tunnel again. Other errors, such as failing to decrypt a reply, show
+// the tunnel carries messages and don't count.
+func (r *Resolver) recordTunnel(err error) {
+	f := &r.fallback
+	if err == nil {
+		f.failures.Store(0)
+		return
+	}
+	if !errors.Is(err, ErrTransport) {
+		return
+	}
+
+	after := f.after.Load()
+	if after <= 0 || f.failures.Add(1) < after || !f.active.CompareAndSwap(false, true) {
+		return
+	}
+	f.queries.Store(0)
+	log.Printf("WARNING: %d tunnel queries failed in a row (last: %v); resolving queries DIRECTLY IN CLEARTEXT against the resolvers until the tunnel works again", after, err)
+
+	r.background.Add(1)
+	go r.fallbackLoop()
+}
+
+// fallbackLoop probes the tunnel while queries are resolved directly, and
+// returns to the tunnel once a probe gets through.
+func (r *Resolver) fallbackLoop() {
+	defer r.background.Done()
+
+	ticker := time.NewTicker(fallbackProbeInterval)
+	defer ticker.Stop()
+	for r.fallback.active.Load() {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if r.probeTunnel(r.ctx) {
+			r.fallback.failures.Store(0)
+			if r.fallback.active.CompareAndSwap(true, false) {
+				log.Printf("Tunnel is working again after %d queries resolved directly in cleartext; resolving through the tunnel", r.fallback.queries.Load())
+			}
+			return
+		}
+		if r.fallback.active.Load() {
+			log.Printf("WARNING: tunnel still down; %d queries resolved directly in cleartext so far", r.fallback.queries.Load())
+		}
+	}
+}
+
+// probeTunnel reports whether a probe reaches the server through any of
+// the resolvers.
+func (r *Resolver) probeTunnel(ctx context.Context) bool {
+	var ok atomic.Bool
+	transport := r.transport.Load()
+	eachResolver(transport, func(_ int, resolver string) {
+		if _, _, err := r.probe(ctx, transport, resolver, 0, 0); err == nil {
+			ok.Store(true)
+		}
+	})
+	return ok.Load()
+}
+
+// setFallbackAfter sets the number of transport failures in a row after
+// which queries fall back to direct resolution, 0 for never. Disabling it
+// returns to the tunnel at once.
+func (r *Resolver) setFallbackAfter(n int) {
+	r.fallback.after.Store(int32(n))
+	if n <= 0 && r.fallback.active.CompareAndSwap(true, false) {
+		log.Printf("Direct fallback disabled; resolving through the tunnel")
+	}
+}
+
+// resolveFallback resolves a query directly against the resolvers, in
+// cleartext, while the tunnel is down. It reports whether the fallback is
+// active; if not, the query is left to the tunnel. With DNSSEC validation
+// on, the answers can't be validated, since the validator looks up keys
+// through the tunnel, so they are returned as unvalidated.
+func (r *Resolver) resolveFallback(ctx context.Context, query *dns.Message, data []byte) ([]byte, bool, error) {
+	if !r.fallback.active.Load() {
+		return nil, false, nil
+	}
+	r.fallback.queries.Add(1)
+	resp, err := r.resolveDirect(ctx, nil, data)
+	if err == nil && r.validator.Load() != nil {
+		resp, err = unvalidatedResponse(query, resp)
+	}
+	return resp, true, err
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// startEchoResolver starts a plain DNS resolver answering every query
+// with an empty response, and returns its address.
+func startEchoResolver(t *testing.T) string {
+	t.Helper()
+	return startPlainResolver(t, dns.CreateResponse)
+}
+
+// startPlainResolver starts a plain DNS resolver answering every query
+// with the response respond returns, and returns its address.
+func startPlainResolver(t *testing.T, respond func(*dns.Message) *dns.Message) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp, _ := respond(query).Marshal()
+			_, _ = conn.WriteToUDP(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDirectFallback(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.Resolvers = []string{startEchoResolver(t)}
+	config.DirectFallback = 3
+
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Stop()
+
+	transportErr := fmt.Errorf("%w: no resolver answered", ErrTransport)
+	r.recordTunnel(transportErr)
+	r.recordTunnel(transportErr)
+	r.recordTunnel(errors.New("failed to decrypt response")) // doesn't count
+	r.recordTunnel(nil)                                      // resets the count
+	r.recordTunnel(transportErr)
+	r.recordTunnel(transportErr)
+	if r.fallback.active.Load() {
+		t.Fatal("Fallback started before 3 transport failures in a row")
+	}
+	r.recordTunnel(transportErr)
+	if !r.fallback.active.Load() {
+		t.Fatal("Fallback not started after 3 transport failures in a row")
+	}
+
+	// Queries are answered directly by the resolvers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 7)
+	data, _ := query.Marshal()
+	r.handleQuery(&listener{conn: conn, route: RouteTunnel}, data, conn.LocalAddr().(*net.UDPAddr))
+
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No answer while falling back: %v", err)
+	}
+	if resp, err := dns.ParseMessage(buf[:n]); err != nil || resp.ID != 7 || resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("Answer while falling back = %v, %v", resp, err)
+	}
+	if status := r.Status(); !status.DirectFallback || status.DirectQueries != 1 {
+		t.Errorf("Status() = fallback %v, %d direct queries, want true, 1", status.DirectFallback, status.DirectQueries)
+	}
+
+	// Disabling the fallback returns to the tunnel
+	disabled := *config
+	disabled.DirectFallback = 0
+	r.Reload(&disabled)
+	if r.fallback.active.Load() {
+		t.Error("Fallback still active after being disabled")
+	}
+	for range 5 {
+		r.recordTunnel(transportErr)
+	}
+	if r.fallback.active.Load() {
+		t.Error("Disabled fallback started")
+	}
+}
+
+func TestDirectFallbackDNSSEC(t *testing.T) {
+	// A resolver claiming to have validated its answers
+	resolver := startPlainResolver(t, func(query *dns.Message) *dns.Message {
+		resp := dns.CreateResponse(query)
+		resp.Flags |= flagAD
+		resp.Answer = []dns.RR{
+			{Name: query.Question[0].Name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 60, Data: []byte{192, 0, 2, 1}},
+			{Name: query.Question[0].Name, Type: dns.RRTypeRRSIG, Class: dns.ClassIN, TTL: 60, Data: make([]byte, 20)},
+		}
+		resp.SetEDNS0(dns.MaxEDNSSize, true)
+		return resp
+	})
+
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+	config.Resolvers = []string{resolver}
+	config.DNSSEC = true
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Stop()
+	r.fallback.active.Store(true)
+
+	for _, do := range []bool{false, true} {
+		query := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 7)
+		if do {
+			query.SetEDNS0(dns.MaxEDNSSize, true)
+		}
+		data, _ := query.Marshal()
+		respData, ok, err := r.resolveFallback(context.Background(), query, data)
+		if !ok || err != nil {
+			t.Fatalf("resolveFallback() = %v, %v", ok, err)
+		}
+		resp, err := dns.ParseMessage(respData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Flags&flagAD != 0 {
+			t.Errorf("DO %v: the fallback answer carries the resolver's AD flag", do)
+		}
+		if want := map[bool]int{false: 1, true: 2}[do]; len(resp.Answer) != want {
+			t.Errorf("DO %v: %d answers, want %d", do, len(resp.Answer), want)
+		}
+		if hasEDNS := resp.GetEDNS0Size() != 0; hasEDNS != do {
+			t.Errorf("DO %v: answer has EDNS %v", do, hasEDNS)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var (
+	ErrUnexpectedFragment = errors.New("unexpected response fragment")
+	ErrNoResponseData     = errors.New("tunnel returned no response data")
+	ErrServerMaintenance  = errors.New("server is in maintenance mode")
+	ErrTransport          = errors.New("transport query failed")
+	ErrTruncated          = errors.New("tunnel response truncated by a resolver")
+)
+
+// exchangeFragments sends an encrypted query under domain as one or more
+// fragments with the given flags and returns the reassembled encrypted
+// response and the flags of its fragments.
+func (r *Resolver) exchangeFragments(ctx context.Context, domain dns.Name, payload []byte, flags byte) ([]byte, byte, error) {
+	id := uint16(atomic.AddUint32(&r.fragmentID, 1))
+
+	fragments, err := dns.SplitPayloadFlags(payload, id, flags, r.queryFragmentSize(domain))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fragment query: %w", err)
+	}
+
+	// Send all query fragments; the one completing the message on the
+	// server carries the first response fragment, the others are acked.
+	replies, err := r.sendFragments(ctx, domain, fragments, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var first *dns.Fragment
+	for _, reply := range replies {
+		if !reply.IsAck() {
+			first = reply
+			break
+		}
+	}
+
+	// A duplicate may have been acked before the message completed;
+	// ask for the first response fragment explicitly.
+	if first == nil {
+		first, err = r.sendFragment(ctx, domain, dns.NewFetchFragment(id, 0))
+		if err != nil {
+			return nil, 0, err
+		}
+		if first.IsAck() {
+			return nil, 0, ErrNoResponseData
+		}
+	}
+
+	if first.Seq != 0 {
+		return nil, 0, ErrUnexpectedFragment
+	}
+	if first.Total == 1 {
+		return first.Data, first.Flags, nil
+	}
+
+	// Fetch the remaining response fragments, all full but the last
+	fetches := make([]*dns.Fragment, 0, first.Total-1)
+	for seq := 1; seq < int(first.Total); seq++ {
+		fetches = append(fetches, dns.NewFetchFragment(id, uint8(seq)))
+	}
+
+	rest, err := r.sendFragments(ctx, domain, fetches, len(fetches)-1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response := append([]byte(nil), first.Data...)
+	for i, f := range rest {
+		if f.Total != first.Total || int(f.Seq) != i+1 {
+			return nil, 0, ErrUnexpectedFragment
+		}
+		response = append(response, f.Data...)
+	}
+
+	return response, first.Flags, nil
+}
+
+// sendFragments sends fragments concurrently and returns the replies in the
+// same order. The replies to the first full fragments are full response
+// fragments, whose loss adapts the response size (see observeChunk).
+func (r *Resolver) sendFragments(ctx context.Context, domain dns.Name, fragments []*dns.Fragment, full int) ([]*dns.Fragment, error) {
+	replies := make([]*dns.Fragment, len(fragments))
+	errs := make([]error, len(fragments))
+	observed := withObserver(ctx, r.observeChunk)
+
+	var wg sync.WaitGroup
+	for i, f := range fragments {
+		wg.Add(1)
+		go func(i int, f *dns.Fragment) {
+			defer wg.Done()
+			if i < full {
+				replies[i], errs[i] = r.sendFragment(observed, domain, f)
+			} else {
+				replies[i], errs[i] = r.sendFragment(ctx, domain, f)
+			}
+		}(i, f)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return replies, nil
+}
+
+// sendFragment sends a single fragment as a tunnel query under domain and
+// returns the response fragment.
+func (r *Resolver) sendFragment(ctx context.Context, domain dns.Name, f *dns.Fragment) (*dns.Fragment, error) {
+	tunnelData, err := r.tunnelQuery(domain, r.encoding(), f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send to resolvers and get response
+	respData, err := r.transport.Load().Query(ctx, tunnelData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTransport, err)
+	}
+
+	// Parse tunnel response
+	tunnelResp, err := dns.ParseMessage(respData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tunnel response: %w", err)
+	}
+	return replyFragment(tunnelResp, domain, f.ID)
+}
+
+// tunnelQuery encodes a fragment into a tunnel query under domain, written
+// in enc. The reply is authenticated, so names echoed in another case are
+// accepted.
+func (r *Resolver) tunnelQuery(domain dns.Name, enc encoding, f *dns.Fragment) ([]byte, error) {
+	// Encode into DNS name
+	level := dns.StealthLevel(r.stealth.Load())
+	tunnelName, err := enc.codec.Encode(f.Marshal(), dns.KeyID(r.config.KeyID), r.clientID, domain, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode payload: %w", err)
+	}
+	if r.randomCase.Load() && enc.codec == dns.CodecBase32 {
+		tunnelName = dns.RandomizeCase(tunnelName)
+	}
+
+	// Create tunnel query
+	tunnelQuery := &dns.Message{
+		ID:    dns.GenerateQueryID(),
+		Flags: 0x0100, // RD=1
+		Question: []dns.Question{
+			{
+				Name:  tunnelName,
+				Type:  enc.carrier.RRType(),
+				Class: dns.ClassIN,
+			},
+		},
+	}
+	tunnelQuery.AddEDNS0(4096)
+
+	// Marshal tunnel query
+	tunnelData, err := tunnelQuery.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tunnel query: %w", err)
+	}
+	return tunnelData, nil
+}
+
+// replyFragment returns the response fragment a tunnel response under
+// domain carries for message id.
+func replyFragment(tunnelResp *dns.Message, domain dns.Name, id uint16) (*dns.Fragment, error) {
+	// Check for errors
+	if tunnelResp.Flags&0x0200 != 0 { // TC
+		return nil, ErrTruncated
+	}
+	if tunnelResp.Rcode() != dns.RcodeNoError {
+		if code, _, ok := tunnelResp.ExtendedError(); ok && code == dns.EDENotReady {
+			return nil, ErrServerMaintenance
+		}
+		return nil, fmt.Errorf("tunnel response error: %d", tunnelResp.Rcode())
+	}
+
+	// Extract payload from TXT record
+	payload, err := dns.ExtractResponsePayload(tunnelResp, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract response payload: %w", err)
+	}
+
+	reply, err := dns.ParseFragment(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response fragment: %w", err)
+	}
+	if reply.ID != id {
+		return nil, ErrUnexpectedFragment
+	}
+
+	return reply, nil
+}
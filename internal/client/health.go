@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var (
+	ErrNoResolverAnswered = errors.New("no resolver answered")
+	ErrDomainUnreachable  = errors.New("resolvers can't reach the server domain")
+)
+
+// Resolver health constants
+const (
+	// DefaultHealthCheckInterval is how often resolvers are probed
+	DefaultHealthCheckInterval = 30 * time.Second
+
+	// quarantineFailures is the number of consecutive failures after which
+	// a resolver is quarantined
+	quarantineFailures = 3
+
+	// minQuarantine and maxQuarantine bound how long a failing resolver is
+	// avoided; the time doubles each time it fails again after release
+	minQuarantine = 10 * time.Second
+	maxQuarantine = 5 * time.Minute
+
+	// healthWeight is the weight of a new sample in the moving averages
+	healthWeight = 0.2
+
+	// minSuccessRate keeps the score of a resolver that always fails finite
+	minSuccessRate = 0.05
+
+	// latencySamples is the number of recent latencies kept per resolver
+	// for percentiles
+	latencySamples = 64
+)
+
+// resolverHealth tracks how well a resolver has been answering.
+type resolverHealth struct {
+	latency     time.Duration // moving average of successful exchanges
+	successRate float64       // moving average, 1 while unknown
+	failures    int           // consecutive failures
+	backoff     time.Duration // next quarantine duration
+	until       time.Time     // end of the current quarantine
+	probation   bool          // released from quarantine, not yet answered
+
+	// Recent latencies of successful exchanges, a ring buffer
+	samples  [latencySamples]time.Duration
+	nSamples int
+	next     int
+}
+
+// newResolverHealth returns the health of a resolver not yet used.
+func newResolverHealth() *resolverHealth {
+	return &resolverHealth{successRate: 1, backoff: minQuarantine}
+}
+
+// record updates the health with the outcome of an exchange.
+func (h *resolverHealth) record(success bool, latency time.Duration, now time.Time) {
+	if !success {
+		h.successRate *= 1 - healthWeight
+		h.failures++
+		if h.failures >= quarantineFailures || h.probation {
+			h.until = now.Add(h.backoff)
+			h.backoff = min(2*h.backoff, maxQuarantine)
+			h.failures = 0
+			h.probation = true
+		}
+		return
+	}
+
+	h.successRate = h.successRate*(1-healthWeight) + healthWeight
+	h.samples[h.next] = latency
+	h.next = (h.next + 1) % latencySamples
+	h.nSamples = min(h.nSamples+1, latencySamples)
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency += time.Duration(healthWeight * float64(latency-h.latency))
+	}
+	h.failures = 0
+	h.backoff = minQuarantine
+	h.until = time.Time{}
+	h.probation = false
+}
+
+// quarantined reports whether the resolver should be avoided.
+func (h *resolverHealth) quarantined(now time.Time) bool {
+	return now.Before(h.until)
+}
+
+// percentile returns the latency below which fraction p of the recent
+// successful exchanges answered, or 0 without enough samples.
+func (h *resolverHealth) percentile(p float64, minSamples int) time.Duration {
+	if h.nSamples < max(minSamples, 1) {
+		return 0
+	}
+	samples := slices.Clone(h.samples[:h.nSamples])
+	slices.Sort(samples)
+	return samples[min(int(p*float64(len(samples))), len(samples)-1)]
+}
+
+// score ranks resolvers, lower is better: the expected latency per
+// successful answer. Resolvers without latency samples score 0, so they
+// get tried.
+func (h *resolverHealth) score() float64 {
+	return float64(h.latency) / max(h.successRate, minSuccessRate)
+}
+
+// candidates returns the resolvers a query may be sent to: the healthy
+// ones, best first, or if all are quarantined, the one released soonest.
+func (t *Transport) candidates() []string {
+	t.statsMu.RLock()
+	defer t.statsMu.RUnlock()
+
+	now := time.Now()
+	var healthy []string
+	for _, r := range t.resolvers {
+		if !t.health[r].quarantined(now) {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		soonest := slices.MinFunc(t.resolvers, func(a, b string) int {
+			return t.health[a].until.Compare(t.health[b].until)
+		})
+		return []string{soonest}
+	}
+
+	slices.SortStableFunc(healthy, func(a, b string) int {
+		sa, sb := t.health[a].score(), t.health[b].score()
+		switch {
+		case sa < sb:
+			return -1
+		case sa > sb:
+			return 1
+		}
+		return 0
+	})
+	return healthy
+}
+
+// ResetHealth forgets the health of every resolver, e.g. after a network
+// change made what was measured on the old network meaningless.
+func (t *Transport) ResetHealth() {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	for _, r := range t.resolvers {
+		t.health[r] = newResolverHealth()
+	}
+}
+
+// healthRecords returns how well the resolvers that have been measured
+// answered, for the resolver history.
+func (t *Transport) healthRecords() map[string]resolverRecord {
+	t.statsMu.RLock()
+	defer t.statsMu.RUnlock()
+
+	records := make(map[string]resolverRecord)
+	for _, r := range t.resolvers {
+		h := t.health[r]
+		if h.latency == 0 && h.successRate == 1 {
+			continue
+		}
+		records[r] = resolverRecord{Latency: h.latency, SuccessRate: h.successRate}
+	}
+	return records
+}
+
+// restoreHealth ranks the resolvers by records measured earlier, such as
+// on a previous visit to the network. Resolvers without a record keep
+// their health.
+func (t *Transport) restoreHealth(records map[string]resolverRecord) {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	for _, r := range t.resolvers {
+		if record, ok := records[r]; ok {
+			t.health[r].latency = max(record.Latency, 0)
+			t.health[r].successRate = min(max(record.SuccessRate, minSuccessRate), 1)
+		}
+	}
+}
+
+// StartHealthChecks probes every resolver each interval with an SOA query
+// for name, such as the tunnel domain, so quarantined resolvers are
+// released once they answer again and latencies stay current without
+// spending tunnel queries.
+func (t *Transport) StartHealthChecks(name dns.Name, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		for {
+			t.probe(name)
+
+			wait := interval
+			if t.powerSaving.Load() {
+				wait *= powerSavingFactor
+			}
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// SetPowerSaving sets whether health checks are spaced powerSavingFactor
+// times further apart to save power.
+func (t *Transport) SetPowerSaving(saving bool) {
+	t.powerSaving.Store(saving)
+}
+
+// probe sends a probe query to each resolver that isn't quarantined or
+// whose quarantine has ended.
+func (t *Transport) probe(name dns.Name) {
+	var wg sync.WaitGroup
+	for _, resolver := range t.resolvers {
+		if t.isQuarantined(resolver) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			query := dns.CreateQuery(name, dns.RRTypeSOA, dns.GenerateQueryID())
+			query.AddEDNS0(4096)
+			data, err := query.Marshal()
+			if err != nil {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(t.ctx, t.timeout)
+			defer cancel()
+
+			start := time.Now()
+			resp, err := t.queryResolver(ctx, resolver, data)
+			if t.ctx.Err() != nil {
+				return
+			}
+			t.recordHealth(resolver, err == nil && probeAnswered(query, resp), time.Since(start))
+		}()
+	}
+	wg.Wait()
+}
+
+// Check sends an SOA query for name to every resolver and succeeds if one
+// answers it, explaining what to fix otherwise: resolvers that don't
+// answer at all, or answers showing the domain isn't served.
+func (t *Transport) Check(ctx context.Context, name dns.Name) error {
+	var mu sync.Mutex
+	var answered bool
+	var rcode uint16
+	var lastErr error
+
+	var wg sync.WaitGroup
+	for _, resolver := range t.resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			query := dns.CreateQuery(name, dns.RRTypeSOA, dns.GenerateQueryID())
+			query.AddEDNS0(4096)
+			data, err := query.Marshal()
+			if err != nil {
+				return
+			}
+
+			qctx, cancel := context.WithTimeout(ctx, t.timeout)
+			defer cancel()
+
+			start := time.Now()
+			resp, err := t.queryResolver(qctx, resolver, data)
+			success := err == nil && probeAnswered(query, resp)
+			t.recordHealth(resolver, success, time.Since(start))
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case success:
+				answered = true
+			case err != nil:
+				lastErr = fmt.Errorf("%s: %w", resolver, err)
+			default:
+				if msg, perr := dns.ParseMessage(resp); perr == nil && msg.ID == query.ID {
+					rcode = msg.Rcode()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	switch {
+	case answered:
+		return nil
+	case rcode != 0:
+		return fmt.Errorf("%w: %s answered with rcode %d (check that its NS records delegate it to the server and that the server is running)",
+			ErrDomainUnreachable, name, rcode)
+	default:
+		return fmt.Errorf("%w: %v (check -resolvers and that this host can send DNS queries to them)", ErrNoResolverAnswered, lastErr)
+	}
+}
+
+// isQuarantined reports whether a resolver is quarantined.
+func (t *Transport) isQuarantined(resolver string) bool {
+	t.statsMu.RLock()
+	defer t.statsMu.RUnlock()
+	h, ok := t.health[resolver]
+	return ok && h.quarantined(time.Now())
+}
+
+// probeAnswered reports whether resp answers the probe query: a response
+// with its ID, and an rcode an authoritative server would give.
+func probeAnswered(query *dns.Message, resp []byte) bool {
+	msg, err := dns.ParseMessage(resp)
+	if err != nil || msg.ID != query.ID || !msg.IsResponse() {
+		return false
+	}
+	rcode := msg.Rcode()
+	return rcode == dns.RcodeNoError || rcode == dns.RcodeNameError
+}
+
+// recordHealth updates a resolver's health.
+func (t *Transport) recordHealth(resolver string, success bool, latency time.Duration) {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	if h, ok := t.health[resolver]; ok {
+		h.record(success, latency, time.Now())
+	}
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestResolverHealthQuarantine(t *testing.T) {
+	h := newResolverHealth()
+	now := time.Now()
+
+	// Quarantined after consecutive failures, not before
+	for i := 0; i < quarantineFailures-1; i++ {
+		h.record(false, 0, now)
+	}
+	if h.quarantined(now) {
+		t.Fatal("Quarantined too early")
+	}
+	h.record(false, 0, now)
+	if !h.quarantined(now) || h.quarantined(now.Add(minQuarantine)) {
+		t.Fatalf("Quarantine: until %v, want %v", h.until, now.Add(minQuarantine))
+	}
+
+	// A failure after release quarantines again, for twice as long
+	now = now.Add(minQuarantine)
+	h.record(false, 0, now)
+	if !h.quarantined(now.Add(2*minQuarantine-time.Second)) || h.quarantined(now.Add(2*minQuarantine)) {
+		t.Errorf("Backoff: until %v, want %v", h.until.Sub(now), 2*minQuarantine)
+	}
+
+	// Backoff is capped
+	for i := 0; i < 20; i++ {
+		h.record(false, 0, now)
+	}
+	if h.backoff != maxQuarantine {
+		t.Errorf("Backoff: got %v, want %v", h.backoff, maxQuarantine)
+	}
+
+	// Success releases the resolver and resets the backoff
+	h.record(true, 50*time.Millisecond, now)
+	if h.quarantined(now) || h.backoff != minQuarantine || h.latency != 50*time.Millisecond {
+		t.Errorf("After success: until %v, backoff %v, latency %v", h.until, h.backoff, h.latency)
+	}
+	h.record(false, 0, now)
+	if h.quarantined(now) {
+		t.Error("Single failure after success quarantined")
+	}
+}
+
+func TestResolverHealthPercentile(t *testing.T) {
+	h := newResolverHealth()
+	if got := h.percentile(0.95, 1); got != 0 {
+		t.Errorf("percentile() without samples = %v, want 0", got)
+	}
+
+	// Only the most recent samples count
+	for i := 0; i < latencySamples; i++ {
+		h.record(true, time.Hour, time.Now())
+	}
+	for i := 1; i <= latencySamples; i++ {
+		h.record(true, time.Duration(i)*time.Millisecond, time.Now())
+	}
+	if got, want := h.percentile(0.95, 10), time.Duration(latencySamples*95/100+1)*time.Millisecond; got != want {
+		t.Errorf("percentile(0.95) = %v, want %v", got, want)
+	}
+	if got := h.percentile(0.5, latencySamples+1); got != 0 {
+		t.Errorf("percentile() with too few samples = %v, want 0", got)
+	}
+}
+
+func TestTransportCandidates(t *testing.T) {
+	resolvers := []string{"a:53", "b:53", "c:53", "d:53", "e:53"}
+	transport := NewTransport(resolvers, time.Second)
+	defer transport.Close()
+
+	latencies := map[string]time.Duration{"a:53": 90, "b:53": 10, "c:53": 50, "d:53": 20, "e:53": 5}
+	for r, latency := range latencies {
+		transport.recordHealth(r, true, latency*time.Millisecond)
+	}
+	for i := 0; i < quarantineFailures; i++ {
+		transport.recordHealth("e:53", false, 0)
+	}
+
+	got := transport.candidates()
+	want := []string{"b:53", "d:53", "c:53", "a:53"}
+	if len(got) != len(want) {
+		t.Fatalf("candidates() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("candidates() = %v, want %v", got, want)
+		}
+	}
+	if stats := transport.GetStats()["e:53"]; !stats.Quarantined {
+		t.Error("Quarantine not reported in stats")
+	}
+
+	// With every resolver quarantined, the one released soonest is used;
+	// e:53 failed again after its first quarantine and waits longer
+	for _, r := range resolvers {
+		for i := 0; i < quarantineFailures; i++ {
+			transport.recordHealth(r, false, 0)
+		}
+	}
+	if got := transport.candidates(); len(got) != 1 || got[0] == "e:53" {
+		t.Errorf("All quarantined: candidates() = %v", got)
+	}
+}
+
+func TestTransportHealthChecks(t *testing.T) {
+	// One resolver answers probes, the other drops them
+	answering, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer answering.Close()
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer silent.Close()
+
+	domain := dns.Name{[]byte("t"), []byte("example"), []byte("com")}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := answering.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil || query.Question[0].Type != dns.RRTypeSOA || !query.Question[0].Name.Equal(domain) {
+				continue
+			}
+			data, _ := dns.CreateResponse(query).Marshal()
+			_, _ = answering.WriteToUDP(data, addr)
+		}
+	}()
+
+	good, bad := answering.LocalAddr().String(), silent.LocalAddr().String()
+	transport := NewTransport([]string{good, bad}, 100*time.Millisecond)
+	defer transport.Close()
+
+	for i := 0; i < quarantineFailures; i++ {
+		transport.probe(domain)
+	}
+
+	stats := transport.GetStats()
+	if stats[good].Quarantined || stats[good].Latency == 0 {
+		t.Errorf("Answering resolver: %+v", stats[good])
+	}
+	if !stats[bad].Quarantined {
+		t.Errorf("Silent resolver not quarantined: %+v", stats[bad])
+	}
+	if got := transport.candidates(); len(got) != 1 || got[0] != good {
+		t.Errorf("candidates() = %v, want [%s]", got, good)
+	}
+}
+
+func TestTransportCheck(t *testing.T) {
+	domain := dns.Name{[]byte("t"), []byte("example"), []byte("com")}
+
+	// serve answers each query on a new resolver with rcode
+	serve := func(rcode uint16) string {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, addr, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				query, err := dns.ParseMessage(buf[:n])
+				if err != nil {
+					continue
+				}
+				resp := dns.CreateResponse(query)
+				resp.SetRcode(rcode)
+				data, _ := resp.Marshal()
+				_, _ = conn.WriteToUDP(data, addr)
+			}
+		}()
+		return conn.LocalAddr().String()
+	}
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer silent.Close()
+
+	tests := []struct {
+		name      string
+		resolvers []string
+		want      error
+	}{
+		{"answered", []string{silent.LocalAddr().String(), serve(dns.RcodeNameError)}, nil},
+		{"not delegated", []string{serve(dns.RcodeServerFail)}, ErrDomainUnreachable},
+		{"no answer", []string{silent.LocalAddr().String()}, ErrNoResolverAnswered},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewTransport(tt.resolvers, 100*time.Millisecond)
+			defer transport.Close()
+
+			err := transport.Check(context.Background(), domain)
+			if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+				t.Errorf("Check() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"log"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// upstreamKey marks contexts of queries asking for a server upstream.
+type upstreamKey struct{}
+
+// withUpstreamHint returns a context whose tunneled queries ask the server
+// for the named upstream instead of the client's UpstreamHint.
+func withUpstreamHint(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, name)
+}
+
+// upstreamHint returns the server upstream a query sent with ctx asks
+// for, or "" for the server's default.
+func (r *Resolver) upstreamHint(ctx context.Context) string {
+	if name, ok := ctx.Value(upstreamKey{}).(string); ok {
+		return name
+	}
+	return *r.upstream.Load()
+}
+
+// checkUpstreamRefused logs why the server refused a query asking for an
+// upstream, which it does if it has no upstream of that name or the key
+// may not use it.
+func (r *Resolver) checkUpstreamRefused(response *dns.Message, upstream string) {
+	if upstream == "" || response.Rcode() != dns.RcodeRefused {
+		return
+	}
+	if code, text, ok := response.ExtendedError(); ok && code == dns.EDEProhibited {
+		log.Printf("The server refused upstream %s: %s", upstream, text)
+	}
+}
+
+// withoutOPT returns the response without its OPT record, parsed and in
+// wire format.
+func withoutOPT(response *dns.Message) (*dns.Message, []byte, error) {
+	resp := *response
+	resp.Additional = nil
+	for _, rr := range response.Additional {
+		if rr.Type != dns.RRTypeOPT {
+			resp.Additional = append(resp.Additional, rr)
+		}
+	}
+	data, err := resp.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resp, data, nil
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+// Resolver history constants
+const (
+	// historyBucket is the storage bucket of per-network resolver records
+	historyBucket = "networks"
+
+	// historySaveInterval is how often the current network's records are
+	// saved while it doesn't change
+	historySaveInterval = 5 * time.Minute
+
+	// maxHistoryAge is how long records of a network not seen again are
+	// kept
+	maxHistoryAge = 90 * 24 * time.Hour
+)
+
+// resolverRecord is how well a resolver answered on a network.
+type resolverRecord struct {
+	Latency     time.Duration `json:"latency"`
+	SuccessRate float64       `json:"success_rate"`
+}
+
+// networkRecords are the resolver records of a network.
+type networkRecords struct {
+	Updated   time.Time                 `json:"updated"`
+	Resolvers map[string]resolverRecord `json:"resolvers"`
+}
+
+// resolverHistory keeps how well each resolver answered on the networks
+// the host has been on, so that on returning to one the resolvers that
+// worked there are preferred right away instead of being measured again.
+// Networks are told apart by a hash of their fingerprint, so the file
+// holds no addresses.
+type resolverHistory struct {
+	store storage.Store
+}
+
+// openResolverHistory opens the history kept in path, forgetting networks
+// not seen for maxHistoryAge.
+func openResolverHistory(path string) (*resolverHistory, error) {
+	store, err := storage.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	_ = store.ForEach(historyBucket, func(key string, value []byte) error {
+		var records networkRecords
+		if json.Unmarshal(value, &records) != nil || time.Since(records.Updated) > maxHistoryAge {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	for _, key := range stale {
+		_ = store.Delete(historyBucket, key)
+	}
+
+	return &resolverHistory{store: store}, nil
+}
+
+// networkKey returns the key of the records of the network with the given
+// fingerprint.
+func networkKey(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(sum[:16])
+}
+
+// load returns the resolver records of a network, or nil if it is unknown.
+func (h *resolverHistory) load(fingerprint string) map[string]resolverRecord {
+	if h == nil || fingerprint == "" {
+		return nil
+	}
+	value, err := h.store.Get(historyBucket, networkKey(fingerprint))
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to read resolver history: %v", err)
+		}
+		return nil
+	}
+	var records networkRecords
+	if err := json.Unmarshal(value, &records); err != nil {
+		log.Printf("Invalid resolver history: %v", err)
+		return nil
+	}
+	return records.Resolvers
+}
+
+// save stores the resolver records of a network. Records of resolvers
+// not among them, such as ones no longer configured, are kept.
+func (h *resolverHistory) save(fingerprint string, resolvers map[string]resolverRecord) {
+	if h == nil || fingerprint == "" || len(resolvers) == 0 {
+		return
+	}
+	merged := h.load(fingerprint)
+	if merged == nil {
+		merged = make(map[string]resolverRecord)
+	}
+	maps.Copy(merged, resolvers)
+	value, err := json.Marshal(networkRecords{Updated: time.Now().UTC(), Resolvers: merged})
+	if err != nil {
+		return
+	}
+	if err := h.store.Put(historyBucket, networkKey(fingerprint), value); err != nil {
+		log.Printf("Failed to save resolver history: %v", err)
+	}
+}
+
+// Close closes the history file.
+func (h *resolverHistory) Close() error {
+	if h == nil {
+		return nil
+	}
+	return h.store.Close()
+}
+
+// saveHistory saves how well the resolvers answered on the network with
+// the given fingerprint.
+func (r *Resolver) saveHistory(fingerprint string) {
+	if r.history == nil {
+		return
+	}
+	r.history.save(fingerprint, r.transport.Load().healthRecords())
+}
+
+// restoreHistory ranks transport's resolvers by how well they answered
+// when the host was last on the current network.
+func (r *Resolver) restoreHistory(transport *Transport) {
+	if r.history == nil {
+		return
+	}
+	if records := r.history.load(networkFingerprint()); len(records) > 0 {
+		transport.restoreHealth(records)
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolverHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := openResolverHistory(path)
+	if err != nil {
+		t.Fatalf("openResolverHistory() error = %v", err)
+	}
+
+	home := map[string]resolverRecord{
+		"8.8.8.8:53": {Latency: 80 * time.Millisecond, SuccessRate: 0.9},
+		"1.1.1.1:53": {Latency: 10 * time.Millisecond, SuccessRate: 1},
+	}
+	h.save("10.0.0.5,via 10.0.0.5", home)
+	h.save("10.0.0.5,via 10.0.0.5", map[string]resolverRecord{"1.1.1.1:53": {Latency: 20 * time.Millisecond, SuccessRate: 1}})
+
+	// A network long gone is forgotten on open
+	stale, _ := json.Marshal(networkRecords{Updated: time.Now().Add(-maxHistoryAge - time.Hour), Resolvers: home})
+	if err := h.store.Put(historyBucket, networkKey("192.168.1.9"), stale); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	h, err = openResolverHistory(path)
+	if err != nil {
+		t.Fatalf("openResolverHistory() error = %v", err)
+	}
+	defer h.Close()
+
+	records := h.load("10.0.0.5,via 10.0.0.5")
+	if len(records) != 2 || records["1.1.1.1:53"].Latency != 20*time.Millisecond || records["8.8.8.8:53"] != home["8.8.8.8:53"] {
+		t.Errorf("load() = %v", records)
+	}
+	if records := h.load("192.168.1.9"); records != nil {
+		t.Errorf("load() of a stale network = %v, want nil", records)
+	}
+	if records := h.load("172.16.0.2"); records != nil {
+		t.Errorf("load() of an unknown network = %v, want nil", records)
+	}
+}
+
+func TestTransportRestoreHealth(t *testing.T) {
+	transport := NewTransport([]string{"8.8.8.8:53", "1.1.1.1:53", "9.9.9.9:53"}, time.Second)
+	defer transport.Close()
+
+	transport.restoreHealth(map[string]resolverRecord{
+		"8.8.8.8:53": {Latency: 50 * time.Millisecond, SuccessRate: 0.2},
+		"1.1.1.1:53": {Latency: 30 * time.Millisecond, SuccessRate: 1},
+		"9.9.9.9:53": {Latency: 40 * time.Millisecond, SuccessRate: 1},
+	})
+	candidates := transport.candidates()
+	want := []string{"1.1.1.1:53", "9.9.9.9:53", "8.8.8.8:53"}
+	for i := range want {
+		if candidates[i] != want[i] {
+			t.Fatalf("candidates() = %v, want %v", candidates, want)
+		}
+	}
+
+	records := transport.healthRecords()
+	if len(records) != 3 || records["8.8.8.8:53"].SuccessRate != 0.2 {
+		t.Errorf("healthRecords() = %v", records)
+	}
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	acl "github.com/AliRezaBeigy/dns-as-doh/internal/listener"
+)
+
+// Route is how a listener resolves the queries it receives.
+type Route int
+
+const (
+	// RouteTunnel resolves queries through the tunnel
+	RouteTunnel Route = iota
+
+	// RouteDirect sends queries straight to resolvers, bypassing the
+	// tunnel
+	RouteDirect
+)
+
+// String returns the name of the route.
+func (r Route) String() string {
+	switch r {
+	case RouteTunnel:
+		return "tunnel"
+	case RouteDirect:
+		return "direct"
+	}
+	return "unknown"
+}
+
+// ListenerConfig is an extra local address with a route of its own, so
+// that applications pointed at it resolve names another way than those
+// using ListenAddr.
+type ListenerConfig struct {
+	Addr  string
+	Route Route
+
+	// Resolvers are the resolvers RouteDirect sends queries to, the
+	// client's resolvers if empty. Another client instance's listen
+	// address routes queries through that instance's server.
+	Resolvers []string
+
+	// Upstream names the server upstream RouteTunnel asks for, instead of
+	// the client's UpstreamHint
+	Upstream string
+}
+
+// String returns the listener in the form ParseListeners accepts.
+func (l ListenerConfig) String() string {
+	s := l.Addr + "=" + l.Route.String()
+	if len(l.Resolvers) > 0 {
+		s += "@" + strings.Join(l.Resolvers, "+")
+	}
+	if l.Upstream != "" {
+		s += "@" + l.Upstream
+	}
+	return s
+}
+
+// ParseListeners parses a comma-separated list of listeners, each an
+// address and its route: addr=tunnel, addr=tunnel@ followed by the name of
+// a server upstream, addr=direct, or addr=direct@ followed by resolvers
+// joined with "+" (e.g. 127.0.0.1:5301=direct@9.9.9.9:53).
+func ParseListeners(s string) ([]ListenerConfig, error) {
+	var listeners []ListenerConfig
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		addr, route, ok := strings.Cut(item, "=")
+		if !ok || addr == "" {
+			return nil, fmt.Errorf("invalid listener %q, want addr=route", item)
+		}
+		l := ListenerConfig{Addr: addr}
+
+		route, resolvers, _ := strings.Cut(route, "@")
+		switch strings.ToLower(route) {
+		case "tunnel":
+			l.Route = RouteTunnel
+		case "direct":
+			l.Route = RouteDirect
+		default:
+			return nil, fmt.Errorf("invalid route %q of listener %s, want tunnel or direct", route, addr)
+		}
+
+		switch {
+		case resolvers == "":
+		case l.Route == RouteTunnel:
+			if err := dns.CheckUpstreamName(resolvers); err != nil {
+				return nil, fmt.Errorf("listener %s: %w", addr, err)
+			}
+			l.Upstream = resolvers
+		default:
+			l.Resolvers = strings.Split(resolvers, "+")
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listener is a local address the client answers queries on.
+type listener struct {
+	conn      *net.UDPConn
+	route     Route
+	transport *Transport  // RouteDirect's own resolvers, nil for the client's
+	upstream  string      // RouteTunnel's own server upstream, "" for the client's
+	acl       *acl.Config // clients answered, nil for any
+}
+
+// listen opens the extra listeners.
+func (r *Resolver) listen(configs []ListenerConfig) ([]*listener, error) {
+	var listeners []*listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.close()
+		}
+	}
+
+	for _, c := range configs {
+		addr, err := net.ResolveUDPAddr("udp", c.Addr)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("invalid listen address %s: %w", c.Addr, err)
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to listen on %s: %w", c.Addr, err)
+		}
+
+		l := &listener{conn: conn, route: c.Route, upstream: c.Upstream}
+		if len(c.Resolvers) > 0 {
+			l.transport = NewTransport(c.Resolvers, r.config.Timeout)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// close closes the listener's socket and transport.
+func (l *listener) close() {
+	l.conn.Close()
+	if l.transport != nil {
+		l.transport.Close()
+	}
+}
+
+// resolveDirect resolves a query with the transport's resolvers, or if
+// nil the client's, directly, bypassing the tunnel and the cache.
+func (r *Resolver) resolveDirect(ctx context.Context, transport *Transport, data []byte) ([]byte, error) {
+	if transport == nil {
+		transport = r.transport.Load()
+	}
+
+	resp, err := transport.Query(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("direct query failed: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners(" 127.0.0.1:5301=direct, [::1]:5302=Tunnel,127.0.0.1:5303=direct@9.9.9.9:53+tls://dns.quad9.net,127.0.0.1:5304=tunnel@eu")
+	if err != nil {
+		t.Fatalf("ParseListeners() error = %v", err)
+	}
+	want := []ListenerConfig{
+		{Addr: "127.0.0.1:5301", Route: RouteDirect},
+		{Addr: "[::1]:5302", Route: RouteTunnel},
+		{Addr: "127.0.0.1:5303", Route: RouteDirect, Resolvers: []string{"9.9.9.9:53", "tls://dns.quad9.net"}},
+		{Addr: "127.0.0.1:5304", Route: RouteTunnel, Upstream: "eu"},
+	}
+	if !slices.EqualFunc(listeners, want, func(a, b ListenerConfig) bool {
+		return a.Addr == b.Addr && a.Route == b.Route && slices.Equal(a.Resolvers, b.Resolvers) && a.Upstream == b.Upstream
+	}) {
+		t.Errorf("ParseListeners() = %v, want %v", listeners, want)
+	}
+
+	for _, l := range listeners {
+		again, err := ParseListeners(l.String())
+		if err != nil || len(again) != 1 || again[0].String() != l.String() {
+			t.Errorf("ParseListeners(%q) = %v, %v", l.String(), again, err)
+		}
+	}
+
+	for _, in := range []string{"127.0.0.1:5301", "=direct", "127.0.0.1:5301=proxy", "127.0.0.1:5301=tunnel@9.9.9.9:53"} {
+		if _, err := ParseListeners(in); err == nil {
+			t.Errorf("ParseListeners(%q) accepted an invalid listener", in)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Path discovery constants
+const (
+	// minPathResponse is the smallest response size path discovery
+	// tries, in bytes: the classic DNS limit every path carries
+	minPathResponse = 512
+
+	// pathResponseStep is the precision, in bytes, to which path
+	// discovery finds the largest response
+	pathResponseStep = 16
+
+	// pathNameJitter is by how many bytes the names of two messages of
+	// the same size can differ, with their random padding base32 encoded
+	pathNameJitter = (dns.MaxPadding - dns.MinPadding) * 8 / 5
+
+	// pathAnnounceIdle is how long the tunnel may be idle before the
+	// response limit is announced to the server again, shorter than the
+	// server keeps idle clients
+	pathAnnounceIdle = 10 * time.Minute
+
+	// pathDiscoveryTimeout bounds path discovery through all resolvers
+	pathDiscoveryTimeout = 2 * time.Minute
+
+	// pathCodecProbes is how many probes must get through in an encoding
+	// for a path to count as carrying it, so that random ciphertext that
+	// happened to avoid the bytes a resolver mangles doesn't pass
+	pathCodecProbes = 2
+)
+
+var ErrPathUnreachable = errors.New("server unreachable through every resolver")
+
+// pathLimits is what path discovery found out about the path to the
+// server through one resolver.
+type pathLimits struct {
+	// querySlack is how many bytes short of a full query fragment the
+	// fragments must stay for their names to arrive intact
+	querySlack int
+
+	// maxResponse is the size of the largest response, in bytes, that
+	// arrived intact
+	maxResponse int
+}
+
+// encoding is how tunnel messages are written: query names in a codec,
+// responses in a carrier.
+type encoding struct {
+	codec   dns.Codec
+	carrier dns.Carrier
+}
+
+// pathState holds the limits path discovery found for all resolvers
+// together, which fragmentation follows.
+type pathState struct {
+	codec         atomic.Int32 // dns.Codec of query names
+	carrier       atomic.Int32 // dns.Carrier of responses
+	querySlack    atomic.Int32 // query fragment bytes left unused
+	responseLimit atomic.Int32 // response size announced to the server, 0 for its default
+	announced     atomic.Int64 // when the server last acted on the limit, Unix nanoseconds
+	announcing    atomic.Bool  // the limit is being announced
+	mu            sync.Mutex   // serializes discovery
+}
+
+// encoding returns how tunnel messages are written: in the densest codec
+// and the first carrier path discovery found every resolver carries. With
+// 0x20 query names are base32, whose random case only base32 survives.
+func (r *Resolver) encoding() encoding {
+	enc := encoding{
+		codec:   dns.Codec(r.paths.codec.Load()),
+		carrier: dns.Carrier(r.paths.carrier.Load()),
+	}
+	if r.randomCase.Load() {
+		enc.codec = dns.CodecBase32
+	}
+	return enc
+}
+
+// queryFragmentSize returns the number of data bytes a query fragment
+// under domain carries: as many as fit the name, less the slack path
+// discovery found some resolver needs.
+func (r *Resolver) queryFragmentSize(domain dns.Name) int {
+	size := r.encoding().codec.QueryFragmentSize(domain)
+	return max(size-int(r.paths.querySlack.Load()), min(size, 1))
+}
+
+// negotiate finds how tunnel messages through resolver are best written:
+// the first carrier, in order of preference, whose responses come back,
+// and then the densest codec, up to MaxCodec, whose query names reach the
+// server intact. The server reads the codec from each name and the carrier
+// from each query's type, so probes it answers show the whole path
+// carries them. The probes are minimal, so paths that cut long names short
+// don't fail them.
+func (r *Resolver) negotiate(ctx context.Context, transport *Transport, resolver string) (encoding, error) {
+	try := func(enc encoding) error {
+		for range pathCodecProbes {
+			if _, _, err := r.probeWith(ctx, transport, resolver, enc, 0, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	enc := encoding{codec: dns.CodecBase32}
+	var err error
+	for enc.carrier = dns.CarrierTXT; enc.carrier.Valid(); enc.carrier++ {
+		if err = try(enc); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return encoding{}, err
+	}
+
+	for codec := r.config.MaxCodec; codec > dns.CodecBase32; codec-- {
+		if try(encoding{codec: codec, carrier: enc.carrier}) == nil {
+			enc.codec = codec
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return enc, nil
+}
+
+// discoverPath finds how long query names and how large responses arrive
+// intact through resolver, by binary search with probes. Probes that get
+// lost, like ones that get mangled, count against a size.
+func (r *Resolver) discoverPath(ctx context.Context, transport *Transport, resolver string) (pathLimits, error) {
+	if _, _, err := r.probe(ctx, transport, resolver, 0, 0); err != nil {
+		return pathLimits{}, err
+	}
+
+	// The smallest slack, i.e. the longest name, that arrives intact.
+	// Names of the same length of data vary with their random padding, so
+	// a path that cut some short keeps a margin for the longest padding.
+	enc := r.encoding()
+	full := enc.codec.QueryFragmentSize(r.domain)
+	shortest := min(crypto.Overhead+4, full)
+	slack := sort.Search(full-shortest, func(slack int) bool {
+		_, _, err := r.probe(ctx, transport, resolver, 0, full-slack)
+		return err == nil
+	})
+	if slack > 0 {
+		slack = min(slack+dns.MaxPadding-dns.MinPadding, full-shortest)
+	}
+
+	// The largest response size that arrives intact, asked for with names
+	// as long as tunnel queries use, since responses echo them. Both the
+	// probes' names and later ones vary in length, so the size found
+	// keeps a margin for both.
+	steps := (dns.MaxEDNSSize-minPathResponse)/pathResponseStep + 1
+	step := sort.Search(steps, func(step int) bool {
+		size := dns.MaxEDNSSize - step*pathResponseStep
+		_, _, err := r.probe(ctx, transport, resolver, max(enc.carrier.FragmentSize(size, r.domain)-crypto.Overhead, 0), full-slack)
+		return err == nil
+	})
+
+	if err := ctx.Err(); err != nil {
+		return pathLimits{}, err
+	}
+	return pathLimits{
+		querySlack:  slack,
+		maxResponse: max(dns.MaxEDNSSize-step*pathResponseStep-2*pathNameJitter, minPathResponse),
+	}, nil
+}
+
+// DiscoverPaths runs path discovery through every resolver in parallel.
+// Tunnel messages are first written in the densest codec and the first
+// carrier every resolver that reached the server carries, then later query
+// fragments are sized so their names arrive intact through all of them,
+// and the server is told the carrier and the largest response all of them
+// carry, to size response fragments by.
+func (r *Resolver) DiscoverPaths(ctx context.Context) error {
+	r.paths.mu.Lock()
+	defer r.paths.mu.Unlock()
+
+	transport := r.transport.Load()
+	encodings := make([]encoding, len(transport.resolvers))
+	errs := make([]error, len(transport.resolvers))
+	eachResolver(transport, func(i int, resolver string) {
+		encodings[i], errs[i] = r.negotiate(ctx, transport, resolver)
+	})
+
+	enc := encoding{codec: r.config.MaxCodec}
+	reached := false
+	for i := range transport.resolvers {
+		if errs[i] == nil {
+			enc.codec = min(enc.codec, encodings[i].codec)
+			enc.carrier = max(enc.carrier, encodings[i].carrier)
+			reached = true
+		}
+	}
+	if !reached {
+		return fmt.Errorf("%w: %w", ErrPathUnreachable, errs[0])
+	}
+	r.paths.codec.Store(int32(enc.codec))
+	r.paths.carrier.Store(int32(enc.carrier))
+
+	limits := make([]pathLimits, len(transport.resolvers))
+	eachResolver(transport, func(i int, resolver string) {
+		if errs[i] == nil {
+			limits[i], errs[i] = r.discoverPath(ctx, transport, resolver)
+		}
+	})
+
+	var slack, response int
+	var paths []string
+	for i, resolver := range transport.resolvers {
+		if errs[i] != nil {
+			continue
+		}
+		slack = max(slack, limits[i].querySlack)
+		if len(paths) == 0 || limits[i].maxResponse < response {
+			response = limits[i].maxResponse
+		}
+		paths = append(paths, resolver)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("%w: %w", ErrPathUnreachable, errs[0])
+	}
+
+	r.paths.querySlack.Store(int32(slack))
+	r.resetChunks(response)
+	r.paths.responseLimit.Store(int32(response))
+	if err := r.announcePath(ctx, transport, paths[0]); err != nil {
+		return err
+	}
+
+	enc = r.encoding()
+	log.Printf("Path discovery: %s query names, %s responses, query fragments of %d bytes, responses of up to %d bytes",
+		enc.codec, enc.carrier, r.queryFragmentSize(r.domain), response)
+	return nil
+}
+
+// eachResolver calls fn for every resolver of transport in parallel and
+// waits for all calls to return.
+func eachResolver(transport *Transport, fn func(i int, resolver string)) {
+	var wg sync.WaitGroup
+	for i, resolver := range transport.resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(i, resolver)
+		}()
+	}
+	wg.Wait()
+}
+
+// announcePath tells the server the response limit path discovery found
+// with a probe through resolver.
+func (r *Resolver) announcePath(ctx context.Context, transport *Transport, resolver string) error {
+	if _, _, err := r.probe(ctx, transport, resolver, 0, 0); err != nil {
+		return err
+	}
+	r.paths.announced.Store(time.Now().UnixNano())
+	return nil
+}
+
+// ensurePathAnnounced announces the response limit again in the
+// background if the server may have forgotten it: after the tunnel has
+// been idle for pathAnnounceIdle, or after an exchange got lost.
+func (r *Resolver) ensurePathAnnounced() {
+	if r.paths.responseLimit.Load() == 0 ||
+		time.Since(time.Unix(0, r.paths.announced.Load())) < pathAnnounceIdle ||
+		!r.paths.announcing.CompareAndSwap(false, true) {
+		return
+	}
+
+	r.background.Add(1)
+	go func() {
+		defer r.background.Done()
+		defer r.paths.announcing.Store(false)
+
+		transport := r.transport.Load()
+		if len(transport.resolvers) > 0 {
+			_ = r.announcePath(r.ctx, transport, transport.candidates()[0])
+		}
+	}()
+}
+
+// pathUsed notes an exchange's outcome: a successful one shows the server
+// still acts on the response limit, a lost one that it may not.
+func (r *Resolver) pathUsed(err error) {
+	switch {
+	case err == nil:
+		r.paths.announced.Store(time.Now().UnixNano())
+	case errors.Is(err, ErrTransport):
+		r.paths.announced.Store(0)
+	}
+}
+
+// startPathDiscovery runs path discovery in the background: at startup,
+// and again when the network or the resolvers change.
+func (r *Resolver) startPathDiscovery() {
+	if !r.config.PathDiscovery {
+		return
+	}
+
+	r.background.Add(1)
+	go func() {
+		defer r.background.Done()
+
+		ctx, cancel := context.WithTimeout(r.ctx, pathDiscoveryTimeout)
+		defer cancel()
+		if err := r.DiscoverPaths(ctx); err != nil && r.ctx.Err() == nil {
+			log.Printf("Path discovery failed: %v", err)
+		}
+	}()
+}
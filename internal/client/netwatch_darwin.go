@@ -0,0 +1,27 @@
+//go:build darwin
+// +build darwin
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchRoutes signals changed whenever an interface, address or route
+// changes, as reported on a routing socket, until ctx is done.
+func watchRoutes(ctx context.Context, changed chan<- struct{}) error {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+	return readNotifications(ctx, os.NewFile(uintptr(fd), "route"), changed)
+}
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchRoutes signals changed whenever a link, address or route changes,
+// as reported over netlink, until ctx is done.
+func watchRoutes(ctx context.Context, changed chan<- struct{}) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	groups := unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+		unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: uint32(groups)}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to subscribe to netlink route changes: %w", err)
+	}
+	return readNotifications(ctx, os.NewFile(uintptr(fd), "netlink"), changed)
+}
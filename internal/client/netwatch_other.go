@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+// watchRoutes isn't supported on this platform; the network is polled.
+func watchRoutes(ctx context.Context, changed chan<- struct{}) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,35 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// readNotifications signals changed for each message read from a
+// non-blocking notification socket, until ctx is done.
+func readNotifications(ctx context.Context, f *os.File, changed chan<- struct{}) error {
+	defer f.Close()
+
+	// Closing the file interrupts the blocked read
+	stop := context.AfterFunc(ctx, func() { f.Close() })
+	defer stop()
+
+	buf := make([]byte, 8192)
+	for {
+		_, err := f.Read(buf)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, syscall.ENOBUFS):
+			// Notifications were dropped, so something changed
+		case err != nil:
+			return err
+		}
+		notifyChange(changed)
+	}
+}
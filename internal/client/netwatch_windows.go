@@ -0,0 +1,73 @@
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	iphlpapi                         = windows.NewLazySystemDLL("iphlpapi.dll")
+	procNotifyRouteChange2           = iphlpapi.NewProc("NotifyRouteChange2")
+	procNotifyUnicastIpAddressChange = iphlpapi.NewProc("NotifyUnicastIpAddressChange")
+	procCancelMibChangeNotify2       = iphlpapi.NewProc("CancelMibChangeNotify2")
+	changeCallback                   = windows.NewCallback(onNetworkChange) // callbacks are never freed, so there is one
+	changeWatchers                   = make(map[uintptr]chan<- struct{})
+	changeWatchersMu                 sync.Mutex
+	nextChangeWatcher                uintptr = 1
+)
+
+// onNetworkChange is called by Windows on one of its threads for each
+// route or address change, with the watcher's key as context.
+func onNetworkChange(key, row, notificationType uintptr) uintptr {
+	changeWatchersMu.Lock()
+	changed, ok := changeWatchers[key]
+	changeWatchersMu.Unlock()
+	if ok {
+		notifyChange(changed)
+	}
+	return 0
+}
+
+// watchRoutes signals changed whenever a route or unicast address changes,
+// as reported by the IP Helper API, until ctx is done.
+func watchRoutes(ctx context.Context, changed chan<- struct{}) error {
+	if err := procNotifyRouteChange2.Find(); err != nil {
+		return err
+	}
+
+	changeWatchersMu.Lock()
+	key := nextChangeWatcher
+	nextChangeWatcher++
+	changeWatchers[key] = changed
+	changeWatchersMu.Unlock()
+	defer func() {
+		changeWatchersMu.Lock()
+		delete(changeWatchers, key)
+		changeWatchersMu.Unlock()
+	}()
+
+	var handles []windows.Handle
+	defer func() {
+		for _, h := range handles {
+			_, _, _ = procCancelMibChangeNotify2.Call(uintptr(h))
+		}
+	}()
+	for _, proc := range []*windows.LazyProc{procNotifyRouteChange2, procNotifyUnicastIpAddressChange} {
+		var h windows.Handle
+		ret, _, _ := proc.Call(windows.AF_UNSPEC, changeCallback, key, 0, uintptr(unsafe.Pointer(&h)))
+		if ret != 0 {
+			return fmt.Errorf("failed to register for %s: %w", proc.Name, windows.Errno(ret))
+		}
+		handles = append(handles, h)
+	}
+
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+// Network change constants
+const (
+	// networkCheckInterval is how often the network is checked for
+	// changes without a notification
+	networkCheckInterval = 5 * time.Second
+
+	// networkSettle is how long to wait after a change notification
+	// before checking the network
+	networkSettle = 500 * time.Millisecond
+
+	// revalidateTimeout bounds revalidating the session after a network
+	// change, including a new handshake
+	revalidateTimeout = 10 * time.Second
+)
+
+// networkFingerprint returns the addresses of the host's interfaces that
+// are up, except loopback and link-local ones, and the source addresses of
+// the default routes, sorted and joined. It changes when the host moves
+// to another network.
+func networkFingerprint() string {
+	var addrs []string
+	for _, addr := range interfaceAddrs() {
+		addrs = append(addrs, addr.String())
+	}
+	slices.Sort(addrs)
+
+	// Connecting a UDP socket picks the route without sending anything
+	for _, dst := range []string{"192.0.2.1:53", "[2001:db8::1]:53"} {
+		if conn, err := net.Dial("udp", dst); err == nil {
+			addrs = append(addrs, "via "+conn.LocalAddr().(*net.UDPAddr).IP.String())
+			conn.Close()
+		}
+	}
+	return strings.Join(addrs, ",")
+}
+
+// interfaceAddrs returns the addresses of the host's interfaces that are
+// up, except loopback and link-local ones.
+func interfaceAddrs() []netip.Addr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var addrs []netip.Addr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
+	}
+	return addrs
+}
+
+// watchNetwork switches network profiles and migrates the tunnel whenever
+// the network changes, e.g. when a laptop switches Wi-Fi networks. Where the platform sends route and
+// address change notifications, changes are picked up right away;
+// polling every networkCheckInterval catches the rest.
+func (r *Resolver) watchNetwork() {
+	defer r.background.Done()
+
+	events := make(chan struct{}, 1)
+	r.background.Add(1)
+	go func() {
+		defer r.background.Done()
+		err := watchRoutes(r.ctx, events)
+		if err != nil && r.ctx.Err() == nil && !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Network change notifications unavailable, checking every %v: %v", networkCheckInterval, err)
+		}
+	}()
+
+	ticker := time.NewTicker(networkCheckInterval)
+	defer ticker.Stop()
+
+	last := networkFingerprint()
+	saved := time.Now()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-events:
+			// Notifications come in bursts while interfaces go down and
+			// up; let the network settle
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(networkSettle):
+			}
+		}
+
+		fingerprint := networkFingerprint()
+		if fingerprint == last {
+			if r.history != nil && time.Since(saved) >= historySaveInterval {
+				r.saveHistory(last)
+				saved = time.Now()
+			}
+			continue
+		}
+		r.saveHistory(last)
+		saved = time.Now()
+		last = fingerprint
+		log.Printf("Network changed, migrating the tunnel")
+		r.applyProfile()
+		r.Migrate()
+	}
+}
+
+// notifyChange signals a network change on changed without blocking.
+func notifyChange(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+// Migrate moves the tunnel to a new network. Connections to resolvers
+// made over the old network are closed, and resolver health measured on it
+// is replaced by what the resolver history recorded on the new network, if
+// anything, and by probing every resolver right away; path discovery runs
+// again in the background. The server keeps
+// sessions by ClientID, whatever address queries come from, so the session
+// is kept; it is revalidated right away so that one the server no longer
+// holds is replaced before the next query needs it. Migrate returns once
+// done.
+func (r *Resolver) Migrate() {
+	transport := r.transport.Load()
+	transport.FlushConnections()
+	transport.ResetHealth()
+	r.restoreHistory(transport)
+	transport.probe(r.domain)
+	r.startPathDiscovery()
+
+	if err := r.revalidateSession(r.ctx); err != nil && r.ctx.Err() == nil {
+		log.Printf("Failed to revalidate session after network change: %v", err)
+	}
+
+	// Stream data in flight over the old network may have been lost
+	r.resyncStreams()
+}
+
+// revalidateSession checks that the server still holds the session by
+// polling through it, and performs a new handshake if it doesn't. Data the
+// poll returns is delivered to the streams.
+func (r *Resolver) revalidateSession(ctx context.Context) error {
+	if !r.config.Handshake || r.session.Load() == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	defer cancel()
+
+	data, err := r.tunnelExchange(ctx, nil, dns.FragmentFlagPoll)
+	if err == nil {
+		if frames, err := stream.ParseFrames(data); err == nil {
+			r.deliverFrames(frames)
+		}
+		return nil
+	}
+
+	// A session the server rejected was dropped; replace it now
+	if r.session.Load() != nil {
+		return err
+	}
+	_, _, _, err = r.queryCipher(ctx)
+	return err
+}
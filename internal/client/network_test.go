@@ -0,0 +1,38 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatchRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watchRoutes(ctx, make(chan struct{}, 1)) }()
+
+	// Watching runs until canceled
+	select {
+	case err := <-done:
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skip("No network change notifications on this platform")
+		}
+		t.Fatalf("watchRoutes() returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watchRoutes() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchRoutes() didn't return after cancel")
+	}
+
+	if a, b := networkFingerprint(), networkFingerprint(); a != b {
+		t.Errorf("networkFingerprint() changed without a network change: %q, %q", a, b)
+	}
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPipelined is how many queries a DoT connection carries at once before
+// another connection is opened for more.
+const maxPipelined = 32
+
+var errQueryTooShort = errors.New("query too short")
+
+// pipeline is a DoT connection carrying several queries at once (RFC 7766
+// section 6.2.1.1). Queries are sent as they come, each under a message ID
+// unique on the connection, and the responses are matched to them by ID in
+// whatever order the resolver sends them.
+type pipeline struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	pending  map[uint16]chan []byte
+	nextID   uint16
+	lastRead atomic.Int64 // Unix nanoseconds of the last response
+	err      error        // why the connection closed, nil while open
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+// newPipeline starts reading responses from conn.
+func newPipeline(conn net.Conn) *pipeline {
+	p := &pipeline{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+	}
+	go p.readLoop()
+	return p
+}
+
+// exchange sends a query and waits for its response until ctx is done or
+// timeout passes, if ctx has no deadline. The query's ID is restored in
+// the response. A query that times out without the resolver sending
+// anything since closes the connection, which is then presumed dead.
+func (p *pipeline) exchange(ctx context.Context, query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errQueryTooShort
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	sent := time.Now()
+	id, ch, err := p.register()
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the length-prefixed query under its connection ID
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	msg = binary.BigEndian.AppendUint16(msg, id)
+	msg = append(msg, query[2:]...)
+	deadline, _ := ctx.Deadline()
+	p.writeMu.Lock()
+	_ = p.conn.SetWriteDeadline(deadline)
+	_, err = p.conn.Write(msg)
+	p.writeMu.Unlock()
+	if err != nil {
+		p.fail(fmt.Errorf("failed to send query: %w", err))
+		return nil, p.closeErr()
+	}
+
+	select {
+	case resp := <-ch:
+		copy(resp, query[:2])
+		return resp, nil
+	case <-p.done:
+		return nil, p.closeErr()
+	case <-ctx.Done():
+		p.forget(id)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && p.lastRead.Load() < sent.UnixNano() {
+			p.fail(ctx.Err())
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// register reserves a message ID for a query and returns the channel its
+// response is delivered on.
+func (p *pipeline) register() (uint16, chan []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, nil, p.err
+	}
+	id := p.nextID
+	for p.pending[id] != nil {
+		id++
+	}
+	p.nextID = id + 1
+	ch := make(chan []byte, 1)
+	p.pending[id] = ch
+	return id, ch, nil
+}
+
+// forget drops a query that is no longer waited for; its response, if it
+// comes, is discarded.
+func (p *pipeline) forget(id uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+}
+
+// readLoop delivers responses to the queries waiting for them until the
+// connection fails.
+func (p *pipeline) readLoop() {
+	var lenBuf [2]byte
+	for {
+		if _, err := io.ReadFull(p.conn, lenBuf[:]); err != nil {
+			p.fail(fmt.Errorf("failed to read response length: %w", err))
+			return
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(p.conn, resp); err != nil {
+			p.fail(fmt.Errorf("failed to read response: %w", err))
+			return
+		}
+		p.lastRead.Store(time.Now().UnixNano())
+		if len(resp) < 2 {
+			continue
+		}
+
+		p.mu.Lock()
+		id := binary.BigEndian.Uint16(resp)
+		ch := p.pending[id]
+		delete(p.pending, id)
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
+
+// fail closes the connection, failing the queries waiting on it with err.
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	close(p.done)
+	p.conn.Close()
+}
+
+// closeErr returns why the connection closed.
+func (p *pipeline) closeErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// load returns the number of queries waiting on the connection, or -1 if
+// it is closed.
+func (p *pipeline) load() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return -1
+	}
+	return len(p.pending)
+}
+
+// dotPool holds the pipelined connections to a single DoT resolver.
+// Queries share the least loaded connection, and another is opened only
+// when all carry maxPipelined queries.
+type dotPool struct {
+	addr      string
+	tlsConfig *tls.Config
+	maxSize   int
+	conns     []*pipeline
+	mu        sync.Mutex
+	dialMu    sync.Mutex // one dial at a time, so bursts share it
+}
+
+func newDoTPool(addr string, tlsConfig *tls.Config, maxSize int) *dotPool {
+	return &dotPool{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		maxSize:   maxSize,
+	}
+}
+
+// get returns the least loaded open connection, or nil if there is none or
+// all are full and there is room for another.
+func (p *dotPool) get() *pipeline {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *pipeline
+	bestLoad := 0
+	open := p.conns[:0]
+	for _, conn := range p.conns {
+		load := conn.load()
+		if load < 0 {
+			continue
+		}
+		open = append(open, conn)
+		if best == nil || load < bestLoad {
+			best, bestLoad = conn, load
+		}
+	}
+	clear(p.conns[len(open):])
+	p.conns = open
+
+	if best == nil || bestLoad >= maxPipelined && len(p.conns) < p.maxSize {
+		return nil
+	}
+	return best
+}
+
+// dial returns a new connection, or one another query opened while it
+// waited to dial.
+func (p *dotPool) dial(ctx context.Context, timeout time.Duration) (*pipeline, error) {
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+	if conn := p.get(); conn != nil {
+		return conn, nil
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout},
+		Config:    p.tlsConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	pl := newPipeline(conn)
+	p.mu.Lock()
+	p.conns = append(p.conns, pl)
+	p.mu.Unlock()
+	return pl, nil
+}
+
+// close closes the connections, failing the queries waiting on them.
+func (p *dotPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.conns {
+		conn.fail(net.ErrClosed)
+	}
+	p.conns = nil
+}
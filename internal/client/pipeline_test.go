@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipelineTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	p := newPipeline(client)
+	defer p.fail(net.ErrClosed)
+
+	// Read queries, answering only those whose last byte is set
+	go func() {
+		for {
+			var length uint16
+			if err := binary.Read(server, binary.BigEndian, &length); err != nil {
+				return
+			}
+			msg := make([]byte, length)
+			if _, err := io.ReadFull(server, msg); err != nil {
+				return
+			}
+			if msg[len(msg)-1] != 0 {
+				_ = binary.Write(server, binary.BigEndian, length)
+				_, _ = server.Write(msg)
+			}
+		}
+	}()
+
+	// A dropped query doesn't close a connection the resolver is answering on
+	lost := make(chan error, 1)
+	go func() {
+		_, err := p.exchange(context.Background(), []byte{1, 2, 0}, 100*time.Millisecond)
+		lost <- err
+	}()
+	for p.load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := p.exchange(context.Background(), []byte{3, 4, 1}, time.Second); err != nil {
+		t.Fatalf("exchange() error = %v", err)
+	}
+	if err := <-lost; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Dropped query: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if p.load() < 0 {
+		t.Fatal("Connection closed after a dropped query")
+	}
+
+	// A connection silent past a query's timeout is presumed dead
+	if _, err := p.exchange(context.Background(), []byte{5, 6, 0}, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unanswered query: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if p.load() >= 0 {
+		t.Error("Silent connection left open")
+	}
+	if _, err := p.exchange(context.Background(), []byte{7, 8, 1}, time.Second); err == nil {
+		t.Error("exchange() on a closed connection succeeded")
+	}
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"log"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+// Poll limits
+const (
+	// pollMinInterval is the delay between polls while data arrives
+	pollMinInterval = 20 * time.Millisecond
+
+	// pollMaxInterval bounds the delay between polls, which doubles with
+	// each poll that returns no data
+	pollMaxInterval = time.Second
+
+	// streamKeepalive is how often a stream without anything to send
+	// exchanges a frame anyway, so the server doesn't expire it
+	streamKeepalive = 30 * time.Second
+)
+
+// pollLoop polls the server for data queued for the client's streams while
+// any are open, and delivers it to them. The interval between polls drops
+// to pollMinInterval while data arrives and doubles up to pollMaxInterval
+// while none does, or up to powerSavingFactor times that while saving
+// power. If the server doesn't answer polls, streams go back to
+// waiting for data in their own exchanges.
+func (r *Resolver) pollLoop() {
+	defer r.wg.Done()
+
+	interval := pollMinInterval
+	failures := 0
+	for r.waitForStreams() {
+		data, err := r.tunnelExchange(r.ctx, nil, dns.FragmentFlagPoll)
+		var frames []*stream.Frame
+		if err == nil {
+			frames, err = stream.ParseFrames(data)
+		}
+
+		switch {
+		case r.ctx.Err() != nil:
+			return
+		case err != nil:
+			// The lost reply may have carried data; streams fetch it again
+			// in their own exchanges
+			r.resyncStreams()
+			failures++
+			if failures >= streamMaxFailures {
+				log.Printf("Server doesn't answer polls, streams wait for data in their own exchanges: %v", err)
+				r.polling.Store(false)
+				return
+			}
+			interval = min(interval*2, r.pollMaxInterval())
+		case len(frames) > 0:
+			failures = 0
+			r.deliverFrames(frames)
+			interval = pollMinInterval
+		default:
+			failures = 0
+			interval = min(interval*2, r.pollMaxInterval())
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// pollMaxInterval returns the longest delay between polls.
+func (r *Resolver) pollMaxInterval() time.Duration {
+	if r.powerSaving.Load() {
+		return pollMaxInterval * powerSavingFactor
+	}
+	return pollMaxInterval
+}
+
+// waitForStreams waits until a stream is open. It returns false once the
+// resolver stops, or drains without streams left.
+func (r *Resolver) waitForStreams() bool {
+	for {
+		r.streamsMu.Lock()
+		n := len(r.streams)
+		r.streamsMu.Unlock()
+		if n > 0 {
+			return true
+		}
+		if r.draining.Load() {
+			return false
+		}
+
+		select {
+		case <-r.pollWake:
+		case <-r.ctx.Done():
+			return false
+		}
+	}
+}
+
+// deliverFrames applies polled frames to their streams.
+func (r *Resolver) deliverFrames(frames []*stream.Frame) {
+	for _, f := range frames {
+		r.streamsMu.Lock()
+		s, ok := r.streams[f.Stream]
+		r.streamsMu.Unlock()
+		if !ok {
+			continue
+		}
+		// A failed write shows again when the stream's own exchange
+		// returns the data
+		_ = s.endpoint.Receive(f)
+		s.wakeup()
+	}
+}
+
+// resyncStreams makes every stream exchange a frame, whose reply carries
+// any data a lost poll reply held.
+func (r *Resolver) resyncStreams() {
+	r.streamsMu.Lock()
+	defer r.streamsMu.Unlock()
+	for _, s := range r.streams {
+		s.resync.Store(true)
+		s.wakeup()
+	}
+}
+
+// addStream registers a stream for polled data.
+func (r *Resolver) addStream(s *clientStream) {
+	r.streamsMu.Lock()
+	r.streams[s.id] = s
+	r.streamsMu.Unlock()
+	r.wakePoller()
+}
+
+// removeStream unregisters a stream.
+func (r *Resolver) removeStream(s *clientStream) {
+	r.streamsMu.Lock()
+	delete(r.streams, s.id)
+	r.streamsMu.Unlock()
+	r.wakePoller()
+}
+
+// wakePoller makes the poll loop check for open streams again.
+func (r *Resolver) wakePoller() {
+	select {
+	case r.pollWake <- struct{}{}:
+	default:
+	}
+}
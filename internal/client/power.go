@@ -0,0 +1,139 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// PowerPolicy says when the client saves battery and data by sending
+// fewer background queries: resolver health probes and stream polls.
+type PowerPolicy int
+
+const (
+	// PowerSaveOnBattery saves power while the host runs on battery
+	PowerSaveOnBattery PowerPolicy = 1 << iota
+
+	// PowerSaveOnMetered saves data while the host's connection is
+	// metered
+	PowerSaveOnMetered
+
+	// PowerSaveAlways saves power and data all the time
+	PowerSaveAlways
+)
+
+// DefaultPowerPolicy saves power on battery and data on metered
+// connections.
+const DefaultPowerPolicy = PowerSaveOnBattery | PowerSaveOnMetered
+
+// Power saving constants
+const (
+	// powerCheckInterval is how often the power source and connection
+	// cost are checked
+	powerCheckInterval = 30 * time.Second
+
+	// powerSavingFactor is how many times longer the intervals between
+	// background queries are while saving power
+	powerSavingFactor = 4
+)
+
+// ParsePowerPolicy parses a power policy: "never", "always", or a
+// comma-separated list of the conditions to save power under (battery,
+// metered).
+func ParsePowerPolicy(s string) (PowerPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "never", "":
+		return 0, nil
+	case "always":
+		return PowerSaveAlways, nil
+	}
+
+	var p PowerPolicy
+	for _, cond := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(cond)) {
+		case "battery":
+			p |= PowerSaveOnBattery
+		case "metered":
+			p |= PowerSaveOnMetered
+		default:
+			return 0, fmt.Errorf("invalid power policy %q", s)
+		}
+	}
+	return p, nil
+}
+
+// String returns the policy in the form ParsePowerPolicy accepts.
+func (p PowerPolicy) String() string {
+	switch {
+	case p == 0:
+		return "never"
+	case p&PowerSaveAlways != 0:
+		return "always"
+	}
+	var conds []string
+	if p&PowerSaveOnBattery != 0 {
+		conds = append(conds, "battery")
+	}
+	if p&PowerSaveOnMetered != 0 {
+		conds = append(conds, "metered")
+	}
+	return strings.Join(conds, ",")
+}
+
+// reason returns why power should be saved under the policy, or "" if it
+// shouldn't.
+func (p PowerPolicy) reason(battery, metered bool) string {
+	switch {
+	case p&PowerSaveAlways != 0:
+		return "always"
+	case p&PowerSaveOnBattery != 0 && battery:
+		return "on battery"
+	case p&PowerSaveOnMetered != 0 && metered:
+		return "metered connection"
+	}
+	return ""
+}
+
+// updatePowerSaving checks the power source and connection cost and
+// starts or stops saving power following the policy.
+func (r *Resolver) updatePowerSaving() {
+	policy := PowerPolicy(r.powerPolicy.Load())
+
+	// Only ask the system what the policy depends on
+	var battery, metered bool
+	if policy&PowerSaveAlways == 0 {
+		battery = policy&PowerSaveOnBattery != 0 && onBattery()
+		metered = policy&PowerSaveOnMetered != 0 && onMeteredConnection()
+	}
+
+	reason := policy.reason(battery, metered)
+	saving := reason != ""
+	if r.powerSaving.Swap(saving) == saving {
+		return
+	}
+	r.transport.Load().SetPowerSaving(saving)
+	if saving {
+		log.Printf("Saving power (%s), background queries are less frequent", reason)
+	} else {
+		log.Printf("No longer saving power")
+	}
+}
+
+// watchPower keeps power saving in line with the power source and
+// connection cost.
+func (r *Resolver) watchPower() {
+	defer r.background.Done()
+
+	ticker := time.NewTicker(powerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		r.updatePowerSaving()
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
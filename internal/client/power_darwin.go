@@ -0,0 +1,32 @@
+//go:build darwin
+// +build darwin
+
+package client
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// powerQueryTimeout bounds asking pmset about the power source
+const powerQueryTimeout = 2 * time.Second
+
+// onBattery reports whether the host runs on battery.
+func onBattery() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), powerQueryTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "pmset", "-g", "batt").Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(out), "'Battery Power'")
+}
+
+// onMeteredConnection isn't supported on macOS; connections are taken to
+// be unmetered.
+func onMeteredConnection() bool {
+	return false
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// meteredQueryTimeout bounds asking NetworkManager about the connection
+const meteredQueryTimeout = 2 * time.Second
+
+// onBattery reports whether a battery is discharging, i.e. the host runs
+// on battery.
+func onBattery() bool {
+	paths, _ := filepath.Glob("/sys/class/power_supply/*/status")
+	for _, path := range paths {
+		status, err := os.ReadFile(path)
+		if err == nil && strings.TrimSpace(string(status)) == "Discharging" {
+			return true
+		}
+	}
+	return false
+}
+
+// onMeteredConnection reports whether NetworkManager considers the primary
+// connection metered. Without NetworkManager, connections are taken to be
+// unmetered.
+func onMeteredConnection() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), meteredQueryTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "busctl", "get-property",
+		"org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		return false
+	}
+
+	// The property is an NMMetered, printed as "u 1": 1 is metered and 3
+	// is guessed metered
+	switch strings.TrimSpace(string(out)) {
+	case "u 1", "u 3":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package client
+
+// onBattery isn't supported on this platform; the host is taken to run on
+// mains power.
+func onBattery() bool {
+	return false
+}
+
+// onMeteredConnection isn't supported on this platform; connections are
+// taken to be unmetered.
+func onMeteredConnection() bool {
+	return false
+}
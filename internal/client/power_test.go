@@ -0,0 +1,54 @@
+package client
+
+import "testing"
+
+func TestParsePowerPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PowerPolicy
+	}{
+		{"never", 0},
+		{"always", PowerSaveAlways},
+		{"battery", PowerSaveOnBattery},
+		{"metered", PowerSaveOnMetered},
+		{"battery,metered", DefaultPowerPolicy},
+		{" Metered , battery", DefaultPowerPolicy},
+	}
+	for _, tt := range tests {
+		got, err := ParsePowerPolicy(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePowerPolicy(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+		if again, err := ParsePowerPolicy(got.String()); err != nil || again != got {
+			t.Errorf("ParsePowerPolicy(%q) = %v, %v, want %v", got.String(), again, err, got)
+		}
+	}
+	for _, in := range []string{"wifi", "battery,", "battery;metered"} {
+		if _, err := ParsePowerPolicy(in); err == nil {
+			t.Errorf("ParsePowerPolicy(%q) accepted an invalid policy", in)
+		}
+	}
+}
+
+func TestPowerPolicyReason(t *testing.T) {
+	tests := []struct {
+		policy           PowerPolicy
+		battery, metered bool
+		saving           bool
+	}{
+		{0, true, true, false},
+		{PowerSaveAlways, false, false, true},
+		{PowerSaveOnBattery, true, false, true},
+		{PowerSaveOnBattery, false, true, false},
+		{PowerSaveOnMetered, false, true, true},
+		{PowerSaveOnMetered, true, false, false},
+		{DefaultPowerPolicy, false, false, false},
+		{DefaultPowerPolicy, false, true, true},
+	}
+	for _, tt := range tests {
+		got := tt.policy.reason(tt.battery, tt.metered) != ""
+		if got != tt.saving {
+			t.Errorf("%v: reason(%v, %v) saving = %v, want %v", tt.policy, tt.battery, tt.metered, got, tt.saving)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetSystemPowerStatus = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus is SYSTEM_POWER_STATUS.
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// onBattery reports whether the host runs on battery.
+func onBattery() bool {
+	var status systemPowerStatus
+	ok, _, _ := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status)))
+	return ok != 0 && status.ACLineStatus == 0 // offline
+}
+
+// onMeteredConnection isn't supported on Windows, where connection cost is
+// only available through WinRT; connections are taken to be unmetered.
+func onMeteredConnection() bool {
+	return false
+}
@@ -0,0 +1,320 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var ErrInvalidProfile = errors.New("invalid network profile")
+
+// NetworkProfile overrides settings of the client while the host is on a
+// network it matches, e.g. the home network's own resolver, or a higher
+// stealth level on networks known to inspect DNS. A profile matches when
+// every criterion it has does.
+type NetworkProfile struct {
+	Name string
+
+	// Networks match if one of the host's addresses is in one of them
+	Networks []netip.Prefix
+
+	// Gateway matches the default gateway's IP or MAC address
+	Gateway string
+
+	// Suffix matches a DNS search domain of the network, or its parent
+	Suffix dns.Name
+
+	// Resolvers replace the client's resolvers, if not empty
+	Resolvers []string
+
+	// Strategy and Stealth replace the client's, if not nil
+	Strategy *Strategy
+	Stealth  *dns.StealthLevel
+
+	// Direct are domains resolved directly on this network, added to the
+	// client's DirectDomains
+	Direct []dns.Name
+
+	// DirectResolvers replace the client's, if not empty
+	DirectResolvers []string
+}
+
+// ReadProfiles reads a file of network profiles, one per line: a name,
+// then the criteria and settings as key=value pairs, lists joined with +:
+//
+//	# name  criteria                    settings
+//	home    gateway=aa:bb:cc:dd:ee:ff   resolvers=192.168.1.1:53 stealth=off
+//	office  suffix=corp.example         stealth=high direct=corp.example+lan
+//	cafe    network=10.20.0.0/16        resolvers=https://dns.google/dns-query
+//
+// The criteria are network=prefix+prefix, gateway=ip-or-mac and
+// suffix=domain; the settings resolvers=, strategy=, stealth=, direct=
+// and direct-resolvers= take the values of the flags of the same names.
+// The first matching profile applies.
+func ReadProfiles(path string) ([]NetworkProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network profiles: %w", err)
+	}
+	defer f.Close()
+
+	var profiles []NetworkProfile
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		p, err := parseProfile(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		if slices.ContainsFunc(profiles, func(q NetworkProfile) bool { return q.Name == p.Name }) {
+			return nil, fmt.Errorf("%s:%d: %w: %s defined twice", path, lineNum, ErrInvalidProfile, p.Name)
+		}
+		profiles = append(profiles, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read network profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+// parseProfile parses the fields of a profile line.
+func parseProfile(fields []string) (NetworkProfile, error) {
+	p := NetworkProfile{Name: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return p, fmt.Errorf("%w: %q, want key=value", ErrInvalidProfile, field)
+		}
+		items := strings.Split(value, "+")
+
+		switch key {
+		case "network":
+			for _, item := range items {
+				prefix, err := netip.ParsePrefix(item)
+				if err != nil {
+					return p, fmt.Errorf("%w: %w", ErrInvalidProfile, err)
+				}
+				p.Networks = append(p.Networks, prefix.Masked())
+			}
+		case "gateway":
+			if ip, err := netip.ParseAddr(value); err == nil {
+				p.Gateway = ip.String()
+			} else if mac, err := net.ParseMAC(value); err == nil {
+				p.Gateway = mac.String()
+			} else {
+				return p, fmt.Errorf("%w: invalid gateway %q", ErrInvalidProfile, value)
+			}
+		case "suffix":
+			suffix, err := dns.ParseName(value)
+			if err != nil {
+				return p, fmt.Errorf("%w: invalid suffix: %w", ErrInvalidProfile, err)
+			}
+			p.Suffix = suffix
+		case "resolvers":
+			p.Resolvers = items
+		case "strategy":
+			strategy, err := ParseStrategy(value)
+			if err != nil {
+				return p, fmt.Errorf("%w: %w", ErrInvalidProfile, err)
+			}
+			p.Strategy = &strategy
+		case "stealth":
+			level, err := dns.ParseStealthLevel(value)
+			if err != nil {
+				return p, fmt.Errorf("%w: %w", ErrInvalidProfile, err)
+			}
+			p.Stealth = &level
+		case "direct-resolvers":
+			p.DirectResolvers = items
+		case "direct":
+			for _, item := range items {
+				domain, err := dns.ParseName(item)
+				if err != nil {
+					return p, fmt.Errorf("%w: invalid direct domain: %w", ErrInvalidProfile, err)
+				}
+				p.Direct = append(p.Direct, domain)
+			}
+		default:
+			return p, fmt.Errorf("%w: unknown key %q", ErrInvalidProfile, key)
+		}
+	}
+
+	if len(p.Networks) == 0 && p.Gateway == "" && p.Suffix == nil {
+		return p, fmt.Errorf("%w: %s has no network, gateway or suffix to match", ErrInvalidProfile, p.Name)
+	}
+	return p, nil
+}
+
+// matches reports whether the profile applies on the network.
+func (p *NetworkProfile) matches(info networkInfo) bool {
+	if len(p.Networks) > 0 && !slices.ContainsFunc(info.addrs, func(addr netip.Addr) bool {
+		return slices.ContainsFunc(p.Networks, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+	}) {
+		return false
+	}
+	if p.Gateway != "" && p.Gateway != info.gateway.String() && p.Gateway != info.gatewayMAC {
+		return false
+	}
+	if p.Suffix != nil && !slices.ContainsFunc(info.suffixes, func(s dns.Name) bool {
+		_, ok := s.TrimSuffix(p.Suffix)
+		return ok
+	}) {
+		return false
+	}
+	return true
+}
+
+// withProfile returns the configuration with the settings of the first
+// profile matching the network, and that profile's name ("" if none).
+func (c *Config) withProfile(info networkInfo) (*Config, string) {
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		if !p.matches(info) {
+			continue
+		}
+		config := *c
+		if len(p.Resolvers) > 0 {
+			config.Resolvers = p.Resolvers
+		}
+		if p.Strategy != nil {
+			config.ResolverStrategy = *p.Strategy
+		}
+		if p.Stealth != nil {
+			config.StealthLevel = *p.Stealth
+		}
+		if len(p.DirectResolvers) > 0 {
+			config.DirectResolvers = p.DirectResolvers
+		}
+		config.DirectDomains = append(slices.Clip(c.DirectDomains), p.Direct...)
+		return &config, p.Name
+	}
+	return c, ""
+}
+
+// profileConfig returns the configuration with the settings of the
+// network profile matching the current network, and its name.
+func (c *Config) profileConfig() (*Config, string) {
+	if len(c.Profiles) == 0 {
+		return c, ""
+	}
+	return c.withProfile(currentNetwork())
+}
+
+// applyProfile switches to the network profile matching the network the
+// host is now on, if it changed.
+func (r *Resolver) applyProfile() {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	if len(r.base.Profiles) > 0 {
+		r.reload(r.base)
+	}
+}
+
+// networkInfo is what network profiles are matched against.
+type networkInfo struct {
+	addrs      []netip.Addr
+	gateway    netip.Addr // of the IPv4 default route
+	gatewayMAC string
+	suffixes   []dns.Name
+}
+
+// currentNetwork returns information about the network the host is on.
+// The gateway and search domains are read from /proc and /etc/resolv.conf
+// where they exist, so profiles can match them on Linux only, and search
+// domains on other Unix systems too.
+func currentNetwork() networkInfo {
+	info := networkInfo{addrs: interfaceAddrs()}
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		info.gateway = parseRouteTable(f)
+		f.Close()
+	}
+	if info.gateway.IsValid() {
+		if f, err := os.Open("/proc/net/arp"); err == nil {
+			info.gatewayMAC = parseARPTable(f, info.gateway)
+			f.Close()
+		}
+	}
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		info.suffixes = parseSearchDomains(f)
+		f.Close()
+	}
+	return info
+}
+
+// parseRouteTable returns the gateway of the default route in a Linux
+// /proc/net/route table.
+func parseRouteTable(r io.Reader) netip.Addr {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		// Addresses are in host byte order, little-endian in practice
+		return netip.AddrFrom4([4]byte{byte(gw), byte(gw >> 8), byte(gw >> 16), byte(gw >> 24)})
+	}
+	return netip.Addr{}
+}
+
+// parseARPTable returns the MAC address of ip in a Linux /proc/net/arp
+// table, or "" if it isn't listed.
+func parseARPTable(r io.Reader, ip netip.Addr) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != ip.String() {
+			continue
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil {
+			return mac.String()
+		}
+	}
+	return ""
+}
+
+// parseSearchDomains returns the search domains of a resolv.conf file.
+func parseSearchDomains(r io.Reader) []dns.Name {
+	var suffixes []dns.Name
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || (fields[0] != "search" && fields[0] != "domain") {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if name, err := dns.ParseName(field); err == nil {
+				suffixes = append(suffixes, name)
+			}
+		}
+	}
+	return suffixes
+}
+
+// logProfile logs a change of the network profile in use.
+func logProfile(old, profile string) {
+	switch {
+	case profile == old:
+	case profile == "":
+		log.Printf("Network profile %s no longer applies", old)
+	default:
+		log.Printf("Using network profile %s", profile)
+	}
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func mustParseName(t *testing.T, s string) dns.Name {
+	t.Helper()
+	name, err := dns.ParseName(s)
+	if err != nil {
+		t.Fatalf("ParseName(%q) error = %v", s, err)
+	}
+	return name
+}
+
+func TestReadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles")
+	data := `# name  criteria  settings
+home    gateway=AA:BB:CC:DD:EE:FF  resolvers=192.168.1.1:53+9.9.9.9:53 stealth=off
+office  suffix=corp.example network=10.1.0.0/16  stealth=high direct=corp.example+lan direct-resolvers=10.1.0.53:53
+cafe    network=10.20.0.7/16       strategy=sequential   # trailing comment
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := ReadProfiles(path)
+	if err != nil {
+		t.Fatalf("ReadProfiles() error = %v", err)
+	}
+	if len(profiles) != 3 {
+		t.Fatalf("ReadProfiles() = %d profiles, want 3", len(profiles))
+	}
+	home, office, cafe := profiles[0], profiles[1], profiles[2]
+	if home.Gateway != "aa:bb:cc:dd:ee:ff" || !slices.Equal(home.Resolvers, []string{"192.168.1.1:53", "9.9.9.9:53"}) ||
+		home.Stealth == nil || *home.Stealth != dns.StealthOff {
+		t.Errorf("home = %+v", home)
+	}
+	if office.Suffix.String() != "corp.example" || len(office.Direct) != 2 || office.Stealth == nil || *office.Stealth != dns.StealthHigh ||
+		!slices.Equal(office.DirectResolvers, []string{"10.1.0.53:53"}) {
+		t.Errorf("office = %+v", office)
+	}
+	if !slices.Equal(cafe.Networks, []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")}) ||
+		cafe.Strategy == nil || *cafe.Strategy != StrategySequential {
+		t.Errorf("cafe = %+v", cafe)
+	}
+
+	for _, line := range []string{
+		"any stealth=high",
+		"bad network=10.0.0.0",
+		"bad gateway=router",
+		"bad network=10.0.0.0/8 color=blue",
+		"bad network=10.0.0.0/8 stealth",
+		"twice network=10.0.0.0/8\ntwice network=10.1.0.0/16",
+	} {
+		if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadProfiles(path); err == nil {
+			t.Errorf("ReadProfiles(%q) succeeded", line)
+		}
+	}
+}
+
+func TestConfigWithProfile(t *testing.T) {
+	high := dns.StealthHigh
+	config := DefaultConfig()
+	config.DirectDomains = []dns.Name{mustParseName(t, "local")}
+	config.Profiles = []NetworkProfile{
+		{Name: "home", Gateway: "aa:bb:cc:dd:ee:ff", Resolvers: []string{"192.168.1.1:53"}},
+		{Name: "office", Suffix: mustParseName(t, "corp.example"), Networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+			Stealth: &high, Direct: []dns.Name{mustParseName(t, "corp.example")}},
+	}
+
+	home := networkInfo{gateway: netip.MustParseAddr("192.168.1.1"), gatewayMAC: "aa:bb:cc:dd:ee:ff"}
+	office := networkInfo{
+		addrs:    []netip.Addr{netip.MustParseAddr("10.1.2.3")},
+		suffixes: []dns.Name{mustParseName(t, "corp.example")},
+	}
+	elsewhere := networkInfo{addrs: []netip.Addr{netip.MustParseAddr("10.2.2.3")}, suffixes: office.suffixes}
+
+	got, name := config.withProfile(home)
+	if name != "home" || !slices.Equal(got.Resolvers, []string{"192.168.1.1:53"}) || got.StealthLevel != config.StealthLevel {
+		t.Errorf("withProfile(home) = %s, %v", name, got.Resolvers)
+	}
+
+	got, name = config.withProfile(office)
+	if name != "office" || got.StealthLevel != dns.StealthHigh || len(got.DirectDomains) != 2 ||
+		!slices.Equal(got.Resolvers, config.Resolvers) {
+		t.Errorf("withProfile(office) = %s, stealth %v, direct %v", name, got.StealthLevel, got.DirectDomains)
+	}
+	if len(config.DirectDomains) != 1 {
+		t.Errorf("withProfile() changed the base direct domains: %v", config.DirectDomains)
+	}
+
+	// Every criterion of a profile must match
+	if got, name := config.withProfile(elsewhere); name != "" || got != config {
+		t.Errorf("withProfile(elsewhere) = %s", name)
+	}
+}
+
+func TestNetworkInfoParsers(t *testing.T) {
+	route := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wlan0	0000A8C0	00000000	0001	0	0	600	00FFFFFF	0	0	0
+wlan0	00000000	0101A8C0	0003	0	0	600	00000000	0	0	0
+`
+	gateway := parseRouteTable(strings.NewReader(route))
+	if gateway != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("parseRouteTable() = %v, want 192.168.1.1", gateway)
+	}
+
+	arp := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.7      0x1         0x2         11:22:33:44:55:66     *        wlan0
+192.168.1.1      0x1         0x2         AA:BB:CC:DD:EE:FF     *        wlan0
+`
+	if mac := parseARPTable(strings.NewReader(arp), gateway); mac != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("parseARPTable() = %q", mac)
+	}
+
+	resolv := "nameserver 127.0.0.53\nsearch corp.example lan\noptions edns0\n"
+	suffixes := parseSearchDomains(strings.NewReader(resolv))
+	if len(suffixes) != 2 || suffixes[0].String() != "corp.example" || suffixes[1].String() != "lan" {
+		t.Errorf("parseSearchDomains() = %v", suffixes)
+	}
+}
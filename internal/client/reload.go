@@ -0,0 +1,113 @@
+package client
+
+import (
+	"bytes"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dnssec"
+)
+
+// Reload applies a new configuration without restarting the listener.
+// Resolvers, resolver strategy, send jitter, timeout, health checks, cache
+// size, stealth level, case randomization, upstream hint, split DNS
+// rules, direct fallback, network profiles and DNSSEC settings take effect
+// immediately; changes to other options are logged and require a restart.
+func (r *Resolver) Reload(config *Config) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	r.base = config
+	r.reload(config)
+}
+
+// reload applies base with the settings of the network profile matching
+// the current network. The caller must hold reloadMu.
+func (r *Resolver) reload(base *Config) {
+	config, profile := base.profileConfig()
+	logProfile(r.profile, profile)
+	r.profile = profile
+
+	old := r.active
+
+	if !slices.Equal(config.Resolvers, old.Resolvers) || config.Timeout != old.Timeout ||
+		config.HealthCheckInterval != old.HealthCheckInterval {
+		transport := NewTransport(config.Resolvers, config.Timeout)
+		transport.SetStrategy(config.ResolverStrategy)
+		transport.SetSendJitter(config.SendJitter)
+		transport.SetPowerSaving(r.powerSaving.Load())
+		r.restoreHistory(transport)
+		if r.conn != nil {
+			transport.StartHealthChecks(r.domain, config.HealthCheckInterval)
+		}
+		prev := r.transport.Swap(transport)
+		if r.conn != nil && !slices.Equal(config.Resolvers, old.Resolvers) {
+			r.startPathDiscovery()
+		}
+
+		// Keep the old transport for in-flight queries
+		time.AfterFunc(2*old.Timeout, prev.Close)
+		log.Printf("Using %d resolvers (%s)", len(config.Resolvers), config.ResolverStrategy)
+	} else {
+		if config.ResolverStrategy != old.ResolverStrategy {
+			r.transport.Load().SetStrategy(config.ResolverStrategy)
+			log.Printf("Using %d resolvers (%s)", len(config.Resolvers), config.ResolverStrategy)
+		}
+		r.transport.Load().SetSendJitter(config.SendJitter)
+	}
+	r.sched.setLimit(config.TunnelConcurrency)
+
+	dnssecChanged := config.DNSSEC != old.DNSSEC || !slices.EqualFunc(config.TrustAnchors, old.TrustAnchors,
+		func(a, b dnssec.TrustAnchor) bool { return a.String() == b.String() })
+	if dnssecChanged {
+		r.validator.Store(r.newValidator(config))
+		log.Printf("DNSSEC validation: %s", validatorString(config))
+	}
+
+	// Cached responses were validated under the old settings
+	if config.CacheSize != old.CacheSize || dnssecChanged {
+		var cache *Cache
+		if config.CacheSize > 0 {
+			cache = NewCache(config.CacheSize)
+		}
+		r.cache.Store(cache)
+	}
+
+	r.stealth.Store(int32(config.StealthLevel))
+	r.randomCase.Store(config.CaseRandomization)
+	r.compress.Store(config.Compression)
+	r.traceLog.Store(config.TraceLog)
+	r.traceSample.SetRate(config.TraceLogSample)
+	r.upstream.Store(&config.UpstreamHint)
+	r.setFallbackAfter(config.DirectFallback)
+	if splitChanged(config, old) {
+		prev := r.split.Swap(newSplitDNS(config))
+		time.AfterFunc(2*old.Timeout, prev.close)
+	}
+
+	if config.PowerPolicy != old.PowerPolicy {
+		r.powerPolicy.Store(int32(config.PowerPolicy))
+		if r.conn != nil {
+			r.updatePowerSaving()
+		}
+	}
+
+	if config.ListenAddr != old.ListenAddr || config.ServerDomain != old.ServerDomain ||
+		!bytes.Equal(config.SharedSecret, old.SharedSecret) || config.KeyID != old.KeyID ||
+		config.Handshake != old.Handshake || config.MaxConcurrent != old.MaxConcurrent ||
+		config.TrustAnchorState != old.TrustAnchorState || config.SocksAddr != old.SocksAddr ||
+		config.ResolverHistory != old.ResolverHistory || config.SessionFile != old.SessionFile ||
+		config.DoHAddr != old.DoHAddr ||
+		config.DoHCert != old.DoHCert || config.DoHKey != old.DoHKey ||
+		!slices.Equal(config.DoHAllow, old.DoHAllow) || config.DoTAddr != old.DoTAddr ||
+		config.DoTCert != old.DoTCert || config.DoTKey != old.DoTKey ||
+		!slices.Equal(config.DoTAllow, old.DoTAllow) || config.ExportInterface != old.ExportInterface ||
+		config.MaxCodec != old.MaxCodec ||
+		!slices.EqualFunc(config.Listeners, old.Listeners, func(a, b ListenerConfig) bool { return a.String() == b.String() }) ||
+		config.AlertWebhook != old.AlertWebhook || config.AlertFormat != old.AlertFormat ||
+		config.AlertInterval != old.AlertInterval {
+		log.Printf("Listen address, domain, key, handshake, concurrency, trust anchor state, SOCKS5 address, DoH and DoT endpoint, export interface, resolver history, session file, codec, listener and alert changes require a restart")
+	}
+
+	r.active = config
+}
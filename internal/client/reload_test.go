@@ -0,0 +1,55 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolverReload(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerDomain = "t.example.com"
+	config.SharedSecret = make([]byte, 32)
+
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.transport.Load().Close()
+
+	transport := r.transport.Load()
+	cache := r.cache.Load()
+
+	// Unchanged resolvers and cache size keep the current instances
+	same := *config
+	r.Reload(&same)
+	if r.transport.Load() != transport || r.cache.Load() != cache {
+		t.Error("Transport or cache replaced without changes")
+	}
+
+	changed := same
+	changed.Resolvers = []string{"1.1.1.1:53"}
+	changed.Timeout = time.Second
+	changed.CacheSize = 0
+	r.Reload(&changed)
+
+	newTransport := r.transport.Load()
+	if newTransport == transport {
+		t.Fatal("Transport not replaced")
+	}
+	if len(newTransport.resolvers) != 1 || newTransport.timeout != time.Second {
+		t.Errorf("New transport: got %d resolvers, timeout %v", len(newTransport.resolvers), newTransport.timeout)
+	}
+	if r.cache.Load() != nil {
+		t.Error("Cache not disabled")
+	}
+
+	if r.validator.Load() != nil {
+		t.Fatal("Validator created with DNSSEC disabled")
+	}
+	validating := changed
+	validating.DNSSEC = true
+	r.Reload(&validating)
+	if r.validator.Load() == nil {
+		t.Error("Validator not created")
+	}
+}
@@ -3,16 +3,31 @@ package client
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AliRezaBeigy/dns-as-doh/internal/alert"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dnssec"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/sampling"
 )
 
+// DefaultDrainTimeout is how long in-flight queries are given to finish on
+// shutdown.
+const DefaultDrainTimeout = 5 * time.Second
+
+// startupCheckTimeout bounds the resolver check at startup
+const startupCheckTimeout = 10 * time.Second
+
 // Config holds the client configuration.
 type Config struct {
 	// ListenAddr is the address to listen for DNS queries (default: 127.0.0.1:53)
@@ -27,19 +42,208 @@ type Config struct {
 	// SharedSecret is the encryption key
 	SharedSecret []byte
 
+	// KeyID selects the server-side key for SharedSecret; 0 is the
+	// server's shared key, other IDs are per-client keys
+	KeyID uint16
+
 	// Timeout is the timeout for DNS queries
 	Timeout time.Duration
 
+	// HealthCheckInterval is how often resolvers are probed with a query
+	// for the server domain's SOA record (0 disables probing). Resolvers
+	// that keep failing are avoided until a probe or query succeeds.
+	HealthCheckInterval time.Duration
+
+	// StartupChecks makes Start verify that a resolver answers for the
+	// server domain, failing with an explanation instead of timing out
+	// on every query later
+	StartupChecks bool
+
+	// ResolverStrategy is how queries are spread over the resolvers
+	ResolverStrategy Strategy
+
+	// SendJitter is the maximum random delay of sends to resolvers after
+	// the first when a query goes to several at once (0 sends them all at
+	// once)
+	SendJitter time.Duration
+
 	// MaxConcurrent is the maximum number of concurrent queries
 	MaxConcurrent int
+
+	// TunnelConcurrency is the maximum number of tunnel exchanges in
+	// flight at once; DNS lookups waiting for one go ahead of stream
+	// data and polls (0 disables the limit)
+	TunnelConcurrency int
+
+	// CacheSize is the number of responses to cache (0 disables caching)
+	CacheSize int
+
+	// Handshake establishes per-session keys with an X25519 key exchange
+	// for forward secrecy instead of using the shared key directly
+	Handshake bool
+
+	// SessionFile is a file to keep the handshake's session and its
+	// resumption ticket in, so a restarted client resumes the session
+	// without a new handshake (used with Handshake; empty disables it)
+	SessionFile string
+
+	// DrainTimeout is how long Shutdown waits for in-flight queries
+	DrainTimeout time.Duration
+
+	// StealthLevel shapes tunnel query names to resemble ordinary
+	// hostnames, trading some name space for less distinctive labels
+	StealthLevel dns.StealthLevel
+
+	// CaseRandomization sends tunnel query names in random case (DNS
+	// 0x20), as some resolvers do, for more entropy in each name
+	CaseRandomization bool
+
+	// DNSSEC validates responses locally and sets AD only on those that
+	// validate, instead of trusting the upstream resolver
+	DNSSEC bool
+
+	// TrustAnchors are the keys DNSSEC validation starts from (default:
+	// the root zone keys)
+	TrustAnchors []dnssec.TrustAnchor
+
+	// SocksAddr is the address of a local SOCKS5 proxy whose connections
+	// are tunneled to the server as TCP streams (empty disables it)
+	SocksAddr string
+
+	// DoHAddr is the address of a local DNS over HTTPS endpoint (RFC
+	// 8484) answering queries at /dns-query like ListenAddr does, for
+	// browsers and systems configured for DoH (empty disables it)
+	DoHAddr string
+
+	// DoHCert and DoHKey are the certificate and key files the DoH
+	// endpoint serves HTTPS with; without them it serves plain HTTP
+	DoHCert string
+	DoHKey  string
+
+	// DoHAllow are the client networks allowed to use the DoH endpoint;
+	// if empty, only loopback clients are
+	DoHAllow []netip.Prefix
+
+	// DoTAddr is the address of a local DNS over TLS endpoint (RFC 7858)
+	// answering queries like ListenAddr does, for systems configured for
+	// an encrypted resolver (empty disables it)
+	DoTAddr string
+
+	// DoTCert and DoTKey are the certificate and key files the DoT
+	// endpoint serves; without them it serves a self-signed certificate
+	DoTCert string
+	DoTKey  string
+
+	// DoTAllow are the client networks allowed to use the DoT endpoint;
+	// if empty, only loopback clients are
+	DoTAllow []netip.Prefix
+
+	// ExportInterface is a bridge interface, such as docker0 or virbr0,
+	// on whose addresses plain DNS (port 53) and DoH (port 8053) are
+	// served to the containers and VMs on its networks, so guests given
+	// the bridge address as their resolver use the tunnel (empty disables
+	// it)
+	ExportInterface string
+
+	// TrustAnchorState is a file to keep RFC 5011 trust anchor state in;
+	// if set, the anchors follow key rollovers announced in the DNSKEY
+	// RRsets of their zones
+	TrustAnchorState string
+
+	// DirectDomains are resolved directly against DirectResolvers instead
+	// of through the tunnel, with their subdomains
+	DirectDomains []dns.Name
+
+	// DirectRules are domains resolved directly too, optionally against
+	// resolvers of their own (see ReadDirectRules)
+	DirectRules []DirectRule
+
+	// DirectPrivatePTR resolves the reverse names of RFC 1918 addresses
+	// directly (see PrivatePTRDomains)
+	DirectPrivatePTR bool
+
+	// DirectResolvers are the plain resolvers, such as the LAN's, that
+	// direct domains are resolved against; if empty, Resolvers are
+	DirectResolvers []string
+
+	// Profiles override resolvers, resolver strategy, stealth level and
+	// direct domains on the networks they match (see ReadProfiles)
+	Profiles []NetworkProfile
+
+	// ResolverHistory is a file to keep how well each resolver answered on
+	// each network in, so resolvers that worked on a network are preferred
+	// right away when the host returns to it (empty disables it)
+	ResolverHistory string
+
+	// PowerPolicy says when to send fewer background queries to save
+	// battery and data
+	PowerPolicy PowerPolicy
+
+	// Listeners are extra local addresses with routes of their own, for
+	// applications that should resolve names another way
+	Listeners []ListenerConfig
+
+	// PathDiscovery probes each resolver at startup for the longest query
+	// names and largest responses that arrive intact, and fragments
+	// messages to fit
+	PathDiscovery bool
+
+	// MaxCodec is the densest codec path discovery tries for query names;
+	// it picks the densest every resolver carries intact
+	MaxCodec dns.Codec
+
+	// Compression compresses DNS messages before encryption, when that
+	// makes them smaller, once the server shows it supports it
+	Compression bool
+
+	// TraceLog logs every tunneled query with its trace ID, to correlate
+	// client and server logs while debugging
+	TraceLog bool
+
+	// TraceLogSample logs only 1 in TraceLogSample successful queries, so
+	// TraceLog stays usable at high query rates; failures are always
+	// logged. 0 or 1 logs every query.
+	TraceLogSample int
+
+	// UpstreamHint names the server upstream tunneled queries ask to be
+	// resolved with, from the server's named upstreams (empty uses the
+	// server's default upstream)
+	UpstreamHint string
+
+	// DirectFallback is the number of tunnel transport failures in a row
+	// after which queries are resolved directly, in cleartext, against the
+	// resolvers until a probe gets through the tunnel again (0 never falls
+	// back)
+	DirectFallback int
+
+	// AlertWebhook is the URL alerts are posted to (empty disables alerts)
+	AlertWebhook string
+
+	// AlertFormat is the body format of AlertWebhook: alert.FormatGeneric,
+	// alert.FormatSlack or alert.FormatDiscord
+	AlertFormat string
+
+	// AlertInterval is the minimum time between two alerts of the same
+	// event
+	AlertInterval time.Duration
 }
 
 // DefaultConfig returns a default configuration.
 func DefaultConfig() *Config {
 	return &Config{
-		ListenAddr:    "127.0.0.1:53",
-		Timeout:       2 * time.Second,
-		MaxConcurrent: 100,
+		ListenAddr:          "127.0.0.1:53",
+		Timeout:             2 * time.Second,
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		MaxConcurrent:       100,
+		TunnelConcurrency:   DefaultTunnelConcurrency,
+		CacheSize:           DefaultCacheSize,
+		DrainTimeout:        DefaultDrainTimeout,
+		PowerPolicy:         DefaultPowerPolicy,
+		PathDiscovery:       true,
+		MaxCodec:            dns.CodecBinary,
+		Compression:         true,
+		AlertFormat:         alert.FormatGeneric,
+		AlertInterval:       alert.DefaultInterval,
 		Resolvers: []string{
 			"8.8.8.8:53",
 			"1.1.1.1:53",
@@ -50,20 +254,65 @@ func DefaultConfig() *Config {
 
 // Resolver is the DNS tunnel client resolver.
 type Resolver struct {
-	config    *Config
-	domain    dns.Name
-	cipher    *crypto.Cipher
-	clientID  dns.ClientID
-	transport *Transport
-	conn      *net.UDPConn
-	sem       chan struct{}
-	wg        sync.WaitGroup
-	ctx       context.Context
-	cancel    context.CancelFunc
+	config      *Config
+	domain      dns.Name
+	cipher      *crypto.Cipher
+	clientID    dns.ClientID
+	fragmentID  uint32 // last message ID used for tunnel exchanges
+	session     atomic.Pointer[session]
+	handshakeMu sync.Mutex
+	transport   atomic.Pointer[Transport]
+	cache       atomic.Pointer[Cache]
+	validator   atomic.Pointer[dnssec.Validator]
+	stealth     atomic.Int32 // dns.StealthLevel
+	randomCase  atomic.Bool  // tunnel query names in random case
+	compress    atomic.Bool  // DNS messages are compressed
+	compressed  atomic.Bool  // the server sent a compressed reply
+	traceLog    atomic.Bool  // tunneled queries are logged
+	traceSample sampling.Sampler
+	upstream    atomic.Pointer[string]   // UpstreamHint
+	split       atomic.Pointer[splitDNS] // direct domains and rules
+	powerPolicy atomic.Int32             // PowerPolicy
+	powerSaving atomic.Bool              // background queries are less frequent
+	active      *Config                  // last reloaded configuration
+	base        *Config                  // active before the network profile
+	profile     string                   // name of the network profile in use
+	reloadMu    sync.Mutex
+	conn        *net.UDPConn
+	listeners   []*listener // ListenAddr's first, then the extra ones
+	draining    atomic.Bool
+	sem         chan struct{}
+	sched       *scheduler // tunnel exchanges in flight
+	wg          sync.WaitGroup
+	background  sync.WaitGroup // tasks Shutdown doesn't wait for
+	ctx         context.Context
+	cancel      context.CancelFunc
+	anchors     *dnssec.AnchorManager // nil without trust anchor state
+	socks       net.Listener          // nil without a SOCKS5 proxy
+	doh         *http.Server          // nil without a DoH endpoint
+	dohLn       net.Listener          // the DoH endpoint's listener
+	dot         *dotServer            // nil without a DoT endpoint
+	export      *http.Server          // nil without ExportInterface
+	exportLns   []net.Listener        // the exported DoH listeners
+	streamID    uint32                // last stream ID used
+	streams     map[uint32]*clientStream
+	streamsMu   sync.Mutex
+	polling     atomic.Bool   // streams receive data through polls
+	pollWake    chan struct{} // signalled when streams open or close
+	status      statusTracker
+	fallback    directFallback
+	paths       pathState
+	chunks      chunkState
+	alerts      *alert.Notifier  // nil without AlertWebhook
+	history     *resolverHistory // nil without ResolverHistory
+	sessionFile *sessionFile     // nil without SessionFile or Handshake
 }
 
 // NewResolver creates a new client resolver.
-func NewResolver(config *Config) (*Resolver, error) {
+func NewResolver(base *Config) (*Resolver, error) {
+	config, profile := base.profileConfig()
+	logProfile("", profile)
+
 	// Parse server domain
 	domain, err := dns.ParseName(config.ServerDomain)
 	if err != nil {
@@ -76,6 +325,14 @@ func NewResolver(config *Config) (*Resolver, error) {
 		return nil, fmt.Errorf("failed to create cipher: %w", err)
 	}
 
+	var alerts *alert.Notifier
+	if config.AlertWebhook != "" {
+		alerts, err = alert.New(config.AlertWebhook, config.AlertFormat, "client for "+domain.String(), config.AlertInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Generate client ID for this session
 	clientID := dns.NewClientID()
 
@@ -83,16 +340,69 @@ func NewResolver(config *Config) (*Resolver, error) {
 
 	r := &Resolver{
 		config:   config,
+		active:   config,
+		base:     base,
+		profile:  profile,
 		domain:   domain,
 		cipher:   cipher,
 		clientID: clientID,
 		sem:      make(chan struct{}, config.MaxConcurrent),
+		sched:    newScheduler(config.TunnelConcurrency),
 		ctx:      ctx,
 		cancel:   cancel,
+		streams:  make(map[uint32]*clientStream),
+		pollWake: make(chan struct{}, 1),
+		status:   statusTracker{started: time.Now()},
+		alerts:   alerts,
+	}
+
+	if config.ResolverHistory != "" {
+		if r.history, err = openResolverHistory(config.ResolverHistory); err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to open resolver history: %w", err)
+		}
+	}
+
+	if config.SessionFile != "" && config.Handshake {
+		if r.sessionFile, err = openSessionFile(config.SessionFile); err != nil {
+			r.history.Close()
+			cancel()
+			return nil, fmt.Errorf("failed to open session file: %w", err)
+		}
+		if s := r.sessionFile.load(domain); s != nil {
+			r.session.Store(s)
+		}
 	}
 
 	// Create transport with parallel resolver support
-	r.transport = NewTransport(config.Resolvers, config.Timeout)
+	transport := NewTransport(config.Resolvers, config.Timeout)
+	transport.SetStrategy(config.ResolverStrategy)
+	transport.SetSendJitter(config.SendJitter)
+	r.restoreHistory(transport)
+	r.transport.Store(transport)
+
+	if config.CacheSize > 0 {
+		r.cache.Store(NewCache(config.CacheSize))
+	}
+
+	r.stealth.Store(int32(config.StealthLevel))
+	r.randomCase.Store(config.CaseRandomization)
+	r.compress.Store(config.Compression)
+	r.traceLog.Store(config.TraceLog)
+	r.traceSample.SetRate(config.TraceLogSample)
+	r.upstream.Store(&config.UpstreamHint)
+	r.split.Store(newSplitDNS(config))
+	r.powerPolicy.Store(int32(config.PowerPolicy))
+	r.setFallbackAfter(config.DirectFallback)
+
+	if config.DNSSEC && config.TrustAnchorState != "" {
+		r.anchors, err = r.newAnchorManager(config)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	r.validator.Store(r.newValidator(config))
 
 	return r, nil
 }
@@ -105,20 +415,137 @@ func (r *Resolver) Start() error {
 		return fmt.Errorf("invalid listen address: %w", err)
 	}
 
-	// Create UDP listener
+	// Fail fast if the server domain can't be reached
+	if r.config.StartupChecks {
+		ctx, cancel := context.WithTimeout(r.ctx, startupCheckTimeout)
+		err := r.transport.Load().Check(ctx, r.domain)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create UDP listeners
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", r.config.ListenAddr, err)
 	}
+	extra, err := r.listen(r.config.Listeners)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 	r.conn = conn
+	r.listeners = append([]*listener{{conn: conn, route: RouteTunnel}}, extra...)
+
+	// Create SOCKS5 listener
+	if r.config.SocksAddr != "" {
+		ln, err := net.Listen("tcp", r.config.SocksAddr)
+		if err != nil {
+			r.closeEndpoints()
+			return fmt.Errorf("failed to listen on %s: %w", r.config.SocksAddr, err)
+		}
+		r.socks = ln
+	}
+
+	// Create DoH listener
+	if r.config.DoHAddr != "" {
+		ln, server, err := r.listenDoH()
+		if err != nil {
+			r.closeEndpoints()
+			return err
+		}
+		r.dohLn, r.doh = ln, server
+	}
+
+	// Create DoT listener
+	if r.config.DoTAddr != "" {
+		r.dot, err = r.listenDoT()
+		if err != nil {
+			r.closeEndpoints()
+			return err
+		}
+	}
+
+	// Export plain DNS and DoH to guests on a bridge
+	if r.config.ExportInterface != "" {
+		exported, lns, err := r.listenExport(exportDNSPort, exportDoHPort)
+		if err != nil {
+			r.closeEndpoints()
+			return err
+		}
+		r.listeners = append(r.listeners, exported...)
+		r.exportLns = lns
+		r.export = &http.Server{
+			Handler:           r.exportHandler(),
+			ReadHeaderTimeout: dohReadTimeout,
+			BaseContext:       func(net.Listener) context.Context { return r.ctx },
+		}
+	}
 
 	log.Printf("DNS resolver listening on %s", r.config.ListenAddr)
+	for _, l := range r.config.Listeners {
+		log.Printf("DNS resolver listening on %s (%s)", l.Addr, l.Route)
+	}
+	exported := r.listeners[len(r.listeners)-len(r.exportLns):]
+	for i, ln := range r.exportLns {
+		log.Printf("Exporting to %s guests: DNS on %s, DoH at http://%s%s",
+			r.config.ExportInterface, exported[i].conn.LocalAddr(), ln.Addr(), dohPath)
+	}
 	log.Printf("Server domain: %s", r.domain.String())
-	log.Printf("Using %d resolvers", len(r.config.Resolvers))
+	log.Printf("Using %d resolvers (%s)", len(r.config.Resolvers), r.config.ResolverStrategy)
+	log.Printf("DNSSEC validation: %s", validatorString(r.config))
+	if n := len(r.split.Load().routes); n > 0 {
+		log.Printf("Split DNS: %d domains resolved directly", n)
+	}
+	if n := r.config.DirectFallback; n > 0 {
+		log.Printf("Direct fallback: queries resolved in cleartext after %d tunnel failures in a row", n)
+	}
+
+	r.transport.Load().StartHealthChecks(r.domain, r.config.HealthCheckInterval)
+	r.startPathDiscovery()
+
+	if r.anchors != nil {
+		r.wg.Add(1)
+		go r.refreshTrustAnchors()
+	}
 
 	// Start accepting queries
-	r.wg.Add(1)
-	go r.acceptLoop()
+	for _, l := range r.listeners {
+		r.wg.Add(1)
+		go r.acceptLoop(l)
+	}
+
+	r.background.Add(2)
+	go r.watchNetwork()
+	go r.watchPower()
+
+	if r.socks != nil {
+		log.Printf("SOCKS5 proxy listening on %s", r.socks.Addr())
+		r.polling.Store(true)
+		r.wg.Add(2)
+		go r.socksLoop()
+		go r.pollLoop()
+	}
+
+	if r.doh != nil {
+		log.Printf("DoH endpoint listening on %s://%s%s", r.dohScheme(), r.dohLn.Addr(), dohPath)
+		go r.serveDoH(r.dohLn, r.doh)
+	}
+
+	for _, ln := range r.exportLns {
+		go r.serveDoH(ln, r.export)
+	}
+
+	if r.dot != nil {
+		if r.dot.pin != "" {
+			log.Printf("DoT endpoint listening on %s with a self-signed certificate (SPKI pin sha256/%s)", r.dot.ln.Addr(), r.dot.pin)
+		} else {
+			log.Printf("DoT endpoint listening on %s", r.dot.ln.Addr())
+		}
+		r.wg.Add(1)
+		go r.acceptDoTLoop()
+	}
 
 	return nil
 }
@@ -126,11 +553,69 @@ func (r *Resolver) Start() error {
 // Stop stops the resolver.
 func (r *Resolver) Stop() {
 	r.cancel()
-	if r.conn != nil {
-		r.conn.Close()
+	r.closeListeners()
+	if r.socks != nil {
+		r.socks.Close()
+	}
+	if r.doh != nil {
+		r.doh.Close()
+	}
+	if r.dot != nil {
+		r.dot.close()
+	}
+	if r.export != nil {
+		r.export.Close()
 	}
-	r.transport.Close()
+	r.transport.Load().Close()
+	r.split.Load().close()
 	r.wg.Wait()
+	r.background.Wait()
+	r.alerts.Close()
+	if r.history != nil {
+		r.saveHistory(networkFingerprint())
+		r.history.Close()
+	}
+	r.sessionFile.Close()
+}
+
+// Shutdown stops accepting queries and waits for in-flight queries to
+// finish until ctx is done, then stops the resolver. It returns ctx's error
+// if queries were still in flight.
+func (r *Resolver) Shutdown(ctx context.Context) error {
+	r.draining.Store(true)
+
+	// Wake the accept loops
+	for _, l := range r.listeners {
+		_ = l.conn.SetReadDeadline(time.Now())
+	}
+	if r.socks != nil {
+		r.socks.Close()
+	}
+	if r.dot != nil {
+		r.dot.drain()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if r.doh != nil {
+			_ = r.doh.Shutdown(ctx)
+		}
+		if r.export != nil {
+			_ = r.export.Shutdown(ctx)
+		}
+		r.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	r.Stop()
+	return err
 }
 
 // ListenAddr returns the address the resolver is listening on.
@@ -138,8 +623,32 @@ func (r *Resolver) ListenAddr() string {
 	return r.config.ListenAddr
 }
 
-// acceptLoop accepts incoming DNS queries.
-func (r *Resolver) acceptLoop() {
+// closeEndpoints closes the listeners Start opened, when it fails.
+func (r *Resolver) closeEndpoints() {
+	r.closeListeners()
+	if r.socks != nil {
+		r.socks.Close()
+	}
+	if r.dohLn != nil {
+		r.dohLn.Close()
+	}
+	if r.dot != nil {
+		r.dot.close()
+	}
+	for _, ln := range r.exportLns {
+		ln.Close()
+	}
+}
+
+// closeListeners closes the UDP listeners.
+func (r *Resolver) closeListeners() {
+	for _, l := range r.listeners {
+		l.close()
+	}
+}
+
+// acceptLoop accepts incoming DNS queries on a listener.
+func (r *Resolver) acceptLoop(l *listener) {
 	defer r.wg.Done()
 
 	buf := make([]byte, dns.MaxEDNSSize)
@@ -150,10 +659,14 @@ func (r *Resolver) acceptLoop() {
 		default:
 		}
 
-		// Set read deadline
-		_ = r.conn.SetReadDeadline(time.Now().Add(time.Second))
+		// Set read deadline; checked after setting it so Shutdown's wakeup
+		// isn't overwritten
+		_ = l.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if r.draining.Load() {
+			return
+		}
 
-		n, addr, err := r.conn.ReadFromUDP(buf)
+		n, addr, err := l.conn.ReadFromUDP(buf)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
@@ -165,6 +678,10 @@ func (r *Resolver) acceptLoop() {
 			continue
 		}
 
+		if l.acl != nil && !l.acl.Allowed(addr) {
+			continue
+		}
+
 		// Copy the data
 		data := make([]byte, n)
 		copy(data, buf[:n])
@@ -182,13 +699,13 @@ func (r *Resolver) acceptLoop() {
 			defer r.wg.Done()
 			defer func() { <-r.sem }()
 
-			r.handleQuery(data, addr)
+			r.handleQuery(l, data, addr)
 		}(data, addr)
 	}
 }
 
-// handleQuery handles a single DNS query.
-func (r *Resolver) handleQuery(data []byte, addr *net.UDPAddr) {
+// handleQuery handles a single DNS query received on a listener.
+func (r *Resolver) handleQuery(l *listener, data []byte, addr *net.UDPAddr) {
 	// Parse the incoming DNS query
 	query, err := dns.ParseMessage(data)
 	if err != nil {
@@ -203,118 +720,290 @@ func (r *Resolver) handleQuery(data []byte, addr *net.UDPAddr) {
 
 	// Must have exactly one question
 	if len(query.Question) != 1 {
-		r.sendError(query, addr, dns.RcodeFormatError)
+		r.sendError(l.conn, query, addr, dns.RcodeFormatError)
 		return
 	}
 
-	// Process the query through the tunnel
-	response, err := r.processTunneledQuery(r.ctx, query)
+	response, err := r.resolve(r.ctx, l, query, data)
 	if err != nil {
-		log.Printf("tunnel query failed: %v", err)
-		r.sendError(query, addr, dns.RcodeServerFail)
+		log.Printf("%v", err)
+		r.sendError(l.conn, query, addr, dns.RcodeServerFail)
 		return
 	}
+	_, _ = l.conn.WriteToUDP(response, addr)
+}
 
-	// Send response
-	respData, err := response.Marshal()
-	if err != nil {
-		log.Printf("failed to marshal response: %v", err)
-		return
+// resolve resolves a query received on a listener the way its route, the
+// split DNS and the direct fallback say, and returns the response to send
+// back. data is the query as received.
+func (r *Resolver) resolve(ctx context.Context, l *listener, query *dns.Message, data []byte) ([]byte, error) {
+	if l.route == RouteDirect {
+		return r.resolveDirect(ctx, l.transport, data)
+	}
+	if transport, ok := r.split.Load().route(query.Question[0].Name); ok {
+		return r.resolveDirect(ctx, transport, data)
+	}
+	if resp, ok, err := r.resolveFallback(ctx, query, data); ok {
+		return resp, err
 	}
 
-	_, _ = r.conn.WriteToUDP(respData, addr)
-}
-
-// processTunneledQuery sends a DNS query through the tunnel.
-func (r *Resolver) processTunneledQuery(ctx context.Context, query *dns.Message) (*dns.Message, error) {
-	// Marshal the original query
-	originalData, err := query.Marshal()
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal query: %w", err)
+	if l.upstream != "" {
+		ctx = withUpstreamHint(ctx, l.upstream)
 	}
 
-	// Encrypt the query
-	encryptedQuery, err := r.cipher.Encrypt(originalData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt query: %w", err)
+	if v := r.validator.Load(); v != nil {
+		return r.resolveValidatedQuery(ctx, v, query)
 	}
 
-	// Encode into DNS name
-	tunnelName, err := dns.EncodePayload(encryptedQuery, r.clientID, r.domain)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode payload: %w", err)
-	}
-
-	// Create tunnel query
-	tunnelQuery := &dns.Message{
-		ID:    dns.GenerateQueryID(),
-		Flags: 0x0100, // RD=1
-		Question: []dns.Question{
-			{
-				Name:  tunnelName,
-				Type:  dns.RRTypeTXT,
-				Class: dns.ClassIN,
-			},
-		},
+	// Serve from cache, rebuilt for the query's DO and EDNS, or process
+	// the query through the tunnel. Tunneled responses are returned as
+	// received, so responses the server relays byte for byte reach the
+	// stub unchanged.
+	if response, ok := r.cachedResponse(query); ok {
+		respData, err := response.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal response: %w", err)
+		}
+		return respData, nil
 	}
-	tunnelQuery.AddEDNS0(4096)
 
-	// Marshal tunnel query
-	tunnelData, err := tunnelQuery.Marshal()
+	response, respData, err := r.processTunneledQuery(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal tunnel query: %w", err)
+		err = fmt.Errorf("tunnel query failed: %w", err)
+		if resp, ok, fallbackErr := r.resolveFallback(ctx, query, data); ok {
+			log.Printf("%v", err)
+			return resp, fallbackErr
+		}
+		return nil, err
+	}
+	if cache := r.cache.Load(); cache != nil {
+		cache.Put(query, response)
 	}
+	return respData, nil
+}
 
-	// Send to resolvers and get response
-	respData, err := r.transport.Query(ctx, tunnelData)
-	if err != nil {
-		return nil, fmt.Errorf("transport query failed: %w", err)
+// respond resolves a query received on the DoH or DoT endpoint like one
+// received on the listen address and returns the response: FORMERR unless
+// it has exactly one question, SERVFAIL if it fails to resolve. It fails
+// only if ctx ends first or the error response can't be marshaled.
+func (r *Resolver) respond(ctx context.Context, query *dns.Message, data []byte) ([]byte, error) {
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+	defer func() { <-r.sem }()
 
-	// Parse tunnel response
-	tunnelResp, err := dns.ParseMessage(respData)
+	if len(query.Question) != 1 {
+		return errorResponse(query, dns.RcodeFormatError)
+	}
+	response, err := r.resolve(ctx, &listener{route: RouteTunnel}, query, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse tunnel response: %w", err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Printf("%v", err)
+		return errorResponse(query, dns.RcodeServerFail)
 	}
+	return response, nil
+}
 
-	// Check for errors
-	if tunnelResp.Rcode() != dns.RcodeNoError {
-		return nil, fmt.Errorf("tunnel response error: %d", tunnelResp.Rcode())
+// cachedResponse returns a cached response to the query, if any.
+func (r *Resolver) cachedResponse(query *dns.Message) (*dns.Message, bool) {
+	cache := r.cache.Load()
+	if cache == nil {
+		return nil, false
 	}
+	return cache.Get(query)
+}
+
+// processTunneledQuery sends a DNS query through the tunnel and returns the
+// response, parsed and as received with the ID of the query. Each query
+// gets a trace ID, sent to the server inside the encrypted query if it
+// uses EDNS, and named in errors so client and server logs can be matched.
+// The query also carries the server upstream it asks for, if any.
+// If a resolver truncates the tunnel response, the query is retried once
+// with plain resolvers queried over TCP.
+func (r *Resolver) processTunneledQuery(ctx context.Context, query *dns.Message) (*dns.Message, []byte, error) {
+	trace := dns.NewTraceID()
+	start := time.Now()
 
-	// Extract payload from TXT record
-	payload, err := dns.ExtractResponsePayload(tunnelResp, r.domain)
+	// Marshal the original query
+	inner := query.WithTraceID(trace)
+	upstream := r.upstreamHint(ctx)
+	if upstream != "" {
+		inner = inner.WithUpstreamHint(upstream)
+	}
+	originalData, err := inner.Marshal()
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract response payload: %w", err)
+		return nil, nil, fmt.Errorf("failed to marshal query: %w", err)
 	}
 
-	// Decrypt the response
-	decryptedResp, err := r.cipher.DecryptWithoutTimestamp(payload)
+	// Send through the tunnel
+	var flags byte
+	if r.compress.Load() {
+		flags = dns.FragmentFlagCompress
+	}
+	decryptedResp, err := r.tunnelExchange(ctx, originalData, flags)
+	if errors.Is(err, ErrTruncated) {
+		// A resolver truncated a response fragment over UDP; retry the
+		// query once over TCP, which carries whole answers
+		decryptedResp, err = r.tunnelExchange(withStreamTransport(ctx), originalData, flags)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt response: %w", err)
+		return nil, nil, fmt.Errorf("%w (trace %s)", err, trace)
 	}
 
 	// Parse the original DNS response
 	response, err := dns.ParseMessage(decryptedResp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse decrypted response: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse decrypted response: %w (trace %s)", err, trace)
 	}
 
+	r.checkKeyRejected(response)
+	r.checkUpstreamRefused(response, upstream)
+
 	// Update response ID to match original query
 	response.ID = query.ID
+	binary.BigEndian.PutUint16(decryptedResp, query.ID)
 
-	return response, nil
+	// The hint added an OPT record to a query without one; the stub
+	// mustn't get one back
+	if upstream != "" && query.GetEDNS0Size() == 0 {
+		if response, decryptedResp, err = withoutOPT(response); err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal response: %w (trace %s)", err, trace)
+		}
+	}
+
+	if r.traceLog.Load() && r.traceSample.Sample() {
+		q := query.Question[0]
+		log.Printf("trace %s: %s type %d, %d byte response in %v", trace, q.Name, q.Type, len(decryptedResp), time.Since(start).Round(time.Millisecond))
+	}
+	return response, decryptedResp, nil
 }
 
-// sendError sends a DNS error response.
-func (r *Resolver) sendError(query *dns.Message, addr *net.UDPAddr, rcode uint16) {
-	resp := dns.CreateResponse(query)
-	resp.SetRcode(rcode)
+// checkKeyRejected notes whether the server refused a tunneled query
+// because it no longer accepts the key, telling the user to get a new one.
+// Only the server can send the error, inside the encrypted reply.
+func (r *Resolver) checkKeyRejected(response *dns.Message) {
+	var reason string
+	if code, text, ok := response.ExtendedError(); ok && code == dns.EDEKeyRejected {
+		reason = text
+	}
+	if !r.status.setKeyRejected(reason) || reason == "" {
+		return
+	}
+	log.Printf("The server refused the key (%s); get a new key from its operator", reason)
+	r.alerts.Notify(alert.EventKeyRejected, fmt.Sprintf("the server refused the key: %s", reason))
+}
+
+// tunnelExchange encrypts a message with the shared or session keys,
+// sends it through the tunnel with the given fragment flags and returns
+// the decrypted reply. The outcome is recorded for the status and the
+// direct fallback unless ctx ended first.
+func (r *Resolver) tunnelExchange(ctx context.Context, message []byte, flags byte) ([]byte, error) {
+	class := exchangeClass(flags)
+	if err := r.sched.acquire(ctx, class); err != nil {
+		return nil, err
+	}
+	reply, err := r.exchangeMessage(ctx, message, flags)
+	r.sched.release(class)
+	if ctx.Err() != nil {
+		return reply, err
+	}
+	if r.status.record(err) {
+		r.alerts.Notify(alert.EventTunnelDown, fmt.Sprintf("%d tunnel queries failed in a row, last: %v", tunnelDownFailures, err))
+	}
+	r.recordTunnel(err)
+	return reply, err
+}
 
-	data, err := resp.Marshal()
+// exchangeMessage implements tunnelExchange. Messages sent with
+// FragmentFlagCompress are compressed once the server has sent a
+// compressed reply, which shows it decompresses them too; servers that
+// don't know the flag ignore it.
+func (r *Resolver) exchangeMessage(ctx context.Context, message []byte, flags byte) ([]byte, error) {
+	r.ensurePathAnnounced()
+	if flags&dns.FragmentFlagCompress != 0 && r.compressed.Load() {
+		if compressed, ok := dns.Compress(message); ok {
+			message, flags = compressed, flags|dns.FragmentFlagCompressed
+		}
+	}
+	for {
+		cipher, cipherFlags, domain, err := r.queryCipher(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted, err := cipher.Encrypt(message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt query: %w", err)
+		}
+		resuming := cipherFlags == dns.FragmentFlagResume
+		if resuming {
+			// Send the ticket first, unless the session changed meanwhile
+			ticket, ok := r.sessionTicket(cipher)
+			if !ok {
+				continue
+			}
+			encrypted = append(crypto.AppendTicket(nil, ticket), encrypted...)
+		}
+
+		// Send through the tunnel, fragmenting as needed
+		payload, replyFlags, err := r.exchangeFragments(ctx, domain, encrypted, flags|cipherFlags)
+		r.pathUsed(err)
+		if err != nil {
+			// Retry through the server's domain if the instance holding
+			// the session can't be reached under its own
+			if r.unpinSession(cipher) {
+				continue
+			}
+			// The server keeps the session by ClientID, so queries lost
+			// on the way, e.g. while the network changes, don't end it
+			if !errors.Is(err, ErrTransport) {
+				r.dropSession(cipher)
+				// A session that couldn't be resumed is replaced right
+				// away, like one the server forgot
+				if resuming {
+					continue
+				}
+			}
+			return nil, err
+		}
+		if resuming {
+			r.sessionResumed(cipher)
+		}
+
+		// Decrypt the reply
+		reply, err := cipher.DecryptWithoutTimestamp(payload)
+		if err != nil {
+			r.alerts.Notify(alert.EventKeyMismatch, "a tunnel response failed to decrypt; the server may use a different key")
+			r.dropSession(cipher)
+			return nil, fmt.Errorf("failed to decrypt response: %w", err)
+		}
+		if replyFlags&dns.FragmentFlagCompressed != 0 {
+			if reply, err = dns.Decompress(reply); err != nil {
+				return nil, fmt.Errorf("failed to decompress response: %w", err)
+			}
+			r.compressed.Store(true)
+		}
+		return reply, nil
+	}
+}
+
+// sendError sends a DNS error response on conn.
+func (r *Resolver) sendError(conn *net.UDPConn, query *dns.Message, addr *net.UDPAddr, rcode uint16) {
+	data, err := errorResponse(query, rcode)
 	if err != nil {
 		return
 	}
 
-	_, _ = r.conn.WriteToUDP(data, addr)
+	_, _ = conn.WriteToUDP(data, addr)
+}
+
+// errorResponse returns a DNS error response to the query.
+func errorResponse(query *dns.Message, rcode uint16) ([]byte, error) {
+	resp := dns.CreateResponse(query)
+	resp.SetRcode(rcode)
+	return resp.Marshal()
 }
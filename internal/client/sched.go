@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// DefaultTunnelConcurrency is the number of tunnel exchanges in flight at
+// once
+const DefaultTunnelConcurrency = 32
+
+// bulkShare is the fraction of the scheduler's slots bulk exchanges may
+// hold
+const bulkShare = 0.75
+
+// Tunnel exchange classes, in order of priority
+const (
+	// classInteractive is DNS lookups and handshakes, which someone
+	// waits on
+	classInteractive = iota
+
+	// classBulk is stream data and polls, which move as much as the
+	// tunnel carries
+	classBulk
+
+	numClasses
+)
+
+// exchangeClass returns the class of a tunnel exchange of a message with
+// the given fragment flags.
+func exchangeClass(flags byte) int {
+	if flags&(dns.FragmentFlagStream|dns.FragmentFlagPoll) != 0 {
+		return classBulk
+	}
+	return classInteractive
+}
+
+// scheduler admits tunnel exchanges up to a limit in flight, so that
+// interactive lookups aren't starved behind bulk stream traffic: waiting
+// interactive exchanges go first, and bulk ones may hold only bulkShare
+// of the slots, leaving the rest for interactive ones to start at once.
+// Within a class, exchanges are admitted in order.
+type scheduler struct {
+	mu       sync.Mutex
+	limit    int // 0 admits every exchange at once
+	inFlight [numClasses]int
+	waiting  [numClasses][]chan struct{}
+}
+
+// newScheduler creates a scheduler admitting limit exchanges at once.
+func newScheduler(limit int) *scheduler {
+	return &scheduler{limit: max(limit, 0)}
+}
+
+// setLimit changes the number of exchanges admitted at once.
+func (s *scheduler) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = max(limit, 0)
+	s.dispatch()
+}
+
+// acquire waits until an exchange of class may start or ctx is done. Each
+// successful acquire must be followed by a release.
+func (s *scheduler) acquire(ctx context.Context, class int) error {
+	s.mu.Lock()
+	if s.admits(class) && len(s.waiting[classInteractive]) == 0 && len(s.waiting[class]) == 0 {
+		s.inFlight[class]++
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.waiting[class] = append(s.waiting[class], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-ready:
+		// Admitted meanwhile; pass the slot on
+		s.inFlight[class]--
+		s.dispatch()
+	default:
+		for i, ch := range s.waiting[class] {
+			if ch == ready {
+				s.waiting[class] = append(s.waiting[class][:i], s.waiting[class][i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// release frees the slot of an exchange of class.
+func (s *scheduler) release(class int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight[class]--
+	s.dispatch()
+}
+
+// admits reports whether an exchange of class may start now. The caller
+// must hold mu.
+func (s *scheduler) admits(class int) bool {
+	if s.limit == 0 {
+		return true
+	}
+	if s.inFlight[classInteractive]+s.inFlight[classBulk] >= s.limit {
+		return false
+	}
+	return class == classInteractive || s.inFlight[classBulk] < max(int(float64(s.limit)*bulkShare), 1)
+}
+
+// dispatch admits waiting exchanges, interactive ones first, while slots
+// are free. The caller must hold mu.
+func (s *scheduler) dispatch() {
+	for class := range numClasses {
+		for len(s.waiting[class]) > 0 && s.admits(class) {
+			s.inFlight[class]++
+			close(s.waiting[class][0])
+			s.waiting[class] = s.waiting[class][1:]
+		}
+	}
+}
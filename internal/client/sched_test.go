@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestExchangeClass(t *testing.T) {
+	tests := []struct {
+		flags byte
+		want  int
+	}{
+		{0, classInteractive},
+		{dns.FragmentFlagCompress, classInteractive},
+		{dns.FragmentFlagHandshake, classInteractive},
+		{dns.FragmentFlagStream, classBulk},
+		{dns.FragmentFlagPoll, classBulk},
+	}
+	for _, tt := range tests {
+		if got := exchangeClass(tt.flags); got != tt.want {
+			t.Errorf("exchangeClass(%#x) = %d, want %d", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(4)
+	ctx := context.Background()
+
+	// Bulk exchanges leave a quarter of the slots to interactive ones
+	for range 3 {
+		if err := s.acquire(ctx, classBulk); err != nil {
+			t.Fatalf("acquire(bulk) error = %v", err)
+		}
+	}
+	admitted := make(chan int, 8)
+	go func() {
+		if s.acquire(ctx, classBulk) == nil {
+			admitted <- classBulk
+		}
+	}()
+	if err := s.acquire(ctx, classInteractive); err != nil {
+		t.Fatalf("acquire(interactive) with bulk over its share: %v", err)
+	}
+	waitWaiting(t, s, classBulk, 1)
+
+	// Waiting interactive exchanges go first once slots are freed
+	go func() {
+		if s.acquire(ctx, classInteractive) == nil {
+			admitted <- classInteractive
+		}
+	}()
+	waitWaiting(t, s, classInteractive, 1)
+	s.release(classBulk)
+	if got := <-admitted; got != classInteractive {
+		t.Errorf("First admitted: %d, want interactive", got)
+	}
+	s.release(classInteractive)
+	s.release(classInteractive)
+	if got := <-admitted; got != classBulk {
+		t.Errorf("Then admitted: %d, want bulk", got)
+	}
+
+	// Waits end with their context
+	_ = s.acquire(ctx, classInteractive)
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(short, classInteractive); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire() when full = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Raising the limit admits waiting exchanges, and 0 lifts it
+	go func() {
+		if s.acquire(ctx, classInteractive) == nil {
+			admitted <- classInteractive
+		}
+	}()
+	waitWaiting(t, s, classInteractive, 1)
+	s.setLimit(5)
+	<-admitted
+	s.setLimit(0)
+	for range 10 {
+		if err := s.acquire(ctx, classBulk); err != nil {
+			t.Fatalf("acquire() without a limit: %v", err)
+		}
+	}
+}
+
+// waitWaiting waits until n exchanges of class wait on s.
+func waitWaiting(t *testing.T, s *scheduler, class, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		waiting := len(s.waiting[class])
+		s.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d exchanges of class %d waiting, want %d", waiting, class, n)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+// SessionLifetime is how long session keys are used before a new handshake.
+// It is shorter than the server's idle session timeout.
+const SessionLifetime = 10 * time.Minute
+
+// sessionBucket is the storage bucket of saved sessions, keyed by server
+// domain
+const sessionBucket = "sessions"
+
+// session holds keys established with a handshake.
+type session struct {
+	cipher  *crypto.Cipher
+	created time.Time
+	domain  dns.Name // subdomain of the instance holding the session, or nil
+	ticket  []byte   // resumption ticket, nil if the server sent none
+	resume  bool     // the server may not hold the session: send the ticket
+}
+
+// queryCipher returns the cipher for a tunnel query, the fragment flags
+// marking it and the domain to send it under. With handshakes enabled a
+// session is established first if there is none or it has expired.
+func (r *Resolver) queryCipher(ctx context.Context) (*crypto.Cipher, byte, dns.Name, error) {
+	if !r.config.Handshake {
+		return r.cipher, 0, r.domain, nil
+	}
+
+	if s := r.session.Load(); s != nil && time.Since(s.created) < SessionLifetime {
+		return s.cipher, s.flags(), s.queryDomain(r.domain), nil
+	}
+
+	// Only one handshake at a time; others wait for its result
+	r.handshakeMu.Lock()
+	defer r.handshakeMu.Unlock()
+
+	if s := r.session.Load(); s != nil && time.Since(s.created) < SessionLifetime {
+		return s.cipher, s.flags(), s.queryDomain(r.domain), nil
+	}
+
+	s, err := r.handshake(ctx)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	r.session.Store(s)
+	r.sessionFile.save(r.domain, s)
+	return s.cipher, dns.FragmentFlagSession, s.queryDomain(r.domain), nil
+}
+
+// flags returns the fragment flags of the session's messages.
+func (s *session) flags() byte {
+	if s.resume {
+		return dns.FragmentFlagResume
+	}
+	return dns.FragmentFlagSession
+}
+
+// queryDomain returns the domain to send the session's queries under.
+func (s *session) queryDomain(domain dns.Name) dns.Name {
+	if s.domain != nil {
+		return s.domain
+	}
+	return domain
+}
+
+// handshake exchanges ephemeral X25519 keys with the server, authenticated
+// by the pre-shared key, and returns the session. With a session file the
+// client asks for a resumption ticket, which the server sends after its
+// key. Servers with an instance label send it last; the session's queries
+// then go to that instance's subdomain.
+func (r *Resolver) handshake(ctx context.Context) (*session, error) {
+	hs, err := crypto.NewHandshake()
+	if err != nil {
+		return nil, err
+	}
+
+	request := hs.PublicKey()
+	if r.sessionFile != nil {
+		request = append(request, crypto.TicketRequest)
+	}
+	msg, err := r.cipher.Encrypt(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt handshake: %w", err)
+	}
+
+	reply, _, err := r.exchangeFragments(ctx, r.domain, msg, dns.FragmentFlagHandshake)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := r.cipher.DecryptWithoutTimestamp(reply)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt handshake: %w", err)
+	}
+	if len(plaintext) < crypto.PublicKeySize {
+		return nil, crypto.ErrInvalidKey
+	}
+
+	cipher, err := hs.SessionCipher(plaintext[:crypto.PublicKeySize], true) // isClient=true
+	if err != nil {
+		return nil, err
+	}
+	s := &session{cipher: cipher, created: time.Now()}
+	label := plaintext[crypto.PublicKeySize:]
+	if r.sessionFile != nil {
+		if s.ticket, label, err = crypto.SplitTicket(label); err != nil {
+			return nil, err
+		}
+	}
+	s.domain = r.instanceDomain(label)
+	return s, nil
+}
+
+// instanceDomain returns the subdomain for an instance label from a
+// handshake reply, or nil if there is none or it leaves no room for
+// payload.
+func (r *Resolver) instanceDomain(label []byte) dns.Name {
+	if len(label) == 0 {
+		return nil
+	}
+	name, err := dns.NewName(append([][]byte{label}, r.domain...))
+	if err != nil || dns.QueryFragmentSize(name) <= 0 {
+		return nil
+	}
+	return name
+}
+
+// unpinSession sends the queries of the session using cipher to the
+// server's domain instead of its instance's subdomain, e.g. when the
+// subdomain isn't delegated. It reports whether the session was pinned.
+func (r *Resolver) unpinSession(cipher *crypto.Cipher) bool {
+	s := r.session.Load()
+	if s == nil || s.cipher != cipher || s.domain == nil {
+		return false
+	}
+	unpinned := *s
+	unpinned.domain = nil
+	if !r.session.CompareAndSwap(s, &unpinned) {
+		return false
+	}
+	r.sessionFile.save(r.domain, &unpinned)
+	return true
+}
+
+// sessionTicket returns the resumption ticket of the session using cipher,
+// or false if the session was replaced.
+func (r *Resolver) sessionTicket(cipher *crypto.Cipher) ([]byte, bool) {
+	s := r.session.Load()
+	if s == nil || s.cipher != cipher {
+		return nil, false
+	}
+	return s.ticket, true
+}
+
+// sessionResumed marks the session using cipher as held by the server
+// again, once it answered a message resuming it.
+func (r *Resolver) sessionResumed(cipher *crypto.Cipher) {
+	s := r.session.Load()
+	if s == nil || s.cipher != cipher || !s.resume {
+		return
+	}
+	resumed := *s
+	resumed.resume = false
+	r.session.CompareAndSwap(s, &resumed)
+}
+
+// dropSession discards the session using cipher, so that the next query
+// performs a new handshake, e.g. after the server forgot the session.
+func (r *Resolver) dropSession(cipher *crypto.Cipher) {
+	if s := r.session.Load(); s != nil && s.cipher == cipher && r.session.CompareAndSwap(s, nil) {
+		r.sessionFile.clear(r.domain)
+	}
+}
+
+// savedSession is a session as kept in the session file.
+type savedSession struct {
+	Created time.Time `json:"created"`
+	Keys    []byte    `json:"keys"`
+	Ticket  []byte    `json:"ticket"`
+	Domain  string    `json:"domain,omitempty"`
+}
+
+// sessionFile keeps the client's sessions and their resumption tickets,
+// so that a restarted client resumes its session instead of performing a
+// new handshake. The file holds session keys, so it is created with mode
+// 0600.
+type sessionFile struct {
+	store storage.Store
+}
+
+// openSessionFile opens the sessions kept in path.
+func openSessionFile(path string) (*sessionFile, error) {
+	store, err := storage.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionFile{store: store}, nil
+}
+
+// load returns the saved session with the server of domain, marked to be
+// resumed, or nil if there is none younger than SessionLifetime.
+func (f *sessionFile) load(domain dns.Name) *session {
+	if f == nil {
+		return nil
+	}
+	value, err := f.store.Get(sessionBucket, domain.String())
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to read session file: %v", err)
+		}
+		return nil
+	}
+	var saved savedSession
+	if err := json.Unmarshal(value, &saved); err != nil || len(saved.Ticket) == 0 || time.Since(saved.Created) >= SessionLifetime {
+		return nil
+	}
+	cipher, err := crypto.NewCipherFromKeys(saved.Keys)
+	if err != nil {
+		return nil
+	}
+	s := &session{cipher: cipher, created: saved.Created, ticket: saved.Ticket, resume: true}
+	if saved.Domain != "" {
+		s.domain, _ = dns.ParseName(saved.Domain)
+	}
+	return s
+}
+
+// save stores the session with the server of domain. Sessions without a
+// ticket can't be resumed and aren't saved.
+func (f *sessionFile) save(domain dns.Name, s *session) {
+	if f == nil || len(s.ticket) == 0 {
+		return
+	}
+	saved := savedSession{Created: s.created, Keys: s.cipher.Keys(), Ticket: s.ticket}
+	if s.domain != nil {
+		saved.Domain = s.domain.String()
+	}
+	value, err := json.Marshal(saved)
+	if err != nil {
+		return
+	}
+	defer crypto.ZeroBytes(saved.Keys)
+	if err := f.store.Put(sessionBucket, domain.String(), value); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+}
+
+// clear removes the saved session with the server of domain.
+func (f *sessionFile) clear(domain dns.Name) {
+	if f == nil {
+		return
+	}
+	if err := f.store.Delete(sessionBucket, domain.String()); err != nil {
+		log.Printf("Failed to delete saved session: %v", err)
+	}
+}
+
+// Close closes the session file.
+func (f *sessionFile) Close() error {
+	if f == nil {
+		return nil
+	}
+	return f.store.Close()
+}
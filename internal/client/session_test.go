@@ -0,0 +1,69 @@
+package client
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestSessionFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session")
+	f, err := openSessionFile(path)
+	if err != nil {
+		t.Fatalf("openSessionFile() error = %v", err)
+	}
+	domain, _ := dns.ParseName("t.example.com")
+	instance, _ := dns.ParseName("ns1-a.t.example.com")
+	cipher, _ := crypto.NewCipher(make([]byte, crypto.KeySize), true)
+
+	// Sessions without a ticket can't be resumed
+	f.save(domain, &session{cipher: cipher, created: time.Now()})
+	if s := f.load(domain); s != nil {
+		t.Error("Loaded a session saved without a ticket")
+	}
+
+	s := &session{cipher: cipher, created: time.Now().Add(-time.Minute), domain: instance, ticket: []byte("ticket")}
+	f.save(domain, s)
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// A restarted client loads the session to resume it
+	f, err = openSessionFile(path)
+	if err != nil {
+		t.Fatalf("openSessionFile() reopen error = %v", err)
+	}
+	defer f.Close()
+	loaded := f.load(domain)
+	if loaded == nil {
+		t.Fatal("Saved session not loaded")
+	}
+	if !loaded.resume || !bytes.Equal(loaded.ticket, s.ticket) || !loaded.created.Equal(s.created) ||
+		!bytes.Equal(loaded.cipher.Keys(), cipher.Keys()) || loaded.domain.String() != instance.String() {
+		t.Errorf("load() = %+v, want the saved session to resume", loaded)
+	}
+	if loaded.flags() != dns.FragmentFlagResume {
+		t.Errorf("flags() = %#x, want %#x", loaded.flags(), dns.FragmentFlagResume)
+	}
+	other, _ := dns.ParseName("u.example.com")
+	if f.load(other) != nil {
+		t.Error("Loaded the session of another server")
+	}
+
+	// Sessions past their lifetime are renewed with a handshake instead
+	s.created = time.Now().Add(-SessionLifetime)
+	f.save(domain, s)
+	if f.load(domain) != nil {
+		t.Error("Loaded an expired session")
+	}
+
+	f.save(domain, &session{cipher: cipher, created: time.Now(), ticket: []byte("ticket")})
+	f.clear(domain)
+	if f.load(domain) != nil {
+		t.Error("Loaded a cleared session")
+	}
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Lookup is a DNS lookup to replay with Simulate.
+type Lookup struct {
+	Name dns.Name
+	Type uint16
+}
+
+// ReadLookups reads the lookups to replay: a HAR capture (JSON, as saved by
+// browser developer tools), whose request hosts are looked up once each in
+// order of first request, or a text list, one lookup per line, a name and
+// optionally a type:
+//
+//	# name              type
+//	www.example.com
+//	example.com         AAAA
+//
+// Text after '#' is a comment. Lookups without a type use defaultType.
+func ReadLookups(r io.Reader, defaultType uint16) ([]Lookup, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lookups: %w", err)
+	}
+	if first == '{' {
+		return readHAR(br, defaultType)
+	}
+
+	var lookups []Lookup
+	scanner := bufio.NewScanner(br)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: want a name and optionally a type", lineNum)
+		}
+
+		name, err := dns.ParseName(fields[0])
+		if err != nil || len(name) == 0 {
+			return nil, fmt.Errorf("line %d: invalid name %q", lineNum, fields[0])
+		}
+		lookup := Lookup{Name: name, Type: defaultType}
+		if len(fields) == 2 {
+			if lookup.Type, err = dns.ParseType(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+		}
+		lookups = append(lookups, lookup)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read lookups: %w", err)
+	}
+	return lookups, nil
+}
+
+// peekNonSpace returns the first byte of br that isn't white space, without
+// consuming it, or 0 if there is none.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0], nil
+		}
+		_, _ = br.Discard(1)
+	}
+}
+
+// readHAR returns a lookup of defaultType for each host requested in a
+// HAR capture, in order of first request. Hosts given as addresses are
+// skipped.
+func readHAR(r io.Reader, defaultType uint16) ([]Lookup, error) {
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					URL string `json:"url"`
+				} `json:"request"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("failed to parse HAR: %w", err)
+	}
+
+	var lookups []Lookup
+	seen := make(map[string]bool)
+	for _, entry := range har.Log.Entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if host == "" || seen[host] || net.ParseIP(host) != nil {
+			continue
+		}
+		seen[host] = true
+
+		name, err := dns.ParseName(host)
+		if err != nil {
+			continue
+		}
+		lookups = append(lookups, Lookup{Name: name, Type: defaultType})
+	}
+	return lookups, nil
+}
+
+// SimulationReport is the result of Simulate.
+type SimulationReport struct {
+	// Lookups is the number of lookups replayed
+	Lookups int
+
+	// Answered is the number of lookups the tunnel returned a response
+	// to, whatever its rcode
+	Answered int
+
+	// Failed is the number of lookups that got no response
+	Failed int
+
+	// Duration is how long the replay took
+	Duration time.Duration
+
+	// Rcodes counts the responses by rcode mnemonic
+	Rcodes map[string]int
+
+	// Failures counts the failed lookups by cause
+	Failures map[string]int
+
+	// P50, P95 and P99 are percentiles of the latency of answered lookups
+	P50, P95, P99 time.Duration
+}
+
+// Throughput returns the lookups answered per second.
+func (s *SimulationReport) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Answered) / s.Duration.Seconds()
+}
+
+// failureCauses are the errors failed lookups are counted by, checked in
+// order.
+var failureCauses = []error{
+	ErrServerMaintenance,
+	ErrTruncated,
+	ErrUnexpectedFragment,
+	ErrNoResponseData,
+	ErrNoResolverAnswered,
+	ErrTransport,
+}
+
+// failureCause returns the cause a failed lookup is counted by: "timeout"
+// if it ran out of time, one of failureCauses, or the innermost error.
+func failureCause(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return "timeout"
+	}
+	for _, cause := range failureCauses {
+		if errors.Is(err, cause) {
+			return cause.Error()
+		}
+	}
+	for errors.Unwrap(err) != nil {
+		err = errors.Unwrap(err)
+	}
+	return err.Error()
+}
+
+// Exchange resolves a query through the tunnel, validating the response
+// if DNSSEC validation is on. Unlike queries received on the listeners, it
+// bypasses the cache and split DNS. The resolver needn't be started.
+func (r *Resolver) Exchange(ctx context.Context, query *dns.Message) (*dns.Message, error) {
+	if v := r.validator.Load(); v != nil {
+		return r.resolveValidated(ctx, v, query)
+	}
+	response, _, err := r.processTunneledQuery(ctx, query)
+	return response, err
+}
+
+// Simulate replays lookups through the tunnel, concurrency at a time, and
+// reports throughput, rcodes, latencies and the causes of failures, to
+// see how the tunnel copes with the load of real browsing. Each lookup is
+// bounded by the resolver's timeout; lookups not started when ctx is done
+// are left out of the report.
+func (r *Resolver) Simulate(ctx context.Context, lookups []Lookup, concurrency int) *SimulationReport {
+	return simulate(ctx, lookups, concurrency, func(ctx context.Context, query *dns.Message) (*dns.Message, error) {
+		ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+		return r.Exchange(ctx, query)
+	})
+}
+
+// simulate implements Simulate with the given exchange function.
+func simulate(ctx context.Context, lookups []Lookup, concurrency int, exchange func(context.Context, *dns.Message) (*dns.Message, error)) *SimulationReport {
+	report := &SimulationReport{
+		Rcodes:   make(map[string]int),
+		Failures: make(map[string]int),
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		latencies []time.Duration
+	)
+	sem := make(chan struct{}, max(concurrency, 1))
+	start := time.Now()
+	for i, lookup := range lookups {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			sent := time.Now()
+			response, err := exchange(ctx, dns.CreateQuery(lookup.Name, lookup.Type, uint16(i)))
+			latency := time.Since(sent)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Lookups++
+			if err != nil {
+				report.Failed++
+				report.Failures[failureCause(err)]++
+				return
+			}
+			report.Answered++
+			report.Rcodes[dns.RcodeString(response.Rcode())]++
+			latencies = append(latencies, latency)
+		}()
+	}
+	wg.Wait()
+	report.Duration = time.Since(start)
+
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		percentile := func(p float64) time.Duration {
+			return latencies[min(int(p*float64(len(latencies))), len(latencies)-1)]
+		}
+		report.P50, report.P95, report.P99 = percentile(0.50), percentile(0.95), percentile(0.99)
+	}
+	return report
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestReadLookups(t *testing.T) {
+	list := `# name              type
+www.example.com
+example.com         aaaa   # IPv6
+`
+	lookups, err := ReadLookups(strings.NewReader(list), dns.RRTypeA)
+	if err != nil {
+		t.Fatalf("ReadLookups() error = %v", err)
+	}
+	if len(lookups) != 2 || lookups[0].Name.String() != "www.example.com" || lookups[0].Type != dns.RRTypeA ||
+		lookups[1].Name.String() != "example.com" || lookups[1].Type != dns.RRTypeAAAA {
+		t.Errorf("ReadLookups() = %v", lookups)
+	}
+
+	for _, list := range []string{"www.example.com A extra", "bad..name", "example.com BOGUS"} {
+		if _, err := ReadLookups(strings.NewReader(list), dns.RRTypeA); err == nil {
+			t.Errorf("ReadLookups(%q) accepted an invalid list", list)
+		}
+	}
+}
+
+func TestReadLookupsHAR(t *testing.T) {
+	har := ` {"log": {"entries": [
+		{"request": {"url": "https://www.example.com/"}},
+		{"request": {"url": "https://cdn.example.net:8443/app.js"}},
+		{"request": {"url": "https://WWW.example.com/style.css"}},
+		{"request": {"url": "http://192.0.2.1/pixel.gif"}}
+	]}}`
+	lookups, err := ReadLookups(strings.NewReader(har), dns.RRTypeHTTPS)
+	if err != nil {
+		t.Fatalf("ReadLookups() error = %v", err)
+	}
+	if len(lookups) != 2 || lookups[0].Name.String() != "www.example.com" ||
+		lookups[1].Name.String() != "cdn.example.net" || lookups[1].Type != dns.RRTypeHTTPS {
+		t.Errorf("ReadLookups() of a HAR = %v", lookups)
+	}
+
+	if _, err := ReadLookups(strings.NewReader(`{"log": `), dns.RRTypeA); err == nil {
+		t.Error("ReadLookups() accepted a truncated HAR")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	var lookups []Lookup
+	for i := range 20 {
+		lookups = append(lookups, Lookup{Name: mustParseName(t, fmt.Sprintf("host%d.example", i)), Type: dns.RRTypeA})
+	}
+
+	var inFlight, peak atomic.Int32
+	exchange := func(ctx context.Context, query *dns.Message) (*dns.Message, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		switch query.ID % 4 {
+		case 1:
+			return nil, fmt.Errorf("%w (trace 1)", ErrTruncated)
+		case 2:
+			return nil, fmt.Errorf("send: %w", context.DeadlineExceeded)
+		case 3:
+			resp := dns.CreateResponse(query)
+			resp.SetRcode(dns.RcodeNameError)
+			return resp, nil
+		}
+		return dns.CreateResponse(query), nil
+	}
+
+	report := simulate(context.Background(), lookups, 4, exchange)
+	if report.Lookups != 20 || report.Answered != 10 || report.Failed != 10 {
+		t.Errorf("simulate() = %d lookups, %d answered, %d failed, want 20, 10, 10", report.Lookups, report.Answered, report.Failed)
+	}
+	if report.Rcodes["NOERROR"] != 5 || report.Rcodes["NXDOMAIN"] != 5 {
+		t.Errorf("Rcodes = %v", report.Rcodes)
+	}
+	if report.Failures[ErrTruncated.Error()] != 5 || report.Failures["timeout"] != 5 {
+		t.Errorf("Failures = %v", report.Failures)
+	}
+	if p := peak.Load(); p > 4 {
+		t.Errorf("%d lookups in flight, want at most 4", p)
+	}
+	if report.P50 < 5*time.Millisecond || report.P99 < report.P50 || report.Throughput() <= 0 {
+		t.Errorf("Latencies %v %v %v, throughput %v", report.P50, report.P95, report.P99, report.Throughput())
+	}
+
+	// A done context stops the replay
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := simulate(ctx, lookups, 4, exchange); report.Lookups != 0 {
+		t.Errorf("simulate() after cancel replayed %d lookups", report.Lookups)
+	}
+}
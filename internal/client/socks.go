@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+// SOCKS5 protocol values (RFC 1928)
+const (
+	socksVersion     = 5
+	socksNoAuth      = 0x00
+	socksNoMethods   = 0xff
+	socksConnect     = 0x01
+	socksAddrIPv4    = 0x01
+	socksAddrDomain  = 0x03
+	socksAddrIPv6    = 0x04
+	socksSucceeded   = 0x00
+	socksFailure     = 0x01
+	socksRefused     = 0x05
+	socksCmdNotSupp  = 0x07
+	socksAddrNotSupp = 0x08
+)
+
+// Stream limits
+const (
+	// socksHandshakeTimeout bounds the SOCKS5 negotiation with a local
+	// application
+	socksHandshakeTimeout = 10 * time.Second
+
+	// streamMaxFailures is the number of consecutive failed exchanges
+	// after which a stream is given up
+	streamMaxFailures = 8
+
+	// streamRetryDelay is the delay before retrying a failed exchange; it
+	// doubles with each consecutive failure
+	streamRetryDelay = 100 * time.Millisecond
+)
+
+var (
+	ErrSocksVersion = errors.New("unsupported SOCKS version")
+	ErrSocksCommand = errors.New("unsupported SOCKS command")
+	ErrSocksAddress = errors.New("unsupported SOCKS address type")
+	ErrStreamReset  = errors.New("stream reset by server")
+)
+
+// socksLoop accepts local SOCKS5 connections until the listener closes.
+func (r *Resolver) socksLoop() {
+	defer r.wg.Done()
+	defer r.wakePoller()
+
+	for {
+		conn, err := r.socks.Accept()
+		if err != nil {
+			if r.ctx.Err() != nil || r.draining.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.handleSocks(conn)
+		}()
+	}
+}
+
+// handleSocks serves a SOCKS5 connection: it negotiates the destination,
+// opens a stream to it through the tunnel and relays data until both
+// sides are done.
+func (r *Resolver) handleSocks(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	addr, err := readSocksRequest(conn)
+	if err != nil {
+		log.Printf("SOCKS request from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	s := &clientStream{r: r, id: atomic.AddUint32(&r.streamID, 1), wake: make(chan struct{}, 1)}
+	reply, err := s.open(addr)
+	if err != nil {
+		log.Printf("Failed to open stream to %s: %v", addr, err)
+		r.status.recordError(fmt.Errorf("failed to open stream to %s: %w", addr, err))
+		code := byte(socksFailure)
+		if errors.Is(err, ErrStreamReset) {
+			code = socksRefused
+		}
+		_ = writeSocksReply(conn, code)
+		return
+	}
+	if err := writeSocksReply(conn, socksSucceeded); err != nil {
+		s.abort()
+		return
+	}
+
+	s.endpoint = stream.NewEndpoint(conn, stream.DefaultBufferSize, nil)
+	defer s.endpoint.Close()
+	r.addStream(s)
+	defer r.removeStream(s)
+	if err := s.relay(reply); err != nil {
+		log.Printf("Stream to %s failed: %v", addr, err)
+		r.status.recordError(fmt.Errorf("stream to %s failed: %w", addr, err))
+	}
+}
+
+// readSocksRequest negotiates a SOCKS5 session without authentication and
+// returns the destination of its CONNECT request.
+func readSocksRequest(conn net.Conn) (string, error) {
+	// Greeting: version, number of methods, methods
+	buf := make([]byte, 256+2)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVersion {
+		return "", ErrSocksVersion
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoMethods)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoMethods {
+		return "", errors.New("client requires authentication")
+	}
+
+	// Request: version, command, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVersion {
+		return "", ErrSocksVersion
+	}
+	if buf[1] != socksConnect {
+		_ = writeSocksReply(conn, socksCmdNotSupp)
+		return "", fmt.Errorf("%w: %d", ErrSocksCommand, buf[1])
+	}
+
+	var host string
+	switch buf[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, 4)
+		if buf[3] == socksAddrIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		name := buf[1 : 1+int(buf[0])]
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = writeSocksReply(conn, socksAddrNotSupp)
+		return "", fmt.Errorf("%w: %d", ErrSocksAddress, buf[3])
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// writeSocksReply answers a SOCKS5 request. The bound address isn't
+// meaningful for a tunneled connection and is sent as zero.
+func writeSocksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// clientStream relays a local connection over a tunnel stream. One frame
+// is in flight at a time. Data from the server arrives through the
+// resolver's polls, or without them in replies the server holds until it
+// has data.
+type clientStream struct {
+	r        *Resolver
+	id       uint32
+	endpoint *stream.Endpoint
+	wake     chan struct{} // signalled when polled data arrived
+	resync   atomic.Bool   // a poll reply was lost
+}
+
+// open asks the server to connect the stream to addr and returns its
+// reply.
+func (s *clientStream) open(addr string) (*stream.Frame, error) {
+	reply, err := s.exchange(&stream.Frame{Op: stream.OpOpen, Stream: s.id, Data: []byte(addr)})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Op == stream.OpReset {
+		return nil, fmt.Errorf("%w: %s", ErrStreamReset, reply.Data)
+	}
+	return reply, nil
+}
+
+// exchange sends a frame and returns the server's reply, retrying failed
+// exchanges with backoff.
+func (s *clientStream) exchange(f *stream.Frame) (*stream.Frame, error) {
+	delay := streamRetryDelay
+	var err error
+	for failures := 0; failures < streamMaxFailures; failures++ {
+		if failures > 0 {
+			select {
+			case <-time.After(delay):
+			case <-s.r.ctx.Done():
+				return nil, s.r.ctx.Err()
+			}
+			delay *= 2
+		}
+
+		var data []byte
+		data, err = s.r.tunnelExchange(s.r.ctx, f.Marshal(), dns.FragmentFlagStream)
+		if err != nil {
+			continue
+		}
+		var reply *stream.Frame
+		reply, err = stream.ParseFrame(data)
+		if err != nil {
+			continue
+		}
+		if reply.Stream != f.Stream {
+			err = ErrUnexpectedFragment
+			continue
+		}
+		return reply, nil
+	}
+	return nil, err
+}
+
+// relay applies the server's reply to the open request, then exchanges
+// frames until both sides finished sending and closes the stream.
+func (s *clientStream) relay(reply *stream.Frame) error {
+	for {
+		if err := s.endpoint.Receive(reply); err != nil {
+			s.abort()
+			return err
+		}
+
+		// Polled data may finish the stream while waiting
+		for ready := false; !ready; {
+			if s.endpoint.Done() {
+				_, _ = s.r.tunnelExchange(s.r.ctx, (&stream.Frame{Op: stream.OpClose, Stream: s.id}).Marshal(), dns.FragmentFlagStream)
+				return nil
+			}
+			var err error
+			if ready, err = s.wait(); err != nil {
+				return err
+			}
+		}
+
+		f := s.endpoint.Outgoing(stream.OpData, s.id, stream.MaxUpstreamData)
+		if s.r.polling.Load() {
+			f.Flags |= stream.FlagNoWait
+		}
+		var err error
+		reply, err = s.exchange(f)
+		if err != nil {
+			s.abort()
+			return err
+		}
+		if reply.Op == stream.OpReset {
+			return fmt.Errorf("%w: %s", ErrStreamReset, reply.Data)
+		}
+	}
+}
+
+// wait waits until the stream should exchange a frame and reports whether
+// it should. With polling that is when there is data or an acknowledgement
+// to send, or a keepalive is due; without, whenever data may still arrive,
+// since the server holds the reply until it has some.
+func (s *clientStream) wait() (bool, error) {
+	if !s.r.polling.Load() {
+		// Nothing to send and nothing more to receive: wait for local data
+		for s.endpoint.Idle() {
+			select {
+			case <-s.endpoint.Ready():
+			case <-s.r.ctx.Done():
+				return false, s.r.ctx.Err()
+			}
+		}
+		return true, nil
+	}
+	if s.endpoint.Pending() || s.resync.Swap(false) {
+		return true, nil
+	}
+
+	timer := time.NewTimer(streamKeepalive)
+	defer timer.Stop()
+	select {
+	case <-s.endpoint.Ready():
+	case <-s.wake:
+	case <-timer.C:
+		return true, nil
+	case <-s.r.ctx.Done():
+		return false, s.r.ctx.Err()
+	}
+	return s.endpoint.Pending() || s.resync.Swap(false) || !s.r.polling.Load(), nil
+}
+
+// wakeup signals the stream that polled data arrived.
+func (s *clientStream) wakeup() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// abort resets the stream on the server, best effort.
+func (s *clientStream) abort() {
+	ctx, cancel := context.WithTimeout(s.r.ctx, s.r.config.Timeout)
+	defer cancel()
+	_, _ = s.r.tunnelExchange(ctx, (&stream.Frame{Op: stream.OpReset, Stream: s.id}).Marshal(), dns.FragmentFlagStream)
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// DirectRule sends queries for names under Domain straight to resolvers
+// instead of through the tunnel.
+type DirectRule struct {
+	Domain dns.Name
+
+	// Resolvers answer the domain's names; if empty, DirectResolvers do
+	Resolvers []string
+}
+
+// ReadDirectRules reads a split DNS rules file, one rule per line: a
+// domain, optionally written *.domain, and optionally the resolvers to
+// send its names to, joined with +:
+//
+//	# domain        resolvers
+//	local
+//	*.corp.example  10.0.0.53:53+10.0.0.54:53
+//
+// A rule covers the domain and its subdomains; the most specific rule for
+// a name applies. Text after '#' is a comment.
+func ReadDirectRules(path string) ([]DirectRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open split DNS rules: %w", err)
+	}
+	defer f.Close()
+
+	var rules []DirectRule
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want a domain and optionally resolvers", path, lineNum)
+		}
+
+		domain, err := dns.ParseName(strings.TrimPrefix(fields[0], "*."))
+		if err != nil || len(domain) == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid domain %q", path, lineNum, fields[0])
+		}
+		rule := DirectRule{Domain: domain}
+		if len(fields) == 2 {
+			rule.Resolvers = strings.Split(fields[1], "+")
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read split DNS rules: %w", err)
+	}
+	return rules, nil
+}
+
+// PrivatePTRDomains returns the reverse DNS domains of the RFC 1918
+// private networks: 10.in-addr.arpa, 16.172.in-addr.arpa through
+// 31.172.in-addr.arpa and 168.192.in-addr.arpa. Public resolvers can't
+// answer PTR queries for them, and shouldn't see them.
+func PrivatePTRDomains() []dns.Name {
+	arpa := []string{"10.in-addr.arpa", "168.192.in-addr.arpa"}
+	for i := 16; i <= 31; i++ {
+		arpa = append(arpa, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	domains := make([]dns.Name, len(arpa))
+	for i, s := range arpa {
+		domains[i], _ = dns.ParseName(s)
+	}
+	return domains
+}
+
+// splitDNS holds the direct rules in effect and their transports.
+type splitDNS struct {
+	routes    []directRoute // most specific domain first
+	transport *Transport    // DirectResolvers', nil for the client's resolvers
+	own       []*Transport  // transports of rules with their own resolvers
+}
+
+// directRoute is a domain resolved directly, with the transport of its
+// rule's own resolvers or nil.
+type directRoute struct {
+	domain    dns.Name
+	transport *Transport
+}
+
+// newSplitDNS creates the split DNS of config: its DirectDomains and
+// DirectRules, and the private reverse domains if DirectPrivatePTR is set.
+func newSplitDNS(config *Config) *splitDNS {
+	s := &splitDNS{}
+	if len(config.DirectResolvers) > 0 {
+		s.transport = NewTransport(config.DirectResolvers, config.Timeout)
+	}
+
+	for _, domain := range config.DirectDomains {
+		s.routes = append(s.routes, directRoute{domain: domain})
+	}
+	if config.DirectPrivatePTR {
+		for _, domain := range PrivatePTRDomains() {
+			s.routes = append(s.routes, directRoute{domain: domain})
+		}
+	}
+	for _, rule := range config.DirectRules {
+		route := directRoute{domain: rule.Domain}
+		if len(rule.Resolvers) > 0 {
+			route.transport = NewTransport(rule.Resolvers, config.Timeout)
+			s.own = append(s.own, route.transport)
+		}
+		s.routes = append(s.routes, route)
+	}
+
+	// Rules with their own resolvers win over equally specific others
+	slices.SortStableFunc(s.routes, func(a, b directRoute) int {
+		if len(a.domain) != len(b.domain) {
+			return len(b.domain) - len(a.domain)
+		}
+		if (a.transport != nil) != (b.transport != nil) {
+			if a.transport != nil {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+	return s
+}
+
+// route returns whether name is resolved directly and if so, the
+// transport to resolve it with, nil for the client's resolvers.
+func (s *splitDNS) route(name dns.Name) (*Transport, bool) {
+	for _, route := range s.routes {
+		if _, ok := name.TrimSuffix(route.domain); !ok {
+			continue
+		}
+		if route.transport != nil {
+			return route.transport, true
+		}
+		return s.transport, true
+	}
+	return nil, false
+}
+
+// close closes the transports of the split DNS.
+func (s *splitDNS) close() {
+	if s.transport != nil {
+		s.transport.Close()
+	}
+	for _, t := range s.own {
+		t.Close()
+	}
+}
+
+// splitChanged reports whether the split DNS configuration differs.
+func splitChanged(a, b *Config) bool {
+	return !slices.EqualFunc(a.DirectDomains, b.DirectDomains, dns.Name.Equal) ||
+		!slices.EqualFunc(a.DirectRules, b.DirectRules, func(x, y DirectRule) bool {
+			return x.Domain.Equal(y.Domain) && slices.Equal(x.Resolvers, y.Resolvers)
+		}) ||
+		!slices.Equal(a.DirectResolvers, b.DirectResolvers) ||
+		a.DirectPrivatePTR != b.DirectPrivatePTR || a.Timeout != b.Timeout
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestReadDirectRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	data := `# domain        resolvers
+local
+*.corp.example  10.0.0.53:53+10.0.0.54:53   # office resolvers
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := ReadDirectRules(path)
+	if err != nil {
+		t.Fatalf("ReadDirectRules() error = %v", err)
+	}
+	if len(rules) != 2 || rules[0].Domain.String() != "local" || rules[0].Resolvers != nil ||
+		rules[1].Domain.String() != "corp.example" || !slices.Equal(rules[1].Resolvers, []string{"10.0.0.53:53", "10.0.0.54:53"}) {
+		t.Errorf("ReadDirectRules() = %v", rules)
+	}
+
+	for _, line := range []string{".", "corp.example 10.0.0.53:53 extra", "bad..domain"} {
+		if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadDirectRules(path); err == nil {
+			t.Errorf("ReadDirectRules(%q) succeeded", line)
+		}
+	}
+}
+
+func TestPrivatePTRDomains(t *testing.T) {
+	s := newSplitDNS(&Config{DirectPrivatePTR: true, Timeout: time.Second})
+	defer s.close()
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"1.0.0.10.in-addr.arpa", true},
+		{"1.1.16.172.in-addr.arpa", true},
+		{"1.1.31.172.in-addr.arpa", true},
+		{"1.1.32.172.in-addr.arpa", false},
+		{"1.1.168.192.in-addr.arpa", true},
+		{"1.1.169.192.in-addr.arpa", false},
+		{"8.8.8.8.in-addr.arpa", false},
+	}
+	for _, tt := range tests {
+		if _, got := s.route(mustParseName(t, tt.name)); got != tt.want {
+			t.Errorf("route(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitDNSRoute(t *testing.T) {
+	config := &Config{
+		Timeout:         time.Second,
+		DirectDomains:   []dns.Name{mustParseName(t, "corp.example")},
+		DirectResolvers: []string{"192.168.1.1:53"},
+		DirectRules: []DirectRule{
+			{Domain: mustParseName(t, "lab.corp.example"), Resolvers: []string{"10.0.1.53:53"}},
+			{Domain: mustParseName(t, "corp.example"), Resolvers: []string{"10.0.0.53:53"}},
+			{Domain: mustParseName(t, "local")},
+		},
+	}
+	s := newSplitDNS(config)
+	defer s.close()
+
+	tests := []struct {
+		name   string
+		direct bool
+		want   string // first resolver of the transport
+	}{
+		{"host.lab.corp.example", true, "10.0.1.53:53"},
+		{"www.CORP.example", true, "10.0.0.53:53"}, // the rule's own resolvers win
+		{"printer.local", true, "192.168.1.1:53"},
+		{"example.com", false, ""},
+	}
+	for _, tt := range tests {
+		transport, direct := s.route(mustParseName(t, tt.name))
+		if direct != tt.direct {
+			t.Errorf("route(%s) direct = %v, want %v", tt.name, direct, tt.direct)
+			continue
+		}
+		if direct && transport.resolvers[0] != tt.want {
+			t.Errorf("route(%s) = %v, want %s", tt.name, transport.resolvers, tt.want)
+		}
+	}
+
+	// Without DirectResolvers, direct domains use the client's resolvers
+	config.DirectResolvers = nil
+	s = newSplitDNS(config)
+	defer s.close()
+	if transport, direct := s.route(mustParseName(t, "printer.local")); !direct || transport != nil {
+		t.Errorf("route() without direct resolvers = %v, %v, want the client's", transport, direct)
+	}
+
+	if !splitChanged(config, &Config{Timeout: time.Second}) || splitChanged(config, config) {
+		t.Error("splitChanged() is wrong")
+	}
+}
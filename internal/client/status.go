@@ -0,0 +1,176 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentErrorCount is the number of recent errors kept for the status
+const recentErrorCount = 20
+
+// tunnelDownFailures is the number of consecutive failed tunnel exchanges
+// after which the tunnel is considered down
+const tunnelDownFailures = 5
+
+// ErrorRecord is an error that occurred in the running client.
+type ErrorRecord struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// ResolverStatus describes how a resolver has been answering.
+type ResolverStatus struct {
+	Address     string        `json:"address"`
+	Queries     uint64        `json:"queries"`
+	Failures    uint64        `json:"failures"`
+	Latency     time.Duration `json:"latency"`
+	Quarantined bool          `json:"quarantined"`
+}
+
+// Status describes the state of a running client.
+type Status struct {
+	ServerDomain   string           `json:"server_domain"`
+	Started        time.Time        `json:"started"`
+	Session        bool             `json:"session"` // a handshake session is established
+	TunnelQueries  uint64           `json:"tunnel_queries"`
+	TunnelFailures uint64           `json:"tunnel_failures"`
+	LastSuccess    time.Time        `json:"last_success"`
+	LastFailure    time.Time        `json:"last_failure"`
+	Streams        int              `json:"streams"`
+	PowerSaving    bool             `json:"power_saving"`
+	QueryCodec     string           `json:"query_codec"`              // codec of tunnel query names
+	Carrier        string           `json:"carrier"`                  // record type of tunnel responses
+	Compression    bool             `json:"compression"`              // DNS messages are compressed both ways
+	KeyRejected    string           `json:"key_rejected,omitempty"`   // why the server refuses the key
+	DirectFallback bool             `json:"direct_fallback"`          // queries are resolved directly, the tunnel being down
+	DirectQueries  uint64           `json:"direct_queries,omitempty"` // resolved in cleartext while the tunnel is down
+	Resolvers      []ResolverStatus `json:"resolvers"`
+	Cache          *CacheStats      `json:"cache,omitempty"` // nil with caching disabled
+	RecentErrors   []ErrorRecord    `json:"recent_errors"`
+}
+
+// Healthy reports whether the last tunnel exchange succeeded, or none
+// failed yet, and the server accepts the key.
+func (s *Status) Healthy() bool {
+	return s.KeyRejected == "" && (s.LastFailure.IsZero() || s.LastSuccess.After(s.LastFailure))
+}
+
+// statusTracker records the outcome of tunnel exchanges and recent errors.
+type statusTracker struct {
+	started     time.Time
+	queries     uint64
+	failures    uint64
+	consecutive int // failures since the last success
+	keyRejected string
+	lastSuccess time.Time
+	lastFailure time.Time
+	errors      []ErrorRecord // oldest first
+	mu          sync.Mutex
+}
+
+// record records the outcome of a tunnel exchange. It reports whether the
+// exchange failed as the tunnelDownFailures-th in a row, taking the tunnel
+// down.
+func (t *statusTracker) record(err error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.queries++
+	if err == nil {
+		t.lastSuccess = time.Now()
+		t.consecutive = 0
+		return false
+	}
+	t.failures++
+	t.consecutive++
+	t.lastFailure = time.Now()
+	t.addError(err)
+	return t.consecutive == tunnelDownFailures
+}
+
+// setKeyRejected records why the server refuses the key, "" once it
+// accepts it again, and reports whether that changed.
+func (t *statusTracker) setKeyRejected(reason string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if reason == t.keyRejected {
+		return false
+	}
+	t.keyRejected = reason
+	if reason != "" {
+		t.addError(fmt.Errorf("server refused the key: %s", reason))
+	}
+	return true
+}
+
+// recordError records an error that isn't a tunnel exchange failure.
+func (t *statusTracker) recordError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addError(err)
+}
+
+// addError keeps err among the recent errors. The caller holds t.mu.
+func (t *statusTracker) addError(err error) {
+	if len(t.errors) == recentErrorCount {
+		copy(t.errors, t.errors[1:])
+		t.errors = t.errors[:recentErrorCount-1]
+	}
+	t.errors = append(t.errors, ErrorRecord{Time: time.Now(), Message: err.Error()})
+}
+
+// Status returns the state of the client: tunnel health, resolver
+// latencies, cache use and recent errors.
+func (r *Resolver) Status() Status {
+	r.status.mu.Lock()
+	status := Status{
+		ServerDomain:   r.domain.String(),
+		Started:        r.status.started,
+		TunnelQueries:  r.status.queries,
+		TunnelFailures: r.status.failures,
+		LastSuccess:    r.status.lastSuccess,
+		LastFailure:    r.status.lastFailure,
+		KeyRejected:    r.status.keyRejected,
+		PowerSaving:    r.powerSaving.Load(),
+		QueryCodec:     r.encoding().codec.String(),
+		Carrier:        r.encoding().carrier.String(),
+		Compression:    r.compress.Load() && r.compressed.Load(),
+		RecentErrors:   append([]ErrorRecord(nil), r.status.errors...),
+	}
+	r.status.mu.Unlock()
+
+	if r.fallback.active.Load() {
+		status.DirectQueries = r.fallback.queries.Load()
+		status.DirectFallback = true
+	}
+
+	if s := r.session.Load(); s != nil && time.Since(s.created) < SessionLifetime {
+		status.Session = true
+	}
+
+	r.streamsMu.Lock()
+	status.Streams = len(r.streams)
+	r.streamsMu.Unlock()
+
+	for addr, stats := range r.transport.Load().GetStats() {
+		status.Resolvers = append(status.Resolvers, ResolverStatus{
+			Address:     addr,
+			Queries:     stats.Queries,
+			Failures:    stats.Failures,
+			Latency:     stats.Latency,
+			Quarantined: stats.Quarantined,
+		})
+	}
+	sort.Slice(status.Resolvers, func(i, j int) bool {
+		return status.Resolvers[i].Address < status.Resolvers[j].Address
+	})
+
+	if cache := r.cache.Load(); cache != nil {
+		stats := cache.Stats()
+		status.Cache = &stats
+	}
+	return status
+}
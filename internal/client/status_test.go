@@ -0,0 +1,24 @@
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatusTrackerTunnelDown(t *testing.T) {
+	var s statusTracker
+	failure := errors.New("no reply")
+
+	// Only the failure reaching tunnelDownFailures in a row takes the
+	// tunnel down, and a success resets the count
+	for round := 0; round < 2; round++ {
+		for i := 1; i <= tunnelDownFailures+1; i++ {
+			if got, want := s.record(failure), i == tunnelDownFailures; got != want {
+				t.Errorf("round %d, failure %d: record() = %v, want %v", round, i, got, want)
+			}
+		}
+		if s.record(nil) {
+			t.Errorf("round %d: record(nil) = true", round)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+)
+
+// Strategy is how a query is spread over the resolvers. Sending to fewer
+// resolvers puts fewer duplicate queries in front of the authoritative
+// server; sending to more answers faster when resolvers are slow or fail.
+type Strategy int
+
+const (
+	// StrategyParallel sends each query to every healthy resolver
+	StrategyParallel Strategy = iota
+
+	// StrategyRace sends each query to the two best resolvers
+	StrategyRace
+
+	// StrategySequential tries the resolvers one at a time, best first
+	StrategySequential
+
+	// StrategyWeighted tries the resolvers one at a time in a random
+	// order favouring the healthiest
+	StrategyWeighted
+
+	// StrategyHedged sends each query to the best resolver, and to the
+	// second best only if the first hasn't answered within its usual
+	// latency
+	StrategyHedged
+)
+
+// raceResolvers is the number of resolvers StrategyRace queries.
+const raceResolvers = 2
+
+// Hedging constants
+const (
+	// hedgePercentile is the latency percentile of the best resolver after
+	// which the query is hedged
+	hedgePercentile = 0.95
+
+	// minHedgeSamples is the number of latency samples needed before the
+	// percentile is trusted; until then the query is hedged after
+	// timeout/hedgeTimeoutDivisor
+	minHedgeSamples     = 10
+	hedgeTimeoutDivisor = 4
+)
+
+// ParseStrategy parses a resolver strategy name (parallel, race,
+// sequential, weighted, hedged).
+func ParseStrategy(s string) (Strategy, error) {
+	switch strings.ToLower(s) {
+	case "parallel":
+		return StrategyParallel, nil
+	case "race":
+		return StrategyRace, nil
+	case "sequential":
+		return StrategySequential, nil
+	case "weighted":
+		return StrategyWeighted, nil
+	case "hedged":
+		return StrategyHedged, nil
+	}
+	return StrategyParallel, fmt.Errorf("invalid resolver strategy %q", s)
+}
+
+// String returns the name of the strategy.
+func (s Strategy) String() string {
+	switch s {
+	case StrategyParallel:
+		return "parallel"
+	case StrategyRace:
+		return "race"
+	case StrategySequential:
+		return "sequential"
+	case StrategyWeighted:
+		return "weighted"
+	case StrategyHedged:
+		return "hedged"
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// SetStrategy sets how queries are spread over the resolvers.
+func (t *Transport) SetStrategy(s Strategy) {
+	t.strategy.Store(int32(s))
+}
+
+// SetSendJitter sets the maximum random delay of parallel sends to
+// resolvers after the first (0 sends them all at once).
+func (t *Transport) SetSendJitter(jitter time.Duration) {
+	t.sendJitter.Store(int64(jitter))
+}
+
+// SetRandom sets the source of the send jitter and of the weighted
+// strategy's resolver order, clock.Random if nil. It must be called before
+// the transport is used.
+func (t *Transport) SetRandom(r io.Reader) {
+	t.random = clock.RandomOr(r)
+}
+
+// sendOffsets returns how long to wait before sending a query to each of
+// n resolvers queried in parallel, or nil to send to all at once. The
+// first, best resolver gets the query at once, so the jitter adds no
+// latency while it answers; the others at random offsets up to the send
+// jitter, so the logs of different resolvers don't show copies of a query
+// arriving at the same instant. Sends still waiting when an answer
+// arrives are dropped.
+func (t *Transport) sendOffsets(n int) []time.Duration {
+	jitter := time.Duration(t.sendJitter.Load())
+	if jitter <= 0 || n < 2 {
+		return nil
+	}
+	offsets := make([]time.Duration, n)
+	for i := 1; i < n; i++ {
+		offsets[i] = clock.Duration(t.random, jitter)
+	}
+	return offsets
+}
+
+// querySequential tries the resolvers in order until one answers. Each
+// attempt gets half of the time left, and the last one all of it, so a
+// slow first resolver still leaves time to fail over.
+func (t *Transport) querySequential(ctx context.Context, resolvers []string, query []byte) ([]byte, error) {
+	deadline := time.Now().Add(t.timeout)
+	var lastErr error
+	for i, resolver := range resolvers {
+		timeout := time.Until(deadline)
+		if i < len(resolvers)-1 {
+			timeout /= 2
+		}
+		data, err := t.queryParallel(ctx, timeout, []string{resolver}, query)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || time.Until(deadline) <= 0 {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// weightedOrder returns the resolvers in a random order, each next one
+// picked with a probability inversely proportional to its score, so the
+// healthiest resolver usually comes first. Resolvers without latency
+// samples weigh as much as one answering in a millisecond.
+func (t *Transport) weightedOrder(resolvers []string) []string {
+	t.statsMu.RLock()
+	weights := make([]float64, len(resolvers))
+	for i, r := range resolvers {
+		weights[i] = 1 / max(t.health[r].score(), float64(time.Millisecond))
+	}
+	t.statsMu.RUnlock()
+
+	remaining := append([]string(nil), resolvers...)
+	order := make([]string, 0, len(resolvers))
+	for len(remaining) > 0 {
+		var total float64
+		for _, w := range weights {
+			total += w
+		}
+		pick, x := len(remaining)-1, clock.Float64(t.random)*total
+		for i, w := range weights {
+			if x < w {
+				pick = i
+				break
+			}
+			x -= w
+		}
+		order = append(order, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+		weights = append(weights[:pick], weights[pick+1:]...)
+	}
+	return order
+}
+
+// hedgeDelay returns how long to wait for resolver before hedging: its
+// recent p95 latency, at most half the timeout so the second resolver
+// still has time to answer.
+func (t *Transport) hedgeDelay(resolver string) time.Duration {
+	t.statsMu.RLock()
+	delay := t.health[resolver].percentile(hedgePercentile, minHedgeSamples)
+	t.statsMu.RUnlock()
+
+	if delay == 0 {
+		delay = t.timeout / hedgeTimeoutDivisor
+	}
+	return min(delay, t.timeout/2)
+}
+
+// queryHedged sends the query to the first resolver, and to the second as
+// well if the first fails or hasn't answered after its hedge delay. The
+// first valid response wins. Most queries thus reach a single resolver,
+// while a slow one no longer sets the tail latency.
+func (t *Transport) queryHedged(ctx context.Context, resolvers []string, query []byte) ([]byte, error) {
+	if len(resolvers) < 2 {
+		return t.queryParallel(ctx, t.timeout, resolvers, query)
+	}
+	first, second := resolvers[0], resolvers[1]
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 2)
+	send := func(resolver string) {
+		go func() {
+			start := time.Now()
+			data, err := t.queryResolver(ctx, resolver, query)
+			if err == nil || parent.Err() == nil {
+				t.updateStats(resolver, err == nil, time.Since(start))
+			}
+			results <- result{data: data, err: err}
+		}()
+	}
+
+	send(first)
+	hedge := time.NewTimer(t.hedgeDelay(first))
+	defer hedge.Stop()
+
+	pending, hedged := 1, false
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.data, nil
+			}
+			lastErr = r.err
+			if hedged {
+				continue
+			}
+		case <-hedge.C:
+			if hedged {
+				continue
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		hedged = true
+		pending++
+		send(second)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestParseStrategy(t *testing.T) {
+	for _, s := range []Strategy{StrategyParallel, StrategyRace, StrategySequential, StrategyWeighted, StrategyHedged} {
+		got, err := ParseStrategy(s.String())
+		if err != nil || got != s {
+			t.Errorf("ParseStrategy(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseStrategy("random"); err == nil {
+		t.Error("ParseStrategy() accepted an unknown strategy")
+	}
+}
+
+// countingResolver starts a UDP resolver that counts the queries it gets
+// and answers them if answer is set.
+func countingResolver(t *testing.T, answer bool) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var count atomic.Int32
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			count.Add(1)
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil || !answer {
+				continue
+			}
+			data, _ := dns.CreateResponse(query).Marshal()
+			_, _ = conn.WriteToUDP(data, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &count
+}
+
+func TestTransportStrategies(t *testing.T) {
+	query, err := dns.CreateQuery(dns.Name{[]byte("example"), []byte("com")}, dns.RRTypeA, 1).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		strategy Strategy
+		answers  []bool
+		want     []int32 // queries each resolver gets
+	}{
+		{StrategyParallel, []bool{true, true, true}, []int32{1, 1, 1}},
+		{StrategyRace, []bool{true, true, true}, []int32{1, 1, 0}},
+		{StrategySequential, []bool{true, true, true}, []int32{1, 0, 0}},
+		{StrategySequential, []bool{false, true, true}, []int32{1, 1, 0}},
+		{StrategyWeighted, []bool{true, true, true}, nil},
+		{StrategyHedged, []bool{true, true, true}, []int32{1, 0, 0}},
+		{StrategyHedged, []bool{false, true, true}, []int32{1, 1, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy.String(), func(t *testing.T) {
+			var resolvers []string
+			var counts []*atomic.Int32
+			for _, answer := range tt.answers {
+				addr, count := countingResolver(t, answer)
+				resolvers = append(resolvers, addr)
+				counts = append(counts, count)
+			}
+			transport := NewTransport(resolvers, 400*time.Millisecond)
+			defer transport.Close()
+			transport.SetStrategy(tt.strategy)
+
+			if _, err := transport.Query(context.Background(), query); err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+
+			// Let queries to slower resolvers arrive
+			time.Sleep(50 * time.Millisecond)
+			var total int32
+			for i, count := range counts {
+				total += count.Load()
+				if tt.want != nil && count.Load() != tt.want[i] {
+					t.Errorf("Resolver %d got %d queries, want %d", i, count.Load(), tt.want[i])
+				}
+			}
+			if tt.want == nil && total != 1 {
+				t.Errorf("Resolvers got %d queries, want 1", total)
+			}
+		})
+	}
+}
+
+func TestTransportSendJitter(t *testing.T) {
+	query, err := dns.CreateQuery(dns.Name{[]byte("example"), []byte("com")}, dns.RRTypeA, 1).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := NewTransport([]string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}, time.Second)
+	defer transport.Close()
+	if offsets := transport.sendOffsets(3); offsets != nil {
+		t.Errorf("sendOffsets() without jitter = %v, want nil", offsets)
+	}
+	transport.SetSendJitter(100 * time.Millisecond)
+	offsets := transport.sendOffsets(3)
+	if len(offsets) != 3 || offsets[0] != 0 {
+		t.Fatalf("sendOffsets() = %v, want the first resolver at once", offsets)
+	}
+	for _, offset := range offsets[1:] {
+		if offset < 0 || offset >= 100*time.Millisecond {
+			t.Errorf("sendOffsets() = %v, want offsets below the jitter", offsets)
+		}
+	}
+
+	// A seeded source gives the same offsets every run
+	transport.SetRandom(clock.NewSeeded(1))
+	offsets = transport.sendOffsets(3)
+	transport.SetRandom(clock.NewSeeded(1))
+	if again := transport.sendOffsets(3); !slices.Equal(again, offsets) {
+		t.Errorf("sendOffsets() with the same seed = %v, then %v", offsets, again)
+	}
+
+	// Sends still waiting when the best resolver answers are dropped
+	first, firstCount := countingResolver(t, true)
+	second, secondCount := countingResolver(t, true)
+	transport = NewTransport([]string{first, second}, time.Second)
+	defer transport.Close()
+	transport.SetSendJitter(time.Hour)
+	if _, err := transport.Query(context.Background(), query); err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if firstCount.Load() != 1 || secondCount.Load() != 0 {
+		t.Errorf("Resolvers got %d and %d queries, want 1 and 0", firstCount.Load(), secondCount.Load())
+	}
+
+	// The others are still asked when the best resolver doesn't answer
+	silent, _ := countingResolver(t, false)
+	transport = NewTransport([]string{silent, second}, time.Second)
+	defer transport.Close()
+	transport.SetSendJitter(50 * time.Millisecond)
+	if _, err := transport.Query(context.Background(), query); err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+}
@@ -1,24 +1,90 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
 )
 
-// Transport handles UDP DNS communication with parallel resolver support.
+// Resolver schemes
+const (
+	// SchemeDoH prefixes DNS over HTTPS resolver URLs
+	SchemeDoH = "https://"
+
+	// dohGetTemplate marks a DoH URL that should use GET (RFC 8484 URI template)
+	dohGetTemplate = "{?dns}"
+
+	// dohContentType is the DoH media type
+	dohContentType = "application/dns-message"
+
+	// SchemeDoT prefixes DNS over TLS resolver addresses
+	SchemeDoT = "tls://"
+
+	// dotPort is the default DNS over TLS port
+	dotPort = "853"
+
+	// dotPoolSize is the maximum number of connections per DoT resolver
+	dotPoolSize = 4
+)
+
+// Transport handles DNS communication with parallel resolver support.
+// Resolvers are plain UDP addresses (8.8.8.8:53), DoH URLs
+// (https://dns.google/dns-query) or DoT addresses (1.1.1.1:853,
+// tls://dns.quad9.net).
 type Transport struct {
 	resolvers []string
 	timeout   time.Duration
 	stats     map[string]*ResolverStats
+	health    map[string]*resolverHealth
 	statsMu   sync.RWMutex
+	strategy  atomic.Int32 // Strategy
+
+	// Maximum random delay of sends to resolvers after the first
+	sendJitter atomic.Int64 // time.Duration
+
+	// Randomness of send jitter and weighted resolver order
+	random io.Reader
+
+	// Health checks are less frequent while saving power
+	powerSaving atomic.Bool
+
+	// For DoH, shared so connections are reused across queries
+	httpClient *http.Client
+
+	// For DoT, one pool of pipelined connections per resolver
+	tlsConfig *tls.Config
+	dotPools  map[string]*dotPool
+	dotMu     sync.Mutex
+
+	// EDNS cookies per resolver, as real resolvers keep them
+	cookies  map[string]*resolverCookie
+	cookieMu sync.Mutex
+
+	// Background health checks
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// resolverCookie is the EDNS cookie state for one resolver: a random
+// client cookie and the server cookie last received.
+type resolverCookie struct {
+	client [dns.EDNSClientCookieSize]byte
+	server []byte
 }
 
 // ResolverStats tracks resolver performance.
@@ -27,32 +93,80 @@ type ResolverStats struct {
 	Successes    uint64
 	Failures     uint64
 	TotalLatency time.Duration
+
+	// Latency is the recent average latency, including health probes
+	Latency time.Duration
+
+	// Quarantined is set while the resolver is avoided after repeated
+	// failures
+	Quarantined bool
 }
 
 // NewTransport creates a new transport with the given resolvers.
 func NewTransport(resolvers []string, timeout time.Duration) *Transport {
+	ctx, cancel := context.WithCancel(context.Background())
 	t := &Transport{
 		resolvers: resolvers,
 		timeout:   timeout,
 		stats:     make(map[string]*ResolverStats),
+		health:    make(map[string]*resolverHealth),
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        10,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+		tlsConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		dotPools:  make(map[string]*dotPool),
+		cookies:   make(map[string]*resolverCookie),
+		random:    clock.Random,
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 
-	// Initialize stats for each resolver
+	// Initialize stats, health and cookies for each resolver
 	for _, r := range resolvers {
 		t.stats[r] = &ResolverStats{}
+		t.health[r] = newResolverHealth()
+
+		c := &resolverCookie{}
+		_, _ = rand.Read(c.client[:])
+		t.cookies[r] = c
 	}
 
 	return t
 }
 
-// Query sends a DNS query to all resolvers in parallel and returns the first valid response.
+// Query sends a DNS query to the healthiest resolvers following the
+// transport's strategy and returns the first valid response.
 func (t *Transport) Query(ctx context.Context, query []byte) ([]byte, error) {
 	if len(t.resolvers) == 0 {
 		return nil, errors.New("no resolvers configured")
 	}
+	resolvers := t.candidates()
+
+	switch Strategy(t.strategy.Load()) {
+	case StrategyRace:
+		return t.queryParallel(ctx, t.timeout, resolvers[:min(len(resolvers), raceResolvers)], query)
+	case StrategySequential:
+		return t.querySequential(ctx, resolvers, query)
+	case StrategyWeighted:
+		return t.querySequential(ctx, t.weightedOrder(resolvers), query)
+	case StrategyHedged:
+		return t.queryHedged(ctx, resolvers, query)
+	}
+	return t.queryParallel(ctx, t.timeout, resolvers, query)
+}
 
+// queryParallel sends a DNS query to the resolvers in parallel and returns
+// the first valid response within the timeout.
+func (t *Transport) queryParallel(ctx context.Context, timeout time.Duration, resolvers []string, query []byte) ([]byte, error) {
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	// Channel for results
@@ -63,15 +177,26 @@ func (t *Transport) Query(ctx context.Context, query []byte) ([]byte, error) {
 		err      error
 	}
 
-	results := make(chan result, len(t.resolvers))
+	results := make(chan result, len(resolvers))
 	var wg sync.WaitGroup
 
-	// Send to all resolvers in parallel
-	for _, resolver := range t.resolvers {
+	// Send to the resolvers in parallel
+	offsets := t.sendOffsets(len(resolvers))
+	for i, resolver := range resolvers {
 		wg.Add(1)
 		go func(resolver string) {
 			defer wg.Done()
 
+			if offsets != nil && offsets[i] > 0 {
+				timer := time.NewTimer(offsets[i])
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+
 			start := time.Now()
 			data, err := t.queryResolver(ctx, resolver, query)
 			latency := time.Since(start)
@@ -92,8 +217,10 @@ func (t *Transport) Query(ctx context.Context, query []byte) ([]byte, error) {
 	// Wait for first valid response
 	var lastErr error
 	for r := range results {
-		// Update stats
-		t.updateStats(r.resolver, r.err == nil, r.latency)
+		// Update stats, unless the caller gave up on the query
+		if r.err == nil || parent.Err() == nil {
+			t.updateStats(r.resolver, r.err == nil, r.latency)
+		}
 
 		if r.err != nil {
 			lastErr = r.err
@@ -112,8 +239,111 @@ func (t *Transport) Query(ctx context.Context, query []byte) ([]byte, error) {
 	return nil, errors.New("all resolvers failed")
 }
 
-// queryResolver sends a query to a single resolver.
+// streamKey marks contexts of queries that must not use UDP.
+type streamKey struct{}
+
+// withStreamTransport returns a context whose queries go to plain
+// resolvers over TCP instead of UDP, so they carry answers of any size.
+// DoT and DoH resolvers are queried as always.
+func withStreamTransport(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamKey{}, true)
+}
+
+// observerKey marks contexts of queries whose outcome is reported.
+type observerKey struct{}
+
+// withObserver returns a context whose queries report the response or
+// error of each resolver they were sent to to observe.
+func withObserver(ctx context.Context, observe func(resolver string, resp []byte, err error)) context.Context {
+	return context.WithValue(ctx, observerKey{}, observe)
+}
+
+// queryResolver sends a query to a single resolver using its transport.
 func (t *Transport) queryResolver(ctx context.Context, resolver string, query []byte) ([]byte, error) {
+	doh := strings.HasPrefix(resolver, SchemeDoH)
+	dot := !doh && isDoTResolver(resolver)
+	query = t.prepareQuery(resolver, query, !doh, doh || dot)
+
+	var resp []byte
+	var err error
+	switch {
+	case doh:
+		resp, err = t.queryDoH(ctx, resolver, query)
+	case dot:
+		resp, err = t.queryDoT(ctx, resolver, query)
+	case ctx.Value(streamKey{}) != nil:
+		resp, err = t.queryTCP(ctx, resolver, query)
+	default:
+		resp, err = t.queryUDP(ctx, resolver, query)
+	}
+	if err == nil && !doh {
+		t.learnCookie(resolver, resp)
+	}
+	if observe, ok := ctx.Value(observerKey{}).(func(string, []byte, error)); ok {
+		observe(resolver, resp, err)
+	}
+	return resp, err
+}
+
+// prepareQuery sets the EDNS options a real stub would send to resolver:
+// its cookie, and padding on encrypted transports (RFC 8467). Queries
+// without EDNS are sent unchanged.
+func (t *Transport) prepareQuery(resolver string, query []byte, cookie, pad bool) []byte {
+	msg, err := dns.ParseMessage(query)
+	if err != nil {
+		return query
+	}
+	if opt, err := msg.OPT(); err != nil || opt == nil {
+		return query
+	}
+
+	if cookie {
+		if option, ok := t.cookieOption(resolver); ok {
+			_ = msg.SetEDNSOption(option)
+		}
+	}
+	if pad {
+		_ = msg.Pad(dns.QueryPaddingBlock)
+	}
+
+	data, err := msg.Marshal()
+	if err != nil {
+		return query
+	}
+	return data
+}
+
+// cookieOption returns the COOKIE option to send to resolver.
+func (t *Transport) cookieOption(resolver string) (dns.EDNSOption, bool) {
+	t.cookieMu.Lock()
+	defer t.cookieMu.Unlock()
+	c := t.cookies[resolver]
+	if c == nil {
+		return dns.EDNSOption{}, false
+	}
+	return dns.NewCookieOption(c.client, c.server), true
+}
+
+// learnCookie remembers the server cookie in a resolver's response.
+func (t *Transport) learnCookie(resolver string, resp []byte) {
+	msg, err := dns.ParseMessage(resp)
+	if err != nil {
+		return
+	}
+
+	t.cookieMu.Lock()
+	defer t.cookieMu.Unlock()
+	c := t.cookies[resolver]
+	if c == nil {
+		return
+	}
+	if server, ok := dns.MatchCookie(msg, c.client); ok {
+		c.server = bytes.Clone(server)
+	}
+}
+
+// queryUDP sends a query to a plain UDP resolver.
+func (t *Transport) queryUDP(ctx context.Context, resolver string, query []byte) ([]byte, error) {
 	// Resolve address
 	addr, err := net.ResolveUDPAddr("udp", resolver)
 	if err != nil {
@@ -133,6 +363,10 @@ func (t *Transport) queryResolver(ctx context.Context, resolver string, query []
 		_ = conn.SetDeadline(deadline)
 	}
 
+	// Abort the exchange when ctx is canceled, e.g. on shutdown
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
 	// Send query
 	_, err = conn.Write(query)
 	if err != nil {
@@ -149,6 +383,156 @@ func (t *Transport) queryResolver(ctx context.Context, resolver string, query []
 	return buf[:n], nil
 }
 
+// queryTCP sends a query to a plain resolver over TCP, on a connection of
+// its own.
+func (t *Transport) queryTCP(ctx context.Context, resolver string, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", resolver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	return t.exchangeStream(ctx, conn, query)
+}
+
+// queryDoH sends a query to a DNS over HTTPS resolver. URLs ending in the
+// RFC 8484 "{?dns}" template use GET; all others use POST.
+func (t *Transport) queryDoH(ctx context.Context, resolver string, query []byte) ([]byte, error) {
+	method := http.MethodPost
+	url := resolver
+	var body io.Reader = bytes.NewReader(query)
+
+	if strings.HasSuffix(resolver, dohGetTemplate) {
+		method = http.MethodGet
+		url = strings.TrimSuffix(resolver, dohGetTemplate) + "?dns=" + base64.RawURLEncoding.EncodeToString(query)
+		body = nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", dohContentType)
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH returned status: %d", resp.StatusCode)
+	}
+
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxEDNSSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return respData, nil
+}
+
+// isDoTResolver returns true for tls:// resolvers and addresses on port 853.
+func isDoTResolver(resolver string) bool {
+	return strings.HasPrefix(resolver, SchemeDoT) || strings.HasSuffix(resolver, ":"+dotPort)
+}
+
+// queryDoT sends a query to a DNS over TLS resolver, pipelined with any
+// other queries on a pooled connection. A pooled connection that fails
+// (e.g. closed by the resolver while idle) is retried once on a fresh
+// connection.
+func (t *Transport) queryDoT(ctx context.Context, resolver string, query []byte) ([]byte, error) {
+	pool, err := t.getDoTPool(resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	if conn := pool.get(); conn != nil {
+		respData, err := conn.exchange(ctx, query, t.timeout)
+		if err == nil || ctx.Err() != nil {
+			return respData, err
+		}
+	}
+
+	conn, err := pool.dial(ctx, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return conn.exchange(ctx, query, t.timeout)
+}
+
+// exchangeStream sends a length-prefixed query on a TCP or TLS connection
+// and reads the length-prefixed response.
+func (t *Transport) exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	// Set deadline from context
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(t.timeout))
+	}
+
+	// Abort the exchange when ctx is canceled, e.g. on shutdown
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// Send length-prefixed query (TCP DNS format)
+	lenBuf := []byte{byte(len(query) >> 8), byte(len(query))}
+	if _, err := conn.Write(append(lenBuf, query...)); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	// Read length-prefixed response
+	respLenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, respLenBuf); err != nil {
+		return nil, fmt.Errorf("failed to read response length: %w", err)
+	}
+
+	respLen := int(respLenBuf[0])<<8 | int(respLenBuf[1])
+	respData := make([]byte, respLen)
+	if _, err := io.ReadFull(conn, respData); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// A canceled ctx may have set the deadline; don't pool the connection
+	if !stop() {
+		return nil, ctx.Err()
+	}
+
+	return respData, nil
+}
+
+// getDoTPool returns the connection pool for a DoT resolver, creating it on
+// first use.
+func (t *Transport) getDoTPool(resolver string) (*dotPool, error) {
+	t.dotMu.Lock()
+	defer t.dotMu.Unlock()
+
+	if pool, ok := t.dotPools[resolver]; ok {
+		return pool, nil
+	}
+
+	addr := strings.TrimPrefix(resolver, SchemeDoT)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(host, dotPort)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid DoT resolver: %s", resolver)
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+	tlsConfig.ServerName = host
+
+	pool := newDoTPool(addr, tlsConfig, dotPoolSize)
+	t.dotPools[resolver] = pool
+	return pool, nil
+}
+
 // updateStats updates resolver statistics.
 func (t *Transport) updateStats(resolver string, success bool, latency time.Duration) {
 	t.statsMu.Lock()
@@ -159,6 +543,10 @@ func (t *Transport) updateStats(resolver string, success bool, latency time.Dura
 		return
 	}
 
+	if h, ok := t.health[resolver]; ok {
+		h.record(success, latency, time.Now())
+	}
+
 	atomic.AddUint64(&stats.Queries, 1)
 	if success {
 		atomic.AddUint64(&stats.Successes, 1)
@@ -175,20 +563,44 @@ func (t *Transport) GetStats() map[string]*ResolverStats {
 
 	// Create a copy
 	result := make(map[string]*ResolverStats)
+	now := time.Now()
 	for k, v := range t.stats {
 		result[k] = &ResolverStats{
 			Queries:      atomic.LoadUint64(&v.Queries),
 			Successes:    atomic.LoadUint64(&v.Successes),
 			Failures:     atomic.LoadUint64(&v.Failures),
 			TotalLatency: v.TotalLatency,
+			Latency:      t.health[k].latency,
+			Quarantined:  t.health[k].quarantined(now),
 		}
 	}
 	return result
 }
 
-// Close closes the transport.
+// Close stops health checks and closes the transport.
 func (t *Transport) Close() {
-	// Nothing to close for now
+	t.cancel()
+	t.wg.Wait()
+	t.httpClient.CloseIdleConnections()
+
+	t.dotMu.Lock()
+	defer t.dotMu.Unlock()
+	for _, pool := range t.dotPools {
+		pool.close()
+	}
+}
+
+// FlushConnections closes the idle DoH connections and the DoT
+// connections, failing queries still waiting on them, e.g. after a network
+// change left them dead. New ones are made for the next queries.
+func (t *Transport) FlushConnections() {
+	t.httpClient.CloseIdleConnections()
+
+	t.dotMu.Lock()
+	defer t.dotMu.Unlock()
+	for _, pool := range t.dotPools {
+		pool.close()
+	}
 }
 
 // AntiFingerprint provides anti-fingerprinting utilities.
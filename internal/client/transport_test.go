@@ -1,9 +1,24 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
 )
 
 func TestNewTransport(t *testing.T) {
@@ -56,10 +71,28 @@ func TestAntiFingerprint(t *testing.T) {
 	}
 }
 
+func TestAntiFingerprintSeeded(t *testing.T) {
+	choices := func() []any {
+		config := DefaultAntiFingerConfig()
+		config.Random = clock.NewSeeded(1)
+		af := NewAntiFingerprinting(config)
+		return []any{af.GetRandomDelay(), af.VaryTTL(300), af.VaryResponseDelay(), af.RandomizeQueryType(), len(af.GetRandomPadding(3, 8))}
+	}
+	if a, b := choices(), choices(); !slices.Equal(a, b) {
+		t.Errorf("Choices with the same seed differ: %v, %v", a, b)
+	}
+
+	// TTLs too small to vary are kept
+	if ttl := NewAntiFingerprinting(DefaultAntiFingerConfig()).VaryTTL(4); ttl != 4 {
+		t.Errorf("VaryTTL(4) = %d, want 4", ttl)
+	}
+}
+
 func TestRandomizeQueryType(t *testing.T) {
+	af := NewAntiFingerprinting(DefaultAntiFingerConfig())
 	types := make(map[uint16]int)
 	for i := 0; i < 1000; i++ {
-		qtype := RandomizeQueryType()
+		qtype := af.RandomizeQueryType()
 		types[qtype]++
 	}
 
@@ -70,8 +103,9 @@ func TestRandomizeQueryType(t *testing.T) {
 }
 
 func TestObfuscateSize(t *testing.T) {
+	af := NewAntiFingerprinting(DefaultAntiFingerConfig())
 	data := []byte{1, 2, 3}
-	obfuscated := ObfuscateSize(data, 10, 20)
+	obfuscated := af.ObfuscateSize(data, 10, 20)
 
 	if len(obfuscated) < 10 || len(obfuscated) > 20 {
 		t.Errorf("Obfuscated size out of range: got %d", len(obfuscated))
@@ -86,8 +120,9 @@ func TestObfuscateSize(t *testing.T) {
 }
 
 func TestVaryTTL(t *testing.T) {
+	af := NewAntiFingerprinting(DefaultAntiFingerConfig())
 	baseTTL := uint32(300)
-	ttl := VaryTTL(baseTTL)
+	ttl := af.VaryTTL(baseTTL)
 
 	// Should be within ±20% of base
 	minTTL := baseTTL - baseTTL/5
@@ -99,7 +134,8 @@ func TestVaryTTL(t *testing.T) {
 }
 
 func TestVaryResponseDelay(t *testing.T) {
-	delay := VaryResponseDelay()
+	af := NewAntiFingerprinting(DefaultAntiFingerConfig())
+	delay := af.VaryResponseDelay()
 
 	if delay < 10*time.Millisecond || delay > 100*time.Millisecond {
 		t.Errorf("Delay out of range: got %v", delay)
@@ -141,3 +177,334 @@ func TestTransportContextCancellation(t *testing.T) {
 		t.Error("Expected error for cancelled context")
 	}
 }
+
+func TestTransportDoH(t *testing.T) {
+	query := []byte{0x12, 0x34, 0x01, 0x00}
+	answer := []byte{0x12, 0x34, 0x81, 0x80}
+
+	var gotMethod string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+
+		var body []byte
+		switch r.Method {
+		case http.MethodGet:
+			body, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			body, _ = io.ReadAll(r.Body)
+		}
+
+		if !bytes.Equal(body, query) {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(answer)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		resolver   string
+		wantMethod string
+	}{
+		{
+			name:       "POST",
+			resolver:   srv.URL + "/dns-query",
+			wantMethod: http.MethodPost,
+		},
+		{
+			name:       "GET template",
+			resolver:   srv.URL + "/dns-query{?dns}",
+			wantMethod: http.MethodGet,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewTransport([]string{tt.resolver}, 2*time.Second)
+			transport.httpClient = srv.Client()
+			defer transport.Close()
+
+			resp, err := transport.Query(context.Background(), query)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+
+			if !bytes.Equal(resp, answer) {
+				t.Errorf("Response: got %x, want %x", resp, answer)
+			}
+
+			if gotMethod != tt.wantMethod {
+				t.Errorf("Method: got %s, want %s", gotMethod, tt.wantMethod)
+			}
+
+			if stats := transport.GetStats()[tt.resolver]; stats == nil || stats.Successes != 1 {
+				t.Errorf("Stats not updated for DoH resolver: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestTransportDoHError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	transport := NewTransport([]string{srv.URL + "/dns-query"}, 2*time.Second)
+	transport.httpClient = srv.Client()
+
+	if _, err := transport.Query(context.Background(), []byte{0x12, 0x34}); err == nil {
+		t.Error("Expected error for non-200 DoH response")
+	}
+}
+
+func TestIsDoTResolver(t *testing.T) {
+	tests := []struct {
+		resolver string
+		want     bool
+	}{
+		{"1.1.1.1:853", true},
+		{"tls://dns.quad9.net", true},
+		{"tls://dns.quad9.net:8853", true},
+		{"8.8.8.8:53", false},
+		{"https://dns.google/dns-query", false},
+	}
+
+	for _, tt := range tests {
+		if got := isDoTResolver(tt.resolver); got != tt.want {
+			t.Errorf("isDoTResolver(%q) = %v, want %v", tt.resolver, got, tt.want)
+		}
+	}
+}
+
+func TestTransportDoT(t *testing.T) {
+	// Borrow the httptest certificate (valid for 127.0.0.1)
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					var length uint16
+					if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+						return
+					}
+					msg := make([]byte, length)
+					if _, err := io.ReadFull(conn, msg); err != nil {
+						return
+					}
+					// Echo the query back as the answer
+					_ = binary.Write(conn, binary.BigEndian, length)
+					_, _ = conn.Write(msg)
+				}
+			}(conn)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	resolver := SchemeDoT + ln.Addr().String()
+	transport := NewTransport([]string{resolver}, 2*time.Second)
+	transport.tlsConfig = &tls.Config{RootCAs: roots}
+	defer transport.Close()
+
+	for i := 0; i < 3; i++ {
+		query := []byte{0x12, byte(i), 0x01, 0x00}
+		resp, err := transport.Query(context.Background(), query)
+		if err != nil {
+			t.Fatalf("Query %d error = %v", i, err)
+		}
+		if !bytes.Equal(resp, query) {
+			t.Errorf("Query %d response: got %x, want %x", i, resp, query)
+		}
+	}
+
+	// Sequential queries reuse the pooled connection
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Connections: got %d, want 1", n)
+	}
+}
+
+func TestTransportDoTPipelining(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	const queries = 8
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				// Answer only once all queries are in, last first
+				var msgs [][]byte
+				for len(msgs) < queries {
+					var length uint16
+					if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+						return
+					}
+					msg := make([]byte, length)
+					if _, err := io.ReadFull(conn, msg); err != nil {
+						return
+					}
+					msgs = append(msgs, msg)
+				}
+				for _, msg := range slices.Backward(msgs) {
+					_ = binary.Write(conn, binary.BigEndian, uint16(len(msg)))
+					_, _ = conn.Write(msg)
+				}
+				_, _ = io.Copy(io.Discard, conn)
+			}(conn)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	resolver := SchemeDoT + ln.Addr().String()
+	transport := NewTransport([]string{resolver}, 2*time.Second)
+	transport.tlsConfig = &tls.Config{RootCAs: roots}
+	defer transport.Close()
+
+	// Concurrent queries, even with the same ID, share one connection and
+	// each gets its own response
+	errs := make(chan error, queries)
+	for i := 0; i < queries; i++ {
+		go func() {
+			query := []byte{0x12, 0x34, 0x01, byte(i)}
+			resp, err := transport.Query(context.Background(), query)
+			if err == nil && !bytes.Equal(resp, query) {
+				err = fmt.Errorf("response %x, want %x", resp, query)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < queries; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Query error = %v", err)
+		}
+	}
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Connections: got %d, want 1", n)
+	}
+}
+
+func TestTransportEDNSCookies(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer conn.Close()
+
+	serverCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	cookies := make(chan []byte, 2)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			cookie, _ := query.GetEDNSOption(dns.EDNSOptionCookie)
+			cookies <- bytes.Clone(cookie)
+
+			client, _, _ := dns.ParseCookieOption(cookie)
+			resp := dns.CreateResponse(query)
+			resp.SetEDNS0(1232, false, dns.NewCookieOption(client, serverCookie))
+			data, _ := resp.Marshal()
+			_, _ = conn.WriteToUDP(data, addr)
+		}
+	}()
+
+	resolver := conn.LocalAddr().String()
+	transport := NewTransport([]string{resolver}, 2*time.Second)
+	defer transport.Close()
+
+	query := dns.CreateQuery(dns.Name{[]byte("example"), []byte("com")}, dns.RRTypeA, 1)
+	query.AddEDNS0(4096)
+	data, _ := query.Marshal()
+
+	for i := 0; i < 2; i++ {
+		if _, err := transport.Query(context.Background(), data); err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+	}
+
+	// The first query carries only the client cookie, the second echoes
+	// the server cookie learned from the response
+	first, second := <-cookies, <-cookies
+	if len(first) != dns.EDNSClientCookieSize {
+		t.Errorf("First cookie: got %x", first)
+	}
+	if !bytes.Equal(second, append(bytes.Clone(first), serverCookie...)) {
+		t.Errorf("Second cookie: got %x, want %x + %x", second, first, serverCookie)
+	}
+}
+
+func TestTransportPrepareQuery(t *testing.T) {
+	transport := NewTransport([]string{"tls://dns.example", "8.8.8.8:53"}, time.Second)
+	defer transport.Close()
+
+	query := dns.CreateQuery(dns.Name{[]byte("example"), []byte("com")}, dns.RRTypeA, 1)
+	query.AddEDNS0(4096)
+	data, _ := query.Marshal()
+
+	// Encrypted transports pad to the query block size
+	padded := transport.prepareQuery("tls://dns.example", data, true, true)
+	if len(padded)%dns.QueryPaddingBlock != 0 {
+		t.Errorf("Padded length: got %d", len(padded))
+	}
+
+	// Queries without EDNS are sent unchanged
+	plain := dns.CreateQuery(dns.Name{[]byte("example"), []byte("com")}, dns.RRTypeA, 1)
+	plainData, _ := plain.Marshal()
+	if got := transport.prepareQuery("8.8.8.8:53", plainData, true, false); !bytes.Equal(got, plainData) {
+		t.Error("Query without EDNS modified")
+	}
+
+	// Each resolver gets its own client cookie
+	a, _ := dns.ParseMessage(transport.prepareQuery("tls://dns.example", data, true, false))
+	b, _ := dns.ParseMessage(transport.prepareQuery("8.8.8.8:53", data, true, false))
+	cookieA, _ := a.GetEDNSOption(dns.EDNSOptionCookie)
+	cookieB, _ := b.GetEDNSOption(dns.EDNSOptionCookie)
+	if len(cookieA) != dns.EDNSClientCookieSize || bytes.Equal(cookieA, cookieB) {
+		t.Errorf("Cookies: got %x and %x", cookieA, cookieB)
+	}
+}
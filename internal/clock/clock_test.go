@@ -0,0 +1,57 @@
+package clock
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	if !f.Now().Equal(start) {
+		t.Errorf("Now() = %v, want %v", f.Now(), start)
+	}
+	f.Advance(time.Minute)
+	if got := f.Now().Sub(start); got != time.Minute {
+		t.Errorf("Advance() moved the clock by %v, want 1m", got)
+	}
+	f.Set(start)
+	if !f.Now().Equal(start) {
+		t.Errorf("Set() = %v, want %v", f.Now(), start)
+	}
+
+	if Or(nil) != System || Or(f) != f {
+		t.Error("Or() returned the wrong clock")
+	}
+}
+
+func TestSeeded(t *testing.T) {
+	a, b := make([]byte, 32), make([]byte, 32)
+	io.ReadFull(NewSeeded(1), a)
+	io.ReadFull(NewSeeded(1), b)
+	if !bytes.Equal(a, b) {
+		t.Error("Sources with the same seed differ")
+	}
+	io.ReadFull(NewSeeded(2), b)
+	if bytes.Equal(a, b) {
+		t.Error("Sources with different seeds agree")
+	}
+
+	r := NewSeeded(3)
+	for range 1000 {
+		if n := Uint64N(r, 10); n >= 10 {
+			t.Fatalf("Uint64N(10) = %d", n)
+		}
+		if f := Float64(r); f < 0 || f >= 1 {
+			t.Fatalf("Float64() = %v", f)
+		}
+		if d := Duration(r, time.Second); d < 0 || d >= time.Second {
+			t.Fatalf("Duration(1s) = %v", d)
+		}
+	}
+	if Uint64N(r, 0) != 0 || Duration(r, 0) != 0 {
+		t.Error("Empty ranges should return 0")
+	}
+}
@@ -0,0 +1,75 @@
+package clock
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Random is the source of random bytes for jitter: crypto/rand's reader,
+// which can't be predicted by an observer timing the traffic.
+var Random io.Reader = rand.Reader
+
+// RandomOr returns r, or Random if r is nil.
+func RandomOr(r io.Reader) io.Reader {
+	if r == nil {
+		return Random
+	}
+	return r
+}
+
+// seeded is a deterministic random source safe for concurrent use.
+type seeded struct {
+	rng *mrand.ChaCha8
+	mu  sync.Mutex
+}
+
+// NewSeeded returns a deterministic random source: sources with the same
+// seed return the same bytes. It is safe for concurrent use, but only for
+// tests and simulations.
+func NewSeeded(seed uint64) io.Reader {
+	var s [32]byte
+	binary.BigEndian.PutUint64(s[:], seed)
+	return &seeded{rng: mrand.NewChaCha8(s)}
+}
+
+func (s *seeded) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Read(p)
+}
+
+// Uint64 returns a random uint64 read from r, or 0 if r fails.
+func Uint64(r io.Reader) uint64 {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// Uint64N returns a random number in [0, n) read from r, or 0 if n is 0.
+// The modulo bias is negligible for the small n jitter uses.
+func Uint64N(r io.Reader, n uint64) uint64 {
+	if n == 0 {
+		return 0
+	}
+	return Uint64(r) % n
+}
+
+// Float64 returns a random number in [0, 1) read from r.
+func Float64(r io.Reader) float64 {
+	return float64(Uint64(r)>>11) / (1 << 53)
+}
+
+// Duration returns a random duration in [0, d) read from r, or 0 if d
+// isn't positive.
+func Duration(r io.Reader, d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(Uint64N(r, uint64(d)))
+}
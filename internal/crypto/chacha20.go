@@ -2,6 +2,7 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
@@ -14,6 +15,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
@@ -28,20 +30,36 @@ const (
 	// NonceCounterSize is the counter portion of the nonce
 	NonceCounterSize = 8
 
-	// NonceRandomSize is the random portion of the nonce
+	// NonceRandomSize is the random portion of the nonce, chosen once per
+	// Cipher so it identifies the sender for replay detection, along with
+	// the high half of the counter
 	NonceRandomSize = 4
 
 	// TimestampSize is the size of timestamp in payload
 	TimestampSize = 4
 
+	// Overhead is the most bytes encryption adds to a message
+	Overhead = NonceSize + TimestampSize + chacha20poly1305.Overhead
+
 	// ReplayWindow is the time window for replay protection (5 minutes)
 	ReplayWindow = 5 * time.Minute
 
+	// ReplayCounterWindow is the number of recent nonce counters tracked
+	// per sender. Older counters are rejected as replays.
+	ReplayCounterWindow = 4096
+
+	// MaxReplaySenders bounds the number of senders tracked by a
+	// ReplayDetector
+	MaxReplaySenders = 65536
+
 	// Client to server context for key derivation
 	ContextClientToServer = "client-to-server"
 
 	// Server to client context for key derivation
 	ContextServerToClient = "server-to-client"
+
+	// Context for key derivation between server instances of a cluster
+	ContextCluster = "cluster"
 )
 
 var (
@@ -50,6 +68,7 @@ var (
 	ErrReplayDetected   = errors.New("replay attack detected")
 	ErrMessageTooOld    = errors.New("message timestamp too old")
 	ErrMessageTooNew    = errors.New("message timestamp too far in future")
+	ErrInvalidTicket    = errors.New("invalid resumption ticket")
 )
 
 // Cipher provides encryption and decryption with replay protection.
@@ -57,6 +76,8 @@ type Cipher struct {
 	encryptKey []byte
 	decryptKey []byte
 	counter    uint64
+	sender     [NonceRandomSize]byte
+	clock      clock.Clock // timestamps messages and checks their age
 }
 
 // NewCipher creates a new Cipher from a shared secret.
@@ -77,18 +98,64 @@ func NewCipher(sharedSecret []byte, isClient bool) (*Cipher, error) {
 		return nil, err
 	}
 
-	c := &Cipher{}
 	if isClient {
-		c.encryptKey = clientToServerKey
-		c.decryptKey = serverToClientKey
-	} else {
-		c.encryptKey = serverToClientKey
-		c.decryptKey = clientToServerKey
+		return newCipher(clientToServerKey, serverToClientKey)
 	}
+	return newCipher(serverToClientKey, clientToServerKey)
+}
 
+// newCipher creates a cipher with a random sender ID and starting counter,
+// so ciphers sharing a key don't reuse nonces and replay detection can
+// tell them apart.
+func newCipher(encryptKey, decryptKey []byte) (*Cipher, error) {
+	c := &Cipher{encryptKey: encryptKey, decryptKey: decryptKey, clock: clock.System}
+	var start [8]byte
+	if _, err := rand.Read(start[:]); err != nil {
+		return nil, err
+	}
+	c.counter = binary.BigEndian.Uint64(start[:]) >> 1
+	if _, err := rand.Read(c.sender[:]); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
+// SetClock sets the clock messages are timestamped and checked with,
+// clock.System if nil. It must be called before the cipher is used.
+func (c *Cipher) SetClock(clk clock.Clock) {
+	c.clock = clock.Or(clk)
+}
+
+// NewGroupCipher creates a Cipher whose encryption and decryption keys are
+// the same, derived from the shared secret, so every holder of the secret
+// can decrypt what any other encrypts. Server instances use it to talk to
+// each other.
+func NewGroupCipher(sharedSecret []byte) (*Cipher, error) {
+	if len(sharedSecret) < 16 {
+		return nil, ErrInvalidKey
+	}
+	key, err := deriveKey(sharedSecret, ContextCluster)
+	if err != nil {
+		return nil, err
+	}
+	return newCipher(key, key)
+}
+
+// Keys returns the cipher's encryption and decryption keys, for persisting
+// session keys. NewCipherFromKeys restores the cipher.
+func (c *Cipher) Keys() []byte {
+	return append(append([]byte(nil), c.encryptKey...), c.decryptKey...)
+}
+
+// NewCipherFromKeys restores a cipher from the output of Keys. The restored
+// cipher gets a new sender ID and counter.
+func NewCipherFromKeys(keys []byte) (*Cipher, error) {
+	if len(keys) != 2*KeySize {
+		return nil, ErrInvalidKey
+	}
+	return newCipher(bytes.Clone(keys[:KeySize]), bytes.Clone(keys[KeySize:]))
+}
+
 // deriveKey derives a key from the shared secret using HKDF-SHA256.
 func deriveKey(secret []byte, context string) ([]byte, error) {
 	key, err := hkdf.Key(sha256.New, secret, nil, context, KeySize)
@@ -107,16 +174,11 @@ func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	// Generate nonce: [counter (8 bytes)][random (4 bytes)]
-	nonce := make([]byte, NonceSize)
-	counter := atomic.AddUint64(&c.counter, 1)
-	binary.BigEndian.PutUint64(nonce[:NonceCounterSize], counter)
-	if _, err := rand.Read(nonce[NonceCounterSize:]); err != nil {
-		return nil, err
-	}
+	// Generate nonce: [counter (8 bytes)][sender (4 bytes)]
+	nonce := c.nextNonce()
 
 	// Build payload: [timestamp (4 bytes)][plaintext]
-	timestamp := uint32(time.Now().Unix())
+	timestamp := uint32(c.clock.Now().Unix())
 	payload := make([]byte, TimestampSize+len(plaintext))
 	binary.BigEndian.PutUint32(payload[:TimestampSize], timestamp)
 	copy(payload[TimestampSize:], plaintext)
@@ -132,6 +194,15 @@ func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
 	return result, nil
 }
 
+// nextNonce returns a new nonce from the counter and sender ID.
+func (c *Cipher) nextNonce() []byte {
+	nonce := make([]byte, NonceSize)
+	counter := atomic.AddUint64(&c.counter, 1)
+	binary.BigEndian.PutUint64(nonce[:NonceCounterSize], counter)
+	copy(nonce[NonceCounterSize:], c.sender[:])
+	return nonce
+}
+
 // Decrypt decrypts ciphertext and verifies the timestamp.
 // Input format: [nonce (12 bytes)][encrypted payload]
 func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
@@ -161,7 +232,7 @@ func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
 
 	timestamp := binary.BigEndian.Uint32(payload[:TimestampSize])
 	msgTime := time.Unix(int64(timestamp), 0)
-	now := time.Now()
+	now := c.clock.Now()
 
 	// Check if message is too old
 	if now.Sub(msgTime) > ReplayWindow {
@@ -185,12 +256,7 @@ func (c *Cipher) EncryptWithoutTimestamp(plaintext []byte) ([]byte, error) {
 	}
 
 	// Generate nonce
-	nonce := make([]byte, NonceSize)
-	counter := atomic.AddUint64(&c.counter, 1)
-	binary.BigEndian.PutUint64(nonce[:NonceCounterSize], counter)
-	if _, err := rand.Read(nonce[NonceCounterSize:]); err != nil {
-		return nil, err
-	}
+	nonce := c.nextNonce()
 
 	// Encrypt
 	ciphertext := aead.Seal(nil, nonce, plaintext, nil)
@@ -225,6 +291,16 @@ func (c *Cipher) DecryptWithoutTimestamp(data []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// ReplayKey returns the nonce of an encrypted message for replay
+// detection, or nil if data is too short to be a message. The nonce is
+// authenticated, so it can't be changed to evade detection.
+func ReplayKey(data []byte) []byte {
+	if len(data) < NonceSize+chacha20poly1305.Overhead {
+		return nil
+	}
+	return data[:NonceSize]
+}
+
 // GenerateKey generates a random encryption key.
 func GenerateKey() ([]byte, error) {
 	key := make([]byte, KeySize)
@@ -246,59 +322,132 @@ func ZeroBytes(b []byte) {
 	}
 }
 
-// ReplayDetector tracks seen nonces to detect replay attacks.
+// ReplayDetector detects replayed messages from their nonces. Each sender
+// has a sliding bitmap of the most recent ReplayCounterWindow counters, so
+// memory stays bounded at any query rate. Counters older than the window
+// are rejected; messages older than ReplayWindow are already rejected by
+// their timestamp.
+//
+// Senders are told apart by the random part of the nonce and the high half
+// of its counter, which starts at random too. The 32 random bits alone
+// collide once tens of thousands of clients share a key, and a collision
+// would reject one client's messages as replays of another's. The client
+// ID can't tell them apart instead: it isn't authenticated, so a captured
+// message could be replayed under a fresh one.
 type ReplayDetector struct {
-	seen   map[string]time.Time
-	window time.Duration
-	mu     sync.RWMutex
+	senders    map[uint64]*replayWindow
+	window     time.Duration
+	maxSenders int
+	lastSweep  time.Time
+	clock      clock.Clock
+	mu         sync.Mutex
 }
 
-// NewReplayDetector creates a new replay detector with the given window.
+// replayWindow is the sliding counter bitmap of a sender. The bit of
+// counter c is c % ReplayCounterWindow.
+type replayWindow struct {
+	highest  uint64
+	bitmap   [ReplayCounterWindow / 64]uint64
+	lastSeen time.Time
+}
+
+// NewReplayDetector creates a new replay detector. Senders idle for longer
+// than window are forgotten.
 func NewReplayDetector(window time.Duration) *ReplayDetector {
-	rd := &ReplayDetector{
-		seen:   make(map[string]time.Time),
-		window: window,
+	return &ReplayDetector{
+		senders:    make(map[uint64]*replayWindow),
+		window:     window,
+		maxSenders: MaxReplaySenders,
+		clock:      clock.System,
 	}
-	// Start cleanup goroutine
-	go rd.cleanup()
-	return rd
 }
 
-// Check returns true if the nonce has been seen before (replay attack).
-func (rd *ReplayDetector) Check(nonce []byte) bool {
-	key := string(nonce)
-
-	rd.mu.RLock()
-	_, exists := rd.seen[key]
-	rd.mu.RUnlock()
+// SetClock sets the clock idle senders are timed with, clock.System if
+// nil.
+func (rd *ReplayDetector) SetClock(clk clock.Clock) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.clock = clock.Or(clk)
+}
 
-	if exists {
+// Check returns true if the nonce has been seen before (replay attack) or
+// is too old to tell.
+func (rd *ReplayDetector) Check(nonce []byte) bool {
+	if len(nonce) < NonceSize {
 		return true
 	}
+	counter := binary.BigEndian.Uint64(nonce[:NonceCounterSize])
+	sender := counter&^0xffffffff | uint64(binary.BigEndian.Uint32(nonce[NonceCounterSize:NonceSize]))
 
 	rd.mu.Lock()
-	rd.seen[key] = time.Now()
-	rd.mu.Unlock()
+	defer rd.mu.Unlock()
+
+	now := rd.clock.Now()
+	w, ok := rd.senders[sender]
+	if !ok {
+		rd.makeRoom(now)
+		w = &replayWindow{highest: counter}
+		rd.senders[sender] = w
+	}
+	w.lastSeen = now
+
+	if counter > w.highest {
+		// Slide the window forward, clearing the skipped counters
+		if counter-w.highest >= ReplayCounterWindow {
+			w.bitmap = [ReplayCounterWindow / 64]uint64{}
+		} else {
+			for c := w.highest + 1; c <= counter; c++ {
+				w.clear(c)
+			}
+		}
+		w.highest = counter
+	} else if w.highest-counter >= ReplayCounterWindow {
+		return true
+	}
 
+	if w.isSet(counter) {
+		return true
+	}
+	w.set(counter)
 	return false
 }
 
-// cleanup periodically removes old nonces from the detector.
-func (rd *ReplayDetector) cleanup() {
-	ticker := time.NewTicker(rd.window / 2)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		cutoff := time.Now().Add(-rd.window)
+// makeRoom drops idle senders at most once per window, or when full. If
+// still full, the least recently seen sender is dropped.
+func (rd *ReplayDetector) makeRoom(now time.Time) {
+	if len(rd.senders) < rd.maxSenders && now.Sub(rd.lastSweep) < rd.window {
+		return
+	}
 
-		rd.mu.Lock()
-		for k, v := range rd.seen {
-			if v.Before(cutoff) {
-				delete(rd.seen, k)
-			}
+	var oldest uint64
+	var oldestSeen time.Time
+	for k, w := range rd.senders {
+		if now.Sub(w.lastSeen) > rd.window {
+			delete(rd.senders, k)
+		} else if oldestSeen.IsZero() || w.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = k, w.lastSeen
 		}
-		rd.mu.Unlock()
 	}
+	rd.lastSweep = now
+
+	if len(rd.senders) >= rd.maxSenders {
+		delete(rd.senders, oldest)
+	}
+}
+
+func (w *replayWindow) isSet(c uint64) bool {
+	i := c % ReplayCounterWindow
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *replayWindow) set(c uint64) {
+	i := c % ReplayCounterWindow
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(c uint64) {
+	i := c % ReplayCounterWindow
+	w.bitmap[i/64] &^= 1 << (i % 64)
 }
 
 // ParseHexKey parses a hexadecimal key string.
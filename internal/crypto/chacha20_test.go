@@ -2,8 +2,11 @@ package crypto
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
 )
 
 func TestNewCipher(t *testing.T) {
@@ -184,6 +187,32 @@ func TestReplayProtection(t *testing.T) {
 	}
 }
 
+func TestMessageAge(t *testing.T) {
+	secret := make([]byte, 32)
+	clientCipher, _ := NewCipher(secret, true)
+	serverCipher, _ := NewCipher(secret, false)
+	start := time.Unix(1700000000, 0)
+	clk := clock.NewFake(start)
+	clientCipher.SetClock(clk)
+	serverCipher.SetClock(clk)
+
+	ciphertext, _ := clientCipher.Encrypt([]byte{1, 2, 3})
+	clk.Advance(ReplayWindow)
+	if _, err := serverCipher.Decrypt(ciphertext); err != nil {
+		t.Errorf("Decrypt() at the end of the window: %v", err)
+	}
+	clk.Advance(time.Second)
+	if _, err := serverCipher.Decrypt(ciphertext); err != ErrMessageTooOld {
+		t.Errorf("Decrypt() after the window = %v, want ErrMessageTooOld", err)
+	}
+
+	// A sender whose clock runs ahead by more than a minute is rejected
+	clk.Set(start.Add(-time.Minute - time.Second))
+	if _, err := serverCipher.Decrypt(ciphertext); err != ErrMessageTooNew {
+		t.Errorf("Decrypt() of a message from the future = %v, want ErrMessageTooNew", err)
+	}
+}
+
 func TestReplayDetector(t *testing.T) {
 	detector := NewReplayDetector(5 * time.Minute)
 
@@ -206,6 +235,147 @@ func TestReplayDetector(t *testing.T) {
 	}
 }
 
+func TestReplayDetectorWindow(t *testing.T) {
+	detector := NewReplayDetector(5 * time.Minute)
+	nonce := func(counter uint64, sender uint32) []byte {
+		n := make([]byte, NonceSize)
+		binary.BigEndian.PutUint64(n, counter)
+		binary.BigEndian.PutUint32(n[NonceCounterSize:], sender)
+		return n
+	}
+
+	// Out of order counters within the window are accepted once
+	for _, c := range []uint64{100, 102, 101, 99} {
+		if detector.Check(nonce(c, 1)) {
+			t.Errorf("Counter %d detected as replay", c)
+		}
+	}
+	for _, c := range []uint64{100, 102, 101, 99} {
+		if !detector.Check(nonce(c, 1)) {
+			t.Errorf("Replayed counter %d not detected", c)
+		}
+	}
+
+	// Senders have separate windows
+	if detector.Check(nonce(100, 2)) {
+		t.Error("Counter of another sender detected as replay")
+	}
+
+	// Sliding forward forgets nothing inside the window and rejects
+	// counters that fell out of it
+	high := uint64(100 + ReplayCounterWindow)
+	if detector.Check(nonce(high, 1)) {
+		t.Error("New highest counter detected as replay")
+	}
+	if !detector.Check(nonce(high-ReplayCounterWindow+2, 1)) {
+		t.Error("Replayed counter inside the window not detected")
+	}
+	if detector.Check(nonce(high-1, 1)) {
+		t.Error("Skipped counter detected as replay")
+	}
+	if !detector.Check(nonce(100, 1)) {
+		t.Error("Counter outside the window accepted")
+	}
+
+	if !detector.Check([]byte{1, 2, 3}) {
+		t.Error("Short nonce accepted")
+	}
+}
+
+func TestReplayDetectorSenderCollision(t *testing.T) {
+	detector := NewReplayDetector(5 * time.Minute)
+	nonce := func(counter uint64, sender uint32) []byte {
+		n := make([]byte, NonceSize)
+		binary.BigEndian.PutUint64(n, counter)
+		binary.BigEndian.PutUint32(n[NonceCounterSize:], sender)
+		return n
+	}
+
+	// Two clients whose ciphers drew the same sender ID but different
+	// starting counters keep separate windows
+	a, b := uint64(0x5a5a5a5a_00001000), uint64(0x1234abcd_00000010)
+	if detector.Check(nonce(a, 7)) {
+		t.Fatal("First client's counter detected as replay")
+	}
+	if detector.Check(nonce(b, 7)) {
+		t.Error("Second client's lower counter detected as replay")
+	}
+	if detector.Check(nonce(a+1, 7)) {
+		t.Error("First client's next counter detected as replay")
+	}
+	if !detector.Check(nonce(b, 7)) || !detector.Check(nonce(a, 7)) {
+		t.Error("Replay not detected")
+	}
+
+	// A counter crossing into the next high half starts a new window, and
+	// the old one still rejects its replays
+	edge := uint64(0x1234abcd_ffffffff)
+	if detector.Check(nonce(edge, 9)) || detector.Check(nonce(edge+1, 9)) {
+		t.Error("Counter across the boundary detected as replay")
+	}
+	if !detector.Check(nonce(edge, 9)) || !detector.Check(nonce(edge+1, 9)) {
+		t.Error("Replay across the boundary not detected")
+	}
+}
+
+func TestReplayDetectorMaxSenders(t *testing.T) {
+	detector := NewReplayDetector(5 * time.Minute)
+	detector.maxSenders = 4
+
+	nonce := make([]byte, NonceSize)
+	for sender := uint32(0); sender < 10; sender++ {
+		binary.BigEndian.PutUint32(nonce[NonceCounterSize:], sender)
+		if detector.Check(nonce) {
+			t.Errorf("Sender %d detected as replay", sender)
+		}
+	}
+	if len(detector.senders) != 4 {
+		t.Errorf("Tracked senders: got %d, want 4", len(detector.senders))
+	}
+}
+
+func TestReplayDetectorIdleSenders(t *testing.T) {
+	detector := NewReplayDetector(time.Minute)
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	detector.SetClock(clk)
+
+	nonce := make([]byte, NonceSize)
+	detector.Check(nonce)
+	clk.Advance(2 * time.Minute)
+
+	// A new sender sweeps the one idle for longer than the window
+	binary.BigEndian.PutUint32(nonce[NonceCounterSize:], 1)
+	detector.Check(nonce)
+	if len(detector.senders) != 1 {
+		t.Errorf("Tracked senders: got %d, want 1", len(detector.senders))
+	}
+}
+
+func TestReplayKey(t *testing.T) {
+	key, _ := GenerateKey()
+	c, _ := NewCipher(key, true)
+
+	msg1, _ := c.Encrypt([]byte("query"))
+	msg2, _ := c.Encrypt([]byte("query"))
+	if !bytes.Equal(ReplayKey(msg1), msg1[:NonceSize]) {
+		t.Error("ReplayKey is not the nonce")
+	}
+
+	// A cipher keeps its sender ID and increments its counter
+	if !bytes.Equal(msg1[NonceCounterSize:NonceSize], msg2[NonceCounterSize:NonceSize]) {
+		t.Error("Sender ID changed between messages")
+	}
+	c1 := binary.BigEndian.Uint64(msg1[:NonceCounterSize])
+	c2 := binary.BigEndian.Uint64(msg2[:NonceCounterSize])
+	if c2 != c1+1 {
+		t.Errorf("Counters: got %d then %d", c1, c2)
+	}
+
+	if ReplayKey(msg1[:NonceSize]) != nil {
+		t.Error("Expected nil replay key for a short message")
+	}
+}
+
 func TestKeyDerivation(t *testing.T) {
 	secret := make([]byte, 32)
 
@@ -378,3 +548,43 @@ func TestTamperedCiphertext(t *testing.T) {
 		t.Error("Tampered ciphertext should fail to decrypt")
 	}
 }
+
+func TestCipherKeys(t *testing.T) {
+	client, _ := NewCipher(make([]byte, 32), true)
+	server, _ := NewCipher(make([]byte, 32), false)
+
+	restored, err := NewCipherFromKeys(server.Keys())
+	if err != nil {
+		t.Fatalf("NewCipherFromKeys() error = %v", err)
+	}
+	if restored.sender == server.sender {
+		t.Error("Restored cipher reuses the sender ID")
+	}
+	query, _ := client.Encrypt([]byte("query"))
+	if got, err := restored.Decrypt(query); err != nil || string(got) != "query" {
+		t.Errorf("Decrypt() = %q, %v", got, err)
+	}
+	response, _ := restored.EncryptWithoutTimestamp([]byte("response"))
+	if got, err := client.DecryptWithoutTimestamp(response); err != nil || string(got) != "response" {
+		t.Errorf("DecryptWithoutTimestamp() = %q, %v", got, err)
+	}
+
+	if _, err := NewCipherFromKeys(make([]byte, KeySize)); err != ErrInvalidKey {
+		t.Errorf("Short keys: got %v, want %v", err, ErrInvalidKey)
+	}
+}
+
+func TestGroupCipher(t *testing.T) {
+	a, _ := NewGroupCipher(make([]byte, 32))
+	b, _ := NewGroupCipher(make([]byte, 32))
+	tunnel, _ := NewCipher(make([]byte, 32), false)
+
+	msg, _ := a.Encrypt([]byte("state"))
+	if got, err := b.Decrypt(msg); err != nil || string(got) != "state" {
+		t.Errorf("Decrypt() by another member = %q, %v", got, err)
+	}
+	// Cluster traffic doesn't decrypt with tunnel keys
+	if _, err := tunnel.Decrypt(msg); err == nil {
+		t.Error("Tunnel cipher decrypted cluster traffic")
+	}
+}
@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInsecureKeyFile = errors.New("insecure key file permissions")
+	ErrInvalidKeyID    = errors.New("invalid key ID")
+)
+
+// ReadKeyFile reads a hex-encoded key from a file. Unless allowInsecure is
+// set, the file must not be accessible by group or others and must be owned
+// by the current user or root.
+func ReadKeyFile(path string, allowInsecure bool) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	defer f.Close()
+
+	// Check the file opened, so it can't be swapped after the check
+	if !allowInsecure {
+		if err := checkKeyFilePerms(f); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in file: %w", err)
+	}
+	return key, nil
+}
+
+// WriteKeyFile writes a hex-encoded key to a new file readable only by the
+// owner. It refuses to overwrite an existing file.
+func WriteKeyFile(path string, key []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+// ReadClientKeysFile reads per-client keys from a file with one
+// "<key ID> <hex key>" pair per line, optionally followed by the key's
+// policy options (see ParseKeyPolicy). Key IDs are 1-65535; ID 0 is
+// reserved for the shared key. An ID may be listed more than once during
+// rotation, newest key first. Text after # is a comment.
+// The file permissions are checked as for ReadKeyFile.
+func ReadClientKeysFile(path string, allowInsecure bool) (map[uint16][]ClientKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client keys file: %w", err)
+	}
+	defer f.Close()
+
+	if !allowInsecure {
+		if err := checkKeyFilePerms(f); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make(map[uint16][]ClientKey)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected key ID and key", path, lineNum)
+		}
+
+		id, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("%s:%d: %w %q", path, lineNum, ErrInvalidKeyID, fields[0])
+		}
+
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, ErrInvalidKey)
+		}
+
+		policy, err := ParseKeyPolicy(fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+
+		keys[uint16(id)] = append(keys[uint16(id)], ClientKey{Secret: key, Policy: policy})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read client keys file: %w", err)
+	}
+
+	return keys, nil
+}
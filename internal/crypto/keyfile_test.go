@@ -0,0 +1,130 @@
+//go:build !windows
+// +build !windows
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReadKeyFile(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := WriteKeyFile(path, key); err != nil {
+		t.Fatalf("WriteKeyFile() error = %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Permissions: got %04o, want 0600", perm)
+	}
+
+	got, err := ReadKeyFile(path, false)
+	if err != nil {
+		t.Fatalf("ReadKeyFile() error = %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("Key mismatch after round trip")
+	}
+
+	// Existing key files are not overwritten
+	if err := WriteKeyFile(path, key); err == nil {
+		t.Error("Expected error overwriting an existing key file")
+	}
+}
+
+func TestReadKeyFilePermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(FormatHexKey(make([]byte, KeySize))), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	// WriteFile is subject to umask
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("Chmod() error = %v", err)
+	}
+
+	if _, err := ReadKeyFile(path, false); !errors.Is(err, ErrInsecureKeyFile) {
+		t.Errorf("ReadKeyFile() error = %v, want %v", err, ErrInsecureKeyFile)
+	}
+
+	if _, err := ReadKeyFile(path, true); err != nil {
+		t.Errorf("ReadKeyFile() with allowInsecure error = %v", err)
+	}
+}
+
+func TestReadClientKeysFile(t *testing.T) {
+	alice, _ := GenerateKey()
+	bob, _ := GenerateKey()
+	bobOld, _ := GenerateKey()
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[uint16]int
+		wantErr error
+	}{
+		{
+			name: "valid",
+			content: "# clients\n1 " + FormatHexKey(alice) + " # laptop\n\n" +
+				"2 " + FormatHexKey(bob) + "\n2 " + FormatHexKey(bobOld) + "\n",
+			want: map[uint16]int{1: 1, 2: 2},
+		},
+		{
+			name: "policy",
+			content: "1 " + FormatHexKey(alice) + " until=2030-01-31 hours=09:00-17:00 # demo\n" +
+				"2 " + FormatHexKey(bob) + "\n",
+			want: map[uint16]int{1: 1, 2: 1},
+		},
+		{name: "invalid policy", content: "1 " + FormatHexKey(alice) + " hours=9-5\n", wantErr: ErrInvalidPolicy},
+		{name: "reserved id", content: "0 " + FormatHexKey(alice) + "\n", wantErr: ErrInvalidKeyID},
+		{name: "id out of range", content: "65536 " + FormatHexKey(alice) + "\n", wantErr: ErrInvalidKeyID},
+		{name: "short key", content: "1 abcd\n", wantErr: ErrInvalidKey},
+		{name: "missing key", content: "1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clients")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+
+			got, err := ReadClientKeysFile(path, false)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("Expected error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("ReadClientKeysFile() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadClientKeysFile() error = %v", err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("Key IDs: got %d, want %d", len(got), len(tt.want))
+			}
+			for id, n := range tt.want {
+				if len(got[id]) != n {
+					t.Errorf("Keys for ID %d: got %d, want %d", id, len(got[id]), n)
+				}
+			}
+			if !bytes.Equal(got[2][0].Secret, bob) {
+				t.Error("Keys for an ID are not kept in file order")
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package crypto
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkKeyFilePerms verifies the mode and owner of an open key file.
+func checkKeyFilePerms(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	path := f.Name()
+
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%w: %s has mode %04o, want 0600 or stricter (chmod 600 %s)", ErrInsecureKeyFile, path, perm, path)
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if uid := int(st.Uid); uid != os.Getuid() && uid != 0 {
+			return fmt.Errorf("%w: %s is owned by uid %d", ErrInsecureKeyFile, path, uid)
+		}
+	}
+
+	return nil
+}
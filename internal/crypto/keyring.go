@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"errors"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+)
+
+// Keyring holds ciphers for several shared secrets so that keys can be
+// rotated without an outage. Ciphers are tried in order, newest first.
+// Each key may carry a policy restricting when it's accepted.
+type Keyring struct {
+	ciphers  []*Cipher
+	policies []KeyPolicy // by cipher
+	clock    clock.Clock
+}
+
+// NewKeyring creates a keyring from shared secrets ordered newest first.
+func NewKeyring(secrets [][]byte, isClient bool) (*Keyring, error) {
+	if len(secrets) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	k := &Keyring{clock: clock.System}
+	for _, secret := range secrets {
+		c, err := NewCipher(secret, isClient)
+		if err != nil {
+			return nil, err
+		}
+		k.ciphers = append(k.ciphers, c)
+		k.policies = append(k.policies, KeyPolicy{})
+	}
+	return k, nil
+}
+
+// NewClientKeyring creates a keyring from per-client keys ordered newest
+// first, enforcing their policies.
+func NewClientKeyring(keys []ClientKey, isClient bool) (*Keyring, error) {
+	secrets := make([][]byte, len(keys))
+	for i, key := range keys {
+		secrets[i] = key.Secret
+	}
+	k, err := NewKeyring(secrets, isClient)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		k.policies[i] = key.Policy
+	}
+	return k, nil
+}
+
+// SetClock sets the clock of the keyring's ciphers and its key policies,
+// clock.System if nil. It must be called before the keyring is used.
+func (k *Keyring) SetClock(clk clock.Clock) {
+	k.clock = clock.Or(clk)
+	for _, c := range k.ciphers {
+		c.SetClock(clk)
+	}
+}
+
+// Decrypt decrypts data with the first key that authenticates it and
+// returns that key's cipher, so the reply can be encrypted with the same
+// key. Data authenticated by a key its policy doesn't accept now is
+// rejected with the policy's error, still returned with the plaintext and
+// cipher so the rejection can be sent to the client encrypted.
+func (k *Keyring) Decrypt(data []byte) ([]byte, *Cipher, error) {
+	for i, c := range k.ciphers {
+		plaintext, err := c.Decrypt(data)
+		if err == nil {
+			return plaintext, c, k.policies[i].Check(k.clock.Now())
+		}
+		// The key matched but the message was rejected
+		if !errors.Is(err, ErrDecryptionFailed) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, ErrDecryptionFailed
+}
+
+// Check returns nil if the policy of any key accepts it at now, and
+// otherwise the newest key's policy error. Messages of sessions
+// established with one of the keys are checked with it.
+func (k *Keyring) Check(now time.Time) error {
+	var first error
+	for _, p := range k.policies {
+		err := p.Check(now)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// AllowsUpstream reports whether the policy of any key allows asking for
+// the named upstream.
+func (k *Keyring) AllowsUpstream(name string) bool {
+	for _, p := range k.policies {
+		if p.AllowsUpstream(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of keys.
+func (k *Keyring) Len() int {
+	return len(k.ciphers)
+}
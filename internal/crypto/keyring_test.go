@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey, _ := GenerateKey()
+	newKey, _ := GenerateKey()
+	otherKey, _ := GenerateKey()
+
+	keyring, err := NewKeyring([][]byte{newKey, oldKey}, false)
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	if keyring.Len() != 2 {
+		t.Errorf("Len: got %d, want 2", keyring.Len())
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		wantErr bool
+	}{
+		{name: "newest key", key: newKey},
+		{name: "previous key", key: oldKey},
+		{name: "unknown key", key: otherKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewCipher(tt.key, true)
+			data, err := client.Encrypt([]byte("query"))
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+
+			plaintext, server, err := keyring.Decrypt(data)
+			if tt.wantErr {
+				if err != ErrDecryptionFailed {
+					t.Errorf("Decrypt() error = %v, want %v", err, ErrDecryptionFailed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if !bytes.Equal(plaintext, []byte("query")) {
+				t.Errorf("Plaintext: got %q", plaintext)
+			}
+
+			// The reply is readable with the client's key
+			reply, err := server.EncryptWithoutTimestamp([]byte("response"))
+			if err != nil {
+				t.Fatalf("EncryptWithoutTimestamp() error = %v", err)
+			}
+			if _, err := client.DecryptWithoutTimestamp(reply); err != nil {
+				t.Errorf("Client cannot decrypt reply: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewKeyringEmpty(t *testing.T) {
+	if _, err := NewKeyring(nil, false); err != ErrInvalidKey {
+		t.Errorf("NewKeyring(nil) error = %v, want %v", err, ErrInvalidKey)
+	}
+}
@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyExpired      = errors.New("key expired")
+	ErrKeyOutsideHours = errors.New("key not valid at this time of day")
+	ErrInvalidPolicy   = errors.New("invalid key policy")
+)
+
+// minutesPerDay is the length of a day in the minutes of KeyPolicy windows
+const minutesPerDay = 24 * 60
+
+// KeyPolicy restricts when a key is accepted, e.g. a demo key valid only
+// during office hours or until a date. The zero KeyPolicy always accepts
+// the key.
+type KeyPolicy struct {
+	// Until is when the key expires, zero for never
+	Until time.Time
+
+	// From and To bound the daily window the key is accepted in, in
+	// minutes after midnight UTC. The window wraps past midnight if To is
+	// before From; equal values accept the key all day.
+	From, To int
+
+	// Upstreams are the names of the server's named upstreams the client
+	// may ask for; nil allows all of them, an empty list none
+	Upstreams []string
+}
+
+// ClientKey is a per-client key with the policy restricting its use.
+type ClientKey struct {
+	Secret []byte
+	Policy KeyPolicy
+}
+
+// Check returns ErrKeyExpired or ErrKeyOutsideHours if the policy doesn't
+// accept the key at now.
+func (p KeyPolicy) Check(now time.Time) error {
+	if !p.Until.IsZero() && !now.Before(p.Until) {
+		return ErrKeyExpired
+	}
+	if p.From == p.To {
+		return nil
+	}
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	if p.From < p.To {
+		if minute < p.From || minute >= p.To {
+			return ErrKeyOutsideHours
+		}
+	} else if minute < p.From && minute >= p.To {
+		return ErrKeyOutsideHours
+	}
+	return nil
+}
+
+// AllowsUpstream reports whether the client may ask for the named upstream.
+func (p KeyPolicy) AllowsUpstream(name string) bool {
+	return p.Upstreams == nil || slices.Contains(p.Upstreams, name)
+}
+
+// Equal reports whether two policies are the same.
+func (p KeyPolicy) Equal(q KeyPolicy) bool {
+	return p.Until.Equal(q.Until) && p.From == q.From && p.To == q.To &&
+		(p.Upstreams == nil) == (q.Upstreams == nil) && slices.Equal(p.Upstreams, q.Upstreams)
+}
+
+// ParseKeyPolicy parses key policy options:
+//
+//	until=2025-12-31           valid through the end of that day (UTC)
+//	until=2025-12-31T18:00:00Z valid until that time
+//	hours=09:00-17:00          valid only between those times of day (UTC)
+//	upstreams=eu,us            may ask only for these named upstreams
+//	upstreams=none             may ask for no named upstream
+func ParseKeyPolicy(options []string) (KeyPolicy, error) {
+	var p KeyPolicy
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "until":
+			until, err := parseUntil(value)
+			if err != nil {
+				return KeyPolicy{}, fmt.Errorf("%w: until %q", ErrInvalidPolicy, value)
+			}
+			p.Until = until
+		case "hours":
+			from, to, ok := strings.Cut(value, "-")
+			var err1, err2 error
+			p.From, err1 = parseMinute(from)
+			p.To, err2 = parseMinute(to)
+			if !ok || err1 != nil || err2 != nil {
+				return KeyPolicy{}, fmt.Errorf("%w: hours %q", ErrInvalidPolicy, value)
+			}
+		case "upstreams":
+			p.Upstreams = []string{}
+			for _, upstream := range strings.Split(value, ",") {
+				if upstream == "" {
+					return KeyPolicy{}, fmt.Errorf("%w: upstreams %q", ErrInvalidPolicy, value)
+				}
+				if upstream != "none" {
+					p.Upstreams = append(p.Upstreams, upstream)
+				}
+			}
+		default:
+			return KeyPolicy{}, fmt.Errorf("%w: unknown option %q", ErrInvalidPolicy, option)
+		}
+	}
+	return p, nil
+}
+
+// parseUntil parses an RFC 3339 time, or a date meaning the midnight UTC
+// ending it.
+func parseUntil(s string) (time.Time, error) {
+	if date, err := time.Parse(time.DateOnly, s); err == nil {
+		return date.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseMinute parses a time of day as HH:MM, 24:00 included, into minutes
+// after midnight.
+func parseMinute(s string) (int, error) {
+	if s == "24:00" {
+		return minutesPerDay, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseKeyPolicy(t *testing.T) {
+	tests := []struct {
+		options []string
+		want    KeyPolicy
+		wantErr bool
+	}{
+		{options: nil, want: KeyPolicy{}},
+		{
+			options: []string{"until=2030-01-31"},
+			want:    KeyPolicy{Until: time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			options: []string{"until=2030-01-31T18:00:00+02:00", "hours=22:30-06:00"},
+			want:    KeyPolicy{Until: time.Date(2030, 1, 31, 16, 0, 0, 0, time.UTC), From: 22*60 + 30, To: 6 * 60},
+		},
+		{options: []string{"hours=00:00-24:00"}, want: KeyPolicy{To: 24 * 60}},
+		{options: []string{"upstreams=eu,us"}, want: KeyPolicy{Upstreams: []string{"eu", "us"}}},
+		{options: []string{"upstreams=none"}, want: KeyPolicy{Upstreams: []string{}}},
+		{options: []string{"until=tomorrow"}, wantErr: true},
+		{options: []string{"upstreams=eu,"}, wantErr: true},
+		{options: []string{"hours=09:00"}, wantErr: true},
+		{options: []string{"hours=09:00-25:00"}, wantErr: true},
+		{options: []string{"days=mon"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseKeyPolicy(tt.options)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidPolicy) {
+				t.Errorf("ParseKeyPolicy(%q) error = %v, want ErrInvalidPolicy", tt.options, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseKeyPolicy(%q) error = %v", tt.options, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseKeyPolicy(%q) = %+v, want %+v", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPolicyCheck(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2030, 1, 15, hour, minute, 0, 0, time.UTC)
+	}
+	office := KeyPolicy{From: 9 * 60, To: 17 * 60}
+	night := KeyPolicy{From: 22 * 60, To: 6 * 60}
+	expiring := KeyPolicy{Until: at(12, 0)}
+
+	tests := []struct {
+		name   string
+		policy KeyPolicy
+		now    time.Time
+		want   error
+	}{
+		{"no policy", KeyPolicy{}, at(3, 0), nil},
+		{"office hours", office, at(9, 0), nil},
+		{"after office hours", office, at(17, 0), ErrKeyOutsideHours},
+		{"before office hours", office, at(8, 59), ErrKeyOutsideHours},
+		{"night", night, at(23, 0), nil},
+		{"early morning", night, at(5, 59), nil},
+		{"day", night, at(12, 0), ErrKeyOutsideHours},
+		{"before expiry", expiring, at(11, 59), nil},
+		{"expired", expiring, at(12, 0), ErrKeyExpired},
+		{"other time zone", office, time.Date(2030, 1, 15, 10, 0, 0, 0, time.FixedZone("", -8*3600)), ErrKeyOutsideHours},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Check(tt.now); err != tt.want {
+			t.Errorf("%s: Check() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestKeyringPolicy(t *testing.T) {
+	current, _ := GenerateKey()
+	expired, _ := GenerateKey()
+	keyring, err := NewClientKeyring([]ClientKey{
+		{Secret: current},
+		{Secret: expired, Policy: KeyPolicy{Until: time.Now().Add(-time.Hour)}},
+	}, false)
+	if err != nil {
+		t.Fatalf("NewClientKeyring() error = %v", err)
+	}
+	if err := keyring.Check(time.Now()); err != nil {
+		t.Errorf("Check() = %v, want nil while a key is valid", err)
+	}
+
+	for _, tt := range []struct {
+		secret []byte
+		want   error
+	}{
+		{current, nil},
+		{expired, ErrKeyExpired},
+	} {
+		c, _ := NewCipher(tt.secret, true)
+		data, _ := c.Encrypt([]byte("query"))
+		if _, _, err := keyring.Decrypt(data); err != tt.want {
+			t.Errorf("Decrypt() error = %v, want %v", err, tt.want)
+		}
+	}
+}
+
+func TestKeyPolicyAllowsUpstream(t *testing.T) {
+	if !(KeyPolicy{}).AllowsUpstream("eu") {
+		t.Error("Zero policy refused an upstream")
+	}
+	p := KeyPolicy{Upstreams: []string{"eu"}}
+	if !p.AllowsUpstream("eu") || p.AllowsUpstream("us") {
+		t.Errorf("%+v: AllowsUpstream(eu) = %v, AllowsUpstream(us) = %v", p, p.AllowsUpstream("eu"), p.AllowsUpstream("us"))
+	}
+	if (KeyPolicy{Upstreams: []string{}}).AllowsUpstream("eu") {
+		t.Error("Empty upstream list allowed an upstream")
+	}
+}
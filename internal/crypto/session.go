@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Session key exchange constants
+const (
+	// PublicKeySize is the size of an X25519 public key
+	PublicKeySize = 32
+
+	// ContextSession is the key derivation context for session keys
+	ContextSession = "session"
+
+	// ContextTicket is the key derivation context for resumption ticket
+	// keys
+	ContextTicket = "ticket"
+)
+
+// Handshake holds one side's ephemeral X25519 key while a session is
+// established. The public keys are exchanged encrypted with the pre-shared
+// key, which authenticates both sides; the session keys are derived from
+// the X25519 shared secret alone, so recorded traffic stays private even if
+// the pre-shared key is later compromised.
+type Handshake struct {
+	private *ecdh.PrivateKey
+}
+
+// NewHandshake generates a new ephemeral key.
+func NewHandshake() (*Handshake, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	return &Handshake{private: private}, nil
+}
+
+// PublicKey returns the ephemeral public key to send to the peer.
+func (h *Handshake) PublicKey() []byte {
+	return h.private.PublicKey().Bytes()
+}
+
+// SessionCipher derives the session cipher from the peer's ephemeral public
+// key. isClient determines the key directions as in NewCipher.
+func (h *Handshake) SessionCipher(peerPublic []byte, isClient bool) (*Cipher, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	shared, err := h.private.ECDH(peer)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	defer ZeroBytes(shared)
+
+	// Bind the session key to both public keys, client first
+	clientPublic, serverPublic := h.PublicKey(), peerPublic
+	if !isClient {
+		clientPublic, serverPublic = serverPublic, clientPublic
+	}
+	info := ContextSession + string(clientPublic) + string(serverPublic)
+
+	sessionKey, err := hkdf.Key(sha256.New, shared, nil, info, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+	defer ZeroBytes(sessionKey)
+
+	return NewCipher(sessionKey, isClient)
+}
+
+// TicketRequest follows the public key in a client's handshake message to
+// ask for a resumption ticket. Servers then send the ticket after their
+// public key, as a message prefixed by AppendTicket.
+const TicketRequest byte = 1
+
+// AppendTicket appends ticket to dst with its 2-byte length before it, as
+// tickets are sent before the message they come with.
+func AppendTicket(dst, ticket []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(ticket)))
+	return append(dst, ticket...)
+}
+
+// SplitTicket splits data written by AppendTicket into the ticket and the
+// rest.
+func SplitTicket(data []byte) (ticket, rest []byte, err error) {
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return nil, nil, ErrInvalidTicket
+	}
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	return data[2:n], data[n:], nil
+}
+
+// TicketKey seals session resumption tickets: session state the server
+// hands to the client and only it can read back. Tickets carry random
+// nonces, so any number can be sealed under one key.
+type TicketKey struct {
+	aead cipher.AEAD
+}
+
+// NewTicketKey creates a ticket key from KeySize random bytes.
+func NewTicketKey(key []byte) (*TicketKey, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return &TicketKey{aead: aead}, nil
+}
+
+// DeriveTicketKey derives a ticket key from a secret, so every holder of
+// the secret can open the tickets any of them sealed.
+func DeriveTicketKey(secret []byte) (*TicketKey, error) {
+	key, err := deriveKey(secret, ContextTicket)
+	if err != nil {
+		return nil, err
+	}
+	defer ZeroBytes(key)
+	return NewTicketKey(key)
+}
+
+// Seal returns a ticket holding state.
+func (k *TicketKey) Seal(state []byte) ([]byte, error) {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(state)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return k.aead.Seal(nonce, nonce, state, []byte(ContextTicket)), nil
+}
+
+// Open returns the state in a ticket, or ErrDecryptionFailed if the ticket
+// wasn't sealed with the key or was altered.
+func (k *TicketKey) Open(ticket []byte) ([]byte, error) {
+	if len(ticket) < chacha20poly1305.NonceSizeX+k.aead.Overhead() {
+		return nil, ErrDecryptionFailed
+	}
+	state, err := k.aead.Open(nil, ticket[:chacha20poly1305.NonceSizeX], ticket[chacha20poly1305.NonceSizeX:], []byte(ContextTicket))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return state, nil
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandshakeSessionCipher(t *testing.T) {
+	client, err := NewHandshake()
+	if err != nil {
+		t.Fatalf("NewHandshake() error = %v", err)
+	}
+	server, err := NewHandshake()
+	if err != nil {
+		t.Fatalf("NewHandshake() error = %v", err)
+	}
+
+	if len(client.PublicKey()) != PublicKeySize {
+		t.Fatalf("PublicKey length: got %d, want %d", len(client.PublicKey()), PublicKeySize)
+	}
+
+	clientCipher, err := client.SessionCipher(server.PublicKey(), true)
+	if err != nil {
+		t.Fatalf("SessionCipher() error = %v", err)
+	}
+	serverCipher, err := server.SessionCipher(client.PublicKey(), false)
+	if err != nil {
+		t.Fatalf("SessionCipher() error = %v", err)
+	}
+
+	// Both directions work with the derived keys
+	query, _ := clientCipher.Encrypt([]byte("query"))
+	if got, err := serverCipher.Decrypt(query); err != nil || !bytes.Equal(got, []byte("query")) {
+		t.Errorf("Server Decrypt() = %q, %v", got, err)
+	}
+	response, _ := serverCipher.EncryptWithoutTimestamp([]byte("response"))
+	if got, err := clientCipher.DecryptWithoutTimestamp(response); err != nil || !bytes.Equal(got, []byte("response")) {
+		t.Errorf("Client Decrypt() = %q, %v", got, err)
+	}
+
+	// A different session cannot decrypt the traffic
+	other, _ := NewHandshake()
+	otherCipher, _ := other.SessionCipher(client.PublicKey(), false)
+	if _, err := otherCipher.Decrypt(query); err == nil {
+		t.Error("Expected other session to fail decryption")
+	}
+}
+
+func TestHandshakeInvalidPeer(t *testing.T) {
+	h, _ := NewHandshake()
+
+	if _, err := h.SessionCipher([]byte{1, 2, 3}, true); err != ErrInvalidKey {
+		t.Errorf("Short key: got %v, want %v", err, ErrInvalidKey)
+	}
+	// The all-zero point yields an all-zero shared secret and is rejected
+	if _, err := h.SessionCipher(make([]byte, PublicKeySize), true); err != ErrInvalidKey {
+		t.Errorf("Zero key: got %v, want %v", err, ErrInvalidKey)
+	}
+}
+
+func TestTicketKey(t *testing.T) {
+	key, err := DeriveTicketKey(bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatalf("DeriveTicketKey() error = %v", err)
+	}
+	ticket, err := key.Seal([]byte("state"))
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if again, _ := key.Seal([]byte("state")); bytes.Equal(again, ticket) {
+		t.Error("Tickets of the same state are equal")
+	}
+
+	// Holders of the same secret open each other's tickets
+	peer, _ := DeriveTicketKey(bytes.Repeat([]byte{1}, KeySize))
+	if state, err := peer.Open(ticket); err != nil || string(state) != "state" {
+		t.Fatalf("Open() = %q, %v", state, err)
+	}
+
+	other, _ := DeriveTicketKey(bytes.Repeat([]byte{2}, KeySize))
+	if _, err := other.Open(ticket); err != ErrDecryptionFailed {
+		t.Errorf("Other key: got %v, want %v", err, ErrDecryptionFailed)
+	}
+	ticket[len(ticket)-1] ^= 1
+	if _, err := key.Open(ticket); err != ErrDecryptionFailed {
+		t.Errorf("Altered ticket: got %v, want %v", err, ErrDecryptionFailed)
+	}
+	if _, err := key.Open(ticket[:10]); err != ErrDecryptionFailed {
+		t.Errorf("Short ticket: got %v, want %v", err, ErrDecryptionFailed)
+	}
+	if _, err := NewTicketKey(make([]byte, 16)); err != ErrInvalidKey {
+		t.Errorf("Short key: got %v, want %v", err, ErrInvalidKey)
+	}
+}
@@ -0,0 +1,232 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Carrier is the record type tunnel responses are carried in. A query's
+// type selects the carrier of its response. Carriers are ordered by
+// preference, the densest and most ordinary first.
+type Carrier int
+
+const (
+	// CarrierTXT carries response data in the character strings of a
+	// single TXT record
+	CarrierTXT Carrier = iota
+
+	// CarrierHTTPS carries response data in a private-use SvcParam of a
+	// single HTTPS record, a type resolvers increasingly pass through
+	// with large data for filtering TXT less
+	CarrierHTTPS
+
+	// CarrierNULL carries response data as the raw data of a single NULL
+	// record, for resolvers that filter TXT but pass unusual types
+	CarrierNULL
+
+	// CarrierAAAA carries response data in a set of AAAA records. Each
+	// address is a sequence number, since resolvers may reorder the set,
+	// and 15 bytes of data.
+	CarrierAAAA
+
+	// CarrierCNAME carries response data base32 encoded in the target of
+	// a single CNAME record under the server domain, for resolvers that
+	// pass little but names. Queries ask for the CNAME itself, so
+	// resolvers don't follow it.
+	CarrierCNAME
+)
+
+// aaaaChunk is the number of data bytes an AAAA record carries.
+const aaaaChunk = 15
+
+// httpsParamKey is the SvcParamKey HTTPS records carry data in, the first
+// of the private-use keys (RFC 9460, Section 14.3.2).
+const httpsParamKey = 65280
+
+// carrierTypes are the record types of the carriers, in carrier order.
+var carrierTypes = []uint16{RRTypeTXT, RRTypeHTTPS, RRTypeNULL, RRTypeAAAA, RRTypeCNAME}
+
+// CarrierOf returns the carrier of the response to a query of qtype: TXT
+// for types no carrier has.
+func CarrierOf(qtype uint16) Carrier {
+	for c, t := range carrierTypes {
+		if t == qtype {
+			return Carrier(c)
+		}
+	}
+	return CarrierTXT
+}
+
+// String returns the name of the carrier.
+func (c Carrier) String() string {
+	switch c {
+	case CarrierTXT:
+		return "TXT"
+	case CarrierHTTPS:
+		return "HTTPS"
+	case CarrierNULL:
+		return "NULL"
+	case CarrierAAAA:
+		return "AAAA"
+	case CarrierCNAME:
+		return "CNAME"
+	}
+	return fmt.Sprintf("Carrier(%d)", int(c))
+}
+
+// Valid reports whether c is a known carrier.
+func (c Carrier) Valid() bool {
+	return c >= 0 && int(c) < len(carrierTypes)
+}
+
+// RRType returns the query and record type of the carrier.
+func (c Carrier) RRType() uint16 {
+	if !c.Valid() {
+		return RRTypeTXT
+	}
+	return carrierTypes[c]
+}
+
+// FragmentSize returns the number of data bytes a single response
+// fragment in the carrier can carry within maxSize bytes under domain, on
+// the same assumptions as ResponseFragmentSize.
+func (c Carrier) FragmentSize(maxSize int, domain Name) int {
+	// Header, question, answer RR header with a name pointer and echoed
+	// OPT record
+	budget := maxSize - 12 - (MaxNameLength + 4) - (2 + 10) - 11
+
+	var size int
+	switch c {
+	case CarrierNULL:
+		size = budget
+	case CarrierHTTPS:
+		// Priority, the root target name and the SvcParam's key and length
+		size = budget - 2 - 1 - 4
+	case CarrierAAAA:
+		// Each further record repeats the RR header. Sequence numbers are
+		// a byte, and the data has a length prefix.
+		records := min(max(budget+2+10, 0)/(2+10+16), 256)
+		size = records*aaaaChunk - 2
+	case CarrierCNAME:
+		// The target name, within the budget and the 255-byte limit
+		room := min(budget, MaxNameLength) - 1
+		for _, label := range domain {
+			room -= len(label) + 1
+		}
+		size = CodecBase32.capacity(room)
+	default:
+		return ResponseFragmentSize(maxSize)
+	}
+
+	size -= FragmentHeaderSize
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// encodeCNAMEData encodes data into the target name of a CNAME record
+// under domain.
+func encodeCNAMEData(data []byte, domain Name) ([]byte, error) {
+	target, err := NewName(append(plainLabels(CodecBase32.encode(data)), domain...))
+	if err != nil {
+		return nil, ErrPayloadTooLong
+	}
+	return EncodeNameData(target), nil
+}
+
+// decodeCNAMEData decodes data from the target name of a CNAME record
+// under domain, in whatever case resolvers sent it.
+func decodeCNAMEData(rdata []byte, domain Name) ([]byte, error) {
+	target, err := DecodeNameData(rdata)
+	if err != nil {
+		return nil, err
+	}
+	prefix, ok := target.TrimSuffix(domain)
+	if !ok {
+		return nil, ErrInvalidResponse
+	}
+	return decodeLabels(bytes.Join(prefix, nil))
+}
+
+// encodeHTTPSData encodes data into a private-use SvcParam of an HTTPS
+// record in service mode, whose target is the owner name.
+func encodeHTTPSData(data []byte) ([]byte, error) {
+	if len(data) > 0xFFFF {
+		return nil, ErrPayloadTooLong
+	}
+	params := binary.BigEndian.AppendUint16(nil, httpsParamKey)
+	params = binary.BigEndian.AppendUint16(params, uint16(len(data)))
+	params = append(params, data...)
+	return EncodeSVCBData(SVCB{Priority: 1, Params: params}), nil
+}
+
+// decodeHTTPSData decodes data from the private-use SvcParam of an HTTPS
+// record, among whatever other SvcParams resolvers added.
+func decodeHTTPSData(rdata []byte) ([]byte, error) {
+	svcb, err := DecodeSVCBData(rdata)
+	if err != nil {
+		return nil, err
+	}
+	for params := svcb.Params; len(params) >= 4; {
+		key := binary.BigEndian.Uint16(params)
+		n := int(binary.BigEndian.Uint16(params[2:]))
+		if n > len(params)-4 {
+			break
+		}
+		if key == httpsParamKey {
+			return params[4 : 4+n], nil
+		}
+		params = params[4+n:]
+	}
+	return nil, ErrInvalidResponse
+}
+
+// encodeAAAAData splits data into the addresses of AAAA records: a
+// sequence number and 15 bytes each, of the length-prefixed data.
+func encodeAAAAData(data []byte) [][]byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	buf = append(buf, data...)
+
+	var addrs [][]byte
+	for seq := 0; len(buf) > 0; seq++ {
+		addr := make([]byte, 16)
+		addr[0] = byte(seq)
+		buf = buf[copy(addr[1:], buf):]
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// decodeAAAAData reassembles data from the addresses of AAAA records, in
+// any order.
+func decodeAAAAData(addrs [][]byte) ([]byte, error) {
+	sorted := make([][]byte, 0, len(addrs))
+	for _, addr := range addrs {
+		if len(addr) != 16 {
+			return nil, ErrInvalidResponse
+		}
+		sorted = append(sorted, addr)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+
+	var buf bytes.Buffer
+	for i, addr := range sorted {
+		if int(addr[0]) != i {
+			return nil, ErrInvalidResponse
+		}
+		buf.Write(addr[1:])
+	}
+
+	data := buf.Bytes()
+	if len(data) < 2 {
+		return nil, ErrInvalidResponse
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if n > len(data)-2 {
+		return nil, ErrInvalidResponse
+	}
+	return data[2 : 2+n], nil
+}
@@ -0,0 +1,175 @@
+package dns
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCarriers(t *testing.T) {
+	maxSize := 1232
+
+	// A worst-case question name
+	labels := make([][]byte, 4)
+	for i := range labels {
+		labels[i] = bytes.Repeat([]byte{'a'}, 62)
+	}
+	domain := Name(labels[2:])
+
+	for _, carrier := range []Carrier{CarrierTXT, CarrierHTTPS, CarrierNULL, CarrierAAAA, CarrierCNAME} {
+		size := carrier.FragmentSize(maxSize, domain)
+		if size <= 0 {
+			t.Fatalf("%v: FragmentSize(%d) = %d", carrier, maxSize, size)
+		}
+
+		query := CreateQuery(Name(labels), carrier.RRType(), 1)
+		query.AddEDNS0(4096)
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		f := &Fragment{ID: 1, Total: 1, Data: data}
+		resp, err := CreateTunnelResponse(query, domain, f.Marshal(), 60, uint16(maxSize))
+		if err != nil {
+			t.Fatalf("%v: CreateTunnelResponse() error = %v", carrier, err)
+		}
+		wire, err := resp.Marshal()
+		if err != nil {
+			t.Fatalf("%v: Marshal() error = %v", carrier, err)
+		}
+		if len(wire) > maxSize {
+			t.Errorf("%v: response is %d bytes, want at most %d", carrier, len(wire), maxSize)
+		}
+		for _, rr := range resp.Answer {
+			if rr.Type != carrier.RRType() {
+				t.Fatalf("%v: answer of type %d", carrier, rr.Type)
+			}
+		}
+
+		parsed, err := ParseMessage(wire)
+		if err != nil {
+			t.Fatalf("%v: ParseMessage() error = %v", carrier, err)
+		}
+		payload, err := ExtractResponsePayload(parsed, domain)
+		if err != nil {
+			t.Fatalf("%v: ExtractResponsePayload() error = %v", carrier, err)
+		}
+		if !bytes.Equal(payload, f.Marshal()) {
+			t.Errorf("%v: payload mismatch", carrier)
+		}
+	}
+
+	if txt, null := CarrierTXT.FragmentSize(maxSize, domain), CarrierNULL.FragmentSize(maxSize, domain); null < txt {
+		t.Errorf("NULL fragments of %d bytes, want at least TXT's %d", null, txt)
+	}
+}
+
+func TestAAAACarrierReordered(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	query := CreateQuery(append(Name{[]byte("q")}, domain...), RRTypeAAAA, 1)
+	payload := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, 40)
+
+	resp, err := CreateTunnelResponse(query, domain, payload, 60, 0)
+	if err != nil {
+		t.Fatalf("CreateTunnelResponse() error = %v", err)
+	}
+
+	// Resolvers may reorder the set
+	rand.Shuffle(len(resp.Answer), func(i, j int) {
+		resp.Answer[i], resp.Answer[j] = resp.Answer[j], resp.Answer[i]
+	})
+	got, err := ExtractResponsePayload(resp, domain)
+	if err != nil {
+		t.Fatalf("ExtractResponsePayload() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Payload mismatch after reordering")
+	}
+
+	// A missing record is detected
+	resp.Answer = resp.Answer[1:]
+	if _, err := ExtractResponsePayload(resp, domain); err == nil {
+		t.Error("ExtractResponsePayload() with a record missing succeeded")
+	}
+}
+
+func TestCNAMECarrierMixedCase(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	query := CreateQuery(append(Name{[]byte("q")}, domain...), RRTypeCNAME, 1)
+	payload := []byte("payload carried in a name")
+
+	resp, err := CreateTunnelResponse(query, domain, payload, 60, 0)
+	if err != nil {
+		t.Fatalf("CreateTunnelResponse() error = %v", err)
+	}
+	target, err := DecodeNameData(resp.Answer[0].Data)
+	if err != nil {
+		t.Fatalf("DecodeNameData() error = %v", err)
+	}
+	resp.Answer[0].Data = EncodeNameData(RandomizeCase(target))
+
+	got, err := ExtractResponsePayload(resp, domain)
+	if err != nil {
+		t.Fatalf("ExtractResponsePayload() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Payload = %q, want %q", got, payload)
+	}
+}
+
+func TestHTTPSCarrierExtraParams(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	query := CreateQuery(append(Name{[]byte("q")}, domain...), RRTypeHTTPS, 1)
+	payload := bytes.Repeat([]byte{0xAB}, 1000)
+
+	resp, err := CreateTunnelResponse(query, domain, payload, 60, 0)
+	if err != nil {
+		t.Fatalf("CreateTunnelResponse() error = %v", err)
+	}
+	svcb, err := DecodeSVCBData(resp.Answer[0].Data)
+	if err != nil {
+		t.Fatalf("DecodeSVCBData() error = %v", err)
+	}
+	if svcb.Priority != 1 || len(svcb.Target) != 0 {
+		t.Errorf("HTTPS record priority %d, target %v, want service mode at the owner", svcb.Priority, svcb.Target)
+	}
+
+	// Resolvers may add SvcParams, such as alpn (key 1) "h2"
+	svcb.Params = append([]byte{0, 1, 0, 3, 2, 'h', '2'}, svcb.Params...)
+	resp.Answer[0].Data = EncodeSVCBData(svcb)
+	got, err := ExtractResponsePayload(resp, domain)
+	if err != nil {
+		t.Fatalf("ExtractResponsePayload() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Payload mismatch")
+	}
+
+	// A record without the data's SvcParam carries nothing
+	resp.Answer[0].Data = EncodeSVCBData(SVCB{Priority: 1, Params: []byte{0, 1, 0, 3, 2, 'h', '2'}})
+	if _, err := ExtractResponsePayload(resp, domain); err == nil {
+		t.Error("ExtractResponsePayload() without the SvcParam succeeded")
+	}
+}
+
+func TestCarrierOf(t *testing.T) {
+	tests := []struct {
+		qtype uint16
+		want  Carrier
+	}{
+		{RRTypeTXT, CarrierTXT},
+		{RRTypeA, CarrierTXT},
+		{RRTypeHTTPS, CarrierHTTPS},
+		{RRTypeNULL, CarrierNULL},
+		{RRTypeAAAA, CarrierAAAA},
+		{RRTypeCNAME, CarrierCNAME},
+	}
+	for _, tt := range tests {
+		if got := CarrierOf(tt.qtype); got != tt.want {
+			t.Errorf("CarrierOf(%d) = %v, want %v", tt.qtype, got, tt.want)
+		}
+		if got := tt.want.RRType(); tt.qtype != RRTypeA && got != tt.qtype {
+			t.Errorf("%v.RRType() = %d, want %d", tt.want, got, tt.qtype)
+		}
+	}
+}
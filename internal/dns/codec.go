@@ -0,0 +1,162 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Codec is how encoded payloads are written into query name labels.
+// Codecs are ordered from least to most dense.
+type Codec int
+
+const (
+	// CodecBase32 writes 5 bits per character in lowercase letters and
+	// digits, which every resolver carries in any case
+	CodecBase32 Codec = iota
+
+	// CodecBase64 writes 6 bits per character in base64url, for paths
+	// that preserve the case of names
+	CodecBase64
+
+	// CodecBinary writes the raw bytes as labels, for paths that carry
+	// any octet in a name
+	CodecBinary
+)
+
+// Codec markers: the first byte of the data labels of a name in a codec
+// other than base32. Neither is a base32 character, so base32 names need
+// no marker.
+const (
+	codecMarkerBase64 = '0'
+	codecMarkerBinary = '1'
+)
+
+// base64Encoding is base64url without padding, whose characters are all
+// valid in hostnames except for the underscore.
+var base64Encoding = base64.RawURLEncoding
+
+// ParseCodec parses a codec name (base32, base64, binary).
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(s) {
+	case "base32":
+		return CodecBase32, nil
+	case "base64", "base64url":
+		return CodecBase64, nil
+	case "binary", "base128":
+		return CodecBinary, nil
+	}
+	return CodecBase32, fmt.Errorf("invalid codec %q", s)
+}
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	switch c {
+	case CodecBase32:
+		return "base32"
+	case CodecBase64:
+		return "base64"
+	case CodecBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("Codec(%d)", int(c))
+}
+
+// NameCapacity returns the number of bytes the codec fits in a query name
+// under domain, marker included.
+func (c Codec) NameCapacity(domain Name) int {
+	// Maximum DNS name is 255 bytes, less the null terminator
+	room := 255 - 1
+
+	// Subtract domain labels and their length bytes
+	for _, label := range domain {
+		room -= len(label) + 1
+	}
+	return c.capacity(room)
+}
+
+// capacity returns the number of bytes the codec fits in room bytes of
+// labels, marker included.
+func (c Codec) capacity(room int) int {
+	// Each label can hold up to 63 bytes, but needs 64 bytes to encode
+	// (63 bytes data + 1 byte length prefix)
+	capacity := max(room, 0) * 63 / 64
+
+	switch c {
+	case CodecBase64:
+		// Base64 expands 3 bytes to 4
+		return max(capacity-1, 0) * 3 / 4
+	case CodecBinary:
+		return max(capacity-1, 0)
+	}
+	// Base32 expands 5 bytes to 8
+	return capacity * 5 / 8
+}
+
+// MaxPayloadSize returns the largest payload the codec encodes under
+// domain, accounting for the KeyID, ClientID and maximum padding.
+func (c Codec) MaxPayloadSize(domain Name) int {
+	size := c.NameCapacity(domain) - KeyIDSize - ClientIDSize - 1 - MaxPadding - 1
+	if size > PaddingPrefixBase-1 {
+		size = PaddingPrefixBase - 1
+	}
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// QueryFragmentSize returns the number of data bytes a single query
+// fragment carries in a name of the codec under domain.
+func (c Codec) QueryFragmentSize(domain Name) int {
+	size := c.MaxPayloadSize(domain) - FragmentHeaderSize
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// encode encodes raw data into the characters of the codec's data labels,
+// marker first.
+func (c Codec) encode(raw []byte) []byte {
+	switch c {
+	case CodecBase64:
+		encoded := make([]byte, 1+base64Encoding.EncodedLen(len(raw)))
+		encoded[0] = codecMarkerBase64
+		base64Encoding.Encode(encoded[1:], raw)
+		return encoded
+	case CodecBinary:
+		return append([]byte{codecMarkerBinary}, raw...)
+	}
+	encoded := make([]byte, base32Encoding.EncodedLen(len(raw)))
+	base32Encoding.Encode(encoded, raw)
+	return encoded
+}
+
+// decodeLabels decodes the joined data labels of a name in whichever codec
+// their marker names. Base32 is lowercased first, whatever case resolvers
+// sent it in.
+func decodeLabels(encoded []byte) ([]byte, error) {
+	if len(encoded) > 0 {
+		switch encoded[0] {
+		case codecMarkerBase64:
+			decoded := make([]byte, base64Encoding.DecodedLen(len(encoded)-1))
+			n, err := base64Encoding.Decode(decoded, encoded[1:])
+			if err != nil {
+				return nil, fmt.Errorf("base64 decode failed: %w", err)
+			}
+			return decoded[:n], nil
+		case codecMarkerBinary:
+			return encoded[1:], nil
+		}
+	}
+
+	encoded = bytes.ToLower(encoded)
+	decoded := make([]byte, base32Encoding.DecodedLen(len(encoded)))
+	n, err := base32Encoding.Decode(decoded, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("base32 decode failed: %w", err)
+	}
+	return decoded[:n], nil
+}
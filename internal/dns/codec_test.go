@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	clientID := NewClientID()
+
+	codecs := []Codec{CodecBase32, CodecBase64, CodecBinary}
+	levels := []StealthLevel{StealthOff, StealthLow, StealthMedium, StealthHigh}
+
+	for _, codec := range codecs {
+		for _, level := range levels {
+			for _, size := range []int{0, 16, codec.MaxPayloadSize(domain)} {
+				payload := make([]byte, size)
+				for i := 0; i < 50; i++ {
+					_, _ = rand.Read(payload)
+					name, err := codec.Encode(payload, 7, clientID, domain, level)
+					if err != nil {
+						t.Fatalf("%v/%v/%d: Encode() error = %v", codec, level, size, err)
+					}
+					if _, err := NewName(name); err != nil {
+						t.Fatalf("%v/%v/%d: invalid name: %v", codec, level, size, err)
+					}
+
+					keyID, gotID, got, err := DecodePayload(name, domain)
+					if err != nil {
+						t.Fatalf("%v/%v/%d: DecodePayload(%s) error = %v", codec, level, size, name, err)
+					}
+					if keyID != 7 || gotID != clientID || !bytes.Equal(got, payload) {
+						t.Fatalf("%v/%v/%d: round trip mismatch for %s", codec, level, size, name)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCodecCapacity(t *testing.T) {
+	domain := mustParseName("t.example.com")
+
+	base32 := CodecBase32.QueryFragmentSize(domain)
+	base64 := CodecBase64.QueryFragmentSize(domain)
+	binary := CodecBinary.QueryFragmentSize(domain)
+	if base32 != QueryFragmentSize(domain) {
+		t.Errorf("base32 fragment size = %d, want %d", base32, QueryFragmentSize(domain))
+	}
+	if base64 <= base32*115/100 || binary <= base32*155/100 {
+		t.Errorf("fragment sizes base32 %d, base64 %d, binary %d: want about 20%% and 60%% more", base32, base64, binary)
+	}
+
+	// Too long even with the least padding
+	payload := make([]byte, CodecBinary.MaxPayloadSize(domain)+MaxPadding-MinPadding+1)
+	if _, err := CodecBinary.Encode(payload, 0, ClientID{}, domain, StealthOff); err != ErrPayloadTooLong {
+		t.Errorf("Encode() of %d bytes error = %v, want ErrPayloadTooLong", len(payload), err)
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for _, codec := range []Codec{CodecBase32, CodecBase64, CodecBinary} {
+		got, err := ParseCodec(codec.String())
+		if err != nil || got != codec {
+			t.Errorf("ParseCodec(%q) = %v, %v", codec.String(), got, err)
+		}
+	}
+	if _, err := ParseCodec("base16"); err == nil {
+		t.Error("ParseCodec(base16) succeeded")
+	}
+}
@@ -0,0 +1,55 @@
+package dns
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// MaxDecompressedSize bounds decompressed messages: the largest DNS
+// message, so a small compressed payload can't expand without limit.
+const MaxDecompressedSize = 65535
+
+var ErrDecompressedTooLarge = errors.New("decompressed message too large")
+
+// flateWriters reuses compressors, which are costly to allocate.
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestCompression)
+		return w
+	},
+}
+
+// Compress compresses a tunnel message with raw DEFLATE (RFC 1951). It
+// reports false, and returns data unchanged, if that wouldn't make it
+// smaller, as for short or already compressed messages.
+func Compress(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return data, false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(data) {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+// Decompress decompresses a tunnel message compressed by Compress.
+func Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return out, nil
+}
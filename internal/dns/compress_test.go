@@ -0,0 +1,50 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	resp := CreateResponse(CreateQuery(mustParseName("www.example.com"), RRTypeA, 1))
+	for i := range 20 {
+		resp.Answer = append(resp.Answer, RR{Name: resp.Question[0].Name, Type: RRTypeA, Class: ClassIN, TTL: 300, Data: []byte{192, 0, 2, byte(i)}})
+	}
+	data, err := resp.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	compressed, ok := Compress(data)
+	if !ok || len(compressed) >= len(data) {
+		t.Fatalf("Compress() of %d bytes = %d bytes, %v", len(data), len(compressed), ok)
+	}
+	got, err := Decompress(compressed)
+	if err != nil {
+		t.Fatalf("Decompress() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Round trip mismatch")
+	}
+
+	// Random data doesn't shrink and is left alone
+	random := make([]byte, 200)
+	_, _ = rand.Read(random)
+	if out, ok := Compress(random); ok || !bytes.Equal(out, random) {
+		t.Error("Compress() of random data reported success")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	bomb, ok := Compress(make([]byte, MaxDecompressedSize+1))
+	if !ok {
+		t.Fatal("Compress() failed")
+	}
+	if _, err := Decompress(bomb); err != ErrDecompressedTooLarge {
+		t.Errorf("Decompress() error = %v, want ErrDecompressedTooLarge", err)
+	}
+	if _, err := Decompress([]byte{0xff, 0xff}); err == nil {
+		t.Error("Decompress() of garbage succeeded")
+	}
+}
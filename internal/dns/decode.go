@@ -10,70 +10,87 @@ var (
 	ErrInvalidQuery     = errors.New("invalid DNS query")
 	ErrInvalidResponse  = errors.New("invalid DNS response")
 	ErrNoAnswer         = errors.New("no answer in response")
+	ErrEDNSTooSmall     = errors.New("EDNS0 payload size too small")
 )
 
 // ExtractQueryPayload extracts the encoded payload from a DNS query.
-// Returns the ClientID and decrypted payload from the query name.
-func ExtractQueryPayload(msg *Message, domain Name) (ClientID, []byte, error) {
+// Returns the KeyID, ClientID and encrypted payload from the query name.
+func ExtractQueryPayload(msg *Message, domain Name) (KeyID, ClientID, []byte, error) {
+	var keyID KeyID
 	var clientID ClientID
 
 	// Validate query
 	if msg.IsResponse() {
-		return clientID, nil, ErrInvalidQuery
+		return keyID, clientID, nil, ErrInvalidQuery
 	}
 
 	if len(msg.Question) != 1 {
-		return clientID, nil, ErrInvalidQuery
+		return keyID, clientID, nil, ErrInvalidQuery
 	}
 
 	q := msg.Question[0]
 
-	// Check if query type is TXT (we also accept A/AAAA for variation)
-	if q.Type != RRTypeTXT && q.Type != RRTypeA && q.Type != RRTypeAAAA {
-		return clientID, nil, ErrInvalidQuery
+	// Check the query type is a carrier's (we also accept A for
+	// variation). This applies to the outer tunnel query only; the
+	// encrypted inner query may be of any type.
+	if q.Type != RRTypeA && CarrierOf(q.Type).RRType() != q.Type {
+		return keyID, clientID, nil, ErrInvalidQuery
 	}
 
 	// Decode the payload from the query name
 	return DecodePayload(q.Name, domain)
 }
 
-// ExtractResponsePayload extracts the payload from a DNS response TXT record.
+// ExtractResponsePayload extracts the payload from a DNS response: the
+// data of its TXT, NULL or CNAME record, or of its set of AAAA records.
 func ExtractResponsePayload(msg *Message, domain Name) ([]byte, error) {
 	// Validate response
 	if !msg.IsResponse() {
 		return nil, ErrInvalidResponse
 	}
 
-	if msg.Rcode() != RcodeNoError {
+	if msg.ExtendedRcode() != RcodeNoError {
 		return nil, ErrInvalidResponse
 	}
 
-	// Look for TXT record in answer section
+	// Look for a record carrying the payload in the answer section,
+	// collecting AAAA records on the way
+	var addrs [][]byte
 	for _, rr := range msg.Answer {
-		if rr.Type != RRTypeTXT {
-			continue
-		}
-
 		// Verify the name matches our domain
-		_, ok := rr.Name.TrimSuffix(domain)
-		if !ok {
+		if _, ok := rr.Name.TrimSuffix(domain); !ok {
 			continue
 		}
 
-		// Decode the TXT record data
-		txtData, err := DecodeTXTData(rr.Data)
-		if err != nil {
-			continue
+		switch rr.Type {
+		case RRTypeTXT:
+			// Decode the TXT record data
+			txtData, err := DecodeTXTData(rr.Data)
+			if err != nil {
+				continue
+			}
+			return txtData, nil
+		case RRTypeNULL:
+			return rr.Data, nil
+		case RRTypeHTTPS:
+			return decodeHTTPSData(rr.Data)
+		case RRTypeCNAME:
+			return decodeCNAMEData(rr.Data, domain)
+		case RRTypeAAAA:
+			addrs = append(addrs, rr.Data)
 		}
-
-		return txtData, nil
 	}
 
+	if len(addrs) > 0 {
+		return decodeAAAAData(addrs)
+	}
 	return nil, ErrNoAnswer
 }
 
-// CreateTunnelResponse creates a DNS response with encoded payload.
-func CreateTunnelResponse(query *Message, domain Name, payload []byte, ttl uint32) (*Message, error) {
+// CreateTunnelResponse creates a DNS response with encoded payload, in the
+// carrier the query's type selects; CNAME targets are under domain. udpSize
+// is the payload size advertised if the query used EDNS.
+func CreateTunnelResponse(query *Message, domain Name, payload []byte, ttl uint32, udpSize uint16) (*Message, error) {
 	if query == nil || len(query.Question) != 1 {
 		return nil, ErrInvalidQuery
 	}
@@ -81,29 +98,44 @@ func CreateTunnelResponse(query *Message, domain Name, payload []byte, ttl uint3
 	resp := CreateResponse(query)
 	resp.Flags |= 0x0400 // AA = 1 (authoritative)
 
-	// Encode payload as TXT record
-	txtData := EncodeTXTData(payload)
-
-	resp.Answer = []RR{
-		{
-			Name:  query.Question[0].Name,
-			Type:  RRTypeTXT,
-			Class: ClassIN,
-			TTL:   ttl,
-			Data:  txtData,
-		},
+	name := query.Question[0].Name
+	switch CarrierOf(query.Question[0].Type) {
+	case CarrierNULL:
+		resp.Answer = []RR{{Name: name, Type: RRTypeNULL, Class: ClassIN, TTL: ttl, Data: payload}}
+	case CarrierHTTPS:
+		// Encode payload in a SvcParam of an HTTPS record
+		data, err := encodeHTTPSData(payload)
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = []RR{{Name: name, Type: RRTypeHTTPS, Class: ClassIN, TTL: ttl, Data: data}}
+	case CarrierCNAME:
+		// Encode payload in the target of a CNAME record
+		target, err := encodeCNAMEData(payload, domain)
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = []RR{{Name: name, Type: RRTypeCNAME, Class: ClassIN, TTL: ttl, Data: target}}
+	case CarrierAAAA:
+		// Encode payload as a set of AAAA records
+		for _, addr := range encodeAAAAData(payload) {
+			resp.Answer = append(resp.Answer, RR{Name: name, Type: RRTypeAAAA, Class: ClassIN, TTL: ttl, Data: addr})
+		}
+	default:
+		// Encode payload as TXT record
+		resp.Answer = []RR{{Name: name, Type: RRTypeTXT, Class: ClassIN, TTL: ttl, Data: EncodeTXTData(payload)}}
 	}
 
 	// Add EDNS0 if query had it
-	if ednsSize := query.GetEDNS0Size(); ednsSize > 0 {
-		resp.AddEDNS0(ednsSize)
-	}
+	resp.addResponseEDNS(query, udpSize, RcodeNoError)
 
 	return resp, nil
 }
 
-// CreateErrorResponse creates a DNS error response.
-func CreateErrorResponse(query *Message, domain Name, rcode uint16) *Message {
+// CreateErrorResponse creates a DNS error response. rcode may be an
+// extended rcode such as RcodeBadVersion. udpSize is the payload size
+// advertised if the query used EDNS.
+func CreateErrorResponse(query *Message, domain Name, rcode uint16, udpSize uint16) *Message {
 	if query == nil {
 		return nil
 	}
@@ -119,13 +151,32 @@ func CreateErrorResponse(query *Message, domain Name, rcode uint16) *Message {
 	}
 
 	// Add EDNS0 if query had it
-	if ednsSize := query.GetEDNS0Size(); ednsSize > 0 {
-		resp.AddEDNS0(ednsSize)
-	}
+	resp.addResponseEDNS(query, udpSize, rcode)
 
 	return resp
 }
 
+// CreateNegativeResponse creates an NXDOMAIN or NODATA (NOERROR without
+// answers) response with the zone's SOA record in the authority section,
+// as authoritative servers send. The record's TTL is soa.Minimum, so
+// resolvers cache the negative answer for that long (RFC 2308).
+func CreateNegativeResponse(query *Message, domain Name, rcode uint16, soa SOA, udpSize uint16) *Message {
+	resp := CreateErrorResponse(query, domain, rcode, udpSize)
+	if resp == nil {
+		return nil
+	}
+	resp.Authority = []RR{
+		{
+			Name:  domain,
+			Type:  RRTypeSOA,
+			Class: ClassIN,
+			TTL:   soa.Minimum,
+			Data:  EncodeSOAData(soa),
+		},
+	}
+	return resp
+}
+
 // ValidateQuery validates a DNS query for tunnel use.
 func ValidateQuery(msg *Message, domain Name, minEDNSSize uint16) error {
 	if msg.IsResponse() {
@@ -140,6 +191,11 @@ func ValidateQuery(msg *Message, domain Name, minEDNSSize uint16) error {
 		return errors.New("query must have exactly one question")
 	}
 
+	// Check EDNS before anything else, like authoritative servers
+	if err := CheckEDNS(msg); err != nil {
+		return err
+	}
+
 	q := msg.Question[0]
 
 	// Check if authoritative for this domain
@@ -152,7 +208,7 @@ func ValidateQuery(msg *Message, domain Name, minEDNSSize uint16) error {
 	if minEDNSSize > 0 {
 		ednsSize := msg.GetEDNS0Size()
 		if ednsSize < minEDNSSize {
-			return errors.New("EDNS0 payload size too small")
+			return ErrEDNSTooSmall
 		}
 	}
 
@@ -169,9 +225,9 @@ func IsValidTunnelResponse(msg *Message, domain Name) bool {
 		return false
 	}
 
-	// Must have at least one TXT answer
+	// Must have at least one answer of a carrier's type
 	for _, rr := range msg.Answer {
-		if rr.Type == RRTypeTXT {
+		if CarrierOf(rr.Type).RRType() == rr.Type {
 			_, ok := rr.Name.TrimSuffix(domain)
 			if ok {
 				return true
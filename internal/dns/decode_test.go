@@ -10,7 +10,7 @@ func TestExtractQueryPayload(t *testing.T) {
 	payload := []byte{1, 2, 3, 4, 5}
 
 	// Encode payload
-	encodedName, err := EncodePayload(payload, clientID, domain)
+	encodedName, err := EncodePayload(payload, 7, clientID, domain)
 	if err != nil {
 		t.Fatalf("EncodePayload failed: %v", err)
 	}
@@ -29,11 +29,15 @@ func TestExtractQueryPayload(t *testing.T) {
 	}
 
 	// Extract payload
-	extractedClientID, extractedPayload, err := ExtractQueryPayload(query, domain)
+	extractedKeyID, extractedClientID, extractedPayload, err := ExtractQueryPayload(query, domain)
 	if err != nil {
 		t.Fatalf("ExtractQueryPayload failed: %v", err)
 	}
 
+	if extractedKeyID != 7 {
+		t.Errorf("KeyID mismatch: got %d, want 7", extractedKeyID)
+	}
+
 	if extractedClientID != clientID {
 		t.Errorf("ClientID mismatch")
 	}
@@ -93,7 +97,7 @@ func TestExtractQueryPayloadInvalid(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, _, err := ExtractQueryPayload(tt.query, domain)
+			_, _, _, err := ExtractQueryPayload(tt.query, domain)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ExtractQueryPayload() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -214,7 +218,7 @@ func TestCreateTunnelResponse(t *testing.T) {
 		},
 	}
 
-	response, err := CreateTunnelResponse(query, domain, payload, 300)
+	response, err := CreateTunnelResponse(query, domain, payload, 300, 1232)
 	if err != nil {
 		t.Fatalf("CreateTunnelResponse failed: %v", err)
 	}
@@ -251,7 +255,7 @@ func TestCreateErrorResponse(t *testing.T) {
 		},
 	}
 
-	response := CreateErrorResponse(query, domain, RcodeNameError)
+	response := CreateErrorResponse(query, domain, RcodeNameError, 1232)
 
 	if !response.IsResponse() {
 		t.Error("Response should have QR=1")
@@ -262,6 +266,43 @@ func TestCreateErrorResponse(t *testing.T) {
 	}
 }
 
+func TestCreateNegativeResponse(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	query := CreateQuery(mustParseName("test.t.example.com"), RRTypeTXT, 0x1234)
+	soa := SOA{
+		MName:   mustParseName("ns1.t.example.com"),
+		RName:   mustParseName("hostmaster.t.example.com"),
+		Serial:  2024010101,
+		Minimum: 300,
+	}
+
+	response := CreateNegativeResponse(query, domain, RcodeNameError, soa, 1232)
+
+	data, err := response.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+
+	if parsed.Rcode() != RcodeNameError || parsed.Flags&0x0400 == 0 {
+		t.Errorf("Header: got rcode %d, flags %#04x", parsed.Rcode(), parsed.Flags)
+	}
+	if len(parsed.Answer) != 0 || len(parsed.Authority) != 1 {
+		t.Fatalf("Sections: got %d answers, %d authority records", len(parsed.Answer), len(parsed.Authority))
+	}
+
+	rr := parsed.Authority[0]
+	if rr.Type != RRTypeSOA || !rr.Name.Equal(domain) || rr.TTL != soa.Minimum {
+		t.Errorf("Authority: got %s type %d TTL %d", rr.Name, rr.Type, rr.TTL)
+	}
+	if got, err := DecodeSOAData(rr.Data); err != nil || got.Serial != soa.Serial || !got.MName.Equal(soa.MName) {
+		t.Errorf("SOA: got %+v, %v", got, err)
+	}
+}
+
 func TestValidateQuery(t *testing.T) {
 	domain, _ := ParseName("t.example.com")
 
@@ -0,0 +1,260 @@
+package dns
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// DNSKEY flags
+const (
+	// DNSKEYFlagZone marks a zone key, which may sign the zone's records
+	DNSKEYFlagZone uint16 = 0x0100
+
+	// DNSKEYFlagSEP marks a key signing key (secure entry point)
+	DNSKEYFlagSEP uint16 = 0x0001
+
+	// DNSKEYFlagRevoke marks a revoked key (RFC 5011)
+	DNSKEYFlagRevoke uint16 = 0x0080
+)
+
+// NSEC3FlagOptOut marks an NSEC3 record whose span may contain unsigned
+// delegations.
+const NSEC3FlagOptOut uint8 = 0x01
+
+// DS is the data of a DS record.
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// DNSKEY is the data of a DNSKEY record.
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+// RRSIG is the data of an RRSIG record.
+type RRSIG struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  Name
+	Signature   []byte
+}
+
+// NSEC is the data of an NSEC record.
+type NSEC struct {
+	NextDomain Name
+	Types      []uint16
+}
+
+// NSEC3 is the data of an NSEC3 record. NextHashed is the raw hash of the
+// next owner name, not its base32 form.
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []uint16
+}
+
+// EncodeDSData encodes the data of a DS record.
+func EncodeDSData(ds DS) []byte {
+	data := binary.BigEndian.AppendUint16(nil, ds.KeyTag)
+	data = append(data, ds.Algorithm, ds.DigestType)
+	return append(data, ds.Digest...)
+}
+
+// DecodeDSData decodes the data of a DS record.
+func DecodeDSData(data []byte) (DS, error) {
+	if len(data) < 4 {
+		return DS{}, ErrInvalidRData
+	}
+	return DS{
+		KeyTag:     binary.BigEndian.Uint16(data),
+		Algorithm:  data[2],
+		DigestType: data[3],
+		Digest:     data[4:],
+	}, nil
+}
+
+// EncodeDNSKEYData encodes the data of a DNSKEY record.
+func EncodeDNSKEYData(key DNSKEY) []byte {
+	data := binary.BigEndian.AppendUint16(nil, key.Flags)
+	data = append(data, key.Protocol, key.Algorithm)
+	return append(data, key.PublicKey...)
+}
+
+// DecodeDNSKEYData decodes the data of a DNSKEY record.
+func DecodeDNSKEYData(data []byte) (DNSKEY, error) {
+	if len(data) < 4 {
+		return DNSKEY{}, ErrInvalidRData
+	}
+	return DNSKEY{
+		Flags:     binary.BigEndian.Uint16(data),
+		Protocol:  data[2],
+		Algorithm: data[3],
+		PublicKey: data[4:],
+	}, nil
+}
+
+// EncodeRRSIGData encodes the data of an RRSIG record.
+func EncodeRRSIGData(sig RRSIG) []byte {
+	return append(EncodeRRSIGHeader(sig), sig.Signature...)
+}
+
+// EncodeRRSIGHeader encodes the data of an RRSIG record without the
+// signature, the part covered by the signature itself.
+func EncodeRRSIGHeader(sig RRSIG) []byte {
+	data := binary.BigEndian.AppendUint16(nil, sig.TypeCovered)
+	data = append(data, sig.Algorithm, sig.Labels)
+	data = binary.BigEndian.AppendUint32(data, sig.OriginalTTL)
+	data = binary.BigEndian.AppendUint32(data, sig.Expiration)
+	data = binary.BigEndian.AppendUint32(data, sig.Inception)
+	data = binary.BigEndian.AppendUint16(data, sig.KeyTag)
+	return appendName(data, sig.SignerName)
+}
+
+// DecodeRRSIGData decodes the data of an RRSIG record.
+func DecodeRRSIGData(data []byte) (RRSIG, error) {
+	if len(data) < 18 {
+		return RRSIG{}, ErrInvalidRData
+	}
+	signer, signature, err := decodeName(data[18:])
+	if err != nil {
+		return RRSIG{}, err
+	}
+	return RRSIG{
+		TypeCovered: binary.BigEndian.Uint16(data[0:2]),
+		Algorithm:   data[2],
+		Labels:      data[3],
+		OriginalTTL: binary.BigEndian.Uint32(data[4:8]),
+		Expiration:  binary.BigEndian.Uint32(data[8:12]),
+		Inception:   binary.BigEndian.Uint32(data[12:16]),
+		KeyTag:      binary.BigEndian.Uint16(data[16:18]),
+		SignerName:  signer,
+		Signature:   signature,
+	}, nil
+}
+
+// EncodeNSECData encodes the data of an NSEC record.
+func EncodeNSECData(nsec NSEC) []byte {
+	return appendTypeBitmap(appendName(nil, nsec.NextDomain), nsec.Types)
+}
+
+// DecodeNSECData decodes the data of an NSEC record.
+func DecodeNSECData(data []byte) (NSEC, error) {
+	next, rest, err := decodeName(data)
+	if err != nil {
+		return NSEC{}, err
+	}
+	types, err := decodeTypeBitmap(rest)
+	if err != nil {
+		return NSEC{}, err
+	}
+	return NSEC{NextDomain: next, Types: types}, nil
+}
+
+// EncodeNSEC3Data encodes the data of an NSEC3 record.
+func EncodeNSEC3Data(nsec3 NSEC3) []byte {
+	data := []byte{nsec3.HashAlgorithm, nsec3.Flags}
+	data = binary.BigEndian.AppendUint16(data, nsec3.Iterations)
+	data = append(data, byte(len(nsec3.Salt)))
+	data = append(data, nsec3.Salt...)
+	data = append(data, byte(len(nsec3.NextHashed)))
+	data = append(data, nsec3.NextHashed...)
+	return appendTypeBitmap(data, nsec3.Types)
+}
+
+// DecodeNSEC3Data decodes the data of an NSEC3 record.
+func DecodeNSEC3Data(data []byte) (NSEC3, error) {
+	if len(data) < 5 || len(data) < 6+int(data[4]) {
+		return NSEC3{}, ErrInvalidRData
+	}
+	nsec3 := NSEC3{
+		HashAlgorithm: data[0],
+		Flags:         data[1],
+		Iterations:    binary.BigEndian.Uint16(data[2:4]),
+	}
+	saltEnd := 5 + int(data[4])
+	nsec3.Salt = data[5:saltEnd]
+	hashEnd := saltEnd + 1 + int(data[saltEnd])
+	if data[saltEnd] == 0 || len(data) < hashEnd {
+		return NSEC3{}, ErrInvalidRData
+	}
+	nsec3.NextHashed = data[saltEnd+1 : hashEnd]
+
+	types, err := decodeTypeBitmap(data[hashEnd:])
+	if err != nil {
+		return NSEC3{}, err
+	}
+	nsec3.Types = types
+	return nsec3, nil
+}
+
+// HasType reports whether the NSEC record lists rrType.
+func (n NSEC) HasType(rrType uint16) bool {
+	return slices.Contains(n.Types, rrType)
+}
+
+// HasType reports whether the NSEC3 record lists rrType.
+func (n NSEC3) HasType(rrType uint16) bool {
+	return slices.Contains(n.Types, rrType)
+}
+
+// appendTypeBitmap appends the NSEC type bitmap of types to b: one window
+// per 256 types, each with a bit per type.
+func appendTypeBitmap(b []byte, types []uint16) []byte {
+	sorted := slices.Clone(types)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	for len(sorted) > 0 {
+		window := sorted[0] >> 8
+		var bits [32]byte
+		length := 0
+		for len(sorted) > 0 && sorted[0]>>8 == window {
+			low := sorted[0] & 0xff
+			bits[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+			sorted = sorted[1:]
+		}
+		b = append(b, byte(window), byte(length))
+		b = append(b, bits[:length]...)
+	}
+	return b
+}
+
+// decodeTypeBitmap decodes an NSEC type bitmap.
+func decodeTypeBitmap(data []byte) ([]uint16, error) {
+	var types []uint16
+	last := -1
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, ErrInvalidRData
+		}
+		window, length := int(data[0]), int(data[1])
+		if window <= last || length == 0 || length > 32 || len(data) < 2+length {
+			return nil, ErrInvalidRData
+		}
+		for i, octet := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, uint16(window<<8|i*8+bit))
+				}
+			}
+		}
+		last = window
+		data = data[2+length:]
+	}
+	return types, nil
+}
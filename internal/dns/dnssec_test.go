@@ -0,0 +1,47 @@
+package dns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDNSSECRDataRoundTrip(t *testing.T) {
+	ds := DS{KeyTag: 20326, Algorithm: 8, DigestType: 2, Digest: []byte{0xe0, 0x6d, 0x44}}
+	if got, err := DecodeDSData(EncodeDSData(ds)); err != nil || !reflect.DeepEqual(got, ds) {
+		t.Errorf("DS: got %+v, %v", got, err)
+	}
+
+	key := DNSKEY{Flags: DNSKEYFlagZone | DNSKEYFlagSEP, Protocol: 3, Algorithm: 15, PublicKey: []byte{1, 2, 3}}
+	if got, err := DecodeDNSKEYData(EncodeDNSKEYData(key)); err != nil || !reflect.DeepEqual(got, key) {
+		t.Errorf("DNSKEY: got %+v, %v", got, err)
+	}
+
+	sig := RRSIG{
+		TypeCovered: RRTypeA, Algorithm: 13, Labels: 3, OriginalTTL: 300,
+		Expiration: 1700003600, Inception: 1700000000, KeyTag: 12345,
+		SignerName: mustParseName("example.com"), Signature: []byte{9, 8, 7},
+	}
+	if got, err := DecodeRRSIGData(EncodeRRSIGData(sig)); err != nil || !reflect.DeepEqual(got, sig) {
+		t.Errorf("RRSIG: got %+v, %v", got, err)
+	}
+
+	// Types in several bitmap windows
+	types := []uint16{RRTypeA, RRTypeNS, RRTypeRRSIG, RRTypeNSEC, RRTypeCAA}
+	nsec := NSEC{NextDomain: mustParseName("b.example.com"), Types: types}
+	got, err := DecodeNSECData(EncodeNSECData(nsec))
+	if err != nil || !reflect.DeepEqual(got, nsec) {
+		t.Errorf("NSEC: got %+v, %v", got, err)
+	}
+	if !got.HasType(RRTypeCAA) || got.HasType(RRTypeAAAA) {
+		t.Errorf("NSEC types: got %v", got.Types)
+	}
+
+	nsec3 := NSEC3{HashAlgorithm: 1, Flags: NSEC3FlagOptOut, Iterations: 10, Salt: []byte{0xaa, 0xbb}, NextHashed: make([]byte, 20), Types: types[:2]}
+	if got, err := DecodeNSEC3Data(EncodeNSEC3Data(nsec3)); err != nil || !reflect.DeepEqual(got, nsec3) {
+		t.Errorf("NSEC3: got %+v, %v", got, err)
+	}
+
+	if _, err := DecodeRRSIGData(EncodeRRSIGData(sig)[:10]); err != ErrInvalidRData {
+		t.Errorf("Short RRSIG: got %v", err)
+	}
+}
@@ -0,0 +1,378 @@
+package dns
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// EDNS constants (RFC 6891)
+const (
+	// EDNSVersion is the highest EDNS version supported
+	EDNSVersion = 0
+
+	// RcodeBadVersion is the extended BADVERS rcode, answered to queries
+	// with an unsupported EDNS version
+	RcodeBadVersion uint16 = 16
+
+	// RcodeBadCookie is the extended BADCOOKIE rcode, asking the client to
+	// retry with the server cookie of the response (RFC 7873)
+	RcodeBadCookie uint16 = 23
+
+	// EDNSMinUDPSize is the smallest UDP payload size; smaller advertised
+	// sizes are treated as this
+	EDNSMinUDPSize = 512
+
+	// ednsFlagDO is the DNSSEC OK flag in the OPT TTL
+	ednsFlagDO = 0x8000
+
+	// EDNSClientCookieSize is the size of a client cookie; server cookies
+	// are EDNSMinServerCookieSize to EDNSMaxServerCookieSize bytes (RFC 7873)
+	EDNSClientCookieSize    = 8
+	EDNSMinServerCookieSize = 8
+	EDNSMaxServerCookieSize = 32
+
+	// QueryPaddingBlock and ResponsePaddingBlock are the block sizes
+	// queries and responses are padded to (RFC 8467)
+	QueryPaddingBlock    = 128
+	ResponsePaddingBlock = 468
+)
+
+var (
+	ErrInvalidOPT     = errors.New("invalid OPT record")
+	ErrBadEDNSVersion = errors.New("unsupported EDNS version")
+	ErrInvalidCookie  = errors.New("invalid EDNS cookie")
+)
+
+// EDNSOption is an option in the data of an OPT record.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// ParseEDNSOptions parses the data of an OPT record into options.
+func ParseEDNSOptions(data []byte) ([]EDNSOption, error) {
+	var options []EDNSOption
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, ErrInvalidEDNSOption
+		}
+		n := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+n {
+			return nil, ErrInvalidEDNSOption
+		}
+		options = append(options, EDNSOption{
+			Code: binary.BigEndian.Uint16(data[0:2]),
+			Data: data[4 : 4+n],
+		})
+		data = data[4+n:]
+	}
+	return options, nil
+}
+
+// EncodeEDNSOptions encodes options as the data of an OPT record.
+func EncodeEDNSOptions(options []EDNSOption) []byte {
+	data := []byte{}
+	for _, o := range options {
+		data = binary.BigEndian.AppendUint16(data, o.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(o.Data)))
+		data = append(data, o.Data...)
+	}
+	return data
+}
+
+// OPT returns the message's OPT record, or nil if it has none. A message
+// with several OPT records or one not owned by the root is invalid.
+func (m *Message) OPT() (*RR, error) {
+	var opt *RR
+	for i := range m.Additional {
+		rr := &m.Additional[i]
+		if rr.Type != RRTypeOPT {
+			continue
+		}
+		if opt != nil || len(rr.Name) != 0 {
+			return nil, ErrInvalidOPT
+		}
+		opt = rr
+	}
+	return opt, nil
+}
+
+// SetEDNS0 replaces the message's OPT records with one advertising udpSize,
+// the DO flag if do is set, and the given options.
+func (m *Message) SetEDNS0(udpSize uint16, do bool, options ...EDNSOption) {
+	var additional []RR
+	for _, rr := range m.Additional {
+		if rr.Type != RRTypeOPT {
+			additional = append(additional, rr)
+		}
+	}
+
+	var ttl uint32
+	if do {
+		ttl |= ednsFlagDO
+	}
+	m.Additional = append(additional, RR{
+		Name:  Name{},
+		Type:  RRTypeOPT,
+		Class: udpSize,
+		TTL:   ttl,
+		Data:  EncodeEDNSOptions(options),
+	})
+}
+
+// DO reports whether the message's OPT record has the DNSSEC OK flag set.
+func (m *Message) DO() bool {
+	opt, err := m.OPT()
+	return err == nil && opt != nil && opt.TTL&ednsFlagDO != 0
+}
+
+// ExtendedRcode returns the message's rcode including the upper bits
+// carried in its OPT record.
+func (m *Message) ExtendedRcode() uint16 {
+	rcode := m.Rcode()
+	if opt, err := m.OPT(); err == nil && opt != nil {
+		rcode |= uint16(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// GetEDNSOption returns the data of the first option with the given code in
+// the message's OPT record.
+func (m *Message) GetEDNSOption(code uint16) ([]byte, bool) {
+	opt, err := m.OPT()
+	if err != nil || opt == nil {
+		return nil, false
+	}
+	options, err := ParseEDNSOptions(opt.Data)
+	if err != nil {
+		return nil, false
+	}
+	for _, o := range options {
+		if o.Code == code {
+			return o.Data, true
+		}
+	}
+	return nil, false
+}
+
+// SetEDNSOption replaces the options with o's code in the message's OPT
+// record with o, or adds it. The message must have a valid OPT record.
+func (m *Message) SetEDNSOption(o EDNSOption) error {
+	opt, err := m.OPT()
+	if err != nil {
+		return err
+	}
+	if opt == nil {
+		return ErrInvalidOPT
+	}
+	options, err := ParseEDNSOptions(opt.Data)
+	if err != nil {
+		return err
+	}
+
+	kept := []EDNSOption{}
+	for _, existing := range options {
+		if existing.Code != o.Code {
+			kept = append(kept, existing)
+		}
+	}
+	opt.Data = EncodeEDNSOptions(append(kept, o))
+	return nil
+}
+
+// NewCookieOption returns a COOKIE option with the client cookie and, once
+// learned from a response, the server cookie.
+func NewCookieOption(client [EDNSClientCookieSize]byte, server []byte) EDNSOption {
+	return EDNSOption{Code: EDNSOptionCookie, Data: append(client[:], server...)}
+}
+
+// NewExtendedErrorOption returns an Extended DNS Error option with the
+// info code and an optional explanation.
+func NewExtendedErrorOption(code uint16, text string) EDNSOption {
+	data := binary.BigEndian.AppendUint16(nil, code)
+	return EDNSOption{Code: EDNSOptionExtendedError, Data: append(data, text...)}
+}
+
+// ExtendedError returns the info code and explanation of the message's
+// Extended DNS Error option, if it has one.
+func (m *Message) ExtendedError() (uint16, string, bool) {
+	data, ok := m.GetEDNSOption(EDNSOptionExtendedError)
+	if !ok || len(data) < 2 {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint16(data), string(data[2:]), true
+}
+
+// ParseCookieOption splits the data of a COOKIE option into the client
+// cookie and the server cookie, which is empty in queries without one.
+func ParseCookieOption(data []byte) (client [EDNSClientCookieSize]byte, server []byte, err error) {
+	n := len(data) - EDNSClientCookieSize
+	if n < 0 || (n > 0 && (n < EDNSMinServerCookieSize || n > EDNSMaxServerCookieSize)) {
+		return client, nil, ErrInvalidCookie
+	}
+	copy(client[:], data)
+	return client, data[EDNSClientCookieSize:], nil
+}
+
+// MatchCookie returns the server cookie of a response if its COOKIE option
+// echoes the client cookie.
+func MatchCookie(resp *Message, client [EDNSClientCookieSize]byte) ([]byte, bool) {
+	data, ok := resp.GetEDNSOption(EDNSOptionCookie)
+	if !ok {
+		return nil, false
+	}
+	echoed, server, err := ParseCookieOption(data)
+	if err != nil || len(server) == 0 || subtle.ConstantTimeCompare(echoed[:], client[:]) != 1 {
+		return nil, false
+	}
+	return server, true
+}
+
+// Pad adds a PADDING option to the message's OPT record so the marshaled
+// message is a multiple of blockSize bytes (RFC 7830), replacing any
+// existing padding. The message must have a valid OPT record.
+func (m *Message) Pad(blockSize int) error {
+	if err := m.SetEDNSOption(EDNSOption{Code: EDNSOptionPadding}); err != nil {
+		return err
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if blockSize <= 0 {
+		return nil
+	}
+
+	n := (blockSize - len(data)%blockSize) % blockSize
+	return m.SetEDNSOption(EDNSOption{Code: EDNSOptionPadding, Data: make([]byte, n)})
+}
+
+// CheckEDNS validates the EDNS part of a query the way authoritative
+// servers do: malformed OPT records are ErrInvalidOPT (FORMERR) and
+// versions above EDNSVersion are ErrBadEDNSVersion (BADVERS). Unknown
+// options are ignored.
+func CheckEDNS(query *Message) error {
+	opt, err := query.OPT()
+	if err != nil {
+		return err
+	}
+	if opt != nil && uint8(opt.TTL>>16) > EDNSVersion {
+		return ErrBadEDNSVersion
+	}
+	return nil
+}
+
+// MaxResponseSize returns the largest UDP response allowed for a query: its
+// EDNS payload size (at least EDNSMinUDPSize) capped at serverMax, or
+// EDNSMinUDPSize without EDNS.
+func MaxResponseSize(query *Message, serverMax int) int {
+	size := int(query.GetEDNS0Size())
+	if size < EDNSMinUDPSize {
+		size = EDNSMinUDPSize
+	}
+	if serverMax > 0 && size > serverMax {
+		size = serverMax
+	}
+	return size
+}
+
+// addResponseEDNS adds an OPT record to a response if the query had one.
+// Like authoritative servers it advertises the server's own payload size
+// rather than echoing the client's, uses version 0, copies only the DO flag
+// and sends no options. The upper bits of extended rcodes go in the OPT
+// record.
+func (m *Message) addResponseEDNS(query *Message, udpSize uint16, rcode uint16) {
+	opt, err := query.OPT()
+	if err != nil || opt == nil {
+		return
+	}
+
+	if udpSize < EDNSMinUDPSize {
+		udpSize = EDNSMinUDPSize
+	}
+
+	ttl := uint32(rcode>>4) << 24
+	ttl |= opt.TTL & ednsFlagDO
+
+	m.Additional = append(m.Additional, RR{
+		Name:  Name{},
+		Type:  RRTypeOPT,
+		Class: udpSize,
+		TTL:   ttl,
+		Data:  []byte{},
+	})
+}
+
+// TruncateTo removes records from a response until it marshals to at most
+// size bytes, and returns it marshaled. Additional records other than the
+// OPT record go first, then whole RRsets from the end of the authority
+// section and then the answer section. The TC bit is set if answer or
+// authority records, or the glue of a referral, had to go (RFC 2181
+// section 9, RFC 9471), so resolvers retry over TCP; other additional
+// records are optional. A response that doesn't fit even without records
+// is returned as Truncate leaves it.
+func (m *Message) TruncateTo(size int) ([]byte, error) {
+	data, err := m.Marshal()
+	if err != nil || len(data) <= size {
+		return data, err
+	}
+
+	var opt []RR
+	for _, rr := range m.Additional {
+		if rr.Type == RRTypeOPT {
+			opt = append(opt, rr)
+		}
+	}
+	if len(opt) < len(m.Additional) {
+		m.Additional = opt
+		if len(m.Answer) == 0 && len(m.Authority) > 0 {
+			m.Flags |= 0x0200 // TC = 1, referral glue is required
+		}
+		if data, err = m.Marshal(); err != nil || len(data) <= size {
+			return data, err
+		}
+	}
+
+	for _, section := range []*[]RR{&m.Authority, &m.Answer} {
+		for len(*section) > 0 {
+			*section = dropLastRRset(*section)
+			m.Flags |= 0x0200 // TC = 1
+			if data, err = m.Marshal(); err != nil || len(data) <= size {
+				return data, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// dropLastRRset returns records without the RRset of its last record, the
+// records before it with the same name, type and class.
+func dropLastRRset(records []RR) []RR {
+	last := records[len(records)-1]
+	n := len(records) - 1
+	for n > 0 {
+		rr := records[n-1]
+		if rr.Type != last.Type || rr.Class != last.Class || !rr.Name.Equal(last.Name) {
+			break
+		}
+		n--
+	}
+	return records[:n]
+}
+
+// Truncate removes all records except the OPT record and sets the TC bit,
+// as servers do when a response doesn't fit the client's payload size.
+func (m *Message) Truncate() {
+	m.Answer = nil
+	m.Authority = nil
+
+	var additional []RR
+	for _, rr := range m.Additional {
+		if rr.Type == RRTypeOPT {
+			additional = append(additional, rr)
+		}
+	}
+	m.Additional = additional
+	m.Flags |= 0x0200 // TC = 1
+}
@@ -0,0 +1,354 @@
+package dns
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCheckEDNS(t *testing.T) {
+	opt := func(ttl uint32, data []byte) RR {
+		return RR{Name: Name{}, Type: RRTypeOPT, Class: 1232, TTL: ttl, Data: data}
+	}
+
+	tests := []struct {
+		name       string
+		additional []RR
+		wantErr    error
+	}{
+		{"no EDNS", nil, nil},
+		{"version 0", []RR{opt(0, nil)}, nil},
+		{"DO flag", []RR{opt(ednsFlagDO, nil)}, nil},
+		{"unknown option", []RR{opt(0, []byte{0xfd, 0xe9, 0, 1, 7})}, nil},
+		{"version 1", []RR{opt(1<<16, nil)}, ErrBadEDNSVersion},
+		{"two OPT records", []RR{opt(0, nil), opt(0, nil)}, ErrInvalidOPT},
+		{"non-root owner", []RR{{Name: mustParseName("example.com"), Type: RRTypeOPT, Class: 1232}}, ErrInvalidOPT},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := CreateQuery(mustParseName("example.com"), RRTypeTXT, 1)
+			query.Additional = tt.additional
+			if err := CheckEDNS(query); err != tt.wantErr {
+				t.Errorf("CheckEDNS() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponseEDNS(t *testing.T) {
+	domain := mustParseName("t.example.com")
+
+	tests := []struct {
+		name     string
+		udpSize  uint16
+		ttl      uint32
+		data     []byte
+		rcode    uint16
+		wantOPT  bool
+		wantTTL  uint32
+		wantSize uint16
+	}{
+		{name: "no EDNS", rcode: RcodeNameError},
+		{name: "own size", udpSize: 4096, rcode: RcodeNameError, wantOPT: true, wantSize: 1232},
+		{name: "DO echoed, Z cleared", udpSize: 512, ttl: ednsFlagDO | 0x0001, rcode: RcodeNoError, wantOPT: true, wantTTL: ednsFlagDO, wantSize: 1232},
+		{name: "options not echoed", udpSize: 1232, data: []byte{0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}, rcode: RcodeNoError, wantOPT: true, wantSize: 1232},
+		{name: "BADVERS", udpSize: 1232, ttl: 1 << 16, rcode: RcodeBadVersion, wantOPT: true, wantTTL: 1 << 24, wantSize: 1232},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := CreateQuery(mustParseName("x.t.example.com"), RRTypeTXT, 1)
+			if tt.udpSize > 0 {
+				query.Additional = []RR{{Name: Name{}, Type: RRTypeOPT, Class: tt.udpSize, TTL: tt.ttl, Data: tt.data}}
+			}
+
+			resp := CreateErrorResponse(query, domain, tt.rcode, 1232)
+			if resp.Rcode() != tt.rcode&0xf {
+				t.Errorf("Header rcode: got %d, want %d", resp.Rcode(), tt.rcode&0xf)
+			}
+
+			opt, err := resp.OPT()
+			if err != nil {
+				t.Fatalf("OPT() error = %v", err)
+			}
+			if (opt != nil) != tt.wantOPT {
+				t.Fatalf("OPT present: got %v, want %v", opt != nil, tt.wantOPT)
+			}
+			if opt == nil {
+				return
+			}
+			if opt.Class != tt.wantSize {
+				t.Errorf("UDP size: got %d, want %d", opt.Class, tt.wantSize)
+			}
+			if opt.TTL != tt.wantTTL {
+				t.Errorf("OPT TTL: got %#x, want %#x", opt.TTL, tt.wantTTL)
+			}
+			if len(opt.Data) != 0 {
+				t.Errorf("Options echoed: %x", opt.Data)
+			}
+		})
+	}
+
+	// Invalid OPT records are answered without EDNS
+	query := CreateQuery(mustParseName("x.t.example.com"), RRTypeTXT, 1)
+	query.AddEDNS0(1232)
+	query.AddEDNS0(1232)
+	if opt, _ := CreateErrorResponse(query, domain, RcodeFormatError, 1232).OPT(); opt != nil {
+		t.Error("OPT record in response to an invalid OPT")
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		udpSize   uint16
+		serverMax int
+		want      int
+	}{
+		{"no EDNS", 0, 1232, 512},
+		{"below minimum", 256, 1232, 512},
+		{"client smaller", 1024, 1232, 1024},
+		{"server smaller", 4096, 1232, 1232},
+		{"no server limit", 4096, 0, 4096},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := CreateQuery(mustParseName("example.com"), RRTypeTXT, 1)
+			if tt.udpSize > 0 {
+				query.AddEDNS0(tt.udpSize)
+			}
+			if got := MaxResponseSize(query, tt.serverMax); got != tt.want {
+				t.Errorf("MaxResponseSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	query := CreateQuery(mustParseName("x.t.example.com"), RRTypeTXT, 1)
+	query.AddEDNS0(1232)
+	resp, err := CreateTunnelResponse(query, mustParseName("t.example.com"), make([]byte, 100), 60, 1232)
+	if err != nil {
+		t.Fatalf("CreateTunnelResponse() error = %v", err)
+	}
+	resp.Authority = []RR{{Name: mustParseName("t.example.com"), Type: RRTypeTXT, Class: ClassIN, Data: []byte{0}}}
+
+	resp.Truncate()
+	if resp.Flags&0x0200 == 0 {
+		t.Error("TC bit not set")
+	}
+	if len(resp.Answer) != 0 || len(resp.Authority) != 0 {
+		t.Errorf("Records kept: %d answers, %d authority", len(resp.Answer), len(resp.Authority))
+	}
+	if opt, _ := resp.OPT(); opt == nil {
+		t.Error("OPT record removed")
+	}
+
+	data, err := resp.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if _, err := ParseMessage(data); err != nil {
+		t.Errorf("ParseMessage() error = %v", err)
+	}
+}
+
+func TestTruncateTo(t *testing.T) {
+	name := mustParseName("t.example.com")
+	ns := mustParseName("ns1.t.example.com")
+	txt := func(n int) RR {
+		return RR{Name: name, Type: RRTypeTXT, Class: ClassIN, TTL: 60, Data: EncodeTXTData(make([]byte, n))}
+	}
+	glue := RR{Name: ns, Type: RRTypeA, Class: ClassIN, TTL: 60, Data: []byte{192, 0, 2, 53}}
+	nsRR := RR{Name: name, Type: RRTypeNS, Class: ClassIN, TTL: 60, Data: EncodeNameData(ns)}
+	mx := RR{Name: name, Type: RRTypeMX, Class: ClassIN, TTL: 60, Data: make([]byte, 250)}
+
+	tests := []struct {
+		name           string
+		answer         []RR
+		authority      []RR
+		additional     []RR
+		size           int
+		wantTC         bool
+		wantAnswer     int
+		wantAuthority  int
+		wantAdditional int
+	}{
+		{"fits", []RR{txt(100)}, nil, []RR{glue}, 512, false, 1, 0, 2},
+		{"optional additional dropped", []RR{txt(400)}, nil, []RR{glue, glue, glue, glue}, 512, false, 1, 0, 1},
+		{"referral glue dropped", nil, []RR{nsRR}, []RR{txt(500)}, 512, true, 0, 1, 1},
+		{"authority dropped first", []RR{txt(200)}, []RR{txt(200), txt(200)}, nil, 512, true, 1, 0, 1},
+		{"last RRset dropped whole", []RR{mx, txt(100), txt(100)}, nil, nil, 512, true, 1, 0, 1},
+		{"nothing fits", []RR{txt(400), txt(400)}, nil, nil, 40, true, 0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := CreateQuery(name, RRTypeTXT, 1)
+			query.AddEDNS0(1232)
+			resp := CreateResponse(query)
+			resp.Answer = tt.answer
+			resp.Authority = tt.authority
+			resp.Additional = append(tt.additional, RR{Type: RRTypeOPT, Class: 1232})
+
+			data, err := resp.TruncateTo(tt.size)
+			if err != nil {
+				t.Fatalf("TruncateTo() error = %v", err)
+			}
+			if tt.size >= 512 && len(data) > tt.size {
+				t.Errorf("Size: got %d bytes, want at most %d", len(data), tt.size)
+			}
+
+			got, err := ParseMessage(data)
+			if err != nil {
+				t.Fatalf("ParseMessage() error = %v", err)
+			}
+			if tc := got.Flags&0x0200 != 0; tc != tt.wantTC {
+				t.Errorf("TC: got %v, want %v", tc, tt.wantTC)
+			}
+			if len(got.Answer) != tt.wantAnswer || len(got.Authority) != tt.wantAuthority || len(got.Additional) != tt.wantAdditional {
+				t.Errorf("Sections: got %d/%d/%d records, want %d/%d/%d", len(got.Answer), len(got.Authority), len(got.Additional),
+					tt.wantAnswer, tt.wantAuthority, tt.wantAdditional)
+			}
+			if opt, _ := got.OPT(); opt == nil {
+				t.Error("OPT record removed")
+			}
+		})
+	}
+}
+
+func TestEDNSOptions(t *testing.T) {
+	options := []EDNSOption{
+		{Code: EDNSOptionCookie, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{Code: EDNSOptionPadding, Data: []byte{}},
+	}
+	got, err := ParseEDNSOptions(EncodeEDNSOptions(options))
+	if err != nil || !reflect.DeepEqual(got, options) {
+		t.Fatalf("Round trip: got %+v, %v", got, err)
+	}
+	if _, err := ParseEDNSOptions([]byte{0, 10, 0, 8, 1}); err != ErrInvalidEDNSOption {
+		t.Errorf("Truncated option: got %v", err)
+	}
+
+	query := CreateQuery(mustParseName("example.com"), RRTypeA, 1)
+	query.AddEDNS0(4096)
+	query.SetEDNS0(1232, true, options[0])
+	if opt, _ := query.OPT(); opt == nil || opt.Class != 1232 {
+		t.Fatalf("SetEDNS0() did not replace the OPT record")
+	}
+	if !query.DO() {
+		t.Error("DO flag not set")
+	}
+
+	// SetEDNSOption replaces options with the same code
+	if err := query.SetEDNSOption(EDNSOption{Code: EDNSOptionCookie, Data: []byte{9, 9, 9, 9, 9, 9, 9, 9}}); err != nil {
+		t.Fatalf("SetEDNSOption() error = %v", err)
+	}
+	if data, ok := query.GetEDNSOption(EDNSOptionCookie); !ok || data[0] != 9 {
+		t.Errorf("Cookie: got %x", data)
+	}
+	opt, _ := query.OPT()
+	if all, _ := ParseEDNSOptions(opt.Data); len(all) != 1 {
+		t.Errorf("Options: got %d, want 1", len(all))
+	}
+
+	noEDNS := CreateQuery(mustParseName("example.com"), RRTypeA, 1)
+	if err := noEDNS.SetEDNSOption(options[0]); err != ErrInvalidOPT {
+		t.Errorf("SetEDNSOption() without OPT: got %v", err)
+	}
+}
+
+func TestExtendedRcode(t *testing.T) {
+	query := CreateQuery(mustParseName("x.t.example.com"), RRTypeTXT, 1)
+	query.AddEDNS0(1232)
+	resp := CreateErrorResponse(query, mustParseName("t.example.com"), RcodeBadVersion, 1232)
+	if resp.Rcode() != 0 {
+		t.Errorf("Header rcode: got %d, want 0", resp.Rcode())
+	}
+	if resp.ExtendedRcode() != RcodeBadVersion {
+		t.Errorf("ExtendedRcode() = %d, want %d", resp.ExtendedRcode(), RcodeBadVersion)
+	}
+}
+
+func TestExtendedError(t *testing.T) {
+	query := CreateQuery(mustParseName("x.t.example.com"), RRTypeTXT, 1)
+	query.AddEDNS0(1232)
+	resp := CreateErrorResponse(query, mustParseName("t.example.com"), RcodeServerFail, 1232)
+	if _, _, ok := resp.ExtendedError(); ok {
+		t.Error("ExtendedError() found an option in a response without one")
+	}
+
+	if err := resp.SetEDNSOption(NewExtendedErrorOption(EDENotReady, "maintenance")); err != nil {
+		t.Fatalf("SetEDNSOption() error = %v", err)
+	}
+	data, err := resp.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	code, text, ok := parsed.ExtendedError()
+	if !ok || code != EDENotReady || text != "maintenance" {
+		t.Errorf("ExtendedError() = %d %q %v, want %d \"maintenance\" true", code, text, ok, EDENotReady)
+	}
+}
+
+func TestCookieOption(t *testing.T) {
+	client := [EDNSClientCookieSize]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	server := bytes.Repeat([]byte{0xaa}, 16)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"client only", client[:], false},
+		{"client and server", NewCookieOption(client, server).Data, false},
+		{"short client", client[:5], true},
+		{"short server", append(client[:], 1, 2, 3), true},
+		{"long server", append(client[:], make([]byte, 33)...), true},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParseCookieOption(tt.data); (err != nil) != tt.wantErr {
+			t.Errorf("%s: ParseCookieOption() error = %v", tt.name, err)
+		}
+	}
+
+	resp := CreateQuery(mustParseName("example.com"), RRTypeA, 1)
+	resp.SetEDNS0(1232, false, NewCookieOption(client, server))
+	if got, ok := MatchCookie(resp, client); !ok || !bytes.Equal(got, server) {
+		t.Errorf("MatchCookie() = %x, %v", got, ok)
+	}
+	if _, ok := MatchCookie(resp, [EDNSClientCookieSize]byte{}); ok {
+		t.Error("MatchCookie() matched another client cookie")
+	}
+}
+
+func TestPad(t *testing.T) {
+	for _, name := range []string{"a.example.com", "a-much-longer-name.with.several.labels.example.com"} {
+		query := CreateQuery(mustParseName(name), RRTypeA, 1)
+		query.SetEDNS0(1232, false, EDNSOption{Code: EDNSOptionCookie, Data: make([]byte, 8)})
+
+		for _, block := range []int{QueryPaddingBlock, ResponsePaddingBlock} {
+			if err := query.Pad(block); err != nil {
+				t.Fatalf("Pad() error = %v", err)
+			}
+			data, err := query.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if len(data)%block != 0 {
+				t.Errorf("%s: padded length %d not a multiple of %d", name, len(data), block)
+			}
+		}
+	}
+
+	noEDNS := CreateQuery(mustParseName("example.com"), RRTypeA, 1)
+	if err := noEDNS.Pad(QueryPaddingBlock); err != ErrInvalidOPT {
+		t.Errorf("Pad() without OPT: got %v", err)
+	}
+}
@@ -12,6 +12,9 @@ import (
 
 // Encoding constants
 const (
+	// KeyID size
+	KeyIDSize = 2
+
 	// ClientID size
 	ClientIDSize = 8
 
@@ -27,13 +30,19 @@ const (
 )
 
 var (
-	// base32Encoding is base32 without padding, lowercase
-	base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+	// base32Encoding is base32 without padding in lowercase. Resolvers
+	// may change the case of query names, so names are lowercased before
+	// decoding and no information is carried in case.
+	base32Encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
 
 	ErrPayloadTooLong = errors.New("payload too long to encode in DNS name")
 	ErrInvalidPayload = errors.New("invalid encoded payload")
 )
 
+// KeyID identifies the key a query is encrypted with. ID 0 selects the
+// server's shared key; other IDs select per-client keys.
+type KeyID uint16
+
 // ClientID represents an 8-byte client identifier.
 type ClientID [ClientIDSize]byte
 
@@ -49,34 +58,33 @@ func NewClientID() ClientID {
 // DNSNameCapacity calculates the available bytes for encoded data
 // given a domain suffix.
 func DNSNameCapacity(domain Name) int {
-	// Maximum DNS name is 255 bytes
-	capacity := 255 - 1 // null terminator
-
-	// Subtract domain labels and their length bytes
-	for _, label := range domain {
-		capacity -= len(label) + 1
-	}
-
-	// Each label can hold up to 63 bytes, but needs 64 bytes to encode
-	// (63 bytes data + 1 byte length prefix)
-	capacity = capacity * 63 / 64
-
-	// Base32 expands 5 bytes to 8
-	capacity = capacity * 5 / 8
-
-	return capacity
+	return CodecBase32.NameCapacity(domain)
 }
 
 // EncodePayload encodes a payload into a DNS query name.
-// Format: [ClientID][padding][length-prefixed data]
+// Format: [KeyID][ClientID][padding][length-prefixed data]
 // The result is base32 encoded and split into DNS labels.
-func EncodePayload(payload []byte, clientID ClientID, domain Name) (Name, error) {
-	capacity := DNSNameCapacity(domain)
+func EncodePayload(payload []byte, keyID KeyID, clientID ClientID, domain Name) (Name, error) {
+	return EncodeShapedPayload(payload, keyID, clientID, domain, StealthOff)
+}
+
+// EncodeShapedPayload is like EncodePayload but shapes the labels for the
+// given stealth level: label lengths vary and dictionary words are
+// interleaved as far as the space left in the name allows.
+func EncodeShapedPayload(payload []byte, keyID KeyID, clientID ClientID, domain Name, level StealthLevel) (Name, error) {
+	return CodecBase32.Encode(payload, keyID, clientID, domain, level)
+}
 
-	// Build the raw data: ClientID + padding + length-prefixed payload
+// Encode is like EncodeShapedPayload but writes the name in the codec.
+// Names decode the same way whatever codec they were written in.
+func (c Codec) Encode(payload []byte, keyID KeyID, clientID ClientID, domain Name, level StealthLevel) (Name, error) {
+	capacity := c.NameCapacity(domain)
+
+	// Build the raw data: KeyID + ClientID + padding + length-prefixed payload
 	var raw bytes.Buffer
 
-	// Write ClientID
+	// Write KeyID and ClientID
+	_ = binary.Write(&raw, binary.BigEndian, uint16(keyID))
 	raw.Write(clientID[:])
 
 	// Calculate and write padding
@@ -114,19 +122,15 @@ func EncodePayload(payload []byte, clientID ClientID, domain Name) (Name, error)
 		return nil, ErrPayloadTooLong
 	}
 
-	// Base32 encode
-	encoded := make([]byte, base32Encoding.EncodedLen(raw.Len()))
-	base32Encoding.Encode(encoded, raw.Bytes())
+	encoded := c.encode(raw.Bytes())
 
-	// Convert to lowercase
-	for i, b := range encoded {
-		if b >= 'A' && b <= 'Z' {
-			encoded[i] = b + 32
-		}
+	// Split into DNS labels (max 63 bytes each), within the space the
+	// domain leaves in a 255-byte name
+	room := 255 - 1
+	for _, label := range domain {
+		room -= len(label) + 1
 	}
-
-	// Split into DNS labels (max 63 bytes each)
-	labels := splitLabels(encoded, MaxLabelLength)
+	labels := shapeLabels(encoded, room, level)
 
 	// Append domain
 	labels = append(labels, domain...)
@@ -134,6 +138,25 @@ func EncodePayload(payload []byte, clientID ClientID, domain Name) (Name, error)
 	return Name(labels), nil
 }
 
+// RandomizeCase returns a copy of name with each letter in random case
+// (DNS 0x20). Base32 tunnel names decode the same in any case; names in
+// other codecs don't.
+func RandomizeCase(name Name) Name {
+	out := make(Name, len(name))
+	for i, label := range name {
+		bits := make([]byte, len(label))
+		_, _ = rand.Read(bits)
+
+		out[i] = bytes.Clone(label)
+		for j, b := range out[i] {
+			if b |= 0x20; b >= 'a' && b <= 'z' {
+				out[i][j] = b &^ (bits[j] & 1 << 5)
+			}
+		}
+	}
+	return out
+}
+
 // splitLabels splits data into chunks of at most maxLen bytes.
 func splitLabels(data []byte, maxLen int) [][]byte {
 	var labels [][]byte
@@ -149,33 +172,31 @@ func splitLabels(data []byte, maxLen int) [][]byte {
 }
 
 // DecodePayload decodes a DNS name back into the original payload.
-// Returns the ClientID and the payload data.
-func DecodePayload(name Name, domain Name) (ClientID, []byte, error) {
+// Returns the KeyID, ClientID and the payload data.
+func DecodePayload(name Name, domain Name) (KeyID, ClientID, []byte, error) {
+	var keyID KeyID
 	var clientID ClientID
 
 	// Trim domain suffix
 	prefix, ok := name.TrimSuffix(domain)
 	if !ok {
-		return clientID, nil, ErrInvalidPayload
+		return keyID, clientID, nil, ErrInvalidPayload
 	}
 
-	// Join labels and uppercase for base32 decoding
-	encoded := bytes.ToUpper(bytes.Join(prefix, nil))
-
-	// Base32 decode
-	decoded := make([]byte, base32Encoding.DecodedLen(len(encoded)))
-	n, err := base32Encoding.Decode(decoded, encoded)
+	// Join data labels, skipping dictionary words added by shaping, and
+	// decode them
+	decoded, err := decodeLabels(bytes.Join(dataLabels(prefix), nil))
 	if err != nil {
-		return clientID, nil, fmt.Errorf("base32 decode failed: %w", err)
+		return keyID, clientID, nil, err
 	}
-	decoded = decoded[:n]
 
-	// Read ClientID
-	if len(decoded) < ClientIDSize {
-		return clientID, nil, ErrInvalidPayload
+	// Read KeyID and ClientID
+	if len(decoded) < KeyIDSize+ClientIDSize {
+		return keyID, clientID, nil, ErrInvalidPayload
 	}
-	copy(clientID[:], decoded[:ClientIDSize])
-	decoded = decoded[ClientIDSize:]
+	keyID = KeyID(binary.BigEndian.Uint16(decoded))
+	copy(clientID[:], decoded[KeyIDSize:KeyIDSize+ClientIDSize])
+	decoded = decoded[KeyIDSize+ClientIDSize:]
 
 	// Read packets (skip padding)
 	var payload []byte
@@ -187,27 +208,27 @@ func DecodePayload(name Name, domain Name) (ClientID, []byte, error) {
 			break
 		}
 		if err != nil {
-			return clientID, nil, err
+			return keyID, clientID, nil, err
 		}
 
 		if prefix >= PaddingPrefixBase {
 			// Padding - skip it
 			paddingLen := int(prefix - PaddingPrefixBase)
 			if _, err := io.CopyN(io.Discard, r, int64(paddingLen)); err != nil {
-				return clientID, nil, err
+				return keyID, clientID, nil, err
 			}
 		} else {
 			// Data packet
 			dataLen := int(prefix)
 			data := make([]byte, dataLen)
 			if _, err := io.ReadFull(r, data); err != nil {
-				return clientID, nil, err
+				return keyID, clientID, nil, err
 			}
 			payload = append(payload, data...)
 		}
 	}
 
-	return clientID, payload, nil
+	return keyID, clientID, payload, nil
 }
 
 // EncodeResponse encodes response data into TXT record format.
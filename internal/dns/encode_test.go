@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -65,7 +66,7 @@ func TestEncodeDecodePayload(t *testing.T) {
 			}
 
 			// Encode
-			encodedName, err := EncodePayload(tt.payload, clientID, domain)
+			encodedName, err := EncodePayload(tt.payload, 0x1234, clientID, domain)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("EncodePayload() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -79,12 +80,17 @@ func TestEncodeDecodePayload(t *testing.T) {
 			}
 
 			// Decode
-			decodedClientID, decodedPayload, err := DecodePayload(encodedName, domain)
+			decodedKeyID, decodedClientID, decodedPayload, err := DecodePayload(encodedName, domain)
 			if err != nil {
 				t.Errorf("DecodePayload() error = %v", err)
 				return
 			}
 
+			// Verify key ID matches
+			if decodedKeyID != 0x1234 {
+				t.Errorf("KeyID mismatch: got %#x, want %#x", decodedKeyID, 0x1234)
+			}
+
 			// Verify client ID matches
 			if decodedClientID != clientID {
 				t.Errorf("ClientID mismatch: got %x, want %x", decodedClientID, clientID)
@@ -111,7 +117,7 @@ func TestEncodePayloadTooLong(t *testing.T) {
 	clientID := NewClientID()
 	domain, _ := ParseName("t.example.com")
 
-	_, err := EncodePayload(payload, clientID, domain)
+	_, err := EncodePayload(payload, 0, clientID, domain)
 	if err == nil {
 		t.Error("Expected error for payload that's too long")
 	}
@@ -225,13 +231,13 @@ func TestEncodeDecodeRoundTrip(t *testing.T) {
 			}
 
 			// Encode
-			encoded, err := EncodePayload(payload, clientID, domain)
+			encoded, err := EncodePayload(payload, 0, clientID, domain)
 			if err != nil {
 				t.Fatalf("EncodePayload failed: %v", err)
 			}
 
 			// Decode
-			decodedClientID, decodedPayload, err := DecodePayload(encoded, domain)
+			_, decodedClientID, decodedPayload, err := DecodePayload(encoded, domain)
 			if err != nil {
 				t.Fatalf("DecodePayload failed: %v", err)
 			}
@@ -253,3 +259,65 @@ func TestEncodeDecodeRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodePayloadMixedCase(t *testing.T) {
+	domain, err := ParseName("T.Example.com")
+	if err != nil {
+		t.Fatalf("ParseName failed: %v", err)
+	}
+	payload := []byte("resolvers may change the case of any letter")
+	clientID := NewClientID()
+
+	// Resolvers may lowercase, uppercase or randomize the case of names
+	mangles := map[string]func(Name) Name{
+		"upper": func(n Name) Name {
+			out := make(Name, len(n))
+			for i, label := range n {
+				out[i] = bytes.ToUpper(label)
+			}
+			return out
+		},
+		"random": RandomizeCase,
+	}
+	for _, level := range []StealthLevel{StealthOff, StealthHigh} {
+		for mangling, mangle := range mangles {
+			name, err := EncodeShapedPayload(payload, 7, clientID, domain, level)
+			if err != nil {
+				t.Fatalf("EncodeShapedPayload failed: %v", err)
+			}
+			keyID, gotClientID, got, err := DecodePayload(mangle(name), domain)
+			if err != nil || keyID != 7 || gotClientID != clientID || !bytes.Equal(got, payload) {
+				t.Errorf("%s, %s case: decoded %d, %x, %q, %v", level, mangling, keyID, gotClientID, got, err)
+			}
+		}
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	name, err := ParseName("abcdefghijklmnopqrstuvwxyz-0123456789.t.example.com")
+	if err != nil {
+		t.Fatalf("ParseName failed: %v", err)
+	}
+
+	// Only the case of letters changes, and both cases show up
+	upper := 0
+	for range 10 {
+		randomized := RandomizeCase(name)
+		if !randomized.Equal(name) {
+			t.Fatalf("RandomizeCase(%s) = %s", name, randomized)
+		}
+		for _, label := range randomized {
+			for _, b := range label {
+				if b >= 'A' && b <= 'Z' {
+					upper++
+				}
+			}
+		}
+	}
+	if letters := 10 * 37; upper == 0 || upper == letters {
+		t.Errorf("%d of %d letters uppercased, want some", upper, letters)
+	}
+	if name.String() != "abcdefghijklmnopqrstuvwxyz-0123456789.t.example.com" {
+		t.Errorf("RandomizeCase modified its argument: %s", name)
+	}
+}
@@ -0,0 +1,378 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Fragmentation constants
+const (
+	// FragmentHeaderSize is the size of the fragment header.
+	// Format: [flags (1 byte)][message ID (2 bytes)][seq (1 byte)][total (1 byte)]
+	FragmentHeaderSize = 5
+
+	// MaxFragments is the maximum number of fragments per message
+	MaxFragments = 255
+
+	// FragmentFlagFetch marks a query that requests a stored response fragment
+	FragmentFlagFetch byte = 0x01
+
+	// FragmentFlagHandshake marks a query message carrying a session
+	// handshake instead of a DNS query
+	FragmentFlagHandshake byte = 0x02
+
+	// FragmentFlagSession marks a query message encrypted with session keys
+	FragmentFlagSession byte = 0x04
+
+	// FragmentFlagResume marks a session message resuming the session of
+	// a resumption ticket sent before it. It combines the handshake and
+	// session flags, which no other message sets together.
+	FragmentFlagResume = FragmentFlagHandshake | FragmentFlagSession
+
+	// FragmentFlagStream marks a query message carrying a stream frame
+	// instead of a DNS query
+	FragmentFlagStream byte = 0x08
+
+	// FragmentFlagPoll marks a query message polling for downstream data
+	// queued for the client
+	FragmentFlagPoll byte = 0x10
+
+	// FragmentFlagProbe marks a single-fragment diagnostic message asking
+	// for a reply of a given size
+	FragmentFlagProbe byte = 0x20
+
+	// FragmentFlagCompress marks a query message whose reply may be
+	// compressed. Peers that don't know it ignore it, so clients set it
+	// until a compressed reply shows the server decompresses too.
+	FragmentFlagCompress byte = 0x40
+
+	// FragmentFlagCompressed marks a query or response message whose
+	// plaintext was compressed with Compress before encryption
+	FragmentFlagCompressed byte = 0x80
+
+	// DefaultReassemblyTimeout is how long incomplete messages are kept
+	DefaultReassemblyTimeout = 10 * time.Second
+
+	// DefaultMaxReassemblyBuffers bounds the number of incomplete messages
+	DefaultMaxReassemblyBuffers = 4096
+)
+
+var (
+	ErrFragmentTooShort   = errors.New("fragment too short")
+	ErrInvalidFragment    = errors.New("invalid fragment")
+	ErrTooManyFragments   = errors.New("payload needs too many fragments")
+	ErrFragmentMismatch   = errors.New("fragment does not match message")
+	ErrReassemblyOverflow = errors.New("too many incomplete messages")
+)
+
+// Fragment is a piece of a tunnel message that fits in a single DNS query
+// name or TXT answer. A fragment with Total == 0 carries no data and
+// acknowledges receipt of a query fragment.
+type Fragment struct {
+	Flags byte
+	ID    uint16
+	Seq   uint8
+	Total uint8
+	Data  []byte
+}
+
+// IsFetch returns true if the fragment requests a stored response fragment.
+func (f *Fragment) IsFetch() bool {
+	return f.Flags&FragmentFlagFetch != 0
+}
+
+// IsHandshake returns true if the fragment belongs to a handshake message.
+func (f *Fragment) IsHandshake() bool {
+	return f.Flags&FragmentFlagHandshake != 0
+}
+
+// IsSession returns true if the fragment belongs to a message encrypted
+// with session keys.
+func (f *Fragment) IsSession() bool {
+	return f.Flags&FragmentFlagSession != 0
+}
+
+// IsResume returns true if the fragment belongs to a message resuming a
+// session from a ticket.
+func (f *Fragment) IsResume() bool {
+	return f.Flags&FragmentFlagResume == FragmentFlagResume
+}
+
+// IsStream returns true if the fragment belongs to a stream frame.
+func (f *Fragment) IsStream() bool {
+	return f.Flags&FragmentFlagStream != 0
+}
+
+// IsPoll returns true if the fragment belongs to a poll for queued data.
+func (f *Fragment) IsPoll() bool {
+	return f.Flags&FragmentFlagPoll != 0
+}
+
+// IsProbe returns true if the fragment is a diagnostic probe.
+func (f *Fragment) IsProbe() bool {
+	return f.Flags&FragmentFlagProbe != 0
+}
+
+// IsCompressed returns true if the fragment belongs to a message whose
+// plaintext is compressed.
+func (f *Fragment) IsCompressed() bool {
+	return f.Flags&FragmentFlagCompressed != 0
+}
+
+// IsAck returns true if the fragment is an acknowledgement without data.
+func (f *Fragment) IsAck() bool {
+	return !f.IsFetch() && f.Total == 0
+}
+
+// Marshal converts the fragment to wire format.
+func (f *Fragment) Marshal() []byte {
+	buf := make([]byte, FragmentHeaderSize+len(f.Data))
+	buf[0] = f.Flags
+	binary.BigEndian.PutUint16(buf[1:3], f.ID)
+	buf[3] = f.Seq
+	buf[4] = f.Total
+	copy(buf[FragmentHeaderSize:], f.Data)
+	return buf
+}
+
+// ParseFragment parses a fragment from wire format.
+func ParseFragment(data []byte) (*Fragment, error) {
+	if len(data) < FragmentHeaderSize {
+		return nil, ErrFragmentTooShort
+	}
+
+	f := &Fragment{
+		Flags: data[0],
+		ID:    binary.BigEndian.Uint16(data[1:3]),
+		Seq:   data[3],
+		Total: data[4],
+		Data:  data[FragmentHeaderSize:],
+	}
+
+	// Data fragments must have a valid position within the message
+	if !f.IsFetch() && f.Total > 0 && f.Seq >= f.Total {
+		return nil, ErrInvalidFragment
+	}
+
+	return f, nil
+}
+
+// NewAckFragment creates an acknowledgement for a message ID.
+func NewAckFragment(id uint16) *Fragment {
+	return &Fragment{ID: id}
+}
+
+// NewFetchFragment creates a request for response fragment seq of a message.
+func NewFetchFragment(id uint16, seq uint8) *Fragment {
+	return &Fragment{Flags: FragmentFlagFetch, ID: id, Seq: seq}
+}
+
+// SplitPayload splits a payload into fragments carrying at most chunkSize
+// bytes of data each. An empty payload yields a single empty fragment.
+func SplitPayload(payload []byte, id uint16, chunkSize int) ([]*Fragment, error) {
+	return SplitPayloadFlags(payload, id, 0, chunkSize)
+}
+
+// SplitPayloadFlags is like SplitPayload but sets flags on every fragment.
+func SplitPayloadFlags(payload []byte, id uint16, flags byte, chunkSize int) ([]*Fragment, error) {
+	if chunkSize <= 0 {
+		return nil, ErrPayloadTooLong
+	}
+
+	total := (len(payload) + chunkSize - 1) / chunkSize
+	if total == 0 {
+		total = 1
+	}
+	if total > MaxFragments {
+		return nil, ErrTooManyFragments
+	}
+
+	fragments := make([]*Fragment, 0, total)
+	for seq := 0; seq < total; seq++ {
+		start := seq * chunkSize
+		end := start + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		fragments = append(fragments, &Fragment{
+			Flags: flags,
+			ID:    id,
+			Seq:   uint8(seq),
+			Total: uint8(total),
+			Data:  payload[start:end],
+		})
+	}
+
+	return fragments, nil
+}
+
+// MaxPayloadSize returns the largest payload EncodePayload accepts for the
+// given domain, accounting for the KeyID, ClientID and maximum padding.
+func MaxPayloadSize(domain Name) int {
+	return CodecBase32.MaxPayloadSize(domain)
+}
+
+// QueryFragmentSize returns the number of data bytes a single query
+// fragment can carry for the given domain.
+func QueryFragmentSize(domain Name) int {
+	return CodecBase32.QueryFragmentSize(domain)
+}
+
+// ResponseFragmentSize returns the number of data bytes a single TXT
+// response fragment can carry within maxSize bytes. It assumes a
+// maximum-length question name and an echoed OPT record, since any query
+// for the same message (fetches, duplicates) may carry the fragment.
+func ResponseFragmentSize(maxSize int) int {
+	// Header
+	size := maxSize - 12
+
+	// Question section (the answer name is compressed to a pointer)
+	size -= MaxNameLength + 4
+
+	// Answer RR: name pointer, type, class, TTL, rdlength
+	size -= 2 + 10
+
+	// Echoed OPT record
+	size -= 11
+
+	// TXT character-string length bytes
+	size -= (size + 255) / 256
+
+	size -= FragmentHeaderSize
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// reassemblyKey identifies a message being reassembled.
+type reassemblyKey struct {
+	clientID ClientID
+	id       uint16
+}
+
+// reassemblyBuffer holds the received fragments of a message.
+type reassemblyBuffer struct {
+	chunks   [][]byte
+	received int
+	size     int
+	created  time.Time
+}
+
+// Reassembler collects fragments per ClientID and message ID and returns
+// complete messages once all fragments have arrived.
+type Reassembler struct {
+	buffers    map[reassemblyKey]*reassemblyBuffer
+	timeout    time.Duration
+	maxBuffers int
+	lastSweep  time.Time
+	mu         sync.Mutex
+}
+
+// NewReassembler creates a new reassembler. Incomplete messages older than
+// timeout are discarded, and at most maxBuffers messages are tracked.
+func NewReassembler(timeout time.Duration, maxBuffers int) *Reassembler {
+	return &Reassembler{
+		buffers:    make(map[reassemblyKey]*reassemblyBuffer),
+		timeout:    timeout,
+		maxBuffers: maxBuffers,
+	}
+}
+
+// Add adds a fragment. It returns the reassembled payload and true once the
+// final missing fragment has been added. Duplicate fragments are ignored.
+func (r *Reassembler) Add(clientID ClientID, f *Fragment) ([]byte, bool, error) {
+	if f.IsFetch() || f.Total == 0 || f.Seq >= f.Total {
+		return nil, false, ErrInvalidFragment
+	}
+
+	// Fast path for unfragmented messages
+	if f.Total == 1 {
+		return f.Data, true, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	key := reassemblyKey{clientID: clientID, id: f.ID}
+
+	buf, ok := r.buffers[key]
+	if ok && now.Sub(buf.created) > r.timeout {
+		delete(r.buffers, key)
+		ok = false
+	}
+
+	if !ok {
+		if len(r.buffers) >= r.maxBuffers || now.Sub(r.lastSweep) > r.timeout/2 {
+			r.expire(now)
+		}
+		if len(r.buffers) >= r.maxBuffers {
+			return nil, false, ErrReassemblyOverflow
+		}
+		buf = &reassemblyBuffer{
+			chunks:  make([][]byte, f.Total),
+			created: now,
+		}
+		r.buffers[key] = buf
+	}
+
+	if len(buf.chunks) != int(f.Total) {
+		return nil, false, ErrFragmentMismatch
+	}
+
+	// Ignore duplicates (e.g. the same query arriving via several resolvers)
+	if buf.chunks[f.Seq] != nil {
+		return nil, false, nil
+	}
+
+	chunk := make([]byte, len(f.Data))
+	copy(chunk, f.Data)
+	buf.chunks[f.Seq] = chunk
+	buf.received++
+	buf.size += len(chunk)
+
+	if buf.received < len(buf.chunks) {
+		return nil, false, nil
+	}
+
+	delete(r.buffers, key)
+
+	payload := make([]byte, 0, buf.size)
+	for _, c := range buf.chunks {
+		payload = append(payload, c...)
+	}
+	return payload, true, nil
+}
+
+// Pending returns the number of incomplete messages.
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buffers)
+}
+
+// Size returns the number of fragment bytes held for incomplete messages.
+func (r *Reassembler) Size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size := 0
+	for _, buf := range r.buffers {
+		size += buf.size
+	}
+	return size
+}
+
+// expire removes incomplete messages older than the timeout.
+// Must be called with r.mu held.
+func (r *Reassembler) expire(now time.Time) {
+	for key, buf := range r.buffers {
+		if now.Sub(buf.created) > r.timeout {
+			delete(r.buffers, key)
+		}
+	}
+	r.lastSweep = now
+}
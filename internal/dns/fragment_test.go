@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFragmentMarshalParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment Fragment
+	}{
+		{
+			name:     "data fragment",
+			fragment: Fragment{ID: 0x1234, Seq: 1, Total: 3, Data: []byte{1, 2, 3}},
+		},
+		{
+			name:     "ack",
+			fragment: *NewAckFragment(0xbeef),
+		},
+		{
+			name:     "fetch",
+			fragment: *NewFetchFragment(0x0001, 7),
+		},
+		{
+			name:     "session",
+			fragment: Fragment{Flags: FragmentFlagSession, ID: 9, Seq: 0, Total: 1, Data: []byte{4}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.fragment.Marshal()
+			if len(data) != FragmentHeaderSize+len(tt.fragment.Data) {
+				t.Errorf("Marshaled length: got %d, want %d", len(data), FragmentHeaderSize+len(tt.fragment.Data))
+			}
+
+			got, err := ParseFragment(data)
+			if err != nil {
+				t.Fatalf("ParseFragment() error = %v", err)
+			}
+
+			if got.Flags != tt.fragment.Flags || got.ID != tt.fragment.ID ||
+				got.Seq != tt.fragment.Seq || got.Total != tt.fragment.Total {
+				t.Errorf("Header mismatch: got %+v, want %+v", got, tt.fragment)
+			}
+			if !bytes.Equal(got.Data, tt.fragment.Data) {
+				t.Errorf("Data mismatch: got %x, want %x", got.Data, tt.fragment.Data)
+			}
+			if got.IsAck() != tt.fragment.IsAck() || got.IsFetch() != tt.fragment.IsFetch() ||
+				got.IsSession() != tt.fragment.IsSession() || got.IsHandshake() != tt.fragment.IsHandshake() {
+				t.Errorf("Kind mismatch: ack=%v fetch=%v session=%v", got.IsAck(), got.IsFetch(), got.IsSession())
+			}
+		})
+	}
+}
+
+func TestParseFragmentInvalid(t *testing.T) {
+	if _, err := ParseFragment([]byte{0, 1, 2}); err != ErrFragmentTooShort {
+		t.Errorf("Short fragment: got %v, want %v", err, ErrFragmentTooShort)
+	}
+
+	// Seq beyond total
+	if _, err := ParseFragment([]byte{0, 0, 1, 3, 3}); err != ErrInvalidFragment {
+		t.Errorf("Seq >= total: got %v, want %v", err, ErrInvalidFragment)
+	}
+}
+
+func TestSplitPayload(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize int
+		wantTotal int
+		wantErr   bool
+	}{
+		{name: "empty", size: 0, chunkSize: 10, wantTotal: 1},
+		{name: "exact", size: 20, chunkSize: 10, wantTotal: 2},
+		{name: "remainder", size: 21, chunkSize: 10, wantTotal: 3},
+		{name: "too many", size: MaxFragments*10 + 1, chunkSize: 10, wantErr: true},
+		{name: "zero chunk", size: 10, chunkSize: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, tt.size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+
+			fragments, err := SplitPayload(payload, 42, tt.chunkSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SplitPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(fragments) != tt.wantTotal {
+				t.Fatalf("Fragment count: got %d, want %d", len(fragments), tt.wantTotal)
+			}
+
+			var joined []byte
+			for i, f := range fragments {
+				if f.ID != 42 || int(f.Seq) != i || int(f.Total) != tt.wantTotal {
+					t.Errorf("Fragment %d header: got %+v", i, f)
+				}
+				if len(f.Data) > tt.chunkSize {
+					t.Errorf("Fragment %d too large: %d", i, len(f.Data))
+				}
+				joined = append(joined, f.Data...)
+			}
+			if !bytes.Equal(joined, payload) {
+				t.Error("Joined fragments do not match payload")
+			}
+		})
+	}
+}
+
+func TestSplitPayloadFlags(t *testing.T) {
+	fragments, err := SplitPayloadFlags(make([]byte, 25), 7, FragmentFlagHandshake, 10)
+	if err != nil {
+		t.Fatalf("SplitPayloadFlags() error = %v", err)
+	}
+	for i, f := range fragments {
+		if !f.IsHandshake() || f.IsFetch() || f.IsAck() {
+			t.Errorf("Fragment %d flags: got %#x", i, f.Flags)
+		}
+	}
+}
+
+func TestQueryFragmentFitsName(t *testing.T) {
+	domains := []string{"t.com", "t.example.com", "tunnel.subdomain.example.com"}
+
+	for _, d := range domains {
+		t.Run(d, func(t *testing.T) {
+			domain := mustParseName(d)
+			size := QueryFragmentSize(domain)
+			if size <= 0 {
+				t.Fatalf("QueryFragmentSize() = %d", size)
+			}
+
+			f := &Fragment{ID: 1, Seq: 0, Total: 1, Data: make([]byte, size)}
+			for i := 0; i < 20; i++ { // padding is random
+				name, err := EncodePayload(f.Marshal(), 0xffff, NewClientID(), domain)
+				if err != nil {
+					t.Fatalf("EncodePayload() error = %v", err)
+				}
+				if _, err := NewName(name); err != nil {
+					t.Fatalf("Encoded name invalid: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseFragmentSize(t *testing.T) {
+	if got := ResponseFragmentSize(100); got != 0 {
+		t.Errorf("Tiny budget: got %d, want 0", got)
+	}
+
+	maxSize := 1232
+	size := ResponseFragmentSize(maxSize)
+
+	// Build a worst-case response and check it fits
+	labels := make([][]byte, 4)
+	for i := range labels {
+		labels[i] = bytes.Repeat([]byte{'a'}, 62)
+	}
+	query := CreateQuery(Name(labels), RRTypeTXT, 1)
+	query.AddEDNS0(4096)
+
+	f := &Fragment{ID: 1, Total: 1, Data: make([]byte, size)}
+	resp, err := CreateTunnelResponse(query, Name(labels[3:]), f.Marshal(), 60, uint16(maxSize))
+	if err != nil {
+		t.Fatalf("CreateTunnelResponse() error = %v", err)
+	}
+
+	data, err := resp.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if len(data) > maxSize {
+		t.Errorf("Response size %d exceeds %d", len(data), maxSize)
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	r := NewReassembler(time.Minute, 10)
+	clientID := NewClientID()
+
+	payload := []byte("the quick brown fox jumps over the lazy dog")
+	fragments, err := SplitPayload(payload, 7, 8)
+	if err != nil {
+		t.Fatalf("SplitPayload() error = %v", err)
+	}
+
+	// Add out of order, with a duplicate
+	order := []int{3, 0, 5, 0, 1, 4, 2}
+	var got []byte
+	held := 0
+	for i, idx := range order {
+		if idx >= len(fragments) {
+			continue
+		}
+		data, complete, err := r.Add(clientID, fragments[idx])
+		if err != nil {
+			t.Fatalf("Add(%d) error = %v", idx, err)
+		}
+		if i == 1 {
+			held = r.Size()
+		}
+		if complete {
+			if i != len(order)-1 {
+				t.Fatalf("Completed early at step %d", i)
+			}
+			got = data
+		}
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Reassembled: got %q, want %q", got, payload)
+	}
+	if r.Pending() != 0 {
+		t.Errorf("Pending after completion: got %d, want 0", r.Pending())
+	}
+	if want := len(fragments[3].Data) + len(fragments[0].Data); held != want {
+		t.Errorf("Size after two fragments: got %d, want %d", held, want)
+	}
+	if r.Size() != 0 {
+		t.Errorf("Size after completion: got %d, want 0", r.Size())
+	}
+}
+
+func TestReassemblerSingleFragment(t *testing.T) {
+	r := NewReassembler(time.Minute, 10)
+
+	data, complete, err := r.Add(NewClientID(), &Fragment{ID: 1, Total: 1, Data: []byte{9}})
+	if err != nil || !complete || !bytes.Equal(data, []byte{9}) {
+		t.Errorf("Add() = %v, %v, %v", data, complete, err)
+	}
+	if r.Pending() != 0 {
+		t.Errorf("Pending: got %d, want 0", r.Pending())
+	}
+}
+
+func TestReassemblerSeparatesClients(t *testing.T) {
+	r := NewReassembler(time.Minute, 10)
+	a, b := NewClientID(), NewClientID()
+
+	if _, complete, _ := r.Add(a, &Fragment{ID: 1, Seq: 0, Total: 2, Data: []byte{1}}); complete {
+		t.Fatal("Completed with one fragment")
+	}
+	if _, complete, _ := r.Add(b, &Fragment{ID: 1, Seq: 1, Total: 2, Data: []byte{2}}); complete {
+		t.Fatal("Fragments from different clients were combined")
+	}
+	if r.Pending() != 2 {
+		t.Errorf("Pending: got %d, want 2", r.Pending())
+	}
+}
+
+func TestReassemblerErrors(t *testing.T) {
+	r := NewReassembler(time.Minute, 1)
+	clientID := NewClientID()
+
+	if _, _, err := r.Add(clientID, NewFetchFragment(1, 0)); err != ErrInvalidFragment {
+		t.Errorf("Fetch fragment: got %v, want %v", err, ErrInvalidFragment)
+	}
+
+	if _, _, err := r.Add(clientID, &Fragment{ID: 1, Seq: 0, Total: 2}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	if _, _, err := r.Add(clientID, &Fragment{ID: 1, Seq: 1, Total: 3}); err != ErrFragmentMismatch {
+		t.Errorf("Total mismatch: got %v, want %v", err, ErrFragmentMismatch)
+	}
+
+	if _, _, err := r.Add(clientID, &Fragment{ID: 2, Seq: 0, Total: 2}); err != ErrReassemblyOverflow {
+		t.Errorf("Overflow: got %v, want %v", err, ErrReassemblyOverflow)
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := NewReassembler(10*time.Millisecond, 1)
+	clientID := NewClientID()
+
+	if _, _, err := r.Add(clientID, &Fragment{ID: 1, Seq: 0, Total: 2}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Expired buffer makes room for a new message
+	if _, _, err := r.Add(clientID, &Fragment{ID: 2, Seq: 0, Total: 2}); err != nil {
+		t.Errorf("Add() after timeout error = %v", err)
+	}
+}
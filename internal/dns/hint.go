@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// EDNSOptionUpstream names the server upstream a client asks to resolve
+// the inner query with, from the local/experimental range (RFC 6891,
+// Section 9). Like the trace ID it travels only inside the encrypted inner
+// query, and servers never forward it upstream.
+const EDNSOptionUpstream uint16 = 65002
+
+// maxUpstreamName bounds the length of upstream names
+const maxUpstreamName = 63
+
+var ErrInvalidUpstreamName = errors.New("invalid upstream name")
+
+// CheckUpstreamName returns an error unless name is a valid upstream name:
+// 1-63 lowercase letters, digits and hyphens.
+func CheckUpstreamName(name string) error {
+	if name == "" || len(name) > maxUpstreamName {
+		return fmt.Errorf("%w %q", ErrInvalidUpstreamName, name)
+	}
+	for _, c := range name {
+		if c != '-' && (c < '0' || c > '9') && (c < 'a' || c > 'z') {
+			return fmt.Errorf("%w %q", ErrInvalidUpstreamName, name)
+		}
+	}
+	return nil
+}
+
+// UpstreamHint returns the upstream name a query asks for, if any.
+func (m *Message) UpstreamHint() (string, bool) {
+	data, ok := m.GetEDNSOption(EDNSOptionUpstream)
+	if !ok || CheckUpstreamName(string(data)) != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// WithUpstreamHint returns a copy of a query asking for the named
+// upstream. Unlike WithTraceID it adds an OPT record with the minimum
+// payload size to queries without one, since the hint must not be lost;
+// the OPT record of the response should then be removed again.
+func (m *Message) WithUpstreamHint(name string) *Message {
+	hinted := *m
+	hinted.Additional = slices.Clone(m.Additional)
+	if opt, err := m.OPT(); err != nil || opt == nil {
+		hinted.SetEDNS0(EDNSMinUDPSize, false)
+	}
+	if err := hinted.SetEDNSOption(EDNSOption{Code: EDNSOptionUpstream, Data: []byte(name)}); err != nil {
+		return m
+	}
+	return &hinted
+}
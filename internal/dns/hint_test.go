@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpstreamHint(t *testing.T) {
+	query := CreateQuery(mustParseName("www.example.com"), RRTypeA, 1)
+	query.SetEDNS0(1232, true)
+	hinted := query.WithUpstreamHint("eu-doh")
+	if got, ok := hinted.UpstreamHint(); !ok || got != "eu-doh" {
+		t.Errorf("UpstreamHint() = %q, %v, want eu-doh", got, ok)
+	}
+	if hinted.GetEDNS0Size() != 1232 || !hinted.DO() {
+		t.Error("OPT record changed")
+	}
+	if _, ok := query.UpstreamHint(); ok {
+		t.Error("Original query modified")
+	}
+
+	// Queries without EDNS get an OPT record, since the hint must arrive
+	plain := CreateQuery(mustParseName("www.example.com"), RRTypeA, 1)
+	hinted = plain.WithUpstreamHint("eu-doh")
+	if _, ok := hinted.UpstreamHint(); !ok || hinted.GetEDNS0Size() != EDNSMinUDPSize {
+		t.Errorf("Hint on a query without EDNS: size %d, hint %v", hinted.GetEDNS0Size(), ok)
+	}
+	if len(plain.Additional) != 0 {
+		t.Error("Original query modified")
+	}
+}
+
+func TestCheckUpstreamName(t *testing.T) {
+	for _, name := range []string{"eu", "eu-doh", "us2"} {
+		if err := CheckUpstreamName(name); err != nil {
+			t.Errorf("CheckUpstreamName(%q) error = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "EU", "eu doh", "eu.doh", string(make([]byte, 64))} {
+		if err := CheckUpstreamName(name); !errors.Is(err, ErrInvalidUpstreamName) {
+			t.Errorf("CheckUpstreamName(%q) error = %v, want ErrInvalidUpstreamName", name, err)
+		}
+	}
+}
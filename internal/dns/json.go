@@ -0,0 +1,512 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// JSONContentType is the media type of the JSON dialect of DoH
+const JSONContentType = "application/dns-json"
+
+// JSONMessage is a DNS response in the JSON dialect of DoH served by
+// Google Public DNS at /resolve and Cloudflare at /dns-query, for tools
+// that don't speak the wire format.
+type JSONMessage struct {
+	Status     uint16
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []JSONQuestion
+	Answer     []JSONRecord `json:",omitempty"`
+	Authority  []JSONRecord `json:",omitempty"`
+	Additional []JSONRecord `json:",omitempty"`
+	Comment    string       `json:",omitempty"`
+}
+
+// JSONQuestion is a question of a JSONMessage.
+type JSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// JSONRecord is a record of a JSONMessage, with its data in presentation
+// format.
+type JSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// ToJSON converts a response to the JSON dialect. OPT records are left
+// out, as the dialect has no EDNS.
+func ToJSON(m *Message) *JSONMessage {
+	j := &JSONMessage{
+		Status:     m.Rcode(),
+		TC:         m.Flags&0x0200 != 0,
+		RD:         m.Flags&0x0100 != 0,
+		RA:         m.Flags&0x0080 != 0,
+		AD:         m.Flags&0x0020 != 0,
+		CD:         m.Flags&0x0010 != 0,
+		Question:   []JSONQuestion{},
+		Answer:     jsonRecords(m.Answer),
+		Authority:  jsonRecords(m.Authority),
+		Additional: jsonRecords(m.Additional),
+	}
+	for _, q := range m.Question {
+		j.Question = append(j.Question, JSONQuestion{Name: FormatName(q.Name), Type: q.Type})
+	}
+	return j
+}
+
+// jsonRecords converts records to the JSON dialect, leaving out OPT ones.
+func jsonRecords(rrs []RR) []JSONRecord {
+	var out []JSONRecord
+	for _, rr := range rrs {
+		if rr.Type == RRTypeOPT {
+			continue
+		}
+		out = append(out, JSONRecord{
+			Name: FormatName(rr.Name),
+			Type: rr.Type,
+			TTL:  rr.TTL,
+			Data: FormatRData(rr.Type, rr.Data),
+		})
+	}
+	return out
+}
+
+// FromJSON converts a response in the JSON dialect to a message with the
+// given ID. Records whose data can't be parsed are left out rather than
+// fail the whole answer; it returns how many were.
+func FromJSON(j *JSONMessage, id uint16) (*Message, int, error) {
+	if j.Status > 0xf {
+		return nil, 0, fmt.Errorf("%w: %d", ErrInvalidRcode, j.Status)
+	}
+
+	m := &Message{ID: id, Flags: 0x8000 | j.Status}
+	for _, flag := range []struct {
+		set bool
+		bit uint16
+	}{{j.TC, 0x0200}, {j.RD, 0x0100}, {j.RA, 0x0080}, {j.AD, 0x0020}, {j.CD, 0x0010}} {
+		if flag.set {
+			m.Flags |= flag.bit
+		}
+	}
+
+	for _, q := range j.Question {
+		name, err := parseFormattedName(q.Name)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid question name %q: %w", q.Name, err)
+		}
+		m.Question = append(m.Question, Question{Name: name, Type: q.Type, Class: ClassIN})
+	}
+
+	var dropped int
+	for _, section := range []struct {
+		records []JSONRecord
+		rrs     *[]RR
+	}{{j.Answer, &m.Answer}, {j.Authority, &m.Authority}, {j.Additional, &m.Additional}} {
+		rrs, n, err := parseJSONRecords(section.records)
+		if err != nil {
+			return nil, 0, err
+		}
+		*section.rrs = rrs
+		dropped += n
+	}
+	return m, dropped, nil
+}
+
+// parseJSONRecords converts records in the JSON dialect to wire format,
+// skipping those whose data can't be parsed and returning how many were.
+// An invalid owner name fails the conversion.
+func parseJSONRecords(records []JSONRecord) ([]RR, int, error) {
+	var rrs []RR
+	var dropped int
+	for _, rec := range records {
+		name, err := parseFormattedName(rec.Name)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid record name %q: %w", rec.Name, err)
+		}
+		data, err := ParseRData(rec.Type, rec.Data)
+		if err != nil {
+			dropped++
+			continue
+		}
+		rrs = append(rrs, RR{Name: name, Type: rec.Type, Class: ClassIN, TTL: rec.TTL, Data: data})
+	}
+	return rrs, dropped, nil
+}
+
+// FormatName returns a name in presentation format: with the trailing
+// dot, and dots, backslashes and non-printable bytes in labels escaped.
+func FormatName(name Name) string {
+	if len(name) == 0 {
+		return "."
+	}
+	var b strings.Builder
+	for _, label := range name {
+		for _, c := range label {
+			switch {
+			case c == '.' || c == '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c <= 0x20 || c > 0x7e:
+				fmt.Fprintf(&b, "\\%03d", c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+// parseFormattedName parses a name in the presentation format FormatName
+// returns; the trailing dot is optional.
+func parseFormattedName(s string) (Name, error) {
+	var labels [][]byte
+	var label []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '.':
+			if len(label) == 0 {
+				if i == len(s)-1 && len(labels) == 0 {
+					break // the root
+				}
+				return nil, ErrZeroLengthLabel
+			}
+			labels = append(labels, label)
+			label = nil
+		case c == '\\' && i+3 < len(s) && isDecimal(s[i+1:i+4]):
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			if n > 255 {
+				return nil, ErrInvalidRData
+			}
+			label = append(label, byte(n))
+			i += 3
+		case c == '\\' && i+1 < len(s):
+			i++
+			label = append(label, s[i])
+		default:
+			label = append(label, c)
+		}
+	}
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+	if labels == nil {
+		return Name{}, nil
+	}
+	return NewName(labels)
+}
+
+// FormatRData returns record data in presentation format: the usual
+// zone file syntax for the common types and the RFC 3597 generic syntax,
+// \# and the length and hex of the data, for the others.
+func FormatRData(rrType uint16, data []byte) string {
+	switch rrType {
+	case RRTypeA, RRTypeAAAA:
+		if addr, err := DecodeAddrData(data); err == nil && addr.Is4() == (rrType == RRTypeA) {
+			return addr.String()
+		}
+	case RRTypeNS, RRTypeCNAME, RRTypePTR, RRTypeDNAME:
+		if name, err := DecodeNameData(data); err == nil {
+			return FormatName(name)
+		}
+	case RRTypeMX:
+		if mx, err := DecodeMXData(data); err == nil {
+			return fmt.Sprintf("%d %s", mx.Preference, FormatName(mx.Exchange))
+		}
+	case RRTypeSRV:
+		if srv, err := DecodeSRVData(data); err == nil {
+			return fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, FormatName(srv.Target))
+		}
+	case RRTypeSOA:
+		if soa, err := DecodeSOAData(data); err == nil {
+			return fmt.Sprintf("%s %s %d %d %d %d %d", FormatName(soa.MName), FormatName(soa.RName),
+				soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+		}
+	case RRTypeTXT:
+		if strs, ok := characterStrings(data); ok {
+			quoted := make([]string, len(strs))
+			for i, s := range strs {
+				quoted[i] = quoteString(s)
+			}
+			return strings.Join(quoted, " ")
+		}
+	case RRTypeCAA:
+		if caa, err := DecodeCAAData(data); err == nil {
+			return fmt.Sprintf("%d %s %s", caa.Flags, caa.Tag, quoteString(caa.Value))
+		}
+	case RRTypeDS:
+		if ds, err := DecodeDSData(data); err == nil {
+			return fmt.Sprintf("%d %d %d %X", ds.KeyTag, ds.Algorithm, ds.DigestType, ds.Digest)
+		}
+	case RRTypeDNSKEY:
+		if key, err := DecodeDNSKEYData(data); err == nil {
+			return fmt.Sprintf("%d %d %d %s", key.Flags, key.Protocol, key.Algorithm,
+				base64.StdEncoding.EncodeToString(key.PublicKey))
+		}
+	case RRTypeRRSIG:
+		if sig, err := DecodeRRSIGData(data); err == nil {
+			return formatRRSIG(sig)
+		}
+	case RRTypeTLSA:
+		if tlsa, err := DecodeTLSAData(data); err == nil {
+			return fmt.Sprintf("%d %d %d %X", tlsa.Usage, tlsa.Selector, tlsa.MatchingType, tlsa.Data)
+		}
+	case RRTypeSSHFP:
+		if fp, err := DecodeSSHFPData(data); err == nil {
+			return fmt.Sprintf("%d %d %X", fp.Algorithm, fp.Type, fp.Fingerprint)
+		}
+	case RRTypeNAPTR:
+		if naptr, err := DecodeNAPTRData(data); err == nil {
+			return fmt.Sprintf("%d %d %s %s %s %s", naptr.Order, naptr.Preference, quoteString(naptr.Flags),
+				quoteString(naptr.Services), quoteString(naptr.Regexp), FormatName(naptr.Replacement))
+		}
+	case RRTypeSVCB, RRTypeHTTPS:
+		if svcb, err := DecodeSVCBData(data); err == nil {
+			if s, ok := formatSVCB(svcb); ok {
+				return s
+			}
+		}
+	}
+
+	if len(data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %x`, len(data), data)
+}
+
+// rdataFields is the number of presentation format fields of the record
+// types ParseRData parses, except those ending in a variable number:
+// TXT, the base64 or hex of the DNSSEC, TLSA and SSHFP types, and the
+// SvcParams of SVCB and HTTPS.
+var rdataFields = map[uint16]int{
+	RRTypeA: 1, RRTypeAAAA: 1, RRTypeNS: 1, RRTypeCNAME: 1, RRTypePTR: 1, RRTypeDNAME: 1,
+	RRTypeMX: 2, RRTypeSRV: 4, RRTypeSOA: 7, RRTypeCAA: 3, RRTypeNAPTR: 6,
+}
+
+// ParseRData parses record data in the presentation format FormatRData
+// returns. Unquoted TXT data is taken as a single string.
+func ParseRData(rrType uint16, s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == `\#` || strings.HasPrefix(s, `\# `) {
+		return parseGenericRData(s)
+	}
+	if rrType == RRTypeTXT && !strings.HasPrefix(s, `"`) {
+		return EncodeTXTData([]byte(s)), nil
+	}
+
+	fields, err := presentationFields(s)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := rdataFields[rrType]; ok && len(fields) != n {
+		return nil, ErrInvalidRData
+	}
+
+	switch rrType {
+	case RRTypeA, RRTypeAAAA:
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || addr.Zone() != "" || addr.Is4() != (rrType == RRTypeA) {
+			return nil, ErrInvalidRData
+		}
+		return EncodeAddrData(addr), nil
+	case RRTypeNS, RRTypeCNAME, RRTypePTR, RRTypeDNAME:
+		name, err := parseFormattedName(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		return EncodeNameData(name), nil
+	case RRTypeMX:
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, ErrInvalidRData
+		}
+		name, err := parseFormattedName(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return EncodeMXData(MX{Preference: uint16(pref), Exchange: name}), nil
+	case RRTypeSRV:
+		var nums [3]uint16
+		for i := range nums {
+			n, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, ErrInvalidRData
+			}
+			nums[i] = uint16(n)
+		}
+		name, err := parseFormattedName(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		return EncodeSRVData(SRV{Priority: nums[0], Weight: nums[1], Port: nums[2], Target: name}), nil
+	case RRTypeSOA:
+		mname, err := parseFormattedName(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rname, err := parseFormattedName(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		var nums [5]uint32
+		for i := range nums {
+			n, err := strconv.ParseUint(fields[2+i], 10, 32)
+			if err != nil {
+				return nil, ErrInvalidRData
+			}
+			nums[i] = uint32(n)
+		}
+		return EncodeSOAData(SOA{
+			MName: mname, RName: rname,
+			Serial: nums[0], Refresh: nums[1], Retry: nums[2], Expire: nums[3], Minimum: nums[4],
+		}), nil
+	case RRTypeTXT:
+		var data []byte
+		for _, field := range fields {
+			data = append(data, EncodeTXTData([]byte(field))...)
+		}
+		return data, nil
+	case RRTypeCAA:
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil || fields[1] == "" || len(fields[1]) > 255 {
+			return nil, ErrInvalidRData
+		}
+		return EncodeCAAData(CAA{Flags: uint8(flags), Tag: fields[1], Value: []byte(fields[2])}), nil
+	case RRTypeDS:
+		return parseDS(fields)
+	case RRTypeDNSKEY:
+		return parseDNSKEY(fields)
+	case RRTypeRRSIG:
+		return parseRRSIG(fields)
+	case RRTypeTLSA:
+		return parseTLSA(fields)
+	case RRTypeSSHFP:
+		return parseSSHFP(fields)
+	case RRTypeNAPTR:
+		return parseNAPTR(fields)
+	case RRTypeSVCB, RRTypeHTTPS:
+		return parseSVCB(fields)
+	}
+	return nil, fmt.Errorf("%w: no presentation format for type %d", ErrInvalidRData, rrType)
+}
+
+// parseGenericRData parses data in the RFC 3597 generic syntax.
+func parseGenericRData(s string) ([]byte, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return nil, ErrInvalidRData
+	}
+	length, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidRData
+	}
+	data, err := hex.DecodeString(strings.Join(fields[2:], ""))
+	if err != nil || len(data) != int(length) {
+		return nil, ErrInvalidRData
+	}
+	return data, nil
+}
+
+// characterStrings splits TXT record data into its character strings.
+func characterStrings(data []byte) ([][]byte, bool) {
+	var strs [][]byte
+	for len(data) > 0 {
+		length := int(data[0])
+		if len(data) < 1+length {
+			return nil, false
+		}
+		strs = append(strs, data[1:1+length])
+		data = data[1+length:]
+	}
+	return strs, true
+}
+
+// quoteString returns a character string quoted for presentation format,
+// with quotes and backslashes escaped and non-printable bytes as \DDD.
+func quoteString(s []byte) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// presentationFields splits record data in presentation format into its
+// fields, unquoting quoted ones.
+func presentationFields(s string) ([]string, error) {
+	var fields []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return fields, nil
+		}
+		if s[0] != '"' {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			fields = append(fields, s[:end])
+			s = s[end:]
+			continue
+		}
+
+		var field []byte
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				field = append(field, s[i])
+				continue
+			}
+			if i+3 < len(s) && isDecimal(s[i+1:i+4]) {
+				n, _ := strconv.Atoi(s[i+1 : i+4])
+				if n > 255 {
+					return nil, ErrInvalidRData
+				}
+				field = append(field, byte(n))
+				i += 3
+				continue
+			}
+			if i+1 >= len(s) {
+				return nil, ErrInvalidRData
+			}
+			i++
+			field = append(field, s[i])
+		}
+		if i >= len(s) {
+			return nil, ErrInvalidRData // unterminated
+		}
+		fields = append(fields, string(field))
+		s = s[i+1:]
+	}
+}
+
+// isDecimal reports whether s consists of decimal digits.
+func isDecimal(s string) bool {
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestPresentationFormat(t *testing.T) {
+	tests := []struct {
+		rrType uint16
+		data   []byte
+		text   string
+	}{
+		{RRTypeA, EncodeAddrData(netip.MustParseAddr("192.0.2.1")), "192.0.2.1"},
+		{RRTypeAAAA, EncodeAddrData(netip.MustParseAddr("2001:db8::1")), "2001:db8::1"},
+		{RRTypeCNAME, EncodeNameData(mustParseName("www.example.com")), "www.example.com."},
+		{RRTypeMX, EncodeMXData(MX{Preference: 10, Exchange: mustParseName("mail.example.com")}), "10 mail.example.com."},
+		{RRTypeSRV, EncodeSRVData(SRV{Priority: 1, Weight: 5, Port: 5060, Target: mustParseName("sip.example.com")}), "1 5 5060 sip.example.com."},
+		{RRTypeSOA, EncodeSOAData(SOA{
+			MName: mustParseName("ns1.example.com"), RName: mustParseName("hostmaster.example.com"),
+			Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+		}), "ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300"},
+		{RRTypeTXT, append(EncodeTXTData([]byte(`v=spf1 "-all"`)), EncodeTXTData([]byte{'a', 0})...), `"v=spf1 \"-all\"" "a\000"`},
+		{RRTypeCAA, EncodeCAAData(CAA{Tag: "issue", Value: []byte("letsencrypt.org")}), `0 issue "letsencrypt.org"`},
+		{RRTypeDS, []byte{0xab, 0xcd}, `\# 2 abcd`},
+		{RRTypeDS, EncodeDSData(DS{KeyTag: 2371, Algorithm: 13, DigestType: 2, Digest: []byte{0xab, 0xcd}}), "2371 13 2 ABCD"},
+		{RRTypeDNSKEY, EncodeDNSKEYData(DNSKEY{Flags: 257, Protocol: 3, Algorithm: 13, PublicKey: []byte("key")}), "257 3 13 a2V5"},
+		{RRTypeRRSIG, EncodeRRSIGData(RRSIG{
+			TypeCovered: RRTypeHTTPS, Algorithm: 13, Labels: 2, OriginalTTL: 300,
+			Expiration: 1700000000, Inception: 1699900000, KeyTag: 34505,
+			SignerName: mustParseName("example.com"), Signature: []byte("sig"),
+		}), "HTTPS 13 2 300 20231114221320 20231113182640 34505 example.com. c2ln"},
+		{RRTypeTLSA, EncodeTLSAData(TLSA{Usage: 3, Selector: 1, MatchingType: 1, Data: []byte{0x01, 0xfe}}), "3 1 1 01FE"},
+		{RRTypeSSHFP, EncodeSSHFPData(SSHFP{Algorithm: 4, Type: 2, Fingerprint: []byte{0xc0, 0xde}}), "4 2 C0DE"},
+		{RRTypeNAPTR, EncodeNAPTRData(NAPTR{
+			Order: 100, Preference: 10, Flags: []byte("S"), Services: []byte("SIP+D2U"),
+			Replacement: mustParseName("_sip._udp.example.com"),
+		}), `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`},
+		{RRTypeHTTPS, EncodeSVCBData(SVCB{Priority: 1, Params: []byte{
+			0, 1, 0, 6, 2, 'h', '3', 2, 'h', '2', // alpn
+			0, 3, 0, 2, 0x01, 0xbb, // port
+			0, 4, 0, 4, 192, 0, 2, 1, // ipv4hint
+			0, 7, 0, 16, '/', 'd', 'n', 's', '-', 'q', 'u', 'e', 'r', 'y', '{', '?', 'd', 'n', 's', '}', // dohpath
+		}}), `1 . alpn=h3,h2 port=443 ipv4hint=192.0.2.1 dohpath="/dns-query{?dns}"`},
+		{RRTypeSVCB, EncodeSVCBData(SVCB{Priority: 0, Target: mustParseName("svc.example.com")}), "0 svc.example.com."},
+		{RRTypeNULL, []byte{}, `\# 0`},
+	}
+	for _, tt := range tests {
+		if got := FormatRData(tt.rrType, tt.data); got != tt.text {
+			t.Errorf("FormatRData(%d) = %q, want %q", tt.rrType, got, tt.text)
+		}
+		if got, err := ParseRData(tt.rrType, tt.text); err != nil || !bytes.Equal(got, tt.data) {
+			t.Errorf("ParseRData(%d, %q) = %x, %v, want %x", tt.rrType, tt.text, got, err, tt.data)
+		}
+	}
+
+	// Unquoted TXT data is a single string
+	if got, err := ParseRData(RRTypeTXT, "hello world"); err != nil || !bytes.Equal(got, EncodeTXTData([]byte("hello world"))) {
+		t.Errorf("ParseRData(TXT, unquoted) = %x, %v", got, err)
+	}
+
+	for _, invalid := range []struct {
+		rrType uint16
+		text   string
+	}{
+		{RRTypeA, "2001:db8::1"},
+		{RRTypeAAAA, "192.0.2.1"},
+		{RRTypeMX, "mail.example.com."},
+		{RRTypeTXT, `"unterminated`},
+		{RRTypeDS, `\# 3 abcd`},
+		{RRTypeDS, "2371 13 2 xyz"},
+		{RRTypeDNSKEY, "257 3 13"},
+		{RRTypeRRSIG, "HTTPS 13 2 300 20231114221320 20231113182640 34505 example.com."},
+		{RRTypeNAPTR, `100 10 "S" "SIP+D2U" _sip._udp.example.com.`},
+		{RRTypeHTTPS, "1 . alpn=h3 alpn=h2"},
+		{RRTypeHTTPS, "1 . ipv4hint=2001:db8::1"},
+		{RRTypeHTTPS, "1 . no-default-alpn=h2"},
+		{RRTypeHTTPS, "1 . unknown=1"},
+		{RRTypeNSEC, "a.example.com. A RRSIG"},
+	} {
+		if _, err := ParseRData(invalid.rrType, invalid.text); err == nil {
+			t.Errorf("ParseRData(%d, %q) succeeded", invalid.rrType, invalid.text)
+		}
+	}
+}
+
+func TestFormatName(t *testing.T) {
+	tests := []struct {
+		name Name
+		text string
+	}{
+		{Name{}, "."},
+		{mustParseName("_sip._tcp.example.com"), "_sip._tcp.example.com."},
+		{Name{[]byte("a.b"), []byte("c d"), []byte{'\\', 0xff}}, `a\.b.c\032d.\\\255.`},
+	}
+	for _, tt := range tests {
+		if got := FormatName(tt.name); got != tt.text {
+			t.Errorf("FormatName(%v) = %q, want %q", tt.name, got, tt.text)
+		}
+		if got, err := parseFormattedName(tt.text); err != nil || !reflect.DeepEqual(got, tt.name) {
+			t.Errorf("parseFormattedName(%q) = %v, %v, want %v", tt.text, got, err, tt.name)
+		}
+	}
+	if got, err := parseFormattedName("example.com"); err != nil || !got.Equal(mustParseName("example.com")) {
+		t.Errorf("parseFormattedName() without the trailing dot = %v, %v", got, err)
+	}
+	if _, err := parseFormattedName("a..b"); err == nil {
+		t.Error("parseFormattedName() of an empty label succeeded")
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	query := CreateQuery(mustParseName("www.example.com"), RRTypeA, 1)
+	resp := CreateResponse(query)
+	resp.Flags |= 0x0100 | 0x0080 | 0x0020
+	resp.Answer = []RR{
+		{Name: mustParseName("www.example.com"), Type: RRTypeCNAME, Class: ClassIN, TTL: 300, Data: EncodeNameData(mustParseName("example.com"))},
+		{Name: mustParseName("example.com"), Type: RRTypeA, Class: ClassIN, TTL: 60, Data: EncodeAddrData(netip.MustParseAddr("192.0.2.1"))},
+	}
+	resp.AddEDNS0(1232)
+
+	j := ToJSON(resp)
+	if j.Status != RcodeNoError || !j.RD || !j.RA || !j.AD || j.TC || j.CD {
+		t.Errorf("ToJSON() header = %+v", j)
+	}
+	if len(j.Additional) != 0 {
+		t.Errorf("ToJSON() kept the OPT record: %+v", j.Additional)
+	}
+
+	encoded, err := json.Marshal(j)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	var decoded JSONMessage
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	got, dropped, err := FromJSON(&decoded, 1)
+	if err != nil || dropped != 0 {
+		t.Fatalf("FromJSON() = %d dropped, %v", dropped, err)
+	}
+	resp.Additional = nil
+	if !reflect.DeepEqual(got, resp) {
+		t.Errorf("FromJSON(ToJSON()) = %+v, want %+v", got, resp)
+	}
+
+	// A Google Public DNS answer
+	google := `{"Status":3,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,
+		"Question":[{"name":"nx.example.com.","type":1}],
+		"Authority":[{"name":"example.com.","type":6,"TTL":1800,"data":"ns.icann.org. noc.dns.icann.org. 2024081459 7200 3600 1209600 3600"}]}`
+	var nx JSONMessage
+	if err := json.Unmarshal([]byte(google), &nx); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	msg, _, err := FromJSON(&nx, 7)
+	if err != nil {
+		t.Fatalf("FromJSON() error = %v", err)
+	}
+	if msg.ID != 7 || msg.Rcode() != RcodeNameError || !msg.IsResponse() || len(msg.Answer) != 0 || len(msg.Authority) != 1 {
+		t.Errorf("FromJSON() = %+v", msg)
+	}
+}
+
+func TestFromJSONRecordTypes(t *testing.T) {
+	// Google Public DNS answers for HTTPS and its DNSSEC records, with
+	// an NSEC record, which has no presentation format here, in the
+	// authority section
+	google := `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":true,"CD":false,
+		"Question":[{"name":"cloudflare.com.","type":65}],
+		"Answer":[
+			{"name":"cloudflare.com.","type":65,"TTL":300,"data":"1 . alpn=h3,h2 ipv4hint=104.16.132.229,104.16.133.229 ipv6hint=2606:4700::6810:84e5,2606:4700::6810:85e5"},
+			{"name":"cloudflare.com.","type":46,"TTL":300,"data":"https 13 2 300 20241017210312 20241015190312 34505 cloudflare.com. tsvzrAKeK3rxc2E3w0+UPEoNzsWPIPkP9cHHBQCdtvGqpyyUdRQChQ77ta8w6/qNcAWl1rUVG5hN2g5SZYlt7w=="}],
+		"Authority":[
+			{"name":"cloudflare.com.","type":47,"TTL":300,"data":"\\000.cloudflare.com. RRSIG NSEC TYPE65283"}]}`
+	var j JSONMessage
+	if err := json.Unmarshal([]byte(google), &j); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	msg, dropped, err := FromJSON(&j, 1)
+	if err != nil {
+		t.Fatalf("FromJSON() error = %v", err)
+	}
+	if dropped != 1 || len(msg.Answer) != 2 || len(msg.Authority) != 0 {
+		t.Fatalf("FromJSON() = %d answers, %d authority records, %d dropped, want 2, 0 and 1",
+			len(msg.Answer), len(msg.Authority), dropped)
+	}
+
+	svcb, err := DecodeSVCBData(msg.Answer[0].Data)
+	if err != nil {
+		t.Fatalf("DecodeSVCBData() error = %v", err)
+	}
+	if svcb.Priority != 1 || len(svcb.Target) != 0 {
+		t.Errorf("HTTPS record = %+v", svcb)
+	}
+	if got := FormatRData(RRTypeHTTPS, msg.Answer[0].Data); got != j.Answer[0].Data {
+		t.Errorf("FormatRData(HTTPS) = %q, want %q", got, j.Answer[0].Data)
+	}
+	sig, err := DecodeRRSIGData(msg.Answer[1].Data)
+	if err != nil || sig.TypeCovered != RRTypeHTTPS || sig.KeyTag != 34505 || len(sig.Signature) != 64 {
+		t.Errorf("RRSIG record = %+v, %v", sig, err)
+	}
+
+	// Cloudflare gives SVCB and HTTPS data in the generic syntax
+	j.Answer = []JSONRecord{{Name: "cloudflare.com.", Type: RRTypeHTTPS, TTL: 300, Data: `\# 13 00010000010006026833026832`}}
+	if msg, dropped, err = FromJSON(&j, 1); err != nil || dropped != 1 || len(msg.Answer) != 1 {
+		t.Fatalf("FromJSON() of generic data = %+v, %d dropped, %v", msg, dropped, err)
+	}
+	if got := FormatRData(RRTypeHTTPS, msg.Answer[0].Data); got != "1 . alpn=h3,h2" {
+		t.Errorf("FormatRData(HTTPS) = %q", got)
+	}
+}
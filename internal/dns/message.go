@@ -7,16 +7,37 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strconv"
 	"strings"
 )
 
 // DNS constants
 const (
 	// Record types
-	RRTypeA    uint16 = 1
-	RRTypeAAAA uint16 = 28
-	RRTypeTXT  uint16 = 16
-	RRTypeOPT  uint16 = 41
+	RRTypeA      uint16 = 1
+	RRTypeNS     uint16 = 2
+	RRTypeCNAME  uint16 = 5
+	RRTypeSOA    uint16 = 6
+	RRTypeNULL   uint16 = 10
+	RRTypePTR    uint16 = 12
+	RRTypeMX     uint16 = 15
+	RRTypeTXT    uint16 = 16
+	RRTypeAAAA   uint16 = 28
+	RRTypeSRV    uint16 = 33
+	RRTypeNAPTR  uint16 = 35
+	RRTypeDNAME  uint16 = 39
+	RRTypeOPT    uint16 = 41
+	RRTypeDS     uint16 = 43
+	RRTypeSSHFP  uint16 = 44
+	RRTypeRRSIG  uint16 = 46
+	RRTypeNSEC   uint16 = 47
+	RRTypeDNSKEY uint16 = 48
+	RRTypeNSEC3  uint16 = 50
+	RRTypeTLSA   uint16 = 52
+	RRTypeSVCB   uint16 = 64
+	RRTypeHTTPS  uint16 = 65
+	RRTypeCAA    uint16 = 257
 
 	// Classes
 	ClassIN uint16 = 1
@@ -29,6 +50,26 @@ const (
 	RcodeNotImpl     uint16 = 4
 	RcodeRefused     uint16 = 5
 
+	// EDNS option codes
+	EDNSOptionNSID          uint16 = 3
+	EDNSOptionClientSubnet  uint16 = 8 // ECS
+	EDNSOptionExpire        uint16 = 9
+	EDNSOptionCookie        uint16 = 10
+	EDNSOptionKeepalive     uint16 = 11
+	EDNSOptionPadding       uint16 = 12
+	EDNSOptionExtendedError uint16 = 15 // EDE
+
+	// Extended DNS error codes (RFC 8914)
+	EDEOther      uint16 = 0
+	EDENotReady   uint16 = 14
+	EDEBlocked    uint16 = 15
+	EDEProhibited uint16 = 18
+
+	// EDEKeyRejected is a private-use info code (RFC 8914 section 4) sent
+	// inside the tunnel when the server no longer accepts the client's
+	// key: it was revoked, expired or isn't valid at this time of day
+	EDEKeyRejected uint16 = 49152
+
 	// Maximum sizes
 	MaxLabelLength = 63
 	MaxNameLength  = 255
@@ -48,6 +89,9 @@ var (
 	ErrTrailingBytes     = errors.New("trailing bytes after message")
 	ErrIntegerOverflow   = errors.New("integer overflow")
 	ErrInvalidMessage    = errors.New("invalid DNS message")
+	ErrInvalidRcode      = errors.New("invalid rcode")
+	ErrInvalidType       = errors.New("invalid RR type")
+	ErrInvalidEDNSOption = errors.New("invalid EDNS option")
 )
 
 // Name represents a DNS domain name as a sequence of labels.
@@ -122,6 +166,12 @@ func (n Name) TrimSuffix(suffix Name) (Name, bool) {
 	return fore, true
 }
 
+// Equal reports whether the names are the same, ignoring case.
+func (n Name) Equal(other Name) bool {
+	prefix, ok := n.TrimSuffix(other)
+	return ok && len(prefix) == 0
+}
+
 // Question represents a DNS question.
 type Question struct {
 	Name  Name
@@ -178,6 +228,116 @@ func (m *Message) SetRcode(rcode uint16) {
 	m.Flags = (m.Flags & 0xfff0) | (rcode & 0xf)
 }
 
+// rcodeNames maps rcode mnemonics to values.
+var rcodeNames = map[string]uint16{
+	"NOERROR":  RcodeNoError,
+	"FORMERR":  RcodeFormatError,
+	"SERVFAIL": RcodeServerFail,
+	"NXDOMAIN": RcodeNameError,
+	"NOTIMP":   RcodeNotImpl,
+	"REFUSED":  RcodeRefused,
+}
+
+// ParseRcode parses an rcode given as a mnemonic (e.g. "REFUSED") or a
+// number between 0 and 15.
+func ParseRcode(s string) (uint16, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if rcode, ok := rcodeNames[s]; ok {
+		return rcode, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 4)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidRcode, s)
+	}
+	return uint16(n), nil
+}
+
+// RcodeString returns the mnemonic of an rcode, or its number if it has
+// none.
+func RcodeString(rcode uint16) string {
+	for name, value := range rcodeNames {
+		if value == rcode {
+			return name
+		}
+	}
+	return strconv.Itoa(int(rcode))
+}
+
+// rrTypeNames maps RR type mnemonics to values.
+var rrTypeNames = map[string]uint16{
+	"A":      RRTypeA,
+	"NS":     RRTypeNS,
+	"CNAME":  RRTypeCNAME,
+	"SOA":    RRTypeSOA,
+	"PTR":    RRTypePTR,
+	"MX":     RRTypeMX,
+	"TXT":    RRTypeTXT,
+	"AAAA":   RRTypeAAAA,
+	"SRV":    RRTypeSRV,
+	"NAPTR":  RRTypeNAPTR,
+	"DNAME":  RRTypeDNAME,
+	"DS":     RRTypeDS,
+	"SSHFP":  RRTypeSSHFP,
+	"RRSIG":  RRTypeRRSIG,
+	"NSEC":   RRTypeNSEC,
+	"DNSKEY": RRTypeDNSKEY,
+	"NSEC3":  RRTypeNSEC3,
+	"TLSA":   RRTypeTLSA,
+	"SVCB":   RRTypeSVCB,
+	"HTTPS":  RRTypeHTTPS,
+	"CAA":    RRTypeCAA,
+}
+
+// ParseType parses an RR type given as a mnemonic (e.g. "AAAA"), a
+// number or in the RFC 3597 TYPE<number> form.
+func ParseType(s string) (uint16, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if rrType, ok := rrTypeNames[s]; ok {
+		return rrType, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidType, s)
+	}
+	return uint16(n), nil
+}
+
+// TypeString returns the mnemonic of an RR type, or TYPE and its number
+// (RFC 3597) if it has none.
+func TypeString(rrType uint16) string {
+	for name, value := range rrTypeNames {
+		if value == rrType {
+			return name
+		}
+	}
+	return "TYPE" + strconv.Itoa(int(rrType))
+}
+
+// ednsOptionNames maps EDNS option mnemonics to codes.
+var ednsOptionNames = map[string]uint16{
+	"NSID":      EDNSOptionNSID,
+	"ECS":       EDNSOptionClientSubnet,
+	"EXPIRE":    EDNSOptionExpire,
+	"COOKIE":    EDNSOptionCookie,
+	"KEEPALIVE": EDNSOptionKeepalive,
+	"PADDING":   EDNSOptionPadding,
+}
+
+// ParseEDNSOption parses an EDNS option code given as a mnemonic (e.g.
+// "ECS") or a number.
+func ParseEDNSOption(s string) (uint16, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if code, ok := ednsOptionNames[s]; ok {
+		return code, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidEDNSOption, s)
+	}
+	return uint16(n), nil
+}
+
 // readName reads a DNS name from a reader with compression support.
 func readName(r io.ReadSeeker) (Name, error) {
 	var labels [][]byte
@@ -285,11 +445,26 @@ func readRR(r io.ReadSeeker) (RR, error) {
 		return rr, err
 	}
 
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return rr, err
+	}
+
 	rr.Data = make([]byte, rdLength)
 	if _, err := io.ReadFull(r, rr.Data); err != nil {
 		return rr, err
 	}
 
+	// Names in the record data may be compressed against this message;
+	// expand them so the record stays valid in any other message
+	expanded, err := expandRData(r, rr.Type, start, int64(rdLength))
+	if err != nil {
+		return rr, err
+	}
+	if expanded != nil {
+		rr.Data = expanded
+	}
+
 	return rr, nil
 }
 
@@ -527,7 +702,8 @@ func CreateResponse(query *Message) *Message {
 	return resp
 }
 
-// AddEDNS0 adds an EDNS0 OPT record to the message.
+// AddEDNS0 adds an EDNS0 OPT record without flags or options to the
+// message. SetEDNS0 sets flags and options.
 func (m *Message) AddEDNS0(udpSize uint16) {
 	m.Additional = append(m.Additional, RR{
 		Name:  Name{},
@@ -538,6 +714,38 @@ func (m *Message) AddEDNS0(udpSize uint16) {
 	})
 }
 
+// StripEDNSOptions removes all options except those with codes in keep
+// from the message's OPT record and returns the number removed. Malformed
+// option data is removed as well.
+func (m *Message) StripEDNSOptions(keep []uint16) int {
+	removed := 0
+	for i := range m.Additional {
+		rr := &m.Additional[i]
+		if rr.Type != RRTypeOPT {
+			continue
+		}
+
+		var kept []byte
+		data := rr.Data
+		for len(data) > 0 {
+			if len(data) < 4 || len(data) < 4+int(binary.BigEndian.Uint16(data[2:4])) {
+				removed++
+				break
+			}
+			code := binary.BigEndian.Uint16(data[0:2])
+			n := 4 + int(binary.BigEndian.Uint16(data[2:4]))
+			if slices.Contains(keep, code) {
+				kept = append(kept, data[:n]...)
+			} else {
+				removed++
+			}
+			data = data[n:]
+		}
+		rr.Data = kept
+	}
+	return removed
+}
+
 // GetEDNS0Size returns the EDNS0 UDP payload size, or 0 if not present.
 func (m *Message) GetEDNS0Size() uint16 {
 	for _, rr := range m.Additional {
@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -320,3 +321,144 @@ func TestTXTData(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRcode(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint16
+		wantErr bool
+	}{
+		{input: "REFUSED", want: RcodeRefused},
+		{input: "nxdomain", want: RcodeNameError},
+		{input: " SERVFAIL ", want: RcodeServerFail},
+		{input: "9", want: 9},
+		{input: "16", wantErr: true},
+		{input: "BOGUS", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseRcode(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRcode(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseRcode(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRcodeString(t *testing.T) {
+	if got := RcodeString(RcodeNameError); got != "NXDOMAIN" {
+		t.Errorf("RcodeString(3) = %s, want NXDOMAIN", got)
+	}
+	if got := RcodeString(9); got != "9" {
+		t.Errorf("RcodeString(9) = %s, want 9", got)
+	}
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint16
+		wantErr bool
+	}{
+		{input: "AAAA", want: RRTypeAAAA},
+		{input: " https ", want: RRTypeHTTPS},
+		{input: "99", want: 99},
+		{input: "TYPE65", want: RRTypeHTTPS},
+		{input: "type99", want: 99},
+		{input: "0", wantErr: true},
+		{input: "65536", wantErr: true},
+		{input: "BOGUS", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseType(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseType(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseType(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEDNSOption(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint16
+		wantErr bool
+	}{
+		{input: "ECS", want: EDNSOptionClientSubnet},
+		{input: " cookie ", want: EDNSOptionCookie},
+		{input: "65001", want: 65001},
+		{input: "65536", wantErr: true},
+		{input: "BOGUS", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseEDNSOption(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEDNSOption(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseEDNSOption(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripEDNSOptions(t *testing.T) {
+	option := func(code uint16, data ...byte) []byte {
+		return append([]byte{byte(code >> 8), byte(code), 0, byte(len(data))}, data...)
+	}
+	ecs := option(EDNSOptionClientSubnet, 0, 1, 24, 0, 198, 51, 100)
+	cookie := option(EDNSOptionCookie, 1, 2, 3, 4, 5, 6, 7, 8)
+	padding := option(EDNSOptionPadding, 0, 0, 0)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		keep        []uint16
+		want        []byte
+		wantRemoved int
+	}{
+		{"strip all", bytes.Join([][]byte{ecs, cookie, padding}, nil), nil, nil, 3},
+		{"keep cookie", bytes.Join([][]byte{ecs, cookie, padding}, nil), []uint16{EDNSOptionCookie}, cookie, 2},
+		{"no options", nil, nil, nil, 0},
+		{"malformed", append(bytes.Clone(cookie), 0, 8, 0, 9, 1), []uint16{EDNSOptionCookie}, cookie, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := CreateQuery(Name{[]byte("example"), []byte("com")}, RRTypeA, 1)
+			msg.AddEDNS0(1232)
+			msg.Additional[0].Data = tt.data
+
+			if got := msg.StripEDNSOptions(tt.keep); got != tt.wantRemoved {
+				t.Errorf("StripEDNSOptions() = %d, want %d", got, tt.wantRemoved)
+			}
+			if !bytes.Equal(msg.Additional[0].Data, tt.want) {
+				t.Errorf("Options: got %x, want %x", msg.Additional[0].Data, tt.want)
+			}
+			if msg.GetEDNS0Size() != 1232 {
+				t.Errorf("EDNS0 size changed to %d", msg.GetEDNS0Size())
+			}
+
+			// The stripped message still marshals and parses
+			data, err := msg.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if _, err := ParseMessage(data); err != nil {
+				t.Errorf("ParseMessage() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package dns
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presentation formats of the DNSSEC, TLSA, SSHFP, NAPTR and SVCB/HTTPS
+// records, which upstreams of the JSON dialect return for the types
+// clients ask about most after the basic ones.
+
+// sigTimeLayout is the YYYYMMDDHHmmSS form of RRSIG times (RFC 4034
+// section 3.2).
+const sigTimeLayout = "20060102150405"
+
+// formatRRSIG returns RRSIG data in presentation format.
+func formatRRSIG(sig RRSIG) string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s %s", TypeString(sig.TypeCovered),
+		sig.Algorithm, sig.Labels, sig.OriginalTTL, formatSigTime(sig.Expiration),
+		formatSigTime(sig.Inception), sig.KeyTag, FormatName(sig.SignerName),
+		base64.StdEncoding.EncodeToString(sig.Signature))
+}
+
+// formatSigTime returns an RRSIG time as YYYYMMDDHHmmSS.
+func formatSigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(sigTimeLayout)
+}
+
+// parseRRSIG parses RRSIG data; the signature may be split into several
+// fields.
+func parseRRSIG(fields []string) ([]byte, error) {
+	if len(fields) < 9 {
+		return nil, ErrInvalidRData
+	}
+	covered, err := ParseType(fields[0])
+	if err != nil {
+		return nil, ErrInvalidRData
+	}
+	nums, err := parseUints(fields[1:4], 8, 8, 32)
+	if err != nil {
+		return nil, err
+	}
+	expiration, err := parseSigTime(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	inception, err := parseSigTime(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	keyTag, err := strconv.ParseUint(fields[6], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidRData
+	}
+	signer, err := parseFormattedName(fields[7])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.Join(fields[8:], ""))
+	if err != nil {
+		return nil, ErrInvalidRData
+	}
+	return EncodeRRSIGData(RRSIG{
+		TypeCovered: covered, Algorithm: uint8(nums[0]), Labels: uint8(nums[1]),
+		OriginalTTL: uint32(nums[2]), Expiration: expiration, Inception: inception,
+		KeyTag: uint16(keyTag), SignerName: signer, Signature: signature,
+	}), nil
+}
+
+// parseSigTime parses an RRSIG time given as YYYYMMDDHHmmSS or as seconds
+// since the epoch.
+func parseSigTime(s string) (uint32, error) {
+	if len(s) == len(sigTimeLayout) && isDecimal(s) {
+		t, err := time.Parse(sigTimeLayout, s)
+		if err != nil || t.Unix() < 0 {
+			return 0, ErrInvalidRData
+		}
+		// Times past 2106 wrap around (RFC 4034 section 3.1.5)
+		return uint32(t.Unix()), nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, ErrInvalidRData
+	}
+	return uint32(n), nil
+}
+
+// parseUints parses decimal fields of the given bit sizes.
+func parseUints(fields []string, bitSizes ...int) ([]uint64, error) {
+	if len(fields) < len(bitSizes) {
+		return nil, ErrInvalidRData
+	}
+	nums := make([]uint64, len(bitSizes))
+	for i, bits := range bitSizes {
+		n, err := strconv.ParseUint(fields[i], 10, bits)
+		if err != nil {
+			return nil, ErrInvalidRData
+		}
+		nums[i] = n
+	}
+	return nums, nil
+}
+
+// parseHexFields parses hex data that may be split into several fields.
+func parseHexFields(fields []string) ([]byte, error) {
+	data, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return nil, ErrInvalidRData
+	}
+	return data, nil
+}
+
+// parseDS parses DS data: key tag, algorithm, digest type and digest.
+func parseDS(fields []string) ([]byte, error) {
+	nums, err := parseUints(fields, 16, 8, 8)
+	if err != nil || len(fields) < 4 {
+		return nil, ErrInvalidRData
+	}
+	digest, err := parseHexFields(fields[3:])
+	if err != nil {
+		return nil, err
+	}
+	return EncodeDSData(DS{
+		KeyTag: uint16(nums[0]), Algorithm: uint8(nums[1]), DigestType: uint8(nums[2]), Digest: digest,
+	}), nil
+}
+
+// parseDNSKEY parses DNSKEY data: flags, protocol, algorithm and the
+// public key in base64.
+func parseDNSKEY(fields []string) ([]byte, error) {
+	nums, err := parseUints(fields, 16, 8, 8)
+	if err != nil || len(fields) < 4 {
+		return nil, ErrInvalidRData
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, ErrInvalidRData
+	}
+	return EncodeDNSKEYData(DNSKEY{
+		Flags: uint16(nums[0]), Protocol: uint8(nums[1]), Algorithm: uint8(nums[2]), PublicKey: key,
+	}), nil
+}
+
+// parseTLSA parses TLSA data: usage, selector, matching type and the
+// certificate association data.
+func parseTLSA(fields []string) ([]byte, error) {
+	nums, err := parseUints(fields, 8, 8, 8)
+	if err != nil || len(fields) < 4 {
+		return nil, ErrInvalidRData
+	}
+	data, err := parseHexFields(fields[3:])
+	if err != nil {
+		return nil, err
+	}
+	return EncodeTLSAData(TLSA{
+		Usage: uint8(nums[0]), Selector: uint8(nums[1]), MatchingType: uint8(nums[2]), Data: data,
+	}), nil
+}
+
+// parseSSHFP parses SSHFP data: algorithm, fingerprint type and
+// fingerprint.
+func parseSSHFP(fields []string) ([]byte, error) {
+	nums, err := parseUints(fields, 8, 8)
+	if err != nil || len(fields) < 3 {
+		return nil, ErrInvalidRData
+	}
+	fp, err := parseHexFields(fields[2:])
+	if err != nil {
+		return nil, err
+	}
+	return EncodeSSHFPData(SSHFP{Algorithm: uint8(nums[0]), Type: uint8(nums[1]), Fingerprint: fp}), nil
+}
+
+// parseNAPTR parses NAPTR data: order, preference, the flags, services
+// and regexp strings and the replacement name.
+func parseNAPTR(fields []string) ([]byte, error) {
+	nums, err := parseUints(fields, 16, 16)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range fields[2:5] {
+		if len(s) > 255 {
+			return nil, ErrInvalidRData
+		}
+	}
+	replacement, err := parseFormattedName(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return EncodeNAPTRData(NAPTR{
+		Order: uint16(nums[0]), Preference: uint16(nums[1]),
+		Flags: []byte(fields[2]), Services: []byte(fields[3]), Regexp: []byte(fields[4]),
+		Replacement: replacement,
+	}), nil
+}
+
+// SvcParamKeys (RFC 9460 section 14.3.2)
+const (
+	svcParamMandatory     uint16 = 0
+	svcParamALPN          uint16 = 1
+	svcParamNoDefaultALPN uint16 = 2
+	svcParamPort          uint16 = 3
+	svcParamIPv4Hint      uint16 = 4
+	svcParamECH           uint16 = 5
+	svcParamIPv6Hint      uint16 = 6
+)
+
+// svcParamNames maps SvcParamKey mnemonics to keys.
+var svcParamNames = map[string]uint16{
+	"mandatory":       svcParamMandatory,
+	"alpn":            svcParamALPN,
+	"no-default-alpn": svcParamNoDefaultALPN,
+	"port":            svcParamPort,
+	"ipv4hint":        svcParamIPv4Hint,
+	"ech":             svcParamECH,
+	"ipv6hint":        svcParamIPv6Hint,
+	"dohpath":         7,
+}
+
+// svcParamName returns the mnemonic of an SvcParamKey, or key and its
+// number if it has none.
+func svcParamName(key uint16) string {
+	for name, value := range svcParamNames {
+		if value == key {
+			return name
+		}
+	}
+	return "key" + strconv.Itoa(int(key))
+}
+
+// parseSvcParamKey parses an SvcParamKey mnemonic or keyNNNNN.
+func parseSvcParamKey(s string) (uint16, error) {
+	if key, ok := svcParamNames[s]; ok {
+		return key, nil
+	}
+	digits, ok := strings.CutPrefix(s, "key")
+	if !ok || !isDecimal(digits) {
+		return 0, fmt.Errorf("%w: unknown SvcParamKey %q", ErrInvalidRData, s)
+	}
+	key, err := strconv.ParseUint(digits, 10, 16)
+	if err != nil || key == 65535 {
+		return 0, ErrInvalidRData
+	}
+	return uint16(key), nil
+}
+
+// formatSVCB returns SVCB or HTTPS data in presentation format, or false
+// if its SvcParams are malformed or have a value that can't be written
+// without the escapes of RFC 9460 appendix A.
+func formatSVCB(svcb SVCB) (string, bool) {
+	out := []string{strconv.Itoa(int(svcb.Priority)), FormatName(svcb.Target)}
+	params := svcb.Params
+	for len(params) > 0 {
+		if len(params) < 4 {
+			return "", false
+		}
+		key := binary.BigEndian.Uint16(params)
+		length := int(binary.BigEndian.Uint16(params[2:]))
+		if len(params) < 4+length {
+			return "", false
+		}
+		param, ok := formatSvcParam(key, params[4:4+length])
+		if !ok {
+			return "", false
+		}
+		out = append(out, param)
+		params = params[4+length:]
+	}
+	return strings.Join(out, " "), true
+}
+
+// formatSvcParam returns an SvcParam as key=value.
+func formatSvcParam(key uint16, value []byte) (string, bool) {
+	name := svcParamName(key)
+	var values []string
+	switch key {
+	case svcParamMandatory:
+		if len(value) == 0 || len(value)%2 != 0 {
+			return "", false
+		}
+		for i := 0; i < len(value); i += 2 {
+			values = append(values, svcParamName(binary.BigEndian.Uint16(value[i:])))
+		}
+	case svcParamALPN:
+		ids, ok := characterStrings(value)
+		if !ok || len(ids) == 0 {
+			return "", false
+		}
+		for _, id := range ids {
+			if len(id) == 0 || strings.ContainsFunc(string(id), func(c rune) bool {
+				return c <= 0x20 || c > 0x7e || c == ',' || c == '\\' || c == '"'
+			}) {
+				return "", false
+			}
+			values = append(values, string(id))
+		}
+	case svcParamNoDefaultALPN:
+		return name, len(value) == 0
+	case svcParamPort:
+		if len(value) != 2 {
+			return "", false
+		}
+		values = append(values, strconv.Itoa(int(binary.BigEndian.Uint16(value))))
+	case svcParamIPv4Hint, svcParamIPv6Hint:
+		size := 4
+		if key == svcParamIPv6Hint {
+			size = 16
+		}
+		if len(value) == 0 || len(value)%size != 0 {
+			return "", false
+		}
+		for i := 0; i < len(value); i += size {
+			addr, _ := netip.AddrFromSlice(value[i : i+size])
+			values = append(values, addr.String())
+		}
+	case svcParamECH:
+		values = append(values, base64.StdEncoding.EncodeToString(value))
+	default:
+		if len(value) == 0 {
+			return name, true
+		}
+		return name + "=" + quoteString(value), true
+	}
+	return name + "=" + strings.Join(values, ","), true
+}
+
+// parseSVCB parses SVCB or HTTPS data: priority, target and SvcParams as
+// key=value, with the value optionally quoted.
+func parseSVCB(fields []string) ([]byte, error) {
+	if len(fields) < 2 {
+		return nil, ErrInvalidRData
+	}
+	priority, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidRData
+	}
+	target, err := parseFormattedName(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	type svcParam struct {
+		key   uint16
+		value []byte
+	}
+	var params []svcParam
+	for _, field := range fields[2:] {
+		name, value, hasValue := strings.Cut(field, "=")
+		key, err := parseSvcParamKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := presentationFields(value)
+			if err != nil || len(unquoted) != 1 {
+				return nil, ErrInvalidRData
+			}
+			value = unquoted[0]
+		}
+		data, err := parseSvcParam(key, value, hasValue)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, svcParam{key, data})
+	}
+
+	// SvcParams are in increasing key order, each at most once
+	slices.SortFunc(params, func(a, b svcParam) int { return cmp.Compare(a.key, b.key) })
+	var wire []byte
+	for i, p := range params {
+		if i > 0 && params[i-1].key == p.key || len(p.value) > 0xffff {
+			return nil, ErrInvalidRData
+		}
+		wire = binary.BigEndian.AppendUint16(wire, p.key)
+		wire = binary.BigEndian.AppendUint16(wire, uint16(len(p.value)))
+		wire = append(wire, p.value...)
+	}
+	return EncodeSVCBData(SVCB{Priority: uint16(priority), Target: target, Params: wire}), nil
+}
+
+// parseSvcParam returns the wire format of an SvcParam value.
+func parseSvcParam(key uint16, value string, hasValue bool) ([]byte, error) {
+	if key == svcParamNoDefaultALPN {
+		if hasValue {
+			return nil, ErrInvalidRData
+		}
+		return nil, nil
+	}
+	if !hasValue {
+		if key <= svcParamIPv6Hint {
+			return nil, ErrInvalidRData
+		}
+		return nil, nil
+	}
+
+	var data []byte
+	switch key {
+	case svcParamMandatory:
+		for _, name := range strings.Split(value, ",") {
+			k, err := parseSvcParamKey(name)
+			if err != nil {
+				return nil, err
+			}
+			data = binary.BigEndian.AppendUint16(data, k)
+		}
+	case svcParamALPN:
+		for _, id := range strings.Split(value, ",") {
+			if id == "" || len(id) > 255 {
+				return nil, ErrInvalidRData
+			}
+			data = append(data, byte(len(id)))
+			data = append(data, id...)
+		}
+	case svcParamPort:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, ErrInvalidRData
+		}
+		data = binary.BigEndian.AppendUint16(nil, uint16(port))
+	case svcParamIPv4Hint, svcParamIPv6Hint:
+		for _, s := range strings.Split(value, ",") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil || addr.Zone() != "" || addr.Is4() != (key == svcParamIPv4Hint) {
+				return nil, ErrInvalidRData
+			}
+			data = append(data, addr.AsSlice()...)
+		}
+	case svcParamECH:
+		ech, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, ErrInvalidRData
+		}
+		data = ech
+	default:
+		data = []byte(value)
+	}
+	return data, nil
+}
@@ -0,0 +1,389 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+var ErrInvalidRData = errors.New("invalid record data")
+
+// MX is the data of an MX record.
+type MX struct {
+	Preference uint16
+	Exchange   Name
+}
+
+// SRV is the data of an SRV record.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   Name
+}
+
+// SOA is the data of an SOA record.
+type SOA struct {
+	MName   Name
+	RName   Name
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// CAA is the data of a CAA record.
+type CAA struct {
+	Flags uint8
+	Tag   string
+	Value []byte
+}
+
+// SVCB is the data of an SVCB or HTTPS record. Params holds the
+// SvcParams in wire format.
+type SVCB struct {
+	Priority uint16
+	Target   Name
+	Params   []byte
+}
+
+// TLSA is the data of a TLSA record.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// SSHFP is the data of an SSHFP record.
+type SSHFP struct {
+	Algorithm   uint8
+	Type        uint8
+	Fingerprint []byte
+}
+
+// NAPTR is the data of a NAPTR record.
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       []byte
+	Services    []byte
+	Regexp      []byte
+	Replacement Name
+}
+
+// rdataLayout describes where names appear in the data of record types
+// whose names may be compressed: a fixed-size prefix, then names.
+var rdataLayout = map[uint16]struct{ prefix, names int }{
+	RRTypeNS:    {0, 1},
+	RRTypeCNAME: {0, 1},
+	RRTypePTR:   {0, 1},
+	RRTypeSOA:   {0, 2},
+	RRTypeMX:    {2, 1},
+	RRTypeSRV:   {6, 1},
+}
+
+// expandRData returns the data of the record at start in r with compressed
+// names expanded, or nil if the record type has no compressible names.
+func expandRData(r io.ReadSeeker, rrType uint16, start, length int64) ([]byte, error) {
+	layout, ok := rdataLayout[rrType]
+	if !ok {
+		return nil, nil
+	}
+	end := start + length
+
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if int64(layout.prefix) > length {
+		return nil, ErrInvalidRData
+	}
+	data := make([]byte, layout.prefix)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < layout.names; i++ {
+		name, err := readName(r)
+		if err != nil {
+			return nil, err
+		}
+		data = appendName(data, name)
+	}
+
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if pos > end {
+		return nil, ErrInvalidRData
+	}
+	rest := make([]byte, end-pos)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	return append(data, rest...), nil
+}
+
+// appendName appends the uncompressed wire format of name to b.
+func appendName(b []byte, name Name) []byte {
+	for _, label := range name {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// decodeName reads an uncompressed name from the start of data and returns
+// it with the remaining data.
+func decodeName(data []byte) (Name, []byte, error) {
+	var labels [][]byte
+	for {
+		if len(data) == 0 {
+			return nil, nil, ErrInvalidRData
+		}
+		length := int(data[0])
+		data = data[1:]
+		if length == 0 {
+			name, err := NewName(labels)
+			return name, data, err
+		}
+		if length&0xc0 != 0 || len(data) < length {
+			return nil, nil, ErrInvalidRData
+		}
+		labels = append(labels, data[:length])
+		data = data[length:]
+	}
+}
+
+// EncodeNameData encodes the data of an NS, CNAME or PTR record.
+func EncodeNameData(name Name) []byte {
+	return appendName(nil, name)
+}
+
+// DecodeNameData decodes the data of an NS, CNAME or PTR record.
+func DecodeNameData(data []byte) (Name, error) {
+	name, rest, err := decodeName(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrInvalidRData
+	}
+	return name, nil
+}
+
+// EncodeAddrData encodes the data of an A or AAAA record.
+func EncodeAddrData(addr netip.Addr) []byte {
+	return addr.AsSlice()
+}
+
+// DecodeAddrData decodes the data of an A or AAAA record.
+func DecodeAddrData(data []byte) (netip.Addr, error) {
+	addr, ok := netip.AddrFromSlice(data)
+	if !ok {
+		return netip.Addr{}, ErrInvalidRData
+	}
+	return addr, nil
+}
+
+// EncodeMXData encodes the data of an MX record.
+func EncodeMXData(mx MX) []byte {
+	data := binary.BigEndian.AppendUint16(nil, mx.Preference)
+	return appendName(data, mx.Exchange)
+}
+
+// DecodeMXData decodes the data of an MX record.
+func DecodeMXData(data []byte) (MX, error) {
+	if len(data) < 2 {
+		return MX{}, ErrInvalidRData
+	}
+	name, err := DecodeNameData(data[2:])
+	if err != nil {
+		return MX{}, err
+	}
+	return MX{Preference: binary.BigEndian.Uint16(data), Exchange: name}, nil
+}
+
+// EncodeSRVData encodes the data of an SRV record.
+func EncodeSRVData(srv SRV) []byte {
+	data := binary.BigEndian.AppendUint16(nil, srv.Priority)
+	data = binary.BigEndian.AppendUint16(data, srv.Weight)
+	data = binary.BigEndian.AppendUint16(data, srv.Port)
+	return appendName(data, srv.Target)
+}
+
+// DecodeSRVData decodes the data of an SRV record.
+func DecodeSRVData(data []byte) (SRV, error) {
+	if len(data) < 6 {
+		return SRV{}, ErrInvalidRData
+	}
+	name, err := DecodeNameData(data[6:])
+	if err != nil {
+		return SRV{}, err
+	}
+	return SRV{
+		Priority: binary.BigEndian.Uint16(data[0:2]),
+		Weight:   binary.BigEndian.Uint16(data[2:4]),
+		Port:     binary.BigEndian.Uint16(data[4:6]),
+		Target:   name,
+	}, nil
+}
+
+// EncodeSOAData encodes the data of an SOA record.
+func EncodeSOAData(soa SOA) []byte {
+	data := appendName(nil, soa.MName)
+	data = appendName(data, soa.RName)
+	for _, v := range []uint32{soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return data
+}
+
+// DecodeSOAData decodes the data of an SOA record.
+func DecodeSOAData(data []byte) (SOA, error) {
+	var soa SOA
+	var err error
+	if soa.MName, data, err = decodeName(data); err != nil {
+		return SOA{}, err
+	}
+	if soa.RName, data, err = decodeName(data); err != nil {
+		return SOA{}, err
+	}
+	if len(data) != 20 {
+		return SOA{}, ErrInvalidRData
+	}
+	soa.Serial = binary.BigEndian.Uint32(data[0:4])
+	soa.Refresh = binary.BigEndian.Uint32(data[4:8])
+	soa.Retry = binary.BigEndian.Uint32(data[8:12])
+	soa.Expire = binary.BigEndian.Uint32(data[12:16])
+	soa.Minimum = binary.BigEndian.Uint32(data[16:20])
+	return soa, nil
+}
+
+// EncodeCAAData encodes the data of a CAA record.
+func EncodeCAAData(caa CAA) []byte {
+	data := []byte{caa.Flags, byte(len(caa.Tag))}
+	data = append(data, caa.Tag...)
+	return append(data, caa.Value...)
+}
+
+// DecodeCAAData decodes the data of a CAA record.
+func DecodeCAAData(data []byte) (CAA, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) || data[1] == 0 {
+		return CAA{}, ErrInvalidRData
+	}
+	tagEnd := 2 + int(data[1])
+	return CAA{
+		Flags: data[0],
+		Tag:   string(data[2:tagEnd]),
+		Value: data[tagEnd:],
+	}, nil
+}
+
+// EncodeSVCBData encodes the data of an SVCB or HTTPS record.
+func EncodeSVCBData(svcb SVCB) []byte {
+	data := binary.BigEndian.AppendUint16(nil, svcb.Priority)
+	data = appendName(data, svcb.Target)
+	return append(data, svcb.Params...)
+}
+
+// DecodeSVCBData decodes the data of an SVCB or HTTPS record.
+func DecodeSVCBData(data []byte) (SVCB, error) {
+	if len(data) < 2 {
+		return SVCB{}, ErrInvalidRData
+	}
+	name, params, err := decodeName(data[2:])
+	if err != nil {
+		return SVCB{}, err
+	}
+	return SVCB{Priority: binary.BigEndian.Uint16(data), Target: name, Params: params}, nil
+}
+
+// EncodeTLSAData encodes the data of a TLSA record.
+func EncodeTLSAData(tlsa TLSA) []byte {
+	data := []byte{tlsa.Usage, tlsa.Selector, tlsa.MatchingType}
+	return append(data, tlsa.Data...)
+}
+
+// DecodeTLSAData decodes the data of a TLSA record.
+func DecodeTLSAData(data []byte) (TLSA, error) {
+	if len(data) < 3 {
+		return TLSA{}, ErrInvalidRData
+	}
+	return TLSA{Usage: data[0], Selector: data[1], MatchingType: data[2], Data: data[3:]}, nil
+}
+
+// EncodeSSHFPData encodes the data of an SSHFP record.
+func EncodeSSHFPData(fp SSHFP) []byte {
+	return append([]byte{fp.Algorithm, fp.Type}, fp.Fingerprint...)
+}
+
+// DecodeSSHFPData decodes the data of an SSHFP record.
+func DecodeSSHFPData(data []byte) (SSHFP, error) {
+	if len(data) < 2 {
+		return SSHFP{}, ErrInvalidRData
+	}
+	return SSHFP{Algorithm: data[0], Type: data[1], Fingerprint: data[2:]}, nil
+}
+
+// EncodeNAPTRData encodes the data of a NAPTR record. Flags, Services
+// and Regexp must be at most 255 bytes long.
+func EncodeNAPTRData(naptr NAPTR) []byte {
+	data := binary.BigEndian.AppendUint16(nil, naptr.Order)
+	data = binary.BigEndian.AppendUint16(data, naptr.Preference)
+	for _, s := range [][]byte{naptr.Flags, naptr.Services, naptr.Regexp} {
+		data = append(data, byte(len(s)))
+		data = append(data, s...)
+	}
+	return appendName(data, naptr.Replacement)
+}
+
+// DecodeNAPTRData decodes the data of a NAPTR record.
+func DecodeNAPTRData(data []byte) (NAPTR, error) {
+	if len(data) < 4 {
+		return NAPTR{}, ErrInvalidRData
+	}
+	naptr := NAPTR{Order: binary.BigEndian.Uint16(data), Preference: binary.BigEndian.Uint16(data[2:])}
+	data = data[4:]
+	for _, s := range []*[]byte{&naptr.Flags, &naptr.Services, &naptr.Regexp} {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return NAPTR{}, ErrInvalidRData
+		}
+		*s = data[1 : 1+int(data[0])]
+		data = data[1+int(data[0]):]
+	}
+	name, err := DecodeNameData(data)
+	if err != nil {
+		return NAPTR{}, err
+	}
+	naptr.Replacement = name
+	return naptr, nil
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name used for PTR
+// queries of addr.
+func ReverseName(addr netip.Addr) Name {
+	addr = addr.Unmap()
+	var labels []string
+	if addr.Is4() {
+		b := addr.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(b[i]))
+		}
+		labels = append(labels, "in-addr", "arpa")
+	} else {
+		b := addr.As16()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", b[i]&0xf), fmt.Sprintf("%x", b[i]>>4))
+		}
+		labels = append(labels, "ip6", "arpa")
+	}
+	name, _ := ParseName(strings.Join(labels, "."))
+	return name
+}
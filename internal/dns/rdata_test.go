@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestRDataRoundTrip(t *testing.T) {
+	mx := MX{Preference: 10, Exchange: mustParseName("mail.example.com")}
+	if got, err := DecodeMXData(EncodeMXData(mx)); err != nil || !reflect.DeepEqual(got, mx) {
+		t.Errorf("MX: got %+v, %v", got, err)
+	}
+
+	srv := SRV{Priority: 1, Weight: 5, Port: 5060, Target: mustParseName("sip.example.com")}
+	if got, err := DecodeSRVData(EncodeSRVData(srv)); err != nil || !reflect.DeepEqual(got, srv) {
+		t.Errorf("SRV: got %+v, %v", got, err)
+	}
+
+	soa := SOA{
+		MName: mustParseName("ns1.example.com"), RName: mustParseName("hostmaster.example.com"),
+		Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+	}
+	if got, err := DecodeSOAData(EncodeSOAData(soa)); err != nil || !reflect.DeepEqual(got, soa) {
+		t.Errorf("SOA: got %+v, %v", got, err)
+	}
+
+	caa := CAA{Flags: 0, Tag: "issue", Value: []byte("letsencrypt.org")}
+	if got, err := DecodeCAAData(EncodeCAAData(caa)); err != nil || !reflect.DeepEqual(got, caa) {
+		t.Errorf("CAA: got %+v, %v", got, err)
+	}
+
+	https := SVCB{Priority: 1, Target: mustParseName("svc.example.com"), Params: []byte{0, 1, 0, 3, 2, 'h', '2'}}
+	if got, err := DecodeSVCBData(EncodeSVCBData(https)); err != nil || !reflect.DeepEqual(got, https) {
+		t.Errorf("HTTPS: got %+v, %v", got, err)
+	}
+
+	ns := mustParseName("ns1.example.com")
+	if got, err := DecodeNameData(EncodeNameData(ns)); err != nil || !reflect.DeepEqual(got, ns) {
+		t.Errorf("NS: got %v, %v", got, err)
+	}
+
+	for _, s := range []string{"192.0.2.1", "2001:db8::1"} {
+		addr := netip.MustParseAddr(s)
+		if got, err := DecodeAddrData(EncodeAddrData(addr)); err != nil || got != addr {
+			t.Errorf("Addr %s: got %v, %v", s, got, err)
+		}
+	}
+}
+
+func TestRDataInvalid(t *testing.T) {
+	if _, err := DecodeMXData([]byte{0}); err != ErrInvalidRData {
+		t.Errorf("Short MX: got %v", err)
+	}
+	// Compression pointers are not allowed in expanded data
+	if _, err := DecodeNameData([]byte{0xc0, 0x0c}); err != ErrInvalidRData {
+		t.Errorf("Pointer: got %v", err)
+	}
+	if _, err := DecodeSOAData(EncodeSOAData(SOA{})[:5]); err != ErrInvalidRData {
+		t.Errorf("Short SOA: got %v", err)
+	}
+	if _, err := DecodeCAAData([]byte{0, 9, 'i'}); err != ErrInvalidRData {
+		t.Errorf("Short CAA: got %v", err)
+	}
+	if _, err := DecodeAddrData([]byte{1, 2, 3}); err != ErrInvalidRData {
+		t.Errorf("Short address: got %v", err)
+	}
+}
+
+func TestParseMessageExpandsCompressedRData(t *testing.T) {
+	// Response to "example.com MX" with the exchange compressed against
+	// the question name, as upstream servers send it
+	msg := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		// Question at offset 12: example.com MX IN
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 15, 0, 1,
+		// Answer: pointer to the question name, MX IN, TTL 300
+		0xc0, 12, 0, 15, 0, 1, 0, 0, 1, 44,
+		// RDATA: preference 10, "mail" + pointer to example.com
+		0, 9, 0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, 12,
+	}
+
+	parsed, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	want := MX{Preference: 10, Exchange: mustParseName("mail.example.com")}
+	if got, err := DecodeMXData(parsed.Answer[0].Data); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("MX: got %+v, %v", got, err)
+	}
+
+	// The record stays valid after re-marshaling into a different layout
+	parsed.Question[0].Name = mustParseName("other.example.net")
+	data, err := parsed.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	reparsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if !bytes.Equal(reparsed.Answer[0].Data, parsed.Answer[0].Data) {
+		t.Errorf("RDATA changed: got %x, want %x", reparsed.Answer[0].Data, parsed.Answer[0].Data)
+	}
+
+	// RDATA shorter than its names is rejected
+	bad := bytes.Clone(msg)
+	bad[len(bad)-10] = 4 // RDLENGTH
+	if _, err := ParseMessage(bad); err == nil {
+		t.Error("Expected error for truncated RDATA")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"::ffff:192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, tt := range tests {
+		if got := ReverseName(netip.MustParseAddr(tt.addr)).String(); got != tt.want {
+			t.Errorf("ReverseName(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
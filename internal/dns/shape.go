@@ -0,0 +1,196 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// StealthLevel controls how encoded query names are shaped to resemble
+// ordinary hostnames.
+type StealthLevel int
+
+const (
+	// StealthOff splits encoded data into maximum-length labels
+	StealthOff StealthLevel = iota
+
+	// StealthLow varies label lengths
+	StealthLow
+
+	// StealthMedium uses shorter labels and adds a dictionary word
+	StealthMedium
+
+	// StealthHigh uses short labels and adds several dictionary words
+	StealthHigh
+)
+
+// stealthShape is the label shape of a stealth level: the range of data
+// label lengths and the number of dictionary words added.
+type stealthShape struct {
+	minLen, maxLen int
+	words          int
+}
+
+var stealthShapes = map[StealthLevel]stealthShape{
+	StealthLow:    {minLen: 24, maxLen: MaxLabelLength},
+	StealthMedium: {minLen: 8, maxLen: 32, words: 1},
+	StealthHigh:   {minLen: 3, maxLen: 20, words: 3},
+}
+
+// shapeWords are the labels added between data labels. Decoding drops any
+// label in this list, so the encoder never emits one as a data label.
+var shapeWords = []string{
+	"account", "ads", "analytics", "api", "app", "assets", "auth", "beta",
+	"blog", "cache", "cdn", "chat", "cloud", "content", "data", "dev",
+	"docs", "download", "east", "edge", "files", "help", "images", "img",
+	"live", "login", "mail", "media", "metrics", "news", "node", "origin",
+	"portal", "prod", "proxy", "push", "search", "secure", "service", "shop",
+	"stage", "static", "status", "stream", "support", "sync", "track",
+	"update", "video", "web", "west", "www",
+}
+
+// maxWordLength is the length of the longest word in shapeWords.
+const maxWordLength = 9
+
+var shapeWordSet = func() map[string]bool {
+	set := make(map[string]bool, len(shapeWords))
+	for _, w := range shapeWords {
+		set[w] = true
+	}
+	return set
+}()
+
+// ParseStealthLevel parses a stealth level name (off, low, medium, high)
+// or number.
+func ParseStealthLevel(s string) (StealthLevel, error) {
+	switch strings.ToLower(s) {
+	case "off", "0":
+		return StealthOff, nil
+	case "low", "1":
+		return StealthLow, nil
+	case "medium", "2":
+		return StealthMedium, nil
+	case "high", "3":
+		return StealthHigh, nil
+	}
+	return StealthOff, fmt.Errorf("invalid stealth level %q", s)
+}
+
+// String returns the name of the stealth level.
+func (l StealthLevel) String() string {
+	switch l {
+	case StealthOff:
+		return "off"
+	case StealthLow:
+		return "low"
+	case StealthMedium:
+		return "medium"
+	case StealthHigh:
+		return "high"
+	}
+	return fmt.Sprintf("StealthLevel(%d)", int(l))
+}
+
+// isShapeWord reports whether label is a dictionary word. Resolvers may
+// change the case of query names, so the comparison ignores case.
+func isShapeWord(label []byte) bool {
+	if len(label) > maxWordLength {
+		return false
+	}
+	return shapeWordSet[string(bytes.ToLower(label))]
+}
+
+// shapeLabels splits encoded data into labels shaped for the stealth
+// level, using at most room bytes of name (labels and their length bytes).
+// The shape is relaxed, down to plain maximum-length labels, until it fits.
+func shapeLabels(encoded []byte, room int, level StealthLevel) [][]byte {
+	shape, ok := stealthShapes[level]
+	for ok {
+		for attempt := 0; attempt < 4; attempt++ {
+			if labels := shapeOnce(encoded, room, shape); labels != nil {
+				return labels
+			}
+		}
+
+		// Relax the shape: drop a word, then lengthen labels
+		switch {
+		case shape.words > 0:
+			shape.words--
+		case shape.maxLen < MaxLabelLength:
+			shape.minLen = min(shape.minLen*2, MaxLabelLength)
+			shape.maxLen = min(shape.maxLen*2, MaxLabelLength)
+		default:
+			ok = false
+		}
+	}
+
+	return plainLabels(encoded)
+}
+
+// shapeOnce makes one random attempt at shaping encoded data, returning
+// nil if the result doesn't fit in room or a data label is a word.
+func shapeOnce(encoded []byte, room int, shape stealthShape) [][]byte {
+	var labels [][]byte
+	size := 0
+	for data := encoded; len(data) > 0; {
+		n := shape.minLen + randIntn(shape.maxLen-shape.minLen+1)
+		if n > len(data) {
+			n = len(data)
+		}
+		if isShapeWord(data[:n]) {
+			return nil
+		}
+		labels = append(labels, data[:n])
+		size += n + 1
+		data = data[n:]
+	}
+
+	for i := 0; i < shape.words; i++ {
+		word := []byte(shapeWords[randIntn(len(shapeWords))])
+		size += len(word) + 1
+		pos := randIntn(len(labels) + 1)
+		labels = append(labels[:pos], append([][]byte{word}, labels[pos:]...)...)
+	}
+
+	if size > room {
+		return nil
+	}
+	return labels
+}
+
+// plainLabels splits encoded data into maximum-length labels. If the short
+// last label happens to be a word, characters are moved into it from the
+// label before.
+func plainLabels(encoded []byte) [][]byte {
+	labels := splitLabels(encoded, MaxLabelLength)
+	for last := len(labels) - 1; last > 0 && isShapeWord(labels[last]); {
+		prev := labels[last-1]
+		labels[last-1] = prev[:len(prev)-1]
+		labels[last] = encoded[len(encoded)-len(labels[last])-1:]
+	}
+	return labels
+}
+
+// dataLabels returns the labels of an encoded name that carry data,
+// dropping dictionary words.
+func dataLabels(labels [][]byte) [][]byte {
+	data := make([][]byte, 0, len(labels))
+	for _, label := range labels {
+		if !isShapeWord(label) {
+			data = append(data, label)
+		}
+	}
+	return data
+}
+
+// randIntn returns a uniform random number in [0, n).
+func randIntn(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return int(binary.BigEndian.Uint64(b[:]) % uint64(n))
+}
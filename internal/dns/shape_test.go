@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeShapedPayload(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	clientID := NewClientID()
+
+	levels := []StealthLevel{StealthOff, StealthLow, StealthMedium, StealthHigh}
+	sizes := []int{0, 16, 64, MaxPayloadSize(domain)}
+
+	for _, level := range levels {
+		for _, size := range sizes {
+			payload := bytes.Repeat([]byte{0xa5}, size)
+			for i := 0; i < 50; i++ {
+				name, err := EncodeShapedPayload(payload, 7, clientID, domain, level)
+				if err != nil {
+					t.Fatalf("%v/%d: EncodeShapedPayload() error = %v", level, size, err)
+				}
+				if len(name.String()) > 253 {
+					t.Fatalf("%v/%d: name too long: %d", level, size, len(name.String()))
+				}
+
+				keyID, gotID, got, err := DecodePayload(name, domain)
+				if err != nil {
+					t.Fatalf("%v/%d: DecodePayload(%s) error = %v", level, size, name, err)
+				}
+				if keyID != 7 || gotID != clientID || !bytes.Equal(got, payload) {
+					t.Fatalf("%v/%d: round trip mismatch for %s", level, size, name)
+				}
+			}
+		}
+	}
+}
+
+func TestShapeLabels(t *testing.T) {
+	encoded := []byte(strings.Repeat("abcdefgh234567", 5))
+
+	countWords := func(labels [][]byte) int {
+		return len(labels) - len(dataLabels(labels))
+	}
+
+	// Off uses maximum-length labels and no words
+	labels := shapeLabels(encoded, 200, StealthOff)
+	if len(labels) != 2 || len(labels[0]) != MaxLabelLength || countWords(labels) != 0 {
+		t.Errorf("Off: got %d labels, %d words", len(labels), countWords(labels))
+	}
+
+	// High adds words and keeps labels short
+	labels = shapeLabels(encoded, 200, StealthHigh)
+	if countWords(labels) != 3 {
+		t.Errorf("High: got %d words, want 3", countWords(labels))
+	}
+	for _, label := range dataLabels(labels) {
+		if len(label) > 20 {
+			t.Errorf("High: label %q longer than 20", label)
+		}
+	}
+	if !bytes.Equal(bytes.Join(dataLabels(labels), nil), encoded) {
+		t.Error("High: data labels don't join to the encoded data")
+	}
+
+	// Without room for words or short labels the shape is relaxed
+	labels = shapeLabels(encoded, len(encoded)+2, StealthHigh)
+	if countWords(labels) != 0 || len(labels) != 2 {
+		t.Errorf("No room: got %d labels, %d words", len(labels), countWords(labels))
+	}
+}
+
+func TestPlainLabelsAvoidWords(t *testing.T) {
+	// A short last label that is a word would be dropped by decoding
+	encoded := []byte(strings.Repeat("a", MaxLabelLength) + "mail")
+	labels := plainLabels(encoded)
+	for _, label := range labels {
+		if isShapeWord(label) {
+			t.Errorf("Data label %q is a word", label)
+		}
+	}
+	if !bytes.Equal(bytes.Join(labels, nil), encoded) {
+		t.Error("Labels don't join to the encoded data")
+	}
+}
+
+func TestDecodeShapedPayloadMixedCase(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	clientID := NewClientID()
+	payload := []byte("mixed case")
+
+	name, err := EncodeShapedPayload(payload, 0, clientID, domain, StealthHigh)
+	if err != nil {
+		t.Fatalf("EncodeShapedPayload() error = %v", err)
+	}
+
+	// Resolvers may randomize the case of query names (DNS 0x20)
+	for i, label := range name {
+		label = bytes.Clone(label)
+		if i%2 == 0 {
+			label = bytes.ToUpper(label)
+		}
+		name[i] = label
+	}
+
+	_, _, got, err := DecodePayload(name, domain)
+	if err != nil {
+		t.Fatalf("DecodePayload() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Payload: got %q, want %q", got, payload)
+	}
+}
+
+func TestParseStealthLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    StealthLevel
+		wantErr bool
+	}{
+		{"off", StealthOff, false},
+		{"LOW", StealthLow, false},
+		{"2", StealthMedium, false},
+		{"high", StealthHigh, false},
+		{"max", StealthOff, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseStealthLevel(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseStealthLevel(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+)
+
+// EDNSOptionTrace carries the trace ID of a tunnel exchange in the inner
+// query, from the local/experimental range (RFC 6891, Section 9). Servers
+// never forward it upstream.
+const EDNSOptionTrace uint16 = 65001
+
+// TraceID identifies a tunnel exchange in client and server logs. It
+// travels only inside the encrypted inner query, so it never appears on
+// the wire.
+type TraceID [8]byte
+
+// NewTraceID returns a random trace ID.
+func NewTraceID() TraceID {
+	var id TraceID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+// String returns the trace ID in hex.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// TraceID returns the trace ID a query carries, if any.
+func (m *Message) TraceID() (TraceID, bool) {
+	var id TraceID
+	data, ok := m.GetEDNSOption(EDNSOptionTrace)
+	if !ok || len(data) != len(id) {
+		return id, false
+	}
+	copy(id[:], data)
+	return id, true
+}
+
+// WithTraceID returns a copy of a query carrying the trace ID, or the query
+// itself if it has no valid OPT record: adding one would make the server
+// query upstream with EDNS for a stub that didn't use it.
+func (m *Message) WithTraceID(id TraceID) *Message {
+	if opt, err := m.OPT(); err != nil || opt == nil {
+		return m
+	}
+	traced := *m
+	traced.Additional = slices.Clone(m.Additional)
+	if err := traced.SetEDNSOption(EDNSOption{Code: EDNSOptionTrace, Data: id[:]}); err != nil {
+		return m
+	}
+	return &traced
+}
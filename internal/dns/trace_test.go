@@ -0,0 +1,29 @@
+package dns
+
+import "testing"
+
+func TestTraceID(t *testing.T) {
+	id := NewTraceID()
+	if id == (TraceID{}) || len(id.String()) != 16 {
+		t.Fatalf("NewTraceID() = %s", id)
+	}
+
+	query := CreateQuery(mustParseName("www.example.com"), RRTypeA, 1)
+	query.SetEDNS0(1232, false, NewCookieOption([8]byte{1}, nil))
+	traced := query.WithTraceID(id)
+	if got, ok := traced.TraceID(); !ok || got != id {
+		t.Errorf("TraceID() = %s, %v, want %s", got, ok, id)
+	}
+	if _, ok := traced.GetEDNSOption(EDNSOptionCookie); !ok {
+		t.Error("Other options dropped")
+	}
+	if _, ok := query.TraceID(); ok {
+		t.Error("Original query modified")
+	}
+
+	// Queries without EDNS are left alone
+	plain := CreateQuery(mustParseName("www.example.com"), RRTypeA, 1)
+	if traced := plain.WithTraceID(id); traced != plain || len(traced.Additional) != 0 {
+		t.Error("OPT record added to a query without EDNS")
+	}
+}
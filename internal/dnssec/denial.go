@@ -0,0 +1,339 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// maxNSEC3Iterations is the highest NSEC3 iteration count accepted. Zones
+// using more are treated as insecure (RFC 9276 Section 3.2).
+const maxNSEC3Iterations = 150
+
+// nsec3Encoding is the base32 encoding of NSEC3 owner names (RFC 4648
+// "base32hex" without padding).
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// CompareNames compares names in canonical DNS order (RFC 4034 Section
+// 6.1): label by label from the root, ignoring case.
+func CompareNames(a, b dns.Name) int {
+	for i := 1; i <= len(a) && i <= len(b); i++ {
+		la := bytes.ToLower(a[len(a)-i])
+		lb := bytes.ToLower(b[len(b)-i])
+		if c := bytes.Compare(la, lb); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// isSubdomain reports whether name is parent or below it.
+func isSubdomain(name, parent dns.Name) bool {
+	_, ok := name.TrimSuffix(parent)
+	return ok
+}
+
+// commonAncestor returns the longest name both names are below.
+func commonAncestor(a, b dns.Name) dns.Name {
+	n := 0
+	for n < len(a) && n < len(b) && bytes.EqualFold(a[len(a)-1-n], b[len(b)-1-n]) {
+		n++
+	}
+	return a[len(a)-n:]
+}
+
+// wildcardOf returns the wildcard name directly below name.
+func wildcardOf(name dns.Name) dns.Name {
+	return append(dns.Name{[]byte("*")}, name...)
+}
+
+// nsecRecord is a decoded NSEC record with its owner.
+type nsecRecord struct {
+	owner dns.Name
+	dns.NSEC
+}
+
+// covers reports whether the record proves name doesn't exist: name sorts
+// strictly between the owner and the next name, which wraps around to the
+// zone apex for the last record.
+func (n nsecRecord) covers(name dns.Name) bool {
+	if CompareNames(n.owner, name) >= 0 {
+		return false
+	}
+	if CompareNames(n.owner, n.NextDomain) >= 0 {
+		return isSubdomain(name, n.NextDomain)
+	}
+	return CompareNames(name, n.NextDomain) < 0
+}
+
+// delegation reports whether the record belongs to a zone cut seen from
+// the parent side, whose types only the parent is authoritative for.
+func (n nsecRecord) delegation() bool {
+	return n.HasType(dns.RRTypeNS) && !n.HasType(dns.RRTypeSOA)
+}
+
+// nsecProof checks denials of existence with NSEC records (RFC 4035
+// Section 5.4).
+type nsecProof []nsecRecord
+
+// match returns the record owned by name.
+func (p nsecProof) match(name dns.Name) (nsecRecord, bool) {
+	for _, n := range p {
+		if n.owner.Equal(name) {
+			return n, true
+		}
+	}
+	return nsecRecord{}, false
+}
+
+// cover returns a record covering name that can prove it doesn't exist.
+// Records of delegations above name can't: the names below them belong to
+// the child zone.
+func (p nsecProof) cover(name dns.Name) (nsecRecord, bool) {
+	for _, n := range p {
+		if !n.covers(name) {
+			continue
+		}
+		if n.delegation() && isSubdomain(name, n.owner) {
+			continue
+		}
+		return n, true
+	}
+	return nsecRecord{}, false
+}
+
+// closestEncloser returns the longest existing ancestor of name proven by
+// the record covering it.
+func closestEncloser(n nsecRecord, name dns.Name) dns.Name {
+	ce := commonAncestor(name, n.owner)
+	if other := commonAncestor(name, n.NextDomain); len(other) > len(ce) {
+		ce = other
+	}
+	return ce
+}
+
+// nameError reports whether the records prove name doesn't exist and
+// wasn't synthesized from a wildcard.
+func (p nsecProof) nameError(name dns.Name) bool {
+	n, ok := p.cover(name)
+	if !ok {
+		return false
+	}
+	wildcard := wildcardOf(closestEncloser(n, name))
+	_, ok = p.cover(wildcard)
+	return ok
+}
+
+// noData reports whether the records prove name exists without records of
+// rrType, directly or through a wildcard.
+func (p nsecProof) noData(name dns.Name, rrType uint16) bool {
+	if n, ok := p.match(name); ok {
+		if n.HasType(rrType) || n.HasType(dns.RRTypeCNAME) {
+			return false
+		}
+		// A parent-side NSEC only proves the absence of DS
+		return rrType == dns.RRTypeDS || !n.delegation()
+	}
+
+	n, ok := p.cover(name)
+	if !ok {
+		return false
+	}
+	w, ok := p.match(wildcardOf(closestEncloser(n, name)))
+	return ok && !w.HasType(rrType) && !w.HasType(dns.RRTypeCNAME)
+}
+
+// nextCloserMissing reports whether the records prove that name, answered
+// from a wildcard below closest, doesn't exist itself.
+func (p nsecProof) nextCloserMissing(name, closest dns.Name) bool {
+	_, ok := p.cover(name)
+	return ok
+}
+
+// nsec3Record is a decoded NSEC3 record with the hash from its owner name.
+type nsec3Record struct {
+	hash []byte
+	zone dns.Name
+	dns.NSEC3
+}
+
+// covers reports whether the record proves no name with hash exists.
+func (n nsec3Record) covers(hash []byte) bool {
+	if bytes.Compare(n.hash, n.NextHashed) >= 0 {
+		// Last record of the chain
+		return bytes.Compare(hash, n.hash) > 0 || bytes.Compare(hash, n.NextHashed) < 0
+	}
+	return bytes.Compare(hash, n.hash) > 0 && bytes.Compare(hash, n.NextHashed) < 0
+}
+
+// HashName returns the NSEC3 hash of name (RFC 5155 Section 5).
+func HashName(name dns.Name, iterations uint16, salt []byte) []byte {
+	h := sha1.New()
+	h.Write(appendCanonicalName(nil, name))
+	h.Write(salt)
+	sum := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(salt)
+		sum = h.Sum(sum[:0])
+	}
+	return sum
+}
+
+// newNSEC3Record decodes an NSEC3 record, returning false for records with
+// unknown hash algorithms or malformed owner names.
+func newNSEC3Record(rr dns.RR) (nsec3Record, bool) {
+	nsec3, err := dns.DecodeNSEC3Data(rr.Data)
+	if err != nil || nsec3.HashAlgorithm != 1 || len(rr.Name) < 2 {
+		return nsec3Record{}, false
+	}
+	hash, err := nsec3Encoding.DecodeString(strings.ToUpper(string(rr.Name[0])))
+	if err != nil || len(hash) != len(nsec3.NextHashed) {
+		return nsec3Record{}, false
+	}
+	return nsec3Record{hash: hash, zone: rr.Name[1:], NSEC3: nsec3}, true
+}
+
+// nsec3Proof checks denials of existence with NSEC3 records of one zone
+// (RFC 5155 Section 8).
+type nsec3Proof []nsec3Record
+
+// hash returns the hash of name with the parameters of the proof.
+func (p nsec3Proof) hash(name dns.Name) []byte {
+	return HashName(name, p[0].Iterations, p[0].Salt)
+}
+
+// match returns the record whose owner is the hash of name.
+func (p nsec3Proof) match(name dns.Name) (nsec3Record, bool) {
+	h := p.hash(name)
+	for _, n := range p {
+		if bytes.Equal(n.hash, h) {
+			return n, true
+		}
+	}
+	return nsec3Record{}, false
+}
+
+// cover returns a record covering the hash of name.
+func (p nsec3Proof) cover(name dns.Name) (nsec3Record, bool) {
+	h := p.hash(name)
+	for _, n := range p {
+		if n.covers(h) {
+			return n, true
+		}
+	}
+	return nsec3Record{}, false
+}
+
+// closestEncloser finds the closest encloser proof for name (RFC 5155
+// Section 8.3): an existing ancestor, and a record covering the next
+// closer name one label below it.
+func (p nsec3Proof) closestEncloser(name dns.Name) (closest dns.Name, nextCloser nsec3Record, ok bool) {
+	zone := p[0].zone
+	for i := 1; i <= len(name) && isSubdomain(name[i:], zone); i++ {
+		n, found := p.match(name[i:])
+		if !found {
+			continue
+		}
+		// The closest encloser can't be a delegation or a DNAME
+		if (n.HasType(dns.RRTypeNS) && !n.HasType(dns.RRTypeSOA)) || n.HasType(dns.RRTypeDNAME) {
+			return nil, nsec3Record{}, false
+		}
+		cover, found := p.cover(name[i-1:])
+		return name[i:], cover, found
+	}
+	return nil, nsec3Record{}, false
+}
+
+// nameError reports whether the records prove name doesn't exist and
+// wasn't synthesized from a wildcard.
+func (p nsec3Proof) nameError(name dns.Name) bool {
+	closest, _, ok := p.closestEncloser(name)
+	if !ok {
+		return false
+	}
+	_, ok = p.cover(wildcardOf(closest))
+	return ok
+}
+
+// noData reports whether the records prove name exists without records of
+// rrType, directly or through a wildcard. For DS, an opt-out span covering
+// name also counts, making the delegation insecure.
+func (p nsec3Proof) noData(name dns.Name, rrType uint16) bool {
+	if n, ok := p.match(name); ok {
+		if n.HasType(rrType) || n.HasType(dns.RRTypeCNAME) {
+			return false
+		}
+		return rrType == dns.RRTypeDS || !(n.HasType(dns.RRTypeNS) && !n.HasType(dns.RRTypeSOA))
+	}
+
+	closest, nextCloser, ok := p.closestEncloser(name)
+	if !ok {
+		return false
+	}
+	if rrType == dns.RRTypeDS && nextCloser.Flags&dns.NSEC3FlagOptOut != 0 {
+		return true
+	}
+	w, ok := p.match(wildcardOf(closest))
+	return ok && !w.HasType(rrType) && !w.HasType(dns.RRTypeCNAME)
+}
+
+// nextCloserMissing reports whether the records prove that name, answered
+// from a wildcard below closest, doesn't exist itself.
+func (p nsec3Proof) nextCloserMissing(name, closest dns.Name) bool {
+	if len(name) <= len(closest) {
+		return false
+	}
+	_, ok := p.cover(name[len(name)-len(closest)-1:])
+	return ok
+}
+
+// denial is a set of NSEC or NSEC3 records proving names or types don't
+// exist.
+type denial interface {
+	nameError(name dns.Name) bool
+	noData(name dns.Name, rrType uint16) bool
+	nextCloserMissing(name, closest dns.Name) bool
+}
+
+// newDenial collects the NSEC or NSEC3 records of a response section. It
+// returns nil if there are none, and insecure true if the NSEC3 records use
+// more iterations than are checked.
+func newDenial(rrs []dns.RR) (d denial, insecure bool) {
+	var nsecs nsecProof
+	var nsec3s nsec3Proof
+	for _, rr := range rrs {
+		switch rr.Type {
+		case dns.RRTypeNSEC:
+			if nsec, err := dns.DecodeNSECData(rr.Data); err == nil {
+				nsecs = append(nsecs, nsecRecord{owner: rr.Name, NSEC: nsec})
+			}
+		case dns.RRTypeNSEC3:
+			if n, ok := newNSEC3Record(rr); ok {
+				nsec3s = append(nsec3s, n)
+			}
+		}
+	}
+
+	switch {
+	case len(nsecs) > 0:
+		return nsecs, false
+	case len(nsec3s) > 0:
+		// All records of a proof must share the zone's parameters
+		first := nsec3s[0]
+		for _, n := range nsec3s[1:] {
+			if n.Iterations != first.Iterations || !bytes.Equal(n.Salt, first.Salt) || !n.zone.Equal(first.zone) {
+				return nil, false
+			}
+		}
+		if first.Iterations > maxNSEC3Iterations {
+			return nil, true
+		}
+		return nsec3s, false
+	}
+	return nil, false
+}
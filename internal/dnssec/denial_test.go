@@ -0,0 +1,87 @@
+package dnssec
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestCompareNames(t *testing.T) {
+	// Canonical order from RFC 4034 Section 6.1
+	names := []string{
+		"example", "a.example", "yljkjljk.a.example", "Z.a.example",
+		"zABC.a.EXAMPLE", "z.example", "\001.z.example", "*.z.example", "\200.z.example",
+	}
+	parsed := make([]dns.Name, len(names))
+	for i, s := range names {
+		parsed[i] = mustParseName(t, s)
+	}
+
+	for i := 0; i+1 < len(parsed); i++ {
+		if CompareNames(parsed[i], parsed[i+1]) >= 0 {
+			t.Errorf("%q should sort before %q", names[i], names[i+1])
+		}
+		if CompareNames(parsed[i+1], parsed[i]) <= 0 {
+			t.Errorf("%q should sort after %q", names[i+1], names[i])
+		}
+	}
+	if CompareNames(mustParseName(t, "A.Example"), mustParseName(t, "a.example")) != 0 {
+		t.Error("Comparison depends on case")
+	}
+}
+
+func TestHashName(t *testing.T) {
+	// RFC 5155 Appendix A
+	salt, _ := hex.DecodeString("aabbccdd")
+	hash := HashName(mustParseName(t, "example"), 12, salt)
+	if got := strings.ToLower(nsec3Encoding.EncodeToString(hash)); got != "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom" {
+		t.Errorf("HashName() = %s", got)
+	}
+}
+
+func TestNSECProof(t *testing.T) {
+	nsec := func(owner, next string, types ...uint16) nsecRecord {
+		return nsecRecord{owner: mustParseName(t, owner), NSEC: dns.NSEC{NextDomain: mustParseName(t, next), Types: types}}
+	}
+
+	// Zone example.com with the apex, a.example.com, a delegation to
+	// sub.example.com and www.example.com
+	proof := nsecProof{
+		nsec("example.com", "a.example.com", dns.RRTypeSOA, dns.RRTypeNS, dns.RRTypeNSEC),
+		nsec("a.example.com", "sub.example.com", dns.RRTypeA, dns.RRTypeNSEC),
+		nsec("sub.example.com", "www.example.com", dns.RRTypeNS, dns.RRTypeNSEC),
+		nsec("www.example.com", "example.com", dns.RRTypeA, dns.RRTypeNSEC),
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		nameError bool
+		noData    bool
+	}{
+		{"missing name", "b.example.com", dns.RRTypeA, true, false},
+		{"missing after last", "zzz.example.com", dns.RRTypeA, true, false},
+		{"existing name", "www.example.com", dns.RRTypeA, false, false},
+		{"missing type", "www.example.com", dns.RRTypeAAAA, false, true},
+		{"no DS at delegation", "sub.example.com", dns.RRTypeDS, false, true},
+		{"child data at delegation", "sub.example.com", dns.RRTypeA, false, false},
+		{"below delegation", "x.sub.example.com", dns.RRTypeA, false, false},
+		{"empty non-terminal", "x.a.example.com", dns.RRTypeA, true, false},
+		{"other zone", "www.example.org", dns.RRTypeA, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qname := mustParseName(t, tt.qname)
+			if got := proof.nameError(qname); got != tt.nameError {
+				t.Errorf("nameError() = %v, want %v", got, tt.nameError)
+			}
+			if got := proof.noData(qname, tt.qtype); got != tt.noData {
+				t.Errorf("noData() = %v, want %v", got, tt.noData)
+			}
+		})
+	}
+}
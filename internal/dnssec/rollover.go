@@ -0,0 +1,415 @@
+package dnssec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// RFC 5011 timers
+const (
+	// AddHoldDown is how long a new key must be seen before it is trusted
+	AddHoldDown = 30 * 24 * time.Hour
+
+	// RemoveHoldDown is how long a revoked key is remembered
+	RemoveHoldDown = 30 * 24 * time.Hour
+
+	// minRefresh and maxRefresh bound the interval between DNSKEY queries
+	minRefresh = time.Hour
+	maxRefresh = 15 * 24 * time.Hour
+
+	// retryRefresh is the interval after a failed refresh
+	retryRefresh = time.Hour
+)
+
+// KeyState is the RFC 5011 state of a managed trust anchor key.
+type KeyState int
+
+const (
+	// KeyAddPend keys are waiting out the add hold-down
+	KeyAddPend KeyState = iota
+
+	// KeyValid keys are trusted
+	KeyValid
+
+	// KeyMissing keys are trusted but no longer published
+	KeyMissing
+
+	// KeyRevoked keys have revoked themselves and are no longer trusted
+	KeyRevoked
+)
+
+var keyStateNames = map[KeyState]string{
+	KeyAddPend: "ADDPEND",
+	KeyValid:   "VALID",
+	KeyMissing: "MISSING",
+	KeyRevoked: "REVOKED",
+}
+
+// String returns the name of the state as written to the state file.
+func (s KeyState) String() string {
+	if name, ok := keyStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyState(%d)", int(s))
+}
+
+// trusted reports whether keys in the state are trust anchors.
+func (s KeyState) trusted() bool {
+	return s == KeyValid || s == KeyMissing
+}
+
+// managedKey is a key signing key tracked for automated updates.
+type managedKey struct {
+	zone    dns.Name
+	key     dns.DNSKEY
+	state   KeyState
+	changed time.Time // when the key entered its state
+}
+
+// AnchorManager keeps trust anchors current across key rollovers
+// following RFC 5011: it periodically fetches the DNSKEY RRsets of the
+// anchored zones, trusts new key signing keys once they have been
+// published for the add hold-down and stops trusting keys that revoke
+// themselves. Its state is saved to a file so hold-down timers survive
+// restarts.
+type AnchorManager struct {
+	path   string
+	seed   []TrustAnchor
+	lookup LookupFunc
+	keys   []*managedKey
+	mu     sync.Mutex
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewAnchorManager creates a manager keeping its state in path. The seed
+// anchors are trusted for zones without saved keys, until the keys they
+// match are learned on the first refresh.
+func NewAnchorManager(path string, seed []TrustAnchor, lookup LookupFunc) (*AnchorManager, error) {
+	m := &AnchorManager{path: path, seed: seed, lookup: lookup, now: time.Now}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trust anchor state: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		k, err := parseManagedKey(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		m.keys = append(m.keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read trust anchor state: %w", err)
+	}
+	return m, nil
+}
+
+// parseManagedKey parses a state file line:
+// "<zone> <state> <unix time> <flags> <protocol> <algorithm> <key>".
+func parseManagedKey(fields []string) (*managedKey, error) {
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("expected 7 fields, got %d", len(fields))
+	}
+	zone, err := dns.ParseName(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid zone %q: %w", fields[0], err)
+	}
+
+	k := &managedKey{zone: zone, state: -1}
+	for state, name := range keyStateNames {
+		if strings.EqualFold(fields[1], name) {
+			k.state = state
+		}
+	}
+	if k.state < 0 {
+		return nil, fmt.Errorf("unknown key state %q", fields[1])
+	}
+
+	changed, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q", fields[2])
+	}
+	k.changed = time.Unix(changed, 0)
+
+	var nums [3]uint64
+	for i, bits := range []int{16, 8, 8} {
+		if nums[i], err = strconv.ParseUint(fields[3+i], 10, bits); err != nil {
+			return nil, fmt.Errorf("invalid DNSKEY field %q", fields[3+i])
+		}
+	}
+	pub, err := base64.StdEncoding.DecodeString(fields[6])
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNSKEY public key: %w", err)
+	}
+	k.key = dns.DNSKEY{Flags: uint16(nums[0]), Protocol: uint8(nums[1]), Algorithm: uint8(nums[2]), PublicKey: pub}
+	return k, nil
+}
+
+// TrustAnchors returns the current trust anchors: the DS records of the
+// trusted keys, and the seed anchors of zones without any.
+func (m *AnchorManager) TrustAnchors() []TrustAnchor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var anchors []TrustAnchor
+	for _, k := range m.keys {
+		if !k.state.trusted() {
+			continue
+		}
+		if ds, err := ComputeDS(k.zone, k.key, DigestSHA256); err == nil {
+			anchors = append(anchors, TrustAnchor{Zone: k.zone, DS: ds})
+		}
+	}
+	for _, a := range m.seed {
+		if !m.hasTrustedKeys(a.Zone) {
+			anchors = append(anchors, a)
+		}
+	}
+	return anchors
+}
+
+// hasTrustedKeys reports whether the zone has a trusted managed key.
+func (m *AnchorManager) hasTrustedKeys(zone dns.Name) bool {
+	for _, k := range m.keys {
+		if k.zone.Equal(zone) && k.state.trusted() {
+			return true
+		}
+	}
+	return false
+}
+
+// zones returns the managed zones.
+func (m *AnchorManager) zones() []dns.Name {
+	var zones []dns.Name
+	add := func(zone dns.Name) {
+		for _, z := range zones {
+			if z.Equal(zone) {
+				return
+			}
+		}
+		zones = append(zones, zone)
+	}
+	for _, a := range m.seed {
+		add(a.Zone)
+	}
+	for _, k := range m.keys {
+		add(k.zone)
+	}
+	return zones
+}
+
+// Refresh fetches the DNSKEY RRset of every managed zone, updates the key
+// states, saves them and returns when to refresh next.
+func (m *AnchorManager) Refresh(ctx context.Context) (time.Duration, error) {
+	m.mu.Lock()
+	zones := m.zones()
+	m.mu.Unlock()
+
+	next := maxRefresh
+	var errs []error
+	for _, zone := range zones {
+		interval, err := m.refreshZone(ctx, zone)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DNSKEY %s: %w", zone, err))
+			interval = retryRefresh
+		}
+		next = min(next, interval)
+	}
+
+	if err := m.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return next, errors.Join(errs...)
+}
+
+// refreshZone applies the RFC 5011 state transitions for the zone's
+// current DNSKEY RRset and returns when to refresh it next.
+func (m *AnchorManager) refreshZone(ctx context.Context, zone dns.Name) (time.Duration, error) {
+	resp, err := m.lookup(ctx, zone, dns.RRTypeDNSKEY)
+	if err != nil {
+		return 0, err
+	}
+	var set *rrset
+	for _, s := range rrsets(resp.Answer) {
+		if s.rrs[0].Type == dns.RRTypeDNSKEY && s.name().Equal(zone) {
+			set = s
+		}
+	}
+	if set == nil {
+		return 0, ErrLookupResponse
+	}
+
+	var published []dns.DNSKEY
+	for _, rr := range set.rrs {
+		if key, err := dns.DecodeDNSKEYData(rr.Data); err == nil && key.Flags&dns.DNSKEYFlagZone != 0 {
+			published = append(published, key)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+
+	// Keys revoke themselves by signing the RRset with the REVOKE flag set
+	for _, key := range published {
+		if key.Flags&dns.DNSKEYFlagRevoke == 0 || set.verify(&zoneKeys{zone: zone, keys: []dns.DNSKEY{key}}, now) != nil {
+			continue
+		}
+		if k := m.find(zone, key); k != nil && k.state != KeyRevoked {
+			k.state, k.changed = KeyRevoked, now
+		}
+	}
+
+	// The RRset must be signed by a trusted key, or on first use by a key
+	// matching a seed anchor
+	trusted := &zoneKeys{zone: zone}
+	for _, k := range m.keys {
+		if k.zone.Equal(zone) && k.state.trusted() {
+			trusted.keys = append(trusted.keys, k.key)
+		}
+	}
+	bootstrap := len(trusted.keys) == 0
+	if bootstrap {
+		for _, key := range published {
+			for _, a := range m.seed {
+				if a.Zone.Equal(zone) && key.Flags&dns.DNSKEYFlagRevoke == 0 && MatchDS(zone, key, a.DS) {
+					trusted.keys = append(trusted.keys, key)
+				}
+			}
+		}
+	}
+	if err := set.verify(trusted, now); err != nil {
+		return 0, err
+	}
+	if bootstrap {
+		for _, key := range trusted.keys {
+			m.keys = append(m.keys, &managedKey{zone: zone, key: key, state: KeyValid, changed: now})
+		}
+	}
+
+	// New key signing keys wait out the hold-down; published keys return
+	// from missing
+	for _, key := range published {
+		if key.Flags&dns.DNSKEYFlagSEP == 0 || key.Flags&dns.DNSKEYFlagRevoke != 0 {
+			continue
+		}
+		k := m.find(zone, key)
+		switch {
+		case k == nil:
+			m.keys = append(m.keys, &managedKey{zone: zone, key: key, state: KeyAddPend, changed: now})
+		case k.state == KeyAddPend && now.Sub(k.changed) >= AddHoldDown:
+			k.state, k.changed = KeyValid, now
+		case k.state == KeyMissing:
+			k.state, k.changed = KeyValid, now
+		}
+	}
+
+	// Keys no longer published go missing, lose their pending hold-down,
+	// or are forgotten once revoked for long enough
+	kept := m.keys[:0]
+	for _, k := range m.keys {
+		if k.zone.Equal(zone) && !isPublished(published, k.key) {
+			switch {
+			case k.state == KeyValid:
+				k.state, k.changed = KeyMissing, now
+			case k.state == KeyAddPend:
+				continue
+			case k.state == KeyRevoked && now.Sub(k.changed) >= RemoveHoldDown:
+				continue
+			}
+		}
+		kept = append(kept, k)
+	}
+	m.keys = kept
+
+	return min(max(set.ttl(now)/2, minRefresh), maxRefresh), nil
+}
+
+// find returns the managed key of the zone that is the same key as key,
+// ignoring the REVOKE flag.
+func (m *AnchorManager) find(zone dns.Name, key dns.DNSKEY) *managedKey {
+	for _, k := range m.keys {
+		if k.zone.Equal(zone) && sameKey(k.key, key) {
+			return k
+		}
+	}
+	return nil
+}
+
+// isPublished reports whether key, ignoring the REVOKE flag, is among
+// the published keys.
+func isPublished(published []dns.DNSKEY, key dns.DNSKEY) bool {
+	for _, p := range published {
+		if sameKey(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameKey reports whether two DNSKEYs are the same key, ignoring the
+// REVOKE flag.
+func sameKey(a, b dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.Protocol == b.Protocol &&
+		a.Flags|dns.DNSKEYFlagRevoke == b.Flags|dns.DNSKEYFlagRevoke &&
+		bytes.Equal(a.PublicKey, b.PublicKey)
+}
+
+// save writes the key states to the state file, replacing it atomically.
+func (m *AnchorManager) save() error {
+	m.mu.Lock()
+	var b strings.Builder
+	b.WriteString("; RFC 5011 trust anchor state: zone, state, since (Unix time), DNSKEY\n")
+	for _, k := range m.keys {
+		zone := k.zone.String()
+		if zone != "." {
+			zone += "."
+		}
+		fmt.Fprintf(&b, "%s %s %d %d %d %d %s\n", zone, k.state, k.changed.Unix(),
+			k.key.Flags, k.key.Protocol, k.key.Algorithm, base64.StdEncoding.EncodeToString(k.key.PublicKey))
+	}
+	m.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save trust anchor state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save trust anchor state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save trust anchor state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return fmt.Errorf("failed to save trust anchor state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package dnssec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// testRollover serves a root DNSKEY RRset that tests change between
+// refreshes.
+type testRollover struct {
+	answer []dns.RR
+}
+
+func (r *testRollover) lookup(ctx context.Context, name dns.Name, rrType uint16) (*dns.Message, error) {
+	msg := dns.CreateResponse(dns.CreateQuery(name, rrType, 0))
+	msg.Answer = r.answer
+	return msg, nil
+}
+
+// publish sets the DNSKEY RRset to the keys, signed by the signers with
+// signatures valid for longer than the hold-downs.
+func (r *testRollover) publish(t *testing.T, now time.Time, keys []*testKey, signers ...*testKey) {
+	t.Helper()
+	var rrs []dns.RR
+	for _, k := range keys {
+		rrs = append(rrs, dns.RR{Name: dns.Name{}, Type: dns.RRTypeDNSKEY, Class: dns.ClassIN, TTL: 3600, Data: dns.EncodeDNSKEYData(k.dnskey)})
+	}
+	r.answer = rrs
+	for _, k := range signers {
+		r.answer = append(r.answer, k.signPeriod(t, rrs, now.Add(-time.Hour), now.Add(2*AddHoldDown)))
+	}
+}
+
+// revoked returns the key with the REVOKE flag set.
+func revoked(k *testKey) *testKey {
+	r := *k
+	r.dnskey.Flags |= dns.DNSKEYFlagRevoke
+	return &r
+}
+
+func anchorTags(anchors []TrustAnchor) []uint16 {
+	var tags []uint16
+	for _, a := range anchors {
+		tags = append(tags, a.DS.KeyTag)
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+func TestAnchorManagerRollover(t *testing.T) {
+	oldKey := newTestKey(t, dns.Name{}, AlgorithmED25519)
+	newKey := newTestKey(t, dns.Name{}, AlgorithmED25519)
+	oldTag, newTag := KeyTag(oldKey.dnskey), KeyTag(newKey.dnskey)
+	if oldTag > newTag {
+		oldTag, newTag = newTag, oldTag
+	}
+	path := filepath.Join(t.TempDir(), "anchors.state")
+	ctx := context.Background()
+
+	srv := &testRollover{}
+	m, err := NewAnchorManager(path, []TrustAnchor{{Zone: dns.Name{}, DS: oldKey.ds(t)}}, srv.lookup)
+	if err != nil {
+		t.Fatalf("NewAnchorManager() error = %v", err)
+	}
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	refresh := func(t *testing.T) time.Duration {
+		t.Helper()
+		next, err := m.Refresh(ctx)
+		if err != nil {
+			t.Fatalf("Refresh() error = %v", err)
+		}
+		return next
+	}
+
+	// The seed anchor's key is learned
+	srv.publish(t, now, []*testKey{oldKey}, oldKey)
+	if next := refresh(t); next != minRefresh {
+		t.Errorf("Refresh() = %v, want %v", next, minRefresh)
+	}
+	if got := anchorTags(m.TrustAnchors()); !slices.Equal(got, []uint16{KeyTag(oldKey.dnskey)}) {
+		t.Fatalf("Anchors after first refresh = %v", got)
+	}
+
+	// A new key isn't trusted before the hold-down
+	srv.publish(t, now, []*testKey{oldKey, newKey}, oldKey)
+	refresh(t)
+	now = now.Add(AddHoldDown / 2)
+	refresh(t)
+	if got := anchorTags(m.TrustAnchors()); !slices.Equal(got, []uint16{KeyTag(oldKey.dnskey)}) {
+		t.Fatalf("Anchors during hold-down = %v", got)
+	}
+	now = now.Add(AddHoldDown / 2)
+	refresh(t)
+	if got := anchorTags(m.TrustAnchors()); !slices.Equal(got, []uint16{oldTag, newTag}) {
+		t.Fatalf("Anchors after hold-down = %v", got)
+	}
+
+	// The state survives a restart
+	m, err = NewAnchorManager(path, nil, srv.lookup)
+	if err != nil {
+		t.Fatalf("NewAnchorManager() reload error = %v", err)
+	}
+	m.now = func() time.Time { return now }
+	if got := anchorTags(m.TrustAnchors()); !slices.Equal(got, []uint16{oldTag, newTag}) {
+		t.Fatalf("Anchors after reload = %v", got)
+	}
+
+	// A revoked key stops being trusted
+	srv.publish(t, now, []*testKey{revoked(oldKey), newKey}, revoked(oldKey), newKey)
+	refresh(t)
+	if got := anchorTags(m.TrustAnchors()); !slices.Equal(got, []uint16{KeyTag(newKey.dnskey)}) {
+		t.Fatalf("Anchors after revocation = %v", got)
+	}
+
+	// Key sets not signed by a trusted key change nothing
+	rogue := newTestKey(t, dns.Name{}, AlgorithmED25519)
+	srv.publish(t, now, []*testKey{rogue}, rogue)
+	if _, err := m.Refresh(ctx); err == nil {
+		t.Error("Refresh() of a rogue key set succeeded")
+	}
+	if got := anchorTags(m.TrustAnchors()); !slices.Equal(got, []uint16{KeyTag(newKey.dnskey)}) {
+		t.Errorf("Anchors after rogue key set = %v", got)
+	}
+
+	// Revoked keys are forgotten after the remove hold-down
+	srv.publish(t, now, []*testKey{newKey}, newKey)
+	now = now.Add(RemoveHoldDown)
+	refresh(t)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), KeyRevoked.String()) || !strings.Contains(string(data), KeyValid.String()) {
+		t.Errorf("State file after removal:\n%s", data)
+	}
+}
+
+func TestAnchorManagerSeed(t *testing.T) {
+	seed := DefaultTrustAnchors()
+	m, err := NewAnchorManager(filepath.Join(t.TempDir(), "missing.state"), seed, nil)
+	if err != nil {
+		t.Fatalf("NewAnchorManager() error = %v", err)
+	}
+	if got := m.TrustAnchors(); len(got) != len(seed) {
+		t.Errorf("TrustAnchors() = %v, want the seed", got)
+	}
+
+	for _, bad := range []string{
+		". VALID 1700000000 257 3 15",
+		". TRUSTED 1700000000 257 3 15 AAAA",
+		". VALID soon 257 3 15 AAAA",
+		". VALID 1700000000 257 3 15 !!",
+	} {
+		path := filepath.Join(t.TempDir(), "bad.state")
+		if err := os.WriteFile(path, []byte(bad+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewAnchorManager(path, seed, nil); err == nil {
+			t.Errorf("NewAnchorManager() accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package dnssec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Security is the DNSSEC validation result of a response.
+type Security int
+
+const (
+	// Insecure responses come from zones proven to be unsigned
+	Insecure Security = iota
+
+	// Secure responses are signed by a chain of keys from a trust anchor
+	Secure
+
+	// Bogus responses should be signed but fail validation
+	Bogus
+)
+
+// String returns the name of the validation result.
+func (s Security) String() string {
+	switch s {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return fmt.Sprintf("Security(%d)", int(s))
+}
+
+const (
+	// maxKeyCacheTTL caps how long validated keys and insecure zones are
+	// remembered
+	maxKeyCacheTTL = time.Hour
+
+	// maxKeyCacheEntries limits the number of zones remembered
+	maxKeyCacheEntries = 4096
+)
+
+var (
+	ErrNoSignature    = errors.New("missing signature")
+	ErrNoTrustedKey   = errors.New("no trusted key for signature")
+	ErrMissingDenial  = errors.New("missing proof of nonexistence")
+	ErrBadDelegation  = errors.New("delegation doesn't match zone keys")
+	ErrLookupResponse = errors.New("unusable response to DNSSEC lookup")
+)
+
+// LookupFunc fetches the records of a name and type, with DNSSEC records
+// and without validation by the resolver that answers (DO and CD set).
+type LookupFunc func(ctx context.Context, name dns.Name, rrType uint16) (*dns.Message, error)
+
+// zoneKeys is the validated state of a zone: its trusted keys, or none if
+// it is proven insecure.
+type zoneKeys struct {
+	zone     dns.Name
+	keys     []dns.DNSKEY
+	insecure bool
+	expires  time.Time
+}
+
+// Validator validates responses against trust anchors, fetching DNSKEY
+// and DS records with its lookup function and remembering validated keys.
+type Validator struct {
+	anchors []TrustAnchor
+	lookup  LookupFunc
+	keys    map[string]*zoneKeys
+	mu      sync.Mutex
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewValidator creates a validator trusting the given anchors.
+func NewValidator(anchors []TrustAnchor, lookup LookupFunc) *Validator {
+	return &Validator{
+		anchors: anchors,
+		lookup:  lookup,
+		keys:    make(map[string]*zoneKeys),
+		now:     time.Now,
+	}
+}
+
+// TrustAnchors returns the anchors the validator trusts.
+func (v *Validator) TrustAnchors() []TrustAnchor {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.anchors
+}
+
+// SetTrustAnchors replaces the trust anchors, such as after a key
+// rollover, and forgets the keys validated with the old ones.
+func (v *Validator) SetTrustAnchors(anchors []TrustAnchor) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.anchors = anchors
+	clear(v.keys)
+}
+
+// rrset is the records of one name and type with their signatures.
+type rrset struct {
+	rrs  []dns.RR
+	sigs []dns.RRSIG
+}
+
+// name returns the owner name of the RRset.
+func (s *rrset) name() dns.Name {
+	return s.rrs[0].Name
+}
+
+// rrsets groups the records of a section into RRsets, attaching the
+// signatures covering them. Signatures without records are dropped.
+func rrsets(section []dns.RR) []*rrset {
+	type key struct {
+		name  string
+		rtype uint16
+	}
+	var sets []*rrset
+	index := make(map[key]*rrset)
+	for _, rr := range section {
+		if rr.Type == dns.RRTypeRRSIG || rr.Type == dns.RRTypeOPT {
+			continue
+		}
+		k := key{strings.ToLower(rr.Name.String()), rr.Type}
+		set, ok := index[k]
+		if !ok {
+			set = &rrset{}
+			index[k] = set
+			sets = append(sets, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+
+	for _, rr := range section {
+		if rr.Type != dns.RRTypeRRSIG {
+			continue
+		}
+		sig, err := dns.DecodeRRSIGData(rr.Data)
+		if err != nil {
+			continue
+		}
+		if set, ok := index[key{strings.ToLower(rr.Name.String()), sig.TypeCovered}]; ok {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets
+}
+
+// signer returns the zone that signed the RRset, and false if it is
+// unsigned. The root zone is an empty name.
+func (s *rrset) signer() (dns.Name, bool) {
+	for _, sig := range s.sigs {
+		if isSubdomain(s.name(), sig.SignerName) {
+			return sig.SignerName, true
+		}
+	}
+	return nil, false
+}
+
+// verify checks that a signature by one of the zone's keys covers the
+// RRset.
+func (s *rrset) verify(zk *zoneKeys, now time.Time) error {
+	if len(s.sigs) == 0 {
+		return ErrNoSignature
+	}
+	err := ErrNoTrustedKey
+	for _, sig := range s.sigs {
+		if !sig.SignerName.Equal(zk.zone) || int(sig.Labels) > labelCount(s.name()) {
+			continue
+		}
+		for _, key := range zk.keys {
+			if key.Algorithm != sig.Algorithm || KeyTag(key) != sig.KeyTag {
+				continue
+			}
+			if err = verifySignature(sig, key, s.rrs, now); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// ttl returns the lowest TTL of the RRset, bounded by its signatures'
+// original TTL and expiration.
+func (s *rrset) ttl(now time.Time) time.Duration {
+	ttl := s.rrs[0].TTL
+	for _, rr := range s.rrs {
+		ttl = min(ttl, rr.TTL)
+	}
+	for _, sig := range s.sigs {
+		ttl = min(ttl, sig.OriginalTTL)
+		if left := int64(sig.Expiration) - now.Unix(); left >= 0 && left < int64(ttl) {
+			ttl = uint32(left)
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Validate checks a response against the trust anchors. It returns Bogus
+// with the reason if the response should be signed but isn't validly.
+func (v *Validator) Validate(ctx context.Context, resp *dns.Message) (Security, error) {
+	if len(resp.Question) != 1 {
+		return Insecure, nil
+	}
+	rcode := resp.Rcode()
+	if rcode != dns.RcodeNoError && rcode != dns.RcodeNameError {
+		return Insecure, nil
+	}
+	q := resp.Question[0]
+	now := v.now()
+
+	result := Secure
+	downgrade := func(s Security) {
+		if s == Insecure && result == Secure {
+			result = Insecure
+		}
+	}
+
+	// Validate each answer RRset, following the CNAME chain from the
+	// question name
+	name := q.Name
+	answered := false
+	for _, set := range rrsets(resp.Answer) {
+		s, err := v.validateRRset(ctx, set, resp.Authority, now)
+		if err != nil {
+			return Bogus, fmt.Errorf("%s %d: %w", set.name(), set.rrs[0].Type, err)
+		}
+		downgrade(s)
+
+		if set.name().Equal(name) {
+			switch {
+			case set.rrs[0].Type == q.Type:
+				answered = true
+			case set.rrs[0].Type == dns.RRTypeCNAME:
+				if target, err := dns.DecodeNameData(set.rrs[0].Data); err == nil {
+					name = target
+				}
+			}
+		}
+	}
+	if answered {
+		return result, nil
+	}
+
+	// Without an answer the authority section must prove the name or type
+	// doesn't exist
+	s, err := v.validateDenial(ctx, resp, name, q.Type, now)
+	if err != nil {
+		return Bogus, fmt.Errorf("%s %d: %w", name, q.Type, err)
+	}
+	downgrade(s)
+	return result, nil
+}
+
+// validateRRset validates an answer RRset. Wildcard expansions must come
+// with proof that the name itself doesn't exist.
+func (v *Validator) validateRRset(ctx context.Context, set *rrset, authority []dns.RR, now time.Time) (Security, error) {
+	signer, ok := set.signer()
+	if !ok {
+		// Unsigned data is only acceptable from an insecure zone
+		return v.requireInsecure(ctx, set.name())
+	}
+
+	zk, err := v.zoneKeys(ctx, signer)
+	if err != nil {
+		return Bogus, err
+	}
+	if zk.insecure {
+		return Insecure, nil
+	}
+	if err := set.verify(zk, now); err != nil {
+		return Bogus, err
+	}
+
+	for _, sig := range set.sigs {
+		if n := int(sig.Labels); n < labelCount(set.name()) {
+			closest := set.name()[len(set.name())-n:]
+			proof, s, err := v.authorityDenial(ctx, authority, now)
+			if err != nil || s != Secure {
+				return s, err
+			}
+			if proof == nil || !proof.nextCloserMissing(set.name(), closest) {
+				return Bogus, ErrMissingDenial
+			}
+			break
+		}
+	}
+	return Secure, nil
+}
+
+// validateDenial validates a response without an answer for name and
+// rrType: NXDOMAIN or NODATA, proven by NSEC or NSEC3 records.
+func (v *Validator) validateDenial(ctx context.Context, resp *dns.Message, name dns.Name, rrType uint16, now time.Time) (Security, error) {
+	proof, s, err := v.authorityDenial(ctx, resp.Authority, now)
+	if err != nil || s != Secure {
+		return s, err
+	}
+	if proof == nil {
+		// No signed denial: the zone must be insecure
+		return v.requireInsecure(ctx, name)
+	}
+
+	if resp.Rcode() == dns.RcodeNameError {
+		if !proof.nameError(name) {
+			return Bogus, ErrMissingDenial
+		}
+	} else if !proof.noData(name, rrType) {
+		return Bogus, ErrMissingDenial
+	}
+	return Secure, nil
+}
+
+// authorityDenial validates the signed RRsets of an authority section and
+// returns its NSEC or NSEC3 proof, nil if there are no signed records.
+func (v *Validator) authorityDenial(ctx context.Context, authority []dns.RR, now time.Time) (denial, Security, error) {
+	var signed []dns.RR
+	for _, set := range rrsets(authority) {
+		signer, ok := set.signer()
+		if !ok {
+			continue
+		}
+		zk, err := v.zoneKeys(ctx, signer)
+		if err != nil {
+			return nil, Bogus, err
+		}
+		if zk.insecure {
+			return nil, Insecure, nil
+		}
+		if err := set.verify(zk, now); err != nil {
+			return nil, Bogus, err
+		}
+		signed = append(signed, set.rrs...)
+	}
+
+	proof, insecure := newDenial(signed)
+	if insecure {
+		return nil, Insecure, nil
+	}
+	return proof, Secure, nil
+}
+
+// requireInsecure returns Insecure if name is in a zone proven unsigned,
+// and an error otherwise, since data from signed zones must be signed.
+func (v *Validator) requireInsecure(ctx context.Context, name dns.Name) (Security, error) {
+	zk, err := v.zoneKeys(ctx, name)
+	if err != nil {
+		return Bogus, err
+	}
+	if !zk.insecure {
+		return Bogus, ErrNoSignature
+	}
+	return Insecure, nil
+}
+
+// zoneKeys returns the validated keys of the zone containing name, or marks
+// it insecure. Keys are chased down from the trust anchors through DS
+// records, and remembered.
+func (v *Validator) zoneKeys(ctx context.Context, name dns.Name) (*zoneKeys, error) {
+	key := strings.ToLower(name.String())
+	now := v.now()
+
+	v.mu.Lock()
+	zk, ok := v.keys[key]
+	v.mu.Unlock()
+	if ok && now.Before(zk.expires) {
+		return zk, nil
+	}
+
+	zk, err := v.fetchZoneKeys(ctx, name, now)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	if len(v.keys) >= maxKeyCacheEntries {
+		for k, e := range v.keys {
+			if !now.Before(e.expires) {
+				delete(v.keys, k)
+			}
+		}
+		if len(v.keys) >= maxKeyCacheEntries {
+			clear(v.keys)
+		}
+	}
+	v.keys[key] = zk
+	v.mu.Unlock()
+
+	return zk, nil
+}
+
+// fetchZoneKeys establishes the keys of the zone containing name (see
+// zoneKeys).
+func (v *Validator) fetchZoneKeys(ctx context.Context, name dns.Name, now time.Time) (*zoneKeys, error) {
+	// Trust anchors end the chain
+	var anchors []dns.DS
+	for _, a := range v.TrustAnchors() {
+		if a.Zone.Equal(name) {
+			anchors = append(anchors, a.DS)
+		}
+	}
+	if len(anchors) > 0 {
+		return v.fetchDNSKEY(ctx, name, anchors, maxKeyCacheTTL, now)
+	}
+	if len(name) == 0 {
+		return nil, fmt.Errorf("no trust anchor for the root zone")
+	}
+
+	resp, err := v.lookup(ctx, name, dns.RRTypeDS)
+	if err != nil {
+		return nil, err
+	}
+	if rcode := resp.Rcode(); rcode != dns.RcodeNoError && rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%w: DS %s rcode %d", ErrLookupResponse, name, rcode)
+	}
+
+	// A DS RRset makes name a signed zone cut; it is signed by the parent
+	for _, set := range rrsets(resp.Answer) {
+		if set.rrs[0].Type != dns.RRTypeDS || !set.name().Equal(name) {
+			continue
+		}
+		signer, ok := set.signer()
+		if !ok || len(signer) >= len(name) {
+			return v.insecureParent(ctx, name, now)
+		}
+		parent, err := v.zoneKeys(ctx, signer)
+		if err != nil {
+			return nil, err
+		}
+		if parent.insecure {
+			return parent, nil
+		}
+		if err := set.verify(parent, now); err != nil {
+			return nil, fmt.Errorf("DS %s: %w", name, err)
+		}
+
+		var dss []dns.DS
+		for _, rr := range set.rrs {
+			if ds, err := dns.DecodeDSData(rr.Data); err == nil {
+				dss = append(dss, ds)
+			}
+		}
+		return v.fetchDNSKEY(ctx, name, dss, set.ttl(now), now)
+	}
+
+	// Otherwise a secure parent must prove there is no DS. Names that
+	// aren't zone cuts belong to the zone that answered, which must be
+	// above name.
+	for _, set := range rrsets(resp.Authority) {
+		if signer, ok := set.signer(); ok && (len(signer) >= len(name) || !isSubdomain(name, signer)) {
+			return nil, fmt.Errorf("DS %s: %w", name, ErrBadDelegation)
+		}
+	}
+	proof, s, err := v.authorityDenial(ctx, resp.Authority, now)
+	if err != nil {
+		return nil, err
+	}
+	if s == Insecure {
+		return &zoneKeys{zone: name, insecure: true, expires: now.Add(maxKeyCacheTTL)}, nil
+	}
+	if proof == nil {
+		return v.insecureParent(ctx, name, now)
+	}
+	if resp.Rcode() == dns.RcodeNameError || !proof.noData(name, dns.RRTypeDS) {
+		return nil, fmt.Errorf("DS %s: %w", name, ErrMissingDenial)
+	}
+
+	var zone dns.Name
+	ttl := maxKeyCacheTTL
+	for _, set := range rrsets(resp.Authority) {
+		if signer, ok := set.signer(); ok {
+			zone = signer
+			ttl = min(ttl, set.ttl(now))
+		}
+	}
+	if delegation(proof, name) {
+		return &zoneKeys{zone: name, insecure: true, expires: now.Add(ttl)}, nil
+	}
+	return v.zoneKeys(ctx, zone)
+}
+
+// delegation reports whether the proof shows an unsigned zone cut at name:
+// NS without SOA, or an NSEC3 opt-out span.
+func delegation(proof denial, name dns.Name) bool {
+	switch p := proof.(type) {
+	case nsecProof:
+		n, ok := p.match(name)
+		return ok && n.delegation()
+	case nsec3Proof:
+		n, ok := p.match(name)
+		if !ok {
+			return true // proven by an opt-out span
+		}
+		return n.HasType(dns.RRTypeNS) && !n.HasType(dns.RRTypeSOA)
+	}
+	return false
+}
+
+// insecureParent handles an unsigned answer to a DS lookup: acceptable only
+// if the zone above is itself insecure.
+func (v *Validator) insecureParent(ctx context.Context, name dns.Name, now time.Time) (*zoneKeys, error) {
+	parent, err := v.zoneKeys(ctx, name[1:])
+	if err != nil {
+		return nil, err
+	}
+	if !parent.insecure {
+		return nil, fmt.Errorf("DS %s: %w", name, ErrNoSignature)
+	}
+	return parent, nil
+}
+
+// fetchDNSKEY fetches the keys of zone and validates them against DS
+// records: the DNSKEY RRset must be signed by a key matching one of them.
+func (v *Validator) fetchDNSKEY(ctx context.Context, zone dns.Name, dss []dns.DS, ttl time.Duration, now time.Time) (*zoneKeys, error) {
+	// Zones whose DS records all use unknown algorithms are insecure
+	supported := false
+	for _, ds := range dss {
+		if SupportedAlgorithm(ds.Algorithm) && SupportedDigest(ds.DigestType) {
+			supported = true
+		}
+	}
+	if !supported {
+		return &zoneKeys{zone: zone, insecure: true, expires: now.Add(min(ttl, maxKeyCacheTTL))}, nil
+	}
+
+	resp, err := v.lookup(ctx, zone, dns.RRTypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, set := range rrsets(resp.Answer) {
+		if set.rrs[0].Type != dns.RRTypeDNSKEY || !set.name().Equal(zone) {
+			continue
+		}
+
+		var keys []dns.DNSKEY
+		for _, rr := range set.rrs {
+			if key, err := dns.DecodeDNSKEYData(rr.Data); err == nil && key.Flags&dns.DNSKEYFlagZone != 0 {
+				keys = append(keys, key)
+			}
+		}
+
+		// Find a key signing key matching a DS record that signed the set
+		for _, key := range keys {
+			if key.Flags&dns.DNSKEYFlagRevoke != 0 {
+				continue
+			}
+			matched := false
+			for _, ds := range dss {
+				if MatchDS(zone, key, ds) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			entry := &zoneKeys{zone: zone, keys: []dns.DNSKEY{key}}
+			if set.verify(entry, now) == nil {
+				entry.keys = keys
+				entry.expires = now.Add(min(ttl, set.ttl(now), maxKeyCacheTTL))
+				return entry, nil
+			}
+		}
+		return nil, fmt.Errorf("DNSKEY %s: %w", zone, ErrBadDelegation)
+	}
+
+	return nil, fmt.Errorf("DNSKEY %s: %w", zone, ErrLookupResponse)
+}
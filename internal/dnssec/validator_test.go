@@ -0,0 +1,225 @@
+package dnssec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// testHierarchy is a signed root, com and example.com, with an unsigned
+// insecure.com delegated from com. example.com uses NSEC3.
+type testHierarchy struct {
+	root, com, example *testKey
+	responses          map[string]*dns.Message
+	lookups            atomic.Int32
+}
+
+func responseKey(name dns.Name, rrType uint16) string {
+	return strings.ToLower(name.String()) + "/" + strconv.Itoa(int(rrType))
+}
+
+// add registers the response to a lookup.
+func (h *testHierarchy) add(t *testing.T, name string, rrType uint16, rcode uint16, answer, authority []dns.RR) {
+	t.Helper()
+	qname := mustParseName(t, name)
+	msg := dns.CreateResponse(dns.CreateQuery(qname, rrType, 0))
+	msg.SetRcode(rcode)
+	msg.Answer = answer
+	msg.Authority = authority
+	h.responses[responseKey(qname, rrType)] = msg
+}
+
+func (h *testHierarchy) lookup(ctx context.Context, name dns.Name, rrType uint16) (*dns.Message, error) {
+	h.lookups.Add(1)
+	if msg, ok := h.responses[responseKey(name, rrType)]; ok {
+		return msg, nil
+	}
+	return nil, errors.New("no such test response")
+}
+
+// signed returns the records followed by their signature.
+func signed(t *testing.T, k *testKey, rrs ...dns.RR) []dns.RR {
+	return append(rrs, k.sign(t, rrs...))
+}
+
+// nsec3Chain returns the signed NSEC3 records of a zone holding names with
+// the types given.
+func nsec3Chain(t *testing.T, k *testKey, names map[string][]uint16) []dns.RR {
+	type entry struct {
+		hash  []byte
+		types []uint16
+	}
+	var entries []entry
+	for name, types := range names {
+		entries = append(entries, entry{HashName(mustParseName(t, name), 0, nil), types})
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return bytes.Compare(a.hash, b.hash) })
+
+	var rrs []dns.RR
+	for i, e := range entries {
+		owner := append(dns.Name{[]byte(strings.ToLower(nsec3Encoding.EncodeToString(e.hash)))}, k.zone...)
+		next := entries[(i+1)%len(entries)].hash
+		rr := dns.RR{
+			Name: owner, Type: dns.RRTypeNSEC3, Class: dns.ClassIN, TTL: 300,
+			Data: dns.EncodeNSEC3Data(dns.NSEC3{HashAlgorithm: 1, NextHashed: next, Types: e.types}),
+		}
+		rrs = append(rrs, signed(t, k, rr)...)
+	}
+	return rrs
+}
+
+func newTestHierarchy(t *testing.T) *testHierarchy {
+	h := &testHierarchy{
+		root:      newTestKey(t, dns.Name{}, AlgorithmED25519),
+		com:       newTestKey(t, mustParseName(t, "com"), AlgorithmECDSAP256SHA256),
+		example:   newTestKey(t, mustParseName(t, "example.com"), AlgorithmED25519),
+		responses: make(map[string]*dns.Message),
+	}
+	dsRR := func(k *testKey) dns.RR {
+		return dns.RR{Name: k.zone, Type: dns.RRTypeDS, Class: dns.ClassIN, TTL: 3600, Data: dns.EncodeDSData(k.ds(t))}
+	}
+	soaRR := func(zone string) dns.RR {
+		name := mustParseName(t, zone)
+		return dns.RR{Name: name, Type: dns.RRTypeSOA, Class: dns.ClassIN, TTL: 300, Data: dns.EncodeSOAData(dns.SOA{MName: name, RName: name, Minimum: 300})}
+	}
+
+	// Keys and delegations
+	h.add(t, ".", dns.RRTypeDNSKEY, dns.RcodeNoError, h.root.keyRRs(t), nil)
+	h.add(t, "com", dns.RRTypeDS, dns.RcodeNoError, signed(t, h.root, dsRR(h.com)), nil)
+	h.add(t, "com", dns.RRTypeDNSKEY, dns.RcodeNoError, h.com.keyRRs(t), nil)
+	h.add(t, "example.com", dns.RRTypeDS, dns.RcodeNoError, signed(t, h.com, dsRR(h.example)), nil)
+	h.add(t, "example.com", dns.RRTypeDNSKEY, dns.RcodeNoError, h.example.keyRRs(t), nil)
+
+	// com proves insecure.com has no DS
+	noDS := dns.RR{
+		Name: mustParseName(t, "insecure.com"), Type: dns.RRTypeNSEC, Class: dns.ClassIN, TTL: 300,
+		Data: dns.EncodeNSECData(dns.NSEC{NextDomain: mustParseName(t, "zzz.com"), Types: []uint16{dns.RRTypeNS, dns.RRTypeRRSIG, dns.RRTypeNSEC}}),
+	}
+	h.add(t, "insecure.com", dns.RRTypeDS, dns.RcodeNoError, nil, append(signed(t, h.com, soaRR("com")), signed(t, h.com, noDS)...))
+	h.add(t, "www.insecure.com", dns.RRTypeDS, dns.RcodeNoError, nil, []dns.RR{soaRR("insecure.com")})
+
+	// example.com proves www.example.com is not a zone cut
+	chain := nsec3Chain(t, h.example, map[string][]uint16{
+		"example.com":     {dns.RRTypeSOA, dns.RRTypeNS, dns.RRTypeDNSKEY, dns.RRTypeRRSIG},
+		"www.example.com": {dns.RRTypeA, dns.RRTypeRRSIG},
+	})
+	h.add(t, "www.example.com", dns.RRTypeDS, dns.RcodeNoError, nil, append(signed(t, h.example, soaRR("example.com")), chain...))
+
+	return h
+}
+
+func TestValidate(t *testing.T) {
+	h := newTestHierarchy(t)
+	v := NewValidator([]TrustAnchor{{Zone: dns.Name{}, DS: h.root.ds(t)}}, h.lookup)
+
+	soa := dns.RR{
+		Name: h.example.zone, Type: dns.RRTypeSOA, Class: dns.ClassIN, TTL: 300,
+		Data: dns.EncodeSOAData(dns.SOA{MName: h.example.zone, RName: h.example.zone, Minimum: 300}),
+	}
+	chain := nsec3Chain(t, h.example, map[string][]uint16{
+		"example.com":     {dns.RRTypeSOA, dns.RRTypeNS, dns.RRTypeDNSKEY, dns.RRTypeRRSIG},
+		"www.example.com": {dns.RRTypeA, dns.RRTypeRRSIG},
+	})
+	www := addrRR(t, "www.example.com", "192.0.2.1")
+	forged := addrRR(t, "www.example.com", "198.51.100.1")
+	expired := h.example.signPeriod(t, []dns.RR{www}, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		rcode     uint16
+		answer    []dns.RR
+		authority []dns.RR
+		want      Security
+	}{
+		{"signed answer", "www.example.com", dns.RRTypeA, dns.RcodeNoError, signed(t, h.example, www), nil, Secure},
+		{"forged answer", "www.example.com", dns.RRTypeA, dns.RcodeNoError, []dns.RR{forged, h.example.sign(t, www)}, nil, Bogus},
+		{"stripped signature", "www.example.com", dns.RRTypeA, dns.RcodeNoError, []dns.RR{www}, nil, Bogus},
+		{"expired signature", "www.example.com", dns.RRTypeA, dns.RcodeNoError, []dns.RR{www, expired}, nil, Bogus},
+		{"unsigned zone", "www.insecure.com", dns.RRTypeA, dns.RcodeNoError, []dns.RR{addrRR(t, "www.insecure.com", "192.0.2.9")}, nil, Insecure},
+		{"proven NXDOMAIN", "nope.example.com", dns.RRTypeA, dns.RcodeNameError, nil, append(signed(t, h.example, soa), chain...), Secure},
+		{"unproven NXDOMAIN", "nope.example.com", dns.RRTypeA, dns.RcodeNameError, nil, signed(t, h.example, soa), Bogus},
+		{"NXDOMAIN for existing name", "www.example.com", dns.RRTypeA, dns.RcodeNameError, nil, append(signed(t, h.example, soa), chain...), Bogus},
+		{"proven NODATA", "www.example.com", dns.RRTypeAAAA, dns.RcodeNoError, nil, append(signed(t, h.example, soa), chain...), Secure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := dns.CreateResponse(dns.CreateQuery(mustParseName(t, tt.qname), tt.qtype, 1))
+			resp.SetRcode(tt.rcode)
+			resp.Answer = tt.answer
+			resp.Authority = tt.authority
+
+			got, err := v.Validate(context.Background(), resp)
+			if got != tt.want {
+				t.Errorf("Validate() = %v (%v), want %v", got, err, tt.want)
+			}
+			if (err != nil) != (tt.want == Bogus) {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+
+	// Validated keys are remembered
+	before := h.lookups.Load()
+	resp := dns.CreateResponse(dns.CreateQuery(www.Name, dns.RRTypeA, 1))
+	resp.Answer = signed(t, h.example, www)
+	if got, err := v.Validate(context.Background(), resp); got != Secure {
+		t.Fatalf("Validate() = %v, %v", got, err)
+	}
+	if n := h.lookups.Load() - before; n != 0 {
+		t.Errorf("Repeated validation made %d lookups", n)
+	}
+}
+
+func TestValidateWrongTrustAnchor(t *testing.T) {
+	h := newTestHierarchy(t)
+	other := newTestKey(t, dns.Name{}, AlgorithmED25519)
+	v := NewValidator([]TrustAnchor{{Zone: dns.Name{}, DS: other.ds(t)}}, h.lookup)
+
+	resp := dns.CreateResponse(dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 1))
+	resp.Answer = signed(t, h.example, addrRR(t, "www.example.com", "192.0.2.1"))
+	if got, err := v.Validate(context.Background(), resp); got != Bogus || !errors.Is(err, ErrBadDelegation) {
+		t.Errorf("Validate() = %v, %v; want bogus", got, err)
+	}
+}
+
+func TestParseTrustAnchors(t *testing.T) {
+	input := `
+; Root KSK-2024
+. 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+example.com. IN DNSKEY 257 3 15 l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4=  # RFC 8080
+`
+	anchors, err := ParseTrustAnchors(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseTrustAnchors() error = %v", err)
+	}
+	if len(anchors) != 2 {
+		t.Fatalf("Got %d anchors, want 2", len(anchors))
+	}
+	if got := anchors[0].String(); got != ". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16" {
+		t.Errorf("Root anchor: %s", got)
+	}
+	if got := anchors[1].String(); got != "example.com. IN DS 3613 15 2 3AA5AB37EFCE57F737FC1627013FEE07BDF241BD10F3B1964AB55C78E79A304B" {
+		t.Errorf("DNSKEY anchor: %s", got)
+	}
+
+	for _, bad := range []string{"", ". IN DS 1 8 2 zz", ". IN A 192.0.2.1 1 2", "example.com DS 1 2"} {
+		if _, err := ParseTrustAnchors(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseTrustAnchors(%q) succeeded", bad)
+		}
+	}
+
+	if len(DefaultTrustAnchors()) != 2 {
+		t.Error("Expected two root trust anchors")
+	}
+}
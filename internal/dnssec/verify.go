@@ -0,0 +1,301 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// DNSSEC algorithm numbers
+const (
+	AlgorithmRSASHA1         uint8 = 5
+	AlgorithmRSASHA1NSEC3    uint8 = 7
+	AlgorithmRSASHA256       uint8 = 8
+	AlgorithmRSASHA512       uint8 = 10
+	AlgorithmECDSAP256SHA256 uint8 = 13
+	AlgorithmECDSAP384SHA384 uint8 = 14
+	AlgorithmED25519         uint8 = 15
+)
+
+// DS digest types
+const (
+	DigestSHA1   uint8 = 1
+	DigestSHA256 uint8 = 2
+	DigestSHA384 uint8 = 4
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported DNSSEC algorithm")
+	ErrInvalidKey           = errors.New("invalid DNSKEY")
+	ErrBadSignature         = errors.New("signature verification failed")
+	ErrSignatureExpired     = errors.New("signature expired or not yet valid")
+)
+
+// SupportedAlgorithm reports whether signatures of the algorithm can be
+// verified.
+func SupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3, AlgorithmRSASHA256, AlgorithmRSASHA512,
+		AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519:
+		return true
+	}
+	return false
+}
+
+// SupportedDigest reports whether DS records of the digest type can be
+// checked.
+func SupportedDigest(digestType uint8) bool {
+	return digestType == DigestSHA1 || digestType == DigestSHA256 || digestType == DigestSHA384
+}
+
+// KeyTag returns the key tag of a DNSKEY (RFC 4034 Appendix B).
+func KeyTag(key dns.DNSKEY) uint16 {
+	var sum uint32
+	for i, b := range dns.EncodeDNSKEYData(key) {
+		if i&1 == 0 {
+			sum += uint32(b) << 8
+		} else {
+			sum += uint32(b)
+		}
+	}
+	sum += sum >> 16
+	return uint16(sum)
+}
+
+// ComputeDS returns the DS record of the zone's key with the given digest
+// type.
+func ComputeDS(zone dns.Name, key dns.DNSKEY, digestType uint8) (dns.DS, error) {
+	data := appendCanonicalName(nil, zone)
+	data = append(data, dns.EncodeDNSKEYData(key)...)
+
+	var digest []byte
+	switch digestType {
+	case DigestSHA1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case DigestSHA256:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case DigestSHA384:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return dns.DS{}, ErrUnsupportedAlgorithm
+	}
+
+	return dns.DS{KeyTag: KeyTag(key), Algorithm: key.Algorithm, DigestType: digestType, Digest: digest}, nil
+}
+
+// MatchDS reports whether the DS record refers to the zone's key.
+func MatchDS(zone dns.Name, key dns.DNSKEY, ds dns.DS) bool {
+	if ds.KeyTag != KeyTag(key) || ds.Algorithm != key.Algorithm {
+		return false
+	}
+	computed, err := ComputeDS(zone, key, ds.DigestType)
+	return err == nil && bytes.Equal(computed.Digest, ds.Digest)
+}
+
+// canonicalNames lists where names appear in the data of record types
+// whose names are lowercased in canonical form (RFC 4034 Section 6.2,
+// RFC 6840 Section 5.1): a fixed-size prefix, then names.
+var canonicalNames = map[uint16]struct{ prefix, names int }{
+	dns.RRTypeNS:    {0, 1},
+	dns.RRTypeCNAME: {0, 1},
+	dns.RRTypePTR:   {0, 1},
+	dns.RRTypeDNAME: {0, 1},
+	dns.RRTypeSOA:   {0, 2},
+	dns.RRTypeMX:    {2, 1},
+	dns.RRTypeSRV:   {6, 1},
+	dns.RRTypeRRSIG: {18, 1},
+}
+
+// appendCanonicalName appends the lowercase wire format of name to b.
+func appendCanonicalName(b []byte, name dns.Name) []byte {
+	for _, label := range name {
+		b = append(b, byte(len(label)))
+		b = append(b, bytes.ToLower(label)...)
+	}
+	return append(b, 0)
+}
+
+// canonicalRData returns the record data in canonical form, with embedded
+// names lowercased.
+func canonicalRData(rrType uint16, data []byte) []byte {
+	layout, ok := canonicalNames[rrType]
+	if !ok || len(data) < layout.prefix {
+		return data
+	}
+	out := bytes.Clone(data)
+	pos := layout.prefix
+	for i := 0; i < layout.names; i++ {
+		for pos < len(out) && out[pos] != 0 {
+			n := int(out[pos])
+			if pos+1+n > len(out) {
+				return data
+			}
+			copy(out[pos+1:], bytes.ToLower(out[pos+1:pos+1+n]))
+			pos += n + 1
+		}
+		pos++
+	}
+	return out
+}
+
+// signedData returns the data an RRSIG signs over the records: the RRSIG
+// header, then each record in canonical form and order (RFC 4034 Section
+// 3.1.8.1). Records expanded from a wildcard are signed with the wildcard
+// owner.
+func signedData(sig dns.RRSIG, rrs []dns.RR) []byte {
+	header := sig
+	header.SignerName = lowerName(sig.SignerName)
+	data := dns.EncodeRRSIGHeader(header)
+
+	owner := rrs[0].Name
+	if n := int(sig.Labels); n < labelCount(owner) {
+		owner = append(dns.Name{[]byte("*")}, owner[len(owner)-n:]...)
+	}
+	prefix := appendCanonicalName(nil, owner)
+
+	rdatas := make([][]byte, 0, len(rrs))
+	for _, rr := range rrs {
+		rdatas = append(rdatas, canonicalRData(rr.Type, rr.Data))
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+
+	for _, rdata := range rdatas {
+		data = append(data, prefix...)
+		data = binary.BigEndian.AppendUint16(data, rrs[0].Type)
+		data = binary.BigEndian.AppendUint16(data, rrs[0].Class)
+		data = binary.BigEndian.AppendUint32(data, sig.OriginalTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data
+}
+
+// signatureCurrent reports whether now lies in the signature's validity
+// period, using serial number arithmetic (RFC 4034 Section 3.1.5).
+func signatureCurrent(sig dns.RRSIG, now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-sig.Inception) >= 0 && int32(sig.Expiration-t) >= 0
+}
+
+// verifySignature checks an RRSIG over the records with the key. The
+// records must form one RRset covered by the signature.
+func verifySignature(sig dns.RRSIG, key dns.DNSKEY, rrs []dns.RR, now time.Time) error {
+	if !signatureCurrent(sig, now) {
+		return ErrSignatureExpired
+	}
+	if key.Algorithm != sig.Algorithm || key.Protocol != 3 || key.Flags&dns.DNSKEYFlagZone == 0 {
+		return ErrInvalidKey
+	}
+	return verifyData(key, signedData(sig, rrs), sig.Signature)
+}
+
+// verifyData checks a signature over data with the key.
+func verifyData(key dns.DNSKEY, data, signature []byte) error {
+	switch key.Algorithm {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3:
+		return verifyRSA(key.PublicKey, crypto.SHA1, data, signature)
+	case AlgorithmRSASHA256:
+		return verifyRSA(key.PublicKey, crypto.SHA256, data, signature)
+	case AlgorithmRSASHA512:
+		return verifyRSA(key.PublicKey, crypto.SHA512, data, signature)
+	case AlgorithmECDSAP256SHA256:
+		sum := sha256.Sum256(data)
+		return verifyECDSA(key.PublicKey, elliptic.P256(), sum[:], signature)
+	case AlgorithmECDSAP384SHA384:
+		sum := sha512.Sum384(data)
+		return verifyECDSA(key.PublicKey, elliptic.P384(), sum[:], signature)
+	case AlgorithmED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return ErrInvalidKey
+		}
+		if !ed25519.Verify(key.PublicKey, data, signature) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// verifyRSA checks an RSA PKCS#1 v1.5 signature with a key in DNSKEY
+// format (RFC 3110): exponent length, exponent, modulus.
+func verifyRSA(keyData []byte, hash crypto.Hash, data, signature []byte) error {
+	if len(keyData) < 3 {
+		return ErrInvalidKey
+	}
+	expLen, keyData := int(keyData[0]), keyData[1:]
+	if expLen == 0 {
+		expLen, keyData = int(binary.BigEndian.Uint16(keyData)), keyData[2:]
+	}
+	if expLen == 0 || expLen > 4 || len(keyData) <= expLen {
+		return ErrInvalidKey
+	}
+
+	exp := new(big.Int).SetBytes(keyData[:expLen])
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(keyData[expLen:]), E: int(exp.Int64())}
+
+	h := hash.New()
+	h.Write(data)
+	if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), signature); err != nil {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// verifyECDSA checks an ECDSA signature (r || s) with a key in DNSKEY
+// format (x || y, RFC 6605).
+func verifyECDSA(keyData []byte, curve elliptic.Curve, digest, signature []byte) error {
+	size := (curve.Params().BitSize + 7) / 8
+	if len(keyData) != 2*size {
+		return ErrInvalidKey
+	}
+	if len(signature) != 2*size {
+		return ErrBadSignature
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(keyData[:size]),
+		Y:     new(big.Int).SetBytes(keyData[size:]),
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	if !ecdsa.Verify(pub, digest, r, s) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// labelCount returns the number of labels of name as counted by RRSIG,
+// not counting a leading wildcard label.
+func labelCount(name dns.Name) int {
+	if len(name) > 0 && bytes.Equal(name[0], []byte("*")) {
+		return len(name) - 1
+	}
+	return len(name)
+}
+
+// lowerName returns a lowercase copy of name.
+func lowerName(name dns.Name) dns.Name {
+	lower := make(dns.Name, len(name))
+	for i, label := range name {
+		lower[i] = bytes.ToLower(label)
+	}
+	return lower
+}
@@ -0,0 +1,242 @@
+package dnssec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func mustParseName(t *testing.T, s string) dns.Name {
+	t.Helper()
+	n, err := dns.ParseName(s)
+	if err != nil {
+		t.Fatalf("ParseName(%q) error = %v", s, err)
+	}
+	return n
+}
+
+// testKey is a zone signing key for tests.
+type testKey struct {
+	zone   dns.Name
+	dnskey dns.DNSKEY
+	signer crypto.Signer
+}
+
+// newTestKey generates a zone key of the algorithm.
+func newTestKey(t *testing.T, zone dns.Name, alg uint8) *testKey {
+	t.Helper()
+
+	k := &testKey{zone: zone, dnskey: dns.DNSKEY{Flags: dns.DNSKEYFlagZone | dns.DNSKEYFlagSEP, Protocol: 3, Algorithm: alg}}
+	switch alg {
+	case AlgorithmRSASHA256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey() error = %v", err)
+		}
+		exp := binary.BigEndian.AppendUint32(nil, uint32(priv.E))
+		for len(exp) > 1 && exp[0] == 0 {
+			exp = exp[1:]
+		}
+		k.dnskey.PublicKey = append(append([]byte{byte(len(exp))}, exp...), priv.N.Bytes()...)
+		k.signer = priv
+	case AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+		curve := elliptic.P256()
+		if alg == AlgorithmECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey() error = %v", err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		k.dnskey.PublicKey = append(priv.X.FillBytes(make([]byte, size)), priv.Y.FillBytes(make([]byte, size))...)
+		k.signer = priv
+	case AlgorithmED25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey() error = %v", err)
+		}
+		k.dnskey.PublicKey = pub
+		k.signer = priv
+	}
+	return k
+}
+
+// ds returns the SHA-256 DS record of the key.
+func (k *testKey) ds(t *testing.T) dns.DS {
+	t.Helper()
+	ds, err := ComputeDS(k.zone, k.dnskey, DigestSHA256)
+	if err != nil {
+		t.Fatalf("ComputeDS() error = %v", err)
+	}
+	return ds
+}
+
+// signPeriod returns an RRSIG record over the RRset valid from inception to
+// expiration.
+func (k *testKey) signPeriod(t *testing.T, rrs []dns.RR, inception, expiration time.Time) dns.RR {
+	t.Helper()
+
+	sig := dns.RRSIG{
+		TypeCovered: rrs[0].Type,
+		Algorithm:   k.dnskey.Algorithm,
+		Labels:      uint8(labelCount(rrs[0].Name)),
+		OriginalTTL: rrs[0].TTL,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      KeyTag(k.dnskey),
+		SignerName:  k.zone,
+	}
+	data := signedData(sig, rrs)
+
+	var err error
+	switch priv := k.signer.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		sig.Signature, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if priv.Curve == elliptic.P384() {
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		} else {
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		}
+		r, s, signErr := ecdsa.Sign(rand.Reader, priv, digest)
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig.Signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		err = signErr
+	case ed25519.PrivateKey:
+		sig.Signature = ed25519.Sign(priv, data)
+	}
+	if err != nil {
+		t.Fatalf("sign error = %v", err)
+	}
+
+	return dns.RR{Name: rrs[0].Name, Type: dns.RRTypeRRSIG, Class: dns.ClassIN, TTL: rrs[0].TTL, Data: dns.EncodeRRSIGData(sig)}
+}
+
+// sign returns an RRSIG record over the RRset valid for an hour around now.
+func (k *testKey) sign(t *testing.T, rrs ...dns.RR) dns.RR {
+	t.Helper()
+	now := time.Now()
+	return k.signPeriod(t, rrs, now.Add(-time.Hour), now.Add(time.Hour))
+}
+
+// keyRRs returns the DNSKEY RRset of the zone with its self-signature.
+func (k *testKey) keyRRs(t *testing.T) []dns.RR {
+	t.Helper()
+	rr := dns.RR{Name: k.zone, Type: dns.RRTypeDNSKEY, Class: dns.ClassIN, TTL: 3600, Data: dns.EncodeDNSKEYData(k.dnskey)}
+	return []dns.RR{rr, k.sign(t, rr)}
+}
+
+func addrRR(t *testing.T, name, addr string) dns.RR {
+	return dns.RR{
+		Name: mustParseName(t, name), Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 300,
+		Data: dns.EncodeAddrData(netip.MustParseAddr(addr)),
+	}
+}
+
+func TestKeyTagAndDS(t *testing.T) {
+	// RFC 8080 Section 6.1
+	pub, _ := base64.StdEncoding.DecodeString("l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4=")
+	key := dns.DNSKEY{Flags: 257, Protocol: 3, Algorithm: AlgorithmED25519, PublicKey: pub}
+	digest, _ := hex.DecodeString("3aa5ab37efce57f737fc1627013fee07bdf241bd10f3b1964ab55c78e79a304b")
+	zone := mustParseName(t, "example.com")
+
+	if tag := KeyTag(key); tag != 3613 {
+		t.Errorf("KeyTag() = %d, want 3613", tag)
+	}
+
+	ds := dns.DS{KeyTag: 3613, Algorithm: AlgorithmED25519, DigestType: DigestSHA256, Digest: digest}
+	if !MatchDS(zone, key, ds) {
+		t.Error("MatchDS() = false for the published DS")
+	}
+	if !MatchDS(mustParseName(t, "EXAMPLE.com"), key, ds) {
+		t.Error("MatchDS() depends on the case of the zone")
+	}
+	ds.Digest = append([]byte{0}, digest[1:]...)
+	if MatchDS(zone, key, ds) {
+		t.Error("MatchDS() = true for a wrong digest")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	zone := mustParseName(t, "example.com")
+	algorithms := []uint8{AlgorithmRSASHA256, AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519}
+
+	for _, alg := range algorithms {
+		k := newTestKey(t, zone, alg)
+		rrs := []dns.RR{addrRR(t, "www.example.com", "192.0.2.1"), addrRR(t, "www.example.com", "192.0.2.2")}
+		sigRR := k.sign(t, rrs...)
+		sig, err := dns.DecodeRRSIGData(sigRR.Data)
+		if err != nil {
+			t.Fatalf("DecodeRRSIGData() error = %v", err)
+		}
+		now := time.Now()
+
+		if err := verifySignature(sig, k.dnskey, rrs, now); err != nil {
+			t.Errorf("alg %d: verifySignature() error = %v", alg, err)
+		}
+
+		// Order and case of the records don't matter
+		swapped := []dns.RR{rrs[1], rrs[0]}
+		swapped[0].Name = mustParseName(t, "WWW.Example.COM")
+		swapped[1].Name = swapped[0].Name
+		if err := verifySignature(sig, k.dnskey, swapped, now); err != nil {
+			t.Errorf("alg %d: reordered: verifySignature() error = %v", alg, err)
+		}
+
+		tampered := []dns.RR{rrs[0], addrRR(t, "www.example.com", "192.0.2.3")}
+		if err := verifySignature(sig, k.dnskey, tampered, now); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("alg %d: tampered: got %v", alg, err)
+		}
+
+		if err := verifySignature(sig, k.dnskey, rrs, now.Add(2*time.Hour)); !errors.Is(err, ErrSignatureExpired) {
+			t.Errorf("alg %d: expired: got %v", alg, err)
+		}
+	}
+}
+
+func TestVerifyWildcardSignature(t *testing.T) {
+	zone := mustParseName(t, "example.com")
+	k := newTestKey(t, zone, AlgorithmED25519)
+
+	// Sign the wildcard, then answer a name expanded from it
+	wildcard := addrRR(t, "*.example.com", "192.0.2.1")
+	sig, _ := dns.DecodeRRSIGData(k.sign(t, wildcard).Data)
+
+	expanded := addrRR(t, "host.example.com", "192.0.2.1")
+	if err := verifySignature(sig, k.dnskey, []dns.RR{expanded}, time.Now()); err != nil {
+		t.Errorf("verifySignature() error = %v", err)
+	}
+}
+
+func TestCanonicalRData(t *testing.T) {
+	mx := dns.EncodeMXData(dns.MX{Preference: 10, Exchange: mustParseName(t, "Mail.Example.COM")})
+	want := dns.EncodeMXData(dns.MX{Preference: 10, Exchange: mustParseName(t, "mail.example.com")})
+	if got := canonicalRData(dns.RRTypeMX, mx); string(got) != string(want) {
+		t.Errorf("MX: got %x, want %x", got, want)
+	}
+
+	// Text data keeps its case
+	txt := dns.EncodeTXTData([]byte("Hello"))
+	if got := canonicalRData(dns.RRTypeTXT, txt); string(got) != string(txt) {
+		t.Errorf("TXT: got %x, want %x", got, txt)
+	}
+}
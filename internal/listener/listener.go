@@ -0,0 +1,187 @@
+// Package listener provides the shared bind and access control configuration
+// for local TCP and HTTP surfaces such as DoH, admin and metrics endpoints.
+package listener
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// TokenEnv is the environment variable holding the bearer token used when
+// none is configured.
+const TokenEnv = "DNS_AS_DOH_TOKEN"
+
+var (
+	ErrNoAddr        = errors.New("listen address is required")
+	ErrInvalidPrefix = errors.New("invalid allowlist entry")
+)
+
+// loopbackPrefixes is the allowlist used when none is configured.
+var loopbackPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// Config is the bind and access control configuration of a listener.
+type Config struct {
+	// Addr is the address to listen on
+	Addr string
+
+	// Allow is the list of client networks allowed to connect.
+	// If empty, only loopback clients are allowed.
+	Allow []netip.Prefix
+
+	// Token is the bearer token HTTP clients must present.
+	// If empty, the TokenEnv environment variable is used; if that is
+	// also empty, no token is required.
+	Token string
+}
+
+// Allowed reports whether a client address may use the listener.
+func (c *Config) Allowed(addr net.Addr) bool {
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	case *net.UDPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	default:
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = ap.Addr()
+	}
+	return c.allowedIP(ip)
+}
+
+// allowedIP reports whether ip is in the allowlist.
+func (c *Config) allowedIP(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap()
+
+	allow := c.Allow
+	if len(allow) == 0 {
+		allow = loopbackPrefixes
+	}
+	for _, p := range allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen opens a TCP listener that drops connections from clients outside
+// the allowlist.
+func (c *Config) Listen() (net.Listener, error) {
+	if c.Addr == "" {
+		return nil, ErrNoAddr
+	}
+
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", c.Addr, err)
+	}
+	return &aclListener{Listener: ln, config: c}, nil
+}
+
+// Middleware rejects HTTP requests from clients outside the allowlist and
+// requests without the bearer token, if one is configured.
+func (c *Config) Middleware(next http.Handler) http.Handler {
+	token := c.token()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ap, err := netip.ParseAddrPort(req.RemoteAddr)
+		if err != nil || !c.allowedIP(ap.Addr()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if token != "" && !validBearer(req, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// HasToken reports whether HTTP clients must present a bearer token.
+func (c *Config) HasToken() bool {
+	return c.token() != ""
+}
+
+// token returns the configured bearer token.
+func (c *Config) token() string {
+	if c.Token != "" {
+		return c.Token
+	}
+	return os.Getenv(TokenEnv)
+}
+
+// validBearer reports whether the request carries the bearer token.
+func validBearer(req *http.Request, token string) bool {
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+// aclListener is a net.Listener that enforces the allowlist on accept.
+type aclListener struct {
+	net.Listener
+	config *Config
+}
+
+// Accept returns the next connection from an allowed client.
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.config.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// ParseAllowlist parses a comma-separated list of IP addresses and CIDR
+// prefixes.
+func ParseAllowlist(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidPrefix, entry)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPrefix, entry)
+		}
+		ip = ip.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,190 @@
+package listener
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: nil},
+		{name: "single ip", input: "192.168.1.10", want: []string{"192.168.1.10/32"}},
+		{name: "cidr masked", input: "10.1.2.3/8", want: []string{"10.0.0.0/8"}},
+		{name: "mixed", input: " ::1, 192.168.0.0/16 ", want: []string{"::1/128", "192.168.0.0/16"}},
+		{name: "invalid ip", input: "not-an-ip", wantErr: true},
+		{name: "invalid prefix", input: "10.0.0.0/33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAllowlist(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAllowlist() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseAllowlist() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].String() != tt.want[i] {
+					t.Errorf("Prefix %d: got %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConfigAllowed(t *testing.T) {
+	lan := &Config{Allow: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}}
+	def := &Config{}
+
+	tests := []struct {
+		name   string
+		config *Config
+		addr   net.Addr
+		want   bool
+	}{
+		{name: "default loopback", config: def, addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, want: true},
+		{name: "default loopback v6", config: def, addr: &net.TCPAddr{IP: net.ParseIP("::1")}, want: true},
+		{name: "default rejects lan", config: def, addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.5")}, want: false},
+		{name: "allowlist match", config: lan, addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.5")}, want: true},
+		{name: "allowlist mapped v4", config: lan, addr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.5")}, want: true},
+		{name: "allowlist excludes loopback", config: lan, addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, want: false},
+		{name: "udp addr", config: lan, addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.5")}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.Allowed(tt.addr); got != tt.want {
+				t.Errorf("Allowed(%v) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListen(t *testing.T) {
+	// Only 10.0.0.0/8 is allowed, so the loopback dial is dropped
+	config := &Config{
+		Addr:  "127.0.0.1:0",
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+
+	ln, err := config.Listen()
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+			close(accepted)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	// The server closes the connection without handing it to Accept
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected disallowed connection to be closed")
+	}
+
+	select {
+	case <-accepted:
+		t.Error("Disallowed connection was accepted")
+	default:
+	}
+}
+
+func TestListenNoAddr(t *testing.T) {
+	if _, err := (&Config{}).Listen(); err != ErrNoAddr {
+		t.Errorf("Listen() error = %v, want %v", err, ErrNoAddr)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	config := &Config{Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	handler := config.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{remoteAddr: "10.1.2.3:5000", want: http.StatusNoContent},
+		{remoteAddr: "127.0.0.1:5000", want: http.StatusForbidden},
+		{remoteAddr: "garbage", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.remoteAddr, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestMiddlewareToken(t *testing.T) {
+	handler := func(config *Config) http.Handler {
+		return config.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		env    string
+		header string
+		want   int
+	}{
+		{name: "no token configured", want: http.StatusNoContent},
+		{name: "valid token", token: "secret", header: "Bearer secret", want: http.StatusNoContent},
+		{name: "scheme case insensitive", token: "secret", header: "bearer secret", want: http.StatusNoContent},
+		{name: "missing header", token: "secret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "basic scheme", token: "secret", header: "Basic secret", want: http.StatusUnauthorized},
+		{name: "token from env", env: "envsecret", header: "Bearer envsecret", want: http.StatusNoContent},
+		{name: "env token required", env: "envsecret", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(TokenEnv, tt.env)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "127.0.0.1:5000"
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			handler(&Config{Token: tt.token}).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("Status: got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
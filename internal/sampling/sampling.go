@@ -0,0 +1,39 @@
+// Package sampling decides which of a stream of events to keep, so that
+// verbose logs and statistics stay affordable at high query rates.
+package sampling
+
+import "sync/atomic"
+
+// Sampler keeps one in every N events, starting with the first. The zero
+// Sampler keeps every event. It is safe for concurrent use.
+type Sampler struct {
+	rate  atomic.Int64
+	count atomic.Uint64
+}
+
+// New returns a Sampler keeping one in every n events.
+func New(n int) *Sampler {
+	s := &Sampler{}
+	s.SetRate(n)
+	return s
+}
+
+// SetRate sets the sampler to keep one in every n events; n of 1 or less
+// keeps every event.
+func (s *Sampler) SetRate(n int) {
+	s.rate.Store(int64(max(n, 1)))
+}
+
+// Rate returns the sampler's rate: it keeps one in every Rate() events.
+func (s *Sampler) Rate() int {
+	return int(max(s.rate.Load(), 1))
+}
+
+// Sample reports whether to keep the next event.
+func (s *Sampler) Sample() bool {
+	n := s.rate.Load()
+	if n <= 1 {
+		return true
+	}
+	return s.count.Add(1)%uint64(n) == 1
+}
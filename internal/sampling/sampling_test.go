@@ -0,0 +1,80 @@
+package sampling
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSampler(t *testing.T) {
+	tests := []struct {
+		rate   int
+		events int
+		want   int
+	}{
+		{rate: 0, events: 10, want: 10},
+		{rate: 1, events: 10, want: 10},
+		{rate: 3, events: 10, want: 4},
+		{rate: 10, events: 10, want: 1},
+		{rate: 100, events: 1000, want: 10},
+	}
+
+	for _, tt := range tests {
+		s := New(tt.rate)
+		kept := 0
+		for range tt.events {
+			if s.Sample() {
+				kept++
+			}
+		}
+		if kept != tt.want {
+			t.Errorf("rate %d: kept %d of %d events, want %d", tt.rate, kept, tt.events, tt.want)
+		}
+	}
+}
+
+func TestSamplerKeepsFirst(t *testing.T) {
+	s := New(1000)
+	if !s.Sample() {
+		t.Error("First event not kept")
+	}
+	if s.Sample() {
+		t.Error("Second event kept")
+	}
+}
+
+func TestSamplerZeroValue(t *testing.T) {
+	var s Sampler
+	if s.Rate() != 1 {
+		t.Errorf("Rate() = %d, want 1", s.Rate())
+	}
+	for range 5 {
+		if !s.Sample() {
+			t.Fatal("Zero Sampler dropped an event")
+		}
+	}
+}
+
+func TestSamplerConcurrent(t *testing.T) {
+	s := New(4)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	count := 0
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if s.Sample() {
+					mu.Lock()
+					count++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count != 200 {
+		t.Errorf("Kept %d of 800 events, want 200", count)
+	}
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/audit"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/listener"
+)
+
+// adminShutdownTimeout is how long Close waits for admin requests to finish
+const adminShutdownTimeout = 5 * time.Second
+
+// maxAdminBody bounds the size of admin request bodies
+const maxAdminBody = 4096
+
+var ErrAdminToken = errors.New("admin API requires a bearer token")
+
+// RateLimits are the rate limits that can be adjusted at runtime.
+type RateLimits struct {
+	RateLimit        int `json:"rate_limit"`         // queries per second per network
+	RateBurst        int `json:"rate_burst"`         // queries at once per network
+	FailureRateLimit int `json:"failure_rate_limit"` // failed queries per second per network
+	RRLLimit         int `json:"rrl_limit"`          // error responses per second per network
+	RRLAmplification int `json:"rrl_amplification"`  // response to query bytes per second per network
+	RRLSlip          int `json:"rrl_slip"`           // answer every Nth limited response truncated
+}
+
+// rateLimits returns the rate limits in config.
+func rateLimits(config *Config) RateLimits {
+	return RateLimits{
+		RateLimit:        config.RateLimit,
+		RateBurst:        config.RateBurst,
+		FailureRateLimit: config.FailureRateLimit,
+		RRLLimit:         config.RRLLimit,
+		RRLAmplification: config.RRLAmplification,
+		RRLSlip:          config.RRLSlip,
+	}
+}
+
+// rateLimitPrefixes returns the prefix lengths grouping clients into
+// networks for the rate limits in config.
+func rateLimitPrefixes(config *Config) (v4Bits, v6Bits int) {
+	v4Bits, v6Bits = config.RateLimitIPv4Prefix, config.RateLimitIPv6Prefix
+	if v4Bits == 0 {
+		v4Bits = DefaultRateLimitIPv4Prefix
+	}
+	if v6Bits == 0 {
+		v6Bits = DefaultRateLimitIPv6Prefix
+	}
+	return v4Bits, v6Bits
+}
+
+// SetRateLimits changes the rate limits. They stay in effect until changed
+// again, also across reloads that don't change them.
+func (h *Handler) SetRateLimits(limits RateLimits) {
+	h.security.SetRateLimit(limits.RateLimit, limits.RateBurst)
+	h.security.SetFailureRateLimit(limits.FailureRateLimit, 0)
+	h.security.SetResponseRateLimit(limits.RRLLimit, limits.RRLAmplification, limits.RRLSlip)
+	h.limits.Store(&limits)
+}
+
+// RateLimits returns the rate limits in effect.
+func (h *Handler) RateLimits() RateLimits {
+	return *h.limits.Load()
+}
+
+// FlushCaches drops the connections kept open to DoT and DoH upstreams, so
+// the next queries resolve and verify the upstreams again. The server
+// doesn't cache answers itself.
+func (h *Handler) FlushCaches() {
+	h.resolver.Load().FlushConnections()
+}
+
+// AdminServer serves the HTTP API for managing a running server: listing
+// client sessions, upstream statistics and top reports, flushing caches,
+// reloading the configuration, switching maintenance mode and adjusting
+// rate limits. Changes are recorded in the audit log.
+type AdminServer struct {
+	handler  *Handler
+	config   *listener.Config
+	reload   func(principal string) error
+	auditLog *audit.Log
+	server   *http.Server
+	ln       net.Listener
+}
+
+// NewAdminServer creates an admin API for handler. reload re-reads the
+// configuration, keys included, applies it and records the reload in the
+// audit log as done by principal. The listener config must have a bearer
+// token, since the API can change how the server runs.
+func NewAdminServer(handler *Handler, config *listener.Config, reload func(principal string) error, auditLog *audit.Log) (*AdminServer, error) {
+	if !config.HasToken() {
+		return nil, fmt.Errorf("%w (set -admin-token or the %s environment variable)", ErrAdminToken, listener.TokenEnv)
+	}
+
+	a := &AdminServer{
+		handler:  handler,
+		config:   config,
+		reload:   reload,
+		auditLog: auditLog,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.handleSessions)
+	mux.HandleFunc("GET /stats", a.handleStats)
+	mux.HandleFunc("GET /top", a.handleTop)
+	mux.HandleFunc("POST /cache/flush", a.handleFlush)
+	mux.HandleFunc("POST /reload", a.handleReload)
+	mux.HandleFunc("GET /maintenance", a.handleMaintenance)
+	mux.HandleFunc("PUT /maintenance", a.handleMaintenance)
+	mux.HandleFunc("GET /ratelimit", a.handleRateLimits)
+	mux.HandleFunc("PUT /ratelimit", a.handleRateLimits)
+	a.server = &http.Server{
+		Handler:           config.Middleware(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return a, nil
+}
+
+// Start starts serving the admin API.
+func (a *AdminServer) Start() error {
+	ln, err := a.config.Listen()
+	if err != nil {
+		return fmt.Errorf("failed to start admin API: %w", err)
+	}
+	a.ln = ln
+
+	go func() {
+		if err := a.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin API error: %v", err)
+		}
+	}()
+	log.Printf("Admin API listening on %s", ln.Addr())
+	return nil
+}
+
+// Addr returns the address the admin API listens on.
+func (a *AdminServer) Addr() net.Addr {
+	return a.ln.Addr()
+}
+
+// Close stops the admin API, letting requests in progress finish.
+func (a *AdminServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	return a.server.Shutdown(ctx)
+}
+
+// adminSession is a client session as listed by the admin API.
+type adminSession struct {
+	ClientID  string    `json:"client_id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+	Queries   uint64    `json:"queries"`
+}
+
+// adminUpstream is an upstream's statistics as listed by the admin API.
+type adminUpstream struct {
+	Upstream    string  `json:"upstream"`
+	TLD         string  `json:"tld"`
+	Queries     uint64  `json:"queries"`
+	Failures    uint64  `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+	P95Latency  string  `json:"p95_latency"`
+}
+
+// adminStats is the server state reported by the admin API.
+type adminStats struct {
+	Sessions    int             `json:"sessions"`
+	Replays     uint64          `json:"replays"`
+	Maintenance bool            `json:"maintenance"`
+	Goroutines  int             `json:"goroutines"`
+	Memory      int64           `json:"memory_estimate"`
+	Shedding    bool            `json:"shedding"`
+	Shed        uint64          `json:"shed"`
+	ClientBusy  uint64          `json:"client_busy"`
+	QPSLimited  uint64          `json:"qps_limited"`
+	Upstreams   []adminUpstream `json:"upstreams"`
+	Down        []string        `json:"upstreams_down,omitempty"`
+	Audit       []adminAudit    `json:"audit,omitempty"`
+}
+
+// adminAudit is an upstream's answer audit statistics as listed by the
+// admin API.
+type adminAudit struct {
+	Upstream   string `json:"upstream"`
+	Audited    uint64 `json:"audited"`
+	Mismatches uint64 `json:"mismatches"`
+}
+
+// handleSessions lists the tracked client sessions.
+func (a *AdminServer) handleSessions(w http.ResponseWriter, req *http.Request) {
+	sessions := a.handler.Sessions()
+	result := make([]adminSession, 0, len(sessions))
+	for _, s := range sessions {
+		result = append(result, adminSession{
+			ClientID:  hex.EncodeToString(s.ClientID[:]),
+			FirstSeen: s.FirstSeen.UTC(),
+			LastSeen:  s.LastSeen.UTC(),
+			BytesUp:   s.BytesUp,
+			BytesDown: s.BytesDown,
+			Queries:   s.Queries,
+		})
+	}
+	writeJSON(w, result)
+}
+
+// handleStats reports the session count, replays, load, queries refused
+// by the concurrency limits, upstream statistics and health, and answer
+// audits.
+func (a *AdminServer) handleStats(w http.ResponseWriter, req *http.Request) {
+	upstreams := a.handler.UpstreamStats()
+	load := a.handler.Load()
+	refused := a.handler.ConcurrencyStats()
+	stats := adminStats{
+		Sessions:    a.handler.clients.Len(),
+		Replays:     a.handler.ReplaysDetected(),
+		Maintenance: a.handler.Maintenance(),
+		Goroutines:  load.Goroutines,
+		Memory:      load.Memory,
+		Shedding:    load.Shedding,
+		Shed:        load.Shed,
+		ClientBusy:  refused.ClientBusy,
+		QPSLimited:  refused.QPSLimited,
+		Upstreams:   make([]adminUpstream, 0, len(upstreams)),
+		Down:        a.handler.UpstreamsDown(),
+	}
+	for _, u := range upstreams {
+		stats.Upstreams = append(stats.Upstreams, adminUpstream{
+			Upstream:    u.Upstream,
+			TLD:         u.TLD,
+			Queries:     u.Queries,
+			Failures:    u.Failures,
+			FailureRate: u.FailureRate(),
+			P95Latency:  u.P95Latency.String(),
+		})
+	}
+	for _, s := range a.handler.AuditStats() {
+		stats.Audit = append(stats.Audit, adminAudit(s))
+	}
+	writeJSON(w, stats)
+}
+
+// adminTop is the top domains and clients reported by the admin API.
+type adminTop struct {
+	Current  *TopReport `json:"current"`
+	Previous *TopReport `json:"previous"`
+}
+
+// handleTop reports the top domains and clients of today so far and of
+// the previous day.
+func (a *AdminServer) handleTop(w http.ResponseWriter, req *http.Request) {
+	current, previous := a.handler.TopReport()
+	if current == nil {
+		http.Error(w, "top reports are off (set -top-reports)", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, adminTop{Current: current, Previous: previous})
+}
+
+// handleFlush flushes the caches.
+func (a *AdminServer) handleFlush(w http.ResponseWriter, req *http.Request) {
+	a.handler.FlushCaches()
+	a.record(req, audit.ActionCacheFlush, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReload reloads the configuration and keys.
+func (a *AdminServer) handleReload(w http.ResponseWriter, req *http.Request) {
+	if err := a.reload(principal(req)); err != nil {
+		http.Error(w, fmt.Sprintf("reload failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMaintenance reports or switches maintenance mode. PUT takes a
+// JSON boolean.
+func (a *AdminServer) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPut {
+		var on bool
+		if !readJSON(w, req, &on) {
+			return
+		}
+		a.handler.SetMaintenance(on)
+		a.record(req, audit.ActionMaintenance, strconv.FormatBool(on))
+	}
+	writeJSON(w, a.handler.Maintenance())
+}
+
+// handleRateLimits reports or changes the rate limits. PUT takes the
+// limits to change; omitted ones keep their value.
+func (a *AdminServer) handleRateLimits(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPut {
+		limits := a.handler.RateLimits()
+		if !readJSON(w, req, &limits) {
+			return
+		}
+		if limits.RateLimit < 0 || limits.RateBurst < 0 || limits.FailureRateLimit < 0 ||
+			limits.RRLLimit < 0 || limits.RRLAmplification < 0 || limits.RRLSlip < 0 {
+			http.Error(w, "rate limits can't be negative", http.StatusBadRequest)
+			return
+		}
+		a.handler.SetRateLimits(limits)
+		a.record(req, audit.ActionRateLimit, fmt.Sprintf("rate %d, burst %d, failures %d, RRL %d, amplification %d, slip %d",
+			limits.RateLimit, limits.RateBurst, limits.FailureRateLimit, limits.RRLLimit, limits.RRLAmplification, limits.RRLSlip))
+	}
+	writeJSON(w, a.handler.RateLimits())
+}
+
+// record adds an admin API action to the audit log.
+func (a *AdminServer) record(req *http.Request, action, detail string) {
+	_ = a.auditLog.Record(principal(req), action, detail)
+}
+
+// principal names the client of an admin request in the audit log.
+func principal(req *http.Request) string {
+	return "admin " + req.RemoteAddr
+}
+
+// readJSON decodes the request body into v, answering Bad Request if it
+// isn't valid.
+func readJSON(w http.ResponseWriter, req *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxAdminBody)).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeJSON answers with v as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write admin response: %v", err)
+	}
+}
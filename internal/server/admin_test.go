@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/audit"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/listener"
+)
+
+func TestAdminServer(t *testing.T) {
+	h := newTestHandler(t, nil)
+	config := h.config
+
+	clientID := dns.NewClientID()
+	if err := h.clients.Admit(clientID); err != nil {
+		t.Fatalf("Admit() error = %v", err)
+	}
+
+	var logBuf bytes.Buffer
+	auditLog := audit.New(&logBuf)
+	reloads := 0
+	reload := func(principal string) error {
+		reloads++
+		return nil
+	}
+
+	// The API must be protected by a token
+	t.Setenv(listener.TokenEnv, "")
+	if _, err := NewAdminServer(h, &listener.Config{Addr: "127.0.0.1:0"}, reload, auditLog); !errors.Is(err, ErrAdminToken) {
+		t.Errorf("NewAdminServer() without token: error = %v, want %v", err, ErrAdminToken)
+	}
+
+	a, err := NewAdminServer(h, &listener.Config{Addr: "127.0.0.1:0", Token: "secret"}, reload, auditLog)
+	if err != nil {
+		t.Fatalf("NewAdminServer() error = %v", err)
+	}
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:5000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		a.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/sessions", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /sessions without token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec := do(http.MethodGet, "/sessions", "secret", "")
+	var sessions []adminSession
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil || len(sessions) != 1 {
+		t.Errorf("GET /sessions = %s, want one session", rec.Body)
+	}
+
+	rec = do(http.MethodGet, "/stats", "secret", "")
+	var stats adminStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || stats.Sessions != 1 {
+		t.Errorf("GET /stats = %s, want one session", rec.Body)
+	}
+
+	if rec := do(http.MethodGet, "/top", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /top with top reports off: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	if rec := do(http.MethodPost, "/cache/flush", "secret", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("POST /cache/flush: status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := do(http.MethodPost, "/reload", "secret", ""); rec.Code != http.StatusNoContent || reloads != 1 {
+		t.Errorf("POST /reload: status %d with %d reloads, want %d with 1", rec.Code, reloads, http.StatusNoContent)
+	}
+
+	if rec := do(http.MethodPut, "/maintenance", "secret", "true"); rec.Code != http.StatusOK || !h.Maintenance() {
+		t.Errorf("PUT /maintenance: status %d, maintenance %v", rec.Code, h.Maintenance())
+	}
+
+	// Omitted limits keep their value
+	rec = do(http.MethodPut, "/ratelimit", "secret", `{"rate_limit": 7}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /ratelimit: status %d: %s", rec.Code, rec.Body)
+	}
+	want := RateLimits{RateLimit: 7, FailureRateLimit: config.FailureRateLimit, RRLLimit: config.RRLLimit, RRLAmplification: config.RRLAmplification, RRLSlip: config.RRLSlip}
+	if got := h.RateLimits(); got != want {
+		t.Errorf("RateLimits() = %+v, want %+v", got, want)
+	}
+	if got := h.security.rateLimiter.rate; got != 7 {
+		t.Errorf("rate limiter rate = %v, want 7", got)
+	}
+	if rec := do(http.MethodPut, "/ratelimit", "secret", `{"rate_limit": -1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT /ratelimit with a negative limit: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// Runtime limits survive reloads that don't change them
+	same := *config
+	if err := h.Reload(&same); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got := h.RateLimits(); got != want {
+		t.Errorf("RateLimits() after reload = %+v, want %+v", got, want)
+	}
+
+	// Changes are audited
+	for _, action := range []string{audit.ActionCacheFlush, audit.ActionMaintenance, audit.ActionRateLimit} {
+		if !strings.Contains(logBuf.String(), `"action":"`+action+`"`) {
+			t.Errorf("audit log has no %s entry: %s", action, logBuf.String())
+		}
+	}
+}
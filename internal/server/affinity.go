@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var ErrInvalidInstanceLabel = errors.New("instance label must be a DNS label containing 0, 1, 8, 9 or '-'")
+
+// instanceName returns the subdomain of domain that reaches only this
+// instance, or nil without an instance label. Payload labels are lowercase
+// base32, so a label with a character outside that alphabet can't be
+// mistaken for payload.
+func instanceName(domain dns.Name, label string) (dns.Name, error) {
+	if label == "" {
+		return nil, nil
+	}
+	label = strings.ToLower(label)
+	if len(label) > 63 || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" ||
+		!strings.ContainsAny(label, "0189-") {
+		return nil, ErrInvalidInstanceLabel
+	}
+	return dns.NewName(append([][]byte{[]byte(label)}, domain...))
+}
+
+// payloadDomain returns the domain a tunnel query's payload is encoded
+// under: the instance subdomain if the query was sent to it, otherwise
+// the server's domain.
+func (h *Handler) payloadDomain(query *dns.Message) dns.Name {
+	if h.instance == nil || len(query.Question) != 1 {
+		return h.domain
+	}
+	if prefix, ok := query.Question[0].Name.TrimSuffix(h.instance); ok && len(prefix) > 0 {
+		return h.instance
+	}
+	return h.domain
+}
+
+// isInstanceApex reports whether name is this instance's subdomain itself,
+// which exists but holds no records.
+func (h *Handler) isInstanceApex(name dns.Name) bool {
+	return h.instance != nil && name.Equal(h.instance)
+}
+
+// instanceLabel returns the label of this instance's subdomain, or nil.
+func (h *Handler) instanceLabel() []byte {
+	if h.instance == nil {
+		return nil
+	}
+	return h.instance[0]
+}
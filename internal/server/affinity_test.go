@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestInstanceName(t *testing.T) {
+	domain, _ := dns.ParseName("t.example.com")
+
+	tests := []struct {
+		label string
+		want  string
+		err   error
+	}{
+		{"", "", nil},
+		{"ns-a", "ns-a.t.example.com", nil},
+		{"Node1", "node1.t.example.com", nil},
+		{"abc", "", ErrInvalidInstanceLabel},   // could be payload
+		{"a2b7", "", ErrInvalidInstanceLabel},  // could be payload
+		{"ns_1", "", ErrInvalidInstanceLabel},  // not a hostname label
+		{"a.b-1", "", ErrInvalidInstanceLabel}, // more than one label
+	}
+
+	for _, tt := range tests {
+		name, err := instanceName(domain, tt.label)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("instanceName(%q) error = %v, want %v", tt.label, err, tt.err)
+			continue
+		}
+		if tt.want == "" && name != nil {
+			t.Errorf("instanceName(%q) = %s, want none", tt.label, name)
+		}
+		if tt.want != "" && name.String() != tt.want {
+			t.Errorf("instanceName(%q) = %s, want %s", tt.label, name, tt.want)
+		}
+	}
+}
+
+func TestPayloadDomain(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) { c.InstanceLabel = "ns-a" })
+
+	for _, tt := range []struct{ name, want string }{
+		{"abcd.t.example.com", "t.example.com"},
+		{"abcd.ns-a.t.example.com", "ns-a.t.example.com"},
+		{"ns-a.t.example.com", "t.example.com"},
+		{"abcd.ns-b.t.example.com", "t.example.com"},
+	} {
+		name, _ := dns.ParseName(tt.name)
+		query := dns.CreateQuery(name, dns.RRTypeTXT, 1)
+		if got := h.payloadDomain(query).String(); got != tt.want {
+			t.Errorf("payloadDomain(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	apex, _ := dns.ParseName("ns-a.t.example.com")
+	if !h.isInstanceApex(apex) {
+		t.Error("isInstanceApex() = false for the instance subdomain")
+	}
+}
+
+func TestReferralResponse(t *testing.T) {
+	domain, _ := dns.ParseName("t.example.com")
+	records, err := ParseZoneRecords(strings.NewReader(
+		"@ NS ns1\nns1 A 192.0.2.1\nns2 A 192.0.2.2\nns-a NS ns1\nns-b NS ns2\n"), domain)
+	if err != nil {
+		t.Fatalf("ParseZoneRecords() error = %v", err)
+	}
+
+	h := newTestHandler(t, func(c *Config) {
+		c.InstanceLabel = "ns-a"
+		c.ZoneRecords = records
+	})
+
+	referral := func(name string) *dns.Message {
+		t.Helper()
+		query := dns.CreateQuery(mustParseName(t, name), dns.RRTypeTXT, 1)
+		data := h.referralResponse(query)
+		if data == nil {
+			return nil
+		}
+		resp, err := dns.ParseMessage(data)
+		if err != nil {
+			t.Fatalf("ParseMessage() error = %v", err)
+		}
+		return resp
+	}
+
+	// Another instance's subdomain is referred to its name server
+	resp := referral("abcd.ns-b.t.example.com")
+	if resp == nil {
+		t.Fatal("No referral for another instance's subdomain")
+	}
+	if resp.Flags&0x0400 != 0 || len(resp.Answer) != 0 || len(resp.Authority) != 1 {
+		t.Errorf("Referral: flags %#x, %d answers, %d authority records", resp.Flags, len(resp.Answer), len(resp.Authority))
+	}
+	if len(resp.Additional) == 0 || resp.Additional[0].Type != dns.RRTypeA {
+		t.Errorf("Referral without glue: %v", resp.Additional)
+	}
+
+	// The own subdomain and the rest of the zone are answered here
+	for _, name := range []string{"abcd.ns-a.t.example.com", "ns-a.t.example.com", "abcd.t.example.com", "t.example.com"} {
+		if referral(name) != nil {
+			t.Errorf("Referral for %s", name)
+		}
+	}
+}
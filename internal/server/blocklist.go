@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Blocklist constants
+const (
+	// BlockedTTL is the TTL of answers to blocked names
+	BlockedTTL = 300
+
+	// blocklistCheckInterval is how often blocklist and allowlist files
+	// are checked for changes
+	blocklistCheckInterval = time.Minute
+)
+
+// domainList is a set of names read from blocklist or allowlist files.
+type domainList struct {
+	names   map[string]struct{} // matching only themselves, lowercased
+	domains map[string]struct{} // matching their subdomains too, lowercased
+}
+
+// contains reports whether name is in the list.
+func (l *domainList) contains(name dns.Name) bool {
+	if _, ok := l.names[strings.ToLower(name.String())]; ok {
+		return true
+	}
+	for i := range name {
+		if _, ok := l.domains[strings.ToLower(name[i:].String())]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of entries in the list.
+func (l *domainList) len() int {
+	return len(l.names) + len(l.domains)
+}
+
+// read adds the entries of a blocklist or allowlist file to l and returns
+// the file's modification time (see parse).
+func (l *domainList) read(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read domain list: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read domain list: %w", err)
+	}
+	if err := l.parse(f); err != nil {
+		return time.Time{}, fmt.Errorf("%s:%w", path, err)
+	}
+	return info.ModTime(), nil
+}
+
+// parse adds the entries of a list in hosts-file or domain-list format to
+// l. Hosts-file lines, an address followed by names, list names matching
+// only themselves; names of a single label, such as localhost, are
+// skipped. Domain-list lines, a domain alone, optionally written
+// *.domain, match the domain and its subdomains. Text after '#' is a
+// comment.
+func (l *domainList) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) == 1 {
+			domain, err := dns.ParseName(strings.TrimPrefix(fields[0], "*."))
+			if err != nil || len(domain) == 0 {
+				return fmt.Errorf("%d: invalid domain %q", lineNum, fields[0])
+			}
+			l.domains[strings.ToLower(domain.String())] = struct{}{}
+			continue
+		}
+
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			return fmt.Errorf("%d: want a domain, or an address and names", lineNum)
+		}
+		for _, field := range fields[1:] {
+			name, err := dns.ParseName(field)
+			if err != nil {
+				return fmt.Errorf("%d: invalid name %q", lineNum, field)
+			}
+			if len(name) > 1 && !strings.EqualFold(field, "localhost.localdomain") {
+				l.names[strings.ToLower(name.String())] = struct{}{}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// blocklist answers queries for blocked names on the server instead of
+// the upstream. A nil *blocklist blocks nothing.
+type blocklist struct {
+	blocked  domainList
+	allowed  domainList
+	sinkhole []netip.Addr
+	modTimes map[string]time.Time // of the files when read
+}
+
+// newBlocklist reads the blocklists and allowlists of config, or returns
+// nil if it has no blocklists.
+func newBlocklist(config *Config) (*blocklist, error) {
+	if len(config.Blocklists) == 0 {
+		return nil, nil
+	}
+
+	b := &blocklist{
+		blocked:  domainList{names: make(map[string]struct{}), domains: make(map[string]struct{})},
+		allowed:  domainList{names: make(map[string]struct{}), domains: make(map[string]struct{})},
+		sinkhole: config.BlocklistSinkhole,
+		modTimes: make(map[string]time.Time),
+	}
+	for _, path := range config.Blocklists {
+		modTime, err := b.blocked.read(path)
+		if err != nil {
+			return nil, err
+		}
+		b.modTimes[path] = modTime
+	}
+	for _, path := range config.Allowlists {
+		modTime, err := b.allowed.read(path)
+		if err != nil {
+			return nil, err
+		}
+		b.modTimes[path] = modTime
+	}
+	return b, nil
+}
+
+// changed reports whether any of the files was modified since read.
+func (b *blocklist) changed() bool {
+	if b == nil {
+		return false
+	}
+	for path, modTime := range b.modTimes {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to check domain list: %v", err)
+			continue
+		}
+		if !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks reports whether queries for name are blocked: it is in a
+// blocklist and not in an allowlist.
+func (b *blocklist) blocks(name dns.Name) bool {
+	return b != nil && b.blocked.contains(name) && !b.allowed.contains(name)
+}
+
+// response returns the answer to a blocked query: NXDOMAIN, or with a
+// sinkhole, the sinkhole addresses of the query type, if any. Either
+// carries an Extended DNS Error saying the name is blocked.
+func (b *blocklist) response(query *dns.Message) *dns.Message {
+	resp := dns.CreateResponse(query)
+	if len(b.sinkhole) == 0 {
+		resp.SetRcode(dns.RcodeNameError)
+	} else {
+		q := query.Question[0]
+		for _, addr := range b.sinkhole {
+			switch {
+			case q.Type == dns.RRTypeA && addr.Is4():
+				resp.Answer = append(resp.Answer, dns.RR{Name: q.Name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: BlockedTTL, Data: dns.EncodeAddrData(addr)})
+			case q.Type == dns.RRTypeAAAA && addr.Is6():
+				resp.Answer = append(resp.Answer, dns.RR{Name: q.Name, Type: dns.RRTypeAAAA, Class: dns.ClassIN, TTL: BlockedTTL, Data: dns.EncodeAddrData(addr)})
+			}
+		}
+	}
+	resp.SetEDNS0(dns.EDNSMinUDPSize, false, dns.NewExtendedErrorOption(dns.EDEBlocked, "blocked by the server's blocklist"))
+	return resp
+}
+
+// blockedReply returns the encrypted reply to a tunneled query for a
+// blocked name.
+func (h *Handler) blockedReply(ctx context.Context, b *blocklist, cipher *crypto.Cipher, clientID dns.ClientID, query *dns.Message, id uint16) ([]*dns.Fragment, error) {
+	data, err := b.response(query).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return h.encryptReply(ctx, cipher, clientID, data, id, 0)
+}
+
+// runBlocklistLoop starts blocklistLoop if on and it isn't running, or
+// stops it if off, so blocklists enabled or disabled by a reload are
+// checked for changes like those given at startup. The caller holds
+// h.reloadMu.
+func (h *Handler) runBlocklistLoop(on bool) {
+	switch {
+	case on && h.stopBlocks == nil:
+		ctx, cancel := context.WithCancel(h.ctx)
+		h.stopBlocks = cancel
+		h.wg.Add(1)
+		go h.blocklistLoop(ctx)
+	case !on && h.stopBlocks != nil:
+		h.stopBlocks()
+		h.stopBlocks = nil
+	}
+}
+
+// blocklistLoop re-reads the blocklist and allowlist files whenever one
+// changes, until ctx is done.
+func (h *Handler) blocklistLoop(ctx context.Context) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(blocklistCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.reloadBlocklist()
+	}
+}
+
+// reloadBlocklist re-reads the blocklist and allowlist files if one
+// changed. Lists that fail to read are logged and the previous ones kept.
+func (h *Handler) reloadBlocklist() {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	if !h.blocklist.Load().changed() {
+		return
+	}
+	b, err := newBlocklist(h.active)
+	if err != nil {
+		log.Printf("Keeping the previous blocklist: %v", err)
+		return
+	}
+	h.blocklist.Store(b)
+	logBlocklist("Blocklist reloaded", b)
+}
+
+// logBlocklist logs the size of a blocklist, if any.
+func logBlocklist(prefix string, b *blocklist) {
+	if b == nil {
+		return
+	}
+	log.Printf("%s: %d names and domains blocked, %d allowed", prefix, b.blocked.len(), b.allowed.len())
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func writeList(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDomainListParse(t *testing.T) {
+	l := domainList{names: make(map[string]struct{}), domains: make(map[string]struct{})}
+	list := `# hosts file
+127.0.0.1  localhost localhost.localdomain
+::1        ip6-localhost
+0.0.0.0    Ads.Example.com tracker.example.net   # two names
+# domain list
+*.malware.example
+phishing.example
+`
+	if err := l.parse(strings.NewReader(list)); err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if l.len() != 4 {
+		t.Errorf("parse() = %d entries, want 4: %v %v", l.len(), l.names, l.domains)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"ads.example.com", true},
+		{"www.ads.example.com", false}, // hosts entries match only themselves
+		{"tracker.EXAMPLE.net", true},
+		{"malware.example", true},
+		{"a.b.malware.example", true},
+		{"www.phishing.example", true},
+		{"notphishing.example", false},
+		{"localhost", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := l.contains(mustParseName(t, tt.name)); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, list := range []string{".", "ads.example.com 0.0.0.0", "0.0.0.0 bad..name"} {
+		l := domainList{names: make(map[string]struct{}), domains: make(map[string]struct{})}
+		if err := l.parse(strings.NewReader(list)); err == nil {
+			t.Errorf("parse(%q) accepted an invalid list", list)
+		}
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	blocked, allowed := filepath.Join(dir, "blocked"), filepath.Join(dir, "allowed")
+	writeList(t, blocked, "ads.example\n")
+	writeList(t, allowed, "0.0.0.0 ok.ads.example\n")
+
+	config := DefaultConfig()
+	if b, err := newBlocklist(config); err != nil || b != nil {
+		t.Fatalf("newBlocklist() without blocklists = %v, %v, want nil", b, err)
+	}
+	config.Blocklists = []string{blocked}
+	config.Allowlists = []string{allowed}
+	b, err := newBlocklist(config)
+	if err != nil {
+		t.Fatalf("newBlocklist() error = %v", err)
+	}
+	if !b.blocks(mustParseName(t, "x.ads.example")) || b.blocks(mustParseName(t, "ok.ads.example")) {
+		t.Error("Allowlist doesn't override the blocklist")
+	}
+
+	query := dns.CreateQuery(mustParseName(t, "x.ads.example"), dns.RRTypeA, 1)
+	if resp := b.response(query); resp.Rcode() != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("response() without a sinkhole = rcode %d, %d answers, want NXDOMAIN", resp.Rcode(), len(resp.Answer))
+	}
+	b.sinkhole = []netip.Addr{netip.MustParseAddr("0.0.0.0"), netip.MustParseAddr("::")}
+	if got := describeAnswer(b.response(query)); got != "0.0.0.0" {
+		t.Errorf("response() to A = %s, want 0.0.0.0", got)
+	}
+	query = dns.CreateQuery(mustParseName(t, "x.ads.example"), dns.RRTypeTXT, 1)
+	if resp := b.response(query); resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 {
+		t.Errorf("response() to TXT = rcode %d, %d answers, want NODATA", resp.Rcode(), len(resp.Answer))
+	}
+
+	if b.changed() {
+		t.Error("changed() without changes")
+	}
+	writeList(t, blocked, "ads.example\ntracker.example\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(blocked, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !b.changed() {
+		t.Error("changed() missed a changed file")
+	}
+}
+
+func TestHandlerReloadBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked")
+	writeList(t, path, "ads.example\n")
+
+	h := newTestHandler(t, func(c *Config) { c.Blocklists = []string{path} })
+	config := h.config
+
+	tracker := mustParseName(t, "tracker.example")
+	if !h.blocklist.Load().blocks(mustParseName(t, "ads.example")) || h.blocklist.Load().blocks(tracker) {
+		t.Fatal("Blocklist not loaded")
+	}
+
+	// An invalid file keeps the previous list
+	writeList(t, path, "ads.example extra\n")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	h.reloadBlocklist()
+	if !h.blocklist.Load().blocks(mustParseName(t, "ads.example")) {
+		t.Error("Invalid blocklist replaced the previous one")
+	}
+
+	writeList(t, path, "tracker.example\n")
+	later = later.Add(time.Minute)
+	os.Chtimes(path, later, later)
+	h.reloadBlocklist()
+	if !h.blocklist.Load().blocks(tracker) {
+		t.Error("Changed blocklist not reloaded")
+	}
+
+	// Removing the blocklists on reload stops blocking
+	none := *config
+	none.Blocklists = nil
+	if err := h.Reload(&none); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if h.blocklist.Load().blocks(tracker) {
+		t.Error("Blocklist still applies after being removed")
+	}
+	if h.stopBlocks != nil {
+		t.Error("Blocklist checks still run after the blocklists were removed")
+	}
+
+	// Blocklists added on reload are checked for changes too
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if h.stopBlocks == nil {
+		t.Error("Blocklist checks not started for blocklists added on reload")
+	}
+	h.cancel()
+	h.wg.Wait()
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+)
+
+// Source validation constants
+const (
+	// DefaultChallengeThreshold is the number of error responses per
+	// minute after which an unvalidated client network is challenged
+	DefaultChallengeThreshold = 30
+
+	// challengeWindow is the window in which errors are counted
+	challengeWindow = time.Minute
+
+	// validatedFor is how long a network stays validated after a
+	// successful tunnel query
+	validatedFor = time.Hour
+
+	// maxChallengeSources bounds the number of tracked networks. When
+	// full, unknown networks are challenged.
+	maxChallengeSources = 65536
+)
+
+// challengeThreshold returns the effective challenge threshold of config.
+// Challenges are disabled without a TCP listener to retry on.
+func challengeThreshold(config *Config) int {
+	if !config.ListenTCP {
+		return 0
+	}
+	return config.ChallengeThreshold
+}
+
+// sourceState tracks errors and validation of a client network.
+type sourceState struct {
+	errors         int
+	windowStart    time.Time
+	validatedUntil time.Time
+}
+
+// sourceValidator decides which UDP sources must prove their address by
+// retrying over TCP before the server does expensive decryption and
+// upstream work for them. Networks that recently completed a tunnel query
+// are trusted; others are challenged once their error rate is high.
+type sourceValidator struct {
+	threshold int
+	sources   map[netip.Prefix]*sourceState
+	lastSweep time.Time
+	clock     clock.Clock
+	mu        sync.Mutex
+}
+
+// newSourceValidator creates a validator challenging networks with
+// threshold errors per minute. A threshold of 0 disables challenges.
+func newSourceValidator(threshold int) *sourceValidator {
+	return &sourceValidator{
+		threshold: threshold,
+		sources:   make(map[netip.Prefix]*sourceState),
+		clock:     clock.System,
+	}
+}
+
+// suspicious reports whether a UDP query from ip should be challenged.
+func (v *sourceValidator) suspicious(ip netip.Addr) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.threshold <= 0 || !ip.IsValid() {
+		return false
+	}
+
+	now := v.clock.Now()
+	s, ok := v.sources[clientNetwork(ip)]
+	if !ok {
+		// Too many networks to track, e.g. during a spoofed flood
+		return len(v.sources) >= maxChallengeSources
+	}
+	if now.Before(s.validatedUntil) {
+		return false
+	}
+	return now.Sub(s.windowStart) < challengeWindow && s.errors >= v.threshold
+}
+
+// recordError counts an error response to ip.
+func (v *sourceValidator) recordError(ip netip.Addr) {
+	if !ip.IsValid() {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.clock.Now()
+	s := v.state(clientNetwork(ip), now)
+	if s == nil {
+		return
+	}
+	if now.Sub(s.windowStart) >= challengeWindow {
+		s.errors = 0
+		s.windowStart = now
+	}
+	s.errors++
+}
+
+// recordValid marks the network of ip as validated.
+func (v *sourceValidator) recordValid(ip netip.Addr) {
+	if !ip.IsValid() {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.clock.Now()
+	if s := v.state(clientNetwork(ip), now); s != nil {
+		s.validatedUntil = now.Add(validatedFor)
+	}
+}
+
+// setThreshold changes the error threshold.
+func (v *sourceValidator) setThreshold(threshold int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.threshold = threshold
+}
+
+// setClock sets the clock errors and validations are timed with,
+// clock.System if nil.
+func (v *sourceValidator) setClock(clk clock.Clock) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.clock = clock.Or(clk)
+}
+
+// state returns the state of a network, creating it if there is room.
+func (v *sourceValidator) state(network netip.Prefix, now time.Time) *sourceState {
+	if s, ok := v.sources[network]; ok {
+		return s
+	}
+
+	// Drop idle networks at most once per window, or when full
+	if len(v.sources) >= maxChallengeSources || now.Sub(v.lastSweep) > challengeWindow {
+		for k, s := range v.sources {
+			if now.Sub(s.windowStart) >= challengeWindow && now.After(s.validatedUntil) {
+				delete(v.sources, k)
+			}
+		}
+		v.lastSweep = now
+	}
+	if len(v.sources) >= maxChallengeSources {
+		return nil
+	}
+
+	s := &sourceState{windowStart: now}
+	v.sources[network] = s
+	return s
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestSourceValidator(t *testing.T) {
+	v := newSourceValidator(3)
+	ip := netip.MustParseAddr("198.51.100.7")
+
+	if v.suspicious(ip) {
+		t.Fatal("Unknown source challenged")
+	}
+	for i := 0; i < 3; i++ {
+		v.recordError(netip.MustParseAddr("198.51.100.200"))
+	}
+	if !v.suspicious(ip) {
+		t.Error("Source in a network over the threshold not challenged")
+	}
+	if v.suspicious(netip.MustParseAddr("198.51.101.7")) {
+		t.Error("Other network challenged")
+	}
+
+	// Validated networks are trusted despite errors
+	v.recordValid(ip)
+	v.recordError(ip)
+	if v.suspicious(ip) {
+		t.Error("Validated source challenged")
+	}
+
+	v.setThreshold(0)
+	v.recordError(netip.MustParseAddr("192.0.2.1"))
+	if v.suspicious(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("Source challenged with challenges disabled")
+	}
+}
+
+func TestSourceValidatorExpiry(t *testing.T) {
+	s := NewSecurity(0)
+	s.SetChallengeThreshold(1)
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	s.SetClock(clk)
+	ip := netip.MustParseAddr("198.51.100.7")
+
+	s.RecordSourceValid(ip)
+	s.RecordSourceError(ip)
+	clk.Advance(validatedFor - time.Second)
+	if s.CheckSource(ip) {
+		t.Error("Validated source challenged")
+	}
+
+	// Errors are counted again once the validation ran out
+	clk.Advance(time.Second)
+	s.RecordSourceError(ip)
+	if !s.CheckSource(ip) {
+		t.Error("Source still trusted after the validation ran out")
+	}
+}
+
+func TestSourceValidatorFull(t *testing.T) {
+	v := newSourceValidator(1)
+	for i := 0; i < maxChallengeSources; i++ {
+		v.sources[netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24)] = &sourceState{}
+	}
+
+	// Unknown networks are challenged while the table is full
+	if !v.suspicious(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("Unknown source not challenged with a full table")
+	}
+}
+
+func TestTruncationChallenge(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.UpstreamResolver = startRcodeUpstream(t, dns.RcodeNoError)
+		c.RRLLimit = 0
+		c.ChallengeThreshold = 2
+	})
+	config := h.config
+
+	handle := func(name dns.Name, addr net.Addr, maxSize int) *dns.Message {
+		t.Helper()
+		query := dns.CreateQuery(name, dns.RRTypeTXT, 0x1234)
+		query.AddEDNS0(uint16(config.MaxUDPSize))
+		data, _ := query.Marshal()
+		resp, err := dns.ParseMessage(h.handleQuery(data, addr, maxSize))
+		if err != nil {
+			t.Fatalf("ParseMessage() error = %v", err)
+		}
+		return resp
+	}
+	tunnelName := func() dns.Name {
+		clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+		inner, _ := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1).Marshal()
+		encrypted, _ := clientCipher.Encrypt(inner)
+		f := &dns.Fragment{ID: 1, Seq: 0, Total: 1, Data: encrypted}
+		name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+		if err != nil {
+			t.Fatalf("EncodePayload() error = %v", err)
+		}
+		return name
+	}
+
+	udp := &net.UDPAddr{IP: net.ParseIP("203.0.113.9"), Port: 5353}
+	junk := mustParseName(t, "junk.t.example.com")
+	for i := 0; i < 2; i++ {
+		if resp := handle(junk, udp, config.MaxUDPSize); resp.Flags&0x0200 != 0 {
+			t.Fatalf("Query %d challenged below the threshold", i)
+		}
+	}
+
+	// Over the threshold even valid tunnel queries must retry over TCP
+	resp := handle(tunnelName(), udp, config.MaxUDPSize)
+	if resp.Flags&0x0200 == 0 || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 {
+		t.Fatalf("Challenge: rcode %d, flags %#x, %d answers", resp.Rcode(), resp.Flags, len(resp.Answer))
+	}
+
+	tcp := &net.TCPAddr{IP: udp.IP, Port: 5353}
+	if resp := handle(tunnelName(), tcp, tcpMaxMessageSize); resp.Flags&0x0200 != 0 || len(resp.Answer) == 0 {
+		t.Fatalf("TCP retry: rcode %d, flags %#x", resp.Rcode(), resp.Flags)
+	}
+
+	// The successful TCP query validated the network
+	if resp := handle(tunnelName(), udp, config.MaxUDPSize); resp.Flags&0x0200 != 0 || len(resp.Answer) == 0 {
+		t.Errorf("UDP after validation: rcode %d, flags %#x", resp.Rcode(), resp.Flags)
+	}
+}
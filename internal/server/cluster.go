@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Cluster message types
+const (
+	// clusterReplay carries nonces of accepted tunnel messages
+	clusterReplay byte = 1
+
+	// clusterSession carries a client ID and an encoded session
+	clusterSession byte = 2
+)
+
+// Cluster limits
+const (
+	// clusterFlushInterval is how often batched nonces are sent to peers
+	clusterFlushInterval = 20 * time.Millisecond
+
+	// clusterMaxNonces bounds the nonces in one message, keeping it well
+	// below common path MTUs
+	clusterMaxNonces = 80
+)
+
+var (
+	ErrClusterMessage = errors.New("invalid cluster message")
+	ErrClusterSecret  = errors.New("invalid cluster key")
+)
+
+// cluster shares replay detection and sessions with the other server
+// instances of a deployment behind anycast or several NS records, so
+// clients can reach any instance. Messages are UDP datagrams encrypted
+// with a key derived from the cluster key, which clients don't hold, and
+// are only accepted once from the address of a configured peer. Sharing
+// is best effort and eventually consistent: a message replayed to two
+// instances within the flush interval, or a lost datagram, can go
+// undetected by one of them.
+type cluster struct {
+	conn    *net.UDPConn
+	peers   []*net.UDPAddr
+	cipher  *crypto.Cipher
+	replay  *crypto.ReplayDetector // nonces of accepted peer messages
+	pending [][]byte               // accepted nonces not yet sent
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// checkClusterSecret verifies that the cluster key is set and isn't a key
+// clients hold, which would let any client read the session keys peers
+// share and forge their messages.
+func checkClusterSecret(config *Config) error {
+	if len(config.ClusterSecret) != crypto.KeySize {
+		return fmt.Errorf("%w: the key is %d bytes, want %d (generate one with -gen-key and give every instance the same -cluster-key-file)",
+			ErrClusterSecret, len(config.ClusterSecret), crypto.KeySize)
+	}
+	clientSecrets := append([][]byte{config.SharedSecret}, config.PreviousSecrets...)
+	for _, keys := range config.ClientKeys {
+		for _, key := range keys {
+			clientSecrets = append(clientSecrets, key.Secret)
+		}
+	}
+	for _, secret := range clientSecrets {
+		if bytes.Equal(secret, config.ClusterSecret) {
+			return fmt.Errorf("%w: it is also a client key (generate a separate one with -gen-key)", ErrClusterSecret)
+		}
+	}
+	return nil
+}
+
+// newCluster listens for peers on addr.
+func newCluster(addr string, peers []string, clusterSecret []byte) (*cluster, error) {
+	cipher, err := crypto.NewGroupCipher(clusterSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster cipher: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &cluster{
+		cipher: cipher,
+		replay: crypto.NewReplayDetector(crypto.ReplayWindow),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, peer := range peers {
+		udpAddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster peer %q: %w", peer, err)
+		}
+		c.peers = append(c.peers, udpAddr)
+	}
+
+	listenAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster address: %w", err)
+	}
+	c.conn, err = net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for cluster peers: %w", err)
+	}
+	return c, nil
+}
+
+// start starts sending queued nonces and applying peer messages to h.
+func (c *cluster) start(h *Handler) {
+	c.wg.Add(2)
+	go c.flushLoop()
+	go c.receiveLoop(h)
+}
+
+// close sends the last queued nonces and stops.
+func (c *cluster) close() {
+	c.cancel()
+	_ = c.conn.SetReadDeadline(time.Now())
+	c.wg.Wait()
+	c.conn.Close()
+}
+
+// shareReplay queues the nonce of an accepted message for the peers.
+func (c *cluster) shareReplay(nonce []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, append([]byte(nil), nonce...))
+}
+
+// shareSession sends a newly established session to the peers.
+func (c *cluster) shareSession(clientID dns.ClientID, keyID dns.KeyID, cipher *crypto.Cipher) {
+	msg := append([]byte{clusterSession}, clientID[:]...)
+	c.send(append(msg, encodeSession(&session{keyID: keyID, cipher: cipher, lastUsed: time.Now()})...))
+}
+
+// flush sends the queued nonces to the peers.
+func (c *cluster) flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	for len(pending) > 0 {
+		n := min(len(pending), clusterMaxNonces)
+		msg := []byte{clusterReplay}
+		for _, nonce := range pending[:n] {
+			msg = append(msg, nonce...)
+		}
+		c.send(msg)
+		pending = pending[n:]
+	}
+}
+
+// send encrypts a message and sends it to every peer.
+func (c *cluster) send(msg []byte) {
+	data, err := c.cipher.Encrypt(msg)
+	if err != nil {
+		log.Printf("Failed to encrypt cluster message: %v", err)
+		return
+	}
+	for _, peer := range c.peers {
+		_, _ = c.conn.WriteToUDP(data, peer)
+	}
+}
+
+// flushLoop sends queued nonces every flush interval until closed.
+func (c *cluster) flushLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(clusterFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.flush()
+			return
+		case <-ticker.C:
+			c.flush()
+		}
+	}
+}
+
+// receiveLoop applies peer messages until closed.
+func (c *cluster) receiveLoop(h *Handler) {
+	defer c.wg.Done()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		msg, ok := c.open(buf[:n], from)
+		if !ok {
+			continue
+		}
+		if err := h.applyClusterMessage(msg); err != nil {
+			log.Printf("Cluster message rejected from %s: %v", from, err)
+		}
+	}
+}
+
+// open decrypts a datagram from a peer. It reports false for datagrams
+// that don't come from a configured peer, aren't authentic and recent, or
+// were accepted before.
+func (c *cluster) open(data []byte, from *net.UDPAddr) ([]byte, bool) {
+	if !c.isPeer(from) {
+		return nil, false
+	}
+	msg, err := c.cipher.Decrypt(data)
+	if err != nil {
+		return nil, false
+	}
+	if c.replay.Check(crypto.ReplayKey(data)) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// isPeer reports whether addr is the cluster address of a peer.
+func (c *cluster) isPeer(addr *net.UDPAddr) bool {
+	for _, peer := range c.peers {
+		if addr != nil && peer.IP.Equal(addr.IP) && peer.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// applyClusterMessage applies a decrypted message from a peer.
+func (h *Handler) applyClusterMessage(msg []byte) error {
+	if len(msg) == 0 {
+		return ErrClusterMessage
+	}
+	body := msg[1:]
+
+	switch msg[0] {
+	case clusterReplay:
+		if len(body)%crypto.NonceSize != 0 {
+			return ErrClusterMessage
+		}
+		for ; len(body) > 0; body = body[crypto.NonceSize:] {
+			h.security.MarkReplay(body[:crypto.NonceSize])
+		}
+
+	case clusterSession:
+		var clientID dns.ClientID
+		if len(body) < len(clientID) {
+			return ErrClusterMessage
+		}
+		copy(clientID[:], body)
+		s, ok := decodeSession(body[len(clientID):])
+		if !ok {
+			return ErrClusterMessage
+		}
+		return h.sessions.restore(clientID, s)
+
+	default:
+		return fmt.Errorf("%w: type %d", ErrClusterMessage, msg[0])
+	}
+	return nil
+}
+
+// checkReplay reports whether an authentic message was seen before, by
+// this instance or a peer, and shares its nonce with the peers otherwise.
+func (h *Handler) checkReplay(data []byte) bool {
+	nonce := crypto.ReplayKey(data)
+	if h.security.CheckReplay(nonce) {
+		return true
+	}
+	if h.cluster != nil {
+		h.cluster.shareReplay(nonce)
+	}
+	return false
+}
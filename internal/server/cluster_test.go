@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var testClusterSecret = bytes.Repeat([]byte{7}, crypto.KeySize)
+
+func newClusterHandler(t *testing.T) *Handler {
+	t.Helper()
+	h := newTestHandler(t, nil)
+	cluster, err := newCluster("127.0.0.1:0", nil, testClusterSecret)
+	if err != nil {
+		t.Fatalf("newCluster() error = %v", err)
+	}
+	h.cluster = cluster
+	return h
+}
+
+func TestClusterSharing(t *testing.T) {
+	a, b := newClusterHandler(t), newClusterHandler(t)
+	a.cluster.peers = []*net.UDPAddr{b.cluster.conn.LocalAddr().(*net.UDPAddr)}
+	b.cluster.peers = []*net.UDPAddr{a.cluster.conn.LocalAddr().(*net.UDPAddr)}
+	a.cluster.start(a)
+	b.cluster.start(b)
+
+	clientCipher, _ := crypto.NewCipher(make([]byte, 32), true)
+	sessionCipher, _ := crypto.NewCipher(make([]byte, 32), false)
+	clientID := dns.NewClientID()
+	message, _ := clientCipher.Encrypt([]byte("query"))
+
+	// A accepts a message and establishes a session
+	if a.checkReplay(message) {
+		t.Fatal("checkReplay() rejected a new message")
+	}
+	if err := a.sessions.put(clientID, 7, sessionCipher); err != nil {
+		t.Fatalf("put() error = %v", err)
+	}
+	a.cluster.shareSession(clientID, 7, sessionCipher)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for b.sessions.len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cipher, err := b.sessions.get(clientID, 7)
+	if err != nil {
+		t.Fatalf("Session not shared: %v", err)
+	}
+	query, _ := clientCipher.Encrypt([]byte("query"))
+	if got, err := cipher.Decrypt(query); err != nil || string(got) != "query" {
+		t.Errorf("Decrypt() with shared session = %q, %v", got, err)
+	}
+
+	// B rejects the message once A's nonces are flushed
+	time.Sleep(5 * clusterFlushInterval)
+	if !b.checkReplay(message) {
+		t.Error("Message accepted by a peer was not rejected as a replay")
+	}
+}
+
+func TestClusterMessageValidation(t *testing.T) {
+	h := newClusterHandler(t)
+
+	for _, msg := range [][]byte{
+		nil,
+		{9},
+		append([]byte{clusterReplay}, make([]byte, crypto.NonceSize+1)...),
+		append([]byte{clusterSession}, 1, 2, 3),
+		append([]byte{clusterSession}, make([]byte, dns.ClientIDSize+10)...),
+	} {
+		if err := h.applyClusterMessage(msg); !errors.Is(err, ErrClusterMessage) {
+			t.Errorf("applyClusterMessage(%x) = %v, want %v", msg, err, ErrClusterMessage)
+		}
+	}
+}
+
+func TestClusterOpen(t *testing.T) {
+	h := newClusterHandler(t)
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}
+	h.cluster.peers = []*net.UDPAddr{peer}
+
+	sender, err := crypto.NewGroupCipher(testClusterSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := sender.Encrypt([]byte{clusterReplay})
+	if _, ok := h.cluster.open(data, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 5353}); ok {
+		t.Error("open() accepted a message from an address that isn't a peer")
+	}
+	if _, ok := h.cluster.open(data, &net.UDPAddr{IP: peer.IP, Port: 5354}); ok {
+		t.Error("open() accepted a message from another port of a peer")
+	}
+	if msg, ok := h.cluster.open(data, peer); !ok || !bytes.Equal(msg, []byte{clusterReplay}) {
+		t.Fatalf("open() = %x, %v, want the message", msg, ok)
+	}
+	if _, ok := h.cluster.open(data, peer); ok {
+		t.Error("open() accepted a replayed message")
+	}
+
+	// Clients hold the shared secret, not the cluster key
+	client, _ := crypto.NewGroupCipher(h.config.SharedSecret)
+	forged, _ := client.Encrypt([]byte{clusterReplay})
+	if _, ok := h.cluster.open(forged, peer); ok {
+		t.Error("open() accepted a message encrypted with the client key")
+	}
+}
+
+func TestCheckClusterSecret(t *testing.T) {
+	shared := bytes.Repeat([]byte{1}, crypto.KeySize)
+	previous := bytes.Repeat([]byte{2}, crypto.KeySize)
+	clientKey := bytes.Repeat([]byte{3}, crypto.KeySize)
+
+	tests := []struct {
+		name   string
+		secret []byte
+		ok     bool
+	}{
+		{"distinct", testClusterSecret, true},
+		{"missing", nil, false},
+		{"short", make([]byte, 16), false},
+		{"shared key", shared, false},
+		{"previous key", previous, false},
+		{"client key", clientKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.SharedSecret = shared
+			config.PreviousSecrets = [][]byte{previous}
+			config.ClientKeys = map[uint16][]crypto.ClientKey{1: {{Secret: clientKey}}}
+			config.ClusterSecret = tt.secret
+
+			err := checkClusterSecret(config)
+			if tt.ok && err != nil {
+				t.Errorf("checkClusterSecret() error = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrClusterSecret) {
+				t.Errorf("checkClusterSecret() = %v, want %v", err, ErrClusterSecret)
+			}
+		})
+	}
+}
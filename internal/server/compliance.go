@@ -0,0 +1,338 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// complianceUnknownType is the query type of the unknown type check, the
+// first private-use type.
+const complianceUnknownType = 65280
+
+// complianceUnknownOption is the EDNS option code of the unknown option
+// check, a local/experimental one.
+const complianceUnknownOption = 65534
+
+// ComplianceCheck is the result of one compliance check.
+type ComplianceCheck struct {
+	Name string
+
+	// Err is how the server deviated from an ordinary authoritative
+	// server, nil if it didn't
+	Err error
+}
+
+// ComplianceReport is the result of CheckCompliance.
+type ComplianceReport struct {
+	Checks []ComplianceCheck
+}
+
+// OK reports whether every check passed.
+func (r *ComplianceReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// complianceChecks are the checks of CheckCompliance, in order.
+var complianceChecks = []struct {
+	name string
+	run  func(ctx context.Context, p *complianceProbe) error
+}{
+	{"Authoritative SOA at the apex", checkApexSOA},
+	{"EDNS response, unknown options ignored", checkEDNSResponse},
+	{"No OPT record without EDNS", checkNoEDNS},
+	{"BADVERS for unknown EDNS versions", checkEDNSVersion},
+	{"NODATA for unknown types", checkUnknownType},
+	{"NXDOMAIN for missing names", checkMissingName},
+	{"Question case preserved", checkCasePreserved},
+	{"No authoritative answers outside the zone", checkOutOfZone},
+	{"Truncation and TCP retry", checkTruncation},
+}
+
+// CheckCompliance sends queries that resolvers and scanners commonly send
+// to the server listening at addr, authoritative for domain, and checks
+// that it answers them like an ordinary authoritative server: EDNS
+// handling, unknown types, case preservation and truncation. Each query
+// times out after timeout.
+func CheckCompliance(ctx context.Context, addr string, domain string, timeout time.Duration) (*ComplianceReport, error) {
+	name, err := dns.ParseName(domain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain: %w", err)
+	}
+	p := &complianceProbe{addr: addr, domain: name, timeout: timeout}
+
+	report := &ComplianceReport{}
+	for _, c := range complianceChecks {
+		report.Checks = append(report.Checks, ComplianceCheck{Name: c.name, Err: c.run(ctx, p)})
+	}
+	return report, nil
+}
+
+// complianceProbe sends the queries of compliance checks.
+type complianceProbe struct {
+	addr    string
+	domain  dns.Name
+	timeout time.Duration
+}
+
+// query creates a query for name under the domain ("" for the apex).
+func (p *complianceProbe) query(name string, qtype uint16) *dns.Message {
+	qname := p.domain
+	if name != "" {
+		qname = append(dns.Name{[]byte(name)}, p.domain...)
+	}
+	return dns.CreateQuery(qname, qtype, dns.GenerateQueryID())
+}
+
+// exchange sends query over network ("udp" or "tcp") and returns the
+// response, checking that it answers the query.
+func (p *complianceProbe) exchange(ctx context.Context, network string, query *dns.Message) (*dns.Message, []byte, error) {
+	data, err := query.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, p.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var raw []byte
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, data); err != nil {
+			return nil, nil, err
+		}
+		raw, err = readTCPMessage(conn)
+	} else {
+		if _, err := conn.Write(data); err != nil {
+			return nil, nil, err
+		}
+		buf := make([]byte, 65535)
+		var n int
+		n, err = conn.Read(buf)
+		raw = buf[:n]
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("no response over %s: %w", network, err)
+	}
+
+	resp, err := dns.ParseMessage(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed response: %w", err)
+	}
+	if !resp.IsResponse() || resp.ID != query.ID {
+		return nil, nil, errors.New("response doesn't match the query ID")
+	}
+	if len(resp.Question) != 1 || !resp.Question[0].Name.Equal(query.Question[0].Name) ||
+		resp.Question[0].Type != query.Question[0].Type {
+		return nil, nil, errors.New("response doesn't echo the question")
+	}
+	return resp, raw, nil
+}
+
+// authoritative checks that a response is authoritative with rcode.
+func authoritative(resp *dns.Message, rcode uint16) error {
+	if got := resp.ExtendedRcode(); got != rcode {
+		return fmt.Errorf("rcode %d, want %d", got, rcode)
+	}
+	if resp.Flags&0x0400 == 0 {
+		return errors.New("AA bit not set")
+	}
+	return nil
+}
+
+// negative checks that a response is an authoritative negative answer with
+// rcode and the zone's SOA record in the authority section.
+func negative(resp *dns.Message, rcode uint16) error {
+	if err := authoritative(resp, rcode); err != nil {
+		return err
+	}
+	if len(resp.Answer) != 0 {
+		return fmt.Errorf("%d answers, want none", len(resp.Answer))
+	}
+	if len(resp.Authority) != 1 || resp.Authority[0].Type != dns.RRTypeSOA {
+		return errors.New("no SOA record in the authority section")
+	}
+	return nil
+}
+
+func checkApexSOA(ctx context.Context, p *complianceProbe) error {
+	query := p.query("", dns.RRTypeSOA)
+	query.AddEDNS0(1232)
+	resp, _, err := p.exchange(ctx, "udp", query)
+	if err != nil {
+		return err
+	}
+	if err := authoritative(resp, dns.RcodeNoError); err != nil {
+		return err
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Type != dns.RRTypeSOA {
+		return errors.New("no SOA record in the answer")
+	}
+	return nil
+}
+
+func checkEDNSResponse(ctx context.Context, p *complianceProbe) error {
+	query := p.query("", dns.RRTypeSOA)
+	query.SetEDNS0(1232, true, dns.EDNSOption{Code: complianceUnknownOption, Data: []byte("check")})
+	resp, _, err := p.exchange(ctx, "udp", query)
+	if err != nil {
+		return err
+	}
+	if err := authoritative(resp, dns.RcodeNoError); err != nil {
+		return err
+	}
+
+	opt, err := resp.OPT()
+	if err != nil {
+		return err
+	}
+	switch {
+	case opt == nil:
+		return errors.New("no OPT record in the response")
+	case opt.Class < dns.EDNSMinUDPSize:
+		return fmt.Errorf("advertised payload size %d, want at least %d", opt.Class, dns.EDNSMinUDPSize)
+	case uint8(opt.TTL>>16) != 0:
+		return fmt.Errorf("EDNS version %d, want 0", uint8(opt.TTL>>16))
+	case !resp.DO():
+		return errors.New("DO bit not copied")
+	}
+	if _, ok := resp.GetEDNSOption(complianceUnknownOption); ok {
+		return errors.New("unknown option echoed")
+	}
+	return nil
+}
+
+func checkNoEDNS(ctx context.Context, p *complianceProbe) error {
+	resp, raw, err := p.exchange(ctx, "udp", p.query("", dns.RRTypeSOA))
+	if err != nil {
+		return err
+	}
+	if opt, _ := resp.OPT(); opt != nil {
+		return errors.New("OPT record in the response")
+	}
+	if len(raw) > dns.EDNSMinUDPSize {
+		return fmt.Errorf("response of %d bytes, want at most %d", len(raw), dns.EDNSMinUDPSize)
+	}
+	return authoritative(resp, dns.RcodeNoError)
+}
+
+func checkEDNSVersion(ctx context.Context, p *complianceProbe) error {
+	query := p.query("", dns.RRTypeSOA)
+	query.AddEDNS0(1232)
+	query.Additional[0].TTL |= 1 << 16 // EDNS version 1
+	resp, _, err := p.exchange(ctx, "udp", query)
+	if err != nil {
+		return err
+	}
+	if opt, _ := resp.OPT(); opt == nil {
+		return errors.New("no OPT record in the response")
+	}
+	if got := resp.ExtendedRcode(); got != dns.RcodeBadVersion {
+		return fmt.Errorf("rcode %d, want BADVERS (%d)", got, dns.RcodeBadVersion)
+	}
+	return nil
+}
+
+func checkUnknownType(ctx context.Context, p *complianceProbe) error {
+	resp, _, err := p.exchange(ctx, "udp", p.query("", complianceUnknownType))
+	if err != nil {
+		return err
+	}
+	return negative(resp, dns.RcodeNoError)
+}
+
+func checkMissingName(ctx context.Context, p *complianceProbe) error {
+	resp, _, err := p.exchange(ctx, "udp", p.query("compliance-check", dns.RRTypeA))
+	if err != nil {
+		return err
+	}
+	return negative(resp, dns.RcodeNameError)
+}
+
+func checkCasePreserved(ctx context.Context, p *complianceProbe) error {
+	query := p.query("", dns.RRTypeSOA)
+	query.Question[0].Name = dns.RandomizeCase(query.Question[0].Name)
+	resp, _, err := p.exchange(ctx, "udp", query)
+	if err != nil {
+		return err
+	}
+	if !sameCase(resp.Question[0].Name, query.Question[0].Name) {
+		return fmt.Errorf("question %s echoed as %s", query.Question[0].Name, resp.Question[0].Name)
+	}
+	for _, rr := range resp.Answer {
+		if !sameCase(rr.Name, query.Question[0].Name) {
+			return fmt.Errorf("answer owner %s, want %s", rr.Name, query.Question[0].Name)
+		}
+	}
+	return nil
+}
+
+func checkOutOfZone(ctx context.Context, p *complianceProbe) error {
+	query := dns.CreateQuery(dns.Name{[]byte("example"), []byte("net")}, dns.RRTypeA, dns.GenerateQueryID())
+	resp, _, err := p.exchange(ctx, "udp", query)
+	if err != nil {
+		return err
+	}
+	if resp.Flags&0x0400 != 0 {
+		return errors.New("AA bit set")
+	}
+	if len(resp.Answer) != 0 {
+		return fmt.Errorf("%d answers, want none", len(resp.Answer))
+	}
+	return nil
+}
+
+func checkTruncation(ctx context.Context, p *complianceProbe) error {
+	udp, raw, err := p.exchange(ctx, "udp", p.query("", dns.RRTypeNS))
+	if err != nil {
+		return err
+	}
+	if len(raw) > dns.EDNSMinUDPSize {
+		return fmt.Errorf("UDP response of %d bytes without EDNS, want truncation at %d", len(raw), dns.EDNSMinUDPSize)
+	}
+
+	// Resolvers retry truncated answers over TCP, and some always use it
+	tcp, _, err := p.exchange(ctx, "tcp", p.query("", dns.RRTypeNS))
+	if err != nil {
+		return fmt.Errorf("%w (resolvers can't retry truncated answers; is -tcp off?)", err)
+	}
+	if tcp.Flags&0x0200 != 0 {
+		return errors.New("TC bit set over TCP")
+	}
+	if tcp.Rcode() != udp.Rcode() || len(tcp.Answer) < len(udp.Answer) {
+		return fmt.Errorf("TCP answer (rcode %d, %d records) differs from UDP (rcode %d, %d records)",
+			tcp.Rcode(), len(tcp.Answer), udp.Rcode(), len(udp.Answer))
+	}
+	return nil
+}
+
+// sameCase reports whether two names are equal byte for byte.
+func sameCase(a, b dns.Name) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
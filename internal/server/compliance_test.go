@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckCompliance(t *testing.T) {
+	// A port free for both UDP and TCP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	h := newTestHandler(t, func(c *Config) { c.ListenAddr = addr })
+	if err := h.Start(); err != nil {
+		t.Skipf("Start() error = %v", err)
+	}
+
+	report, err := CheckCompliance(context.Background(), addr, h.config.Domain, 2*time.Second)
+	if err != nil {
+		t.Fatalf("CheckCompliance() error = %v", err)
+	}
+	for _, c := range report.Checks {
+		if c.Err != nil {
+			t.Errorf("%s: %v", c.Name, c.Err)
+		}
+	}
+	if !report.OK() {
+		t.Error("OK() = false")
+	}
+
+	// Without TCP truncated answers can't be retried
+	h.tcpListener.Close()
+	report, _ = CheckCompliance(context.Background(), addr, h.config.Domain, 500*time.Millisecond)
+	if report.OK() || report.Checks[len(report.Checks)-1].Err == nil {
+		t.Error("Compliance without TCP passed")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// DefaultMaxClientConcurrent is the number of queries a client may have
+// resolving at once
+const DefaultMaxClientConcurrent = 32
+
+// Actions on queries over the concurrency limits
+const (
+	// OverLimitServFail answers SERVFAIL with a Not Ready extended error,
+	// so the client retries later
+	OverLimitServFail = "servfail"
+
+	// OverLimitDrop drops the query silently
+	OverLimitDrop = "drop"
+)
+
+var (
+	ErrClientBusy         = errors.New("client has too many queries in flight")
+	ErrQPSExceeded        = errors.New("server query rate exceeded")
+	ErrUnknownLimitAction = errors.New("unknown over limit action")
+)
+
+// ConcurrencyStats counts the queries refused by the concurrency limits.
+type ConcurrencyStats struct {
+	ClientBusy uint64 // refused for a client's queries in flight
+	QPSLimited uint64 // refused for the global query rate
+}
+
+// concurrencyLimiter caps the queries each ClientID has resolving at once
+// and the rate of tunnel queries the server accepts overall, so one client
+// can't take all of MaxConcurrent from the others.
+type concurrencyLimiter struct {
+	mu        sync.Mutex
+	maxClient int // 0 disables the per-client cap
+	inFlight  map[dns.ClientID]int
+	qps       float64 // 0 disables the global rate
+	tokens    float64
+	last      time.Time
+
+	clientBusy atomic.Uint64
+	qpsLimited atomic.Uint64
+}
+
+// newConcurrencyLimiter creates a limiter with both limits disabled.
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{inFlight: make(map[dns.ClientID]int)}
+}
+
+// setLimits changes the per-client cap and the global queries per second.
+// The global rate allows bursts of one second's queries.
+func (l *concurrencyLimiter) setLimits(maxClient, qps int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxClient = maxClient
+	if float64(qps) != l.qps {
+		l.qps = float64(qps)
+		l.tokens = l.qps
+		l.last = time.Now()
+	}
+}
+
+// allowQuery takes a token from the global query rate and reports whether
+// there was one.
+func (l *concurrencyLimiter) allowQuery() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.qps <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	l.tokens = min(l.qps, l.tokens+now.Sub(l.last).Seconds()*l.qps)
+	l.last = now
+	if l.tokens < 1 {
+		l.qpsLimited.Add(1)
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// acquire reserves one of clientID's query slots, reporting false if the
+// client has all of them in flight. Each successful acquire must be
+// followed by a release.
+func (l *concurrencyLimiter) acquire(clientID dns.ClientID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxClient > 0 && l.inFlight[clientID] >= l.maxClient {
+		l.clientBusy.Add(1)
+		return false
+	}
+	l.inFlight[clientID]++
+	return true
+}
+
+// release frees a query slot of clientID.
+func (l *concurrencyLimiter) release(clientID dns.ClientID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[clientID] <= 1 {
+		delete(l.inFlight, clientID)
+	} else {
+		l.inFlight[clientID]--
+	}
+}
+
+// stats returns the number of queries refused so far.
+func (l *concurrencyLimiter) stats() ConcurrencyStats {
+	return ConcurrencyStats{ClientBusy: l.clientBusy.Load(), QPSLimited: l.qpsLimited.Load()}
+}
+
+// checkLimitAction verifies an over limit action; empty means
+// OverLimitServFail.
+func checkLimitAction(action string) error {
+	switch action {
+	case "", OverLimitServFail, OverLimitDrop:
+		return nil
+	}
+	return fmt.Errorf("%w %q, want %s or %s", ErrUnknownLimitAction, action, OverLimitServFail, OverLimitDrop)
+}
+
+// ConcurrencyStats returns the number of queries refused by the
+// concurrency limits.
+func (h *Handler) ConcurrencyStats() ConcurrencyStats {
+	return h.concurrency.stats()
+}
+
+// overLimitResponse returns the response to a query refused by a
+// concurrency limit for reason, or nil to drop it.
+func (h *Handler) overLimitResponse(query *dns.Message, reason error) []byte {
+	if h.limitDrop.Load() {
+		return nil
+	}
+	return h.notReadyResponse(query, reason)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestConcurrencyLimiterClients(t *testing.T) {
+	l := newConcurrencyLimiter()
+	l.setLimits(2, 0)
+	a, b := dns.NewClientID(), dns.NewClientID()
+
+	if !l.acquire(a) || !l.acquire(a) {
+		t.Fatal("acquire() within the cap failed")
+	}
+	if l.acquire(a) {
+		t.Error("acquire() over the cap succeeded")
+	}
+	if !l.acquire(b) {
+		t.Error("Another client was refused")
+	}
+
+	l.release(a)
+	if !l.acquire(a) {
+		t.Error("acquire() after release() failed")
+	}
+	if got := l.stats().ClientBusy; got != 1 {
+		t.Errorf("ClientBusy: got %d, want 1", got)
+	}
+
+	// Released clients aren't kept
+	l.release(a)
+	l.release(a)
+	l.release(b)
+	if len(l.inFlight) != 0 {
+		t.Errorf("%d clients left in flight", len(l.inFlight))
+	}
+}
+
+func TestConcurrencyLimiterQPS(t *testing.T) {
+	l := newConcurrencyLimiter()
+	for i := 0; i < 100; i++ {
+		if !l.allowQuery() {
+			t.Fatal("allowQuery() refused with the limit disabled")
+		}
+	}
+
+	l.setLimits(0, 3)
+	for i := 0; i < 3; i++ {
+		if !l.allowQuery() {
+			t.Fatalf("Query %d refused within the limit", i+1)
+		}
+	}
+	if l.allowQuery() {
+		t.Error("Query over the limit allowed")
+	}
+	if got := l.stats().QPSLimited; got != 1 {
+		t.Errorf("QPSLimited: got %d, want 1", got)
+	}
+}
+
+func TestClientBusy(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) { c.MaxClientConcurrent = 1 })
+
+	// The client already has a message resolving
+	clientID := dns.NewClientID()
+	h.concurrency.acquire(clientID)
+
+	fragment := &dns.Fragment{ID: 1, Total: 1, Data: []byte("x")}
+	if _, err := h.handleFragment(h.ctx, 0, nil, clientID, fragment); !errors.Is(err, ErrClientBusy) {
+		t.Errorf("handleFragment() error = %v, want %v", err, ErrClientBusy)
+	}
+	if got := h.ConcurrencyStats().ClientBusy; got != 1 {
+		t.Errorf("ClientBusy: got %d, want 1", got)
+	}
+}
+
+func TestMaxQPS(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) { c.MaxQPS = 1 })
+	config := h.config
+
+	query := dns.CreateQuery(mustParseName(t, "x.t.example.com"), dns.RRTypeTXT, 1)
+	query.AddEDNS0(1232)
+	data, _ := query.Marshal()
+	tcp := &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 5353}
+
+	first, err := dns.ParseMessage(h.handleQuery(data, tcp, tcpMaxMessageSize))
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if first.Rcode() != dns.RcodeNameError {
+		t.Errorf("First response: rcode %d, want %d", first.Rcode(), dns.RcodeNameError)
+	}
+
+	// Over the limit the client is asked to retry later
+	second, err := dns.ParseMessage(h.handleQuery(data, tcp, tcpMaxMessageSize))
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if code, _, ok := second.ExtendedError(); second.Rcode() != dns.RcodeServerFail || !ok || code != dns.EDENotReady {
+		t.Errorf("Limited response: rcode %d, extended error %d %v", second.Rcode(), code, ok)
+	}
+
+	// Or the query is dropped
+	drop := *config
+	drop.OverLimitAction = OverLimitDrop
+	if err := h.Reload(&drop); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if resp := h.handleQuery(data, tcp, tcpMaxMessageSize); resp != nil {
+		t.Error("Query over the limit answered with -over-limit drop")
+	}
+	if got := h.ConcurrencyStats().QPSLimited; got != 2 {
+		t.Errorf("QPSLimited: got %d, want 2", got)
+	}
+
+	bogus := drop
+	bogus.OverLimitAction = "reset"
+	if err := h.Reload(&bogus); !errors.Is(err, ErrUnknownLimitAction) {
+		t.Errorf("Reload() with an unknown action: got %v, want %v", err, ErrUnknownLimitAction)
+	}
+}
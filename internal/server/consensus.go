@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// flagAD is the Authenticated Data header flag, set by validating
+// upstreams on DNSSEC-validated answers
+const flagAD = 0x0020
+
+var ErrNoConsensus = errors.New("upstreams disagree")
+
+// consensusResult is the answer of the consensus upstream.
+type consensusResult struct {
+	raw  []byte
+	resp *dns.Message
+	err  error
+}
+
+// newConsensusResolver creates the resolver of the consensus upstream, in
+// the ParseUpstreamConfig format.
+func newConsensusResolver(upstream string) (*Resolver, error) {
+	addr, typ, err := ParseUpstreamConfig(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consensus upstream %q: %w", upstream, err)
+	}
+	r, err := NewResolver(addr, typ)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consensus upstream %q: %w", upstream, err)
+	}
+	return r, nil
+}
+
+// consensusExchange resolves the query against the chain and the
+// consensus upstream at once. The chain's answer is returned if the two
+// agree; otherwise the answer only one of them validated with DNSSEC is
+// returned, and if neither or both did, ErrNoConsensus.
+func (c *upstreamChain) consensusExchange(ctx context.Context, query *dns.Message) ([]byte, *dns.Message, string, error) {
+	// Ask for the AD flag, so validating upstreams report validated answers
+	adQuery := *query
+	adQuery.Flags |= flagAD
+
+	done := make(chan consensusResult, 1)
+	go func() {
+		raw, resp, err := c.consensus.exchange(ctx, &adQuery)
+		done <- consensusResult{raw: raw, resp: resp, err: err}
+	}()
+
+	raw, resp, upstream, err := c.chainExchange(ctx, &adQuery)
+	check := <-done
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if check.err != nil {
+		return nil, nil, "", fmt.Errorf("consensus upstream %s failed: %w", c.consensus.upstream, check.err)
+	}
+
+	if answersAgree(resp, check.resp) {
+		return raw, resp, upstream, nil
+	}
+
+	validated, checkValidated := resp.Flags&flagAD != 0, check.resp.Flags&flagAD != 0
+	switch {
+	case validated && !checkValidated:
+		return raw, resp, upstream, nil
+	case checkValidated && !validated:
+		log.Printf("upstream %s disagrees with consensus upstream %s about %s, using the validated answer",
+			upstream, c.consensus.upstream, questionName(query))
+		return check.raw, check.resp, c.consensus.upstream, nil
+	}
+
+	log.Printf("upstream %s disagrees with consensus upstream %s about %s", upstream, c.consensus.upstream, questionName(query))
+	return nil, nil, "", fmt.Errorf("%w: %s and %s", ErrNoConsensus, upstream, c.consensus.upstream)
+}
+
+// answersAgree reports whether two answers to the same question agree:
+// they have the same rcode and either both have empty answer sections or
+// they share at least one answer record, ignoring TTLs. Sharing one record
+// rather than all tolerates load balancers rotating their addresses.
+func answersAgree(a, b *dns.Message) bool {
+	if a.Rcode() != b.Rcode() {
+		return false
+	}
+	if len(a.Answer) == 0 || len(b.Answer) == 0 {
+		return len(a.Answer) == len(b.Answer)
+	}
+
+	type record struct {
+		typ  uint16
+		data string
+	}
+	records := make(map[record]bool, len(a.Answer))
+	for _, rr := range a.Answer {
+		records[record{rr.Type, string(rr.Data)}] = true
+	}
+	for _, rr := range b.Answer {
+		if records[record{rr.Type, string(rr.Data)}] {
+			return true
+		}
+	}
+	return false
+}
+
+// questionName returns the name a query asks about, for logs.
+func questionName(query *dns.Message) string {
+	if len(query.Question) == 0 {
+		return "(no question)"
+	}
+	return query.Question[0].Name.String()
+}
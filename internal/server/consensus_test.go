@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// startAddrUpstream starts a UDP upstream that answers every query with an
+// A record of addr, setting the AD flag if validated.
+func startAddrUpstream(t *testing.T, addr string, validated bool) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := dns.CreateResponse(query)
+			if validated {
+				resp.Flags |= flagAD
+			}
+			resp.Answer = []dns.RR{{
+				Name:  query.Question[0].Name,
+				Type:  dns.RRTypeA,
+				Class: dns.ClassIN,
+				TTL:   60,
+				Data:  dns.EncodeAddrData(netip.MustParseAddr(addr)),
+			}}
+			data, err := resp.Marshal()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(data, from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestAnswersAgree(t *testing.T) {
+	a := auditAnswerMessage(dns.RcodeNoError, "93.184.216.34", "93.184.216.35")
+	rotated := auditAnswerMessage(dns.RcodeNoError, "93.184.216.35", "93.184.216.36")
+	rotated.Answer[0].TTL = 5
+	other := auditAnswerMessage(dns.RcodeNoError, "10.10.34.35")
+	empty := auditAnswerMessage(dns.RcodeNoError)
+	nxdomain := auditAnswerMessage(dns.RcodeNameError)
+
+	tests := []struct {
+		name string
+		a, b *dns.Message
+		want bool
+	}{
+		{"shared record", a, rotated, true},
+		{"no shared record", a, other, false},
+		{"both empty", empty, auditAnswerMessage(dns.RcodeNoError), true},
+		{"one empty", a, empty, false},
+		{"rcode differs", empty, nxdomain, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := answersAgree(tt.a, tt.b); got != tt.want {
+				t.Errorf("answersAgree() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamChainConsensus(t *testing.T) {
+	genuine := startAddrUpstream(t, "93.184.216.34", false)
+	agreeing := startAddrUpstream(t, "93.184.216.34", false)
+	poisoned := startAddrUpstream(t, "10.10.34.35", false)
+	validated := startAddrUpstream(t, "93.184.216.34", true)
+
+	query := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1234)
+
+	tests := []struct {
+		name      string
+		upstream  string
+		consensus string
+		want      string // answered address, or "" for ErrNoConsensus
+	}{
+		{"agree", genuine, agreeing, "93.184.216.34"},
+		{"disagree", poisoned, genuine, ""},
+		{"consensus validated", poisoned, validated, "93.184.216.34"},
+		{"upstream validated", validated, poisoned, "93.184.216.34"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.UpstreamResolver = tt.upstream
+			config.ConsensusUpstream = tt.consensus
+			chain, err := upstreamChainFromConfig(config)
+			if err != nil {
+				t.Fatalf("upstreamChainFromConfig() error = %v", err)
+			}
+			defer chain.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			resp, err := chain.Resolve(ctx, query)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNoConsensus) {
+					t.Errorf("Resolve() error = %v, want ErrNoConsensus", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if got := describeAnswer(resp); got != tt.want {
+				t.Errorf("Resolve() answered %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
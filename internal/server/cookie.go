@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// DNS cookie constants (RFC 7873, RFC 9018)
+const (
+	// CookieSecretSize is the size of the secret server cookies are
+	// derived from
+	CookieSecretSize = 16
+
+	// serverCookieVersion is the version of the server cookie layout
+	serverCookieVersion = 1
+
+	// serverCookieSize is the size of the server cookies generated:
+	// version, 3 reserved bytes, timestamp and an 8-byte hash
+	serverCookieSize = 16
+
+	// cookieLifetime is how long a server cookie is accepted, and
+	// cookieClockSkew how far in the future its timestamp may be
+	cookieLifetime  = time.Hour
+	cookieClockSkew = 5 * time.Minute
+)
+
+// cookieState is what a query's COOKIE option proves about its source.
+type cookieState int
+
+const (
+	cookieNone      cookieState = iota // no COOKIE option
+	cookieClient                       // a client cookie without a valid server cookie
+	cookieValid                        // a server cookie this server issued to the source
+	cookieMalformed                    // a COOKIE option of invalid length
+)
+
+// cookieJar issues and checks server cookies in the layout of RFC 9018,
+// hashed with HMAC-SHA256 under a secret. Instances sharing a secret, such
+// as those behind an anycast address, accept each other's cookies.
+type cookieJar struct {
+	secret []byte
+	clock  clock.Clock
+}
+
+// newCookieJar creates a cookie jar with secret, or a random secret if it
+// is empty, whose server cookies are timed with clk (clock.System if nil).
+func newCookieJar(secret []byte, clk clock.Clock) (*cookieJar, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, CookieSecretSize)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate cookie secret: %w", err)
+		}
+	}
+	if len(secret) < CookieSecretSize {
+		return nil, fmt.Errorf("cookie secret must be at least %d bytes", CookieSecretSize)
+	}
+	return &cookieJar{secret: secret, clock: clock.Or(clk)}, nil
+}
+
+// serverCookie returns the server cookie for a client cookie sent from ip
+// at now.
+func (j *cookieJar) serverCookie(client [dns.EDNSClientCookieSize]byte, ip netip.Addr, now time.Time) []byte {
+	cookie := make([]byte, 8, serverCookieSize)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+	return append(cookie, j.hash(client, cookie, ip)...)
+}
+
+// hash returns the hash of a server cookie whose version, reserved bytes
+// and timestamp are header.
+func (j *cookieJar) hash(client [dns.EDNSClientCookieSize]byte, header []byte, ip netip.Addr) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write(client[:])
+	mac.Write(header)
+	mac.Write(ip.Unmap().AsSlice())
+	return mac.Sum(nil)[:serverCookieSize-8]
+}
+
+// valid reports whether server is a cookie this jar issued for the client
+// cookie and ip within the cookie lifetime.
+func (j *cookieJar) valid(client [dns.EDNSClientCookieSize]byte, server []byte, ip netip.Addr, now time.Time) bool {
+	if len(server) != serverCookieSize || server[0] != serverCookieVersion {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if issued.Before(now.Add(-cookieLifetime)) || issued.After(now.Add(cookieClockSkew)) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(server[8:], j.hash(client, server[:8], ip)) == 1
+}
+
+// check returns what the COOKIE option of a query from ip proves, and its
+// client cookie.
+func (j *cookieJar) check(query *dns.Message, ip netip.Addr) (cookieState, [dns.EDNSClientCookieSize]byte) {
+	var client [dns.EDNSClientCookieSize]byte
+	if j == nil {
+		return cookieNone, client
+	}
+	data, ok := query.GetEDNSOption(dns.EDNSOptionCookie)
+	if !ok {
+		return cookieNone, client
+	}
+	client, server, err := dns.ParseCookieOption(data)
+	if err != nil {
+		return cookieMalformed, client
+	}
+	if len(server) > 0 && ip.IsValid() && j.valid(client, server, ip, j.clock.Now()) {
+		return cookieValid, client
+	}
+	return cookieClient, client
+}
+
+// addCookie adds a COOKIE option with the client cookie and a fresh server
+// cookie to a wire format response that has an OPT record.
+func (j *cookieJar) addCookie(data []byte, client [dns.EDNSClientCookieSize]byte, ip netip.Addr) []byte {
+	resp, err := dns.ParseMessage(data)
+	if err != nil {
+		log.Printf("failed to parse response: %v", err)
+		return data
+	}
+	if opt, err := resp.OPT(); err != nil || opt == nil {
+		return data
+	}
+	if err := resp.SetEDNSOption(dns.NewCookieOption(client, j.serverCookie(client, ip, j.clock.Now()))); err != nil {
+		return data
+	}
+	withCookie, err := resp.Marshal()
+	if err != nil {
+		log.Printf("failed to marshal response: %v", err)
+		return data
+	}
+	return withCookie
+}
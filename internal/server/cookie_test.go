@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar, err := newCookieJar(nil, nil)
+	if err != nil {
+		t.Fatalf("newCookieJar() error = %v", err)
+	}
+	client := [dns.EDNSClientCookieSize]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ip := netip.MustParseAddr("198.51.100.7")
+	now := time.Now()
+	server := jar.serverCookie(client, ip, now)
+
+	if !jar.valid(client, server, ip, now.Add(30*time.Minute)) {
+		t.Error("Issued cookie invalid")
+	}
+	if !jar.valid(client, server, netip.MustParseAddr("::ffff:198.51.100.7"), now) {
+		t.Error("Issued cookie invalid from the IPv4-mapped address")
+	}
+	if jar.valid(client, server, netip.MustParseAddr("198.51.100.8"), now) {
+		t.Error("Cookie valid from another address")
+	}
+	if jar.valid([dns.EDNSClientCookieSize]byte{8}, server, ip, now) {
+		t.Error("Cookie valid with another client cookie")
+	}
+	if jar.valid(client, server, ip, now.Add(cookieLifetime+time.Minute)) {
+		t.Error("Expired cookie valid")
+	}
+	if jar.valid(client, server, ip, now.Add(-time.Hour)) {
+		t.Error("Cookie from the future valid")
+	}
+
+	other, err := newCookieJar(nil, nil)
+	if err != nil {
+		t.Fatalf("newCookieJar() error = %v", err)
+	}
+	if other.valid(client, server, ip, now) {
+		t.Error("Cookie valid under another secret")
+	}
+
+	if _, err := newCookieJar(make([]byte, CookieSecretSize-1), nil); err == nil {
+		t.Error("newCookieJar() accepted a short secret")
+	}
+}
+
+func TestCookieJarClock(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	jar, err := newCookieJar(nil, clk)
+	if err != nil {
+		t.Fatalf("newCookieJar() error = %v", err)
+	}
+	client := [dns.EDNSClientCookieSize]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ip := netip.MustParseAddr("198.51.100.7")
+	query := func(server []byte) *dns.Message {
+		q := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1)
+		q.SetEDNS0(1232, false, dns.NewCookieOption(client, server))
+		return q
+	}
+
+	// Server cookies are issued and checked at the clock's time
+	server := jar.serverCookie(client, ip, clk.Now())
+	if state, _ := jar.check(query(server), ip); state != cookieValid {
+		t.Fatalf("check() = %v, want cookieValid", state)
+	}
+	clk.Advance(cookieLifetime + time.Minute)
+	if state, _ := jar.check(query(server), ip); state != cookieClient {
+		t.Errorf("check() after the lifetime = %v, want cookieClient", state)
+	}
+}
+
+func TestCookieChallenge(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.UpstreamResolver = startRcodeUpstream(t, dns.RcodeNoError)
+		c.RRLLimit = 0
+		c.ChallengeThreshold = 1
+	})
+	config := h.config
+
+	client := [dns.EDNSClientCookieSize]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	handle := func(name dns.Name, cookie []byte) *dns.Message {
+		t.Helper()
+		query := dns.CreateQuery(name, dns.RRTypeTXT, 0x1234)
+		query.SetEDNS0(uint16(config.MaxUDPSize), false, dns.EDNSOption{Code: dns.EDNSOptionCookie, Data: cookie})
+		data, _ := query.Marshal()
+		udp := &net.UDPAddr{IP: net.ParseIP("203.0.113.9"), Port: 5353}
+		resp, err := dns.ParseMessage(h.handleQuery(data, udp, config.MaxUDPSize))
+		if err != nil {
+			t.Fatalf("ParseMessage() error = %v", err)
+		}
+		return resp
+	}
+	tunnelName := func() dns.Name {
+		clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+		inner, _ := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1).Marshal()
+		encrypted, _ := clientCipher.Encrypt(inner)
+		f := &dns.Fragment{ID: 1, Seq: 0, Total: 1, Data: encrypted}
+		name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+		if err != nil {
+			t.Fatalf("EncodePayload() error = %v", err)
+		}
+		return name
+	}
+
+	// Malformed cookies are answered FORMERR, which also makes the
+	// network suspicious
+	if resp := handle(mustParseName(t, "junk.t.example.com"), client[:5]); resp.Rcode() != dns.RcodeFormatError {
+		t.Fatalf("Malformed cookie: rcode %d, want FORMERR", resp.Rcode())
+	}
+
+	// A suspicious source sending only a client cookie gets BADCOOKIE
+	// with a server cookie instead of an answer
+	resp := handle(tunnelName(), client[:])
+	if resp.ExtendedRcode() != dns.RcodeBadCookie || len(resp.Answer) != 0 {
+		t.Fatalf("Client cookie: rcode %d, %d answers", resp.ExtendedRcode(), len(resp.Answer))
+	}
+	server, ok := dns.MatchCookie(resp, client)
+	if !ok {
+		t.Fatal("BADCOOKIE response without a server cookie")
+	}
+
+	// Retrying with the server cookie proves the address
+	resp = handle(tunnelName(), dns.NewCookieOption(client, server).Data)
+	if resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0200 != 0 || len(resp.Answer) == 0 {
+		t.Fatalf("Server cookie: rcode %d, flags %#x, %d answers", resp.ExtendedRcode(), resp.Flags, len(resp.Answer))
+	}
+	if _, ok := dns.MatchCookie(resp, client); !ok {
+		t.Error("Answer without a server cookie")
+	}
+}
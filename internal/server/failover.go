@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var ErrNoUpstreams = errors.New("no upstream resolvers configured")
+
+// RcodeError is returned when an upstream answers with an rcode that the
+// failover policy treats as a failure. Response holds the upstream answer
+// and Raw its bytes.
+type RcodeError struct {
+	Upstream string
+	Rcode    uint16
+	Response *dns.Message
+	Raw      []byte
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("upstream %s answered with failover rcode %d", e.Upstream, e.Rcode)
+}
+
+// upstreamChain resolves queries against an ordered list of upstreams,
+// moving to the next upstream on errors and failover rcodes. Upstreams
+// that keep failing are tried last. With a consensus upstream, answers are
+// also checked against it.
+type upstreamChain struct {
+	resolvers []*Resolver
+	health    []upstreamHealth          // of resolvers, by index
+	balance   bool                      // UpstreamBalance
+	next      atomic.Uint32             // turn of UpstreamBalance
+	consensus *Resolver                 // nil without ConsensusUpstream
+	named     map[string]*upstreamChain // NamedUpstreams by name
+	routes    []upstreamRoute           // UpstreamRoutes, most specific first
+
+	stopChecks context.CancelFunc // nil without health checks
+	checks     sync.WaitGroup
+}
+
+// newUpstreamChain creates a chain from the primary upstream and fallbacks.
+// Fallbacks use the ParseUpstreamConfig format.
+func newUpstreamChain(upstream, upstreamType string, fallbacks []string, failoverRcodes []uint16) (*upstreamChain, error) {
+	primary, err := NewResolver(upstream, upstreamType)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &upstreamChain{resolvers: []*Resolver{primary}}
+	for _, fb := range fallbacks {
+		addr, typ, err := ParseUpstreamConfig(fb)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("invalid fallback upstream %q: %w", fb, err)
+		}
+		r, err := NewResolver(addr, typ)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("invalid fallback upstream %q: %w", fb, err)
+		}
+		c.resolvers = append(c.resolvers, r)
+	}
+
+	for _, r := range c.resolvers {
+		r.SetFailoverRcodes(failoverRcodes)
+	}
+	c.health = make([]upstreamHealth, len(c.resolvers))
+
+	return c, nil
+}
+
+// upstreamChainFromConfig creates the chain of upstreams in config with its
+// query transforms applied.
+func upstreamChainFromConfig(config *Config) (*upstreamChain, error) {
+	if err := checkUpstreamStrategy(config.UpstreamStrategy); err != nil {
+		return nil, err
+	}
+	c, err := newUpstreamChain(config.UpstreamResolver, config.UpstreamType,
+		config.FallbackUpstreams, config.FailoverRcodes)
+	if err != nil {
+		return nil, err
+	}
+	c.balance = config.UpstreamStrategy == UpstreamBalance
+
+	upstreams := append([]string{config.UpstreamResolver}, config.FallbackUpstreams...)
+	resolvers := c.resolvers
+	if config.ConsensusUpstream != "" {
+		if c.consensus, err = newConsensusResolver(config.ConsensusUpstream); err != nil {
+			c.Close()
+			return nil, err
+		}
+		upstreams = append(upstreams, config.ConsensusUpstream)
+		resolvers = append(slices.Clip(resolvers), c.consensus)
+	}
+	for i, r := range resolvers {
+		config.applyTransforms(r, upstreams[i])
+	}
+
+	for name, upstream := range config.NamedUpstreams {
+		named, err := newNamedUpstream(config, upstream)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("invalid upstream %s: %w", name, err)
+		}
+		if c.named == nil {
+			c.named = make(map[string]*upstreamChain)
+		}
+		c.named[name] = named
+	}
+
+	if c.routes, err = newUpstreamRoutes(config); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.startHealthChecks(config.UpstreamHealthInterval)
+	return c, nil
+}
+
+// newNamedUpstream creates the chain of a named upstream, in the
+// ParseUpstreamConfig format, with the query transforms in config applied.
+func newNamedUpstream(config *Config, upstream string) (*upstreamChain, error) {
+	addr, typ, err := ParseUpstreamConfig(upstream)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newUpstreamChain(addr, typ, nil, config.FailoverRcodes)
+	if err != nil {
+		return nil, err
+	}
+	config.applyTransforms(c.resolvers[0], upstream)
+	return c, nil
+}
+
+// applyTransforms applies the query transforms in config to the resolver
+// of upstream.
+func (c *Config) applyTransforms(r *Resolver, upstream string) {
+	r.SetCaseRandomization(c.Upstream0x20)
+	r.SetQNameMinimization(c.QNameMinimization)
+	r.SetRootHints(c.RootHints)
+	r.SetEDNSSize(c.upstreamEDNSSize(upstream))
+	r.SetLatencySample(c.LatencySample)
+}
+
+// upstreamEDNSSize returns the UDP payload size tunneled queries advertise
+// to upstream, or 0 to keep each client's. Upstreams match however their
+// address is written, e.g. with or without the default port.
+func (c *Config) upstreamEDNSSize(upstream string) uint16 {
+	addr, _, _ := ParseUpstreamConfig(upstream)
+	for key, size := range c.UpstreamEDNSSizes {
+		if keyAddr, _, _ := ParseUpstreamConfig(key); keyAddr == addr {
+			return size
+		}
+	}
+	return c.UpstreamEDNSSize
+}
+
+// Resolve resolves the query against the upstreams in the order their
+// health and the chain's strategy give (see order), moving to the next
+// when one errors or answers with a failover rcode, until ctx is done. If
+// none answers otherwise, the last failover rcode answer is returned
+// rather than an error, even if later upstreams failed outright, since
+// the answer is then most likely genuine. With a consensus upstream the
+// answer is also checked against it (see consensusExchange).
+func (c *upstreamChain) Resolve(ctx context.Context, query *dns.Message) (*dns.Message, error) {
+	_, resp, _, err := c.exchange(ctx, query)
+	return resp, err
+}
+
+// ResolveRaw is like Resolve but returns the upstream response bytes
+// unchanged apart from the ID.
+func (c *upstreamChain) ResolveRaw(ctx context.Context, query *dns.Message) ([]byte, error) {
+	raw, _, _, err := c.exchange(ctx, query)
+	return raw, err
+}
+
+// exchange implements Resolve and ResolveRaw, also returning the upstream
+// that answered.
+func (c *upstreamChain) exchange(ctx context.Context, query *dns.Message) ([]byte, *dns.Message, string, error) {
+	if c.consensus != nil {
+		return c.consensusExchange(ctx, query)
+	}
+	return c.chainExchange(ctx, query)
+}
+
+// chainExchange resolves the query against the upstreams in the order
+// the chain's strategy and their health give.
+func (c *upstreamChain) chainExchange(ctx context.Context, query *dns.Message) ([]byte, *dns.Message, string, error) {
+	if len(c.resolvers) == 0 {
+		return nil, nil, "", ErrNoUpstreams
+	}
+
+	var lastErr error
+	var lastAnswer *RcodeError
+
+	for _, i := range c.order() {
+		r := c.resolvers[i]
+		raw, resp, err := r.exchange(ctx, query)
+		c.health[i].record(r.upstream, err)
+		if err == nil {
+			return raw, resp, r.upstream, nil
+		}
+
+		var rcodeErr *RcodeError
+		if errors.As(err, &rcodeErr) {
+			lastAnswer = rcodeErr
+		}
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+		if len(c.resolvers) > 1 {
+			log.Printf("upstream %s failed, trying next: %v", r.upstream, err)
+		}
+	}
+
+	if lastAnswer != nil {
+		return lastAnswer.Raw, lastAnswer.Response, lastAnswer.Upstream, nil
+	}
+	return nil, nil, "", lastErr
+}
+
+// GetStats returns the combined statistics of all upstreams.
+func (c *upstreamChain) GetStats() []UpstreamStats {
+	var stats []UpstreamStats
+	for _, r := range c.resolvers {
+		stats = append(stats, r.GetStats()...)
+	}
+	if c.consensus != nil {
+		stats = append(stats, c.consensus.GetStats()...)
+	}
+	for _, named := range c.named {
+		stats = append(stats, named.GetStats()...)
+	}
+	for _, route := range c.routes {
+		stats = append(stats, route.chain.GetStats()...)
+	}
+	return stats
+}
+
+// FlushConnections closes the idle connections of all upstreams.
+func (c *upstreamChain) FlushConnections() {
+	for _, r := range c.resolvers {
+		r.FlushConnections()
+	}
+	if c.consensus != nil {
+		c.consensus.FlushConnections()
+	}
+	for _, named := range c.named {
+		named.FlushConnections()
+	}
+	for _, route := range c.routes {
+		route.chain.FlushConnections()
+	}
+}
+
+// Close stops the health checks and closes all upstreams.
+func (c *upstreamChain) Close() {
+	if c.stopChecks != nil {
+		c.stopChecks()
+		c.checks.Wait()
+	}
+	for _, r := range c.resolvers {
+		r.Close()
+	}
+	if c.consensus != nil {
+		c.consensus.Close()
+	}
+	for _, named := range c.named {
+		named.Close()
+	}
+	closeRoutes(c.routes)
+}
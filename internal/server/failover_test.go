@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// startRcodeUpstream starts a UDP upstream that answers every query with
+// the given rcode.
+func startRcodeUpstream(t *testing.T, rcode uint16) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := dns.CreateResponse(query)
+			resp.SetRcode(rcode)
+			data, err := resp.Marshal()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestUpstreamChainFailover(t *testing.T) {
+	refused := startRcodeUpstream(t, dns.RcodeRefused)
+	nxdomain := startRcodeUpstream(t, dns.RcodeNameError)
+	ok := startRcodeUpstream(t, dns.RcodeNoError)
+
+	query := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1234)
+	policy := []uint16{dns.RcodeRefused, dns.RcodeNameError}
+
+	tests := []struct {
+		name      string
+		upstreams []string
+		rcodes    []uint16
+		want      uint16
+	}{
+		{
+			name:      "no policy relays answer",
+			upstreams: []string{refused, ok},
+			want:      dns.RcodeRefused,
+		},
+		{
+			name:      "fails over to next upstream",
+			upstreams: []string{refused, nxdomain, ok},
+			rcodes:    policy,
+			want:      dns.RcodeNoError,
+		},
+		{
+			name:      "all failing relays last answer",
+			upstreams: []string{refused, nxdomain},
+			rcodes:    policy,
+			want:      dns.RcodeNameError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := newUpstreamChain(tt.upstreams[0], "udp", tt.upstreams[1:], tt.rcodes)
+			if err != nil {
+				t.Fatalf("newUpstreamChain() error = %v", err)
+			}
+			defer chain.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			resp, err := chain.Resolve(ctx, query)
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if resp.Rcode() != tt.want {
+				t.Errorf("Rcode: got %d, want %d", resp.Rcode(), tt.want)
+			}
+			if resp.ID != query.ID {
+				t.Errorf("ID: got %d, want %d", resp.ID, query.ID)
+			}
+
+			raw, err := chain.ResolveRaw(ctx, query)
+			if err != nil {
+				t.Fatalf("ResolveRaw() error = %v", err)
+			}
+			rawResp, err := dns.ParseMessage(raw)
+			if err != nil {
+				t.Fatalf("ParseMessage() error = %v", err)
+			}
+			if rawResp.Rcode() != tt.want || rawResp.ID != query.ID {
+				t.Errorf("Raw response: got rcode %d ID %d", rawResp.Rcode(), rawResp.ID)
+			}
+		})
+	}
+}
+
+func TestResolverFailoverRcodes(t *testing.T) {
+	upstream := startRcodeUpstream(t, dns.RcodeRefused)
+
+	r, err := NewResolver(upstream, "udp")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	defer r.Close()
+	r.SetFailoverRcodes([]uint16{dns.RcodeRefused})
+
+	query := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1)
+	_, err = r.Resolve(context.Background(), query)
+
+	var rcodeErr *RcodeError
+	if !errors.As(err, &rcodeErr) {
+		t.Fatalf("Resolve() error = %v, want *RcodeError", err)
+	}
+	if rcodeErr.Rcode != dns.RcodeRefused || rcodeErr.Response == nil {
+		t.Errorf("RcodeError: got %+v", rcodeErr)
+	}
+
+	stats := r.GetStats()
+	if len(stats) != 1 || stats[0].Failures != 1 {
+		t.Errorf("Stats: got %+v, want one failure", stats)
+	}
+}
+
+func TestUpstreamEDNSSize(t *testing.T) {
+	config := DefaultConfig()
+	config.UpstreamEDNSSize = 1232
+	config.UpstreamEDNSSizes = map[string]uint16{"9.9.9.9": 4096}
+
+	if got := config.upstreamEDNSSize("9.9.9.9:53"); got != 4096 {
+		t.Errorf("Overridden upstream: size %d, want 4096", got)
+	}
+	if got := config.upstreamEDNSSize("8.8.8.8"); got != 1232 {
+		t.Errorf("Other upstream: size %d, want 1232", got)
+	}
+
+	// The override applies to queries with an OPT record only
+	query := dns.CreateQuery(dns.Name{[]byte("example"), []byte("com")}, dns.RRTypeA, 1)
+	query.AddEDNS0(4096)
+	if got := withEDNSSize(query, 1232); got.GetEDNS0Size() != 1232 || query.GetEDNS0Size() != 4096 {
+		t.Errorf("withEDNSSize() = %d bytes, original %d", got.GetEDNS0Size(), query.GetEDNS0Size())
+	}
+	query.Additional = nil
+	if got := withEDNSSize(query, 1232); len(got.Additional) != 0 {
+		t.Error("withEDNSSize() added an OPT record")
+	}
+}
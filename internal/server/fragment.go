@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+// exchangeBucket is the storage bucket of finished exchanges saved at
+// shutdown
+const exchangeBucket = "exchanges"
+
+// maxExchanges bounds the exchanges being resolved or kept for
+// retransmissions
+const maxExchanges = 16384
+
+var (
+	ErrUnknownExchange = errors.New("unknown tunnel exchange")
+	ErrFragmentIndex   = errors.New("response fragment index out of range")
+	ErrExchangesFull   = errors.New("too many tunnel exchanges")
+)
+
+// exchangeKey identifies a tunnel exchange by client, message ID and the
+// digest of the reassembled message. Neither the client ID nor the message
+// ID is authenticated, and clients number their messages in sequence, so
+// the digest keeps a message sent under a client's next ID by someone else
+// from standing in for the client's own.
+type exchangeKey struct {
+	clientID dns.ClientID
+	id       uint16
+	digest   [sha256.Size]byte
+}
+
+// fetchKey identifies the answered exchange whose response fragments a
+// fetch asks for.
+type fetchKey struct {
+	clientID dns.ClientID
+	id       uint16
+}
+
+// exchange holds the fragmented response for a reassembled tunnel query.
+// done is closed once fragments or err are set.
+type exchange struct {
+	key       exchangeKey
+	done      chan struct{}
+	fragments []*dns.Fragment
+	err       error
+	created   time.Time
+}
+
+// fragment waits for the exchange to finish and returns response fragment seq.
+func (e *exchange) fragment(ctx context.Context, seq uint8) (*dns.Fragment, error) {
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if e.err != nil {
+		return nil, e.err
+	}
+	if int(seq) >= len(e.fragments) {
+		return nil, ErrFragmentIndex
+	}
+	return e.fragments[seq], nil
+}
+
+// finished reports whether the exchange finished.
+func (e *exchange) finished() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// exchangeTable keeps the exchanges being resolved, so that duplicates of
+// a message wait for its answer, and those answered, so that duplicates
+// and fetches for further response fragments can be answered. Exchanges
+// that failed are dropped, leaving the client to retry. Answered ones are
+// saved to a store at shutdown, so a client retrying or fetching the rest
+// of a response across a quick restart gets the same answer rather than
+// having its query run twice.
+type exchangeTable struct {
+	entries   map[exchangeKey]*exchange // running and answered exchanges
+	answered  map[fetchKey]*exchange    // answered exchanges, for fetches
+	ttl       time.Duration
+	lastSweep time.Time
+	store     storage.Store
+	clock     clock.Clock
+	mu        sync.Mutex
+}
+
+// newExchangeTable creates an exchange table holding the exchanges saved
+// in store that haven't expired. Saved exchanges are removed from the
+// store once loaded. Exchanges are timed with clk, clock.System if nil.
+func newExchangeTable(ttl time.Duration, store storage.Store, clk clock.Clock) *exchangeTable {
+	t := &exchangeTable{
+		entries:  make(map[exchangeKey]*exchange),
+		answered: make(map[fetchKey]*exchange),
+		ttl:      ttl,
+		store:    store,
+		clock:    clock.Or(clk),
+	}
+
+	now := t.clock.Now()
+	_ = store.ForEach(exchangeBucket, func(key string, value []byte) error {
+		if err := store.Delete(exchangeBucket, key); err != nil {
+			log.Printf("Failed to delete exchange: %v", err)
+		}
+		var k exchangeKey
+		e, ok := decodeExchange(value)
+		if len(key) != len(k.clientID)+2+len(k.digest) || !ok || now.Sub(e.created) > ttl || len(t.entries) >= maxExchanges {
+			return nil
+		}
+		copy(k.clientID[:], key)
+		k.id = binary.BigEndian.Uint16([]byte(key[len(k.clientID):]))
+		copy(k.digest[:], key[len(k.clientID)+2:])
+		e.key = k
+		t.entries[k] = e
+		t.answered[fetchKey{clientID: k.clientID, id: k.id}] = e
+		return nil
+	})
+	return t
+}
+
+// encodeExchange encodes a finished exchange for storage: its creation in
+// Unix nanoseconds, then each response fragment after its length.
+func encodeExchange(e *exchange) []byte {
+	data := binary.BigEndian.AppendUint64(nil, uint64(e.created.UnixNano()))
+	for _, f := range e.fragments {
+		wire := f.Marshal()
+		data = binary.BigEndian.AppendUint16(data, uint16(len(wire)))
+		data = append(data, wire...)
+	}
+	return data
+}
+
+// decodeExchange decodes a stored exchange as a finished one.
+func decodeExchange(data []byte) (*exchange, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	e := &exchange{done: make(chan struct{}), created: time.Unix(0, int64(binary.BigEndian.Uint64(data)))}
+	for data = data[8:]; len(data) > 0; {
+		if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		f, err := dns.ParseFragment(data[2 : 2+n])
+		if err != nil {
+			return nil, false
+		}
+		e.fragments = append(e.fragments, f)
+		data = data[2+n:]
+	}
+	close(e.done)
+	return e, true
+}
+
+// save stores the live exchanges that finished with a response, before
+// shutdown. Unfinished ones are left for the client to retry.
+func (t *exchangeTable) save() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	for _, e := range t.answered {
+		if now.Sub(e.created) > t.ttl {
+			continue
+		}
+		k := e.key
+		key := binary.BigEndian.AppendUint16(append([]byte(nil), k.clientID[:]...), k.id)
+		key = append(key, k.digest[:]...)
+		if err := t.store.Put(exchangeBucket, string(key), encodeExchange(e)); err != nil {
+			log.Printf("Failed to save exchange: %v", err)
+			return
+		}
+	}
+}
+
+// get returns the live answered exchange for a fetch, if any.
+func (t *exchangeTable) get(clientID dns.ClientID, id uint16) (*exchange, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.answered[fetchKey{clientID: clientID, id: id}]
+	if !ok || t.clock.Now().Sub(e.created) > t.ttl {
+		return nil, false
+	}
+	return e, true
+}
+
+// create registers a new exchange for a reassembled message. If a live
+// exchange for the same message already exists it is returned with created
+// set to false. It fails with ErrExchangesFull if the table holds
+// maxExchanges exchanges that are still being resolved.
+func (t *exchangeTable) create(clientID dns.ClientID, id uint16, message []byte) (e *exchange, created bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	key := exchangeKey{clientID: clientID, id: id, digest: sha256.Sum256(message)}
+	if e, ok := t.entries[key]; ok && now.Sub(e.created) <= t.ttl {
+		return e, false, nil
+	}
+
+	// Drop expired exchanges at most twice per TTL, and answered ones at
+	// random when full
+	if now.Sub(t.lastSweep) > t.ttl/2 {
+		for k, v := range t.entries {
+			if now.Sub(v.created) > t.ttl {
+				t.remove(k)
+			}
+		}
+		t.lastSweep = now
+	}
+	for k, v := range t.entries {
+		if len(t.entries) < maxExchanges {
+			break
+		}
+		if v.finished() {
+			t.remove(k)
+		}
+	}
+	if len(t.entries) >= maxExchanges {
+		return nil, false, ErrExchangesFull
+	}
+
+	e = &exchange{
+		key:     key,
+		done:    make(chan struct{}),
+		created: now,
+	}
+	t.entries[key] = e
+	return e, true, nil
+}
+
+// finish records the result of an exchange and wakes up waiters. Exchanges
+// that failed are dropped, so a retry runs the message again; answered ones
+// become the exchange fetches of their ID are answered from.
+func (t *exchangeTable) finish(e *exchange, fragments []*dns.Fragment, err error) {
+	e.fragments = fragments
+	e.err = err
+	close(e.done)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries[e.key] != e {
+		return
+	}
+	if err != nil || len(fragments) == 0 {
+		delete(t.entries, e.key)
+		return
+	}
+	t.answered[fetchKey{clientID: e.key.clientID, id: e.key.id}] = e
+}
+
+// remove drops an exchange. The caller must hold t.mu.
+func (t *exchangeTable) remove(key exchangeKey) {
+	e := t.entries[key]
+	delete(t.entries, key)
+	fk := fetchKey{clientID: key.clientID, id: key.id}
+	if t.answered[fk] == e {
+		delete(t.answered, fk)
+	}
+}
+
+// len returns the number of tracked exchanges.
+func (t *exchangeTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
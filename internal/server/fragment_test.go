@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+func TestExchangeTable(t *testing.T) {
+	table := newExchangeTable(time.Minute, storage.NewMemory(), nil)
+	clientID := dns.NewClientID()
+
+	if _, ok := table.get(clientID, 1); ok {
+		t.Fatal("Unexpected exchange before create")
+	}
+
+	ex, created, _ := table.create(clientID, 1, []byte("query"))
+	if !created {
+		t.Fatal("First create should create the exchange")
+	}
+
+	dup, created, _ := table.create(clientID, 1, []byte("query"))
+	if created || dup != ex {
+		t.Error("Second create should return the existing exchange")
+	}
+	if _, ok := table.get(clientID, 1); ok {
+		t.Error("Fetches found an exchange before it was answered")
+	}
+
+	// Waiters block until the exchange finishes
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ex.fragment(ctx, 0); err != context.DeadlineExceeded {
+		t.Errorf("Unfinished fragment: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	fragments, _ := dns.SplitPayload([]byte("response"), 1, 4)
+	table.finish(ex, fragments, nil)
+
+	got, ok := table.get(clientID, 1)
+	if !ok {
+		t.Fatal("Exchange not found after create")
+	}
+
+	for seq := range fragments {
+		f, err := got.fragment(context.Background(), uint8(seq))
+		if err != nil {
+			t.Fatalf("fragment(%d) error = %v", seq, err)
+		}
+		if f != fragments[seq] {
+			t.Errorf("fragment(%d) returned wrong fragment", seq)
+		}
+	}
+
+	if _, err := got.fragment(context.Background(), uint8(len(fragments))); err != ErrFragmentIndex {
+		t.Errorf("Out of range: got %v, want %v", err, ErrFragmentIndex)
+	}
+}
+
+func TestExchangeTableExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	table := newExchangeTable(time.Minute, storage.NewMemory(), clk)
+	clientID := dns.NewClientID()
+
+	ex, _, _ := table.create(clientID, 1, []byte("query"))
+	fragments, _ := dns.SplitPayload([]byte("response"), 1, 4)
+	table.finish(ex, fragments, nil)
+	clk.Advance(time.Minute + time.Second)
+
+	if _, ok := table.get(clientID, 1); ok {
+		t.Error("Expired exchange should not be returned")
+	}
+
+	if _, created, _ := table.create(clientID, 2, []byte("query")); !created {
+		t.Error("Create after expiry should create a new exchange")
+	}
+	if table.len() != 1 {
+		t.Errorf("Expired exchanges not swept: got %d entries, want 1", table.len())
+	}
+}
+
+func TestExchangeTablePersistence(t *testing.T) {
+	store := storage.NewMemory()
+	table := newExchangeTable(time.Minute, store, nil)
+	clientID := dns.NewClientID()
+
+	fragments, _ := dns.SplitPayload([]byte("response"), 1, 4)
+	done, _, _ := table.create(clientID, 1, []byte("query"))
+	table.finish(done, fragments, nil)
+	table.create(clientID, 3, []byte("query")) // unfinished
+	table.save()
+
+	// Only the exchange that finished with a response is restored, and
+	// the store is emptied once loaded
+	restored := newExchangeTable(time.Minute, store, nil)
+	if restored.len() != 1 {
+		t.Fatalf("len after restart = %d, want 1", restored.len())
+	}
+	ex, ok := restored.get(clientID, 1)
+	if !ok {
+		t.Fatal("Finished exchange not restored")
+	}
+	for seq := range fragments {
+		f, err := ex.fragment(context.Background(), uint8(seq))
+		if err != nil || string(f.Marshal()) != string(fragments[seq].Marshal()) {
+			t.Errorf("fragment(%d) after restart = %v, %v", seq, f, err)
+		}
+	}
+	if err := store.ForEach(exchangeBucket, func(string, []byte) error { return errors.New("left") }); err != nil {
+		t.Error("Restored exchanges left in the store")
+	}
+
+	// Duplicates are still bound to the message
+	if _, created, _ := restored.create(clientID, 1, []byte("query")); created {
+		t.Error("A restored exchange was not found for a duplicate")
+	}
+}
+
+func TestExchangeTableForgedMessages(t *testing.T) {
+	table := newExchangeTable(time.Minute, storage.NewMemory(), nil)
+	clientID := dns.NewClientID()
+
+	// Garbage sent ahead under the client's next ID fails and is dropped
+	forged, created, _ := table.create(clientID, 1, []byte("garbage"))
+	if !created {
+		t.Fatal("create() of the forged message didn't create an exchange")
+	}
+	table.finish(forged, nil, errors.New("failed to decrypt payload"))
+	if table.len() != 0 {
+		t.Errorf("len after a failure = %d, want 0", table.len())
+	}
+
+	// Even while the forged message runs, the client's own gets its own
+	// exchange
+	forged, _, _ = table.create(clientID, 2, []byte("garbage"))
+	ex, created, _ := table.create(clientID, 2, []byte("query"))
+	if !created || ex == forged {
+		t.Fatal("create() of the client's message returned the forged exchange")
+	}
+	fragments, _ := dns.SplitPayload([]byte("response"), 2, 4)
+	table.finish(ex, fragments, nil)
+	table.finish(forged, nil, errors.New("failed to decrypt payload"))
+	if got, ok := table.get(clientID, 2); !ok || got != ex {
+		t.Error("get() didn't return the client's answered exchange")
+	}
+	if dup, created, _ := table.create(clientID, 2, []byte("garbage")); !created || dup == ex {
+		t.Error("A forged duplicate got the client's answer")
+	}
+}
+
+func TestExchangeTableBounded(t *testing.T) {
+	table := newExchangeTable(time.Minute, storage.NewMemory(), nil)
+	clientID := dns.NewClientID()
+
+	fragments, _ := dns.SplitPayload([]byte("response"), 0, 4)
+	for i := range maxExchanges {
+		ex, _, err := table.create(clientID, uint16(i), []byte("answered"))
+		if err != nil {
+			t.Fatalf("create() error = %v", err)
+		}
+		table.finish(ex, fragments, nil)
+	}
+
+	// Answered exchanges make room for new ones
+	if _, _, err := table.create(clientID, 1, []byte("running")); err != nil {
+		t.Fatalf("create() with answered exchanges to evict error = %v", err)
+	}
+	if table.len() != maxExchanges {
+		t.Errorf("len = %d, want %d", table.len(), maxExchanges)
+	}
+
+	// Running exchanges aren't evicted
+	other := dns.NewClientID()
+	for i := range maxExchanges - 1 {
+		if _, _, err := table.create(other, uint16(i), []byte("running")); err != nil {
+			t.Fatalf("create() error = %v", err)
+		}
+	}
+	if _, _, err := table.create(clientID, 2, []byte("running")); !errors.Is(err, ErrExchangesFull) {
+		t.Errorf("create() with running exchanges only = %v, want %v", err, ErrExchangesFull)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+// Guardrail limits
+const (
+	// DefaultMaxGoroutines is the number of goroutines above which queries
+	// are shed
+	DefaultMaxGoroutines = 20000
+
+	// DefaultMaxMemory is the estimated memory, in bytes, held by queued
+	// work above which queries are shed
+	DefaultMaxMemory = 512 << 20
+
+	// guardInterval is how often the load is measured
+	guardInterval = 100 * time.Millisecond
+
+	// guardResume is the fraction of a limit load must fall below before
+	// shedding stops, so it doesn't flap around the limit
+	guardResume = 0.9
+)
+
+// Memory estimates of queued work, in bytes
+const (
+	queryMemory    = 8 << 10                      // in-flight query: stack, message, reply
+	exchangeMemory = 2 << 10                      // answered exchange kept for retransmissions
+	streamMemory   = 2 * stream.DefaultBufferSize // stream buffers in both directions
+	tcpConnMemory  = 8 << 10                      // TCP connection: stack and buffers
+	sessionMemory  = 512                          // session key or client entry
+)
+
+// Load describes the load the guardrails act on.
+type Load struct {
+	Goroutines int    // goroutines running
+	Memory     int64  // estimated bytes held by queued work
+	Shedding   bool   // queries are being shed
+	Shed       uint64 // queries shed since start
+}
+
+// guard sheds queries while the server runs too many goroutines or holds
+// too much queued work, so attack traffic can't exhaust memory and get the
+// process killed. The load is measured at most once per guardInterval.
+type guard struct {
+	maxGoroutines atomic.Int64 // 0 disables the limit
+	maxMemory     atomic.Int64 // 0 disables the limit
+	shedding      atomic.Bool
+	shed          atomic.Uint64
+	lastCheck     atomic.Int64 // UnixNano of the last measurement
+}
+
+// setLimits changes the goroutine and memory limits.
+func (g *guard) setLimits(maxGoroutines int, maxMemory int64) {
+	g.maxGoroutines.Store(int64(maxGoroutines))
+	g.maxMemory.Store(maxMemory)
+}
+
+// overloaded reports whether a query should be shed, measuring the load
+// if it wasn't measured recently, and counts shed queries.
+func (h *Handler) overloaded() bool {
+	now := time.Now().UnixNano()
+	last := h.guard.lastCheck.Load()
+	if now-last >= int64(guardInterval) && h.guard.lastCheck.CompareAndSwap(last, now) {
+		h.updateShedding()
+	}
+
+	if !h.guard.shedding.Load() {
+		return false
+	}
+	h.guard.shed.Add(1)
+	return true
+}
+
+// updateShedding measures the load and starts or stops shedding.
+func (h *Handler) updateShedding() {
+	goroutines := runtime.NumGoroutine()
+	memory := h.memoryEstimate()
+	maxGoroutines := h.guard.maxGoroutines.Load()
+	maxMemory := h.guard.maxMemory.Load()
+
+	// over reports whether v exceeds limit, or when shedding whether it
+	// hasn't fallen below the resume threshold yet
+	shedding := h.guard.shedding.Load()
+	over := func(v, limit int64) bool {
+		if limit <= 0 {
+			return false
+		}
+		if shedding {
+			return float64(v) >= guardResume*float64(limit)
+		}
+		return v > limit
+	}
+
+	overloaded := over(int64(goroutines), maxGoroutines) || over(memory, maxMemory)
+	if h.guard.shedding.Swap(overloaded) == overloaded {
+		return
+	}
+	if overloaded {
+		log.Printf("Overloaded with %d goroutines and about %d MiB queued, shedding queries", goroutines, memory>>20)
+	} else {
+		log.Printf("Load back to %d goroutines and about %d MiB queued, no longer shedding queries (%d shed)",
+			goroutines, memory>>20, h.guard.shed.Load())
+	}
+}
+
+// memoryEstimate estimates the memory held by queued work from the sizes
+// of the server's queues and tables.
+func (h *Handler) memoryEstimate() int64 {
+	h.tcpMu.Lock()
+	tcpConns := len(h.tcpConns)
+	h.tcpMu.Unlock()
+
+	return int64(h.reassembler.Size()) +
+		int64(len(h.sem))*queryMemory +
+		int64(h.exchanges.len())*exchangeMemory +
+		int64(h.streams.len())*streamMemory +
+		int64(tcpConns)*tcpConnMemory +
+		int64(h.sessions.len()+h.clients.Len())*sessionMemory
+}
+
+// Load returns the current load and how many queries were shed.
+func (h *Handler) Load() Load {
+	return Load{
+		Goroutines: runtime.NumGoroutine(),
+		Memory:     h.memoryEstimate(),
+		Shedding:   h.guard.shedding.Load(),
+		Shed:       h.guard.shed.Load(),
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestGuardSheds(t *testing.T) {
+	h := newTestHandler(t, nil)
+	config := h.config
+
+	if h.overloaded() {
+		t.Fatal("overloaded() = true while idle")
+	}
+
+	// Queue fragments of incomplete messages past a lowered memory limit
+	clientID := dns.NewClientID()
+	for i := 0; i < 10; i++ {
+		f := &dns.Fragment{ID: uint16(i), Seq: 0, Total: 2, Data: make([]byte, 100)}
+		if _, _, err := h.reassembler.Add(clientID, f); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	base := h.memoryEstimate() - 1000
+	h.guard.setLimits(0, base+500)
+	h.updateShedding()
+	if !h.overloaded() {
+		t.Fatalf("overloaded() = false with %d bytes estimated, limit %d", h.memoryEstimate(), base+500)
+	}
+	if load := h.Load(); !load.Shedding || load.Shed != 1 {
+		t.Errorf("Load() = %+v, want shedding with 1 shed", load)
+	}
+
+	// Shedding continues until the load falls below the resume threshold
+	h.guard.setLimits(0, base+1050)
+	h.updateShedding()
+	if !h.guard.shedding.Load() {
+		t.Error("Shedding stopped above the resume threshold")
+	}
+	h.guard.setLimits(0, base+2000)
+	h.updateShedding()
+	if h.guard.shedding.Load() {
+		t.Error("Shedding continued below the resume threshold")
+	}
+
+	// Reloads change the limits
+	reloaded := *config
+	reloaded.MaxGoroutines = 1
+	if err := h.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	h.updateShedding()
+	if !h.guard.shedding.Load() {
+		t.Error("Not shedding above a reloaded goroutine limit")
+	}
+}
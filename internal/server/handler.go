@@ -3,16 +3,42 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AliRezaBeigy/dns-as-doh/internal/alert"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/sampling"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
 )
 
+// DefaultDrainTimeout is how long in-flight queries are given to finish on
+// shutdown.
+const DefaultDrainTimeout = 5 * time.Second
+
+// DefaultTopN is the number of domains and clients in each top report
+// list.
+const DefaultTopN = 10
+
+// DefaultNegativeTTL is how long resolvers cache NXDOMAIN answers for
+// names in the zone that aren't tunnel queries.
+const DefaultNegativeTTL = 300
+
+// ErrNotTunnelQuery is returned for queries in the zone that don't carry a
+// tunnel payload. They are answered like names that don't exist.
+var ErrNotTunnelQuery = errors.New("not a tunnel query")
+
 // Config holds the server configuration.
 type Config struct {
 	// ListenAddr is the UDP address to listen on (default: :53)
@@ -24,6 +50,20 @@ type Config struct {
 	// SharedSecret is the encryption key
 	SharedSecret []byte
 
+	// PreviousSecrets are older keys still accepted during key rotation,
+	// newest first. Responses use the key the query was encrypted with.
+	PreviousSecrets [][]byte
+
+	// ClientKeys are per-client keys by key ID (1-65535), each newest
+	// first. Removing an ID revokes that client without affecting others;
+	// a key's policy limits when it's accepted.
+	ClientKeys map[uint16][]crypto.ClientKey
+
+	// RevocationFile lists revoked client key IDs, one per line (empty for
+	// none). It's re-read whenever it changes; clients using a revoked
+	// key are told so in an encrypted reply.
+	RevocationFile string
+
 	// UpstreamResolver is the upstream DNS resolver for real queries
 	// Can be UDP DNS (8.8.8.8:53), DoH URL, or DoT address
 	UpstreamResolver string
@@ -31,44 +71,376 @@ type Config struct {
 	// UpstreamType is the type of upstream resolver (udp, doh, dot)
 	UpstreamType string
 
+	// FallbackUpstreams are tried in order when the upstream fails,
+	// in ParseUpstreamConfig format
+	FallbackUpstreams []string
+
+	// UpstreamStrategy is how queries are spread over the upstream and
+	// fallbacks: UpstreamFailover (default) or UpstreamBalance
+	UpstreamStrategy string
+
+	// UpstreamHealthInterval is how often the upstream and fallbacks are
+	// probed, so those that are down are tried last (0 disables probing;
+	// failing queries still mark upstreams down)
+	UpstreamHealthInterval time.Duration
+
+	// FailoverRcodes are upstream answer rcodes treated as failures,
+	// e.g. REFUSED from a censoring upstream
+	FailoverRcodes []uint16
+
+	// ConsensusUpstream, in ParseUpstreamConfig format, is asked every
+	// query along with the upstreams. Answers are only relayed if the two
+	// agree or one of them validated its answer with DNSSEC, protecting
+	// against a poisoned upstream path (empty disables it)
+	ConsensusUpstream string
+
+	// NamedUpstreams are upstreams in ParseUpstreamConfig format, by name,
+	// that clients may ask for per query instead of the upstream and its
+	// fallbacks, subject to their key's policy
+	NamedUpstreams map[string]string
+
+	// UpstreamRoutes map domains to the upstreams, in ParseUpstreamConfig
+	// format, that resolve names under them instead of UpstreamResolver,
+	// keyed by domain in lower case (see ParseUpstreamRoutes)
+	UpstreamRoutes map[string]string
+
+	// Blocklists are files of names, in hosts-file or domain-list format,
+	// whose queries are answered by the server instead of the upstream:
+	// with NXDOMAIN, or the BlocklistSinkhole addresses if set. Names in
+	// Allowlists, of the same formats, are never blocked. The files are
+	// re-read when they change.
+	Blocklists        []string
+	Allowlists        []string
+	BlocklistSinkhole []netip.Addr
+
+	// ForwardEDNSOptions are the EDNS option codes of tunneled queries
+	// forwarded to the upstream. All other options, such as client subnet
+	// and cookies, are stripped so the upstream learns less about clients.
+	ForwardEDNSOptions []uint16
+
+	// UpstreamEDNSSize overrides the UDP payload size tunneled queries
+	// advertise to upstreams (0 keeps each client's)
+	UpstreamEDNSSize uint16
+
+	// UpstreamEDNSSizes override UpstreamEDNSSize for single upstreams,
+	// keyed as in UpstreamResolver and FallbackUpstreams
+	UpstreamEDNSSizes map[string]uint16
+
+	// Upstream0x20 sends query names to UDP and iterative upstreams in
+	// random case (DNS 0x20) and accepts only answers echoing it, making
+	// off-path spoofing of upstream answers harder
+	Upstream0x20 bool
+
+	// QNameMinimization sends each zone only the labels it needs during
+	// iterative resolution (RFC 9156)
+	QNameMinimization bool
+
+	// RootHints are the root server addresses iterative resolution starts
+	// at (default DefaultRootHints)
+	RootHints []string
+
+	// RawPassthrough relays upstream responses byte for byte instead of
+	// re-encoding them, preserving DNSSEC signatures, name compression and
+	// record types the parser doesn't understand
+	RawPassthrough bool
+
+	// Compression compresses replies to clients that accept it, when
+	// that makes them smaller, so they need fewer response fragments
+	Compression bool
+
+	// TraceLog logs every tunneled query carrying a trace ID, with the
+	// ID, to correlate client and server logs while debugging
+	TraceLog bool
+
+	// TraceLogSample logs only 1 in TraceLogSample successful traced
+	// queries, so TraceLog stays usable at high query rates; failures are
+	// always logged. 0 or 1 logs every query.
+	TraceLogSample int
+
+	// LatencySample records the latency of only 1 in LatencySample
+	// successful upstream queries for the upstream statistics' latency
+	// percentiles; queries and failures are always counted. 0 or 1
+	// records every latency.
+	LatencySample int
+
+	// AuditUpstream is an independent upstream, in the ParseUpstreamConfig
+	// format, that a sample of answered queries is re-resolved against to
+	// flag upstreams that censor or poison answers (empty disables it)
+	AuditUpstream string
+
+	// AuditSample re-resolves 1 in AuditSample answered queries against
+	// AuditUpstream (0 uses DefaultAuditSample)
+	AuditSample int
+
+	// TopReports counts queries per domain and traffic per client, for
+	// daily reports of the busiest domains and clients. The counts include
+	// the domains of tunneled query names.
+	TopReports bool
+
+	// TopN is the number of domains and clients in each top report list
+	TopN int
+
+	// TopReportFile is where each day's top report is appended as a line
+	// of JSON (empty keeps reports in memory only)
+	TopReportFile string
+
+	// AlertWebhook is the URL alerts are posted to (empty disables alerts)
+	AlertWebhook string
+
+	// AlertFormat is the body format of AlertWebhook: alert.FormatGeneric,
+	// alert.FormatSlack or alert.FormatDiscord
+	AlertFormat string
+
+	// AlertInterval is the minimum time between two alerts of the same
+	// event
+	AlertInterval time.Duration
+
 	// MaxUDPSize is the maximum UDP payload size
 	MaxUDPSize int
 
+	// AcceptNoEDNS accepts tunnel queries without EDNS, from stubs and
+	// resolvers that strip it, instead of answering them from the zone
+	// only. Replies to them over UDP are fragmented to fit 512 bytes.
+	AcceptNoEDNS bool
+
 	// ResponseTTL is the TTL for responses
 	ResponseTTL uint32
 
+	// ZoneRecords are static records served for names in the domain that
+	// aren't tunnel queries, such as the apex NS records and the address
+	// of the name server. An SOA record replaces the generated one.
+	ZoneRecords []dns.RR
+
+	// NegativeTTL is the SOA minimum and TTL sent with NXDOMAIN answers
+	// for names in the zone that aren't tunnel queries
+	NegativeTTL uint32
+
 	// MaxConcurrent is the maximum concurrent queries
 	MaxConcurrent int
 
-	// RateLimit is the per-IP rate limit (queries per second)
+	// MaxClientConcurrent is the number of queries one ClientID may have
+	// resolving at once, so a single client can't take all of
+	// MaxConcurrent (0 disables the cap)
+	MaxClientConcurrent int
+
+	// MaxQPS is the number of tunnel queries per second the server accepts
+	// from all clients together (0 disables the limit)
+	MaxQPS int
+
+	// OverLimitAction is what happens to queries over MaxClientConcurrent
+	// or MaxQPS: OverLimitServFail (the default if empty) or OverLimitDrop
+	OverLimitAction string
+
+	// RateLimit is the rate limit of each client network in queries per
+	// second (0 disables it)
 	RateLimit int
+
+	// RateBurst is the number of queries a client network may send at once
+	// (0 allows one second's worth)
+	RateBurst int
+
+	// RateLimitIPv4Prefix and RateLimitIPv6Prefix are the prefix lengths
+	// grouping client addresses into networks for the rate limits (0 uses
+	// DefaultRateLimitIPv4Prefix and DefaultRateLimitIPv6Prefix)
+	RateLimitIPv4Prefix int
+	RateLimitIPv6Prefix int
+
+	// FailureRateLimit is the rate of queries per second that fail to
+	// decrypt or aren't tunnel traffic, such as probes of the zone, a
+	// client network may send; once they use it up, all its queries are
+	// dropped (0 disables it)
+	FailureRateLimit int
+
+	// MaxClients bounds the number of ClientIDs tracked at once; new
+	// clients are refused beyond it (0 uses DefaultMaxClients)
+	MaxClients int
+
+	// MaxGoroutines is the number of goroutines above which queries are
+	// shed until the load drops (0 disables the limit)
+	MaxGoroutines int
+
+	// MaxMemory is the estimated memory in bytes held by queued fragments,
+	// queries, streams and sessions above which queries are shed until the
+	// load drops (0 disables the limit)
+	MaxMemory int64
+
+	// RRLLimit is the number of error responses per second sent to a UDP
+	// client network (0 disables response rate limiting)
+	RRLLimit int
+
+	// RRLAmplification is the ratio of response to query bytes a UDP
+	// client network may receive each second beyond a small allowance for
+	// queries other than tunnel queries, which are allowed more (0
+	// disables it)
+	RRLAmplification int
+
+	// RRLSlip answers every Nth rate limited response with a truncated
+	// reply instead of dropping it (0 drops all)
+	RRLSlip int
+
+	// ChallengeThreshold is the number of error responses per minute after
+	// which UDP queries from a client network without prior valid tunnel
+	// traffic are answered truncated, forcing a retry over TCP (0 disables,
+	// as does disabling ListenTCP)
+	ChallengeThreshold int
+
+	// Cookies answers DNS cookies (RFC 7873): responses to queries with a
+	// COOKIE option carry a server cookie, and sources presenting a valid
+	// one skip source validation and amplification limits
+	Cookies bool
+
+	// CookieSecret is the secret server cookies are derived from, shared
+	// by instances that should accept each other's cookies (empty uses a
+	// random secret)
+	CookieSecret []byte
+
+	// ListenTCP also serves DNS over TCP on ListenAddr
+	ListenTCP bool
+
+	// DrainTimeout is how long Shutdown waits for in-flight queries
+	DrainTimeout time.Duration
+
+	// ClusterListen is the UDP address peer server instances send shared
+	// replay and session state to (empty disables cluster mode)
+	ClusterListen string
+
+	// ClusterPeers are the cluster addresses of the other instances
+	ClusterPeers []string
+
+	// ClusterSecret is the key cluster messages are encrypted with, shared
+	// by the instances and distinct from every key clients hold
+	ClusterSecret []byte
+
+	// AllowStreams lets clients tunnel TCP connections, such as those of
+	// the client's SOCKS5 proxy, to destinations they choose
+	AllowStreams bool
+
+	// StreamAllowPrivate also lets streams reach loopback, private and
+	// link-local addresses, such as services on the server's own network
+	StreamAllowPrivate bool
+
+	// Maintenance starts the server in maintenance mode, refusing new
+	// sessions and streams; see SetMaintenance. Reloading a configuration
+	// that changes it switches the mode.
+	Maintenance bool
+
+	// InstanceLabel names this instance among several serving the domain.
+	// Handshake replies carry it, and clients then send their session's
+	// queries under <label>.<domain>, which can be delegated to this
+	// instance alone so the session's queries keep reaching it
+	InstanceLabel string
+
+	// StartupChecks makes Start verify that the upstream answers, failing
+	// with an explanation instead of answering SERVFAIL later
+	StartupChecks bool
+
+	// StateFile is where state that should survive restarts is kept:
+	// established sessions, client accounting, recent exchanges and the
+	// last revocation list read (empty keeps it in memory only)
+	StateFile string
+
+	// StateBackend is how StateFile is kept: storage.BackendFile (the
+	// default if empty), a journal replayed into memory at start, or
+	// storage.BackendBolt, a bbolt database written through on each change
+	StateBackend string
+
+	// Clock is what message timestamps, key policies, replay windows, rate
+	// limits, cookies and exchanges are timed with, clock.System if nil
+	Clock clock.Clock
+
+	// Random is the source of the TTL and response delay jitter,
+	// clock.Random if nil; tests and simulations set a seeded one to get
+	// the same choices each run
+	Random io.Reader
 }
 
 // DefaultConfig returns a default server configuration.
 func DefaultConfig() *Config {
 	return &Config{
-		ListenAddr:       ":53",
-		UpstreamResolver: "8.8.8.8:53",
-		UpstreamType:     "udp",
-		MaxUDPSize:       1232,
-		ResponseTTL:      60,
-		MaxConcurrent:    1000,
-		RateLimit:        100,
+		ListenAddr:             ":53",
+		UpstreamResolver:       "8.8.8.8:53",
+		UpstreamType:           "udp",
+		UpstreamStrategy:       UpstreamFailover,
+		UpstreamHealthInterval: DefaultUpstreamHealthInterval,
+		MaxUDPSize:             1232,
+		ResponseTTL:            60,
+		NegativeTTL:            DefaultNegativeTTL,
+		MaxConcurrent:          1000,
+		RateLimit:              100,
+		MaxClients:             DefaultMaxClients,
+		MaxGoroutines:          DefaultMaxGoroutines,
+		MaxMemory:              DefaultMaxMemory,
+		RRLLimit:               DefaultRRLLimit,
+		FailureRateLimit:       DefaultFailureRateLimit,
+		RRLSlip:                DefaultRRLSlip,
+		RRLAmplification:       DefaultRRLAmplification,
+		ChallengeThreshold:     DefaultChallengeThreshold,
+		Cookies:                true,
+		ListenTCP:              true,
+		DrainTimeout:           DefaultDrainTimeout,
+		QNameMinimization:      true,
+		Compression:            true,
+		TopN:                   DefaultTopN,
+		AlertFormat:            alert.FormatGeneric,
+		AlertInterval:          alert.DefaultInterval,
 	}
 }
 
 // Handler is the DNS tunnel server handler.
 type Handler struct {
-	config   *Config
-	domain   dns.Name
-	cipher   *crypto.Cipher
-	resolver *Resolver
-	security *Security
-	conn     *net.UDPConn
-	sem      chan struct{}
-	wg       sync.WaitGroup
-	ctx      context.Context
-	cancel   context.CancelFunc
+	config      *Config
+	domain      dns.Name
+	instance    dns.Name // <InstanceLabel>.<domain>, nil without a label
+	keys        atomic.Pointer[keyStore]
+	revocations atomic.Pointer[revocationList] // nil without RevocationFile
+	blocklist   atomic.Pointer[blocklist]      // nil without Blocklists
+	stopBlocks  context.CancelFunc             // stops blocklistLoop; under reloadMu
+	resolver    atomic.Pointer[upstreamChain]
+	responseTTL atomic.Uint32
+	negativeTTL atomic.Uint32
+	soaSerial   uint32
+	zone        atomic.Pointer[staticZone]
+	forwardEDNS atomic.Pointer[[]uint16]
+	rawPassthru atomic.Bool
+	noEDNS      atomic.Bool // AcceptNoEDNS
+	compress    atomic.Bool
+	traceLog    atomic.Bool
+	traceSample sampling.Sampler
+	streamsOn   atomic.Bool
+	streamsPriv atomic.Bool
+	top         *topTracker // nil unless TopReports is on
+	topN        atomic.Int32
+	alerts      *alert.Notifier // nil without AlertWebhook
+	auditor     *answerAuditor  // nil without AuditUpstream
+	cookies     *cookieJar      // nil without Cookies
+	active      *Config         // last reloaded configuration
+	reloadMu    sync.Mutex
+	security    *Security
+	limits      atomic.Pointer[RateLimits]
+	guard       guard
+	concurrency *concurrencyLimiter
+	limitDrop   atomic.Bool // drop queries over the concurrency limits
+	reassembler *dns.Reassembler
+	exchanges   *exchangeTable
+	sessions    *sessionTable
+	tickets     *crypto.TicketKey
+	clients     *SessionManager
+	store       storage.Store
+	clock       clock.Clock
+	random      io.Reader
+	streams     *streamTable
+	polls       *pollTable
+	cluster     *cluster
+	conn        *net.UDPConn
+	tcpListener net.Listener
+	tcpConns    map[net.Conn]struct{}
+	tcpMu       sync.Mutex
+	draining    atomic.Bool
+	maintenance atomic.Bool
+	sem         chan struct{}
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 // NewHandler creates a new server handler.
@@ -79,33 +451,137 @@ func NewHandler(config *Config) (*Handler, error) {
 		return nil, fmt.Errorf("invalid domain: %w", err)
 	}
 
-	// Create cipher (server side)
-	cipher, err := crypto.NewCipher(config.SharedSecret, false) // isClient=false
+	if err := checkConfig(domain, config); err != nil {
+		return nil, err
+	}
+
+	instance, err := instanceName(domain, config.InstanceLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create keyrings (server side)
+	clk := clock.Or(config.Clock)
+	keys, err := newKeyStore(config, clk)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cipher: %w", err)
 	}
 
 	// Create resolver
-	resolver, err := NewResolver(config.UpstreamResolver, config.UpstreamType)
+	resolver, err := upstreamChainFromConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create resolver: %w", err)
 	}
 
+	zone, err := newStaticZone(domain, config.ZoneRecords)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zone records: %w", err)
+	}
+
+	blocks, err := newBlocklist(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts *alert.Notifier
+	if config.AlertWebhook != "" {
+		alerts, err = alert.New(config.AlertWebhook, config.AlertFormat, "server "+domain.String(), config.AlertInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var auditor *answerAuditor
+	if config.AuditUpstream != "" {
+		if auditor, err = newAnswerAuditor(config.AuditUpstream, config.AuditSample); err != nil {
+			return nil, err
+		}
+	}
+
+	var cookies *cookieJar
+	if config.Cookies {
+		if cookies, err = newCookieJar(config.CookieSecret, clk); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create security handler
 	security := NewSecurity(config.RateLimit)
+	security.SetChallengeThreshold(challengeThreshold(config))
+	security.SetClock(clk)
+
+	store, err := storage.Open(config.StateFile, config.StateBackend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state: %w", err)
+	}
+
+	tickets, err := newTicketKey(config, store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	var revocations *revocationList
+	if config.RevocationFile != "" {
+		if revocations, err = loadRevocationList(config.RevocationFile, store); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	h := &Handler{
-		config:   config,
-		domain:   domain,
-		cipher:   cipher,
-		resolver: resolver,
-		security: security,
-		sem:      make(chan struct{}, config.MaxConcurrent),
-		ctx:      ctx,
-		cancel:   cancel,
+		config:      config,
+		active:      config,
+		domain:      domain,
+		instance:    instance,
+		security:    security,
+		reassembler: dns.NewReassembler(dns.DefaultReassemblyTimeout, dns.DefaultMaxReassemblyBuffers),
+		exchanges:   newExchangeTable(dns.DefaultReassemblyTimeout, store, clk),
+		sessions:    newSessionTable(DefaultSessionTimeout, DefaultMaxSessions, store),
+		tickets:     tickets,
+		clients:     NewSessionManager(DefaultSessionTimeout, config.MaxClients, store),
+		concurrency: newConcurrencyLimiter(),
+		store:       store,
+		streams:     newStreamTable(DefaultMaxStreams),
+		polls:       newPollTable(),
+		tcpConns:    make(map[net.Conn]struct{}),
+		sem:         make(chan struct{}, config.MaxConcurrent),
+		soaSerial:   soaSerial(time.Now()),
+		alerts:      alerts,
+		auditor:     auditor,
+		cookies:     cookies,
+		clock:       clk,
+		random:      clock.RandomOr(config.Random),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	if config.TopReports {
+		h.top = newTopTracker(time.Now().UTC())
 	}
+	h.SetRateLimits(rateLimits(config))
+	h.security.SetRateLimitPrefixes(rateLimitPrefixes(config))
+	h.guard.setLimits(config.MaxGoroutines, config.MaxMemory)
+	h.concurrency.setLimits(config.MaxClientConcurrent, config.MaxQPS)
+	h.limitDrop.Store(config.OverLimitAction == OverLimitDrop)
+	h.keys.Store(keys)
+	h.revocations.Store(revocations)
+	h.blocklist.Store(blocks)
+	h.resolver.Store(resolver)
+	h.zone.Store(zone)
+	h.responseTTL.Store(config.ResponseTTL)
+	h.negativeTTL.Store(config.NegativeTTL)
+	h.forwardEDNS.Store(&config.ForwardEDNSOptions)
+	h.rawPassthru.Store(config.RawPassthrough)
+	h.noEDNS.Store(config.AcceptNoEDNS)
+	h.compress.Store(config.Compression)
+	h.traceLog.Store(config.TraceLog)
+	h.traceSample.SetRate(config.TraceLogSample)
+	h.topN.Store(int32(config.TopN))
+	h.streamsOn.Store(config.AllowStreams)
+	h.streamsPriv.Store(config.StreamAllowPrivate)
+	h.maintenance.Store(config.Maintenance)
 
 	return h, nil
 }
@@ -118,21 +594,96 @@ func (h *Handler) Start() error {
 		return fmt.Errorf("invalid listen address: %w", err)
 	}
 
+	// Fail fast if the upstream can't answer queries
+	if h.config.StartupChecks {
+		if err := h.checkUpstream(); err != nil {
+			return err
+		}
+	}
+
 	// Create UDP listener
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
+		return listenError("UDP", h.config.ListenAddr, err)
 	}
 	h.conn = conn
 
+	// Create TCP listener
+	if h.config.ListenTCP {
+		ln, err := net.Listen("tcp", h.config.ListenAddr)
+		if err != nil {
+			conn.Close()
+			return listenError("TCP", h.config.ListenAddr, err)
+		}
+		h.tcpListener = ln
+	}
+
+	// Join the cluster
+	if h.config.ClusterListen != "" {
+		c, err := newCluster(h.config.ClusterListen, h.config.ClusterPeers, h.config.ClusterSecret)
+		if err != nil {
+			conn.Close()
+			if h.tcpListener != nil {
+				h.tcpListener.Close()
+			}
+			return err
+		}
+		h.cluster = c
+	}
+
 	log.Printf("DNS server listening on %s", h.config.ListenAddr)
+	if h.tcpListener != nil {
+		log.Printf("DNS over TCP enabled on %s", h.tcpListener.Addr())
+	}
 	log.Printf("Authoritative for domain: %s", h.domain.String())
 	log.Printf("Upstream resolver: %s (%s)", h.config.UpstreamResolver, h.config.UpstreamType)
+	if len(h.config.FallbackUpstreams) > 0 {
+		log.Printf("Fallback upstreams: %s (%s)", strings.Join(h.config.FallbackUpstreams, ", "), h.config.UpstreamStrategy)
+	}
+	if len(h.config.NamedUpstreams) > 0 {
+		log.Printf("Named upstreams: %s", strings.Join(upstreamNames(h.config.NamedUpstreams), ", "))
+	}
+	if len(h.config.UpstreamRoutes) > 0 {
+		log.Printf("Routed domains: %s", strings.Join(upstreamNames(h.config.UpstreamRoutes), ", "))
+	}
+	logBlocklist("Blocklist", h.blocklist.Load())
+	if h.config.AllowStreams {
+		log.Printf("TCP streams enabled")
+	}
+	if h.maintenance.Load() {
+		log.Printf("Maintenance mode enabled, refusing new sessions and streams")
+	}
+	if h.instance != nil {
+		log.Printf("Instance subdomain: %s", h.instance.String())
+	}
+	if h.cluster != nil {
+		log.Printf("Cluster listening on %s with %d peers", h.cluster.conn.LocalAddr(), len(h.cluster.peers))
+		h.cluster.start(h)
+	}
 
 	// Start accept loop
 	h.wg.Add(1)
 	go h.acceptLoop()
 
+	if h.tcpListener != nil {
+		h.wg.Add(1)
+		go h.acceptTCPLoop()
+	}
+
+	if h.top != nil {
+		h.wg.Add(1)
+		go h.topReportLoop()
+	}
+
+	if h.config.RevocationFile != "" {
+		h.wg.Add(1)
+		go h.revocationLoop()
+	}
+
+	h.reloadMu.Lock()
+	h.runBlocklistLoop(len(h.active.Blocklists) > 0)
+	h.reloadMu.Unlock()
+
 	return nil
 }
 
@@ -142,8 +693,69 @@ func (h *Handler) Stop() {
 	if h.conn != nil {
 		h.conn.Close()
 	}
-	h.resolver.Close()
+	h.closeTCP()
+	h.streams.closeAll()
+	h.resolver.Load().Close()
 	h.wg.Wait()
+	if h.auditor != nil {
+		h.auditor.resolver.Close()
+	}
+
+	if h.cluster != nil {
+		h.cluster.close()
+	}
+	h.sessions.save()
+	h.clients.save()
+	h.exchanges.save()
+	if err := h.store.Close(); err != nil {
+		log.Printf("Failed to close state: %v", err)
+	}
+	h.alerts.Close()
+}
+
+// Shutdown stops accepting queries and waits for in-flight queries to
+// finish until ctx is done, then stops the handler. It returns ctx's error
+// if queries were still in flight.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.draining.Store(true)
+
+	// Wake the accept loops and idle TCP connections
+	if h.conn != nil {
+		_ = h.conn.SetReadDeadline(time.Now())
+	}
+	h.drainTCP()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	h.Stop()
+	return err
+}
+
+// ReplaysDetected returns the number of replayed tunnel messages rejected.
+func (h *Handler) ReplaysDetected() uint64 {
+	return h.security.Replays()
+}
+
+// Sessions returns the activity of the clients seen recently, most
+// recently seen first.
+func (h *Handler) Sessions() []ClientSession {
+	return h.clients.Sessions()
+}
+
+// UpstreamStats returns upstream latency and failure statistics.
+func (h *Handler) UpstreamStats() []UpstreamStats {
+	return h.resolver.Load().GetStats()
 }
 
 // acceptLoop accepts incoming DNS queries.
@@ -158,8 +770,12 @@ func (h *Handler) acceptLoop() {
 		default:
 		}
 
-		// Set read deadline
+		// Set read deadline; checked after setting it so Shutdown's wakeup
+		// isn't overwritten
 		_ = h.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if h.draining.Load() {
+			return
+		}
 
 		n, addr, err := h.conn.ReadFromUDP(buf)
 		if err != nil {
@@ -174,7 +790,14 @@ func (h *Handler) acceptLoop() {
 		}
 
 		// Check rate limit
-		if !h.security.CheckRateLimit(addr.IP.String()) {
+		ip, _ := sourceAddr(addr)
+		if !h.security.CheckRateLimit(ip) {
+			h.alertRateLimited(ip)
+			continue
+		}
+
+		// Shed queries while overloaded
+		if h.overloaded() {
 			continue
 		}
 
@@ -195,76 +818,351 @@ func (h *Handler) acceptLoop() {
 			defer h.wg.Done()
 			defer func() { <-h.sem }()
 
-			h.handleQuery(data, addr)
+			if resp := h.handleQuery(data, addr, h.config.MaxUDPSize); resp != nil {
+				_, _ = h.conn.WriteToUDP(resp, addr)
+			}
 		}(data, addr)
 	}
 }
 
-// handleQuery handles a single DNS query.
-func (h *Handler) handleQuery(data []byte, addr *net.UDPAddr) {
+// failedDecrypt reports whether err rejects a query that isn't authentic
+// tunnel traffic: not a tunnel query, or one no key decrypts.
+func failedDecrypt(err error) bool {
+	return errors.Is(err, ErrNotTunnelQuery) || errors.Is(err, ErrUnknownKeyID) ||
+		errors.Is(err, crypto.ErrDecryptionFailed)
+}
+
+// alertRateLimited alerts that ip's network exceeded its rate limits.
+func (h *Handler) alertRateLimited(ip netip.Addr) {
+	h.alerts.Notify(alert.EventQuotaExceeded, fmt.Sprintf("%s exceeded the rate limit of %d queries or %d failures per second",
+		ip, h.limits.Load().RateLimit, h.limits.Load().FailureRateLimit))
+}
+
+// handleQuery handles a single DNS query and returns the response to send,
+// or nil if the query should be dropped. Responses larger than maxSize, or
+// over UDP larger than the query's EDNS payload size, are truncated.
+func (h *Handler) handleQuery(data []byte, addr net.Addr, maxSize int) []byte {
 	// Parse DNS message
 	query, err := dns.ParseMessage(data)
 	if err != nil {
 		log.Printf("failed to parse query from %s: %v", addr, err)
-		return
+		return nil
 	}
 
 	// Must be a query
 	if query.IsResponse() {
-		return
+		return nil
+	}
+
+	ip, udp := sourceAddr(addr)
+	cookie, clientCookie := h.cookies.check(query, ip)
+	resp, tunnel := h.answerQuery(query, addr, cookie)
+	if resp != nil && (cookie == cookieClient || cookie == cookieValid) {
+		resp = h.cookies.addCookie(resp, clientCookie, ip)
+	}
+	if udp {
+		maxSize = dns.MaxResponseSize(query, maxSize)
+	}
+	if len(resp) > maxSize {
+		resp = truncateToSize(resp, maxSize)
+	}
+	// Sources with a valid server cookie can't be spoofed, so they aren't
+	// limited as amplification targets
+	if !udp || resp == nil || cookie == cookieValid {
+		return resp
 	}
 
-	// Validate query
-	if err := dns.ValidateQuery(query, h.domain, uint16(h.config.MaxUDPSize)); err != nil {
-		if err == dns.ErrNotAuthoritative {
-			h.sendError(query, addr, dns.RcodeNameError)
-		} else {
-			h.sendError(query, addr, dns.RcodeFormatError)
+	switch h.security.CheckAmplification(ip, len(data), len(resp), tunnel) {
+	case RRLDrop:
+		return nil
+	case RRLSlip:
+		return h.truncatedResponse(query)
+	}
+	return resp
+}
+
+// truncateToSize truncates a wire format response to at most size bytes,
+// dropping whole RRsets so it stays well-formed (see Message.TruncateTo).
+func truncateToSize(data []byte, size int) []byte {
+	resp, err := dns.ParseMessage(data)
+	if err != nil {
+		log.Printf("failed to parse response: %v", err)
+		return nil
+	}
+	data, err = resp.TruncateTo(size)
+	if err != nil {
+		log.Printf("failed to marshal response: %v", err)
+		return nil
+	}
+	return data
+}
+
+// answerQuery returns the response to a query whose COOKIE option proves
+// cookie about its source, or nil if it should be dropped, and whether it
+// is a tunnel response. Tunnel responses answer queries that decrypted,
+// fetch fragments of exchanges that did, or acknowledge query fragments.
+func (h *Handler) answerQuery(query *dns.Message, addr net.Addr, cookie cookieState) ([]byte, bool) {
+	ip, udp := sourceAddr(addr)
+
+	// Validate query; without EDNS, replies are limited to 512 bytes over
+	// UDP, so tunnel responses are fragmented to fit
+	ctx := h.ctx
+	minEDNSSize := uint16(h.config.MaxUDPSize)
+	if h.noEDNS.Load() && query.GetEDNS0Size() == 0 {
+		minEDNSSize = 0
+		if udp {
+			ctx = withResponseLimit(ctx, dns.EDNSMinUDPSize)
 		}
-		return
+	}
+	if err := dns.ValidateQuery(query, h.domain, minEDNSSize); err != nil {
+		h.security.RecordFailure(ip)
+		switch err {
+		case dns.ErrNotAuthoritative:
+			return h.limitedErrorResponse(query, addr, dns.RcodeNameError), false
+		case dns.ErrBadEDNSVersion:
+			return h.limitedErrorResponse(query, addr, dns.RcodeBadVersion), false
+		case dns.ErrEDNSTooSmall:
+			// Too small for tunnel traffic, but fine for the zone's own
+			// records
+			return h.zoneResponse(query, addr), false
+		}
+		return h.limitedErrorResponse(query, addr, dns.RcodeFormatError), false
+	}
+
+	// Refer queries for subdomains delegated elsewhere, such as other
+	// instances' subdomains
+	if resp := h.referralResponse(query); resp != nil {
+		return resp, false
+	}
+
+	if cookie == cookieMalformed {
+		h.security.RecordFailure(ip)
+		return h.limitedErrorResponse(query, addr, dns.RcodeFormatError), false
+	}
+
+	// Make suspicious UDP sources prove their address before decrypting or
+	// querying upstream for them: with the server cookie of a BADCOOKIE
+	// reply if they send cookies, or else by retrying over TCP
+	if udp && cookie != cookieValid && h.security.CheckSource(ip) {
+		if cookie == cookieClient {
+			return h.errorResponse(query, dns.RcodeBadCookie), false
+		}
+		return h.truncatedResponse(query), false
+	}
+
+	if !h.concurrency.allowQuery() {
+		return h.overLimitResponse(query, ErrQPSExceeded), false
 	}
 
 	// Process the tunnel query
-	response, err := h.processTunnelQuery(h.ctx, query)
+	response, err := h.processTunnelQuery(ctx, query)
+	if failedDecrypt(err) {
+		h.security.RecordFailure(ip)
+	}
+	if errors.Is(err, ErrNotTunnelQuery) {
+		return h.zoneResponse(query, addr), false
+	}
+	if errors.Is(err, ErrMaintenance) {
+		return h.maintenanceResponse(query), false
+	}
+	if errors.Is(err, ErrClientBusy) || errors.Is(err, ErrExchangesFull) {
+		return h.overLimitResponse(query, err), false
+	}
 	if err != nil {
 		log.Printf("tunnel query processing failed: %v", err)
-		h.sendError(query, addr, dns.RcodeServerFail)
-		return
+		return h.limitedErrorResponse(query, addr, dns.RcodeServerFail), false
 	}
+	h.security.RecordSourceValid(ip)
 
 	// Add anti-fingerprinting delay
-	time.Sleep(varyResponseDelay())
+	time.Sleep(varyResponseDelay(h.random))
 
-	// Send response
+	// Marshal response
 	respData, err := response.Marshal()
 	if err != nil {
 		log.Printf("failed to marshal response: %v", err)
-		return
-	}
-
-	// Truncate if necessary
-	if len(respData) > h.config.MaxUDPSize {
-		respData = respData[:h.config.MaxUDPSize]
-		respData[2] |= 0x02 // Set TC bit
+		return nil, false
 	}
-
-	_, _ = h.conn.WriteToUDP(respData, addr)
+	return respData, true
 }
 
 // processTunnelQuery processes a tunnel query and returns the response.
 func (h *Handler) processTunnelQuery(ctx context.Context, query *dns.Message) (*dns.Message, error) {
 	// Extract the encrypted payload from the query name
-	clientID, encryptedPayload, err := dns.ExtractQueryPayload(query, h.domain)
+	keyID, clientID, payload, err := dns.ExtractQueryPayload(query, h.payloadDomain(query))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotTunnelQuery, err)
+	}
+
+	// Look up the client's keys
+	keyring, err := h.keys.Load().keyring(keyID)
+	if err != nil {
+		h.alerts.Notify(alert.EventKeyMismatch, fmt.Sprintf("query for %v from client %x", err, clientID[:]))
+		return nil, err
+	}
+
+	// Parse the fragment header
+	fragment, err := dns.ParseFragment(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotTunnelQuery, err)
+	}
+
+	responseFragment, err := h.handleFragment(ctx, keyID, keyring, clientID, fragment)
+	if err != nil {
+		return nil, err
+	}
+	h.clients.Record(clientID, len(fragment.Data), len(responseFragment.Data))
+	h.top.recordTraffic(clientID, len(fragment.Data)+len(responseFragment.Data))
+
+	// Create the tunnel response
+	ttl := varyTTL(h.random, h.responseTTL.Load())
+	response, err := dns.CreateTunnelResponse(query, h.payloadDomain(query), responseFragment.Marshal(), ttl, uint16(h.config.MaxUDPSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tunnel response: %w", err)
+	}
+
+	return response, nil
+}
+
+// handleFragment handles a query fragment and returns the response fragment.
+// Incomplete messages are acknowledged; once a message is complete it is
+// resolved once: duplicates of it wait for its answer, and fetches get the
+// rest of the response from the exchange table.
+func (h *Handler) handleFragment(ctx context.Context, keyID dns.KeyID, keyring *crypto.Keyring, clientID dns.ClientID, fragment *dns.Fragment) (*dns.Fragment, error) {
+	if fragment.IsFetch() {
+		ex, ok := h.exchanges.get(clientID, fragment.ID)
+		if !ok {
+			return nil, ErrUnknownExchange
+		}
+		return ex.fragment(ctx, fragment.Seq)
+	}
+	if fragment.IsProbe() {
+		return h.resolveProbe(keyID, keyring, clientID, fragment)
+	}
+
+	encryptedQuery, complete, err := h.reassembler.Add(clientID, fragment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reassemble payload: %w", err)
+	}
+	if !complete {
+		return dns.NewAckFragment(fragment.ID), nil
+	}
+
+	// Cap the messages each client has resolving at once
+	if !h.concurrency.acquire(clientID) {
+		return nil, ErrClientBusy
+	}
+	defer h.concurrency.release(clientID)
+
+	// Duplicates of the message wait for its exchange and get its answer
+	ex, created, err := h.exchanges.create(clientID, fragment.ID, encryptedQuery)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		// Resumed sessions go on as session messages
+		flags, message := fragment.Flags, encryptedQuery
+		if fragment.IsResume() {
+			message, err = h.resumeSession(keyID, clientID, encryptedQuery)
+			flags &^= dns.FragmentFlagHandshake
+		}
+
+		var fragments []*dns.Fragment
+		switch {
+		case err != nil:
+		case flags&dns.FragmentFlagHandshake != 0 && h.maintenance.Load():
+			// New sessions are refused in maintenance mode; established
+			// ones and answered exchanges are still served
+			err = ErrMaintenance
+		case flags&dns.FragmentFlagHandshake != 0:
+			fragments, err = h.resolveHandshake(ctx, keyID, keyring, clientID, message, fragment.ID)
+		case fragment.IsStream():
+			fragments, err = h.resolveStreamMessage(ctx, keyID, keyring, clientID, fragment.IsSession(), message, fragment.ID)
+		case fragment.IsPoll():
+			fragments, err = h.resolvePoll(ctx, keyID, keyring, clientID, fragment.IsSession(), message, fragment.ID)
+		default:
+			fragments, err = h.resolveTunnelQuery(ctx, keyID, keyring, clientID, flags, message, fragment.ID)
+		}
+		h.exchanges.finish(ex, fragments, err)
+	}
+	return ex.fragment(ctx, 0)
+}
+
+// resolveHandshake establishes a session from a reassembled handshake and
+// returns the server's encrypted ephemeral public key split into fragments.
+// Clients asking for one also get a resumption ticket for the session.
+func (h *Handler) resolveHandshake(ctx context.Context, keyID dns.KeyID, keyring *crypto.Keyring, clientID dns.ClientID, data []byte, id uint16) ([]*dns.Fragment, error) {
+	// The pre-shared key authenticates the client's ephemeral key
+	clientPublic, cipher, err := keyring.Decrypt(data)
+	if err == nil && h.revocations.Load().revoked(keyID) {
+		err = ErrKeyRevoked
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract payload: %w", err)
+		return nil, fmt.Errorf("failed to decrypt handshake: %w", err)
+	}
+	if h.checkReplay(data) {
+		return nil, crypto.ErrReplayDetected
+	}
+	wantTicket := len(clientPublic) == crypto.PublicKeySize+1 && clientPublic[crypto.PublicKeySize] == crypto.TicketRequest
+	if len(clientPublic) != crypto.PublicKeySize && !wantTicket {
+		return nil, ErrInvalidHandshake
+	}
+	clientPublic = clientPublic[:crypto.PublicKeySize]
+	if err := h.clients.Admit(clientID); err != nil {
+		return nil, err
 	}
 
-	_ = clientID // ClientID can be used for session tracking if needed
+	hs, err := crypto.NewHandshake()
+	if err != nil {
+		return nil, err
+	}
+	sessionCipher, err := hs.SessionCipher(clientPublic, false) // isClient=false
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	if err := h.sessions.put(clientID, keyID, sessionCipher); err != nil {
+		return nil, err
+	}
+	if h.cluster != nil {
+		h.cluster.shareSession(clientID, keyID, sessionCipher)
+	}
 
-	// Decrypt the payload
-	decryptedQuery, err := h.cipher.Decrypt(encryptedPayload)
+	// Reply with our ephemeral key under the same pre-shared key, followed
+	// by any ticket and the instance label as an affinity hint
+	reply := hs.PublicKey()
+	if wantTicket {
+		ticket, err := h.issueTicket(keyID, sessionCipher)
+		if err != nil {
+			return nil, err
+		}
+		reply = crypto.AppendTicket(reply, ticket)
+	}
+	reply, err = cipher.EncryptWithoutTimestamp(append(reply, h.instanceLabel()...))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+		return nil, fmt.Errorf("failed to encrypt handshake: %w", err)
+	}
+
+	return dns.SplitPayload(reply, id, h.responseFragmentSize(ctx, clientID))
+}
+
+// resolveTunnelQuery decrypts and resolves a reassembled tunnel query sent
+// with the given fragment flags and returns the encrypted response split
+// into fragments. Compressed queries are decompressed, and replies to
+// clients that accept it are compressed if that makes them smaller. Errors
+// after decryption name the query's trace ID, if it has one.
+func (h *Handler) resolveTunnelQuery(ctx context.Context, keyID dns.KeyID, keyring *crypto.Keyring, clientID dns.ClientID, flags byte, encryptedQuery []byte, id uint16) ([]*dns.Fragment, error) {
+	decryptedQuery, cipher, err := h.decryptMessage(keyID, keyring, clientID, flags&dns.FragmentFlagSession != 0, encryptedQuery)
+	if keyRejected(err) && cipher != nil {
+		log.Printf("Refusing query from client %x with key ID %d: %v", clientID[:], keyID, err)
+		return h.keyRejectedReply(ctx, cipher, clientID, flags, decryptedQuery, id, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if flags&dns.FragmentFlagCompressed != 0 {
+		if decryptedQuery, err = dns.Decompress(decryptedQuery); err != nil {
+			return nil, fmt.Errorf("failed to decompress query: %w", err)
+		}
 	}
 
 	// Parse the original DNS query
@@ -272,70 +1170,421 @@ func (h *Handler) processTunnelQuery(ctx context.Context, query *dns.Message) (*
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse original query: %w", err)
 	}
+	trace, traced := originalQuery.TraceID()
+	start := time.Now()
+
+	if b := h.blocklist.Load(); len(originalQuery.Question) == 1 && b.blocks(originalQuery.Question[0].Name) {
+		return h.blockedReply(ctx, b, cipher, clientID, originalQuery, id)
+	}
+
+	chain, err := h.upstreamFor(keyring, originalQuery)
+	if err != nil {
+		log.Printf("Refusing query from client %x with key ID %d: %v", clientID[:], keyID, err)
+		return h.refusedReply(ctx, cipher, clientID, originalQuery, id, dns.EDEProhibited, err.Error())
+	}
+
+	fragments, err := h.resolveOriginalQuery(ctx, chain, cipher, clientID, flags, originalQuery, id)
+	h.top.recordQuery(originalQuery, err != nil)
+	if traced {
+		if err != nil {
+			return nil, fmt.Errorf("%w (trace %s)", err, trace)
+		}
+		if h.traceLog.Load() && h.traceSample.Sample() {
+			q := originalQuery.Question
+			if len(q) == 1 {
+				log.Printf("trace %s: %s type %d for client %x in %v", trace, q[0].Name, q[0].Type, clientID[:], time.Since(start).Round(time.Millisecond))
+			}
+		}
+	}
+	return fragments, err
+}
+
+// resolveOriginalQuery resolves a decrypted tunnel query with the chain
+// and returns the encrypted response split into fragments.
+func (h *Handler) resolveOriginalQuery(ctx context.Context, chain *upstreamChain, cipher *crypto.Cipher, clientID dns.ClientID, flags byte, originalQuery *dns.Message, id uint16) ([]*dns.Fragment, error) {
+	upstreamQuery, err := h.upstreamQuery(originalQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid original query: %w", err)
+	}
 
 	// Resolve the actual DNS query
-	dnsResponse, err := h.resolver.Resolve(ctx, originalQuery)
+	responseData, err := h.resolveUpstream(ctx, chain, upstreamQuery)
 	if err != nil {
+		return nil, err
+	}
+
+	reply, replyFlags := responseData, byte(0)
+	if flags&dns.FragmentFlagCompress != 0 && h.compress.Load() {
+		if compressed, ok := dns.Compress(responseData); ok {
+			reply, replyFlags = compressed, dns.FragmentFlagCompressed
+		}
+	}
+	fragments, err := h.encryptReply(ctx, cipher, clientID, reply, id, replyFlags)
+	if !errors.Is(err, dns.ErrTooManyFragments) {
+		return fragments, err
+	}
+
+	// Answers too large for the tunnel are truncated, as servers truncate
+	// answers too large for UDP, rather than failing the query
+	truncated, err := truncateResponse(responseData)
+	if err != nil {
+		return nil, err
+	}
+	return h.encryptReply(ctx, cipher, clientID, truncated, id, 0)
+}
+
+// truncateResponse returns a wire format response without its records but
+// the OPT record, with the TC bit set.
+func truncateResponse(data []byte) ([]byte, error) {
+	resp, err := dns.ParseMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	resp.Truncate()
+	return resp.Marshal()
+}
+
+// upstreamQueryFlags are the header flags of a tunneled query that reach
+// the upstream: the opcode, RD, AD and CD. Response-only flags such as QR,
+// AA and TC, the Z bit and the rcode are cleared.
+const upstreamQueryFlags = 0x7800 | 0x0100 | 0x0020 | 0x0010
+
+// upstreamQuery rebuilds a tunneled query for the upstream. Its OPT record
+// is made afresh rather than copied with the other additional records: the
+// client's DO flag is kept, and its payload size within 512 and 4096
+// bytes, so the upstream never sends UDP answers larger than the server
+// reads. Of its options only those in ForwardEDNSOptions are kept, so
+// client-identifying ones such as client subnet don't reach the upstream,
+// and never the trace ID. Other additional records are dropped, and header
+// flags other than upstreamQueryFlags cleared.
+func (h *Handler) upstreamQuery(query *dns.Message) (*dns.Message, error) {
+	opt, err := query.OPT()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dns.Message{ID: query.ID, Flags: query.Flags & upstreamQueryFlags, Question: query.Question}
+	if opt == nil {
+		return out, nil
+	}
+
+	// Malformed option data is dropped
+	options, _ := dns.ParseEDNSOptions(opt.Data)
+	keep := *h.forwardEDNS.Load()
+	var forwarded []dns.EDNSOption
+	for _, o := range options {
+		if slices.Contains(keep, o.Code) && o.Code != dns.EDNSOptionTrace && o.Code != dns.EDNSOptionUpstream {
+			forwarded = append(forwarded, o)
+		}
+	}
+	out.SetEDNS0(min(max(opt.Class, dns.EDNSMinUDPSize), dns.MaxEDNSSize), query.DO(), forwarded...)
+	return out, nil
+}
+
+// alertUpstreamFailed alerts that every upstream failed to answer a query,
+// or that the upstreams disagreed about the answer, unless the query was
+// canceled.
+func (h *Handler) alertUpstreamFailed(ctx context.Context, err error) {
+	if errors.Is(err, ErrNoConsensus) {
+		h.alerts.Notify(alert.EventAnswerMismatch, err.Error())
+	} else if ctx.Err() == nil {
+		h.alerts.Notify(alert.EventUpstreamOutage, fmt.Sprintf("no upstream answered: %v", err))
+	}
+}
+
+// decryptMessage decrypts a reassembled tunnel message and returns it with
+// the cipher for the reply. Session messages use the client's session
+// keys, others the key ID's pre-shared keys. Authentic messages whose key
+// is revoked or outside its policy are returned with the cipher and an
+// error for which keyRejected is true.
+func (h *Handler) decryptMessage(keyID dns.KeyID, keyring *crypto.Keyring, clientID dns.ClientID, session bool, data []byte) ([]byte, *crypto.Cipher, error) {
+	var plaintext []byte
+	var cipher *crypto.Cipher
+	var err error
+	if session {
+		cipher, err = h.sessions.get(clientID, keyID)
+		if err != nil {
+			return nil, nil, err
+		}
+		plaintext, err = cipher.Decrypt(data)
+		if err == nil {
+			// Sessions end with the policies of the key ID's keys
+			err = keyring.Check(h.clock.Now())
+		}
+	} else {
+		// Decrypt the payload with whichever of the key ID's keys the client used
+		plaintext, cipher, err = keyring.Decrypt(data)
+		if errors.Is(err, crypto.ErrDecryptionFailed) {
+			h.alerts.Notify(alert.EventKeyMismatch, fmt.Sprintf("query from client %x not encrypted with any key of key ID %d", clientID[:], keyID))
+		}
+	}
+	if err != nil && !keyRejected(err) {
+		return nil, nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+
+	// Reject authentic messages seen before; only checked after decryption
+	// so forged messages can't fill the detector
+	if h.checkReplay(data) {
+		return nil, nil, crypto.ErrReplayDetected
+	}
+	if err == nil && h.revocations.Load().revoked(keyID) {
+		err = ErrKeyRevoked
+	}
+	if err != nil {
+		return plaintext, cipher, err
+	}
+	if err := h.clients.Admit(clientID); err != nil {
+		if errors.Is(err, ErrTooManyClients) {
+			h.alerts.Notify(alert.EventQuotaExceeded, fmt.Sprintf("client %x refused: client limit reached", clientID[:]))
+		}
+		return nil, nil, err
+	}
+	return plaintext, cipher, nil
+}
+
+// encryptReply encrypts a reply to a client and splits it into fragments
+// with the given flags that fit a single answer on the client's path.
+func (h *Handler) encryptReply(ctx context.Context, cipher *crypto.Cipher, clientID dns.ClientID, reply []byte, id uint16, flags byte) ([]*dns.Fragment, error) {
+	encrypted, err := cipher.EncryptWithoutTimestamp(reply)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt response: %w", err)
+	}
+
+	fragments, err := dns.SplitPayloadFlags(encrypted, id, flags, h.responseFragmentSize(ctx, clientID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fragment response: %w", err)
+	}
+
+	return fragments, nil
+}
+
+// responseFragmentSize returns the number of data bytes a response
+// fragment to a client carries: as many as fit MaxUDPSize, or the smaller
+// response size the client announced its resolvers carry or the query
+// allows (see withResponseLimit), in the carrier it announced. CNAME
+// targets are under the domain the query was sent to, so fragments fit
+// the longer instance subdomain.
+func (h *Handler) responseFragmentSize(ctx context.Context, clientID dns.ClientID) int {
+	size := h.config.MaxUDPSize
+	if limit := h.clients.MaxResponse(clientID); limit > 0 {
+		size = min(size, limit)
+	}
+	if limit, ok := ctx.Value(responseLimitKey{}).(int); ok {
+		size = min(size, limit)
+	}
+	domain := h.domain
+	if h.instance != nil {
+		domain = h.instance
+	}
+	return h.clients.Carrier(clientID).FragmentSize(size, domain)
+}
+
+// responseLimitKey is the context key of the response size limit.
+type responseLimitKey struct{}
+
+// withResponseLimit returns a context whose tunnel responses are
+// fragmented to fit size bytes, for queries whose replies can't be larger.
+func withResponseLimit(ctx context.Context, size int) context.Context {
+	return context.WithValue(ctx, responseLimitKey{}, size)
+}
+
+// resolveUpstream resolves the query with the chain and returns the
+// response to tunnel: the upstream bytes in raw passthrough mode, otherwise the parsed
+// response re-encoded.
+func (h *Handler) resolveUpstream(ctx context.Context, chain *upstreamChain, query *dns.Message) ([]byte, error) {
+	raw, dnsResponse, upstream, err := chain.exchange(ctx, query)
+	if err != nil {
+		h.alertUpstreamFailed(ctx, err)
 		return nil, fmt.Errorf("upstream resolution failed: %w", err)
 	}
 	if dnsResponse == nil {
 		return nil, fmt.Errorf("upstream resolver returned nil response")
 	}
+	h.auditAnswer(query, dnsResponse, upstream)
+	if h.rawPassthru.Load() {
+		return raw, nil
+	}
 
 	// Marshal the DNS response
-	responseData, err := dnsResponse.Marshal()
+	data, err := dnsResponse.Marshal()
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal DNS response: %w", err)
 	}
+	return data, nil
+}
+
+// limitedErrorResponse builds a DNS error response subject to response
+// rate limiting. Only UDP responses are limited, since TCP clients can't
+// spoof their source address.
+func (h *Handler) limitedErrorResponse(query *dns.Message, addr net.Addr, rcode uint16) []byte {
+	ip, udp := sourceAddr(addr)
+	if !udp {
+		return h.errorResponse(query, rcode)
+	}
+
+	h.security.RecordSourceError(ip)
+	switch h.security.CheckResponse(ip, rcode) {
+	case RRLDrop:
+		return nil
+	case RRLSlip:
+		data := h.errorResponse(query, rcode)
+		if len(data) > 2 {
+			data[2] |= 0x02 // Set TC bit
+		}
+		return data
+	}
+	return h.errorResponse(query, rcode)
+}
 
-	// Encrypt the response
-	encryptedResponse, err := h.cipher.EncryptWithoutTimestamp(responseData)
+// truncatedResponse builds an empty response with the TC bit set, asking
+// the client to retry over TCP.
+func (h *Handler) truncatedResponse(query *dns.Message) []byte {
+	data := h.errorResponse(query, dns.RcodeNoError)
+	if len(data) > 2 {
+		data[2] |= 0x02 // Set TC bit
+	}
+	return data
+}
+
+// sourceAddr returns the IP address of a client and whether it is a UDP
+// address, whose source may be spoofed.
+func sourceAddr(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip, true
+	case *net.TCPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip, false
+	}
+	return netip.Addr{}, false
+}
+
+// zoneResponse answers a query in the zone that isn't tunnel traffic as an
+// authoritative server would: with the static zone records, the SOA record
+// at the apex, NODATA for other types at names that exist, and NXDOMAIN
+// for names that don't.
+func (h *Handler) zoneResponse(query *dns.Message, addr net.Addr) []byte {
+	q := query.Question[0]
+	zone := h.zone.Load()
+	apex := q.Name.Equal(h.domain)
+
+	answer, exists := zone.lookup(q.Name, q.Type)
+	if !exists && !apex && !h.isInstanceApex(q.Name) {
+		return h.limitedErrorResponse(query, addr, dns.RcodeNameError)
+	}
+
+	var resp *dns.Message
+	switch {
+	case len(answer) > 0:
+		resp = dns.CreateErrorResponse(query, h.domain, dns.RcodeNoError, uint16(h.config.MaxUDPSize))
+		for _, rr := range answer {
+			rr.Name = q.Name
+			resp.Answer = append(resp.Answer, rr)
+		}
+		resp.Additional = append(zone.glue(answer), resp.Additional...)
+	case apex && q.Type == dns.RRTypeSOA:
+		resp = dns.CreateNegativeResponse(query, h.domain, dns.RcodeNoError, h.soa(), uint16(h.config.MaxUDPSize))
+		resp.Answer, resp.Authority = resp.Authority, nil
+		resp.Answer[0].Name = q.Name
+	default:
+		resp = dns.CreateNegativeResponse(query, h.domain, dns.RcodeNoError, h.soa(), uint16(h.config.MaxUDPSize))
+	}
+
+	data, err := resp.Marshal()
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt response: %w", err)
+		return nil
 	}
+	return data
+}
 
-	// Create the tunnel response
-	ttl := varyTTL(h.config.ResponseTTL)
-	response, err := dns.CreateTunnelResponse(query, h.domain, encryptedResponse, ttl)
+// referralResponse returns a referral for a query in a subdomain delegated
+// by the zone records, or nil if the query is for this server, including
+// its own instance subdomain.
+func (h *Handler) referralResponse(query *dns.Message) []byte {
+	zone := h.zone.Load()
+	cut, ns, ok := zone.delegation(h.domain, query.Question[0].Name)
+	if !ok || (h.instance != nil && cut.Equal(h.instance)) {
+		return nil
+	}
+
+	resp := dns.CreateErrorResponse(query, h.domain, dns.RcodeNoError, uint16(h.config.MaxUDPSize))
+	resp.Flags &^= 0x0400 // AA = 0, the subdomain's servers are authoritative
+	for _, rr := range ns {
+		rr.Name = cut
+		resp.Authority = append(resp.Authority, rr)
+	}
+	resp.Additional = append(zone.glue(ns), resp.Additional...)
+
+	data, err := resp.Marshal()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create tunnel response: %w", err)
+		return nil
 	}
+	return data
+}
 
-	return response, nil
+// soa returns the SOA record of the zone, the configured one if any. Its
+// minimum field is the negative caching TTL.
+func (h *Handler) soa() dns.SOA {
+	if soa := h.zone.Load().soa; soa != nil {
+		return *soa
+	}
+	return dns.SOA{
+		MName:   append(dns.Name{[]byte("ns1")}, h.domain...),
+		RName:   append(dns.Name{[]byte("hostmaster")}, h.domain...),
+		Serial:  h.soaSerial,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minimum: h.negativeTTL.Load(),
+	}
+}
+
+// inZone reports whether name is the domain or below it.
+func (h *Handler) inZone(name dns.Name) bool {
+	_, ok := name.TrimSuffix(h.domain)
+	return ok
 }
 
-// sendError sends a DNS error response.
-func (h *Handler) sendError(query *dns.Message, addr *net.UDPAddr, rcode uint16) {
+// soaSerial returns a date-based zone serial (YYYYMMDDnn) for t.
+func soaSerial(t time.Time) uint32 {
+	y, m, d := t.UTC().Date()
+	return uint32(y*1000000 + int(m)*10000 + d*100 + 1)
+}
+
+// errorResponse builds a DNS error response. NXDOMAIN answers for names in
+// the zone carry its SOA record.
+func (h *Handler) errorResponse(query *dns.Message, rcode uint16) []byte {
 	if query == nil {
-		return
+		return nil
+	}
+
+	var resp *dns.Message
+	if rcode == dns.RcodeNameError && len(query.Question) == 1 && h.inZone(query.Question[0].Name) {
+		resp = dns.CreateNegativeResponse(query, h.domain, rcode, h.soa(), uint16(h.config.MaxUDPSize))
+	} else {
+		resp = dns.CreateErrorResponse(query, h.domain, rcode, uint16(h.config.MaxUDPSize))
 	}
-	resp := dns.CreateErrorResponse(query, h.domain, rcode)
 
 	data, err := resp.Marshal()
 	if err != nil {
-		return
+		return nil
 	}
 
-	_, _ = h.conn.WriteToUDP(data, addr)
+	return data
 }
 
-// varyTTL adds randomness to TTL.
-func varyTTL(baseTTL uint32) uint32 {
-	var buf [1]byte
-	_, _ = crypto.GenerateKey() // Just to ensure random is initialized
-	buf[0] = byte(time.Now().UnixNano())
-
-	// Vary by ±30 seconds
-	variance := uint32(buf[0]) % 60
-	if buf[0]&1 == 0 && baseTTL > variance {
-		return baseTTL - variance/2
+// varyTTL adds up to ±30 seconds of randomness read from r to a TTL.
+func varyTTL(r io.Reader, baseTTL uint32) uint32 {
+	variance := uint32(clock.Uint64N(r, 60)) / 2
+	if clock.Uint64N(r, 2) == 0 && baseTTL > variance {
+		return baseTTL - variance
 	}
-	return baseTTL + variance/2
+	return baseTTL + variance
 }
 
-// varyResponseDelay adds random delay (10-100ms).
-func varyResponseDelay() time.Duration {
-	var buf [1]byte
-	buf[0] = byte(time.Now().UnixNano())
-	return 10*time.Millisecond + time.Duration(buf[0])*90*time.Millisecond/255
+// varyResponseDelay returns a random response delay of 10-100ms read from
+// r.
+func varyResponseDelay(r io.Reader) time.Duration {
+	return 10*time.Millisecond + clock.Duration(r, 90*time.Millisecond)
 }
@@ -0,0 +1,568 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/alert"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// newTestHandler creates a handler for t.example.com with an all-zero
+// shared secret, after configure, if not nil, adjusts its configuration.
+// The handler is stopped when the test ends.
+func newTestHandler(t *testing.T, configure func(*Config)) *Handler {
+	t.Helper()
+	config := DefaultConfig()
+	config.Domain = "t.example.com"
+	config.SharedSecret = make([]byte, crypto.KeySize)
+	if configure != nil {
+		configure(config)
+	}
+	h, err := NewHandler(config)
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	t.Cleanup(h.Stop)
+	return h
+}
+
+// TestEDNSCompatibility checks that EDNS in responses looks like that of
+// a standard authoritative server.
+func TestEDNSCompatibility(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) { c.RRLLimit = 0 })
+	config := h.config
+
+	opt := func(size uint16, ttl uint32, data []byte) dns.RR {
+		return dns.RR{Name: dns.Name{}, Type: dns.RRTypeOPT, Class: size, TTL: ttl, Data: data}
+	}
+
+	tests := []struct {
+		name       string
+		qname      string
+		additional []dns.RR
+		wantRcode  uint16
+		wantOPT    bool
+		wantTTL    uint32
+	}{
+		{
+			name:      "no EDNS",
+			qname:     "www.other.example",
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name:       "DO echoed, own size advertised",
+			qname:      "www.other.example",
+			additional: []dns.RR{opt(4096, 0x8000, nil)},
+			wantRcode:  dns.RcodeNameError,
+			wantOPT:    true,
+			wantTTL:    0x8000,
+		},
+		{
+			name:       "unknown options ignored",
+			qname:      "www.other.example",
+			additional: []dns.RR{opt(1232, 0, []byte{0xfd, 0xe9, 0, 2, 1, 2})},
+			wantRcode:  dns.RcodeNameError,
+			wantOPT:    true,
+		},
+		{
+			name:       "unsupported version",
+			qname:      "x.t.example.com",
+			additional: []dns.RR{opt(1232, 1<<16, nil)},
+			wantRcode:  dns.RcodeBadVersion,
+			wantOPT:    true,
+			wantTTL:    1 << 24,
+		},
+		{
+			name:       "two OPT records",
+			qname:      "x.t.example.com",
+			additional: []dns.RR{opt(1232, 0, nil), opt(1232, 0, nil)},
+			wantRcode:  dns.RcodeFormatError,
+		},
+	}
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.CreateQuery(mustParseName(t, tt.qname), dns.RRTypeTXT, 0x1234)
+			query.Additional = tt.additional
+			data, err := query.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			resp, err := dns.ParseMessage(h.handleQuery(data, udp, config.MaxUDPSize))
+			if err != nil {
+				t.Fatalf("ParseMessage() error = %v", err)
+			}
+			if resp.Rcode() != tt.wantRcode&0xf {
+				t.Errorf("Rcode: got %d, want %d", resp.Rcode(), tt.wantRcode&0xf)
+			}
+
+			opt, err := resp.OPT()
+			if err != nil {
+				t.Fatalf("OPT() error = %v", err)
+			}
+			if (opt != nil) != tt.wantOPT {
+				t.Fatalf("OPT present: got %v, want %v", opt != nil, tt.wantOPT)
+			}
+			if opt == nil {
+				return
+			}
+			if int(opt.Class) != config.MaxUDPSize {
+				t.Errorf("UDP size: got %d, want %d", opt.Class, config.MaxUDPSize)
+			}
+			if opt.TTL != tt.wantTTL {
+				t.Errorf("OPT TTL: got %#x, want %#x", opt.TTL, tt.wantTTL)
+			}
+			if len(opt.Data) != 0 {
+				t.Errorf("Options echoed: %x", opt.Data)
+			}
+		})
+	}
+}
+
+// TestNegativeResponses checks that queries in the zone that aren't tunnel
+// traffic are answered with the zone's SOA record.
+func TestNegativeResponses(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.NegativeTTL = 900
+		c.RRLLimit = 0
+		c.ChallengeThreshold = 0
+	})
+	config := h.config
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		wantRcode     uint16
+		wantAnswer    bool
+		wantAuthority bool
+	}{
+		{"garbage label", "www.t.example.com", dns.RRTypeA, dns.RcodeNameError, false, true},
+		{"unsupported type", "aaaaaaaaaaaaaaaaaaaaaaaaaa.t.example.com", dns.RRTypeMX, dns.RcodeNameError, false, true},
+		{"apex SOA", "t.example.com", dns.RRTypeSOA, dns.RcodeNoError, true, false},
+		{"apex NODATA", "t.example.com", dns.RRTypeA, dns.RcodeNoError, false, true},
+		{"outside zone", "www.other.example", dns.RRTypeA, dns.RcodeNameError, false, false},
+	}
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.CreateQuery(mustParseName(t, tt.qname), tt.qtype, 0x1234)
+			query.AddEDNS0(1232)
+			data, err := query.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			resp, err := dns.ParseMessage(h.handleQuery(data, udp, config.MaxUDPSize))
+			if err != nil {
+				t.Fatalf("ParseMessage() error = %v", err)
+			}
+			if resp.Rcode() != tt.wantRcode {
+				t.Errorf("Rcode: got %d, want %d", resp.Rcode(), tt.wantRcode)
+			}
+			if (len(resp.Answer) == 1) != tt.wantAnswer || (len(resp.Authority) == 1) != tt.wantAuthority {
+				t.Fatalf("Sections: got %d answers, %d authority records", len(resp.Answer), len(resp.Authority))
+			}
+
+			for _, rr := range append(resp.Answer, resp.Authority...) {
+				soa, err := dns.DecodeSOAData(rr.Data)
+				if rr.Type != dns.RRTypeSOA || err != nil {
+					t.Fatalf("Record: got type %d, %v", rr.Type, err)
+				}
+				if rr.TTL != 900 || soa.Minimum != 900 {
+					t.Errorf("TTL: got %d, minimum %d, want 900", rr.TTL, soa.Minimum)
+				}
+				if got := soa.MName.String(); got != "ns1.t.example.com" {
+					t.Errorf("MName: got %s", got)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelCompression(t *testing.T) {
+	// Upstream answering with a large, repetitive RRset
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := dns.CreateResponse(query)
+			for i := range 40 {
+				resp.Answer = append(resp.Answer, dns.RR{Name: query.Question[0].Name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 300, Data: []byte{192, 0, 2, byte(i)}})
+			}
+			data, _ := resp.Marshal()
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+
+	h := newTestHandler(t, func(c *Config) { c.UpstreamResolver = conn.LocalAddr().String() })
+	config := h.config
+
+	clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+	inner, _ := dns.CreateQuery(mustParseName(t, strings.Repeat("a", 60)+".example.com"), dns.RRTypeA, 1).Marshal()
+	id := uint16(0)
+	send := func(flags byte, message []byte) (*dns.Fragment, []byte) {
+		t.Helper()
+		id++
+		encrypted, _ := clientCipher.Encrypt(message)
+		f := &dns.Fragment{Flags: flags, ID: id, Total: 1, Data: encrypted}
+		name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+		if err != nil {
+			t.Fatalf("EncodePayload() error = %v", err)
+		}
+		resp, err := h.processTunnelQuery(context.Background(), dns.CreateQuery(name, dns.RRTypeTXT, 2))
+		if err != nil {
+			t.Fatalf("processTunnelQuery() error = %v", err)
+		}
+		payload, err := dns.ExtractResponsePayload(resp, h.domain)
+		if err != nil {
+			t.Fatalf("ExtractResponsePayload() error = %v", err)
+		}
+		reply, err := dns.ParseFragment(payload)
+		if err != nil {
+			t.Fatalf("ParseFragment() error = %v", err)
+		}
+		plaintext, err := clientCipher.DecryptWithoutTimestamp(reply.Data)
+		if err != nil {
+			t.Fatalf("DecryptWithoutTimestamp() error = %v", err)
+		}
+		return reply, plaintext
+	}
+
+	// Clients that don't ask for compression get plain replies
+	if reply, plaintext := send(0, inner); reply.IsCompressed() || len(plaintext) < 40*16 {
+		t.Errorf("Without FragmentFlagCompress: compressed %v, %d bytes", reply.IsCompressed(), len(plaintext))
+	}
+
+	// A compressed query gets a compressed reply
+	compressed, ok := dns.Compress(inner)
+	if !ok {
+		t.Fatal("Query not compressed")
+	}
+	reply, plaintext := send(dns.FragmentFlagCompress|dns.FragmentFlagCompressed, compressed)
+	if !reply.IsCompressed() {
+		t.Fatal("Reply not compressed")
+	}
+	decompressed, err := dns.Decompress(plaintext)
+	if err != nil {
+		t.Fatalf("Decompress() error = %v", err)
+	}
+	if msg, err := dns.ParseMessage(decompressed); err != nil || len(msg.Answer) != 40 {
+		t.Fatalf("Decompressed reply: %d answers, error %v", len(msg.Answer), err)
+	}
+	if len(plaintext) >= len(decompressed)/2 {
+		t.Errorf("Reply compressed to %d of %d bytes", len(plaintext), len(decompressed))
+	}
+
+	// Servers with compression off reply plainly
+	reloaded := *config
+	reloaded.Compression = false
+	if err := h.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if reply, _ := send(dns.FragmentFlagCompress, inner); reply.IsCompressed() {
+		t.Error("Reply compressed with compression off")
+	}
+}
+
+func TestTunnelQueryTooLarge(t *testing.T) {
+	// Upstream answering with more than the response fragments can carry
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := dns.CreateResponse(query)
+			resp.AddEDNS0(4096)
+			for range 15 {
+				resp.Answer = append(resp.Answer, dns.RR{Name: query.Question[0].Name, Type: dns.RRTypeTXT, Class: dns.ClassIN, TTL: 300, Data: dns.EncodeTXTData(make([]byte, 200))})
+			}
+			data, _ := resp.Marshal()
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+
+	h := newTestHandler(t, func(c *Config) {
+		c.UpstreamResolver = conn.LocalAddr().String()
+		c.MaxUDPSize = 310 // 10 bytes per fragment
+	})
+	config := h.config
+
+	serverCipher, _ := crypto.NewCipher(config.SharedSecret, false)
+	clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+	query := dns.CreateQuery(mustParseName(t, "big.example.com"), dns.RRTypeTXT, 1)
+	query.AddEDNS0(4096)
+	fragments, err := h.resolveOriginalQuery(context.Background(), h.resolver.Load(), serverCipher, dns.NewClientID(), 0, query, 1)
+	if err != nil {
+		t.Fatalf("resolveOriginalQuery() error = %v", err)
+	}
+
+	var encrypted []byte
+	for _, f := range fragments {
+		encrypted = append(encrypted, f.Data...)
+	}
+	plaintext, err := clientCipher.DecryptWithoutTimestamp(encrypted)
+	if err != nil {
+		t.Fatalf("DecryptWithoutTimestamp() error = %v", err)
+	}
+	resp, err := dns.ParseMessage(plaintext)
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+
+	// The stub gets a well-formed truncated answer to retry elsewhere
+	if resp.Flags&0x0200 == 0 || len(resp.Answer) != 0 || resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("Response: TC %v, %d answers, rcode %d, want truncated", resp.Flags&0x0200 != 0, len(resp.Answer), resp.Rcode())
+	}
+	if opt, _ := resp.OPT(); opt == nil {
+		t.Error("OPT record dropped")
+	}
+	if len(resp.Question) != 1 || !resp.Question[0].Name.Equal(query.Question[0].Name) {
+		t.Errorf("Question = %v, want the query's", resp.Question)
+	}
+}
+
+func TestAcceptNoEDNS(t *testing.T) {
+	// Upstream answering with more than fits 512 bytes
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := dns.CreateResponse(query)
+			for i := range 40 {
+				resp.Answer = append(resp.Answer, dns.RR{Name: query.Question[0].Name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 300, Data: []byte{192, 0, 2, byte(i)}})
+			}
+			data, _ := resp.Marshal()
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+
+	h := newTestHandler(t, func(c *Config) {
+		c.UpstreamResolver = conn.LocalAddr().String()
+		c.RRLLimit = 0
+		c.RRLAmplification = 0
+		c.ChallengeThreshold = 0
+	})
+	config := h.config
+
+	clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+	inner, _ := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 1).Marshal()
+	id := uint16(0)
+	send := func(addr net.Addr) (*dns.Message, []byte) {
+		t.Helper()
+		id++
+		encrypted, _ := clientCipher.Encrypt(inner)
+		f := &dns.Fragment{ID: id, Total: 1, Data: encrypted}
+		name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+		if err != nil {
+			t.Fatalf("EncodePayload() error = %v", err)
+		}
+		data, _ := dns.CreateQuery(name, dns.RRTypeTXT, 2).Marshal() // no OPT
+		raw := h.handleQuery(data, addr, tcpMaxMessageSize)
+		resp, err := dns.ParseMessage(raw)
+		if err != nil {
+			t.Fatalf("ParseMessage() error = %v", err)
+		}
+		return resp, raw
+	}
+	fragment := func(resp *dns.Message) *dns.Fragment {
+		t.Helper()
+		payload, err := dns.ExtractResponsePayload(resp, h.domain)
+		if err != nil {
+			t.Fatalf("ExtractResponsePayload() error = %v", err)
+		}
+		f, err := dns.ParseFragment(payload)
+		if err != nil {
+			t.Fatalf("ParseFragment() error = %v", err)
+		}
+		return f
+	}
+
+	// Without the compatibility mode, queries without EDNS are answered
+	// from the zone only
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	if resp, _ := send(udp); resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("Without AcceptNoEDNS: rcode %d, want NXDOMAIN", resp.Rcode())
+	}
+
+	reloaded := *config
+	reloaded.AcceptNoEDNS = true
+	if err := h.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	// Over UDP the reply is fragmented to fit 512 bytes instead of
+	// truncated
+	resp, raw := send(udp)
+	if len(raw) > dns.EDNSMinUDPSize || resp.Flags&0x0200 != 0 {
+		t.Fatalf("UDP reply: %d bytes, TC %v", len(raw), resp.Flags&0x0200 != 0)
+	}
+	if f := fragment(resp); f.Total < 2 {
+		t.Errorf("UDP reply in %d fragments, want several", f.Total)
+	}
+
+	// Over TCP the reply isn't limited
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	resp, raw = send(tcp)
+	if f := fragment(resp); f.Total != 1 || len(raw) <= dns.EDNSMinUDPSize {
+		t.Errorf("TCP reply: %d bytes in %d fragments, want one larger fragment", len(raw), f.Total)
+	}
+}
+
+func TestTunnelQueryTraceID(t *testing.T) {
+	// An upstream that refuses connections
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	conn.Close()
+
+	h := newTestHandler(t, func(c *Config) { c.UpstreamResolver = conn.LocalAddr().String() })
+	config := h.config
+
+	// Errors name the trace ID the client sent
+	trace := dns.NewTraceID()
+	inner := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1)
+	inner.AddEDNS0(1232)
+	data, _ := inner.WithTraceID(trace).Marshal()
+	clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+	encrypted, _ := clientCipher.Encrypt(data)
+	f := &dns.Fragment{ID: 1, Total: 1, Data: encrypted}
+	name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+	if err != nil {
+		t.Fatalf("EncodePayload() error = %v", err)
+	}
+	_, err = h.processTunnelQuery(context.Background(), dns.CreateQuery(name, dns.RRTypeTXT, 2))
+	if err == nil || !strings.Contains(err.Error(), trace.String()) {
+		t.Errorf("processTunnelQuery() error = %v, want one naming trace %s", err, trace)
+	}
+}
+
+func TestTunnelQueryAlerts(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var a alert.Alert
+		if err := json.NewDecoder(req.Body).Decode(&a); err == nil {
+			mu.Lock()
+			events = append(events, a.Event)
+			mu.Unlock()
+		}
+	}))
+	defer webhook.Close()
+
+	// An upstream that refuses connections
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	conn.Close()
+
+	h := newTestHandler(t, func(c *Config) {
+		c.AlertWebhook = webhook.URL
+		c.UpstreamResolver = conn.LocalAddr().String()
+	})
+	config := h.config
+
+	send := func(secret []byte) {
+		inner := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1)
+		data, _ := inner.Marshal()
+		clientCipher, _ := crypto.NewCipher(secret, true)
+		encrypted, _ := clientCipher.Encrypt(data)
+		f := &dns.Fragment{ID: 1, Total: 1, Data: encrypted}
+		name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+		if err != nil {
+			t.Fatalf("EncodePayload() error = %v", err)
+		}
+		if _, err := h.processTunnelQuery(context.Background(), dns.CreateQuery(name, dns.RRTypeTXT, 2)); err == nil {
+			t.Error("processTunnelQuery() succeeded")
+		}
+	}
+	send(bytes.Repeat([]byte{1}, 32)) // another key
+	send(config.SharedSecret)
+	h.alerts.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(events)
+	if want := []string{alert.EventKeyMismatch, alert.EventUpstreamOutage}; !slices.Equal(events, want) {
+		t.Errorf("Alerts: got %v, want %v", events, want)
+	}
+}
+
+// TestResponseJitter checks that TTL and delay jitter stay in range and
+// come only from the random source.
+func TestResponseJitter(t *testing.T) {
+	a, b := clock.NewSeeded(1), clock.NewSeeded(1)
+	for range 100 {
+		ttl := varyTTL(a, 300)
+		if ttl < 270 || ttl > 330 {
+			t.Fatalf("varyTTL(300) = %d, want within ±30", ttl)
+		}
+		if other := varyTTL(b, 300); other != ttl {
+			t.Fatalf("Same seed varied TTL to %d and %d", ttl, other)
+		}
+		if got := varyTTL(a, 10); got == 0 || got > 40 {
+			t.Fatalf("varyTTL(10) = %d, want 1-40", got)
+		}
+		varyTTL(b, 10)
+
+		delay := varyResponseDelay(a)
+		if delay < 10*time.Millisecond || delay >= 100*time.Millisecond {
+			t.Fatalf("varyResponseDelay() = %v, want 10-100ms", delay)
+		}
+		if other := varyResponseDelay(b); other != delay {
+			t.Fatalf("Same seed delayed %v and %v", delay, other)
+		}
+	}
+}
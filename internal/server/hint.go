@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var (
+	ErrUnknownUpstream    = errors.New("unknown upstream")
+	ErrUpstreamNotAllowed = errors.New("upstream not allowed for this key")
+)
+
+// ParseNamedUpstreams parses a comma-separated list of named upstreams,
+// each name=upstream with the upstream in the ParseUpstreamConfig format
+// (e.g. eu=https://dns.example.eu/dns-query,us=9.9.9.9:53).
+func ParseNamedUpstreams(s string) (map[string]string, error) {
+	named := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, upstream, ok := strings.Cut(item, "=")
+		if !ok || upstream == "" {
+			return nil, fmt.Errorf("invalid named upstream %q, want name=upstream", item)
+		}
+		if err := dns.CheckUpstreamName(name); err != nil {
+			return nil, err
+		}
+		if _, ok := named[name]; ok {
+			return nil, fmt.Errorf("upstream %s named twice", name)
+		}
+		if _, _, err := ParseUpstreamConfig(upstream); err != nil {
+			return nil, fmt.Errorf("invalid upstream %s: %w", name, err)
+		}
+		named[name] = upstream
+	}
+	if len(named) == 0 {
+		return nil, nil
+	}
+	return named, nil
+}
+
+// upstreamNames returns the names of the named upstreams, sorted.
+func upstreamNames(named map[string]string) []string {
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// upstreamFor returns the chain to resolve a tunneled query with: the
+// named upstream the query asks for, or if it asks for none, the upstream
+// routed the query name or else the upstream and its fallbacks. Queries
+// asking for an unknown upstream, or one the policy of the client's key
+// doesn't allow, are refused with an error rather than resolved elsewhere,
+// since the client may have asked to keep the query away from the other
+// upstreams.
+func (h *Handler) upstreamFor(keyring *crypto.Keyring, query *dns.Message) (*upstreamChain, error) {
+	chain := h.resolver.Load()
+	name, ok := query.UpstreamHint()
+	if !ok {
+		if len(query.Question) == 1 {
+			return chain.route(query.Question[0].Name), nil
+		}
+		return chain, nil
+	}
+
+	named, ok := chain.named[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownUpstream, name)
+	}
+	if !keyring.AllowsUpstream(name) {
+		return nil, fmt.Errorf("%w: %s", ErrUpstreamNotAllowed, name)
+	}
+	return named, nil
+}
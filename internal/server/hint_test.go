@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestParseNamedUpstreams(t *testing.T) {
+	named, err := ParseNamedUpstreams(" eu=https://dns.example.eu/dns-query?x=1, us=9.9.9.9:53,")
+	if err != nil {
+		t.Fatalf("ParseNamedUpstreams() error = %v", err)
+	}
+	want := map[string]string{"eu": "https://dns.example.eu/dns-query?x=1", "us": "9.9.9.9:53"}
+	if !maps.Equal(named, want) {
+		t.Errorf("ParseNamedUpstreams() = %v, want %v", named, want)
+	}
+
+	if named, err := ParseNamedUpstreams(""); err != nil || named != nil {
+		t.Errorf("ParseNamedUpstreams(\"\") = %v, %v, want nil", named, err)
+	}
+	for _, s := range []string{"eu", "eu=", "EU=9.9.9.9:53", "eu=9.9.9.9:53,eu=1.1.1.1:53"} {
+		if _, err := ParseNamedUpstreams(s); err == nil {
+			t.Errorf("ParseNamedUpstreams(%q) accepted invalid upstreams", s)
+		}
+	}
+}
+
+func TestUpstreamFor(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.NamedUpstreams = map[string]string{"eu": "9.9.9.9:53", "us": "1.1.1.1:53"}
+	})
+	config := h.config
+
+	shared, _ := crypto.NewKeyring([][]byte{config.SharedSecret}, false)
+	euOnly, _ := crypto.NewClientKeyring([]crypto.ClientKey{{
+		Secret: make([]byte, 32),
+		Policy: crypto.KeyPolicy{Upstreams: []string{"eu"}},
+	}}, false)
+
+	query := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 1)
+	if chain, err := h.upstreamFor(shared, query); err != nil || chain != h.resolver.Load() {
+		t.Errorf("upstreamFor() without a hint = %v, %v, want the default chain", chain, err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring *crypto.Keyring
+		hint    string
+		want    string
+		wantErr error
+	}{
+		{"shared key", shared, "us", "1.1.1.1:53", nil},
+		{"allowed", euOnly, "eu", "9.9.9.9:53", nil},
+		{"not allowed", euOnly, "us", "", ErrUpstreamNotAllowed},
+		{"unknown", shared, "asia", "", ErrUnknownUpstream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := h.upstreamFor(tt.keyring, query.WithUpstreamHint(tt.hint))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("upstreamFor() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("upstreamFor() error = %v", err)
+			}
+			if got := chain.resolvers[0].upstream; got != tt.want {
+				t.Errorf("upstreamFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// DefaultRootHints are the IPv4 addresses of the root name servers, where
+// the iterative upstream starts resolution.
+var DefaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	// maxIterations is the number of queries one lookup may send
+	maxIterations = 32
+
+	// maxCNAMEChain is the number of CNAMEs followed for a query
+	maxCNAMEChain = 8
+
+	// maxNSDepth limits nested lookups of name server addresses
+	maxNSDepth = 3
+
+	// iterativeQueryTimeout is how long each name server is given to answer
+	iterativeQueryTimeout = 2 * time.Second
+
+	// maxDelegations is the number of zone cuts the iterator remembers
+	maxDelegations = 4096
+
+	// maxDelegationTTL caps how long a zone cut is remembered
+	maxDelegationTTL = 24 * time.Hour
+)
+
+var (
+	ErrLookupLimit     = errors.New("iterative lookup limit exceeded")
+	ErrNoNameServers   = errors.New("no usable name servers")
+	ErrLameDelegation  = errors.New("name server answered outside its zone")
+	ErrCNAMEChainLimit = errors.New("CNAME chain too long")
+)
+
+// iterator resolves queries itself, starting at the root servers and
+// following referrals, instead of asking a recursive upstream.
+type iterator struct {
+	roots []string
+
+	// port is the name server port, changed only by tests
+	port string
+
+	// minimize asks each zone only for the labels it needs (RFC 9156)
+	minimize bool
+
+	// randomizeCase sends query names in random case (DNS 0x20)
+	randomizeCase bool
+
+	delegations *delegationCache
+}
+
+// newIterator creates an iterator starting at the given root servers.
+func newIterator(roots []string) *iterator {
+	return &iterator{roots: roots, port: "53", minimize: true, delegations: newDelegationCache()}
+}
+
+// resolve answers the query by iterating from the root, following CNAMEs,
+// and returns the response as a recursive resolver would.
+func (it *iterator) resolve(ctx context.Context, query *dns.Message) (*dns.Message, error) {
+	if len(query.Question) != 1 {
+		return nil, dns.ErrInvalidQuery
+	}
+	q := query.Question[0]
+
+	var answers []dns.RR
+	name := q.Name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		resp, err := it.lookup(ctx, name, q.Type, 0)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, resp.Answer...)
+
+		target, ok := chaseTarget(resp, name, q.Type)
+		if !ok {
+			msg := dns.CreateResponse(query)
+			msg.Flags |= 0x0080 // RA = 1
+			msg.SetRcode(resp.Rcode())
+			msg.Answer = answers
+			msg.Authority = resp.Authority
+			if opt, err := query.OPT(); err == nil && opt != nil {
+				msg.SetEDNS0(dns.MaxEDNSSize, query.DO())
+			}
+			return msg, nil
+		}
+		name = target
+	}
+	return nil, ErrCNAMEChainLimit
+}
+
+// chaseTarget returns the name to look up next if the response ends in a
+// CNAME without data of type qtype.
+func chaseTarget(resp *dns.Message, name dns.Name, qtype uint16) (dns.Name, bool) {
+	if resp.Rcode() != dns.RcodeNoError || qtype == dns.RRTypeCNAME {
+		return nil, false
+	}
+	chased := false
+	for i := 0; i < maxCNAMEChain; i++ {
+		var next dns.Name
+		for _, rr := range resp.Answer {
+			if !rr.Name.Equal(name) {
+				continue
+			}
+			if rr.Type == qtype {
+				return nil, false
+			}
+			if rr.Type == dns.RRTypeCNAME {
+				next, _ = dns.DecodeNameData(rr.Data)
+			}
+		}
+		if next == nil {
+			return name, chased
+		}
+		name, chased = next, true
+	}
+	return nil, false
+}
+
+// lookup finds the authoritative response for name and qtype, descending
+// from the closest remembered zone cut, or the root, through referrals.
+// With minimization, zones are asked about one more label than their own
+// until the full name is reached.
+func (it *iterator) lookup(ctx context.Context, name dns.Name, qtype uint16, depth int) (*dns.Message, error) {
+	zone, servers := it.delegations.closest(name)
+	cached := servers != nil
+	if !cached {
+		zone, servers = dns.Name{}, it.roots
+	}
+	labels := 1 // labels of name to send to the current zone
+
+	for i := 0; i < maxIterations; i++ {
+		qname, qt := name, qtype
+		minimized := it.minimize && len(zone)+labels < len(name)
+		if minimized {
+			qname, qt = name[len(name)-len(zone)-labels:], dns.RRTypeA
+		}
+
+		resp, err := it.query(ctx, servers, qname, qt)
+		if err != nil && cached && ctx.Err() == nil {
+			// The remembered servers may have moved; start over at the root
+			it.delegations.forget(zone)
+			zone, servers, labels, cached = dns.Name{}, it.roots, 1, false
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if cut, ok := referral(resp, zone, qname); ok {
+			addrs, ttl, err := it.nameServers(ctx, resp, zone, cut, depth)
+			if err != nil {
+				return nil, err
+			}
+			it.delegations.put(cut, addrs, ttl)
+			zone, servers, labels, cached = cut, addrs, 1, false
+			continue
+		}
+
+		if !minimized {
+			if resp.Flags&0x0400 == 0 && len(resp.Answer) == 0 && resp.Rcode() == dns.RcodeNoError {
+				return nil, ErrLameDelegation
+			}
+			return resp, nil
+		}
+
+		if resp.Rcode() == dns.RcodeNoError {
+			// The name exists without a zone cut; ask for one more label
+			labels++
+		} else {
+			// NXDOMAIN or errors for a minimized name: some servers answer
+			// empty non-terminals wrongly, so ask for the full name
+			labels = len(name) - len(zone)
+		}
+	}
+	return nil, ErrLookupLimit
+}
+
+// referral returns the zone cut a response delegates to: NS records in
+// the authority section of a non-authoritative answer for a zone below the
+// current one that contains qname.
+func referral(resp *dns.Message, zone, qname dns.Name) (dns.Name, bool) {
+	if resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 || resp.Flags&0x0400 != 0 {
+		return nil, false
+	}
+	for _, rr := range resp.Authority {
+		if rr.Type != dns.RRTypeNS || len(rr.Name) <= len(zone) {
+			continue
+		}
+		if _, ok := rr.Name.TrimSuffix(zone); !ok {
+			continue
+		}
+		if _, ok := qname.TrimSuffix(rr.Name); ok {
+			return rr.Name, true
+		}
+	}
+	return nil, false
+}
+
+// nameServers returns the IPv4 and IPv6 addresses of the name servers a
+// referral delegates to cut, and the TTL of the shortest lived record
+// they came from. Glue is only trusted within the referring zone; servers
+// without glue are looked up.
+func (it *iterator) nameServers(ctx context.Context, resp *dns.Message, zone, cut dns.Name, depth int) ([]string, uint32, error) {
+	ttl := uint32(maxDelegationTTL / time.Second)
+	var targets []dns.Name
+	for _, rr := range resp.Authority {
+		if rr.Type != dns.RRTypeNS || !rr.Name.Equal(cut) {
+			continue
+		}
+		if target, err := dns.DecodeNameData(rr.Data); err == nil {
+			targets = append(targets, target)
+			ttl = min(ttl, rr.TTL)
+		}
+	}
+
+	var glue []dns.RR
+	for _, rr := range resp.Additional {
+		if _, ok := rr.Name.TrimSuffix(zone); !ok {
+			continue
+		}
+		for _, target := range targets {
+			if rr.Name.Equal(target) {
+				glue = append(glue, rr)
+			}
+		}
+	}
+	if addrs, glueTTL := addressRecords(glue); len(addrs) > 0 {
+		return addrs, min(ttl, glueTTL), nil
+	}
+
+	if depth >= maxNSDepth {
+		return nil, 0, ErrNoNameServers
+	}
+	for _, target := range targets {
+		for _, qtype := range []uint16{dns.RRTypeA, dns.RRTypeAAAA} {
+			ns, err := it.lookup(ctx, target, qtype, depth+1)
+			if err != nil {
+				continue
+			}
+			if addrs, nsTTL := addressRecords(ns.Answer); len(addrs) > 0 {
+				return addrs, min(ttl, nsTTL), nil
+			}
+		}
+	}
+	return nil, 0, ErrNoNameServers
+}
+
+// addressRecords returns the addresses in the A and AAAA records of rrs
+// and the lowest TTL among them.
+func addressRecords(rrs []dns.RR) ([]string, uint32) {
+	var addrs []string
+	ttl := uint32(maxDelegationTTL / time.Second)
+	for _, rr := range rrs {
+		if rr.Type != dns.RRTypeA && rr.Type != dns.RRTypeAAAA {
+			continue
+		}
+		if addr, err := dns.DecodeAddrData(rr.Data); err == nil {
+			addrs = append(addrs, addr.String())
+			ttl = min(ttl, rr.TTL)
+		}
+	}
+	return addrs, ttl
+}
+
+// delegation is a remembered zone cut.
+type delegation struct {
+	zone    dns.Name
+	servers []string
+	expires time.Time
+}
+
+// delegationCache remembers the name server addresses of zone cuts for
+// the TTL of their NS and address records, so lookups start at the
+// closest known zone instead of the root. It holds at most
+// maxDelegations cuts.
+type delegationCache struct {
+	cuts  map[string]*delegation
+	clock clock.Clock
+	mu    sync.Mutex
+}
+
+// newDelegationCache creates an empty delegation cache.
+func newDelegationCache() *delegationCache {
+	return &delegationCache{cuts: make(map[string]*delegation), clock: clock.System}
+}
+
+// delegationKey returns the cache key of zone, which ignores case.
+func delegationKey(zone dns.Name) string {
+	return strings.ToLower(zone.String())
+}
+
+// closest returns the longest zone cut remembered for name and the
+// addresses of its servers, or nil servers if there is none.
+func (c *delegationCache) closest(name dns.Name) (dns.Name, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	for i := range name {
+		d, ok := c.cuts[delegationKey(name[i:])]
+		if !ok {
+			continue
+		}
+		if now.Before(d.expires) {
+			return d.zone, d.servers
+		}
+		delete(c.cuts, delegationKey(d.zone))
+	}
+	return nil, nil
+}
+
+// put remembers the servers of the zone cut for ttl seconds. When the
+// cache is full, expired cuts are dropped, or else a random one.
+func (c *delegationCache) put(zone dns.Name, servers []string, ttl uint32) {
+	if ttl == 0 || len(zone) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	key := delegationKey(zone)
+	if _, ok := c.cuts[key]; !ok && len(c.cuts) >= maxDelegations {
+		for k, d := range c.cuts {
+			if !now.Before(d.expires) {
+				delete(c.cuts, k)
+			}
+		}
+		for k := range c.cuts {
+			if len(c.cuts) < maxDelegations {
+				break
+			}
+			delete(c.cuts, k)
+		}
+	}
+	c.cuts[key] = &delegation{zone: zone, servers: servers, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// forget drops the zone cut.
+func (c *delegationCache) forget(zone dns.Name) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cuts, delegationKey(zone))
+}
+
+// query asks the servers in random order for name and qtype until one
+// answers.
+func (it *iterator) query(ctx context.Context, servers []string, name dns.Name, qtype uint16) (*dns.Message, error) {
+	msg := dns.CreateQuery(name, qtype, dns.GenerateQueryID())
+	msg.Flags = 0 // RD = 0
+	msg.SetEDNS0(dns.MaxEDNSSize, false)
+	data, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := ErrNoNameServers
+	start := randIntn(len(servers))
+	for i := range servers {
+		addr := net.JoinHostPort(servers[(start+i)%len(servers)], it.port)
+		resp, err := it.exchange(ctx, addr, data)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// exchange sends a query to one name server, over TCP if the UDP answer
+// is truncated.
+func (it *iterator) exchange(ctx context.Context, addr string, query []byte) (*dns.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, iterativeQueryTimeout)
+	defer cancel()
+
+	send := query
+	if it.randomizeCase {
+		send = randomizeCase(query)
+	}
+
+	data, err := exchangeUDPOrTCP(ctx, addr, send, it.randomizeCase, iterativeQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	restoreCase(data, query)
+
+	return dns.ParseMessage(data)
+}
+
+// exchangeTCP sends a wire format query to addr over TCP.
+func exchangeTCP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("failed to read response length: %w", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if !matchesQuery(query, resp, true) {
+		return nil, fmt.Errorf("response does not match query")
+	}
+	return resp, nil
+}
+
+// randIntn returns a random number in [0, n).
+func randIntn(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return int(binary.BigEndian.Uint64(b[:]) % uint64(n))
+}
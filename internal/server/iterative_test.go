@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// authServer is a mock name server that records the names it is asked.
+type authServer struct {
+	mu     sync.Mutex
+	names  []string
+	answer func(query *dns.Message) *dns.Message
+}
+
+func (s *authServer) seen() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.names...)
+}
+
+// startAuthServers starts mock name servers on loopback addresses sharing
+// one port, which is returned.
+func startAuthServers(t *testing.T, servers map[string]*authServer) string {
+	t.Helper()
+
+	port := "0"
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "::1"} {
+		s, ok := servers[ip]
+		if !ok {
+			continue
+		}
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("ListenPacket(%s) error = %v", ip, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				query, err := dns.ParseMessage(buf[:n])
+				if err != nil || len(query.Question) != 1 {
+					continue
+				}
+				s.mu.Lock()
+				s.names = append(s.names, query.Question[0].Name.String())
+				s.mu.Unlock()
+
+				data, err := s.answer(query).Marshal()
+				if err != nil {
+					continue
+				}
+				_, _ = conn.WriteTo(data, addr)
+			}
+		}()
+	}
+	return port
+}
+
+// delegate returns a handler referring every query to the child zone, with
+// glue address addr for its name server.
+func delegate(t *testing.T, child, addr string) func(*dns.Message) *dns.Message {
+	childName := mustParseName(t, child)
+	nsName := mustParseName(t, "ns."+child)
+	glue := netip.MustParseAddr(addr)
+	glueType := dns.RRTypeA
+	if glue.Is6() {
+		glueType = dns.RRTypeAAAA
+	}
+	return func(query *dns.Message) *dns.Message {
+		resp := dns.CreateResponse(query)
+		resp.Flags &^= 0x0080 // RA = 0
+		resp.Authority = []dns.RR{{
+			Name: childName, Type: dns.RRTypeNS, Class: dns.ClassIN, TTL: 60,
+			Data: dns.EncodeNameData(nsName),
+		}}
+		resp.Additional = []dns.RR{{
+			Name: nsName, Type: glueType, Class: dns.ClassIN, TTL: 60,
+			Data: dns.EncodeAddrData(glue),
+		}}
+		return resp
+	}
+}
+
+func TestIterativeResolve(t *testing.T) {
+	www := mustParseName(t, "www.example.com")
+	alias := mustParseName(t, "alias.example.com")
+
+	root := &authServer{answer: delegate(t, "com", "127.0.0.2")}
+	com := &authServer{answer: delegate(t, "example.com", "127.0.0.3")}
+	example := &authServer{answer: func(query *dns.Message) *dns.Message {
+		resp := dns.CreateResponse(query)
+		resp.Flags = resp.Flags&^0x0080 | 0x0400 // RA = 0, AA = 1
+		q := query.Question[0]
+		switch {
+		case q.Name.Equal(www) && q.Type == dns.RRTypeA:
+			resp.Answer = []dns.RR{{
+				Name: q.Name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 60,
+				Data: dns.EncodeAddrData(netip.MustParseAddr("192.0.2.80")),
+			}}
+		case q.Name.Equal(alias):
+			resp.Answer = []dns.RR{{
+				Name: q.Name, Type: dns.RRTypeCNAME, Class: dns.ClassIN, TTL: 60,
+				Data: dns.EncodeNameData(www),
+			}}
+		case q.Name.Equal(www):
+		default:
+			resp.SetRcode(dns.RcodeNameError)
+		}
+		return resp
+	}}
+
+	port := startAuthServers(t, map[string]*authServer{
+		"127.0.0.1": root, "127.0.0.2": com, "127.0.0.3": example,
+	})
+
+	r, err := NewResolver("", string(ResolverTypeIterative))
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	r.SetRootHints([]string{"127.0.0.1"})
+	r.SetCaseRandomization(true)
+	r.iter.port = port
+
+	tests := []struct {
+		name      string
+		wantRcode uint16
+		wantTypes []uint16
+	}{
+		{"www.example.com", dns.RcodeNoError, []uint16{dns.RRTypeA}},
+		{"alias.example.com", dns.RcodeNoError, []uint16{dns.RRTypeCNAME, dns.RRTypeA}},
+		{"missing.example.com", dns.RcodeNameError, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.CreateQuery(mustParseName(t, tt.name), dns.RRTypeA, 4321)
+			resp, err := r.Resolve(context.Background(), query)
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if resp.ID != 4321 || resp.Flags&0x0080 == 0 {
+				t.Errorf("Header: got ID %d, flags %#04x", resp.ID, resp.Flags)
+			}
+			if resp.Rcode() != tt.wantRcode {
+				t.Errorf("Rcode: got %d, want %d", resp.Rcode(), tt.wantRcode)
+			}
+			if len(resp.Answer) != len(tt.wantTypes) {
+				t.Fatalf("Answers: got %d, want %d", len(resp.Answer), len(tt.wantTypes))
+			}
+			for i, rr := range resp.Answer {
+				if rr.Type != tt.wantTypes[i] {
+					t.Errorf("Answer %d: got type %d, want %d", i, rr.Type, tt.wantTypes[i])
+				}
+			}
+		})
+	}
+
+	// With minimization, parent zones never see the full query name
+	for _, name := range root.seen() {
+		if !strings.EqualFold(name, "com") {
+			t.Errorf("Root was asked for %s", name)
+		}
+	}
+	for _, name := range com.seen() {
+		if !strings.EqualFold(name, "example.com") {
+			t.Errorf("com was asked for %s", name)
+		}
+	}
+}
+
+func TestIterativeWithoutMinimization(t *testing.T) {
+	// Without minimization the root sees the full name and may refer
+	// straight to the zone that holds it
+	root := &authServer{answer: delegate(t, "example.com", "127.0.0.2")}
+	example := &authServer{answer: func(query *dns.Message) *dns.Message {
+		resp := dns.CreateResponse(query)
+		resp.Flags |= 0x0400 // AA = 1
+		resp.SetRcode(dns.RcodeNameError)
+		return resp
+	}}
+
+	port := startAuthServers(t, map[string]*authServer{"127.0.0.1": root, "127.0.0.2": example})
+
+	r, err := NewResolver("", string(ResolverTypeIterative))
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	r.SetRootHints([]string{"127.0.0.1"})
+	r.SetQNameMinimization(false)
+	r.iter.port = port
+
+	query := dns.CreateQuery(mustParseName(t, "a.b.example.com"), dns.RRTypeA, 1)
+	resp, err := r.Resolve(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("Rcode: got %d, want NXDOMAIN", resp.Rcode())
+	}
+	for _, name := range append(root.seen(), example.seen()...) {
+		if name != "a.b.example.com" {
+			t.Errorf("Asked for %s, want the full name", name)
+		}
+	}
+}
+
+// answerA returns a handler answering every A query with addr.
+func answerA(addr string) func(*dns.Message) *dns.Message {
+	return func(query *dns.Message) *dns.Message {
+		resp := dns.CreateResponse(query)
+		resp.Flags = resp.Flags&^0x0080 | 0x0400 // RA = 0, AA = 1
+		resp.Answer = []dns.RR{{
+			Name: query.Question[0].Name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 60,
+			Data: dns.EncodeAddrData(netip.MustParseAddr(addr)),
+		}}
+		return resp
+	}
+}
+
+func TestIterativeDelegationCache(t *testing.T) {
+	root := &authServer{answer: delegate(t, "com", "127.0.0.2")}
+	com := &authServer{answer: delegate(t, "example.com", "127.0.0.3")}
+	example := &authServer{answer: answerA("192.0.2.80")}
+	port := startAuthServers(t, map[string]*authServer{
+		"127.0.0.1": root, "127.0.0.2": com, "127.0.0.3": example,
+	})
+
+	r, err := NewResolver("", string(ResolverTypeIterative))
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	r.SetRootHints([]string{"127.0.0.1"})
+	r.iter.port = port
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	r.iter.delegations.clock = clk
+
+	resolve := func(name string) {
+		t.Helper()
+		resp, err := r.Resolve(context.Background(), dns.CreateQuery(mustParseName(t, name), dns.RRTypeA, 1))
+		if err != nil || len(resp.Answer) != 1 {
+			t.Fatalf("Resolve(%s): error %v, answer %v", name, err, resp)
+		}
+	}
+
+	resolve("www.example.com")
+	rootQueries, comQueries := len(root.seen()), len(com.seen())
+
+	// Names in a remembered zone go straight to its servers
+	resolve("mail.example.com")
+	resolve("www.Example.COM")
+	if len(root.seen()) != rootQueries || len(com.seen()) != comQueries {
+		t.Errorf("Cached delegation: root asked %d more times, com %d", len(root.seen())-rootQueries, len(com.seen())-comQueries)
+	}
+
+	// Cuts expire with the TTL of their records
+	clk.Advance(61 * time.Second)
+	resolve("www.example.com")
+	if len(root.seen()) == rootQueries {
+		t.Error("Expired delegation still used")
+	}
+
+	// Servers that stop answering are forgotten
+	r.iter.delegations.put(mustParseName(t, "example.com"), []string{"127.0.0.4"}, 300)
+	resolve("www.example.com")
+	if _, servers := r.iter.delegations.closest(mustParseName(t, "www.example.com")); len(servers) != 1 || servers[0] != "127.0.0.3" {
+		t.Errorf("Delegation after unreachable servers: %v", servers)
+	}
+}
+
+func TestIterativeIPv6Glue(t *testing.T) {
+	root := &authServer{answer: delegate(t, "example.com", "::1")}
+	example := &authServer{answer: answerA("192.0.2.80")}
+	port := startAuthServers(t, map[string]*authServer{"127.0.0.1": root, "::1": example})
+
+	r, err := NewResolver("", string(ResolverTypeIterative))
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	r.SetRootHints([]string{"127.0.0.1"})
+	r.SetQNameMinimization(false)
+	r.iter.port = port
+
+	resp, err := r.Resolve(context.Background(), dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 1))
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if len(resp.Answer) != 1 || len(example.seen()) != 1 {
+		t.Errorf("Got %d answers, IPv6 server asked %d times", len(resp.Answer), len(example.seen()))
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+var ErrUnknownKeyID = errors.New("unknown key ID")
+
+// keyStore holds the keyrings accepted by the server: the shared keyring
+// for key ID 0 and one keyring per client key ID.
+type keyStore struct {
+	shared  *crypto.Keyring
+	clients map[dns.KeyID]*crypto.Keyring
+}
+
+// newKeyStore creates the server keyrings from the shared, previous and
+// per-client keys, timed with clk.
+func newKeyStore(config *Config, clk clock.Clock) (*keyStore, error) {
+	secrets := append([][]byte{config.SharedSecret}, config.PreviousSecrets...)
+	shared, err := crypto.NewKeyring(secrets, false) // isClient=false
+	if err != nil {
+		return nil, err
+	}
+	shared.SetClock(clk)
+
+	k := &keyStore{shared: shared, clients: make(map[dns.KeyID]*crypto.Keyring)}
+	for id, keys := range config.ClientKeys {
+		if id == 0 {
+			return nil, fmt.Errorf("%w: 0 is reserved for the shared key", crypto.ErrInvalidKeyID)
+		}
+		keyring, err := crypto.NewClientKeyring(keys, false)
+		if err != nil {
+			return nil, fmt.Errorf("client key %d: %w", id, err)
+		}
+		keyring.SetClock(clk)
+		k.clients[dns.KeyID(id)] = keyring
+	}
+	return k, nil
+}
+
+// keyring returns the keyring for a key ID. Revoked or unknown IDs are
+// rejected before any reassembly or decryption work is done.
+func (k *keyStore) keyring(id dns.KeyID) (*crypto.Keyring, error) {
+	if id == 0 {
+		return k.shared, nil
+	}
+	keyring, ok := k.clients[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKeyID, id)
+	}
+	return keyring, nil
+}
+
+// Len returns the total number of accepted keys.
+func (k *keyStore) Len() int {
+	n := k.shared.Len()
+	for _, keyring := range k.clients {
+		n += keyring.Len()
+	}
+	return n
+}
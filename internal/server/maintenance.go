@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// ErrMaintenance is returned for handshakes and stream opens refused in
+// maintenance mode.
+var ErrMaintenance = errors.New("server is in maintenance mode")
+
+// SetMaintenance switches maintenance mode on or off. In maintenance mode
+// the server refuses new sessions and streams but keeps serving existing
+// ones, exchanges it already answered and the zone's own records, so it
+// can be taken down without cutting clients off mid-exchange.
+func (h *Handler) SetMaintenance(on bool) {
+	if h.maintenance.Swap(on) == on {
+		return
+	}
+	if on {
+		log.Println("Maintenance mode enabled, refusing new sessions and streams")
+	} else {
+		log.Println("Maintenance mode disabled")
+	}
+}
+
+// Maintenance reports whether maintenance mode is on.
+func (h *Handler) Maintenance() bool {
+	return h.maintenance.Load()
+}
+
+// maintenanceResponse builds the SERVFAIL answered to queries refused in
+// maintenance mode.
+func (h *Handler) maintenanceResponse(query *dns.Message) []byte {
+	return h.notReadyResponse(query, ErrMaintenance)
+}
+
+// notReadyResponse builds a SERVFAIL for a query the server can't serve
+// right now for reason. Queries with EDNS get a Not Ready extended error
+// naming it, so clients can tell a temporary refusal from a failure.
+func (h *Handler) notReadyResponse(query *dns.Message, reason error) []byte {
+	resp := dns.CreateErrorResponse(query, h.domain, dns.RcodeServerFail, uint16(h.config.MaxUDPSize))
+	if opt, _ := resp.OPT(); opt != nil {
+		_ = resp.SetEDNSOption(dns.NewExtendedErrorOption(dns.EDENotReady, reason.Error()))
+	}
+
+	data, err := resp.Marshal()
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.AllowStreams = true
+		c.Maintenance = true
+	})
+	config := h.config
+	clientID := dns.NewClientID()
+
+	// Handshakes are refused before they are reassembled
+	handshake := &dns.Fragment{Flags: dns.FragmentFlagHandshake, ID: 1, Total: 1, Data: []byte("x")}
+	if _, err := h.handleFragment(h.ctx, 0, nil, clientID, handshake); !errors.Is(err, ErrMaintenance) {
+		t.Errorf("Handshake in maintenance mode: got %v, want %v", err, ErrMaintenance)
+	}
+
+	// So are new streams
+	reply := h.handleStreamFrame(h.ctx, clientID, &stream.Frame{Op: stream.OpOpen, Stream: 1, Data: []byte("example.com:80")})
+	if reply.Op != stream.OpReset || string(reply.Data) != ErrMaintenance.Error() {
+		t.Errorf("Open in maintenance mode: got op %d %q, want reset", reply.Op, reply.Data)
+	}
+
+	// The refusal carries a Not Ready extended error
+	query := dns.CreateQuery(mustParseName(t, "x.t.example.com"), dns.RRTypeTXT, 1)
+	query.AddEDNS0(1232)
+	resp, err := dns.ParseMessage(h.maintenanceResponse(query))
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if resp.Rcode() != dns.RcodeServerFail {
+		t.Errorf("Rcode: got %d, want %d", resp.Rcode(), dns.RcodeServerFail)
+	}
+	if code, _, ok := resp.ExtendedError(); !ok || code != dns.EDENotReady {
+		t.Errorf("ExtendedError() = %d %v, want %d", code, ok, dns.EDENotReady)
+	}
+
+	// A reload that doesn't change the option keeps the runtime mode
+	h.SetMaintenance(false)
+	same := *config
+	if err := h.Reload(&same); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if h.Maintenance() {
+		t.Error("Unrelated reload switched maintenance mode on")
+	}
+	off := same
+	off.Maintenance = false
+	on := off
+	on.Maintenance = true
+	if err := h.Reload(&off); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if err := h.Reload(&on); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if !h.Maintenance() {
+		t.Error("Reload enabling maintenance mode ignored")
+	}
+}
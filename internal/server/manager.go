@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+const (
+	// DefaultMaxClients bounds the number of clients tracked at once
+	DefaultMaxClients = 10000
+
+	// clientBucket is the storage bucket of tracked clients
+	clientBucket = "clients"
+)
+
+var ErrTooManyClients = errors.New("too many clients")
+
+// ClientSession holds the activity of a client, identified by the ClientID
+// in its tunnel queries.
+type ClientSession struct {
+	ClientID  dns.ClientID
+	FirstSeen time.Time
+	LastSeen  time.Time
+	BytesUp   uint64 // query fragment payload received
+	BytesDown uint64 // response fragment payload sent
+	Queries   uint64 // tunnel queries answered
+
+	// MaxResponse is the largest response, in bytes, the client found
+	// its resolvers carry intact; 0 if it didn't say
+	MaxResponse int
+
+	// Carrier is the record type the client's responses are carried in,
+	// which fragments are sized for
+	Carrier dns.Carrier
+}
+
+// SessionManager tracks the clients sending tunnel queries. A client is
+// admitted once one of its messages decrypts, so forged ClientIDs don't
+// take up entries; clients idle for the timeout are expired, and new
+// clients are refused while the limit is reached.
+//
+// Clients are kept in a store, so their accounting and the client limit
+// survive restarts. A client is stored when admitted and when its probe
+// results change; its counters are stored with the rest on save, to keep
+// stores from being written on every query.
+type SessionManager struct {
+	entries   map[dns.ClientID]*ClientSession
+	timeout   time.Duration
+	max       int
+	lastSweep time.Time
+	store     storage.Store
+	mu        sync.Mutex
+}
+
+// NewSessionManager creates a session manager tracking at most max clients
+// (DefaultMaxClients if max isn't positive), each until idle for timeout,
+// starting with the clients saved in store that haven't expired.
+func NewSessionManager(timeout time.Duration, max int, store storage.Store) *SessionManager {
+	m := &SessionManager{
+		entries: make(map[dns.ClientID]*ClientSession),
+		timeout: timeout,
+		store:   store,
+	}
+	m.SetLimit(max)
+
+	now := time.Now()
+	_ = store.ForEach(clientBucket, func(key string, value []byte) error {
+		var s ClientSession
+		if err := json.Unmarshal(value, &s); err != nil || key != string(s.ClientID[:]) ||
+			now.Sub(s.LastSeen) > timeout || len(m.entries) >= m.max {
+			m.deleteSaved(key)
+			return nil
+		}
+		m.entries[s.ClientID] = &s
+		return nil
+	})
+	return m
+}
+
+// saveClient stores a client. Failures are logged; the client is still
+// tracked until the server restarts. The caller holds m.mu.
+func (m *SessionManager) saveClient(s *ClientSession) {
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = m.store.Put(clientBucket, string(s.ClientID[:]), data)
+	}
+	if err != nil {
+		log.Printf("Failed to save client: %v", err)
+	}
+}
+
+// deleteSaved removes a stored client.
+func (m *SessionManager) deleteSaved(key string) {
+	if err := m.store.Delete(clientBucket, key); err != nil {
+		log.Printf("Failed to delete client: %v", err)
+	}
+}
+
+// save stores every client with its counters, before shutdown.
+func (m *SessionManager) save() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.entries {
+		m.saveClient(s)
+	}
+}
+
+// SetLimit changes the maximum number of clients. Clients beyond a lowered
+// limit are kept until they expire.
+func (m *SessionManager) SetLimit(max int) {
+	if max <= 0 {
+		max = DefaultMaxClients
+	}
+	m.mu.Lock()
+	m.max = max
+	m.mu.Unlock()
+}
+
+// Admit starts tracking a client whose message decrypted, or marks a
+// tracked one as seen. It returns ErrTooManyClients for a new client while
+// the limit is reached.
+func (m *SessionManager) Admit(clientID dns.ClientID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if s, ok := m.entries[clientID]; ok {
+		s.LastSeen = now
+		return nil
+	}
+
+	// Expire idle clients at most twice per timeout, or when full
+	if len(m.entries) >= m.max || now.Sub(m.lastSweep) > m.timeout/2 {
+		m.expire(now)
+	}
+	if len(m.entries) >= m.max {
+		return ErrTooManyClients
+	}
+
+	s := &ClientSession{ClientID: clientID, FirstSeen: now, LastSeen: now}
+	m.entries[clientID] = s
+	m.saveClient(s)
+	return nil
+}
+
+// Record counts an answered tunnel query of a tracked client with the
+// payload bytes it carried each way. Queries of clients not admitted yet,
+// such as the first fragments of their first message, aren't counted.
+func (m *SessionManager) Record(clientID dns.ClientID, up, down int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.entries[clientID]
+	if !ok {
+		return
+	}
+	s.LastSeen = time.Now()
+	s.BytesUp += uint64(up)
+	s.BytesDown += uint64(down)
+	s.Queries++
+}
+
+// SetMaxResponse records the largest response, in bytes, a tracked client
+// found its resolvers carry intact.
+func (m *SessionManager) SetMaxResponse(clientID dns.ClientID, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.entries[clientID]; ok && s.MaxResponse != size {
+		s.MaxResponse = size
+		m.saveClient(s)
+	}
+}
+
+// MaxResponse returns the largest response size a client announced, or 0
+// if it didn't announce one or isn't tracked.
+func (m *SessionManager) MaxResponse(clientID dns.ClientID) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.entries[clientID]; ok {
+		return s.MaxResponse
+	}
+	return 0
+}
+
+// SetCarrier records the record type a tracked client's responses are
+// carried in.
+func (m *SessionManager) SetCarrier(clientID dns.ClientID, carrier dns.Carrier) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.entries[clientID]; ok && s.Carrier != carrier {
+		s.Carrier = carrier
+		m.saveClient(s)
+	}
+}
+
+// Carrier returns the record type a client announced its responses are
+// carried in, TXT if it didn't announce one or isn't tracked.
+func (m *SessionManager) Carrier(clientID dns.ClientID) dns.Carrier {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.entries[clientID]; ok {
+		return s.Carrier
+	}
+	return dns.CarrierTXT
+}
+
+// expire drops clients idle for the timeout. The caller holds m.mu.
+func (m *SessionManager) expire(now time.Time) {
+	for k, v := range m.entries {
+		if now.Sub(v.LastSeen) > m.timeout {
+			delete(m.entries, k)
+			m.deleteSaved(string(k[:]))
+		}
+	}
+	m.lastSweep = now
+}
+
+// Sessions returns the tracked clients, most recently seen first.
+func (m *SessionManager) Sessions() []ClientSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(time.Now())
+	sessions := make([]ClientSession, 0, len(m.entries))
+	for _, s := range m.entries {
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions
+}
+
+// Len returns the number of tracked clients.
+func (m *SessionManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+func TestSessionManager(t *testing.T) {
+	m := NewSessionManager(time.Minute, 2, storage.NewMemory())
+	a, b, c := dns.NewClientID(), dns.NewClientID(), dns.NewClientID()
+
+	// Queries of clients not admitted aren't counted
+	m.Record(a, 100, 200)
+	if m.Len() != 0 {
+		t.Errorf("Len() = %d after recording an unknown client", m.Len())
+	}
+
+	if err := m.Admit(a); err != nil {
+		t.Fatalf("Admit() error = %v", err)
+	}
+	m.Record(a, 100, 200)
+	m.Record(a, 50, 0)
+	if err := m.Admit(b); err != nil {
+		t.Fatalf("Admit() error = %v", err)
+	}
+	if err := m.Admit(c); !errors.Is(err, ErrTooManyClients) {
+		t.Errorf("Admit() beyond the limit: got %v, want %v", err, ErrTooManyClients)
+	}
+	if err := m.Admit(a); err != nil {
+		t.Errorf("Admit() of a tracked client at the limit: %v", err)
+	}
+
+	sessions := m.Sessions()
+	if len(sessions) != 2 || sessions[0].ClientID != a {
+		t.Fatalf("Sessions() = %+v, want a most recently seen", sessions)
+	}
+	if s := sessions[0]; s.BytesUp != 150 || s.BytesDown != 200 || s.Queries != 2 {
+		t.Errorf("Session of a: got %d up, %d down, %d queries, want 150, 200, 2", s.BytesUp, s.BytesDown, s.Queries)
+	}
+
+	// Raising the limit admits new clients
+	m.SetLimit(3)
+	if err := m.Admit(c); err != nil {
+		t.Errorf("Admit() after raising the limit: %v", err)
+	}
+
+	// Idle clients expire and make room
+	m.mu.Lock()
+	m.entries[a].LastSeen = time.Now().Add(-2 * time.Minute)
+	m.mu.Unlock()
+	if err := m.Admit(dns.NewClientID()); err != nil {
+		t.Errorf("Admit() with an idle client to expire: %v", err)
+	}
+	for _, s := range m.Sessions() {
+		if s.ClientID == a {
+			t.Error("Idle client not expired")
+		}
+	}
+}
+
+func TestSessionManagerPersistence(t *testing.T) {
+	store := storage.NewMemory()
+	m := NewSessionManager(time.Minute, 2, store)
+	a, idle := dns.NewClientID(), dns.NewClientID()
+	for _, id := range []dns.ClientID{a, idle} {
+		if err := m.Admit(id); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+	}
+	m.Record(a, 100, 200)
+	m.SetCarrier(a, dns.CarrierHTTPS)
+	m.entries[idle].LastSeen = time.Now().Add(-2 * time.Minute)
+	m.save()
+
+	// A restarted server keeps the accounting of active clients, which
+	// count against the limit, and drops expired ones
+	restored := NewSessionManager(time.Minute, 2, store)
+	sessions := restored.Sessions()
+	if len(sessions) != 1 || sessions[0].ClientID != a {
+		t.Fatalf("Sessions() after restart = %+v, want only a", sessions)
+	}
+	if s := sessions[0]; s.BytesUp != 100 || s.BytesDown != 200 || s.Queries != 1 || s.Carrier != dns.CarrierHTTPS {
+		t.Errorf("restored session = %+v", s)
+	}
+	if _, err := store.Get(clientBucket, string(idle[:])); err != storage.ErrNotFound {
+		t.Errorf("Expired client still stored: %v", err)
+	}
+
+	restored.SetLimit(1)
+	if err := restored.Admit(dns.NewClientID()); !errors.Is(err, ErrTooManyClients) {
+		t.Errorf("Admit() beyond the limit after restart: got %v, want %v", err, ErrTooManyClients)
+	}
+}
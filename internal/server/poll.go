@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+// pollReplyFragments is the number of response fragments a poll reply's
+// frames may fill
+const pollReplyFragments = 8
+
+// pollQueue holds a client's streams with data that no frame carried yet.
+type pollQueue struct {
+	ready    map[uint32]struct{}
+	wake     chan struct{} // signalled when a stream becomes ready
+	lastUsed time.Time
+}
+
+// pollTable queues downstream data for each client until the client polls
+// for it, so data reaches the client without waiting for the stream's own
+// next exchange.
+type pollTable struct {
+	entries   map[dns.ClientID]*pollQueue
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func newPollTable() *pollTable {
+	return &pollTable{entries: make(map[dns.ClientID]*pollQueue)}
+}
+
+// queue returns the client's queue, creating it if needed. The caller
+// holds t.mu.
+func (t *pollTable) queue(clientID dns.ClientID, now time.Time) *pollQueue {
+	// Drop queues of clients that stopped polling, at most twice per idle
+	// timeout
+	if now.Sub(t.lastSweep) > stream.IdleTimeout/2 {
+		for k, v := range t.entries {
+			if now.Sub(v.lastUsed) > stream.IdleTimeout {
+				delete(t.entries, k)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	q, ok := t.entries[clientID]
+	if !ok {
+		q = &pollQueue{
+			ready:    make(map[uint32]struct{}),
+			wake:     make(chan struct{}, 1),
+			lastUsed: now,
+		}
+		t.entries[clientID] = q
+	}
+	return q
+}
+
+// notify queues a client's stream that has new data.
+func (t *pollTable) notify(clientID dns.ClientID, id uint32) {
+	t.mu.Lock()
+	q := t.queue(clientID, time.Now())
+	q.ready[id] = struct{}{}
+	t.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait takes the client's queued streams, waiting up to timeout for one if
+// there are none.
+func (t *pollTable) wait(ctx context.Context, clientID dns.ClientID, timeout time.Duration) []uint32 {
+	var timer *time.Timer
+	for {
+		t.mu.Lock()
+		q := t.queue(clientID, time.Now())
+		q.lastUsed = time.Now()
+		ids := make([]uint32, 0, len(q.ready))
+		for id := range q.ready {
+			ids = append(ids, id)
+		}
+		clear(q.ready)
+		t.mu.Unlock()
+		if len(ids) > 0 {
+			return ids
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-q.wake:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// resolvePoll decrypts a reassembled poll and returns the encrypted frames
+// carrying the client's queued stream data, split into fragments. Without
+// queued data it waits for some first.
+func (h *Handler) resolvePoll(ctx context.Context, keyID dns.KeyID, keyring *crypto.Keyring, clientID dns.ClientID, session bool, data []byte, id uint16) ([]*dns.Fragment, error) {
+	_, cipher, err := h.decryptMessage(keyID, keyring, clientID, session, data)
+	if err != nil {
+		return nil, err
+	}
+
+	maxData := pollReplyFragments*h.responseFragmentSize(ctx, clientID) - crypto.Overhead
+	return h.encryptReply(ctx, cipher, clientID, stream.MarshalFrames(h.pendingFrames(ctx, clientID, maxData)), id, 0)
+}
+
+// pendingFrames returns frames carrying the data of the client's queued
+// streams, at most maxSize bytes of them in poll reply format. Streams
+// with more data than fits are queued again.
+func (h *Handler) pendingFrames(ctx context.Context, clientID dns.ClientID, maxSize int) []*stream.Frame {
+	var frames []*stream.Frame
+	for _, id := range h.polls.wait(ctx, clientID, streamPollTimeout) {
+		room := maxSize - 2 - stream.HeaderSize
+		if room <= 0 {
+			h.polls.notify(clientID, id)
+			continue
+		}
+
+		s, ok := h.streams.get(streamKey{clientID: clientID, id: id})
+		if !ok {
+			continue
+		}
+		select {
+		case <-s.connected:
+		default:
+			continue
+		}
+		if s.endpoint == nil {
+			continue
+		}
+
+		f := s.endpoint.Fresh(stream.OpData, id, room)
+		if f == nil {
+			continue
+		}
+		if len(f.Data) == room {
+			h.polls.notify(clientID, id)
+		}
+		frames = append(frames, f)
+		maxSize -= 2 + stream.HeaderSize + len(f.Data)
+	}
+	return frames
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestPollTable(t *testing.T) {
+	polls := newPollTable()
+	a, b := dns.NewClientID(), dns.NewClientID()
+
+	polls.notify(a, 1)
+	polls.notify(a, 2)
+	polls.notify(a, 1)
+	polls.notify(b, 3)
+
+	ids := polls.wait(context.Background(), a, time.Second)
+	slices.Sort(ids)
+	if !slices.Equal(ids, []uint32{1, 2}) {
+		t.Errorf("wait() = %v, want [1 2]", ids)
+	}
+
+	// Taken streams aren't returned again; an empty queue waits
+	start := time.Now()
+	if ids := polls.wait(context.Background(), a, 50*time.Millisecond); len(ids) != 0 {
+		t.Errorf("wait() on an empty queue = %v", ids)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("wait() on an empty queue returned before the timeout")
+	}
+
+	// A notification wakes a waiting poll
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		polls.notify(a, 4)
+	}()
+	if ids := polls.wait(context.Background(), a, 5*time.Second); !slices.Equal(ids, []uint32{4}) {
+		t.Errorf("wait() after notify = %v, want [4]", ids)
+	}
+
+	// Other clients' streams stay queued
+	if ids := polls.wait(context.Background(), b, time.Second); !slices.Equal(ids, []uint32{3}) {
+		t.Errorf("wait() for another client = %v, want [3]", ids)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Ways to spread queries over the upstream and its fallbacks
+const (
+	// UpstreamFailover sends every query to the first healthy upstream,
+	// moving down the list when it fails
+	UpstreamFailover = "failover"
+
+	// UpstreamBalance spreads queries over the healthy upstreams in turn,
+	// failing over to the others
+	UpstreamBalance = "balance"
+)
+
+// Upstream health constants
+const (
+	// DefaultUpstreamHealthInterval is how often upstreams are probed
+	DefaultUpstreamHealthInterval = 30 * time.Second
+
+	// upstreamDownFailures is the number of consecutive failures after
+	// which an upstream is considered down
+	upstreamDownFailures = 3
+)
+
+var ErrUnknownUpstreamStrategy = errors.New("unknown upstream strategy")
+
+// checkUpstreamStrategy verifies an upstream strategy; empty means
+// UpstreamFailover.
+func checkUpstreamStrategy(strategy string) error {
+	switch strategy {
+	case "", UpstreamFailover, UpstreamBalance:
+		return nil
+	}
+	return fmt.Errorf("%w %q, want %s or %s", ErrUnknownUpstreamStrategy, strategy, UpstreamFailover, UpstreamBalance)
+}
+
+// upstreamHealth tracks whether an upstream of a chain answers.
+type upstreamHealth struct {
+	failures atomic.Int32 // consecutive failures
+	down     atomic.Bool
+}
+
+// record updates the health of upstream with the outcome of an exchange.
+// Answers with failover rcodes don't count: the upstream is reachable,
+// and the rcode may be about the name alone.
+func (h *upstreamHealth) record(upstream string, err error) {
+	var rcodeErr *RcodeError
+	if err != nil && (errors.As(err, &rcodeErr) || errors.Is(err, context.Canceled)) {
+		return
+	}
+	if err == nil {
+		h.failures.Store(0)
+		if h.down.Swap(false) {
+			log.Printf("upstream %s is answering again", upstream)
+		}
+		return
+	}
+	if h.failures.Add(1) >= upstreamDownFailures && !h.down.Swap(true) {
+		log.Printf("upstream %s is down: %v", upstream, err)
+	}
+}
+
+// order returns the indexes of the chain's upstreams in the order to try
+// them: the healthy ones first, in configured order or for UpstreamBalance
+// starting from the next in turn, then the ones that are down as a last
+// resort.
+func (c *upstreamChain) order() []int {
+	start := 0
+	if c.balance && len(c.resolvers) > 1 {
+		start = int(c.next.Add(1) % uint32(len(c.resolvers)))
+	}
+
+	order := make([]int, 0, len(c.resolvers))
+	var down []int
+	for i := range c.resolvers {
+		i = (start + i) % len(c.resolvers)
+		if c.health[i].down.Load() {
+			down = append(down, i)
+		} else {
+			order = append(order, i)
+		}
+	}
+	return append(order, down...)
+}
+
+// startHealthChecks probes each upstream of the chain every interval with
+// a query for the root NS records, so upstreams that are down are avoided
+// before queries wait for them, and used again once they answer. Chains
+// with a single upstream have nothing to fail over to and aren't probed.
+func (c *upstreamChain) startHealthChecks(interval time.Duration) {
+	if interval <= 0 || len(c.resolvers) < 2 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopChecks = cancel
+	c.checks.Add(1)
+	go func() {
+		defer c.checks.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			c.probe(ctx)
+		}
+	}()
+}
+
+// probe sends a probe query to every upstream and records the outcomes.
+func (c *upstreamChain) probe(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, r := range c.resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := dns.CreateQuery(dns.Name{}, dns.RRTypeNS, dns.GenerateQueryID())
+			_, _, err := r.exchange(ctx, query)
+			if ctx.Err() == nil {
+				c.health[i].record(r.upstream, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// UpstreamsDown returns the upstreams of the default chain that are
+// considered down.
+func (h *Handler) UpstreamsDown() []string {
+	chain := h.resolver.Load()
+	var down []string
+	for i, r := range chain.resolvers {
+		if chain.health[i].down.Load() {
+			down = append(down, r.upstream)
+		}
+	}
+	return down
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// closedUpstream returns the address of a UDP port nothing listens on.
+func closedUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	var h upstreamHealth
+	failure := errors.New("timeout")
+
+	for i := 0; i < upstreamDownFailures-1; i++ {
+		h.record("9.9.9.9:53", failure)
+	}
+	h.record("9.9.9.9:53", &RcodeError{Upstream: "9.9.9.9:53", Rcode: dns.RcodeRefused})
+	if h.down.Load() {
+		t.Fatal("Upstream down before enough failures")
+	}
+	h.record("9.9.9.9:53", failure)
+	if !h.down.Load() {
+		t.Fatal("Upstream not down after consecutive failures")
+	}
+	h.record("9.9.9.9:53", nil)
+	if h.down.Load() || h.failures.Load() != 0 {
+		t.Error("Upstream still down after answering")
+	}
+}
+
+func TestUpstreamChainOrder(t *testing.T) {
+	c, err := newUpstreamChain("192.0.2.1:53", "udp", []string{"192.0.2.2:53", "192.0.2.3:53"}, nil)
+	if err != nil {
+		t.Fatalf("newUpstreamChain() error = %v", err)
+	}
+	defer c.Close()
+
+	if got := c.order(); !slices.Equal(got, []int{0, 1, 2}) {
+		t.Errorf("order() = %v, want [0 1 2]", got)
+	}
+	c.health[0].down.Store(true)
+	if got := c.order(); !slices.Equal(got, []int{1, 2, 0}) {
+		t.Errorf("order() with the first down = %v, want [1 2 0]", got)
+	}
+
+	c.balance = true
+	first := map[int]bool{}
+	for i := 0; i < 4; i++ {
+		order := c.order()
+		if order[len(order)-1] != 0 {
+			t.Errorf("order() = %v, want the upstream that is down last", order)
+		}
+		first[order[0]] = true
+	}
+	if !first[1] || !first[2] {
+		t.Errorf("Balanced order started with %v, want both healthy upstreams", first)
+	}
+}
+
+func TestUpstreamChainPool(t *testing.T) {
+	config := DefaultConfig()
+	config.UpstreamResolver = closedUpstream(t)
+	config.FallbackUpstreams = []string{startAddrUpstream(t, "93.184.216.34", false)}
+	config.UpstreamHealthInterval = 50 * time.Millisecond
+	chain, err := upstreamChainFromConfig(config)
+	if err != nil {
+		t.Fatalf("upstreamChainFromConfig() error = %v", err)
+	}
+	defer chain.Close()
+
+	// Health checks find the dead upstream without a query waiting for it
+	deadline := time.Now().Add(2 * time.Second)
+	for !chain.health[0].down.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("Dead upstream not marked down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := chain.order(); got[0] != 1 {
+		t.Errorf("order() = %v, want the live upstream first", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := chain.Resolve(ctx, dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1))
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if got := describeAnswer(resp); got != "93.184.216.34" {
+		t.Errorf("Resolve() answered %s", got)
+	}
+
+	config.UpstreamStrategy = "random"
+	if _, err := upstreamChainFromConfig(config); !errors.Is(err, ErrUnknownUpstreamStrategy) {
+		t.Errorf("upstreamChainFromConfig() error = %v, want ErrUnknownUpstreamStrategy", err)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+// startupCheckTimeout bounds the upstream check at startup
+const startupCheckTimeout = 5 * time.Second
+
+var ErrUpstreamUnreachable = errors.New("upstream resolver doesn't answer")
+
+// checkConfig verifies the domain and key, explaining how to fix them.
+func checkConfig(domain dns.Name, config *Config) error {
+	if len(domain) == 0 {
+		return fmt.Errorf("invalid domain: the domain is empty (set -domain to the zone delegated to this server, e.g. t.example.com)")
+	}
+	if dns.QueryFragmentSize(domain) <= 0 {
+		return fmt.Errorf("invalid domain: %s leaves no room for tunnel payload in a query name (delegate a shorter zone)", domain)
+	}
+	if len(config.SharedSecret) != crypto.KeySize {
+		return fmt.Errorf("%w: the key is %d bytes, want %d (generate one with -gen-key and use the same key on the client)",
+			crypto.ErrInvalidKey, len(config.SharedSecret), crypto.KeySize)
+	}
+	if config.RateLimitIPv4Prefix < 0 || config.RateLimitIPv4Prefix > 32 ||
+		config.RateLimitIPv6Prefix < 0 || config.RateLimitIPv6Prefix > 128 {
+		return fmt.Errorf("invalid rate limit prefix: /%d for IPv4 and /%d for IPv6, want at most /32 and /128",
+			config.RateLimitIPv4Prefix, config.RateLimitIPv6Prefix)
+	}
+	if err := checkLimitAction(config.OverLimitAction); err != nil {
+		return err
+	}
+	if err := storage.CheckBackend(config.StateBackend); err != nil {
+		return err
+	}
+	if config.ClusterListen != "" {
+		return checkClusterSecret(config)
+	}
+	return nil
+}
+
+// checkUpstream verifies that the upstream chain answers a query for the
+// root name servers.
+func (h *Handler) checkUpstream() error {
+	ctx, cancel := context.WithTimeout(h.ctx, startupCheckTimeout)
+	defer cancel()
+
+	query := dns.CreateQuery(dns.Name{}, dns.RRTypeNS, dns.GenerateQueryID())
+	if _, err := h.resolver.Load().Resolve(ctx, query); err != nil {
+		return fmt.Errorf("%w: %s (%s): %v (check that this host can reach it and that outbound DNS, DoT or HTTPS isn't blocked, or choose another -upstream)",
+			ErrUpstreamUnreachable, h.config.UpstreamResolver, h.config.UpstreamType, err)
+	}
+	return nil
+}
+
+// listenError explains a failure to listen on addr.
+func listenError(network, addr string, err error) error {
+	hint := ""
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		hint = " (another program, such as systemd-resolved or dnsmasq, uses the port; stop it or choose another -listen address)"
+	case errors.Is(err, syscall.EACCES):
+		hint = " (ports below 1024 need root or CAP_NET_BIND_SERVICE; run as a service or grant the capability)"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		hint = " (the address isn't assigned to this host; check -listen)"
+	}
+	return fmt.Errorf("failed to listen on %s %s: %w%s", network, addr, err, hint)
+}
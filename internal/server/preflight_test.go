@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		key    []byte
+		want   string
+	}{
+		{"valid", "t.example.com", make([]byte, crypto.KeySize), ""},
+		{"short key", "t.example.com", make([]byte, 16), "-gen-key"},
+		{"long domain", strings.Repeat("a.", 120) + "com", make([]byte, crypto.KeySize), "shorter zone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Domain = tt.domain
+			config.SharedSecret = tt.key
+			_, err := NewHandler(config)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("NewHandler() error = %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("NewHandler() error = %v, want a hint containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateBackend(t *testing.T) {
+	config := DefaultConfig()
+	config.Domain = "t.example.com"
+	config.SharedSecret = make([]byte, crypto.KeySize)
+	config.StateFile = filepath.Join(t.TempDir(), "state.db")
+	config.StateBackend = "sqlite"
+	if _, err := NewHandler(config); !errors.Is(err, storage.ErrUnknownBackend) {
+		t.Fatalf("NewHandler() with an unknown backend: got %v, want %v", err, storage.ErrUnknownBackend)
+	}
+
+	// Answered exchanges saved in a bbolt database are there after a
+	// restart
+	config.StateBackend = storage.BackendBolt
+	h, err := NewHandler(config)
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	clientID := dns.NewClientID()
+	ex, _, _ := h.exchanges.create(clientID, 1, []byte("query"))
+	fragments, _ := dns.SplitPayload([]byte("response"), 1, 4)
+	h.exchanges.finish(ex, fragments, nil)
+	h.Stop()
+
+	h, err = NewHandler(config)
+	if err != nil {
+		t.Fatalf("NewHandler() restart error = %v", err)
+	}
+	defer h.Stop()
+	if _, ok := h.exchanges.get(clientID, 1); !ok {
+		t.Error("Exchange lost across a restart")
+	}
+}
+
+func TestListenError(t *testing.T) {
+	err := listenError("UDP", ":53", &net.OpError{Op: "listen", Net: "udp", Err: syscall.EADDRINUSE})
+	if !errors.Is(err, syscall.EADDRINUSE) || !strings.Contains(err.Error(), "another program") {
+		t.Errorf("listenError() = %v, want the cause with a hint", err)
+	}
+}
+
+func TestStartupUpstreamCheck(t *testing.T) {
+	// An upstream that never answers
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer silent.Close()
+
+	h := newTestHandler(t, func(c *Config) {
+		c.ListenAddr = "127.0.0.1:0"
+		c.UpstreamResolver = silent.LocalAddr().String()
+		c.StartupChecks = true
+	})
+
+	if err := h.Start(); !errors.Is(err, ErrUpstreamUnreachable) {
+		t.Errorf("Start() error = %v, want %v", err, ErrUpstreamUnreachable)
+	}
+}
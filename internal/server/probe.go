@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Probe constants
+const (
+	// maxProbeReply bounds the reply size a probe may ask for, in bytes
+	maxProbeReply = dns.MaxEDNSSize
+
+	// minResponseLimit is the smallest response size limit a client may
+	// announce, in bytes: the limit every DNS path carries
+	minResponseLimit = 512
+)
+
+var ErrInvalidProbe = errors.New("invalid probe")
+
+// resolveProbe answers a diagnostic probe: an authenticated message in a
+// single fragment holding the size of the reply it wants, optionally
+// followed by the largest response size the client found its resolvers
+// carry (0 if unknown), the carrier of its responses and padding that
+// lengthens the query name. The reply is that many bytes, encrypted, in a
+// single response fragment, so the client learns how large a response
+// survives its path to the server. An announced limit and carrier apply
+// to the fragments of the client's later replies. Probes bypass reassembly and the exchange table; a
+// retransmitted probe is a replay.
+func (h *Handler) resolveProbe(keyID dns.KeyID, keyring *crypto.Keyring, clientID dns.ClientID, fragment *dns.Fragment) (*dns.Fragment, error) {
+	if fragment.Total != 1 {
+		return nil, ErrInvalidProbe
+	}
+
+	plaintext, cipher, err := h.decryptMessage(keyID, keyring, clientID, fragment.IsSession(), fragment.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < 2 {
+		return nil, ErrInvalidProbe
+	}
+
+	if len(plaintext) >= 4 {
+		if limit := int(binary.BigEndian.Uint16(plaintext[2:])); limit != 0 {
+			h.clients.SetMaxResponse(clientID, max(limit, minResponseLimit))
+			if len(plaintext) >= 5 && dns.Carrier(plaintext[4]).Valid() {
+				h.clients.SetCarrier(clientID, dns.Carrier(plaintext[4]))
+			}
+		}
+	}
+
+	size := min(int(binary.BigEndian.Uint16(plaintext)), maxProbeReply)
+	reply, err := cipher.EncryptWithoutTimestamp(make([]byte, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt response: %w", err)
+	}
+	return &dns.Fragment{Flags: dns.FragmentFlagProbe, ID: fragment.ID, Total: 1, Data: reply}, nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestProbe(t *testing.T) {
+	h := newTestHandler(t, nil)
+	config := h.config
+
+	keyring, err := h.keys.Load().keyring(0)
+	if err != nil {
+		t.Fatalf("keyring() error = %v", err)
+	}
+	cipher, err := crypto.NewCipher(config.SharedSecret, true)
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+	clientID := dns.NewClientID()
+
+	probe := func(id uint16, size int) (*dns.Fragment, error) {
+		data, err := cipher.Encrypt(binary.BigEndian.AppendUint16(nil, uint16(size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &dns.Fragment{Flags: dns.FragmentFlagProbe, ID: id, Total: 1, Data: data}
+		return h.handleFragment(h.ctx, 0, keyring, clientID, f)
+	}
+
+	// The reply has the requested size, capped
+	for _, tt := range []struct{ size, want int }{{0, 0}, {1000, 1000}, {60000, maxProbeReply}} {
+		reply, err := probe(uint16(tt.size), tt.size)
+		if err != nil {
+			t.Fatalf("Probe of %d bytes: error = %v", tt.size, err)
+		}
+		plaintext, err := cipher.DecryptWithoutTimestamp(reply.Data)
+		if err != nil || len(plaintext) != tt.want || !reply.IsProbe() || reply.Total != 1 {
+			t.Errorf("Probe of %d bytes: got %d bytes, %v, want %d", tt.size, len(plaintext), err, tt.want)
+		}
+	}
+
+	// Probes must be authentic and fit one fragment
+	forged := &dns.Fragment{Flags: dns.FragmentFlagProbe, ID: 9, Total: 1, Data: make([]byte, 64)}
+	if _, err := h.handleFragment(h.ctx, 0, keyring, clientID, forged); err == nil {
+		t.Error("Forged probe answered")
+	}
+	split := &dns.Fragment{Flags: dns.FragmentFlagProbe, ID: 10, Total: 2, Data: []byte("x")}
+	if _, err := h.handleFragment(h.ctx, 0, keyring, clientID, split); !errors.Is(err, ErrInvalidProbe) {
+		t.Errorf("Fragmented probe: error = %v, want %v", err, ErrInvalidProbe)
+	}
+}
+
+func TestProbeResponseLimit(t *testing.T) {
+	h := newTestHandler(t, nil)
+	config := h.config
+
+	keyring, err := h.keys.Load().keyring(0)
+	if err != nil {
+		t.Fatalf("keyring() error = %v", err)
+	}
+	cipher, err := crypto.NewCipher(config.SharedSecret, true)
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+	clientID := dns.NewClientID()
+	full := h.responseFragmentSize(h.ctx, clientID)
+
+	announce := func(id uint16, limit int, carrier dns.Carrier) {
+		msg := binary.BigEndian.AppendUint16(nil, 0)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(limit))
+		msg = append(msg, byte(carrier))
+		data, err := cipher.Encrypt(append(msg, make([]byte, 40)...)) // padded
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &dns.Fragment{Flags: dns.FragmentFlagProbe, ID: id, Total: 1, Data: data}
+		if _, err := h.handleFragment(h.ctx, 0, keyring, clientID, f); err != nil {
+			t.Fatalf("Probe announcing %d bytes: error = %v", limit, err)
+		}
+	}
+
+	// Replies to the client shrink to the announced limit, but not below
+	// the DNS minimum
+	announce(1, 900, dns.CarrierTXT)
+	if got, want := h.responseFragmentSize(h.ctx, clientID), dns.ResponseFragmentSize(900); got != want {
+		t.Errorf("Fragment size after announcing 900 bytes = %d, want %d", got, want)
+	}
+	fragments, err := h.encryptReply(h.ctx, cipher, clientID, make([]byte, 2000), 7, 0)
+	if err != nil {
+		t.Fatalf("encryptReply() error = %v", err)
+	}
+	for _, f := range fragments {
+		if len(f.Data) > dns.ResponseFragmentSize(900) {
+			t.Errorf("Fragment of %d bytes exceeds the announced limit", len(f.Data))
+		}
+	}
+	announce(2, 100, dns.CarrierTXT)
+	if got, want := h.responseFragmentSize(h.ctx, clientID), dns.ResponseFragmentSize(minResponseLimit); got != want {
+		t.Errorf("Fragment size after announcing 100 bytes = %d, want %d", got, want)
+	}
+
+	// A limit above MaxUDPSize doesn't enlarge fragments, and other
+	// clients are unaffected
+	announce(3, 4096, dns.CarrierTXT)
+	if got := h.responseFragmentSize(h.ctx, clientID); got != full {
+		t.Errorf("Fragment size after announcing 4096 bytes = %d, want %d", got, full)
+	}
+	if got := h.responseFragmentSize(h.ctx, dns.NewClientID()); got != full {
+		t.Errorf("Fragment size of another client = %d, want %d", got, full)
+	}
+
+	// Fragments of a client whose responses are carried in AAAA records
+	// fit those
+	announce(4, 900, dns.CarrierAAAA)
+	if got, want := h.responseFragmentSize(h.ctx, clientID), dns.CarrierAAAA.FragmentSize(900, h.domain); got != want {
+		t.Errorf("Fragment size after announcing AAAA = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+)
+
+// upstreamDrainTimeout is how long a replaced upstream chain is kept open
+// for in-flight queries.
+const upstreamDrainTimeout = 30 * time.Second
+
+// Reload applies a new configuration without restarting the listeners.
+// Keys, upstreams and their query transforms, failover policy, rate
+// limits, the client limit, goroutine and memory guardrails, static zone
+// records, blocklists, response and negative TTLs, AcceptNoEDNS and
+// maintenance mode take effect immediately; changes to other options are
+// logged and require a restart. Rate limits and maintenance mode are only
+// changed if the new configuration changes them, so values set at runtime
+// survive unrelated reloads.
+func (h *Handler) Reload(config *Config) error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	old := h.active
+
+	if err := checkConfig(h.domain, config); err != nil {
+		return err
+	}
+
+	// Build new keys and upstreams before applying anything
+	var keys *keyStore
+	if keysChanged(old, config) {
+		var err error
+		keys, err = newKeyStore(config, h.clock)
+		if err != nil {
+			return fmt.Errorf("failed to create cipher: %w", err)
+		}
+	}
+
+	var chain *upstreamChain
+	if upstreamsChanged(old, config) {
+		var err error
+		chain, err = upstreamChainFromConfig(config)
+		if err != nil {
+			return fmt.Errorf("failed to create resolver: %w", err)
+		}
+	}
+
+	zone, err := newStaticZone(h.domain, config.ZoneRecords)
+	if err != nil {
+		return fmt.Errorf("invalid zone records: %w", err)
+	}
+
+	blocks := h.blocklist.Load()
+	reblock := blocklistChanged(old, config) || blocks.changed()
+	if reblock {
+		if blocks, err = newBlocklist(config); err != nil {
+			return err
+		}
+	}
+
+	if keys != nil {
+		h.keys.Store(keys)
+		log.Printf("Accepting %d keys (%d client key IDs)", keys.Len(), len(keys.clients))
+	}
+
+	if chain != nil {
+		prev := h.resolver.Swap(chain)
+		time.AfterFunc(upstreamDrainTimeout, prev.Close)
+		log.Printf("Upstream resolver: %s (%s)", config.UpstreamResolver, config.UpstreamType)
+	}
+
+	if reblock {
+		h.blocklist.Store(blocks)
+		logBlocklist("Blocklist reloaded", blocks)
+	}
+	h.runBlocklistLoop(blocks != nil)
+
+	if rateLimits(config) != rateLimits(old) {
+		h.SetRateLimits(rateLimits(config))
+	}
+	h.security.SetRateLimitPrefixes(rateLimitPrefixes(config))
+	h.security.SetChallengeThreshold(challengeThreshold(config))
+	h.clients.SetLimit(config.MaxClients)
+	h.guard.setLimits(config.MaxGoroutines, config.MaxMemory)
+	h.concurrency.setLimits(config.MaxClientConcurrent, config.MaxQPS)
+	h.limitDrop.Store(config.OverLimitAction == OverLimitDrop)
+	h.zone.Store(zone)
+	h.responseTTL.Store(config.ResponseTTL)
+	h.negativeTTL.Store(config.NegativeTTL)
+	h.forwardEDNS.Store(&config.ForwardEDNSOptions)
+	h.rawPassthru.Store(config.RawPassthrough)
+	h.noEDNS.Store(config.AcceptNoEDNS)
+	h.compress.Store(config.Compression)
+	h.traceLog.Store(config.TraceLog)
+	h.traceSample.SetRate(config.TraceLogSample)
+	h.topN.Store(int32(config.TopN))
+	if h.auditor != nil {
+		h.auditor.setSample(config.AuditSample)
+	}
+	h.streamsOn.Store(config.AllowStreams)
+	h.streamsPriv.Store(config.StreamAllowPrivate)
+	if config.Maintenance != old.Maintenance {
+		h.SetMaintenance(config.Maintenance)
+	}
+
+	if config.ListenAddr != old.ListenAddr || config.ListenTCP != old.ListenTCP ||
+		config.Domain != old.Domain || config.MaxUDPSize != old.MaxUDPSize ||
+		config.MaxConcurrent != old.MaxConcurrent || config.StateFile != old.StateFile ||
+		config.StateBackend != old.StateBackend ||
+		config.ClusterListen != old.ClusterListen || !slices.Equal(config.ClusterPeers, old.ClusterPeers) ||
+		!bytes.Equal(config.ClusterSecret, old.ClusterSecret) ||
+		config.InstanceLabel != old.InstanceLabel ||
+		config.TopReports != old.TopReports || config.TopReportFile != old.TopReportFile ||
+		config.AlertWebhook != old.AlertWebhook || config.AlertFormat != old.AlertFormat ||
+		config.AlertInterval != old.AlertInterval || config.RevocationFile != old.RevocationFile ||
+		config.AuditUpstream != old.AuditUpstream ||
+		config.Cookies != old.Cookies || !bytes.Equal(config.CookieSecret, old.CookieSecret) {
+		log.Printf("Listen address, domain, MTU, concurrency, state file and backend, cluster, instance label, top report, alert, revocation list, audit upstream and cookie changes require a restart")
+	} else if config.RevocationFile != "" {
+		h.reloadRevocations()
+	}
+
+	h.active = config
+	return nil
+}
+
+// keysChanged reports whether the accepted keys differ.
+func keysChanged(a, b *Config) bool {
+	return !bytes.Equal(a.SharedSecret, b.SharedSecret) ||
+		!slices.EqualFunc(a.PreviousSecrets, b.PreviousSecrets, bytes.Equal) ||
+		!maps.EqualFunc(a.ClientKeys, b.ClientKeys, func(x, y []crypto.ClientKey) bool {
+			return slices.EqualFunc(x, y, func(k, l crypto.ClientKey) bool {
+				return bytes.Equal(k.Secret, l.Secret) && k.Policy.Equal(l.Policy)
+			})
+		})
+}
+
+// blocklistChanged reports whether the blocklist configuration differs.
+func blocklistChanged(a, b *Config) bool {
+	return !slices.Equal(a.Blocklists, b.Blocklists) ||
+		!slices.Equal(a.Allowlists, b.Allowlists) ||
+		!slices.Equal(a.BlocklistSinkhole, b.BlocklistSinkhole)
+}
+
+// upstreamsChanged reports whether the upstream configuration differs.
+func upstreamsChanged(a, b *Config) bool {
+	return a.UpstreamResolver != b.UpstreamResolver ||
+		a.UpstreamType != b.UpstreamType ||
+		!slices.Equal(a.FallbackUpstreams, b.FallbackUpstreams) ||
+		a.UpstreamStrategy != b.UpstreamStrategy ||
+		a.UpstreamHealthInterval != b.UpstreamHealthInterval ||
+		!slices.Equal(a.FailoverRcodes, b.FailoverRcodes) ||
+		a.ConsensusUpstream != b.ConsensusUpstream ||
+		!maps.Equal(a.NamedUpstreams, b.NamedUpstreams) ||
+		!maps.Equal(a.UpstreamRoutes, b.UpstreamRoutes) ||
+		a.Upstream0x20 != b.Upstream0x20 ||
+		a.QNameMinimization != b.QNameMinimization ||
+		!slices.Equal(a.RootHints, b.RootHints) ||
+		a.UpstreamEDNSSize != b.UpstreamEDNSSize ||
+		!maps.Equal(a.UpstreamEDNSSizes, b.UpstreamEDNSSizes) ||
+		a.LatencySample != b.LatencySample
+}
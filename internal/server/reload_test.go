@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+)
+
+func TestHandlerReload(t *testing.T) {
+	h := newTestHandler(t, nil)
+	config := h.config
+
+	chain := h.resolver.Load()
+
+	// Unchanged upstreams keep the current chain
+	same := *config
+	same.ResponseTTL = 300
+	same.RateLimit = 5
+	if err := h.Reload(&same); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if h.resolver.Load() != chain {
+		t.Error("Upstream chain replaced without upstream changes")
+	}
+	if got := h.responseTTL.Load(); got != 300 {
+		t.Errorf("ResponseTTL: got %d, want 300", got)
+	}
+	if got := h.security.rateLimiter.rate; got != 5 {
+		t.Errorf("RateLimit: got %v, want 5", got)
+	}
+
+	// Changed upstreams build a new chain
+	changed := same
+	changed.UpstreamResolver = "1.1.1.1:53"
+	changed.FallbackUpstreams = []string{"9.9.9.9"}
+	if err := h.Reload(&changed); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	newChain := h.resolver.Load()
+	if newChain == chain {
+		t.Fatal("Upstream chain not replaced")
+	}
+	if len(newChain.resolvers) != 2 || newChain.resolvers[0].upstream != "1.1.1.1:53" {
+		t.Errorf("New chain: got %d resolvers", len(newChain.resolvers))
+	}
+
+	// Adding a key replaces the keyring
+	keys := h.keys.Load()
+	rotated := changed
+	rotated.SharedSecret = bytes.Repeat([]byte{1}, 32)
+	rotated.PreviousSecrets = [][]byte{config.SharedSecret}
+	if err := h.Reload(&rotated); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if h.keys.Load() == keys || h.keys.Load().Len() != 2 {
+		t.Error("Keyring not replaced with both keys")
+	}
+
+	// Client keys can be added and revoked independently
+	withClients := rotated
+	withClients.ClientKeys = map[uint16][]crypto.ClientKey{
+		5: {{Secret: bytes.Repeat([]byte{5}, 32)}},
+		6: {{Secret: bytes.Repeat([]byte{6}, 32)}},
+	}
+	if err := h.Reload(&withClients); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, err := h.keys.Load().keyring(5); err != nil {
+		t.Errorf("keyring(5) error = %v", err)
+	}
+
+	revoked := withClients
+	revoked.ClientKeys = map[uint16][]crypto.ClientKey{6: withClients.ClientKeys[6]}
+	if err := h.Reload(&revoked); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, err := h.keys.Load().keyring(5); !errors.Is(err, ErrUnknownKeyID) {
+		t.Errorf("keyring(5) after revoke: got %v, want %v", err, ErrUnknownKeyID)
+	}
+	if _, err := h.keys.Load().keyring(6); err != nil {
+		t.Errorf("keyring(6) after revoking 5: %v", err)
+	}
+
+	// Invalid upstreams leave the current chain in place
+	invalid := revoked
+	invalid.UpstreamType = "bogus"
+	if err := h.Reload(&invalid); err == nil {
+		t.Error("Expected error for invalid upstream type")
+	}
+	if h.resolver.Load() != newChain {
+		t.Error("Failed reload replaced the upstream chain")
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,8 +27,20 @@ const (
 	ResolverTypeUDP ResolverType = "udp"
 	ResolverTypeDoH ResolverType = "doh"
 	ResolverTypeDoT ResolverType = "dot"
+
+	// ResolverTypeDoHJSON queries a DoH server in its JSON dialect
+	ResolverTypeDoHJSON ResolverType = "doh-json"
+
+	// ResolverTypeIterative resolves from the root servers itself
+	ResolverTypeIterative ResolverType = "iterative"
 )
 
+// dohJSONMaxResponse is the largest DoH JSON response read
+const dohJSONMaxResponse = 4 * tcpMaxMessageSize
+
+// flagCD is the Checking Disabled header flag
+const flagCD = 0x0010
+
 // Resolver performs real DNS resolution.
 type Resolver struct {
 	upstream     string
@@ -36,6 +53,21 @@ type Resolver struct {
 	// For DoT
 	tlsConfig *tls.Config
 	dotPool   *connPool
+
+	// For iterative resolution
+	iter *iterator
+
+	// caseRandomization sends UDP query names in random case (DNS 0x20)
+	caseRandomization bool
+
+	stats *upstreamStatsTracker
+
+	// failoverRcodes are answer rcodes treated as upstream failures
+	failoverRcodes map[uint16]bool
+
+	// ednsSize overrides the UDP payload size queries advertise to the
+	// upstream, 0 to keep the query's
+	ednsSize uint16
 }
 
 // NewResolver creates a new resolver.
@@ -44,13 +76,14 @@ func NewResolver(upstream string, resolverType string) (*Resolver, error) {
 		upstream:     upstream,
 		resolverType: ResolverType(resolverType),
 		timeout:      5 * time.Second,
+		stats:        newUpstreamStatsTracker(),
 	}
 
 	switch r.resolverType {
 	case ResolverTypeUDP:
 		// Nothing special to initialize
 
-	case ResolverTypeDoH:
+	case ResolverTypeDoH, ResolverTypeDoHJSON:
 		r.httpClient = &http.Client{
 			Timeout: r.timeout,
 			Transport: &http.Transport{
@@ -60,6 +93,9 @@ func NewResolver(upstream string, resolverType string) (*Resolver, error) {
 			},
 		}
 
+	case ResolverTypeIterative:
+		r.iter = newIterator(DefaultRootHints)
+
 	case ResolverTypeDoT:
 		host, _, err := net.SplitHostPort(upstream)
 		if err != nil {
@@ -81,19 +117,43 @@ func NewResolver(upstream string, resolverType string) (*Resolver, error) {
 
 // Resolve performs DNS resolution.
 func (r *Resolver) Resolve(ctx context.Context, query *dns.Message) (*dns.Message, error) {
+	_, response, err := r.exchange(ctx, query)
+	return response, err
+}
+
+// ResolveRaw performs DNS resolution and returns the upstream response
+// bytes unchanged apart from the ID, preserving DNSSEC signatures and
+// records the parser doesn't understand.
+func (r *Resolver) ResolveRaw(ctx context.Context, query *dns.Message) ([]byte, error) {
+	raw, _, err := r.exchange(ctx, query)
+	return raw, err
+}
+
+// exchange sends the query upstream and returns the response both as raw
+// bytes and parsed, with the ID set to that of the query.
+func (r *Resolver) exchange(ctx context.Context, query *dns.Message) ([]byte, *dns.Message, error) {
+	if r.ednsSize != 0 {
+		query = withEDNSSize(query, r.ednsSize)
+	}
+
 	// Marshal query
 	queryData, err := query.Marshal()
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal query: %w", err)
+		return nil, nil, fmt.Errorf("failed to marshal query: %w", err)
 	}
 
 	var respData []byte
+	start := time.Now()
 
 	switch r.resolverType {
 	case ResolverTypeUDP:
 		respData, err = r.resolveUDP(ctx, queryData)
+	case ResolverTypeIterative:
+		respData, err = r.resolveIterative(ctx, query)
 	case ResolverTypeDoH:
 		respData, err = r.resolveDoH(ctx, queryData)
+	case ResolverTypeDoHJSON:
+		respData, err = r.resolveDoHJSON(ctx, query)
 	case ResolverTypeDoT:
 		respData, err = r.resolveDoT(ctx, queryData)
 	default:
@@ -101,51 +161,59 @@ func (r *Resolver) Resolve(ctx context.Context, query *dns.Message) (*dns.Messag
 	}
 
 	if err != nil {
-		return nil, err
+		r.stats.record(r.upstream, queryTLD(query), 0, false)
+		return nil, nil, err
 	}
 
 	// Parse response
 	response, err := dns.ParseMessage(respData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+		r.stats.record(r.upstream, queryTLD(query), 0, false)
+		return nil, nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
 	// Ensure response ID matches query
 	response.ID = query.ID
+	binary.BigEndian.PutUint16(respData, query.ID)
+
+	// Apply the failover policy
+	if r.failoverRcodes[response.Rcode()] {
+		r.stats.record(r.upstream, queryTLD(query), 0, false)
+		return nil, nil, &RcodeError{Upstream: r.upstream, Rcode: response.Rcode(), Response: response, Raw: respData}
+	}
+
+	r.stats.record(r.upstream, queryTLD(query), time.Since(start), true)
 
-	return response, nil
+	return respData, response, nil
 }
 
-// resolveUDP resolves via UDP DNS.
+// resolveUDP resolves via UDP DNS, retrying over TCP when the answer is
+// truncated. With case randomization the query name is sent in random
+// case, only answers echoing it are accepted, and the original case is
+// restored in the answer.
 func (r *Resolver) resolveUDP(ctx context.Context, query []byte) ([]byte, error) {
-	// Create UDP connection
-	conn, err := net.Dial("udp", r.upstream)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect: %w", err)
+	send := query
+	if r.caseRandomization {
+		send = randomizeCase(query)
 	}
-	defer conn.Close()
 
-	// Set deadline from context
-	if deadline, ok := ctx.Deadline(); ok {
-		_ = conn.SetDeadline(deadline)
-	} else {
-		_ = conn.SetDeadline(time.Now().Add(r.timeout))
-	}
-
-	// Send query
-	_, err = conn.Write(query)
+	resp, err := exchangeUDPOrTCP(ctx, r.upstream, send, r.caseRandomization, r.timeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send query: %w", err)
+		return nil, err
 	}
+	restoreCase(resp, query)
 
-	// Read response
-	buf := make([]byte, dns.MaxEDNSSize)
-	n, err := conn.Read(buf)
+	return resp, nil
+}
+
+// resolveIterative resolves from the root servers and returns the
+// response in wire format.
+func (r *Resolver) resolveIterative(ctx context.Context, query *dns.Message) ([]byte, error) {
+	resp, err := r.iter.resolve(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, err
 	}
-
-	return buf[:n], nil
+	return resp.Marshal()
 }
 
 // resolveDoH resolves via DNS over HTTPS.
@@ -170,15 +238,83 @@ func (r *Resolver) resolveDoH(ctx context.Context, query []byte) ([]byte, error)
 		return nil, fmt.Errorf("DoH returned status: %d", resp.StatusCode)
 	}
 
-	// Read response
-	respData, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxEDNSSize))
+	// Read response, which like TCP responses may be up to 64 KiB
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, tcpMaxMessageSize+1))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
+	if len(respData) > tcpMaxMessageSize {
+		return nil, fmt.Errorf("response too large")
+	}
 
 	return respData, nil
 }
 
+// resolveDoHJSON resolves via a DoH server's JSON dialect, asking for the
+// question's name and type, and returns the answer in wire format. The
+// dialect has no EDNS, so DNSSEC records aren't asked for and answers
+// carry no OPT record, except for an Extended DNS Error when records
+// whose data couldn't be parsed were left out of an EDNS query's answer.
+func (r *Resolver) resolveDoHJSON(ctx context.Context, query *dns.Message) ([]byte, error) {
+	if len(query.Question) != 1 {
+		return nil, fmt.Errorf("DoH JSON queries take exactly one question")
+	}
+	q := query.Question[0]
+
+	u, err := url.Parse(r.upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoH URL: %w", err)
+	}
+	params := u.Query()
+	params.Set("name", dns.FormatName(q.Name))
+	params.Set("type", strconv.Itoa(int(q.Type)))
+	if query.Flags&flagCD != 0 {
+		params.Set("cd", "1")
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", dns.JSONContentType)
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH returned status: %d", resp.StatusCode)
+	}
+
+	// Presentation format is larger than wire format, so allow more
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohJSONMaxResponse+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if len(body) > dohJSONMaxResponse {
+		return nil, fmt.Errorf("response too large")
+	}
+
+	var answer dns.JSONMessage
+	if err := json.Unmarshal(body, &answer); err != nil {
+		return nil, fmt.Errorf("invalid DoH JSON response: %w", err)
+	}
+	msg, dropped, err := dns.FromJSON(&answer, query.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoH JSON response: %w", err)
+	}
+	if dropped > 0 {
+		if size := query.GetEDNS0Size(); size > 0 {
+			msg.SetEDNS0(size, false, dns.NewExtendedErrorOption(dns.EDEOther,
+				fmt.Sprintf("%d records of the DoH JSON answer could not be converted", dropped)))
+		}
+	}
+	return msg.Marshal()
+}
+
 // resolveDoT resolves via DNS over TLS.
 func (r *Resolver) resolveDoT(ctx context.Context, query []byte) ([]byte, error) {
 	// Get connection from pool or create new one
@@ -194,6 +330,10 @@ func (r *Resolver) resolveDoT(ctx context.Context, query []byte) ([]byte, error)
 		_ = conn.SetDeadline(time.Now().Add(r.timeout))
 	}
 
+	// Abort the exchange when ctx is canceled, e.g. on shutdown
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
 	// Send length-prefixed query (TCP DNS format)
 	lenBuf := []byte{byte(len(query) >> 8), byte(len(query))}
 	_, err = conn.Write(append(lenBuf, query...))
@@ -211,11 +351,6 @@ func (r *Resolver) resolveDoT(ctx context.Context, query []byte) ([]byte, error)
 	}
 
 	respLen := int(respLenBuf[0])<<8 | int(respLenBuf[1])
-	if respLen > dns.MaxEDNSSize {
-		conn.Close()
-		return nil, fmt.Errorf("response too large: %d", respLen)
-	}
-
 	respData := make([]byte, respLen)
 	_, err = io.ReadFull(conn, respData)
 	if err != nil {
@@ -223,8 +358,13 @@ func (r *Resolver) resolveDoT(ctx context.Context, query []byte) ([]byte, error)
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	// Return connection to pool
-	r.dotPool.put(conn)
+	// Return connection to pool, unless ctx was canceled meanwhile and
+	// set its deadline
+	if stop() {
+		r.dotPool.put(conn)
+	} else {
+		conn.Close()
+	}
 
 	return respData, nil
 }
@@ -246,6 +386,81 @@ func (r *Resolver) getDoTConnection() (net.Conn, error) {
 	return conn, nil
 }
 
+// SetFailoverRcodes sets the answer rcodes that are treated as failures.
+// Answers with these rcodes are returned wrapped in an *RcodeError.
+func (r *Resolver) SetFailoverRcodes(rcodes []uint16) {
+	r.failoverRcodes = make(map[uint16]bool, len(rcodes))
+	for _, rcode := range rcodes {
+		r.failoverRcodes[rcode] = true
+	}
+}
+
+// SetEDNSSize overrides the UDP payload size queries with an OPT record
+// advertise to the upstream; 0 keeps the size of each query.
+func (r *Resolver) SetEDNSSize(size uint16) {
+	r.ednsSize = size
+}
+
+// SetLatencySample records the latency of only 1 in n successful queries
+// for the latency percentiles of Stats; 0 or 1 records every latency.
+func (r *Resolver) SetLatencySample(n int) {
+	r.stats.latencySample.SetRate(n)
+}
+
+// withEDNSSize returns a copy of query whose OPT record, if it has one,
+// advertises size.
+func withEDNSSize(query *dns.Message, size uint16) *dns.Message {
+	out := *query
+	out.Additional = slices.Clone(query.Additional)
+	for i := range out.Additional {
+		if out.Additional[i].Type == dns.RRTypeOPT {
+			out.Additional[i].Class = size
+		}
+	}
+	return &out
+}
+
+// SetCaseRandomization enables DNS 0x20 case randomization of query names
+// sent over UDP, including iterative queries.
+func (r *Resolver) SetCaseRandomization(enabled bool) {
+	r.caseRandomization = enabled
+	if r.iter != nil {
+		r.iter.randomizeCase = enabled
+	}
+}
+
+// SetQNameMinimization enables QNAME minimization (RFC 9156) for iterative
+// resolution.
+func (r *Resolver) SetQNameMinimization(enabled bool) {
+	if r.iter != nil {
+		r.iter.minimize = enabled
+	}
+}
+
+// SetRootHints sets the root server addresses iterative resolution starts
+// at.
+func (r *Resolver) SetRootHints(hints []string) {
+	if r.iter != nil && len(hints) > 0 {
+		r.iter.roots = hints
+	}
+}
+
+// GetStats returns per-upstream, per-TLD latency and failure statistics.
+func (r *Resolver) GetStats() []UpstreamStats {
+	return r.stats.snapshot()
+}
+
+// FlushConnections closes the idle DoT and DoH connections, so the next
+// queries connect to the upstream again.
+func (r *Resolver) FlushConnections() {
+	if r.dotPool != nil {
+		r.dotPool.close()
+	}
+	if r.httpClient != nil {
+		r.httpClient.CloseIdleConnections()
+	}
+}
+
 // Close closes the resolver.
 func (r *Resolver) Close() {
 	if r.dotPool != nil {
@@ -307,12 +522,25 @@ func (p *connPool) close() {
 // Formats:
 // - "8.8.8.8:53" or "8.8.8.8" (UDP DNS)
 // - "https://dns.google/dns-query" (DoH)
+// - "https://dns.google/resolve" or with ?ct=application/dns-json (DoH JSON)
 // - "dns.google:853" (DoT)
+// - "iterative" (resolve from the root servers)
 func ParseUpstreamConfig(config string) (upstream string, resolverType string, error error) {
 	config = strings.TrimSpace(config)
 
+	if config == string(ResolverTypeIterative) {
+		return config, string(ResolverTypeIterative), nil
+	}
+
 	// Check for DoH
 	if strings.HasPrefix(config, "https://") {
+		u, err := url.Parse(config)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid DoH URL %q: %w", config, err)
+		}
+		if strings.HasSuffix(u.Path, "/resolve") || u.Query().Get("ct") == dns.JSONContentType {
+			return config, string(ResolverTypeDoHJSON), nil
+		}
 		return config, "doh", nil
 	}
 
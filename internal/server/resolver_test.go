@@ -1,9 +1,16 @@
 package server
 
 import (
+	"context"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"testing"
 	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
 )
 
 func TestParseUpstreamConfig(t *testing.T) {
@@ -35,6 +42,20 @@ func TestParseUpstreamConfig(t *testing.T) {
 			wantType:     "doh",
 			wantErr:      false,
 		},
+		{
+			name:         "DoH JSON URL",
+			config:       "https://dns.google/resolve",
+			wantUpstream: "https://dns.google/resolve",
+			wantType:     "doh-json",
+			wantErr:      false,
+		},
+		{
+			name:         "DoH JSON content type",
+			config:       "https://cloudflare-dns.com/dns-query?ct=application/dns-json",
+			wantUpstream: "https://cloudflare-dns.com/dns-query?ct=application/dns-json",
+			wantType:     "doh-json",
+			wantErr:      false,
+		},
 		{
 			name:         "DoT with port",
 			config:       "dns.google:853",
@@ -49,6 +70,13 @@ func TestParseUpstreamConfig(t *testing.T) {
 			wantType:     "udp",
 			wantErr:      false,
 		},
+		{
+			name:         "Iterative",
+			config:       "iterative",
+			wantUpstream: "iterative",
+			wantType:     "iterative",
+			wantErr:      false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -131,6 +159,65 @@ func TestNewResolver(t *testing.T) {
 	}
 }
 
+func TestResolveDoHJSON(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept") != dns.JSONContentType || req.URL.Query().Get("name") != "example.com." {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dns.JSONContentType)
+		switch req.URL.Query().Get("type") {
+		case "28":
+			io.WriteString(w, `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,
+				"Question":[{"name":"example.com.","type":28}],
+				"Answer":[{"name":"example.com.","type":28,"TTL":300,"data":"2001:db8::1"}]}`)
+		case "65":
+			// As Google Public DNS answers, with an NSEC record, which
+			// can't be converted
+			io.WriteString(w, `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":true,"CD":false,
+				"Question":[{"name":"example.com.","type":65}],
+				"Answer":[{"name":"example.com.","type":65,"TTL":300,"data":"1 . alpn=h3,h2 ipv4hint=192.0.2.1"}],
+				"Authority":[{"name":"example.com.","type":47,"TTL":300,"data":"\\000.example.com. RRSIG NSEC"}]}`)
+		default:
+			http.Error(w, "unexpected type", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	r, err := NewResolver(server.URL+"/resolve", string(ResolverTypeDoHJSON))
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	r.httpClient = server.Client()
+
+	name, _ := dns.ParseName("example.com")
+	resp, err := r.Resolve(context.Background(), dns.CreateQuery(name, dns.RRTypeAAAA, 42))
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if resp.ID != 42 || len(resp.Answer) != 1 || resp.Answer[0].TTL != 300 {
+		t.Fatalf("response = %+v", resp)
+	}
+	if addr, err := dns.DecodeAddrData(resp.Answer[0].Data); err != nil || addr != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("answer = %v, %v", addr, err)
+	}
+
+	// Records that can't be converted are left out, with an Extended DNS
+	// Error for EDNS queries
+	query := dns.CreateQuery(name, dns.RRTypeHTTPS, 43)
+	query.AddEDNS0(1232)
+	resp, err = r.Resolve(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Resolve(HTTPS) error = %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Type != dns.RRTypeHTTPS || len(resp.Authority) != 0 {
+		t.Fatalf("HTTPS response = %+v", resp)
+	}
+	if code, _, ok := resp.ExtendedError(); !ok || code != dns.EDEOther {
+		t.Errorf("ExtendedError() = %d, %v, want %d", code, ok, dns.EDEOther)
+	}
+}
+
 func TestConnPool(t *testing.T) {
 	pool := newConnPool(5, time.Second)
 
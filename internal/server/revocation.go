@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+const (
+	// revocationCheckInterval is how often the revocation list file is
+	// checked for changes
+	revocationCheckInterval = 30 * time.Second
+
+	// revocationBucket is the storage bucket of the last revocation list
+	// read, under revocationKey
+	revocationBucket = "revocations"
+	revocationKey    = "list"
+)
+
+var ErrKeyRevoked = errors.New("key revoked")
+
+// revocationList is a set of revoked key IDs read from a file. A nil
+// *revocationList revokes nothing.
+type revocationList struct {
+	ids     map[dns.KeyID]struct{}
+	modTime time.Time // of the file when read
+}
+
+// readRevocationList reads a revocation list file with one key ID per
+// line. Text after # is a comment.
+func readRevocationList(path string) (*revocationList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocation list: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocation list: %w", err)
+	}
+
+	l := &revocationList{ids: make(map[dns.KeyID]struct{}), modTime: info.ModTime()}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(line, 10, 16)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("%s:%d: %w %q", path, lineNum, crypto.ErrInvalidKeyID, line)
+		}
+		l.ids[dns.KeyID(id)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read revocation list: %w", err)
+	}
+	return l, nil
+}
+
+// saveRevocationList stores the key IDs of a revocation list, so they
+// stay revoked if the file can't be read at the next start. Failures are
+// logged.
+func saveRevocationList(store storage.Store, l *revocationList) {
+	var data []byte
+	for _, id := range slices.Sorted(maps.Keys(l.ids)) {
+		data = binary.BigEndian.AppendUint16(data, uint16(id))
+	}
+	if err := store.Put(revocationBucket, revocationKey, data); err != nil {
+		log.Printf("Failed to save revocation list: %v", err)
+	}
+}
+
+// savedRevocationList returns the revocation list last saved in store.
+// Its modification time is zero, so the file replaces it as soon as it
+// can be read.
+func savedRevocationList(store storage.Store) (*revocationList, bool) {
+	data, err := store.Get(revocationBucket, revocationKey)
+	if err != nil || len(data)%2 != 0 {
+		return nil, false
+	}
+	l := &revocationList{ids: make(map[dns.KeyID]struct{})}
+	for ; len(data) > 0; data = data[2:] {
+		l.ids[dns.KeyID(binary.BigEndian.Uint16(data))] = struct{}{}
+	}
+	return l, true
+}
+
+// loadRevocationList reads the revocation list file and saves it in
+// store. If the file can't be read, the list saved by a previous run is
+// used until it can, rather than start with keys unrevoked; without one,
+// the error is returned.
+func loadRevocationList(path string, store storage.Store) (*revocationList, error) {
+	l, err := readRevocationList(path)
+	if err == nil {
+		saveRevocationList(store, l)
+		return l, nil
+	}
+	saved, ok := savedRevocationList(store)
+	if !ok {
+		return nil, err
+	}
+	log.Printf("Using the saved revocation list of %d key IDs: %v", len(saved.ids), err)
+	return saved, nil
+}
+
+// revoked reports whether a key ID is revoked.
+func (l *revocationList) revoked(id dns.KeyID) bool {
+	if l == nil {
+		return false
+	}
+	_, ok := l.ids[id]
+	return ok
+}
+
+// revocationLoop re-reads the revocation list file whenever it changes,
+// until the handler stops. A list that fails to read is logged and the
+// previous one kept.
+func (h *Handler) revocationLoop() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(revocationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.reloadRevocations()
+	}
+}
+
+// reloadRevocations re-reads the revocation list file if it changed.
+func (h *Handler) reloadRevocations() {
+	path := h.config.RevocationFile
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Failed to check revocation list: %v", err)
+		return
+	}
+	if info.ModTime().Equal(h.revocations.Load().modTime) {
+		return
+	}
+
+	l, err := readRevocationList(path)
+	if err != nil {
+		log.Printf("Keeping the previous revocation list: %v", err)
+		return
+	}
+	h.revocations.Store(l)
+	saveRevocationList(h.store, l)
+	log.Printf("Revocation list reloaded: %d key IDs revoked", len(l.ids))
+}
+
+// keyRejected reports whether err rejects an authentic message because
+// the server no longer accepts its key.
+func keyRejected(err error) bool {
+	return errors.Is(err, ErrKeyRevoked) || errors.Is(err, crypto.ErrKeyExpired) ||
+		errors.Is(err, crypto.ErrKeyOutsideHours)
+}
+
+// keyRejectedReply returns the encrypted reply to a tunneled query whose
+// key was rejected: REFUSED with an EDEKeyRejected error naming the
+// reason, so the client can tell its user to get a new key. Only the
+// holder of the key can read it.
+func (h *Handler) keyRejectedReply(ctx context.Context, cipher *crypto.Cipher, clientID dns.ClientID, flags byte, query []byte, id uint16, reason error) ([]*dns.Fragment, error) {
+	if flags&dns.FragmentFlagCompressed != 0 {
+		var err error
+		if query, err = dns.Decompress(query); err != nil {
+			return nil, fmt.Errorf("failed to decompress query: %w", err)
+		}
+	}
+	originalQuery, err := dns.ParseMessage(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse original query: %w", err)
+	}
+
+	return h.refusedReply(ctx, cipher, clientID, originalQuery, id, dns.EDEKeyRejected, reason.Error())
+}
+
+// refusedReply returns the encrypted fragments of a REFUSED response to a
+// tunneled query, explained by an Extended DNS Error.
+func (h *Handler) refusedReply(ctx context.Context, cipher *crypto.Cipher, clientID dns.ClientID, query *dns.Message, id uint16, code uint16, text string) ([]*dns.Fragment, error) {
+	resp := dns.CreateResponse(query)
+	resp.SetRcode(dns.RcodeRefused)
+	resp.SetEDNS0(dns.EDNSMinUDPSize, false, dns.NewExtendedErrorOption(code, text))
+	data, err := resp.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return h.encryptReply(ctx, cipher, clientID, data, id, 0)
+}
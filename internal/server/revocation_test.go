@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+func TestReadRevocationList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, []byte("# revoked\n3 # lost phone\n\n17\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	l, err := readRevocationList(path)
+	if err != nil {
+		t.Fatalf("readRevocationList() error = %v", err)
+	}
+	for id, want := range map[uint16]bool{3: true, 17: true, 4: false} {
+		if got := l.revoked(dns.KeyID(id)); got != want {
+			t.Errorf("revoked(%d) = %v, want %v", id, got, want)
+		}
+	}
+
+	var none *revocationList
+	if none.revoked(3) {
+		t.Error("nil list revokes key IDs")
+	}
+
+	if err := os.WriteFile(path, []byte("0\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := readRevocationList(path); !errors.Is(err, crypto.ErrInvalidKeyID) {
+		t.Errorf("readRevocationList() error = %v, want ErrInvalidKeyID", err)
+	}
+}
+
+func TestReloadRevocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, []byte("3\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	h := newTestHandler(t, func(c *Config) { c.RevocationFile = path })
+
+	// Changed files are re-read; invalid ones keep the previous list
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(path, []byte("4\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	_ = os.Chtimes(path, later, later)
+	h.reloadRevocations()
+	if l := h.revocations.Load(); l.revoked(3) || !l.revoked(4) {
+		t.Error("Changed revocation list not reloaded")
+	}
+
+	if err := os.WriteFile(path, []byte("bogus\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	later = later.Add(time.Minute)
+	_ = os.Chtimes(path, later, later)
+	h.reloadRevocations()
+	if !h.revocations.Load().revoked(4) {
+		t.Error("Invalid revocation list replaced the previous one")
+	}
+}
+
+func TestLoadRevocationList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	store := storage.NewMemory()
+	if _, err := loadRevocationList(path, store); err == nil {
+		t.Fatal("loadRevocationList() of a missing file without a saved list succeeded")
+	}
+
+	if err := os.WriteFile(path, []byte("3\n17\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := loadRevocationList(path, store); err != nil {
+		t.Fatalf("loadRevocationList() error = %v", err)
+	}
+
+	// A list that can't be read at the next start falls back to the saved
+	// one, so its keys stay revoked
+	if err := os.WriteFile(path, []byte("bogus\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	l, err := loadRevocationList(path, store)
+	if err != nil {
+		t.Fatalf("loadRevocationList() with a saved list error = %v", err)
+	}
+	if !l.revoked(3) || !l.revoked(17) || l.revoked(4) || !l.modTime.IsZero() {
+		t.Errorf("saved list = %+v", l)
+	}
+}
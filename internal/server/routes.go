@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// upstreamRoute sends queries for names under a domain to an upstream of
+// its own.
+type upstreamRoute struct {
+	suffix dns.Name
+	chain  *upstreamChain
+}
+
+// LoadUpstreamRoutes reads an upstream routing table from path (see
+// ParseUpstreamRoutes).
+func LoadUpstreamRoutes(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream routes: %w", err)
+	}
+	defer f.Close()
+
+	routes, err := ParseUpstreamRoutes(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return routes, nil
+}
+
+// ParseUpstreamRoutes parses an upstream routing table, one route per
+// line: a domain, optionally written *.domain, and the upstream in the
+// ParseUpstreamConfig format that resolves it and its subdomains. Text
+// after '#' is a comment. The routes are returned keyed by domain in lower
+// case.
+func ParseUpstreamRoutes(r io.Reader) (map[string]string, error) {
+	routes := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%d: want a domain and an upstream", lineNum)
+		}
+
+		suffix, err := dns.ParseName(strings.TrimPrefix(fields[0], "*."))
+		if err != nil {
+			return nil, fmt.Errorf("%d: invalid domain: %w", lineNum, err)
+		}
+		if len(suffix) == 0 {
+			return nil, fmt.Errorf("%d: the root is routed to -upstream", lineNum)
+		}
+		if _, _, err := ParseUpstreamConfig(fields[1]); err != nil {
+			return nil, fmt.Errorf("%d: invalid upstream: %w", lineNum, err)
+		}
+
+		domain := strings.ToLower(suffix.String())
+		if _, ok := routes[domain]; ok {
+			return nil, fmt.Errorf("%d: %s routed twice", lineNum, domain)
+		}
+		routes[domain] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	return routes, nil
+}
+
+// newUpstreamRoutes creates the chains of the upstream routes in config,
+// most specific domain first.
+func newUpstreamRoutes(config *Config) ([]upstreamRoute, error) {
+	var routes []upstreamRoute
+	for domain, upstream := range config.UpstreamRoutes {
+		suffix, err := dns.ParseName(domain)
+		if err != nil {
+			closeRoutes(routes)
+			return nil, fmt.Errorf("invalid routed domain %s: %w", domain, err)
+		}
+		chain, err := newNamedUpstream(config, upstream)
+		if err != nil {
+			closeRoutes(routes)
+			return nil, fmt.Errorf("invalid upstream for %s: %w", domain, err)
+		}
+		routes = append(routes, upstreamRoute{suffix: suffix, chain: chain})
+	}
+	slices.SortFunc(routes, func(a, b upstreamRoute) int { return len(b.suffix) - len(a.suffix) })
+	return routes, nil
+}
+
+// closeRoutes closes the chains of routes.
+func closeRoutes(routes []upstreamRoute) {
+	for _, route := range routes {
+		route.chain.Close()
+	}
+}
+
+// route returns the chain to resolve a query for name with: that of the
+// most specific route covering it, or c itself.
+func (c *upstreamChain) route(name dns.Name) *upstreamChain {
+	for _, route := range c.routes {
+		if _, ok := name.TrimSuffix(route.suffix); ok {
+			return route.chain
+		}
+	}
+	return c
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestParseUpstreamRoutes(t *testing.T) {
+	table := `# domain        upstream
+*.Corp.Example     10.0.0.53:53
+lab.corp.example   https://dns.lab.example/dns-query   # more specific
+
+`
+	routes, err := ParseUpstreamRoutes(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("ParseUpstreamRoutes() error = %v", err)
+	}
+	want := map[string]string{
+		"corp.example":     "10.0.0.53:53",
+		"lab.corp.example": "https://dns.lab.example/dns-query",
+	}
+	if !maps.Equal(routes, want) {
+		t.Errorf("ParseUpstreamRoutes() = %v, want %v", routes, want)
+	}
+
+	if routes, err := ParseUpstreamRoutes(strings.NewReader("# nothing\n")); err != nil || routes != nil {
+		t.Errorf("ParseUpstreamRoutes() of an empty table = %v, %v, want nil", routes, err)
+	}
+	for _, table := range []string{
+		"corp.example",
+		"corp.example 10.0.0.53:53 extra",
+		". 10.0.0.53:53",
+		"corp.example 10.0.0.53:53\nCORP.example 10.0.0.54:53",
+	} {
+		if _, err := ParseUpstreamRoutes(strings.NewReader(table)); err == nil {
+			t.Errorf("ParseUpstreamRoutes(%q) accepted an invalid table", table)
+		}
+	}
+}
+
+func TestUpstreamForRoutes(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.NamedUpstreams = map[string]string{"eu": "9.9.9.9:53"}
+		c.UpstreamRoutes = map[string]string{
+			"corp.example":     "10.0.0.53:53",
+			"lab.corp.example": "10.0.1.53:53",
+		}
+	})
+	config := h.config
+	shared, _ := crypto.NewKeyring([][]byte{config.SharedSecret}, false)
+
+	tests := []struct {
+		name string
+		hint string
+		want string
+	}{
+		{"corp.example", "", "10.0.0.53:53"},
+		{"WWW.Corp.Example", "", "10.0.0.53:53"},
+		{"host.lab.corp.example", "", "10.0.1.53:53"},
+		{"notcorp.example", "", config.UpstreamResolver},
+		{"www.example.com", "", config.UpstreamResolver},
+		{"www.corp.example", "eu", "9.9.9.9:53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.CreateQuery(mustParseName(t, tt.name), dns.RRTypeA, 1)
+			if tt.hint != "" {
+				query = query.WithUpstreamHint(tt.hint)
+			}
+			chain, err := h.upstreamFor(shared, query)
+			if err != nil {
+				t.Fatalf("upstreamFor() error = %v", err)
+			}
+			if got := chain.resolvers[0].upstream; got != tt.want {
+				t.Errorf("upstreamFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+)
+
+// Response rate limiting defaults
+const (
+	// DefaultRRLLimit is the number of error responses per second allowed
+	// for a client network
+	DefaultRRLLimit = 5
+
+	// DefaultRRLSlip answers every second limited response with a
+	// truncated reply so legitimate clients can retry over TCP
+	DefaultRRLSlip = 2
+
+	// DefaultRRLAmplification is the ratio of response to query bytes a
+	// client network may receive over UDP each second for queries that
+	// aren't tunnel queries
+	DefaultRRLAmplification = 2
+
+	// rrlAmplificationAllowance is the response bytes per second a client
+	// network may receive whatever the ratio, so a single large answer
+	// such as a DNSKEY set isn't limited
+	rrlAmplificationAllowance = 1232
+
+	// rrlTunnelAmplification and rrlTunnelAllowance are the ratio and
+	// allowance for tunnel responses, which only answer queries made with
+	// the shared secret. Fetch queries are about 75 bytes and fetch
+	// whole fragments of about 1 KiB
+	rrlTunnelAmplification = 16
+	rrlTunnelAllowance     = 8192
+
+	// rrlIPv4PrefixLen and rrlIPv6PrefixLen group clients into networks,
+	// since spoofed sources are usually spread over one
+	rrlIPv4PrefixLen = 24
+	rrlIPv6PrefixLen = 56
+)
+
+// RRLAction is what to do with a rate limited response.
+type RRLAction int
+
+const (
+	// RRLSend sends the response
+	RRLSend RRLAction = iota
+
+	// RRLDrop drops the response
+	RRLDrop
+
+	// RRLSlip sends a truncated response instead
+	RRLSlip
+)
+
+// rrlKey identifies a response rate limiting bucket.
+type rrlKey struct {
+	network netip.Prefix
+	rcode   uint16
+}
+
+// rrlBucket counts responses in the current window.
+type rrlBucket struct {
+	count       int
+	limited     int
+	windowStart time.Time
+}
+
+// ResponseRateLimiter implements authoritative response rate limiting for
+// error responses, so the server can't be used to reflect NXDOMAIN and
+// error floods at a spoofed victim. Responses over the limit are dropped,
+// except every slip-th one which is answered truncated.
+type ResponseRateLimiter struct {
+	limit     int
+	slip      int
+	window    time.Duration
+	buckets   map[rrlKey]*rrlBucket
+	lastSweep time.Time
+	clock     clock.Clock
+	mu        sync.Mutex
+}
+
+// NewResponseRateLimiter creates a response rate limiter allowing limit
+// responses per second for each client network and rcode. A limit of 0
+// disables rate limiting; a slip of 0 drops all limited responses.
+func NewResponseRateLimiter(limit, slip int) *ResponseRateLimiter {
+	return &ResponseRateLimiter{
+		limit:   limit,
+		slip:    slip,
+		window:  time.Second,
+		buckets: make(map[rrlKey]*rrlBucket),
+		clock:   clock.System,
+	}
+}
+
+// Check accounts for an error response with rcode to ip and returns what
+// to do with it.
+func (r *ResponseRateLimiter) Check(ip netip.Addr, rcode uint16) RRLAction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.limit <= 0 || !ip.IsValid() {
+		return RRLSend
+	}
+
+	key := rrlKey{network: clientNetwork(ip), rcode: rcode}
+
+	now := r.clock.Now()
+	r.sweep(now)
+
+	b, ok := r.buckets[key]
+	if !ok || now.Sub(b.windowStart) >= r.window {
+		r.buckets[key] = &rrlBucket{count: 1, windowStart: now}
+		return RRLSend
+	}
+
+	if b.count < r.limit {
+		b.count++
+		return RRLSend
+	}
+
+	b.limited++
+	if r.slip > 0 && b.limited%r.slip == 0 {
+		return RRLSlip
+	}
+	return RRLDrop
+}
+
+// SetLimits changes the rate limit and slip.
+func (r *ResponseRateLimiter) SetLimits(limit, slip int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = limit
+	r.slip = slip
+}
+
+// SetClock sets the clock windows are timed with, clock.System if nil.
+func (r *ResponseRateLimiter) SetClock(clk clock.Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = clock.Or(clk)
+}
+
+// sweep drops buckets of past windows, at most once per window.
+func (r *ResponseRateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.window {
+		return
+	}
+	for k, b := range r.buckets {
+		if now.Sub(b.windowStart) >= r.window {
+			delete(r.buckets, k)
+		}
+	}
+	r.lastSweep = now
+}
+
+// rrlTrafficKey identifies the tunnel or other traffic of a client
+// network.
+type rrlTrafficKey struct {
+	network netip.Prefix
+	tunnel  bool
+}
+
+// rrlTraffic counts the bytes exchanged with a client network in the
+// current window.
+type rrlTraffic struct {
+	queryBytes    int
+	responseBytes int
+	limited       int
+	windowStart   time.Time
+}
+
+// AmplificationLimiter implements response rate limiting by size, so the
+// server can't be used to reflect traffic much larger than the spoofed
+// queries at a victim. It counts the query and response bytes of each
+// client network; once a network has received more than the allowance in
+// a second and more than ratio times the bytes it sent, further responses
+// are dropped, except every slip-th one which is answered truncated.
+//
+// Tunnel traffic is counted apart from other traffic, with a larger ratio
+// and allowance: a spoofer can't make tunnel queries without the shared
+// secret, while bulk transfers fetch fragments many times larger than the
+// queries for them. Spoofed queries can't use up the tunnel budget, and
+// tunnel clients can't lend theirs to spoofed queries from their network.
+type AmplificationLimiter struct {
+	ratio           int
+	slip            int
+	allowance       int
+	tunnelRatio     int
+	tunnelAllowance int
+	window          time.Duration
+	traffic         map[rrlTrafficKey]*rrlTraffic
+	lastSweep       time.Time
+	clock           clock.Clock
+	mu              sync.Mutex
+}
+
+// NewAmplificationLimiter creates an amplification limiter allowing
+// responses of up to ratio times the query bytes of each client network,
+// or rrlTunnelAmplification times for tunnel responses if that's more.
+// A ratio of 0 disables it; a slip of 0 drops all limited responses.
+func NewAmplificationLimiter(ratio, slip int) *AmplificationLimiter {
+	return &AmplificationLimiter{
+		ratio:           ratio,
+		slip:            slip,
+		allowance:       rrlAmplificationAllowance,
+		tunnelRatio:     rrlTunnelAmplification,
+		tunnelAllowance: rrlTunnelAllowance,
+		window:          time.Second,
+		traffic:         make(map[rrlTrafficKey]*rrlTraffic),
+		clock:           clock.System,
+	}
+}
+
+// Check accounts for a query of querySize bytes from ip and its response
+// of responseSize bytes, a tunnel response if tunnel is set, and returns
+// what to do with the response.
+func (a *AmplificationLimiter) Check(ip netip.Addr, querySize, responseSize int, tunnel bool) RRLAction {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ratio <= 0 || !ip.IsValid() {
+		return RRLSend
+	}
+
+	key := rrlTrafficKey{network: clientNetwork(ip), tunnel: tunnel}
+	ratio, allowance := a.ratio, a.allowance
+	if tunnel {
+		ratio, allowance = max(ratio, a.tunnelRatio), max(allowance, a.tunnelAllowance)
+	}
+
+	now := a.clock.Now()
+	a.sweep(now)
+
+	t, ok := a.traffic[key]
+	if !ok || now.Sub(t.windowStart) >= a.window {
+		t = &rrlTraffic{windowStart: now}
+		a.traffic[key] = t
+	}
+	t.queryBytes += querySize
+
+	sent := t.responseBytes + responseSize
+	if sent <= allowance || sent <= ratio*t.queryBytes {
+		t.responseBytes = sent
+		return RRLSend
+	}
+
+	t.limited++
+	if a.slip > 0 && t.limited%a.slip == 0 {
+		return RRLSlip
+	}
+	return RRLDrop
+}
+
+// SetLimits changes the ratio and slip.
+func (a *AmplificationLimiter) SetLimits(ratio, slip int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ratio = ratio
+	a.slip = slip
+}
+
+// SetClock sets the clock windows are timed with, clock.System if nil.
+func (a *AmplificationLimiter) SetClock(clk clock.Clock) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clock = clock.Or(clk)
+}
+
+// sweep drops the traffic of past windows, at most once per window.
+func (a *AmplificationLimiter) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.window {
+		return
+	}
+	for k, t := range a.traffic {
+		if now.Sub(t.windowStart) >= a.window {
+			delete(a.traffic, k)
+		}
+	}
+	a.lastSweep = now
+}
+
+// clientNetwork returns the /24 (IPv4) or /56 (IPv6) network of ip.
+func clientNetwork(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	bits := rrlIPv6PrefixLen
+	if ip.Is4() {
+		bits = rrlIPv4PrefixLen
+	}
+	network, _ := ip.Prefix(bits)
+	return network
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestResponseRateLimiter(t *testing.T) {
+	rrl := NewResponseRateLimiter(3, 2)
+	ip := netip.MustParseAddr("198.51.100.7")
+
+	var got []RRLAction
+	for i := 0; i < 7; i++ {
+		got = append(got, rrl.Check(ip, dns.RcodeNameError))
+	}
+
+	want := []RRLAction{RRLSend, RRLSend, RRLSend, RRLDrop, RRLSlip, RRLDrop, RRLSlip}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Response %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// Buckets are per network and rcode
+	if a := rrl.Check(netip.MustParseAddr("198.51.100.200"), dns.RcodeNameError); a == RRLSend {
+		t.Error("Address in the same /24 was not limited")
+	}
+	if a := rrl.Check(netip.MustParseAddr("198.51.101.7"), dns.RcodeNameError); a != RRLSend {
+		t.Errorf("Other network: got %v, want %v", a, RRLSend)
+	}
+	if a := rrl.Check(ip, dns.RcodeServerFail); a != RRLSend {
+		t.Errorf("Other rcode: got %v, want %v", a, RRLSend)
+	}
+}
+
+func TestResponseRateLimiterWindow(t *testing.T) {
+	rrl := NewResponseRateLimiter(1, 0)
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	rrl.SetClock(clk)
+	ip := netip.MustParseAddr("2001:db8::1")
+
+	if a := rrl.Check(ip, dns.RcodeNameError); a != RRLSend {
+		t.Fatalf("First response: got %v, want %v", a, RRLSend)
+	}
+	// Slip 0 drops all limited responses; the /56 groups these addresses
+	if a := rrl.Check(netip.MustParseAddr("2001:db8:0:ff::1"), dns.RcodeNameError); a != RRLDrop {
+		t.Errorf("Limited response: got %v, want %v", a, RRLDrop)
+	}
+
+	clk.Advance(time.Second)
+	if a := rrl.Check(ip, dns.RcodeNameError); a != RRLSend {
+		t.Errorf("After window: got %v, want %v", a, RRLSend)
+	}
+}
+
+func TestResponseRateLimiterDisabled(t *testing.T) {
+	rrl := NewResponseRateLimiter(0, 2)
+	ip := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 100; i++ {
+		if a := rrl.Check(ip, dns.RcodeNameError); a != RRLSend {
+			t.Fatalf("Response %d: got %v, want %v", i, a, RRLSend)
+		}
+	}
+
+	rrl.SetLimits(1, 1)
+	rrl.Check(ip, dns.RcodeNameError)
+	if a := rrl.Check(ip, dns.RcodeNameError); a != RRLSlip {
+		t.Errorf("After SetLimits: got %v, want %v", a, RRLSlip)
+	}
+}
+
+func TestAmplificationLimiter(t *testing.T) {
+	a := NewAmplificationLimiter(10, 2)
+	a.allowance = 1000
+	ip := netip.MustParseAddr("198.51.100.7")
+
+	// The allowance is sent whatever the ratio
+	if got := a.Check(ip, 10, 1000, false); got != RRLSend {
+		t.Fatalf("Response within the allowance: got %v, want %v", got, RRLSend)
+	}
+	var got []RRLAction
+	for i := 0; i < 4; i++ {
+		got = append(got, a.Check(ip, 10, 1000, false))
+	}
+	want := []RRLAction{RRLDrop, RRLSlip, RRLDrop, RRLSlip}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Response %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// Responses within the ratio of the bytes the network sent are sent
+	if got := a.Check(netip.MustParseAddr("198.51.100.8"), 300, 1000, false); got != RRLSend {
+		t.Errorf("Response within the ratio: got %v, want %v", got, RRLSend)
+	}
+	if got := a.Check(netip.MustParseAddr("198.51.101.7"), 40, 1000, false); got != RRLSend {
+		t.Errorf("Other network: got %v, want %v", got, RRLSend)
+	}
+
+	a.SetLimits(0, 2)
+	if got := a.Check(ip, 10, 1000, false); got != RRLSend {
+		t.Errorf("Disabled: got %v, want %v", got, RRLSend)
+	}
+}
+
+func TestAmplificationLimiterTunnel(t *testing.T) {
+	a := NewAmplificationLimiter(DefaultRRLAmplification, 0)
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	a.SetClock(clk)
+	client := netip.MustParseAddr("198.51.100.7")
+	victim := netip.MustParseAddr("198.51.100.9")
+
+	// Sizes of tunnel traffic for t.example.com with 1232-byte responses:
+	// a full query fragment, acknowledgments of the first fragments of a
+	// long query, and fetches of a reply's remaining fragments
+	type exchange struct{ query, response int }
+	download := []exchange{{277, 320}, {277, 320}, {277, 1227}}
+	for range 30 {
+		download = append(download, exchange{75, 1025})
+	}
+
+	for second := range 3 {
+		// A download of about 32 KiB a second
+		for i, x := range download {
+			if got := a.Check(client, x.query, x.response, true); got != RRLSend {
+				t.Fatalf("Second %d, tunnel response %d: got %v, want %v", second, i, got, RRLSend)
+			}
+		}
+
+		// Spoofed queries for large answers from the same network get at
+		// most twice their bytes beyond the allowance, and don't limit
+		// the tunnel
+		sent := 0
+		for range 100 {
+			if a.Check(victim, 60, 1000, false) == RRLSend {
+				sent += 1000
+			}
+			if got := a.Check(client, 75, 1025, true); got != RRLSend {
+				t.Fatalf("Second %d: tunnel response after spoofed traffic: got %v, want %v", second, got, RRLSend)
+			}
+		}
+		if sent > rrlAmplificationAllowance+DefaultRRLAmplification*60*100 {
+			t.Errorf("Second %d: sent %d bytes to spoofed queries of 6000 bytes", second, sent)
+		}
+		clk.Advance(time.Second)
+	}
+
+	// Tunnel responses are limited too, if at a larger ratio
+	if got := a.Check(netip.MustParseAddr("203.0.113.1"), 10, 2*rrlTunnelAllowance, true); got != RRLDrop {
+		t.Errorf("Amplified tunnel response: got %v, want %v", got, RRLDrop)
+	}
+}
+
+func TestAmplificationLimiterWindow(t *testing.T) {
+	a := NewAmplificationLimiter(1, 0)
+	a.allowance = 100
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	a.SetClock(clk)
+	ip := netip.MustParseAddr("2001:db8::1")
+
+	if got := a.Check(ip, 50, 200, false); got != RRLDrop {
+		t.Fatalf("Amplified response: got %v, want %v", got, RRLDrop)
+	}
+	clk.Advance(time.Second)
+	if got := a.Check(ip, 50, 100, false); got != RRLSend {
+		t.Errorf("After window: got %v, want %v", got, RRLSend)
+	}
+}
+
+func TestLimitedErrorResponse(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.RRLLimit = 1
+		c.RRLSlip = 1
+	})
+	config := h.config
+
+	query := dns.CreateQuery(mustParseName(t, "random.other.example"), dns.RRTypeA, 0x1234)
+	data, _ := query.Marshal()
+
+	udp := &net.UDPAddr{IP: net.ParseIP("203.0.113.9"), Port: 5353}
+	first, err := dns.ParseMessage(h.handleQuery(data, udp, config.MaxUDPSize))
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if first.Rcode() != dns.RcodeNameError || first.Flags&0x0200 != 0 {
+		t.Errorf("First response: rcode %d, flags %#x", first.Rcode(), first.Flags)
+	}
+
+	second, err := dns.ParseMessage(h.handleQuery(data, udp, config.MaxUDPSize))
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if second.Flags&0x0200 == 0 {
+		t.Error("Limited response not truncated")
+	}
+
+	// TCP responses are never limited
+	tcp := &net.TCPAddr{IP: udp.IP, Port: 5353}
+	resp, err := dns.ParseMessage(h.handleQuery(data, tcp, tcpMaxMessageSize))
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if resp.Flags&0x0200 != 0 {
+		t.Error("TCP response truncated")
+	}
+}
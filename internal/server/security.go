@@ -1,104 +1,286 @@
 package server
 
 import (
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
 )
 
+// Rate limit defaults
+const (
+	// DefaultFailureRateLimit is the number of failed queries per second
+	// after which a client network's queries are dropped
+	DefaultFailureRateLimit = 10
+
+	// DefaultRateLimitIPv4Prefix and DefaultRateLimitIPv6Prefix group
+	// clients for rate limiting: IPv4 per address, since many users may
+	// share one behind NAT, and IPv6 per /64, which one client may use
+	// all of
+	DefaultRateLimitIPv4Prefix = 32
+	DefaultRateLimitIPv6Prefix = 64
+)
+
 // Security provides rate limiting and replay detection.
 type Security struct {
-	rateLimiter    *RateLimiter
-	replayDetector *crypto.ReplayDetector
+	rateLimiter     *RateLimiter
+	failureLimiter  *RateLimiter
+	responseLimiter *ResponseRateLimiter
+	amplification   *AmplificationLimiter
+	sources         *sourceValidator
+	replayDetector  *crypto.ReplayDetector
+	replays         atomic.Uint64
 }
 
-// NewSecurity creates a new security handler.
+// NewSecurity creates a new security handler limiting each address to
+// rateLimit queries per second. The failure limit, response rate limiting
+// and source challenges are disabled until SetFailureRateLimit,
+// SetResponseRateLimit and SetChallengeThreshold are called.
 func NewSecurity(rateLimit int) *Security {
 	return &Security{
-		rateLimiter:    NewRateLimiter(rateLimit, time.Second),
-		replayDetector: crypto.NewReplayDetector(crypto.ReplayWindow),
+		rateLimiter:     NewRateLimiter(rateLimit, 0),
+		failureLimiter:  NewRateLimiter(0, 0),
+		responseLimiter: NewResponseRateLimiter(0, 0),
+		amplification:   NewAmplificationLimiter(0, 0),
+		sources:         newSourceValidator(0),
+		replayDetector:  crypto.NewReplayDetector(crypto.ReplayWindow),
 	}
 }
 
-// CheckRateLimit checks if the request is within rate limits.
-func (s *Security) CheckRateLimit(ip string) bool {
-	return s.rateLimiter.Allow(ip)
+// CheckRateLimit checks if a query from ip is within rate limits: its
+// network has a token left and hasn't used up its failures.
+func (s *Security) CheckRateLimit(ip netip.Addr) bool {
+	return !s.failureLimiter.Limited(ip) && s.rateLimiter.Allow(ip)
+}
+
+// RecordFailure counts a query from ip that failed to decrypt or wasn't
+// tunnel traffic against its network's failure limit.
+func (s *Security) RecordFailure(ip netip.Addr) {
+	s.failureLimiter.Allow(ip)
+}
+
+// SetRateLimit changes the query rate limit and burst.
+func (s *Security) SetRateLimit(rate, burst int) {
+	s.rateLimiter.SetLimit(rate, burst)
+}
+
+// SetFailureRateLimit changes the rate and burst of failed queries after
+// which a network's queries are dropped.
+func (s *Security) SetFailureRateLimit(rate, burst int) {
+	s.failureLimiter.SetLimit(rate, burst)
+}
+
+// SetRateLimitPrefixes changes the prefix lengths grouping clients into
+// networks for the query and failure limits.
+func (s *Security) SetRateLimitPrefixes(v4Bits, v6Bits int) {
+	s.rateLimiter.SetPrefixes(v4Bits, v6Bits)
+	s.failureLimiter.SetPrefixes(v4Bits, v6Bits)
+}
+
+// CheckResponse applies response rate limiting to an error response.
+func (s *Security) CheckResponse(ip netip.Addr, rcode uint16) RRLAction {
+	return s.responseLimiter.Check(ip, rcode)
+}
+
+// SetResponseRateLimit changes the error response rate limit, the
+// amplification ratio and their slip.
+func (s *Security) SetResponseRateLimit(limit, ratio, slip int) {
+	s.responseLimiter.SetLimits(limit, slip)
+	s.amplification.SetLimits(ratio, slip)
+}
+
+// CheckAmplification applies response rate limiting by size to a UDP
+// response of responseSize bytes to a query of querySize bytes, a tunnel
+// response if tunnel is set.
+func (s *Security) CheckAmplification(ip netip.Addr, querySize, responseSize int, tunnel bool) RRLAction {
+	return s.amplification.Check(ip, querySize, responseSize, tunnel)
+}
+
+// CheckSource reports whether a UDP query from ip must be challenged to
+// retry over TCP before it is processed.
+func (s *Security) CheckSource(ip netip.Addr) bool {
+	return s.sources.suspicious(ip)
+}
+
+// RecordSourceError counts an error response to ip.
+func (s *Security) RecordSourceError(ip netip.Addr) {
+	s.sources.recordError(ip)
+}
+
+// RecordSourceValid marks ip as having completed a tunnel query.
+func (s *Security) RecordSourceValid(ip netip.Addr) {
+	s.sources.recordValid(ip)
+}
+
+// SetChallengeThreshold changes the error rate at which unvalidated
+// sources are challenged.
+func (s *Security) SetChallengeThreshold(threshold int) {
+	s.sources.setThreshold(threshold)
+}
+
+// SetClock sets the clock of the rate limiters, source challenges and
+// replay detection, clock.System if nil.
+func (s *Security) SetClock(clk clock.Clock) {
+	s.rateLimiter.SetClock(clk)
+	s.failureLimiter.SetClock(clk)
+	s.responseLimiter.SetClock(clk)
+	s.amplification.SetClock(clk)
+	s.sources.setClock(clk)
+	s.replayDetector.SetClock(clk)
 }
 
 // CheckReplay checks if the nonce has been seen before.
 func (s *Security) CheckReplay(nonce []byte) bool {
-	return s.replayDetector.Check(nonce)
+	if s.replayDetector.Check(nonce) {
+		s.replays.Add(1)
+		return true
+	}
+	return false
+}
+
+// MarkReplay records a nonce accepted elsewhere, such as by another
+// server instance, so later messages with it are rejected.
+func (s *Security) MarkReplay(nonce []byte) {
+	s.replayDetector.Check(nonce)
 }
 
-// RateLimiter implements a simple per-IP rate limiter.
+// Replays returns the number of replays detected.
+func (s *Security) Replays() uint64 {
+	return s.replays.Load()
+}
+
+// RateLimiter limits queries per client network with token buckets: each
+// network may send rate queries per second on average and burst at once.
+// Clients are grouped into networks by prefix length, per address by
+// default, so one client can't evade the limit by spreading its queries
+// over an IPv6 prefix.
 type RateLimiter struct {
-	limit    int
-	window   time.Duration
-	counters map[string]*counter
-	mu       sync.RWMutex
+	rate      float64
+	burst     float64
+	v4Bits    int
+	v6Bits    int
+	buckets   map[netip.Prefix]*tokenBucket
+	lastSweep time.Time
+	clock     clock.Clock
+	mu        sync.Mutex
 }
 
-type counter struct {
-	count       int
-	windowStart time.Time
+// tokenBucket holds the tokens of a network as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
 }
 
-// NewRateLimiter creates a new rate limiter.
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+// NewRateLimiter creates a rate limiter allowing rate queries per second
+// and bursts of burst queries per address. A rate of 0 disables the limit;
+// a burst below 1 allows bursts of one second's queries.
+func NewRateLimiter(rate, burst int) *RateLimiter {
 	rl := &RateLimiter{
-		limit:    limit,
-		window:   window,
-		counters: make(map[string]*counter),
+		v4Bits:  32,
+		v6Bits:  128,
+		buckets: make(map[netip.Prefix]*tokenBucket),
+		clock:   clock.System,
 	}
+	rl.SetLimit(rate, burst)
+	return rl
+}
 
-	// Start cleanup goroutine
-	go rl.cleanup()
+// SetClock sets the clock buckets are refilled by, clock.System if nil.
+func (rl *RateLimiter) SetClock(clk clock.Clock) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.clock = clock.Or(clk)
+}
 
-	return rl
+// SetLimit changes the rate and burst.
+func (rl *RateLimiter) SetLimit(rate, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if burst < 1 {
+		burst = rate
+	}
+	rl.rate = float64(rate)
+	rl.burst = float64(burst)
 }
 
-// Allow checks if a request from the given key should be allowed.
-func (rl *RateLimiter) Allow(key string) bool {
+// SetPrefixes changes the prefix lengths grouping IPv4 and IPv6 clients
+// into networks sharing a bucket. Buckets are started afresh.
+func (rl *RateLimiter) SetPrefixes(v4Bits, v6Bits int) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
+	if v4Bits != rl.v4Bits || v6Bits != rl.v6Bits {
+		rl.v4Bits, rl.v6Bits = v4Bits, v6Bits
+		clear(rl.buckets)
+	}
+}
 
-	now := time.Now()
+// Allow takes a token from ip's network and reports whether it had one.
+func (rl *RateLimiter) Allow(ip netip.Addr) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	c, ok := rl.counters[key]
-	if !ok || now.Sub(c.windowStart) >= rl.window {
-		// New window
-		rl.counters[key] = &counter{
-			count:       1,
-			windowStart: now,
-		}
+	b := rl.bucket(ip, rl.clock.Now())
+	if b == nil {
 		return true
 	}
-
-	// Existing window
-	if c.count >= rl.limit {
+	if b.tokens < 1 {
 		return false
 	}
-
-	c.count++
+	b.tokens--
 	return true
 }
 
-// cleanup removes old counters periodically.
-func (rl *RateLimiter) cleanup() {
-	ticker := time.NewTicker(rl.window * 2)
-	defer ticker.Stop()
+// Limited reports whether ip's network is out of tokens, without taking
+// one.
+func (rl *RateLimiter) Limited(ip netip.Addr) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	for range ticker.C {
-		rl.mu.Lock()
-		now := time.Now()
-		for key, c := range rl.counters {
-			if now.Sub(c.windowStart) >= rl.window*2 {
-				delete(rl.counters, key)
-			}
+	b := rl.bucket(ip, rl.clock.Now())
+	return b != nil && b.tokens < 1
+}
+
+// bucket returns ip's network's bucket refilled up to now, or nil if the
+// limit is disabled or ip invalid. The caller holds rl.mu.
+func (rl *RateLimiter) bucket(ip netip.Addr, now time.Time) *tokenBucket {
+	if rl.rate <= 0 || !ip.IsValid() {
+		return nil
+	}
+	rl.sweep(now)
+
+	ip = ip.Unmap()
+	bits := rl.v6Bits
+	if ip.Is4() {
+		bits = rl.v4Bits
+	}
+	network, _ := ip.Prefix(bits)
+
+	b, ok := rl.buckets[network]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[network] = b
+		return b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	return b
+}
+
+// sweep drops the buckets of networks that would be full again, at most
+// once a second, so idle networks don't take memory.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Second {
+		return
+	}
+	for network, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, network)
 		}
-		rl.mu.Unlock()
 	}
+	rl.lastSweep = now
 }
 
 // InputValidator validates incoming DNS messages.
@@ -1,8 +1,17 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
 	"testing"
 	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
 )
 
 func TestNewSecurity(t *testing.T) {
@@ -21,9 +30,9 @@ func TestNewSecurity(t *testing.T) {
 }
 
 func TestRateLimiter(t *testing.T) {
-	rl := NewRateLimiter(10, time.Second)
+	rl := NewRateLimiter(10, 0)
 
-	ip := "192.168.1.1"
+	ip := netip.MustParseAddr("192.168.1.1")
 
 	// Should allow first 10 requests
 	for i := 0; i < 10; i++ {
@@ -38,32 +47,82 @@ func TestRateLimiter(t *testing.T) {
 	}
 
 	// Different IP should be allowed
-	if !rl.Allow("192.168.1.2") {
+	if !rl.Allow(netip.MustParseAddr("192.168.1.2")) {
 		t.Error("Different IP should be allowed")
 	}
 }
 
-func TestRateLimiterWindow(t *testing.T) {
-	rl := NewRateLimiter(5, 100*time.Millisecond)
+func TestRateLimiterRefill(t *testing.T) {
+	rl := NewRateLimiter(20, 5)
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	rl.SetClock(clk)
 
-	ip := "192.168.1.1"
+	ip := netip.MustParseAddr("192.168.1.1")
 
-	// Use up the limit
+	// Use up the burst
 	for i := 0; i < 5; i++ {
-		rl.Allow(ip)
+		if !rl.Allow(ip) {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
 	}
 
 	// Should be denied
 	if rl.Allow(ip) {
-		t.Error("Should be denied after limit")
+		t.Error("Should be denied after burst")
 	}
 
-	// Wait for window to reset
-	time.Sleep(150 * time.Millisecond)
-
-	// Should be allowed again
+	// A token refills every 50ms
+	clk.Advance(49 * time.Millisecond)
+	if rl.Allow(ip) {
+		t.Error("Should be denied before a token refills")
+	}
+	clk.Advance(time.Millisecond)
 	if !rl.Allow(ip) {
-		t.Error("Should be allowed after window reset")
+		t.Error("Should be allowed after refill")
+	}
+}
+
+func TestRateLimiterPrefixes(t *testing.T) {
+	rl := NewRateLimiter(2, 0)
+	rl.SetPrefixes(24, 64)
+
+	tests := []struct {
+		same, other string
+	}{
+		{"192.0.2.1", "198.51.100.1"},
+		{"2001:db8:0:1::1", "2001:db8:0:2::1"},
+	}
+	for _, tt := range tests {
+		first := netip.MustParseAddr(tt.same)
+		rl.Allow(first)
+		rl.Allow(first)
+
+		// Another address in the network shares the bucket
+		second := first.Next()
+		if rl.Allow(second) {
+			t.Errorf("%s allowed after %s used up the network's limit", second, first)
+		}
+		if !rl.Allow(netip.MustParseAddr(tt.other)) {
+			t.Errorf("%s should be allowed", tt.other)
+		}
+	}
+
+	// IPv4-mapped IPv6 addresses count as IPv4
+	if rl.Allow(netip.MustParseAddr("::ffff:192.0.2.9")) {
+		t.Error("IPv4-mapped address allowed after its network used up the limit")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	rl := NewRateLimiter(0, 0)
+	ip := netip.MustParseAddr("192.168.1.1")
+	for i := 0; i < 100; i++ {
+		if !rl.Allow(ip) {
+			t.Fatalf("Request %d denied with the limit disabled", i+1)
+		}
+	}
+	if rl.Limited(ip) {
+		t.Error("Limited() with the limit disabled")
 	}
 }
 
@@ -157,7 +216,7 @@ func TestConnectionTracker(t *testing.T) {
 func TestSecurityCheckRateLimit(t *testing.T) {
 	security := NewSecurity(5)
 
-	ip := "192.168.1.1"
+	ip := netip.MustParseAddr("192.168.1.1")
 
 	// Should allow first 5
 	for i := 0; i < 5; i++ {
@@ -171,3 +230,195 @@ func TestSecurityCheckRateLimit(t *testing.T) {
 		t.Error("6th request should be denied")
 	}
 }
+
+func TestSecurityFailureRateLimit(t *testing.T) {
+	security := NewSecurity(100)
+	security.SetFailureRateLimit(3, 0)
+
+	ip := netip.MustParseAddr("192.168.1.1")
+	for i := 0; i < 2; i++ {
+		security.RecordFailure(ip)
+		if !security.CheckRateLimit(ip) {
+			t.Fatalf("Query denied after %d failures, want allowed within the failure limit", i+1)
+		}
+	}
+
+	// The network's valid queries are dropped too once its failures use up
+	// the limit
+	security.RecordFailure(ip)
+	if security.CheckRateLimit(ip) {
+		t.Error("Query allowed after exceeding the failure limit")
+	}
+	if !security.CheckRateLimit(netip.MustParseAddr("192.168.1.2")) {
+		t.Error("Other address denied by another's failures")
+	}
+}
+
+func TestTunnelReplayRejected(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) { c.UpstreamResolver = startRcodeUpstream(t, dns.RcodeNoError) })
+	config := h.config
+
+	clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+	inner, _ := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1).Marshal()
+	encrypted, _ := clientCipher.Encrypt(inner)
+
+	// An attacker re-wraps a captured message under a fresh ClientID
+	send := func() error {
+		f := &dns.Fragment{ID: 1, Seq: 0, Total: 1, Data: encrypted}
+		name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+		if err != nil {
+			t.Fatalf("EncodePayload() error = %v", err)
+		}
+		_, err = h.processTunnelQuery(context.Background(), dns.CreateQuery(name, dns.RRTypeTXT, 2))
+		return err
+	}
+
+	if err := send(); err != nil {
+		t.Fatalf("First query error = %v", err)
+	}
+	if err := send(); !errors.Is(err, crypto.ErrReplayDetected) {
+		t.Errorf("Replayed query: got %v, want %v", err, crypto.ErrReplayDetected)
+	}
+	if got := h.ReplaysDetected(); got != 1 {
+		t.Errorf("ReplaysDetected: got %d, want 1", got)
+	}
+}
+
+func TestTunnelQueryStripsEDNSOptions(t *testing.T) {
+	// Upstream that reports the options of each query it receives
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer conn.Close()
+	received := make(chan []byte, 4)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil || len(query.Additional) != 1 {
+				continue
+			}
+			received <- query.Additional[0].Data
+			data, _ := dns.CreateResponse(query).Marshal()
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+
+	h := newTestHandler(t, func(c *Config) { c.UpstreamResolver = conn.LocalAddr().String() })
+	config := h.config
+
+	ecs := []byte{0, 8, 0, 7, 0, 1, 24, 0, 198, 51, 100}
+	cookie := []byte{0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+
+	send := func() []byte {
+		t.Helper()
+		inner := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1)
+		inner.AddEDNS0(1232)
+		inner.Additional[0].Data = append(bytes.Clone(ecs), cookie...)
+		data, _ := inner.Marshal()
+
+		clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+		encrypted, _ := clientCipher.Encrypt(data)
+		f := &dns.Fragment{ID: 1, Seq: 0, Total: 1, Data: encrypted}
+		name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+		if err != nil {
+			t.Fatalf("EncodePayload() error = %v", err)
+		}
+		if _, err := h.processTunnelQuery(context.Background(), dns.CreateQuery(name, dns.RRTypeTXT, 2)); err != nil {
+			t.Fatalf("processTunnelQuery() error = %v", err)
+		}
+		select {
+		case options := <-received:
+			return options
+		case <-time.After(time.Second):
+			t.Fatal("Upstream received no query")
+			return nil
+		}
+	}
+
+	if options := send(); len(options) != 0 {
+		t.Errorf("Default: upstream received options %x", options)
+	}
+
+	// Explicitly forwarded options reach the upstream
+	reloaded := *config
+	reloaded.ForwardEDNSOptions = []uint16{dns.EDNSOptionCookie}
+	if err := h.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if options := send(); !bytes.Equal(options, cookie) {
+		t.Errorf("Forwarding cookies: upstream received options %x, want %x", options, cookie)
+	}
+}
+
+func TestUpstreamQueryOPT(t *testing.T) {
+	h := newTestHandler(t, func(c *Config) {
+		c.ForwardEDNSOptions = []uint16{dns.EDNSOptionCookie, dns.EDNSOptionTrace}
+	})
+
+	cookie := dns.EDNSOption{Code: dns.EDNSOptionCookie, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	query := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1)
+	query.SetEDNS0(1232, true, dns.EDNSOption{Code: dns.EDNSOptionClientSubnet, Data: []byte{0, 1, 24, 0, 198, 51, 100}}, cookie)
+	query.Additional = append(query.Additional, dns.RR{Name: mustParseName(t, "key"), Type: dns.RRTypeTXT, Class: dns.ClassIN})
+	query.Additional[0].TTL |= 1 << 16 // EDNS version 1
+
+	// The size and DO flag are kept, forwarded options only, version 0,
+	// and other records dropped
+	out, err := h.upstreamQuery(query)
+	if err != nil {
+		t.Fatalf("upstreamQuery() error = %v", err)
+	}
+	if len(out.Additional) != 1 || out.GetEDNS0Size() != 1232 || !out.DO() || out.Additional[0].TTL != 0x8000 {
+		t.Fatalf("Upstream query additional = %+v, want one OPT of 1232 bytes with DO", out.Additional)
+	}
+	if _, ok := out.GetEDNSOption(dns.EDNSOptionClientSubnet); ok {
+		t.Error("Client subnet forwarded")
+	}
+	if data, ok := out.GetEDNSOption(dns.EDNSOptionCookie); !ok || !bytes.Equal(data, cookie.Data) {
+		t.Errorf("Cookie = %x, want %x", data, cookie.Data)
+	}
+	if len(query.Additional) != 2 {
+		t.Error("Original query modified")
+	}
+
+	// Trace IDs stay on the server even if configured to be forwarded
+	if out, _ := h.upstreamQuery(query.WithTraceID(dns.NewTraceID())); out != nil {
+		if _, ok := out.TraceID(); ok {
+			t.Error("Trace ID forwarded")
+		}
+	}
+
+	// Sizes below the minimum are raised to it
+	query.SetEDNS0(100, false)
+	if out, err := h.upstreamQuery(query); err != nil || out.GetEDNS0Size() != dns.EDNSMinUDPSize || out.DO() {
+		t.Errorf("Tiny size: got %d bytes, DO %v, error %v", out.GetEDNS0Size(), out.DO(), err)
+	}
+
+	// Sizes above what the server reads over UDP are lowered to it
+	query.SetEDNS0(65535, false)
+	if out, err := h.upstreamQuery(query); err != nil || out.GetEDNS0Size() != dns.MaxEDNSSize {
+		t.Errorf("Huge size: got %d bytes, error %v", out.GetEDNS0Size(), err)
+	}
+
+	// Only query flags reach the upstream
+	query.Flags = 0x8000 | 0x0400 | 0x0200 | 0x0100 | 0x0040 | 0x0010 | 0x0005 // QR, AA, TC, RD, Z, CD, rcode
+	if out, err := h.upstreamQuery(query); err != nil || out.Flags != 0x0110 {
+		t.Errorf("Flags: got %#04x, want %#04x (RD and CD), error %v", out.Flags, 0x0110, err)
+	}
+
+	// Without an OPT record none is added, and two are invalid
+	query.Additional = nil
+	if out, err := h.upstreamQuery(query); err != nil || len(out.Additional) != 0 {
+		t.Errorf("No OPT: got %d additional records, error %v", len(out.Additional), err)
+	}
+	query.AddEDNS0(1232)
+	query.AddEDNS0(1232)
+	if _, err := h.upstreamQuery(query); err == nil {
+		t.Error("Two OPT records accepted")
+	}
+}
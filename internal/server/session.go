@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+// Session limits
+const (
+	// DefaultSessionTimeout is how long an idle session's keys are kept
+	DefaultSessionTimeout = 15 * time.Minute
+
+	// DefaultMaxSessions bounds the number of established sessions
+	DefaultMaxSessions = 4096
+
+	// sessionBucket is the storage bucket of established sessions
+	sessionBucket = "sessions"
+)
+
+var (
+	ErrUnknownSession   = errors.New("unknown session")
+	ErrTooManySessions  = errors.New("too many sessions")
+	ErrInvalidHandshake = errors.New("invalid handshake")
+)
+
+// session holds the keys a client established with a handshake.
+type session struct {
+	keyID    dns.KeyID
+	cipher   *crypto.Cipher
+	lastUsed time.Time
+}
+
+// sessionTable maps clients to their session keys. Sessions are keyed by
+// ClientID alone, never by the address queries arrive from, so a client
+// keeps its session when it moves to another network or resolver.
+// Sessions are kept in a store so clients keep them across server
+// restarts.
+type sessionTable struct {
+	entries   map[dns.ClientID]*session
+	timeout   time.Duration
+	max       int
+	lastSweep time.Time
+	store     storage.Store
+	mu        sync.Mutex
+}
+
+// newSessionTable creates a session table holding the sessions saved in
+// store that haven't timed out.
+func newSessionTable(timeout time.Duration, max int, store storage.Store) *sessionTable {
+	t := &sessionTable{
+		entries: make(map[dns.ClientID]*session),
+		timeout: timeout,
+		max:     max,
+		store:   store,
+	}
+
+	now := time.Now()
+	_ = store.ForEach(sessionBucket, func(key string, value []byte) error {
+		var clientID dns.ClientID
+		s, ok := decodeSession(value)
+		if len(key) != len(clientID) || !ok || now.Sub(s.lastUsed) > timeout || len(t.entries) >= max {
+			t.deleteSaved(key)
+			return nil
+		}
+		copy(clientID[:], key)
+		t.entries[clientID] = s
+		return nil
+	})
+	return t
+}
+
+// encodeSession encodes a session for storage: the key ID, the last use
+// in Unix seconds and the cipher keys.
+func encodeSession(s *session) []byte {
+	data := binary.BigEndian.AppendUint16(nil, uint16(s.keyID))
+	data = binary.BigEndian.AppendUint64(data, uint64(s.lastUsed.Unix()))
+	return append(data, s.cipher.Keys()...)
+}
+
+// decodeSession decodes a stored session.
+func decodeSession(data []byte) (*session, bool) {
+	if len(data) < 10 {
+		return nil, false
+	}
+	cipher, err := crypto.NewCipherFromKeys(data[10:])
+	if err != nil {
+		return nil, false
+	}
+	return &session{
+		keyID:    dns.KeyID(binary.BigEndian.Uint16(data)),
+		cipher:   cipher,
+		lastUsed: time.Unix(int64(binary.BigEndian.Uint64(data[2:])), 0),
+	}, true
+}
+
+// saveSession stores a client's session. Failures are logged; the session
+// still works until the server restarts.
+func (t *sessionTable) saveSession(clientID dns.ClientID, s *session) {
+	if err := t.store.Put(sessionBucket, string(clientID[:]), encodeSession(s)); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+}
+
+// deleteSaved removes a stored session.
+func (t *sessionTable) deleteSaved(key string) {
+	if err := t.store.Delete(sessionBucket, key); err != nil {
+		log.Printf("Failed to delete session: %v", err)
+	}
+}
+
+// save stores every session with its last use, before shutdown.
+func (t *sessionTable) save() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for clientID, s := range t.entries {
+		t.saveSession(clientID, s)
+	}
+}
+
+// get returns the session cipher of a client. Sessions are bound to the key
+// ID that authenticated the handshake; queries for a revoked key ID are
+// rejected before the session is looked up.
+func (t *sessionTable) get(clientID dns.ClientID, keyID dns.KeyID) (*crypto.Cipher, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	s, ok := t.entries[clientID]
+	if !ok || s.keyID != keyID || now.Sub(s.lastUsed) > t.timeout {
+		return nil, ErrUnknownSession
+	}
+	s.lastUsed = now
+	return s.cipher, nil
+}
+
+// put stores the session keys of a client, replacing any previous session.
+func (t *sessionTable) put(clientID dns.ClientID, keyID dns.KeyID, cipher *crypto.Cipher) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	// Drop idle sessions at most twice per timeout, or when full
+	if _, ok := t.entries[clientID]; !ok && (len(t.entries) >= t.max || now.Sub(t.lastSweep) > t.timeout/2) {
+		for k, v := range t.entries {
+			if now.Sub(v.lastUsed) > t.timeout {
+				delete(t.entries, k)
+				t.deleteSaved(string(k[:]))
+			}
+		}
+		t.lastSweep = now
+
+		if len(t.entries) >= t.max {
+			return ErrTooManySessions
+		}
+	}
+
+	s := &session{keyID: keyID, cipher: cipher, lastUsed: now}
+	t.entries[clientID] = s
+	t.saveSession(clientID, s)
+	return nil
+}
+
+// restore adds a session established elsewhere, such as by another server
+// instance, unless the table is full.
+func (t *sessionTable) restore(clientID dns.ClientID, s *session) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.entries[clientID]; !ok && len(t.entries) >= t.max {
+		return ErrTooManySessions
+	}
+	t.entries[clientID] = s
+	t.saveSession(clientID, s)
+	return nil
+}
+
+// len returns the number of sessions.
+func (t *sessionTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+func TestSessionTable(t *testing.T) {
+	table := newSessionTable(time.Minute, 2, storage.NewMemory())
+	cipher, _ := crypto.NewCipher(make([]byte, 32), false)
+	clientID := dns.NewClientID()
+
+	if _, err := table.get(clientID, 0); err != ErrUnknownSession {
+		t.Errorf("get() before put: got %v, want %v", err, ErrUnknownSession)
+	}
+
+	if err := table.put(clientID, 3, cipher); err != nil {
+		t.Fatalf("put() error = %v", err)
+	}
+	if got, err := table.get(clientID, 3); err != nil || got != cipher {
+		t.Errorf("get() = %v, %v", got, err)
+	}
+
+	// Sessions are bound to the key ID of the handshake
+	if _, err := table.get(clientID, 4); err != ErrUnknownSession {
+		t.Errorf("get() with other key ID: got %v, want %v", err, ErrUnknownSession)
+	}
+
+	// The table is bounded; replacing an existing session is allowed
+	if err := table.put(dns.NewClientID(), 0, cipher); err != nil {
+		t.Fatalf("put() error = %v", err)
+	}
+	if err := table.put(dns.NewClientID(), 0, cipher); err != ErrTooManySessions {
+		t.Errorf("put() when full: got %v, want %v", err, ErrTooManySessions)
+	}
+	if err := table.put(clientID, 3, cipher); err != nil {
+		t.Errorf("put() replacing session: %v", err)
+	}
+}
+
+func TestSessionTableExpiry(t *testing.T) {
+	table := newSessionTable(time.Minute, 1, storage.NewMemory())
+	cipher, _ := crypto.NewCipher(make([]byte, 32), false)
+	clientID := dns.NewClientID()
+
+	if err := table.put(clientID, 0, cipher); err != nil {
+		t.Fatalf("put() error = %v", err)
+	}
+	table.entries[clientID].lastUsed = time.Now().Add(-2 * time.Minute)
+
+	if _, err := table.get(clientID, 0); err != ErrUnknownSession {
+		t.Errorf("get() after timeout: got %v, want %v", err, ErrUnknownSession)
+	}
+
+	// Idle sessions are evicted to make room
+	if err := table.put(dns.NewClientID(), 0, cipher); err != nil {
+		t.Errorf("put() with idle session: %v", err)
+	}
+	if table.len() != 1 {
+		t.Errorf("len: got %d, want 1", table.len())
+	}
+}
+
+func TestSessionTablePersistence(t *testing.T) {
+	store := storage.NewMemory()
+	table := newSessionTable(time.Minute, 4, store)
+	clientCipher, _ := crypto.NewCipher(make([]byte, 32), true)
+	serverCipher, _ := crypto.NewCipher(make([]byte, 32), false)
+	clientID, idle := dns.NewClientID(), dns.NewClientID()
+
+	if err := table.put(clientID, 3, serverCipher); err != nil {
+		t.Fatalf("put() error = %v", err)
+	}
+	if err := table.put(idle, 3, serverCipher); err != nil {
+		t.Fatalf("put() error = %v", err)
+	}
+	table.entries[idle].lastUsed = time.Now().Add(-2 * time.Minute)
+	table.save()
+
+	// A restarted server still decrypts the session's queries, and drops
+	// sessions that timed out
+	restored := newSessionTable(time.Minute, 4, store)
+	cipher, err := restored.get(clientID, 3)
+	if err != nil {
+		t.Fatalf("get() after restart error = %v", err)
+	}
+	query, _ := clientCipher.Encrypt([]byte("query"))
+	if got, err := cipher.Decrypt(query); err != nil || string(got) != "query" {
+		t.Errorf("Decrypt() with restored session = %q, %v", got, err)
+	}
+	if restored.len() != 1 {
+		t.Errorf("len after restart: got %d, want 1", restored.len())
+	}
+	if _, err := store.Get(sessionBucket, string(idle[:])); err != storage.ErrNotFound {
+		t.Errorf("Timed out session still stored: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/sampling"
+)
+
+// Upstream statistics constants
+const (
+	// latencySampleSize is the number of recent latencies kept per key
+	latencySampleSize = 256
+
+	// maxStatsKeys bounds the number of tracked upstream/TLD pairs
+	maxStatsKeys = 1024
+
+	// otherTLD aggregates TLDs seen after maxStatsKeys is reached
+	otherTLD = "other"
+)
+
+// UpstreamStats holds latency and failure statistics for an upstream and
+// inner-query TLD.
+type UpstreamStats struct {
+	Upstream   string
+	TLD        string
+	Queries    uint64
+	Failures   uint64
+	P95Latency time.Duration
+}
+
+// FailureRate returns the fraction of failed queries.
+func (s *UpstreamStats) FailureRate() float64 {
+	if s.Queries == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Queries)
+}
+
+type upstreamStatsKey struct {
+	upstream string
+	tld      string
+}
+
+type upstreamStatsEntry struct {
+	queries  uint64
+	failures uint64
+	samples  []time.Duration
+	next     int
+}
+
+// upstreamStatsTracker records per-upstream, per-TLD query outcomes.
+type upstreamStatsTracker struct {
+	entries map[upstreamStatsKey]*upstreamStatsEntry
+	mu      sync.Mutex
+
+	// latencySample picks the successes whose latency is sampled
+	latencySample sampling.Sampler
+}
+
+func newUpstreamStatsTracker() *upstreamStatsTracker {
+	return &upstreamStatsTracker{
+		entries: make(map[upstreamStatsKey]*upstreamStatsEntry),
+	}
+}
+
+// record records a query outcome. Latency is only sampled for successes,
+// and of those only the ones latencySample keeps.
+func (t *upstreamStatsTracker) record(upstream, tld string, latency time.Duration, success bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := upstreamStatsKey{upstream: upstream, tld: tld}
+	e, ok := t.entries[key]
+	if !ok {
+		if len(t.entries) >= maxStatsKeys {
+			key.tld = otherTLD
+			e, ok = t.entries[key]
+		}
+		if !ok {
+			e = &upstreamStatsEntry{}
+			t.entries[key] = e
+		}
+	}
+
+	e.queries++
+	if !success {
+		e.failures++
+		return
+	}
+	if !t.latencySample.Sample() {
+		return
+	}
+
+	if len(e.samples) < latencySampleSize {
+		e.samples = append(e.samples, latency)
+	} else {
+		e.samples[e.next] = latency
+		e.next = (e.next + 1) % latencySampleSize
+	}
+}
+
+// snapshot returns the statistics sorted by upstream and TLD.
+func (t *upstreamStatsTracker) snapshot() []UpstreamStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]UpstreamStats, 0, len(t.entries))
+	for key, e := range t.entries {
+		result = append(result, UpstreamStats{
+			Upstream:   key.upstream,
+			TLD:        key.tld,
+			Queries:    e.queries,
+			Failures:   e.failures,
+			P95Latency: percentile(e.samples, 95),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Upstream != result[j].Upstream {
+			return result[i].Upstream < result[j].Upstream
+		}
+		return result[i].TLD < result[j].TLD
+	})
+	return result
+}
+
+// percentile returns the p-th percentile of the samples.
+func percentile(samples []time.Duration, p int) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// queryTLD returns the lowercase TLD of the query's question name.
+func queryTLD(query *dns.Message) string {
+	if len(query.Question) == 0 || len(query.Question[0].Name) == 0 {
+		return "."
+	}
+	name := query.Question[0].Name
+	return strings.ToLower(string(name[len(name)-1]))
+}
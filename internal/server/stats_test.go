@@ -0,0 +1,140 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestUpstreamStatsTracker(t *testing.T) {
+	tracker := newUpstreamStatsTracker()
+
+	for i := 1; i <= 100; i++ {
+		tracker.record("8.8.8.8:53", "com", time.Duration(i)*time.Millisecond, true)
+	}
+	tracker.record("8.8.8.8:53", "com", 0, false)
+	tracker.record("8.8.8.8:53", "ir", 5*time.Millisecond, true)
+
+	stats := tracker.snapshot()
+	if len(stats) != 2 {
+		t.Fatalf("Stats count: got %d, want 2", len(stats))
+	}
+
+	com := stats[0]
+	if com.TLD != "com" {
+		t.Fatalf("Sort order: got %q first, want \"com\"", com.TLD)
+	}
+	if com.Queries != 101 || com.Failures != 1 {
+		t.Errorf("Counts: got %d queries, %d failures", com.Queries, com.Failures)
+	}
+	if com.P95Latency != 95*time.Millisecond {
+		t.Errorf("P95: got %v, want 95ms", com.P95Latency)
+	}
+	if rate := com.FailureRate(); rate < 0.0098 || rate > 0.0100 {
+		t.Errorf("FailureRate: got %v", rate)
+	}
+
+	if stats[1].P95Latency != 5*time.Millisecond {
+		t.Errorf("Single sample P95: got %v, want 5ms", stats[1].P95Latency)
+	}
+}
+
+func TestUpstreamStatsSampleWindow(t *testing.T) {
+	tracker := newUpstreamStatsTracker()
+
+	// Old slow samples are replaced by newer fast ones
+	for i := 0; i < latencySampleSize; i++ {
+		tracker.record("u", "com", time.Second, true)
+	}
+	for i := 0; i < latencySampleSize; i++ {
+		tracker.record("u", "com", time.Millisecond, true)
+	}
+
+	if p95 := tracker.snapshot()[0].P95Latency; p95 != time.Millisecond {
+		t.Errorf("P95 after window rollover: got %v, want 1ms", p95)
+	}
+}
+
+func TestUpstreamStatsLatencySample(t *testing.T) {
+	tracker := newUpstreamStatsTracker()
+	tracker.latencySample.SetRate(10)
+
+	// Only every tenth success is sampled: 1ms, 11ms, ..., 91ms
+	for i := 1; i <= 100; i++ {
+		tracker.record("u", "com", time.Duration(i)*time.Millisecond, true)
+		tracker.record("u", "com", 0, false)
+	}
+
+	stats := tracker.snapshot()[0]
+	if stats.Queries != 200 || stats.Failures != 100 {
+		t.Errorf("Counts: got %d queries, %d failures, want 200 and 100", stats.Queries, stats.Failures)
+	}
+	if stats.P95Latency != 91*time.Millisecond {
+		t.Errorf("P95: got %v, want 91ms", stats.P95Latency)
+	}
+}
+
+func TestUpstreamStatsKeyLimit(t *testing.T) {
+	tracker := newUpstreamStatsTracker()
+
+	for i := 0; i < maxStatsKeys+10; i++ {
+		tracker.record("u", string(rune('a'+i%26))+string(rune(i)), time.Millisecond, true)
+	}
+
+	stats := tracker.snapshot()
+	if len(stats) > maxStatsKeys+1 {
+		t.Errorf("Tracked keys: got %d, want at most %d", len(stats), maxStatsKeys+1)
+	}
+
+	var other *UpstreamStats
+	for i := range stats {
+		if stats[i].TLD == otherTLD {
+			other = &stats[i]
+		}
+	}
+	if other == nil || other.Queries != 10 {
+		t.Errorf("Overflow bucket: got %+v", other)
+	}
+}
+
+func TestQueryTLD(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *dns.Message
+		want  string
+	}{
+		{
+			name:  "simple",
+			query: dns.CreateQuery(mustParseName(t, "www.Example.COM"), dns.RRTypeA, 1),
+			want:  "com",
+		},
+		{
+			name:  "root",
+			query: dns.CreateQuery(dns.Name{}, dns.RRTypeA, 1),
+			want:  ".",
+		},
+		{
+			name:  "no question",
+			query: &dns.Message{},
+			want:  ".",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryTLD(tt.query); got != tt.want {
+				t.Errorf("queryTLD() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustParseName(t *testing.T, s string) dns.Name {
+	t.Helper()
+	n, err := dns.ParseName(s)
+	if err != nil {
+		t.Fatalf("ParseName(%q) error = %v", s, err)
+	}
+	return n
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+// Stream limits
+const (
+	// DefaultMaxStreams bounds the number of open streams
+	DefaultMaxStreams = 1024
+
+	// streamDialTimeout bounds connecting to a stream's destination
+	streamDialTimeout = 10 * time.Second
+
+	// streamPollTimeout is how long a frame without data waits for data
+	// from the destination before it is answered
+	streamPollTimeout = 500 * time.Millisecond
+
+	// streamReplyFragments is the number of response fragments a reply
+	// frame's data may fill
+	streamReplyFragments = 4
+)
+
+var (
+	ErrStreamsDisabled      = errors.New("streams are disabled")
+	ErrTooManyStreams       = errors.New("too many streams")
+	ErrForbiddenDestination = errors.New("destination not allowed")
+)
+
+// streamKey identifies a stream by client and stream ID.
+type streamKey struct {
+	clientID dns.ClientID
+	id       uint32
+}
+
+// serverStream is a client's TCP connection to a destination.
+type serverStream struct {
+	connected chan struct{}    // closed once the dial finished
+	endpoint  *stream.Endpoint // set once connected
+	dialErr   error
+	created   time.Time
+	closed    bool
+	mu        sync.Mutex
+}
+
+// streamTable holds the open streams.
+type streamTable struct {
+	entries   map[streamKey]*serverStream
+	max       int
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func newStreamTable(max int) *streamTable {
+	return &streamTable{
+		entries: make(map[streamKey]*serverStream),
+		max:     max,
+	}
+}
+
+// open registers a new stream. If the stream exists, as when an open frame
+// is retransmitted, it is returned with created set to false.
+func (t *streamTable) open(key streamKey) (s *serverStream, created bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+	if s, ok := t.entries[key]; ok {
+		return s, false, nil
+	}
+	if len(t.entries) >= t.max {
+		return nil, false, ErrTooManyStreams
+	}
+
+	s = &serverStream{connected: make(chan struct{}), created: now}
+	t.entries[key] = s
+	return s, true, nil
+}
+
+// get returns an open stream.
+func (t *streamTable) get(key streamKey) (*serverStream, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(time.Now())
+	s, ok := t.entries[key]
+	return s, ok
+}
+
+// sweep closes idle streams, at most twice per idle timeout. The caller
+// holds t.mu.
+func (t *streamTable) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) <= stream.IdleTimeout/2 {
+		return
+	}
+	for k, v := range t.entries {
+		if v.idle(now) {
+			v.close()
+			delete(t.entries, k)
+		}
+	}
+	t.lastSweep = now
+}
+
+// remove closes and removes a stream.
+func (t *streamTable) remove(key streamKey) {
+	t.mu.Lock()
+	s, ok := t.entries[key]
+	delete(t.entries, key)
+	t.mu.Unlock()
+	if ok {
+		s.close()
+	}
+}
+
+// closeAll closes all streams.
+func (t *streamTable) closeAll() {
+	t.mu.Lock()
+	entries := t.entries
+	t.entries = make(map[streamKey]*serverStream)
+	t.mu.Unlock()
+	for _, s := range entries {
+		s.close()
+	}
+}
+
+// len returns the number of open streams.
+func (t *streamTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+// idle reports whether the stream saw no frames for the idle timeout.
+func (s *serverStream) idle(now time.Time) bool {
+	s.mu.Lock()
+	e := s.endpoint
+	s.mu.Unlock()
+	if e == nil {
+		return now.Sub(s.created) > stream.IdleTimeout
+	}
+	return e.Inactive(now, stream.IdleTimeout)
+}
+
+// close closes the destination connection, or the one being dialed once
+// it is established.
+func (s *serverStream) close() {
+	s.mu.Lock()
+	s.closed = true
+	e := s.endpoint
+	s.mu.Unlock()
+	if e != nil {
+		e.Close()
+	}
+}
+
+// resolveStreamMessage decrypts a reassembled stream frame, applies it and
+// returns the encrypted reply frame split into fragments.
+func (h *Handler) resolveStreamMessage(ctx context.Context, keyID dns.KeyID, keyring *crypto.Keyring, clientID dns.ClientID, session bool, data []byte, id uint16) ([]*dns.Fragment, error) {
+	plaintext, cipher, err := h.decryptMessage(keyID, keyring, clientID, session, data)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := stream.ParseFrame(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.encryptReply(ctx, cipher, clientID, h.handleStreamFrame(ctx, clientID, frame).Marshal(), id, 0)
+}
+
+// handleStreamFrame applies a frame from a client and returns the reply.
+// Failures are reported to the client with a reset frame.
+func (h *Handler) handleStreamFrame(ctx context.Context, clientID dns.ClientID, f *stream.Frame) *stream.Frame {
+	key := streamKey{clientID: clientID, id: f.Stream}
+	reset := func(err error) *stream.Frame {
+		h.streams.remove(key)
+		return &stream.Frame{Op: stream.OpReset, Stream: f.Stream, Data: []byte(err.Error())}
+	}
+
+	switch f.Op {
+	case stream.OpOpen:
+		if !h.streamsOn.Load() {
+			return reset(ErrStreamsDisabled)
+		}
+		// Retransmitted opens of streams opened before are still answered
+		if _, ok := h.streams.get(key); !ok && h.maintenance.Load() {
+			return reset(ErrMaintenance)
+		}
+		s, created, err := h.streams.open(key)
+		if err != nil {
+			return reset(err)
+		}
+		if created {
+			h.dialStream(s, key, string(f.Data))
+		}
+		select {
+		case <-s.connected:
+		case <-ctx.Done():
+			return reset(ctx.Err())
+		}
+		if s.dialErr != nil {
+			return reset(s.dialErr)
+		}
+		return h.streamReply(ctx, clientID, s.endpoint, stream.OpOpen, f.Stream, false)
+
+	case stream.OpData:
+		s, ok := h.streams.get(key)
+		if !ok {
+			return reset(stream.ErrUnknownStream)
+		}
+		select {
+		case <-s.connected:
+		case <-ctx.Done():
+			return reset(ctx.Err())
+		}
+		if s.dialErr != nil {
+			return reset(s.dialErr)
+		}
+		if err := s.endpoint.Receive(f); err != nil {
+			return reset(err)
+		}
+		return h.streamReply(ctx, clientID, s.endpoint, stream.OpData, f.Stream, len(f.Data) == 0 && !f.NoWait())
+
+	case stream.OpClose:
+		h.streams.remove(key)
+		return &stream.Frame{Op: stream.OpClose, Stream: f.Stream}
+
+	default:
+		h.streams.remove(key)
+		return &stream.Frame{Op: stream.OpReset, Stream: f.Stream}
+	}
+}
+
+// dialStream connects a new stream to addr and starts reading from it,
+// queueing data read for the client's polls.
+func (h *Handler) dialStream(s *serverStream, key streamKey, addr string) {
+	defer close(s.connected)
+
+	dialer := &net.Dialer{Timeout: streamDialTimeout}
+	if !h.streamsPriv.Load() {
+		dialer.Control = publicDestination
+	}
+	conn, err := dialer.DialContext(h.ctx, "tcp", addr)
+	if err != nil {
+		s.dialErr = fmt.Errorf("failed to connect to %s: %w", addr, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		s.dialErr = net.ErrClosed
+		return
+	}
+	s.endpoint = stream.NewEndpoint(conn, stream.DefaultBufferSize, func() {
+		h.polls.notify(key.clientID, key.id)
+	})
+}
+
+// publicDestination refuses connections to loopback, private, link-local
+// and other non-public addresses, so clients can't reach the server's own
+// network. It runs after name resolution, for every address tried.
+func publicDestination(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("%w: %s", ErrForbiddenDestination, ip)
+	}
+	return nil
+}
+
+// streamReply returns the reply to a frame: the acknowledgement of the
+// client's data and the unacknowledged data from the destination. With
+// poll set it waits for data from the destination first, for clients that
+// don't poll for it separately.
+func (h *Handler) streamReply(ctx context.Context, clientID dns.ClientID, e *stream.Endpoint, op byte, id uint32, poll bool) *stream.Frame {
+	if poll {
+		e.Wait(ctx, streamPollTimeout)
+	}
+	maxData := streamReplyFragments*h.responseFragmentSize(ctx, clientID) - crypto.Overhead - stream.HeaderSize
+	return e.Outgoing(op, id, maxData)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/stream"
+)
+
+func TestPublicDestination(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::1]:443", true},
+		{"127.0.0.1:22", false},
+		{"10.1.2.3:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:22", false},
+		{"[fe80::1]:22", false},
+		{"[fd00::1]:22", false},
+		{"[::ffff:127.0.0.1]:22", false},
+	}
+
+	for _, tt := range tests {
+		err := publicDestination("tcp", tt.addr, nil)
+		if tt.allowed && err != nil {
+			t.Errorf("publicDestination(%s) = %v, want allowed", tt.addr, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrForbiddenDestination) {
+			t.Errorf("publicDestination(%s) = %v, want %v", tt.addr, err, ErrForbiddenDestination)
+		}
+	}
+}
+
+func TestStreamFrameHandling(t *testing.T) {
+	h := newTestHandler(t, nil)
+	clientID := dns.NewClientID()
+
+	// Streams are off by default
+	reply := h.handleStreamFrame(h.ctx, clientID, &stream.Frame{Op: stream.OpOpen, Stream: 1, Data: []byte("example.com:80")})
+	if reply.Op != stream.OpReset {
+		t.Errorf("Open with streams disabled: got op %d, want reset", reply.Op)
+	}
+
+	// Data for a stream that was never opened
+	h.streamsOn.Store(true)
+	reply = h.handleStreamFrame(h.ctx, clientID, &stream.Frame{Op: stream.OpData, Stream: 2, Data: []byte("x")})
+	if reply.Op != stream.OpReset {
+		t.Errorf("Data for an unknown stream: got op %d, want reset", reply.Op)
+	}
+
+	// Private destinations are refused
+	reply = h.handleStreamFrame(h.ctx, clientID, &stream.Frame{Op: stream.OpOpen, Stream: 3, Data: []byte("127.0.0.1:1")})
+	if reply.Op != stream.OpReset {
+		t.Errorf("Open to a loopback address: got op %d, want reset", reply.Op)
+	}
+	if h.streams.len() != 0 {
+		t.Errorf("Failed streams kept: %d", h.streams.len())
+	}
+}
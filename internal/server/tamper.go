@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/alert"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/sampling"
+)
+
+// Answer audit settings
+const (
+	// DefaultAuditSample re-resolves one in every DefaultAuditSample
+	// answered queries
+	DefaultAuditSample = 100
+
+	// maxAudits bounds the audits in flight; samples beyond it are skipped
+	maxAudits = 16
+
+	// auditTimeout bounds the re-resolution of a sampled query
+	auditTimeout = 5 * time.Second
+)
+
+// AuditStats counts an upstream's audited answers and those the audit
+// upstream contradicted.
+type AuditStats struct {
+	Upstream   string
+	Audited    uint64
+	Mismatches uint64
+}
+
+// answerAuditor re-resolves a sample of answered queries against an
+// independent upstream and flags upstreams whose answers it contradicts:
+// names that don't exist or addresses that aren't public where the audit
+// upstream has public addresses, the usual signs of censorship or
+// poisoning. Differing public addresses alone aren't flagged, since
+// CDNs answer each resolver differently.
+type answerAuditor struct {
+	resolver *Resolver
+	sampler  sampling.Sampler
+	slots    chan struct{}
+
+	mu    sync.Mutex
+	stats map[string]*AuditStats
+}
+
+// newAnswerAuditor creates an auditor re-resolving one in every sample
+// queries against upstream, in the ParseUpstreamConfig format.
+func newAnswerAuditor(upstream string, sample int) (*answerAuditor, error) {
+	addr, typ, err := ParseUpstreamConfig(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit upstream %q: %w", upstream, err)
+	}
+	r, err := NewResolver(addr, typ)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit upstream %q: %w", upstream, err)
+	}
+
+	a := &answerAuditor{
+		resolver: r,
+		slots:    make(chan struct{}, maxAudits),
+		stats:    make(map[string]*AuditStats),
+	}
+	a.setSample(sample)
+	return a, nil
+}
+
+// setSample changes the sample rate; 0 uses DefaultAuditSample.
+func (a *answerAuditor) setSample(sample int) {
+	if sample == 0 {
+		sample = DefaultAuditSample
+	}
+	a.sampler.SetRate(sample)
+}
+
+// record counts an audited answer of upstream.
+func (a *answerAuditor) record(upstream string, mismatch bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.stats[upstream]
+	if !ok {
+		s = &AuditStats{Upstream: upstream}
+		a.stats[upstream] = s
+	}
+	s.Audited++
+	if mismatch {
+		s.Mismatches++
+	}
+}
+
+// auditStats returns the statistics of each audited upstream.
+func (a *answerAuditor) auditStats() []AuditStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make([]AuditStats, 0, len(a.stats))
+	for _, s := range a.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Upstream < stats[j].Upstream })
+	return stats
+}
+
+// auditAnswer re-resolves a sample of answered queries in the background
+// and compares the answers. A nil auditor audits nothing.
+func (h *Handler) auditAnswer(query, answer *dns.Message, upstream string) {
+	a := h.auditor
+	if a == nil || len(query.Question) != 1 || !a.sampler.Sample() {
+		return
+	}
+	select {
+	case a.slots <- struct{}{}:
+	default:
+		return
+	}
+
+	q := query.Question[0]
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() { <-a.slots }()
+
+		ctx, cancel := context.WithTimeout(h.ctx, auditTimeout)
+		defer cancel()
+		check, err := a.resolver.Resolve(ctx, dns.CreateQuery(q.Name, q.Type, dns.GenerateQueryID()))
+		if err != nil {
+			return
+		}
+
+		reason := answerMismatch(answer, check)
+		a.record(upstream, reason != "")
+		if reason != "" {
+			msg := fmt.Sprintf("upstream %s answered %s type %d with %s, but audit upstream %s with %s",
+				upstream, q.Name, q.Type, reason, a.resolver.upstream, describeAnswer(check))
+			log.Printf("Answer audit: %s", msg)
+			h.alerts.Notify(alert.EventAnswerMismatch, msg)
+		}
+	}()
+}
+
+// answerMismatch compares an upstream's answer with the audit upstream's
+// answer to the same question. It returns a description of the answer if
+// it looks censored or poisoned, or "" if the answers agree.
+func answerMismatch(answer, check *dns.Message) string {
+	checkAddrs := answerAddrs(check)
+	if check.Rcode() != dns.RcodeNoError || !hasPublic(checkAddrs) {
+		return ""
+	}
+
+	if answer.Rcode() != dns.RcodeNoError {
+		return describeAnswer(answer)
+	}
+	addrs := answerAddrs(answer)
+	if len(addrs) == 0 || slices.ContainsFunc(addrs, func(addr netip.Addr) bool { return !isPublic(addr) }) {
+		return describeAnswer(answer)
+	}
+	return ""
+}
+
+// describeAnswer summarizes an answer for logs: its rcode if it failed,
+// otherwise its addresses.
+func describeAnswer(m *dns.Message) string {
+	if m.Rcode() != dns.RcodeNoError {
+		return fmt.Sprintf("rcode %d", m.Rcode())
+	}
+	addrs := answerAddrs(m)
+	if len(addrs) == 0 {
+		return "no addresses"
+	}
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// answerAddrs returns the A and AAAA addresses in a message's answer.
+func answerAddrs(m *dns.Message) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range m.Answer {
+		if rr.Type != dns.RRTypeA && rr.Type != dns.RRTypeAAAA {
+			continue
+		}
+		if addr, err := dns.DecodeAddrData(rr.Data); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// hasPublic reports whether any of addrs is public.
+func hasPublic(addrs []netip.Addr) bool {
+	return slices.ContainsFunc(addrs, isPublic)
+}
+
+// isPublic reports whether addr is a globally routable unicast address,
+// unlike the private, loopback and unspecified addresses that censoring
+// resolvers commonly answer with.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// AuditStats returns the answer audit statistics of each upstream, or nil
+// without AuditUpstream.
+func (h *Handler) AuditStats() []AuditStats {
+	if h.auditor == nil {
+		return nil
+	}
+	return h.auditor.auditStats()
+}
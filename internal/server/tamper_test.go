@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// auditAnswerMessage returns a response with an A record for each address
+// and the given rcode.
+func auditAnswerMessage(rcode uint16, addrs ...string) *dns.Message {
+	m := dns.CreateQuery(nil, dns.RRTypeA, 1)
+	m.SetRcode(rcode)
+	for _, s := range addrs {
+		m.Answer = append(m.Answer, dns.RR{
+			Type:  dns.RRTypeA,
+			Class: dns.ClassIN,
+			TTL:   60,
+			Data:  dns.EncodeAddrData(netip.MustParseAddr(s)),
+		})
+	}
+	return m
+}
+
+func TestAnswerMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer *dns.Message
+		check  *dns.Message
+		want   string
+	}{
+		{"same", auditAnswerMessage(dns.RcodeNoError, "93.184.216.34"), auditAnswerMessage(dns.RcodeNoError, "93.184.216.34"), ""},
+		{"other public", auditAnswerMessage(dns.RcodeNoError, "93.184.216.34"), auditAnswerMessage(dns.RcodeNoError, "8.8.8.8"), ""},
+		{"nxdomain", auditAnswerMessage(dns.RcodeNameError), auditAnswerMessage(dns.RcodeNoError, "8.8.8.8"), "rcode 3"},
+		{"private", auditAnswerMessage(dns.RcodeNoError, "10.10.34.35"), auditAnswerMessage(dns.RcodeNoError, "8.8.8.8"), "10.10.34.35"},
+		{"unspecified", auditAnswerMessage(dns.RcodeNoError, "0.0.0.0"), auditAnswerMessage(dns.RcodeNoError, "8.8.8.8"), "0.0.0.0"},
+		{"empty", auditAnswerMessage(dns.RcodeNoError), auditAnswerMessage(dns.RcodeNoError, "8.8.8.8"), "no addresses"},
+		{"check failed", auditAnswerMessage(dns.RcodeNameError), auditAnswerMessage(dns.RcodeNameError), ""},
+		{"check private", auditAnswerMessage(dns.RcodeNoError, "10.0.0.1"), auditAnswerMessage(dns.RcodeNoError, "192.168.1.1"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := answerMismatch(tt.answer, tt.check); got != tt.want {
+				t.Errorf("answerMismatch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnswerAuditorStats(t *testing.T) {
+	a, err := newAnswerAuditor("9.9.9.9:53", 0)
+	if err != nil {
+		t.Fatalf("newAnswerAuditor() error: %v", err)
+	}
+	defer a.resolver.Close()
+
+	a.record("8.8.8.8:53", false)
+	a.record("8.8.8.8:53", true)
+	a.record("1.1.1.1:53", false)
+
+	stats := a.auditStats()
+	want := []AuditStats{
+		{Upstream: "1.1.1.1:53", Audited: 1},
+		{Upstream: "8.8.8.8:53", Audited: 2, Mismatches: 1},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("auditStats() returned %d upstreams, want %d", len(stats), len(want))
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("auditStats()[%d] = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// TCP constants
+const (
+	// tcpIdleTimeout is how long an idle TCP connection is kept open
+	tcpIdleTimeout = 10 * time.Second
+
+	// tcpMaxMessageSize is the maximum DNS message size over TCP
+	tcpMaxMessageSize = 65535
+
+	// tcpAcceptMinDelay and tcpAcceptMaxDelay bound the pause after a
+	// failed accept, such as when the process is out of file descriptors
+	tcpAcceptMinDelay = 5 * time.Millisecond
+	tcpAcceptMaxDelay = time.Second
+)
+
+// acceptTCPLoop accepts incoming TCP connections until the listener is
+// closed. Other accept errors are retried after a pause that doubles with
+// each consecutive failure, as net/http does.
+func (h *Handler) acceptTCPLoop() {
+	defer h.wg.Done()
+
+	var delay time.Duration
+	for {
+		conn, err := h.tcpListener.Accept()
+		if err != nil {
+			if h.ctx.Err() != nil || h.draining.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = min(max(2*delay, tcpAcceptMinDelay), tcpAcceptMaxDelay)
+			log.Printf("TCP accept error: %v; retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-h.ctx.Done():
+				return
+			}
+			continue
+		}
+		delay = 0
+
+		if !h.trackTCP(conn) {
+			conn.Close()
+			return
+		}
+		if h.overloaded() {
+			h.untrackTCP(conn)
+			continue
+		}
+
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			defer h.untrackTCP(conn)
+
+			h.serveTCP(conn)
+		}()
+	}
+}
+
+// serveTCP serves length-prefixed DNS queries on a TCP connection until it
+// is closed or idle.
+func (h *Handler) serveTCP(conn net.Conn) {
+	ip, _ := sourceAddr(conn.RemoteAddr())
+
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		if h.draining.Load() {
+			return
+		}
+
+		data, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+
+		// Check rate limit
+		if !h.security.CheckRateLimit(ip) {
+			h.alertRateLimited(ip)
+			continue
+		}
+
+		// Shed queries while overloaded, closing the connection to free
+		// its resources
+		if h.overloaded() {
+			return
+		}
+
+		// Acquire semaphore
+		select {
+		case h.sem <- struct{}{}:
+		case <-h.ctx.Done():
+			return
+		}
+
+		resp := h.handleQuery(data, conn.RemoteAddr(), tcpMaxMessageSize)
+		<-h.sem
+
+		if resp == nil {
+			continue
+		}
+
+		if err := writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// trackTCP registers an open connection so Stop can close it.
+// It returns false if the handler is already stopping.
+func (h *Handler) trackTCP(conn net.Conn) bool {
+	h.tcpMu.Lock()
+	defer h.tcpMu.Unlock()
+
+	if h.ctx.Err() != nil {
+		return false
+	}
+	h.tcpConns[conn] = struct{}{}
+	return true
+}
+
+// untrackTCP closes and unregisters a connection.
+func (h *Handler) untrackTCP(conn net.Conn) {
+	h.tcpMu.Lock()
+	defer h.tcpMu.Unlock()
+
+	conn.Close()
+	delete(h.tcpConns, conn)
+}
+
+// drainTCP closes the TCP listener and wakes connections waiting for a
+// query, so they close once their in-flight queries are answered.
+func (h *Handler) drainTCP() {
+	if h.tcpListener != nil {
+		h.tcpListener.Close()
+	}
+
+	h.tcpMu.Lock()
+	defer h.tcpMu.Unlock()
+
+	for conn := range h.tcpConns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+}
+
+// closeTCP closes the TCP listener and all open connections.
+func (h *Handler) closeTCP() {
+	if h.tcpListener != nil {
+		h.tcpListener.Close()
+	}
+
+	h.tcpMu.Lock()
+	defer h.tcpMu.Unlock()
+
+	for conn := range h.tcpConns {
+		conn.Close()
+	}
+}
+
+// readTCPMessage reads a length-prefixed DNS message.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeTCPMessage writes a length-prefixed DNS message.
+func writeTCPMessage(w io.Writer, data []byte) error {
+	if len(data) > tcpMaxMessageSize {
+		return io.ErrShortWrite
+	}
+
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(data)))
+	copy(buf[2:], data)
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingListener fails to accept with err a number of times, then
+// reports that it is closed.
+type failingListener struct {
+	net.Listener
+	err      error
+	failures int32
+	accepts  atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.accepts.Add(1) <= l.failures {
+		return nil, l.err
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error {
+	return nil
+}
+
+func TestAcceptTCPLoopRetries(t *testing.T) {
+	h := newTestHandler(t, nil)
+
+	// Running out of file descriptors doesn't stop the server accepting
+	ln := &failingListener{err: syscall.EMFILE, failures: 3}
+	h.tcpListener = ln
+	h.wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		h.acceptTCPLoop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("acceptTCPLoop() didn't return after the listener closed")
+	}
+	if got := ln.accepts.Load(); got != 4 {
+		t.Errorf("Accept() called %d times, want 4", got)
+	}
+}
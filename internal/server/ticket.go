@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+// Resumption ticket constants
+const (
+	// TicketLifetime is how long after its handshake a resumption ticket
+	// resumes the session. Clients renew their sessions sooner.
+	TicketLifetime = DefaultSessionTimeout
+
+	// ticketBucket is the storage bucket of the ticket key
+	ticketBucket = "tickets"
+)
+
+// newTicketKey returns the key resumption tickets are sealed with. Cluster
+// instances derive it from the cluster secret, so any of them resumes the
+// sessions of the others; a lone server keeps a random key in store, so
+// tickets outlive restarts when the store does.
+func newTicketKey(config *Config, store storage.Store) (*crypto.TicketKey, error) {
+	if config.ClusterListen != "" {
+		return crypto.DeriveTicketKey(config.ClusterSecret)
+	}
+
+	key, err := store.Get(ticketBucket, "key")
+	if errors.Is(err, storage.ErrNotFound) {
+		key = make([]byte, crypto.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate ticket key: %w", err)
+		}
+		err = store.Put(ticketBucket, "key", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to keep ticket key: %w", err)
+	}
+	defer crypto.ZeroBytes(key)
+	return crypto.NewTicketKey(key)
+}
+
+// issueTicket returns a resumption ticket for a session established now
+// under keyID: the session as saved in the store, sealed.
+func (h *Handler) issueTicket(keyID dns.KeyID, cipher *crypto.Cipher) ([]byte, error) {
+	return h.tickets.Seal(encodeSession(&session{keyID: keyID, cipher: cipher, lastUsed: h.clock.Now()}))
+}
+
+// resumeSession restores the session of the ticket before a resume
+// message and returns the session message after it. Tickets resume only
+// sessions of keyID issued within TicketLifetime, and only for a client
+// holding the session keys: the message must decrypt with them.
+func (h *Handler) resumeSession(keyID dns.KeyID, clientID dns.ClientID, data []byte) ([]byte, error) {
+	ticket, message, err := crypto.SplitTicket(data)
+	if err != nil {
+		return nil, err
+	}
+	state, err := h.tickets.Open(ticket)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", crypto.ErrInvalidTicket, err)
+	}
+	s, ok := decodeSession(state)
+	if !ok || s.keyID != keyID || h.clock.Now().Sub(s.lastUsed) > TicketLifetime {
+		return nil, crypto.ErrInvalidTicket
+	}
+	if h.revocations.Load().revoked(keyID) {
+		return nil, ErrKeyRevoked
+	}
+	s.cipher.SetClock(h.clock)
+	if _, err := s.cipher.Decrypt(message); err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+
+	if err := h.sessions.put(clientID, keyID, s.cipher); err != nil {
+		return nil, err
+	}
+	if h.cluster != nil {
+		h.cluster.shareSession(clientID, keyID, s.cipher)
+	}
+	return message, nil
+}
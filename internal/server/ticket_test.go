@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/clock"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/storage"
+)
+
+// sendMessage sends a message as a single fragment with the given flags
+// and returns the reassembled reply.
+func sendMessage(t *testing.T, h *Handler, clientID dns.ClientID, id uint16, flags byte, data []byte) ([]byte, error) {
+	t.Helper()
+	keyring, _ := h.keys.Load().keyring(0)
+	first, err := h.handleFragment(h.ctx, 0, keyring, clientID, &dns.Fragment{Flags: flags, ID: id, Total: 1, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	reply := first.Data
+	for seq := 1; seq < int(first.Total); seq++ {
+		f, err := h.handleFragment(h.ctx, 0, keyring, clientID, dns.NewFetchFragment(id, uint8(seq)))
+		if err != nil {
+			t.Fatalf("Fetch of fragment %d: %v", seq, err)
+		}
+		reply = append(reply, f.Data...)
+	}
+	return reply, nil
+}
+
+func TestSessionResumption(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	h := newTestHandler(t, func(c *Config) {
+		c.UpstreamResolver = startRcodeUpstream(t, dns.RcodeNoError)
+		c.Clock = clk
+	})
+	config := h.config
+
+	// A handshake asking for a ticket gets one after the server's key
+	clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+	hs, _ := crypto.NewHandshake()
+	msg, _ := clientCipher.Encrypt(append(hs.PublicKey(), crypto.TicketRequest))
+	reply, err := sendMessage(t, h, dns.NewClientID(), 1, dns.FragmentFlagHandshake, msg)
+	if err != nil {
+		t.Fatalf("Handshake error = %v", err)
+	}
+	plaintext, err := clientCipher.DecryptWithoutTimestamp(reply)
+	if err != nil || len(plaintext) < crypto.PublicKeySize {
+		t.Fatalf("Handshake reply: %d bytes, %v", len(plaintext), err)
+	}
+	ticket, rest, err := crypto.SplitTicket(plaintext[crypto.PublicKeySize:])
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("SplitTicket() = %d bytes left, %v", len(rest), err)
+	}
+	session, _ := hs.SessionCipher(plaintext[:crypto.PublicKeySize], true)
+
+	resume := func(clientID dns.ClientID, id uint16, cipher *crypto.Cipher) error {
+		query, _ := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, id).Marshal()
+		encrypted, _ := cipher.Encrypt(query)
+		reply, err := sendMessage(t, h, clientID, id, dns.FragmentFlagResume, append(crypto.AppendTicket(nil, ticket), encrypted...))
+		if err != nil {
+			return err
+		}
+		if _, err := cipher.DecryptWithoutTimestamp(reply); err != nil {
+			t.Fatalf("Resumed reply: %v", err)
+		}
+		return nil
+	}
+
+	// Only the holder of the session keys resumes the session
+	forger := dns.NewClientID()
+	other, _ := crypto.NewCipher(bytes.Repeat([]byte{9}, 32), true)
+	if err := resume(forger, 2, other); err == nil {
+		t.Error("Resumed a session without its keys")
+	}
+	if _, err := h.sessions.get(forger, 0); !errors.Is(err, ErrUnknownSession) {
+		t.Errorf("Failed resumption left a session: %v", err)
+	}
+
+	// A restarted client resumes the session under its new ID, and its
+	// next messages are plain session messages
+	restarted := dns.NewClientID()
+	if err := resume(restarted, 3, session); err != nil {
+		t.Fatalf("Resumption error = %v", err)
+	}
+	query, _ := dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 5).Marshal()
+	encrypted, _ := session.Encrypt(query)
+	if _, err := sendMessage(t, h, restarted, 5, dns.FragmentFlagSession, encrypted); err != nil {
+		t.Errorf("Session message after resumption: %v", err)
+	}
+
+	// Tickets expire with the session they resume
+	clk.Advance(TicketLifetime + time.Minute)
+	if err := resume(dns.NewClientID(), 4, session); !errors.Is(err, crypto.ErrInvalidTicket) {
+		t.Errorf("Expired ticket: got %v, want %v", err, crypto.ErrInvalidTicket)
+	}
+}
+
+func TestTicketKeyPersistence(t *testing.T) {
+	store := storage.NewMemory()
+	config := DefaultConfig()
+	key, err := newTicketKey(config, store)
+	if err != nil {
+		t.Fatalf("newTicketKey() error = %v", err)
+	}
+	ticket, _ := key.Seal([]byte("state"))
+
+	// The key is kept in the store, so tickets survive a restart
+	restarted, err := newTicketKey(config, store)
+	if err != nil {
+		t.Fatalf("newTicketKey() restart error = %v", err)
+	}
+	if state, err := restarted.Open(ticket); err != nil || string(state) != "state" {
+		t.Errorf("Open() after restart = %q, %v", state, err)
+	}
+
+	// Cluster instances share a key derived from the cluster secret
+	config.ClusterListen = ":5353"
+	config.ClusterSecret = testClusterSecret
+	a, _ := newTicketKey(config, storage.NewMemory())
+	b, _ := newTicketKey(config, storage.NewMemory())
+	ticket, _ = a.Seal([]byte("state"))
+	if _, err := b.Open(ticket); err != nil {
+		t.Errorf("Cluster instance rejected a peer's ticket: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// Top report constants
+const (
+	// maxTopKeys bounds the domains and clients counted per report period
+	maxTopKeys = 10000
+
+	// otherTopKey aggregates domains and clients seen after maxTopKeys is
+	// reached
+	otherTopKey = "other"
+)
+
+// TopEntry is a domain or client with its count in a TopReport.
+type TopEntry struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// TopReport lists the busiest domains and clients of a report period, for
+// capacity planning and abuse review. Domains are the last two labels of
+// tunneled query names.
+type TopReport struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Domains are the most queried domains, by queries
+	Domains []TopEntry `json:"domains"`
+
+	// Clients are the clients with the most traffic, by tunneled bytes in
+	// both directions
+	Clients []TopEntry `json:"clients"`
+
+	// Errors are the domains with the most failed queries
+	Errors []TopEntry `json:"errors"`
+}
+
+// topTracker counts queries per domain and traffic per client over a
+// report period. A nil *topTracker counts nothing.
+type topTracker struct {
+	mu       sync.Mutex
+	start    time.Time
+	domains  map[string]uint64
+	clients  map[string]uint64
+	errors   map[string]uint64
+	previous *TopReport
+}
+
+func newTopTracker(now time.Time) *topTracker {
+	t := &topTracker{}
+	t.resetLocked(now)
+	return t
+}
+
+func (t *topTracker) resetLocked(now time.Time) {
+	t.start = now
+	t.domains = make(map[string]uint64)
+	t.clients = make(map[string]uint64)
+	t.errors = make(map[string]uint64)
+}
+
+// recordQuery counts a tunneled query and whether it failed.
+func (t *topTracker) recordQuery(query *dns.Message, failed bool) {
+	if t == nil {
+		return
+	}
+	domain := queryDomain(query)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	addTop(t.domains, domain, 1)
+	if failed {
+		addTop(t.errors, domain, 1)
+	}
+}
+
+// recordTraffic counts bytes tunneled to or from a client.
+func (t *topTracker) recordTraffic(clientID dns.ClientID, bytes int) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	addTop(t.clients, hex.EncodeToString(clientID[:]), uint64(bytes))
+}
+
+// addTop adds n to key's count, or to otherTopKey's once counts has
+// maxTopKeys keys.
+func addTop(counts map[string]uint64, key string, n uint64) {
+	if _, ok := counts[key]; !ok && len(counts) >= maxTopKeys {
+		key = otherTopKey
+	}
+	counts[key] += n
+}
+
+// report returns the top n entries of the current period, which ends now.
+func (t *topTracker) report(n int, now time.Time) *TopReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reportLocked(n, now)
+}
+
+func (t *topTracker) reportLocked(n int, now time.Time) *TopReport {
+	return &TopReport{
+		Start:   t.start,
+		End:     now,
+		Domains: topEntries(t.domains, n),
+		Clients: topEntries(t.clients, n),
+		Errors:  topEntries(t.errors, n),
+	}
+}
+
+// rotate ends the current period now, keeping its top n entries as the
+// previous report, and returns that report.
+func (t *topTracker) rotate(n int, now time.Time) *TopReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.previous = t.reportLocked(n, now)
+	t.resetLocked(now)
+	return t.previous
+}
+
+// last returns the report of the previous period, nil before the first
+// rotation.
+func (t *topTracker) last() *TopReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.previous
+}
+
+// topEntries returns the n keys with the highest counts, by count and then
+// name.
+func topEntries(counts map[string]uint64, n int) []TopEntry {
+	entries := make([]TopEntry, 0, len(counts))
+	for name, count := range counts {
+		entries = append(entries, TopEntry{Name: name, Count: count})
+	}
+	slices.SortFunc(entries, func(a, b TopEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// queryDomain returns the last two labels of a query's name in lower case,
+// "." for the root.
+func queryDomain(query *dns.Message) string {
+	if len(query.Question) == 0 || len(query.Question[0].Name) == 0 {
+		return "."
+	}
+	name := query.Question[0].Name
+	return strings.ToLower(name[max(len(name)-2, 0):].String())
+}
+
+// TopReport returns the top domains and clients of the current report
+// period so far and the report of the previous period, which is nil
+// before the first day ends. Both are nil unless TopReports is on.
+func (h *Handler) TopReport() (current, previous *TopReport) {
+	if h.top == nil {
+		return nil, nil
+	}
+	return h.top.report(int(h.topN.Load()), time.Now()), h.top.last()
+}
+
+// topReportLoop ends a report period at every midnight UTC until the
+// handler stops, appending the period's report to TopReportFile if set.
+func (h *Handler) topReportLoop() {
+	defer h.wg.Done()
+
+	for {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		timer := time.NewTimer(midnight.Sub(now))
+		select {
+		case <-h.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		report := h.top.rotate(int(h.topN.Load()), time.Now().UTC())
+		if h.config.TopReportFile != "" {
+			if err := appendTopReport(h.config.TopReportFile, report); err != nil {
+				log.Printf("Failed to write top report: %v", err)
+			}
+		}
+	}
+}
+
+// appendTopReport appends a report to path as a line of JSON.
+func appendTopReport(path string, report *TopReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open top report file: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestTopTracker(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tracker := newTopTracker(start)
+
+	query := func(name string) *dns.Message {
+		return dns.CreateQuery(mustParseName(t, name), dns.RRTypeA, 1)
+	}
+	for range 3 {
+		tracker.recordQuery(query("www.Example.com"), false)
+	}
+	tracker.recordQuery(query("mail.example.com"), true)
+	tracker.recordQuery(query("a.b.example.org"), true)
+	tracker.recordQuery(query("example.net"), false)
+
+	busy, quiet := dns.NewClientID(), dns.NewClientID()
+	tracker.recordTraffic(busy, 1000)
+	tracker.recordTraffic(quiet, 10)
+	tracker.recordTraffic(busy, 500)
+
+	report := tracker.report(2, start.Add(time.Hour))
+	if !report.Start.Equal(start) || !report.End.Equal(start.Add(time.Hour)) {
+		t.Errorf("Period: %v to %v", report.Start, report.End)
+	}
+	wantDomains := []TopEntry{{"example.com", 4}, {"example.net", 1}}
+	if len(report.Domains) != 2 || report.Domains[0] != wantDomains[0] || report.Domains[1] != wantDomains[1] {
+		t.Errorf("Domains = %v, want %v", report.Domains, wantDomains)
+	}
+	if len(report.Clients) != 2 || report.Clients[0].Count != 1500 || report.Clients[1].Count != 10 {
+		t.Errorf("Clients = %v, want 1500 and 10 bytes", report.Clients)
+	}
+	wantErrors := []TopEntry{{"example.com", 1}, {"example.org", 1}}
+	if len(report.Errors) != 2 || report.Errors[0] != wantErrors[0] || report.Errors[1] != wantErrors[1] {
+		t.Errorf("Errors = %v, want %v", report.Errors, wantErrors)
+	}
+
+	// Rotating keeps the ended period's report and starts counting afresh
+	if tracker.last() != nil {
+		t.Error("Previous report before the first rotation")
+	}
+	end := start.Add(24 * time.Hour)
+	rotated := tracker.rotate(2, end)
+	if tracker.last() != rotated || len(rotated.Domains) != 2 {
+		t.Errorf("Previous report = %+v, want the rotated one", tracker.last())
+	}
+	if report := tracker.report(2, end); len(report.Domains) != 0 || !report.Start.Equal(end) {
+		t.Errorf("Report after rotation = %+v, want an empty one from %v", report, end)
+	}
+}
+
+func TestHandlerTopReport(t *testing.T) {
+	// An upstream that refuses connections
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	conn.Close()
+
+	h := newTestHandler(t, func(c *Config) {
+		c.TopReports = true
+		c.UpstreamResolver = conn.LocalAddr().String()
+	})
+	config := h.config
+
+	data, _ := dns.CreateQuery(mustParseName(t, "www.example.com"), dns.RRTypeA, 1).Marshal()
+	clientCipher, _ := crypto.NewCipher(config.SharedSecret, true)
+	encrypted, _ := clientCipher.Encrypt(data)
+	f := &dns.Fragment{ID: 1, Total: 1, Data: encrypted}
+	name, err := dns.EncodePayload(f.Marshal(), 0, dns.NewClientID(), h.domain)
+	if err != nil {
+		t.Fatalf("EncodePayload() error = %v", err)
+	}
+	if _, err := h.processTunnelQuery(context.Background(), dns.CreateQuery(name, dns.RRTypeTXT, 2)); err == nil {
+		t.Fatal("processTunnelQuery() succeeded without an upstream")
+	}
+
+	current, previous := h.TopReport()
+	if current == nil || previous != nil {
+		t.Fatalf("TopReport() = %v, %v, want only a current report", current, previous)
+	}
+	want := TopEntry{"example.com", 1}
+	if len(current.Domains) != 1 || current.Domains[0] != want || len(current.Errors) != 1 || current.Errors[0] != want {
+		t.Errorf("Report domains %v, errors %v, want %v in both", current.Domains, current.Errors, want)
+	}
+}
+
+func TestTopTrackerKeyLimit(t *testing.T) {
+	tracker := newTopTracker(time.Now())
+	for i := range maxTopKeys + 5 {
+		tracker.recordQuery(dns.CreateQuery(mustParseName(t, "d"+strconv.Itoa(i)+".com"), dns.RRTypeA, 1), false)
+	}
+
+	if len(tracker.domains) != maxTopKeys+1 {
+		t.Errorf("Tracked %d domains, want %d", len(tracker.domains), maxTopKeys+1)
+	}
+	if tracker.domains[otherTopKey] != 5 {
+		t.Errorf("Other: got %d, want 5", tracker.domains[otherTopKey])
+	}
+}
+
+func TestTopTrackerNil(t *testing.T) {
+	var tracker *topTracker
+	tracker.recordQuery(dns.CreateQuery(mustParseName(t, "example.com"), dns.RRTypeA, 1), true)
+	tracker.recordTraffic(dns.NewClientID(), 100)
+}
+
+func TestQueryDomain(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "example.com"},
+		{"A.B.Example.COM", "example.com"},
+		{"com", "com"},
+		{"", "."},
+	}
+
+	for _, tt := range tests {
+		query := dns.CreateQuery(mustParseName(t, tt.name), dns.RRTypeA, 1)
+		if got := queryDomain(query); got != tt.want {
+			t.Errorf("queryDomain(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAppendTopReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "top.jsonl")
+	for i := range 2 {
+		report := &TopReport{Domains: []TopEntry{{"example.com", uint64(i + 1)}}}
+		if err := appendTopReport(path, report); err != nil {
+			t.Fatalf("appendTopReport() error = %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for i := range 2 {
+		var report TopReport
+		if err := decoder.Decode(&report); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		if len(report.Domains) != 1 || report.Domains[0].Count != uint64(i+1) {
+			t.Errorf("Report %d = %+v", i, report)
+		}
+	}
+}
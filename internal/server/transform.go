@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// errUDPTooLarge is returned for UDP responses larger than MaxEDNSSize,
+// which queries never advertise.
+var errUDPTooLarge = errors.New("UDP response larger than the advertised payload size")
+
+// questionEnd returns the offset just past the question of a wire format
+// query with one uncompressed question name, or -1 if there is none.
+func questionEnd(msg []byte) int {
+	if len(msg) < 12 || msg[4] != 0 || msg[5] != 1 {
+		return -1
+	}
+	pos := 12
+	for pos < len(msg) && msg[pos] != 0 {
+		if msg[pos]&0xc0 != 0 {
+			return -1
+		}
+		pos += int(msg[pos]) + 1
+	}
+	pos += 1 + 4 // root label, type and class
+	if pos > len(msg) {
+		return -1
+	}
+	return pos
+}
+
+// randomizeCase returns a copy of a wire format query with each letter of
+// its question name in random case (DNS 0x20). Resolvers echo the name as
+// sent, so an off-path attacker must also guess the case of every letter.
+func randomizeCase(query []byte) []byte {
+	end := questionEnd(query)
+	if end < 0 {
+		return query
+	}
+	out := append([]byte(nil), query...)
+
+	bits := make([]byte, end-12)
+	_, _ = rand.Read(bits)
+
+	pos := 12
+	for out[pos] != 0 {
+		n := int(out[pos])
+		for i := pos + 1; i <= pos+n; i++ {
+			if b := out[i] | 0x20; b >= 'a' && b <= 'z' {
+				out[i] = b &^ (bits[i-12] & 1 << 5)
+			}
+		}
+		pos += n + 1
+	}
+	return out
+}
+
+// matchesQuery reports whether resp answers query: a response with the
+// same ID and question. With exactCase the question name must match byte
+// for byte, so DNS 0x20 case bits must be echoed.
+func matchesQuery(query, resp []byte, exactCase bool) bool {
+	if len(resp) < 12 || resp[0] != query[0] || resp[1] != query[1] || resp[2]&0x80 == 0 {
+		return false
+	}
+	end := questionEnd(query)
+	if end < 0 {
+		return true
+	}
+	if len(resp) < end || resp[4] != 0 || resp[5] != 1 {
+		return false
+	}
+	for i := 12; i < end; i++ {
+		a, b := query[i], resp[i]
+		if !exactCase && a >= 'A' && a <= 'Z' {
+			a |= 0x20
+		}
+		if !exactCase && b >= 'A' && b <= 'Z' {
+			b |= 0x20
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreCase copies the question of query over that of resp, which
+// matchesQuery accepted, undoing randomizeCase. Answer names compressed
+// against the question follow.
+func restoreCase(resp, query []byte) {
+	if end := questionEnd(query); end > 0 && len(resp) >= end {
+		copy(resp[12:end], query[12:end])
+	}
+}
+
+// exchangeUDP sends a wire format query to addr over UDP and returns the
+// first matching response (see matchesQuery). Other packets, such as
+// off-path spoofing attempts, are ignored until the deadline. Without a
+// deadline in ctx, timeout applies.
+func exchangeUDP(ctx context.Context, addr string, query []byte, exactCase bool, timeout time.Duration) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	// Set deadline from context
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	// Abort the exchange when ctx is canceled, e.g. on shutdown
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// Send query
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	// Read responses until one matches. The buffer has room for one more
+	// byte than the largest response read, so larger ones aren't cut short
+	// unnoticed.
+	buf := make([]byte, dns.MaxEDNSSize+1)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		if matchesQuery(query, buf[:n], exactCase) {
+			if n > dns.MaxEDNSSize {
+				return nil, errUDPTooLarge
+			}
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeUDPOrTCP is like exchangeUDP, but retries the query over TCP if
+// the UDP response is truncated or too large to read, so whole answers
+// are returned.
+func exchangeUDPOrTCP(ctx context.Context, addr string, query []byte, exactCase bool, timeout time.Duration) ([]byte, error) {
+	resp, err := exchangeUDP(ctx, addr, query, exactCase, timeout)
+	if err == nil && resp[2]&0x02 == 0 || err != nil && !errors.Is(err, errUDPTooLarge) {
+		return resp, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return exchangeTCP(ctx, addr, query)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	query, err := dns.CreateQuery(mustParseName(t, "abcdefghijklmnop-1.example.com"), dns.RRTypeA, 1).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	changed := false
+	for i := 0; i < 20 && !changed; i++ {
+		out := randomizeCase(query)
+		if !bytes.EqualFold(out, query) {
+			t.Fatalf("randomizeCase changed more than case: %q", out)
+		}
+		if !matchesQuery(query, responseTo(out), false) {
+			t.Fatal("Case-insensitive match failed")
+		}
+		changed = !bytes.Equal(out, query)
+		if changed && matchesQuery(query, responseTo(out), true) {
+			t.Fatal("Exact match accepted a different case")
+		}
+		if !matchesQuery(out, responseTo(out), true) {
+			t.Fatal("Exact match rejected the echoed case")
+		}
+
+		resp := responseTo(out)
+		restoreCase(resp, query)
+		if !bytes.Equal(resp[12:], query[12:]) {
+			t.Fatal("restoreCase did not restore the question")
+		}
+	}
+	if !changed {
+		t.Error("randomizeCase never changed the case")
+	}
+}
+
+// responseTo returns a copy of a wire format query with the QR bit set.
+func responseTo(query []byte) []byte {
+	resp := bytes.Clone(query)
+	resp[2] |= 0x80
+	return resp
+}
+
+func TestResolverCaseRandomizationIgnoresSpoofs(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	answer := func(query *dns.Message, name dns.Name, addr string) []byte {
+		resp := dns.CreateResponse(query)
+		resp.Question[0].Name = name
+		resp.Answer = []dns.RR{{
+			Name: name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 60,
+			Data: dns.EncodeAddrData(netip.MustParseAddr(addr)),
+		}}
+		data, _ := resp.Marshal()
+		return data
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			// A spoofer knows the ID but not the case of the name
+			name := query.Question[0].Name
+			lower := make(dns.Name, len(name))
+			for i, label := range name {
+				lower[i] = bytes.ToLower(label)
+			}
+			_, _ = conn.WriteTo(answer(query, lower, "198.51.100.66"), addr)
+			_, _ = conn.WriteTo(answer(query, name, "192.0.2.1"), addr)
+		}
+	}()
+
+	r, err := NewResolver(conn.LocalAddr().String(), "udp")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	r.SetCaseRandomization(true)
+
+	name := mustParseName(t, "abcdefghijklmnopqrstuvwxyz.example.com")
+	for i := 0; i < 5; i++ {
+		resp, err := r.Resolve(context.Background(), dns.CreateQuery(name, dns.RRTypeA, 1234))
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		if got := resp.Question[0].Name.String(); got != name.String() {
+			t.Errorf("Question: got %s, want %s", got, name)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Answers: got %d, want 1", len(resp.Answer))
+		}
+		if addr, _ := dns.DecodeAddrData(resp.Answer[0].Data); addr.String() != "192.0.2.1" {
+			t.Errorf("Answer: got %s, want 192.0.2.1", addr)
+		}
+	}
+}
+
+// startSplitUpstream starts an upstream answering over UDP with udpAnswer
+// and over TCP, on the same port, with a single A record.
+func startSplitUpstream(t *testing.T, udpAnswer func(resp *dns.Message)) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ln, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Skipf("Listen(tcp) error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	answer := func(query *dns.Message) *dns.Message {
+		resp := dns.CreateResponse(query)
+		resp.Answer = []dns.RR{{
+			Name: query.Question[0].Name, Type: dns.RRTypeA, Class: dns.ClassIN, TTL: 60,
+			Data: dns.EncodeAddrData(netip.MustParseAddr("192.0.2.1")),
+		}}
+		return resp
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := answer(query)
+			udpAnswer(resp)
+			data, _ := resp.Marshal()
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			data, err := readTCPMessage(c)
+			if query, perr := dns.ParseMessage(data); err == nil && perr == nil {
+				resp, _ := answer(query).Marshal()
+				_ = writeTCPMessage(c, resp)
+			}
+			c.Close()
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestResolverTCPFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		udpAnswer func(resp *dns.Message)
+	}{
+		{"truncated", func(resp *dns.Message) { resp.Truncate() }},
+		{"larger than advertised", func(resp *dns.Message) {
+			// Sliced to the payload size, this would parse as a shorter answer
+			for range 40 {
+				resp.Answer = append(resp.Answer, dns.RR{
+					Name: resp.Question[0].Name, Type: dns.RRTypeTXT, Class: dns.ClassIN, TTL: 60,
+					Data: dns.EncodeTXTData(bytes.Repeat([]byte("x"), 200)),
+				})
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResolver(startSplitUpstream(t, tt.udpAnswer), "udp")
+			if err != nil {
+				t.Fatalf("NewResolver() error = %v", err)
+			}
+			r.SetCaseRandomization(true)
+
+			name := mustParseName(t, "big.example.com")
+			resp, err := r.Resolve(context.Background(), dns.CreateQuery(name, dns.RRTypeA, 1234))
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if resp.Flags&0x0200 != 0 || len(resp.Answer) != 1 || resp.Answer[0].Type != dns.RRTypeA {
+				t.Errorf("Response: TC %v, %d answers, want the TCP answer", resp.Flags&0x0200 != 0, len(resp.Answer))
+			}
+			if got := resp.Question[0].Name.String(); got != name.String() {
+				t.Errorf("Question: got %s, want %s", got, name)
+			}
+		})
+	}
+}
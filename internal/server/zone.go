@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+// DefaultZoneTTL is the TTL of static zone records that don't set one.
+const DefaultZoneTTL = 3600
+
+// ErrOutOfZone is returned for static records outside the tunnel domain.
+var ErrOutOfZone = errors.New("record outside the zone")
+
+// staticZone holds operator-configured records for names in the tunnel
+// domain, such as the apex NS and SOA records and the address of the name
+// server, so the server can answer for its own delegation.
+type staticZone struct {
+	records map[string][]dns.RR // by lowercased owner name
+	soa     *dns.SOA            // configured apex SOA, if any
+}
+
+// newStaticZone indexes records, which must all be in the domain.
+func newStaticZone(domain dns.Name, records []dns.RR) (*staticZone, error) {
+	z := &staticZone{records: make(map[string][]dns.RR)}
+	for _, rr := range records {
+		if _, ok := rr.Name.TrimSuffix(domain); !ok {
+			return nil, fmt.Errorf("%w: %s", ErrOutOfZone, rr.Name)
+		}
+		if rr.Type == dns.RRTypeSOA {
+			if !rr.Name.Equal(domain) {
+				return nil, fmt.Errorf("SOA record not at the zone apex: %s", rr.Name)
+			}
+			soa, err := dns.DecodeSOAData(rr.Data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SOA record: %w", err)
+			}
+			z.soa = &soa
+			continue
+		}
+		key := strings.ToLower(rr.Name.String())
+		z.records[key] = append(z.records[key], rr)
+	}
+	return z, nil
+}
+
+// lookup returns the records of a type at name, and whether any records
+// exist at name.
+func (z *staticZone) lookup(name dns.Name, rrType uint16) ([]dns.RR, bool) {
+	rrs, exists := z.records[strings.ToLower(name.String())]
+	var answer []dns.RR
+	for _, rr := range rrs {
+		if rr.Type == rrType {
+			answer = append(answer, rr)
+		}
+	}
+	return answer, exists
+}
+
+// delegation returns the NS records of the highest zone cut between the
+// apex and name, inclusive of name, for names in a subdomain delegated
+// with NS records.
+func (z *staticZone) delegation(domain, name dns.Name) (dns.Name, []dns.RR, bool) {
+	prefix, ok := name.TrimSuffix(domain)
+	if !ok {
+		return nil, nil, false
+	}
+	for n := 1; n <= len(prefix); n++ {
+		cut := name[len(prefix)-n:]
+		if ns, _ := z.lookup(cut, dns.RRTypeNS); len(ns) > 0 {
+			return cut, ns, true
+		}
+	}
+	return nil, nil, false
+}
+
+// glue returns the address records of the in-zone name servers of an NS
+// answer, for the additional section.
+func (z *staticZone) glue(answer []dns.RR) []dns.RR {
+	var glue []dns.RR
+	for _, rr := range answer {
+		if rr.Type != dns.RRTypeNS {
+			continue
+		}
+		target, err := dns.DecodeNameData(rr.Data)
+		if err != nil {
+			continue
+		}
+		for _, addr := range z.records[strings.ToLower(target.String())] {
+			if addr.Type == dns.RRTypeA || addr.Type == dns.RRTypeAAAA {
+				glue = append(glue, addr)
+			}
+		}
+	}
+	return glue
+}
+
+// LoadZoneFile reads static zone records from a file (see
+// ParseZoneRecords).
+func LoadZoneFile(path string, domain string) ([]dns.RR, error) {
+	origin, err := dns.ParseName(domain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
+	}
+	defer f.Close()
+
+	records, err := ParseZoneRecords(f, origin)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return records, nil
+}
+
+// ParseZoneRecords parses A, AAAA, NS, SOA and TXT records in zone file
+// format, one per line: "<name> [ttl] [IN] <type> <data>". Names without a
+// trailing dot and "@" are relative to origin. Text after ';' is a
+// comment, and TXT data may be quoted.
+func ParseZoneRecords(r io.Reader, origin dns.Name) ([]dns.RR, error) {
+	var records []dns.RR
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields, err := splitZoneLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", lineNum, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		rr, err := parseZoneRecord(fields, origin)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", lineNum, err)
+		}
+		records = append(records, rr)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
+	}
+	return records, nil
+}
+
+// splitZoneLine splits a zone file line into fields, keeping quoted
+// strings together without their quotes and dropping comments.
+func splitZoneLine(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || line[0] == ';' {
+			return fields, nil
+		}
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			fields = append(fields, line[1:1+end])
+			line = line[2+end:]
+			continue
+		}
+		end := strings.IndexAny(line, " \t;")
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+}
+
+// parseZoneRecord parses the fields of a record.
+func parseZoneRecord(fields []string, origin dns.Name) (dns.RR, error) {
+	name, err := zoneName(fields[0], origin)
+	if err != nil {
+		return dns.RR{}, err
+	}
+	rr := dns.RR{Name: name, Class: dns.ClassIN, TTL: DefaultZoneTTL}
+	fields = fields[1:]
+
+	// Optional TTL and class, in either order
+	for len(fields) > 0 {
+		if ttl, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+			rr.TTL = uint32(ttl)
+		} else if !strings.EqualFold(fields[0], "IN") {
+			break
+		}
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return dns.RR{}, fmt.Errorf("expected record type and data")
+	}
+
+	rrType, data := strings.ToUpper(fields[0]), fields[1:]
+	switch rrType {
+	case "A", "AAAA":
+		addr, err := netip.ParseAddr(data[0])
+		if err != nil || addr.Is4() != (rrType == "A") || len(data) != 1 {
+			return dns.RR{}, fmt.Errorf("invalid %s record address %q", rrType, data[0])
+		}
+		rr.Type = dns.RRTypeA
+		if rrType == "AAAA" {
+			rr.Type = dns.RRTypeAAAA
+		}
+		rr.Data = dns.EncodeAddrData(addr)
+
+	case "NS":
+		target, err := zoneName(data[0], origin)
+		if err != nil || len(data) != 1 {
+			return dns.RR{}, fmt.Errorf("invalid NS record target %q", data[0])
+		}
+		rr.Type = dns.RRTypeNS
+		rr.Data = dns.EncodeNameData(target)
+
+	case "SOA":
+		if len(data) != 7 {
+			return dns.RR{}, fmt.Errorf("SOA record needs 7 fields, got %d", len(data))
+		}
+		mname, err := zoneName(data[0], origin)
+		if err != nil {
+			return dns.RR{}, err
+		}
+		rname, err := zoneName(data[1], origin)
+		if err != nil {
+			return dns.RR{}, err
+		}
+		var nums [5]uint32
+		for i, s := range data[2:] {
+			n, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return dns.RR{}, fmt.Errorf("invalid SOA field %q", s)
+			}
+			nums[i] = uint32(n)
+		}
+		rr.Type = dns.RRTypeSOA
+		rr.Data = dns.EncodeSOAData(dns.SOA{
+			MName: mname, RName: rname,
+			Serial: nums[0], Refresh: nums[1], Retry: nums[2], Expire: nums[3], Minimum: nums[4],
+		})
+
+	case "TXT":
+		rr.Type = dns.RRTypeTXT
+		for _, s := range data {
+			if len(s) > 255 {
+				return dns.RR{}, fmt.Errorf("TXT string longer than 255 bytes")
+			}
+			rr.Data = append(append(rr.Data, byte(len(s))), s...)
+		}
+
+	default:
+		return dns.RR{}, fmt.Errorf("unsupported record type %s", fields[0])
+	}
+	return rr, nil
+}
+
+// zoneName parses a name in a zone file: "@" is the origin, and names
+// without a trailing dot are relative to it.
+func zoneName(s string, origin dns.Name) (dns.Name, error) {
+	if s == "@" {
+		return origin, nil
+	}
+	name, err := dns.ParseName(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name %q: %w", s, err)
+	}
+	if strings.HasSuffix(s, ".") {
+		return name, nil
+	}
+	return append(name[:len(name):len(name)], origin...), nil
+}
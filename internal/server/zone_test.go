@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
+)
+
+const testZone = `
+; Delegation of t.example.com to this server
+@        IN NS   ns1
+@           NS   tns.example.com.
+ns1  600 IN A    192.0.2.53
+ns1         AAAA 2001:db8::53
+@           A    192.0.2.80
+@           TXT  "v=spf1 -all" "second string"
+`
+
+func TestParseZoneRecords(t *testing.T) {
+	origin := mustParseName(t, "t.example.com")
+	records, err := ParseZoneRecords(strings.NewReader(testZone), origin)
+	if err != nil {
+		t.Fatalf("ParseZoneRecords() error = %v", err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("Got %d records, want 6", len(records))
+	}
+
+	if target, _ := dns.DecodeNameData(records[0].Data); target.String() != "ns1.t.example.com" || records[0].TTL != DefaultZoneTTL {
+		t.Errorf("Relative NS: got %s, TTL %d", target, records[0].TTL)
+	}
+	if target, _ := dns.DecodeNameData(records[1].Data); target.String() != "tns.example.com" {
+		t.Errorf("Absolute NS: got %s", target)
+	}
+	if addr, _ := dns.DecodeAddrData(records[2].Data); records[2].Name.String() != "ns1.t.example.com" || addr != netip.MustParseAddr("192.0.2.53") || records[2].TTL != 600 {
+		t.Errorf("A: got %s %d %s", records[2].Name, records[2].TTL, addr)
+	}
+	if records[4].Name.String() != "t.example.com" {
+		t.Errorf("Apex: got %s", records[4].Name)
+	}
+	if got := string(records[5].Data); got != "\x0bv=spf1 -all\x0dsecond string" {
+		t.Errorf("TXT: got %q", got)
+	}
+
+	for _, bad := range []string{
+		"@ A 2001:db8::1",
+		"@ AAAA 192.0.2.1",
+		"@ MX 10 mail",
+		"@ SOA ns1 hostmaster 1 2 3",
+		"@ TXT \"unterminated",
+		"@ 300 IN",
+	} {
+		if _, err := ParseZoneRecords(strings.NewReader(bad), origin); err == nil {
+			t.Errorf("ParseZoneRecords(%q) succeeded", bad)
+		}
+	}
+
+	outside, _ := ParseZoneRecords(strings.NewReader("www.example.org. A 192.0.2.1"), origin)
+	if _, err := newStaticZone(origin, outside); !errors.Is(err, ErrOutOfZone) {
+		t.Errorf("newStaticZone() error = %v, want ErrOutOfZone", err)
+	}
+}
+
+func TestZoneResponses(t *testing.T) {
+	records, err := ParseZoneRecords(strings.NewReader(testZone), mustParseName(t, "t.example.com"))
+	if err != nil {
+		t.Fatalf("ParseZoneRecords() error = %v", err)
+	}
+	h := newTestHandler(t, func(c *Config) {
+		c.RRLLimit = 0
+		c.ChallengeThreshold = 0
+		c.ZoneRecords = records
+	})
+	config := h.config
+
+	tests := []struct {
+		name           string
+		qname          string
+		qtype          uint16
+		edns           bool
+		wantRcode      uint16
+		wantAnswer     int
+		wantAuthority  int
+		wantAdditional int
+	}{
+		{"apex NS with glue", "T.example.com", dns.RRTypeNS, true, dns.RcodeNoError, 2, 0, 3},
+		{"apex NS without EDNS", "t.example.com", dns.RRTypeNS, false, dns.RcodeNoError, 2, 0, 2},
+		{"apex A", "t.example.com", dns.RRTypeA, true, dns.RcodeNoError, 1, 0, 1},
+		{"apex TXT", "t.example.com", dns.RRTypeTXT, false, dns.RcodeNoError, 1, 0, 0},
+		{"apex SOA", "t.example.com", dns.RRTypeSOA, true, dns.RcodeNoError, 1, 0, 1},
+		{"name server address", "ns1.t.example.com", dns.RRTypeAAAA, false, dns.RcodeNoError, 1, 0, 0},
+		{"name server NODATA", "ns1.t.example.com", dns.RRTypeTXT, false, dns.RcodeNoError, 0, 1, 0},
+		{"missing name", "ns2.t.example.com", dns.RRTypeA, false, dns.RcodeNameError, 0, 1, 0},
+	}
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dns.CreateQuery(mustParseName(t, tt.qname), tt.qtype, 0x1234)
+			if tt.edns {
+				query.AddEDNS0(1232)
+			}
+			data, err := query.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			resp, err := dns.ParseMessage(h.handleQuery(data, udp, config.MaxUDPSize))
+			if err != nil {
+				t.Fatalf("ParseMessage() error = %v", err)
+			}
+			if resp.Rcode() != tt.wantRcode {
+				t.Errorf("Rcode: got %d, want %d", resp.Rcode(), tt.wantRcode)
+			}
+			if resp.Flags&0x0400 == 0 {
+				t.Error("AA bit not set")
+			}
+			if len(resp.Answer) != tt.wantAnswer || len(resp.Authority) != tt.wantAuthority || len(resp.Additional) != tt.wantAdditional {
+				t.Fatalf("Sections: got %d/%d/%d records", len(resp.Answer), len(resp.Authority), len(resp.Additional))
+			}
+			for _, rr := range resp.Answer {
+				if !rr.Name.Equal(query.Question[0].Name) || string(rr.Name[0]) != string(query.Question[0].Name[0]) {
+					t.Errorf("Answer owner %s doesn't match the question", rr.Name)
+				}
+			}
+		})
+	}
+
+	// A configured SOA replaces the generated one
+	soa, _ := ParseZoneRecords(strings.NewReader("@ SOA tns.example.com. admin.example.com. 7 3600 600 86400 60"), h.domain)
+	reloaded := *config
+	reloaded.ZoneRecords = append(records, soa...)
+	if err := h.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got := h.soa(); got.Serial != 7 || got.Minimum != 60 || got.MName.String() != "tns.example.com" {
+		t.Errorf("SOA after reload: %+v", got)
+	}
+}
+
+func TestZoneResponseTruncation(t *testing.T) {
+	zone := testZone
+	for i := range 8 {
+		zone += "www TXT \"" + strings.Repeat(string(rune('a'+i)), 100) + "\"\n"
+	}
+	records, err := ParseZoneRecords(strings.NewReader(zone), mustParseName(t, "t.example.com"))
+	if err != nil {
+		t.Fatalf("ParseZoneRecords() error = %v", err)
+	}
+	h := newTestHandler(t, func(c *Config) {
+		c.RRLLimit = 0
+		c.ChallengeThreshold = 0
+		c.ZoneRecords = records
+	})
+	config := h.config
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	data, _ := dns.CreateQuery(mustParseName(t, "www.t.example.com"), dns.RRTypeTXT, 0x1234).Marshal()
+
+	// Without EDNS the RRset doesn't fit 512 bytes, so none of it is sent
+	raw := h.handleQuery(data, udp, config.MaxUDPSize)
+	if len(raw) > dns.EDNSMinUDPSize {
+		t.Errorf("UDP response of %d bytes, want at most %d", len(raw), dns.EDNSMinUDPSize)
+	}
+	resp, err := dns.ParseMessage(raw)
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if resp.Flags&0x0200 == 0 || len(resp.Answer) != 0 || resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("UDP response: TC %v, %d answers, rcode %d, want truncated", resp.Flags&0x0200 != 0, len(resp.Answer), resp.Rcode())
+	}
+
+	// Over TCP the whole RRset is sent
+	resp, err = dns.ParseMessage(h.handleQuery(data, tcp, tcpMaxMessageSize))
+	if err != nil {
+		t.Fatalf("ParseMessage() error = %v", err)
+	}
+	if resp.Flags&0x0200 != 0 || len(resp.Answer) != 8 {
+		t.Errorf("TCP response: TC %v, %d answers, want 8", resp.Flags&0x0200 != 0, len(resp.Answer))
+	}
+}
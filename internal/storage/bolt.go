@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltLockTimeout is how long OpenBolt waits for another process holding
+// the database to release it.
+const boltLockTimeout = time.Second
+
+// Bolt is a Store kept in a bbolt database. Unlike File, values aren't
+// held in memory, and each change is committed to disk before it returns,
+// so a crash loses nothing written. The file is created with mode 0600,
+// since it may hold key material, and is locked while open. Keys can't be
+// empty.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens or creates a bbolt database store.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+	return &Bolt{db: db}, nil
+}
+
+// Get returns the value of a key, or ErrNotFound.
+func (s *Bolt) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		// A cursor tells a missing key from an empty value
+		k, v := b.Cursor().Seek([]byte(key))
+		if !bytes.Equal(k, []byte(key)) {
+			return ErrNotFound
+		}
+		value = slices.Clone(v)
+		return nil
+	})
+	return value, err
+}
+
+// Put stores a value, replacing any previous one.
+func (s *Bolt) Put(bucket, key string, value []byte) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write state database: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a key, and its bucket once empty.
+func (s *Bolt) Delete(bucket, key string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return tx.DeleteBucket([]byte(bucket))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write state database: %w", err)
+	}
+	return nil
+}
+
+// ForEach calls fn for each key of a bucket in key order. The bucket is
+// read before fn is first called, so fn may modify the store.
+func (s *Bolt) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	var keys []string
+	var values [][]byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			values = append(values, slices.Clone(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read state database: %w", err)
+	}
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database, releasing its lock.
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// compactSlack is the number of superseded journal entries tolerated
+// beyond the live keys before the journal is rewritten.
+const compactSlack = 1024
+
+var fieldEncoding = base64.RawURLEncoding
+
+// File is a Store persisted to a journal file. Values are held in memory;
+// each change is appended to the journal, which is replayed on open and
+// rewritten once superseded entries dominate it. The file is created with
+// mode 0600, since it may hold key material.
+type File struct {
+	mem     *Memory
+	path    string
+	f       *os.File
+	entries int // journal lines, including superseded ones
+	mu      sync.Mutex
+}
+
+// OpenFile opens or creates a journal file store.
+func OpenFile(path string) (*File, error) {
+	s := &File{mem: NewMemory(), path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the journal. An incomplete last line, left by a crash
+// during a write, is ignored.
+func (s *File) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for lineNum := 1; ; lineNum++ {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read state file: %w", err)
+		}
+		if err := s.apply(strings.TrimSuffix(line, "\n")); err != nil {
+			return fmt.Errorf("%s:%d: %w", s.path, lineNum, err)
+		}
+	}
+}
+
+// apply applies a journal line: "put <bucket> <key> <value>" or
+// "del <bucket> <key>", with fields in unpadded URL-safe base64.
+func (s *File) apply(line string) error {
+	if line == "" {
+		return nil
+	}
+	fields := strings.Split(line, " ")
+	decoded := make([][]byte, len(fields)-1)
+	for i, field := range fields[1:] {
+		var err error
+		if decoded[i], err = fieldEncoding.DecodeString(field); err != nil {
+			return fmt.Errorf("invalid field %q", field)
+		}
+	}
+
+	switch {
+	case fields[0] == "put" && len(decoded) == 3:
+		s.mem.put(string(decoded[0]), string(decoded[1]), decoded[2])
+	case fields[0] == "del" && len(decoded) == 2:
+		s.mem.delete(string(decoded[0]), string(decoded[1]))
+	default:
+		return fmt.Errorf("invalid journal entry %q", fields[0])
+	}
+	return nil
+}
+
+// Get returns the value of a key, or ErrNotFound.
+func (s *File) Get(bucket, key string) ([]byte, error) {
+	return s.mem.Get(bucket, key)
+}
+
+// Put stores a value and appends it to the journal.
+func (s *File) Put(bucket, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append("put", bucket, key, value); err != nil {
+		return err
+	}
+	return s.mem.Put(bucket, key, value)
+}
+
+// Delete removes a key and appends the removal to the journal.
+func (s *File) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.mem.Get(bucket, key); errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err := s.append("del", bucket, key); err != nil {
+		return err
+	}
+	return s.mem.Delete(bucket, key)
+}
+
+// ForEach calls fn for each key of a bucket in key order.
+func (s *File) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return s.mem.ForEach(bucket, fn)
+}
+
+// Close syncs and closes the journal.
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
+
+// append writes a journal line, rewriting the journal first if it has
+// grown well beyond the live keys.
+func (s *File) append(op, bucket, key string, value ...[]byte) error {
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if s.entries > 2*s.mem.len()+compactSlack {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.f.WriteString(journalLine(op, append([][]byte{[]byte(bucket), []byte(key)}, value...)...)); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	s.entries++
+	return nil
+}
+
+// compact atomically replaces the journal with one entry per live key and
+// reopens it for appending.
+func (s *File) compact() error {
+	var b strings.Builder
+	for _, bucket := range slices.Sorted(maps.Keys(s.mem.buckets)) {
+		_ = s.mem.ForEach(bucket, func(key string, value []byte) error {
+			b.WriteString(journalLine("put", []byte(bucket), []byte(key), value))
+			return nil
+		})
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open state file: %w", err)
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = f
+	s.entries = s.mem.len()
+	return nil
+}
+
+// journalLine formats a journal entry.
+func journalLine(op string, fields ...[]byte) string {
+	var b strings.Builder
+	b.WriteString(op)
+	for _, field := range fields {
+		b.WriteByte(' ')
+		b.WriteString(fieldEncoding.EncodeToString(field))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
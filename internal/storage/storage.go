@@ -0,0 +1,156 @@
+// Package storage keeps state that should survive restarts, such as the
+// server's established sessions or the client's resolver history, behind a
+// small key-value interface.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Backends that Open can persist a store with.
+const (
+	// BackendFile keeps values in memory and changes in a journal file
+	// (see OpenFile)
+	BackendFile = "file"
+
+	// BackendBolt keeps values in a bbolt database (see OpenBolt)
+	BackendBolt = "bolt"
+)
+
+var (
+	// ErrNotFound is returned for keys that aren't stored.
+	ErrNotFound = errors.New("key not found")
+
+	ErrUnknownBackend = errors.New("unknown storage backend")
+)
+
+// Store is a key-value store with values grouped in named buckets.
+// Implementations are safe for concurrent use.
+type Store interface {
+	// Get returns the value of a key, or ErrNotFound
+	Get(bucket, key string) ([]byte, error)
+
+	// Put stores a value, replacing any previous one
+	Put(bucket, key string, value []byte) error
+
+	// Delete removes a key; deleting a missing key is not an error
+	Delete(bucket, key string) error
+
+	// ForEach calls fn for each key of a bucket in key order, stopping at
+	// the first error
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+
+	// Close releases the store
+	Close() error
+}
+
+// Open returns a store persisted to path with backend, BackendFile if
+// empty, or an in-memory store if path is empty.
+func Open(path, backend string) (Store, error) {
+	if err := CheckBackend(backend); err != nil {
+		return nil, err
+	}
+	switch {
+	case path == "":
+		return NewMemory(), nil
+	case backend == BackendBolt:
+		return OpenBolt(path)
+	}
+	return OpenFile(path)
+}
+
+// CheckBackend verifies a backend name; empty means BackendFile.
+func CheckBackend(backend string) error {
+	switch backend {
+	case "", BackendFile, BackendBolt:
+		return nil
+	}
+	return fmt.Errorf("%w %q, want %s or %s", ErrUnknownBackend, backend, BackendFile, BackendBolt)
+}
+
+// Memory is a Store that keeps values in memory only.
+type Memory struct {
+	buckets map[string]map[string][]byte
+	mu      sync.RWMutex
+}
+
+// NewMemory creates an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]map[string][]byte)}
+}
+
+// Get returns the value of a key, or ErrNotFound.
+func (m *Memory) Get(bucket, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.buckets[bucket][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(value), nil
+}
+
+// Put stores a value, replacing any previous one.
+func (m *Memory) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(bucket, key, value)
+	return nil
+}
+
+func (m *Memory) put(bucket, key string, value []byte) {
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = slices.Clone(value)
+}
+
+// Delete removes a key.
+func (m *Memory) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delete(bucket, key)
+	return nil
+}
+
+func (m *Memory) delete(bucket, key string) {
+	delete(m.buckets[bucket], key)
+	if len(m.buckets[bucket]) == 0 {
+		delete(m.buckets, bucket)
+	}
+}
+
+// ForEach calls fn for each key of a bucket in key order. The store isn't
+// locked while fn runs, so fn may modify it.
+func (m *Memory) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	m.mu.RLock()
+	b := maps.Clone(m.buckets[bucket])
+	m.mu.RUnlock()
+
+	for _, key := range slices.Sorted(maps.Keys(b)) {
+		if err := fn(key, slices.Clone(b[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing; the values are discarded with the store.
+func (m *Memory) Close() error {
+	return nil
+}
+
+// len returns the number of stored keys.
+func (m *Memory) len() int {
+	n := 0
+	for _, b := range m.buckets {
+		n += len(b)
+	}
+	return n
+}
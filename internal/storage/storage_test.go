@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+
+	if _, err := s.Get("b", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() missing key: got %v, want %v", err, ErrNotFound)
+	}
+	for _, kv := range [][2]string{{"k2", "two"}, {"k1", "one"}, {"k3", ""}} {
+		if err := s.Put("b", kv[0], []byte(kv[1])); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	if err := s.Put("other", "k1", []byte("elsewhere")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := s.Put("b", "k1", []byte("uno")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := s.Delete("b", "k2"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Delete("b", "missing"); err != nil {
+		t.Errorf("Delete() missing key: %v", err)
+	}
+
+	if got, err := s.Get("b", "k1"); err != nil || string(got) != "uno" {
+		t.Errorf("Get() = %q, %v", got, err)
+	}
+	var keys []string
+	err := s.ForEach("b", func(key string, value []byte) error {
+		keys = append(keys, key+"="+string(value))
+		return nil
+	})
+	if err != nil || len(keys) != 2 || keys[0] != "k1=uno" || keys[1] != "k3=" {
+		t.Errorf("ForEach() = %v, %v", keys, err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	s, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	testStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("State file mode: %v, %v", info.Mode(), err)
+	}
+
+	// The values survive reopening, and a torn last write is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("put Yg azE")
+	f.Close()
+
+	s, err = OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile() reopen error = %v", err)
+	}
+	defer s.Close()
+	if got, err := s.Get("b", "k1"); err != nil || string(got) != "uno" {
+		t.Errorf("Get() after reopen = %q, %v", got, err)
+	}
+	if _, err := s.Get("b", "k2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleted key after reopen: %v", err)
+	}
+	if got, err := s.Get("other", "k1"); err != nil || string(got) != "elsewhere" {
+		t.Errorf("Get() other bucket = %q, %v", got, err)
+	}
+}
+
+func TestBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, err := OpenBolt(path)
+	if err != nil {
+		t.Fatalf("OpenBolt() error = %v", err)
+	}
+	testStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("State database mode: %v, %v", info.Mode(), err)
+	}
+
+	// The values survive reopening, empty ones included
+	s, err = OpenBolt(path)
+	if err != nil {
+		t.Fatalf("OpenBolt() reopen error = %v", err)
+	}
+	defer s.Close()
+	if got, err := s.Get("b", "k1"); err != nil || string(got) != "uno" {
+		t.Errorf("Get() after reopen = %q, %v", got, err)
+	}
+	if got, err := s.Get("b", "k3"); err != nil || len(got) != 0 {
+		t.Errorf("Get() empty value after reopen = %q, %v", got, err)
+	}
+	if _, err := s.Get("b", "k2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleted key after reopen: %v", err)
+	}
+
+	// ForEach callbacks may change the store, as loaders that delete
+	// what they read do
+	err = s.ForEach("b", func(key string, _ []byte) error {
+		return s.Delete("b", key)
+	})
+	if err != nil {
+		t.Fatalf("ForEach() deleting error = %v", err)
+	}
+	if _, err := s.Get("b", "k1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Key deleted during ForEach still stored: %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		path, backend string
+		want          Store
+	}{
+		{"", "", &Memory{}},
+		{"", BackendBolt, &Memory{}},
+		{filepath.Join(dir, "journal"), "", &File{}},
+		{filepath.Join(dir, "file"), BackendFile, &File{}},
+		{filepath.Join(dir, "bolt"), BackendBolt, &Bolt{}},
+	} {
+		s, err := Open(tc.path, tc.backend)
+		if err != nil {
+			t.Fatalf("Open(%q, %q) error = %v", tc.path, tc.backend, err)
+		}
+		if got, want := reflect.TypeOf(s), reflect.TypeOf(tc.want); got != want {
+			t.Errorf("Open(%q, %q) = %v, want %v", tc.path, tc.backend, got, want)
+		}
+		s.Close()
+	}
+
+	if _, err := Open(filepath.Join(dir, "sql"), "sqlite"); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("Open() unknown backend: got %v, want %v", err, ErrUnknownBackend)
+	}
+}
+
+func TestFileCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	s, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3*compactSlack; i++ {
+		if err := s.Put("b", "k"+strconv.Itoa(i%10), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	if s.entries > 2*10+compactSlack+1 {
+		t.Errorf("Journal has %d entries for 10 keys", s.entries)
+	}
+
+	reopened, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile() reopen error = %v", err)
+	}
+	defer reopened.Close()
+	last := 3*compactSlack - 1
+	if got, err := reopened.Get("b", "k"+strconv.Itoa(last%10)); err != nil || string(got) != strconv.Itoa(last) {
+		t.Errorf("Get() after compaction = %q, %v", got, err)
+	}
+}
+
+func TestFileCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	if err := os.WriteFile(path, []byte("put Yg azE dg\nset Yg azE dg\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(path); err == nil {
+		t.Error("OpenFile() accepted a corrupt journal")
+	}
+}
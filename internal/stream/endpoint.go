@@ -0,0 +1,257 @@
+package stream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Endpoint limits
+const (
+	// DefaultBufferSize bounds the data read from a connection that the
+	// peer hasn't acknowledged yet. Reading stops while it is full, which
+	// throttles the connection's sender.
+	DefaultBufferSize = 64 * 1024
+
+	// WriteTimeout bounds writing the peer's data to a connection
+	WriteTimeout = 10 * time.Second
+
+	// readSize is the most data read from a connection at once
+	readSize = 16 * 1024
+)
+
+// Endpoint is one side of a stream, relaying a TCP connection to the
+// peer. Data read from the connection is kept until the peer acknowledges
+// it, so every frame can carry it again until then; data from the peer is
+// written to the connection in order, and duplicates are dropped. Frames
+// are exchanged in request and reply pairs, so there is no timer: a frame
+// whose exchange failed is simply sent again. Data can also be pushed
+// ahead of the exchanges with Fresh frames, which carry it only once.
+type Endpoint struct {
+	conn       net.Conn
+	bufferSize int
+	send       Buffer // data read from conn not yet acknowledged
+	sent       uint32 // offset after the data frames carried so far
+	eof        bool   // conn finished sending
+	finSent    bool   // a frame carried the FIN
+	finAcked   bool   // the peer received all data and the FIN
+	recvNext   uint32 // offset of the next byte from the peer
+	recvFIN    bool   // the peer finished sending
+	ackSent    uint32 // acknowledgement carried by the last frame
+	behind     bool   // data from the peer was lost, and it must resend
+	closed     bool
+	lastActive time.Time
+	ready      chan struct{} // signalled when data was read
+	notify     func()        // called when data was read, or nil
+	mu         sync.Mutex
+	cond       *sync.Cond // signalled when buffer space is available
+}
+
+// NewEndpoint starts relaying conn, buffering at most bufferSize bytes.
+// notify, if not nil, is called whenever data was read from conn, or it
+// finished sending.
+func NewEndpoint(conn net.Conn, bufferSize int, notify func()) *Endpoint {
+	e := &Endpoint{
+		conn:       conn,
+		bufferSize: bufferSize,
+		lastActive: time.Now(),
+		ready:      make(chan struct{}, 1),
+		notify:     notify,
+	}
+	e.cond = sync.NewCond(&e.mu)
+	go e.readLoop()
+	return e
+}
+
+// readLoop buffers data from the connection until it finishes sending or
+// the endpoint is closed.
+func (e *Endpoint) readLoop() {
+	buf := make([]byte, readSize)
+	for {
+		e.mu.Lock()
+		for len(e.send.Data) >= e.bufferSize && !e.closed {
+			e.cond.Wait()
+		}
+		closed := e.closed
+		room := e.bufferSize - len(e.send.Data)
+		e.mu.Unlock()
+		if closed {
+			return
+		}
+
+		n, err := e.conn.Read(buf[:min(room, len(buf))])
+		e.mu.Lock()
+		e.send.Data = append(e.send.Data, buf[:n]...)
+		if err != nil {
+			e.eof = true
+		}
+		e.mu.Unlock()
+
+		select {
+		case e.ready <- struct{}{}:
+		default:
+		}
+		if e.notify != nil {
+			e.notify()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Outgoing returns a frame for stream id carrying up to maxData bytes of
+// unacknowledged data, the acknowledgement of the peer's data, and the FIN
+// once the connection finished sending and all its data fits.
+func (e *Endpoint) Outgoing(op byte, id uint32, maxData int) *Frame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.frame(op, id, 0, min(len(e.send.Data), maxData))
+}
+
+// Fresh returns a frame like Outgoing, but carrying only data no frame
+// carried yet, or nil if there is no such data and the FIN was sent.
+func (e *Endpoint) Fresh(op byte, id uint32, maxData int) *Frame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	start := e.unsent()
+	n := min(len(e.send.Data)-start, maxData)
+	if n == 0 && (!e.eof || e.finSent) {
+		return nil
+	}
+	return e.frame(op, id, start, n)
+}
+
+// unsent returns the index in the send buffer of the first byte no frame
+// carried yet. The caller holds e.mu.
+func (e *Endpoint) unsent() int {
+	return int(min(e.sent-e.send.Base, uint32(len(e.send.Data))))
+}
+
+// frame builds a frame carrying n bytes of buffered data from index start.
+// The caller holds e.mu.
+func (e *Endpoint) frame(op byte, id uint32, start, n int) *Frame {
+	f := &Frame{
+		Op:     op,
+		Stream: id,
+		Seq:    e.send.Base + uint32(start),
+		Ack:    e.recvNext,
+		Data:   append([]byte(nil), e.send.Data[start:start+n]...),
+	}
+	if e.eof && start+n == len(e.send.Data) {
+		f.Flags |= FlagFIN
+		e.finSent = true
+	}
+	if start+n > e.unsent() {
+		e.sent = f.Seq + uint32(n)
+	}
+	e.ackSent = e.recvNext
+	e.behind = false
+	return f
+}
+
+// Receive applies a frame from the peer: drops the data it acknowledged,
+// writes its new data to the connection and, after the peer's FIN, closes
+// the connection for writing.
+func (e *Endpoint) Receive(f *Frame) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastActive = time.Now()
+	if e.send.Acknowledge(f.Ack) {
+		e.cond.Broadcast()
+	}
+	if e.finSent && f.Ack == e.send.End() {
+		e.finAcked = true
+	}
+
+	// Data after a gap is dropped; the peer resends it in its replies
+	// once acknowledgements show what's missing
+	if len(f.Data) > 0 && int32(f.Seq-e.recvNext) > 0 {
+		e.behind = true
+	}
+	data := Accept(e.recvNext, f.Seq, f.Data)
+	if len(data) > 0 && !e.recvFIN {
+		_ = e.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+		if _, err := e.conn.Write(data); err != nil {
+			return err
+		}
+		e.recvNext += uint32(len(data))
+	}
+
+	// All data up to the peer's FIN arrived
+	if f.FIN() && f.Seq+uint32(len(f.Data)) == e.recvNext && !e.recvFIN {
+		e.recvFIN = true
+		if tcp, ok := e.conn.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+	}
+	return nil
+}
+
+// Wait waits up to timeout for data from the connection, unless there is
+// some already or the connection finished sending.
+func (e *Endpoint) Wait(ctx context.Context, timeout time.Duration) {
+	e.mu.Lock()
+	waiting := len(e.send.Data) == 0 && !e.eof
+	e.mu.Unlock()
+	if !waiting {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-e.ready:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Ready returns a channel signalled when data was read from the
+// connection.
+func (e *Endpoint) Ready() <-chan struct{} {
+	return e.ready
+}
+
+// Idle reports whether there is nothing to exchange until the connection
+// sends more: nothing to send and the peer finished sending.
+func (e *Endpoint) Idle() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.send.Data) == 0 && !e.eof && e.recvFIN
+}
+
+// Pending reports whether there is anything to send: data or the FIN not
+// acknowledged yet, an acknowledgement of data received since the last
+// frame, or one that makes the peer resend lost data.
+func (e *Endpoint) Pending() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.send.Data) > 0 || (e.eof && !e.finAcked) || e.recvNext != e.ackSent || e.behind
+}
+
+// Done reports whether both sides finished sending and received all data.
+func (e *Endpoint) Done() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.finAcked && e.recvFIN
+}
+
+// Inactive reports whether no frame arrived for longer than d before now.
+func (e *Endpoint) Inactive(now time.Time, d time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return now.Sub(e.lastActive) > d
+}
+
+// Close closes the connection and stops reading from it.
+func (e *Endpoint) Close() {
+	e.mu.Lock()
+	e.closed = true
+	e.cond.Broadcast()
+	e.mu.Unlock()
+	e.conn.Close()
+}
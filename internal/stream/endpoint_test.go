@@ -0,0 +1,178 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+// sendAll writes data to conn and closes it for writing.
+func sendAll(conn net.Conn, data []byte) {
+	_, _ = conn.Write(data)
+	_ = conn.(*net.TCPConn).CloseWrite()
+}
+
+func TestEndpointLossyExchanges(t *testing.T) {
+	app, clientSide := tcpPair(t)
+	serverSide, dest := tcpPair(t)
+
+	client := NewEndpoint(clientSide, 4096, nil)
+	defer client.Close()
+	server := NewEndpoint(serverSide, 4096, nil)
+	defer server.Close()
+
+	upstream := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	downstream := bytes.Repeat([]byte("fedcba9876543210"), 700)
+	go sendAll(app, upstream)
+	go sendAll(dest, downstream)
+
+	gotUp := make(chan []byte, 1)
+	gotDown := make(chan []byte, 1)
+	go func() { data, _ := io.ReadAll(dest); gotUp <- data }()
+	go func() { data, _ := io.ReadAll(app); gotDown <- data }()
+
+	// Drop every third frame and every fourth reply; the data they carried
+	// must be sent again
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; !client.Done() || !server.Done(); i++ {
+		if time.Now().After(deadline) {
+			t.Fatal("stream didn't finish")
+		}
+		f := client.Outgoing(OpData, 1, MaxUpstreamData)
+		if i%3 == 2 {
+			continue
+		}
+		if err := server.Receive(f); err != nil {
+			t.Fatalf("server Receive() error = %v", err)
+		}
+		server.Wait(context.Background(), 10*time.Millisecond)
+		reply := server.Outgoing(OpData, 1, 1000)
+		if i%4 == 3 {
+			continue
+		}
+		if err := client.Receive(reply); err != nil {
+			t.Fatalf("client Receive() error = %v", err)
+		}
+	}
+
+	if data := <-gotUp; !bytes.Equal(data, upstream) {
+		t.Errorf("destination received %d bytes, want %d", len(data), len(upstream))
+	}
+	if data := <-gotDown; !bytes.Equal(data, downstream) {
+		t.Errorf("application received %d bytes, want %d", len(data), len(downstream))
+	}
+}
+
+func TestEndpointDropsDuplicates(t *testing.T) {
+	conn, peer := tcpPair(t)
+	e := NewEndpoint(conn, DefaultBufferSize, nil)
+	defer e.Close()
+
+	frames := []*Frame{
+		{Op: OpData, Seq: 0, Data: []byte("hello ")},
+		{Op: OpData, Seq: 0, Data: []byte("hello ")},     // retransmitted
+		{Op: OpData, Seq: 3, Data: []byte("lo world")},   // overlapping
+		{Op: OpData, Seq: 20, Data: []byte("ahead")},     // beyond a gap
+		{Op: OpData, Flags: FlagFIN, Seq: 11, Data: nil}, // FIN
+		{Op: OpData, Seq: 11, Data: []byte("after FIN")}, // ignored
+	}
+	for _, f := range frames {
+		if err := e.Receive(f); err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+	}
+
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("connection received %q, want %q", data, "hello world")
+	}
+	if f := e.Outgoing(OpData, 1, MaxUpstreamData); f.Ack != 11 {
+		t.Errorf("Outgoing() Ack = %d, want 11", f.Ack)
+	}
+}
+
+func TestEndpointFresh(t *testing.T) {
+	conn, peer := tcpPair(t)
+	e := NewEndpoint(conn, DefaultBufferSize, nil)
+	defer e.Close()
+
+	go sendAll(peer, []byte("0123456789"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e.mu.Lock()
+		eof := e.eof
+		e.mu.Unlock()
+		if eof {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection data not read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Fresh frames carry each byte once
+	if f := e.Fresh(OpData, 1, 4); f == nil || string(f.Data) != "0123" || f.FIN() {
+		t.Fatalf("Fresh() = %+v, want \"0123\"", f)
+	}
+	if f := e.Fresh(OpData, 1, 100); f == nil || string(f.Data) != "456789" || f.Seq != 4 || !f.FIN() {
+		t.Fatalf("Fresh() = %+v, want \"456789\" with FIN", f)
+	}
+	if f := e.Fresh(OpData, 1, 100); f != nil {
+		t.Errorf("Fresh() after all data = %+v, want nil", f)
+	}
+
+	// Outgoing frames still resend unacknowledged data
+	if f := e.Outgoing(OpData, 1, 100); string(f.Data) != "0123456789" {
+		t.Errorf("Outgoing() = %q, want all unacknowledged data", f.Data)
+	}
+
+	// Once everything is acknowledged only data from the peer after a gap,
+	// which asks for a resend, makes the endpoint send again
+	if !e.Pending() {
+		t.Error("Pending() = false with unacknowledged data")
+	}
+	if err := e.Receive(&Frame{Op: OpData, Ack: 10}); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if e.Pending() {
+		t.Error("Pending() = true with everything acknowledged")
+	}
+	if err := e.Receive(&Frame{Op: OpData, Seq: 5, Ack: 10, Data: []byte("x")}); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if !e.Pending() {
+		t.Error("Pending() = false after data beyond a gap")
+	}
+}
@@ -0,0 +1,177 @@
+// Package stream defines the frames that carry TCP streams through the
+// tunnel. Each tunnel exchange carries one frame from the client and one
+// back. Frames are sequenced by byte offsets and acknowledge the data
+// received, so either side can resend data whose exchange was lost. An
+// Endpoint implements this for one side of a stream.
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Frame operations
+const (
+	// OpOpen asks the server to connect to the address in the data, and
+	// acknowledges the connection in the reply
+	OpOpen byte = 1
+
+	// OpData carries stream data and acknowledgements; an empty frame
+	// polls for data
+	OpData byte = 2
+
+	// OpClose ends a stream after both sides finished and acknowledged
+	// all data
+	OpClose byte = 3
+
+	// OpReset aborts a stream; the data may hold a reason
+	OpReset byte = 4
+)
+
+// Frame flags
+const (
+	// FlagFIN marks the sender's last data: no data follows this frame's
+	FlagFIN byte = 0x01
+
+	// FlagNoWait asks the server to answer a frame without data at once
+	// instead of waiting for data, since the client polls for it
+	FlagNoWait byte = 0x02
+)
+
+// Stream limits
+const (
+	// HeaderSize is the size of the frame header.
+	// Format: [op (1)][flags (1)][stream ID (4)][seq (4)][ack (4)]
+	HeaderSize = 14
+
+	// MaxUpstreamData is the most data a client frame carries, keeping
+	// exchanges to a few query fragments
+	MaxUpstreamData = 512
+
+	// IdleTimeout is how long a stream without frames is kept
+	IdleTimeout = 2 * time.Minute
+)
+
+var (
+	ErrFrameTooShort = errors.New("stream frame too short")
+	ErrUnknownStream = errors.New("unknown stream")
+)
+
+// Frame is a stream message. Seq is the stream offset of the first data
+// byte, and Ack the offset of the next byte expected from the peer.
+// Offsets wrap around at 2^32.
+type Frame struct {
+	Op     byte
+	Flags  byte
+	Stream uint32
+	Seq    uint32
+	Ack    uint32
+	Data   []byte
+}
+
+// FIN reports whether the frame carries the sender's last data.
+func (f *Frame) FIN() bool {
+	return f.Flags&FlagFIN != 0
+}
+
+// NoWait reports whether the frame's reply shouldn't wait for data.
+func (f *Frame) NoWait() bool {
+	return f.Flags&FlagNoWait != 0
+}
+
+// Marshal converts the frame to wire format.
+func (f *Frame) Marshal() []byte {
+	buf := make([]byte, HeaderSize+len(f.Data))
+	buf[0] = f.Op
+	buf[1] = f.Flags
+	binary.BigEndian.PutUint32(buf[2:6], f.Stream)
+	binary.BigEndian.PutUint32(buf[6:10], f.Seq)
+	binary.BigEndian.PutUint32(buf[10:14], f.Ack)
+	copy(buf[HeaderSize:], f.Data)
+	return buf
+}
+
+// ParseFrame parses a frame from wire format.
+func ParseFrame(data []byte) (*Frame, error) {
+	if len(data) < HeaderSize {
+		return nil, ErrFrameTooShort
+	}
+	return &Frame{
+		Op:     data[0],
+		Flags:  data[1],
+		Stream: binary.BigEndian.Uint32(data[2:6]),
+		Seq:    binary.BigEndian.Uint32(data[6:10]),
+		Ack:    binary.BigEndian.Uint32(data[10:14]),
+		Data:   data[HeaderSize:],
+	}, nil
+}
+
+// MarshalFrames converts frames to the wire format of a poll reply: each
+// frame preceded by its 2-byte length.
+func MarshalFrames(frames []*Frame) []byte {
+	buf := []byte{}
+	for _, f := range frames {
+		data := f.Marshal()
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+		buf = append(buf, data...)
+	}
+	return buf
+}
+
+// ParseFrames parses the frames of a poll reply.
+func ParseFrames(data []byte) ([]*Frame, error) {
+	var frames []*Frame
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, ErrFrameTooShort
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+n {
+			return nil, ErrFrameTooShort
+		}
+		f, err := ParseFrame(data[2 : 2+n])
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+		data = data[2+n:]
+	}
+	return frames, nil
+}
+
+// Buffer is the unacknowledged data a side has sent: bytes from offset
+// Base on. Data is appended as it is produced and dropped once the peer
+// acknowledges it.
+type Buffer struct {
+	Base uint32
+	Data []byte
+}
+
+// Acknowledge drops the data before offset ack. It returns false if ack
+// is outside the buffered data.
+func (b *Buffer) Acknowledge(ack uint32) bool {
+	n := ack - b.Base
+	if n > uint32(len(b.Data)) {
+		return false
+	}
+	b.Data = b.Data[n:]
+	b.Base = ack
+	return true
+}
+
+// End returns the offset after the last buffered byte.
+func (b *Buffer) End() uint32 {
+	return b.Base + uint32(len(b.Data))
+}
+
+// Accept returns the part of data at offset seq that is new to a receiver
+// expecting offset next: nothing for a frame that starts later, and
+// without bytes already received for one that overlaps.
+func Accept(next, seq uint32, data []byte) []byte {
+	skip := next - seq
+	if skip > uint32(len(data)) {
+		return nil
+	}
+	return data[skip:]
+}
@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	f := &Frame{Op: OpData, Flags: FlagFIN, Stream: 7, Seq: 0xfffffff0, Ack: 42, Data: []byte("hello")}
+	parsed, err := ParseFrame(f.Marshal())
+	if err != nil {
+		t.Fatalf("ParseFrame() error = %v", err)
+	}
+	if parsed.Op != f.Op || !parsed.FIN() || parsed.Stream != f.Stream || parsed.Seq != f.Seq ||
+		parsed.Ack != f.Ack || !bytes.Equal(parsed.Data, f.Data) {
+		t.Errorf("ParseFrame() = %+v, want %+v", parsed, f)
+	}
+
+	if _, err := ParseFrame(make([]byte, HeaderSize-1)); !errors.Is(err, ErrFrameTooShort) {
+		t.Errorf("ParseFrame() short frame: got %v, want %v", err, ErrFrameTooShort)
+	}
+}
+
+func TestBufferAcknowledge(t *testing.T) {
+	b := &Buffer{Base: 0xfffffffe, Data: []byte("abcdef")}
+
+	if b.Acknowledge(b.Base - 1) {
+		t.Error("Acknowledge() accepted an offset before the buffer")
+	}
+	if b.Acknowledge(b.End() + 1) {
+		t.Error("Acknowledge() accepted an offset after the buffer")
+	}
+	// Acknowledging across the wrap-around
+	if !b.Acknowledge(3) || b.Base != 3 || string(b.Data) != "f" {
+		t.Errorf("Acknowledge() = %d %q, want 3 \"f\"", b.Base, b.Data)
+	}
+	if !b.Acknowledge(b.End()) || len(b.Data) != 0 {
+		t.Errorf("Acknowledge() of all data left %q", b.Data)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	tests := []struct {
+		name string
+		next uint32
+		seq  uint32
+		data string
+		want string
+	}{
+		{"in order", 10, 10, "abc", "abc"},
+		{"overlapping", 11, 10, "abc", "bc"},
+		{"duplicate", 13, 10, "abc", ""},
+		{"gap", 9, 10, "abc", ""},
+		{"wrap-around", 0, 0xffffffff, "abc", "bc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Accept(tt.next, tt.seq, []byte(tt.data)); string(got) != tt.want {
+				t.Errorf("Accept() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFramesRoundTrip(t *testing.T) {
+	frames := []*Frame{
+		{Op: OpData, Stream: 1, Seq: 10, Ack: 20, Data: []byte("abc")},
+		{Op: OpData, Flags: FlagFIN, Stream: 2, Seq: 30, Ack: 40},
+	}
+	parsed, err := ParseFrames(MarshalFrames(frames))
+	if err != nil {
+		t.Fatalf("ParseFrames() error = %v", err)
+	}
+	if len(parsed) != len(frames) {
+		t.Fatalf("ParseFrames() returned %d frames, want %d", len(parsed), len(frames))
+	}
+	for i, f := range frames {
+		if !bytes.Equal(parsed[i].Marshal(), f.Marshal()) {
+			t.Errorf("Frame %d: got %+v, want %+v", i, parsed[i], f)
+		}
+	}
+
+	if parsed, err := ParseFrames(nil); err != nil || len(parsed) != 0 {
+		t.Errorf("ParseFrames(nil) = %v, %v, want no frames", parsed, err)
+	}
+	data := MarshalFrames(frames)
+	if _, err := ParseFrames(data[:len(data)-1]); !errors.Is(err, ErrFrameTooShort) {
+		t.Errorf("ParseFrames() truncated: got %v, want %v", err, ErrFrameTooShort)
+	}
+}
@@ -0,0 +1,298 @@
+// Package config loads option files shared by the client and server
+// commands.
+//
+// A config file uses a flat subset of TOML where each key is a command
+// line flag name:
+//
+//	# Client configuration
+//	domain     = "t.example.com"
+//	key-file   = "/etc/dns-as-doh/key"
+//	resolvers  = ["8.8.8.8:53", "https://dns.google/dns-query"]
+//	timeout    = "3s"
+//	cache-size = 8192
+//
+// Underscores in keys are treated as dashes. Arrays are joined with commas,
+// matching the comma-separated list flags.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrSyntax        = errors.New("syntax error")
+	ErrUnknownOption = errors.New("unknown option")
+)
+
+// Option is a single key/value pair from a config file.
+type Option struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// Load reads the options in the config file at path.
+func Load(path string) ([]Option, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	var options []Option
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: %w: expected key = value", path, lineNum, ErrSyntax)
+		}
+
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		if key == "" {
+			return nil, fmt.Errorf("%s:%d: %w: missing key", path, lineNum, ErrSyntax)
+		}
+
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+
+		options = append(options, Option{Key: key, Value: value, Line: lineNum})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	return options, nil
+}
+
+// Apply loads the config file at path and sets the matching flags in fs.
+// Flags already set on the command line take precedence over the file.
+// Keys listed in skip (such as the config flag itself) are rejected.
+func Apply(fs *flag.FlagSet, path string, skip ...string) error {
+	return NewLoader(fs, path, skip...).Load()
+}
+
+// Loader applies a config file to a flag set and can re-apply it when the
+// file changes.
+type Loader struct {
+	fs       *flag.FlagSet
+	path     string
+	skip     []string
+	explicit map[string]bool
+}
+
+// NewLoader creates a loader for the config file at path. It must be
+// created after fs is parsed, so that it records which flags were set on
+// the command line.
+func NewLoader(fs *flag.FlagSet, path string, skip ...string) *Loader {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	return &Loader{fs: fs, path: path, skip: skip, explicit: explicit}
+}
+
+// Load reads the config file and sets the matching flags. Flags not set on
+// the command line are first reset to their defaults, so options removed
+// from the file revert on reload.
+func (l *Loader) Load() error {
+	options, err := Load(l.path)
+	if err != nil {
+		return err
+	}
+
+	for _, opt := range options {
+		if l.fs.Lookup(opt.Key) == nil || slices.Contains(l.skip, opt.Key) {
+			return fmt.Errorf("%s:%d: %w %q", l.path, opt.Line, ErrUnknownOption, opt.Key)
+		}
+	}
+
+	var resetErr error
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if !l.explicit[f.Name] && resetErr == nil {
+			resetErr = f.Value.Set(f.DefValue)
+		}
+	})
+	if resetErr != nil {
+		return fmt.Errorf("failed to reset flags: %w", resetErr)
+	}
+
+	for _, opt := range options {
+		if l.explicit[opt.Key] {
+			continue
+		}
+		if err := l.fs.Set(opt.Key, opt.Value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %q: %w", l.path, opt.Line, opt.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// Write writes the flags set in fs (on the command line or by a loaded
+// config file) to a new config file at path, readable only by the owner.
+// Flags listed in skip are not written.
+func Write(path string, fs *flag.FlagSet, header string, skip ...string) error {
+	var options []Option
+	fs.Visit(func(f *flag.Flag) {
+		if !slices.Contains(skip, f.Name) {
+			options = append(options, Option{Key: f.Name, Value: f.Value.String()})
+		}
+	})
+	return WriteOptions(path, header, options)
+}
+
+// WriteOptions writes options to a new config file at path, readable only
+// by the owner.
+func WriteOptions(path, header string, options []Option) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	defer f.Close()
+
+	// Tighten permissions of an existing file
+	if err := f.Chmod(0600); err != nil {
+		return fmt.Errorf("failed to set config file permissions: %w", err)
+	}
+
+	if _, err := f.WriteString(Format(header, options)); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// Format formats options as config file text, preceded by header as
+// comment lines.
+func Format(header string, options []Option) string {
+	var buf strings.Builder
+	if header != "" {
+		for _, line := range strings.Split(header, "\n") {
+			fmt.Fprintf(&buf, "# %s\n", line)
+		}
+	}
+	for _, opt := range options {
+		fmt.Fprintf(&buf, "%s = %s\n", opt.Key, strconv.Quote(opt.Value))
+	}
+	return buf.String()
+}
+
+// parseValue parses a string, number, boolean or array of those.
+func parseValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, "[") {
+		if !strings.HasSuffix(raw, "]") {
+			return "", fmt.Errorf("%w: unterminated array", ErrSyntax)
+		}
+
+		var items []string
+		for _, item := range splitArray(raw[1 : len(raw)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			v, err := parseScalar(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	}
+
+	return parseScalar(raw)
+}
+
+// parseScalar parses a quoted string, number or boolean.
+func parseScalar(raw string) (string, error) {
+	if raw == "" {
+		return "", fmt.Errorf("%w: missing value", ErrSyntax)
+	}
+
+	switch raw[0] {
+	case '"':
+		v, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid string %s", ErrSyntax, raw)
+		}
+		return v, nil
+	case '\'':
+		if len(raw) < 2 || raw[len(raw)-1] != '\'' {
+			return "", fmt.Errorf("%w: invalid string %s", ErrSyntax, raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+
+	if raw == "true" || raw == "false" {
+		return raw, nil
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(raw, "_", ""), 64); err == nil {
+		return strings.ReplaceAll(raw, "_", ""), nil
+	}
+
+	return "", fmt.Errorf("%w: invalid value %s", ErrSyntax, raw)
+}
+
+// splitArray splits array items on commas outside of quotes.
+func splitArray(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// stripComment removes a trailing # comment outside of quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
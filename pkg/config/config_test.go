@@ -0,0 +1,228 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+# Client configuration
+domain = "t.example.com"   # trailing comment
+key_file = '/etc/dns-as-doh/key'
+resolvers = ["8.8.8.8:53", "https://dns.google/dns-query{?dns}", "tls://a#b"]
+cache-size = 8_192
+tcp = false
+`)
+
+	options, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	want := []Option{
+		{Key: "domain", Value: "t.example.com", Line: 3},
+		{Key: "key-file", Value: "/etc/dns-as-doh/key", Line: 4},
+		{Key: "resolvers", Value: "8.8.8.8:53,https://dns.google/dns-query{?dns},tls://a#b", Line: 5},
+		{Key: "cache-size", Value: "8192", Line: 6},
+		{Key: "tcp", Value: "false", Line: 7},
+	}
+	if len(options) != len(want) {
+		t.Fatalf("Options: got %+v, want %+v", options, want)
+	}
+	for i := range want {
+		if options[i] != want[i] {
+			t.Errorf("Option %d: got %+v, want %+v", i, options[i], want[i])
+		}
+	}
+}
+
+func TestLoadSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "missing equals", content: "domain"},
+		{name: "missing key", content: `= "x"`},
+		{name: "missing value", content: "domain ="},
+		{name: "bare word", content: "domain = example"},
+		{name: "unterminated string", content: `domain = "example`},
+		{name: "unterminated array", content: `resolvers = ["a"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load(writeConfig(t, tt.content)); !errors.Is(err, ErrSyntax) {
+				t.Errorf("Load() error = %v, want %v", err, ErrSyntax)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	path := writeConfig(t, `
+listen = "127.0.0.1:5353"
+timeout = "5s"
+rate-limit = 50
+`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFile := fs.String("config", "", "")
+	listen := fs.String("listen", ":53", "")
+	timeout := fs.Duration("timeout", time.Second, "")
+	rateLimit := fs.Int("rate-limit", 100, "")
+
+	// Command line flags override the file
+	if err := fs.Parse([]string{"-config", path, "-rate-limit", "10"}); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if err := Apply(fs, *configFile, "config"); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	if *listen != "127.0.0.1:5353" {
+		t.Errorf("listen: got %q", *listen)
+	}
+	if *timeout != 5*time.Second {
+		t.Errorf("timeout: got %v", *timeout)
+	}
+	if *rateLimit != 10 {
+		t.Errorf("rate-limit: got %d, want command line value 10", *rateLimit)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr error
+	}{
+		{name: "unknown option", content: `bogus = 1`, wantErr: ErrUnknownOption},
+		{name: "skipped option", content: `config = "other.toml"`, wantErr: ErrUnknownOption},
+		{name: "invalid value", content: `rate-limit = "fast"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("config", "", "")
+			fs.Int("rate-limit", 100, "")
+
+			err := Apply(fs, writeConfig(t, tt.content), "config")
+			if err == nil {
+				t.Fatal("Expected error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Apply() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoaderReload(t *testing.T) {
+	path := writeConfig(t, `
+ttl = 120
+rate-limit = 50
+`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	ttl := fs.Uint("ttl", 60, "")
+	rateLimit := fs.Int("rate-limit", 100, "")
+	listen := fs.String("listen", ":53", "")
+
+	if err := fs.Parse([]string{"-listen", ":5353"}); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	loader := NewLoader(fs, path)
+	if err := loader.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if *ttl != 120 || *rateLimit != 50 {
+		t.Fatalf("After load: ttl=%d rate-limit=%d", *ttl, *rateLimit)
+	}
+
+	// Options removed from the file revert to their defaults
+	if err := os.WriteFile(path, []byte("rate-limit = 20\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := loader.Load(); err != nil {
+		t.Fatalf("Reload error = %v", err)
+	}
+	if *ttl != 60 {
+		t.Errorf("ttl: got %d, want default 60", *ttl)
+	}
+	if *rateLimit != 20 {
+		t.Errorf("rate-limit: got %d, want 20", *rateLimit)
+	}
+	if *listen != ":5353" {
+		t.Errorf("listen: got %q, want command line value", *listen)
+	}
+
+	// A bad file leaves the current values untouched
+	if err := os.WriteFile(path, []byte("bogus = 1\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := loader.Load(); err == nil {
+		t.Error("Expected error for unknown option")
+	}
+	if *rateLimit != 20 {
+		t.Errorf("rate-limit changed by failed reload: got %d", *rateLimit)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("domain", "", "")
+	fs.String("key", "", "")
+	fs.Int("rate-limit", 100, "")
+	fs.Bool("install", false, "")
+
+	if err := fs.Parse([]string{"-install", "-domain", "t.example.com", "-key", `a"b`}); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "sub", "server.conf")
+	if err := Write(path, fs, "Generated on install", "install"); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Permissions: got %o, want 600", perm)
+	}
+
+	// The written file loads back into the same values
+	options, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := []Option{
+		{Key: "domain", Value: "t.example.com", Line: 2},
+		{Key: "key", Value: `a"b`, Line: 3},
+	}
+	if len(options) != len(want) {
+		t.Fatalf("Options: got %+v, want %+v", options, want)
+	}
+	for i := range want {
+		if options[i] != want[i] {
+			t.Errorf("Option %d: got %+v, want %+v", i, options[i], want[i])
+		}
+	}
+}
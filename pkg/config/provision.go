@@ -0,0 +1,79 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Bundle file names written by WriteBundle
+const (
+	BundleKeyFile    = "key"
+	BundleClientFile = "client.toml"
+	BundleServerFile = "server.toml"
+)
+
+// Provision holds the settings a client and server must agree on, used to
+// generate matching config files alongside a new key.
+type Provision struct {
+	// Domain is the tunnel domain
+	Domain string
+
+	// KeyFile is the path of the key file. If empty, Key is inlined.
+	KeyFile string
+
+	// Key is the hex-encoded key, used when KeyFile is empty
+	Key string
+
+	// Resolvers are the client resolvers; omitted if empty
+	Resolvers []string
+
+	// Upstream is the server upstream resolver; omitted if empty
+	Upstream string
+}
+
+// ClientOptions returns the client config options.
+func (p *Provision) ClientOptions() []Option {
+	options := []Option{{Key: "domain", Value: p.Domain}}
+	options = append(options, p.keyOption())
+	if len(p.Resolvers) > 0 {
+		options = append(options, Option{Key: "resolvers", Value: strings.Join(p.Resolvers, ",")})
+	}
+	return options
+}
+
+// ServerOptions returns the server config options.
+func (p *Provision) ServerOptions() []Option {
+	options := []Option{{Key: "domain", Value: p.Domain}}
+	options = append(options, p.keyOption())
+	if p.Upstream != "" {
+		options = append(options, Option{Key: "upstream", Value: p.Upstream})
+	}
+	return options
+}
+
+// keyOption returns the option referencing the key.
+func (p *Provision) keyOption() Option {
+	if p.KeyFile != "" {
+		return Option{Key: "key-file", Value: p.KeyFile}
+	}
+	return Option{Key: "key", Value: p.Key}
+}
+
+// WriteBundle writes the client and server config files into dir,
+// referencing the key file BundleKeyFile in the same directory. The key
+// file itself is written by the caller.
+func (p *Provision) WriteBundle(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	bundle := *p
+	bundle.KeyFile = filepath.Join(abs, BundleKeyFile)
+
+	header := "config generated by -gen-key for " + p.Domain
+	if err := WriteOptions(filepath.Join(dir, BundleClientFile), "Client "+header, bundle.ClientOptions()); err != nil {
+		return err
+	}
+	return WriteOptions(filepath.Join(dir, BundleServerFile), "Server "+header, bundle.ServerOptions())
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProvisionOptions(t *testing.T) {
+	p := &Provision{
+		Domain:    "t.example.com",
+		Key:       "00ff",
+		Resolvers: []string{"8.8.8.8:53", "1.1.1.1:53"},
+	}
+
+	want := "domain = \"t.example.com\"\nkey = \"00ff\"\nresolvers = \"8.8.8.8:53,1.1.1.1:53\"\n"
+	if got := Format("", p.ClientOptions()); got != want {
+		t.Errorf("Client options:\ngot  %q\nwant %q", got, want)
+	}
+
+	// The key file takes precedence over the inline key
+	p.KeyFile = "/etc/dns-as-doh/key"
+	p.Upstream = "https://dns.google/dns-query"
+	want = "domain = \"t.example.com\"\nkey-file = \"/etc/dns-as-doh/key\"\nupstream = \"https://dns.google/dns-query\"\n"
+	if got := Format("", p.ServerOptions()); got != want {
+		t.Errorf("Server options:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	dir := t.TempDir()
+	p := &Provision{Domain: "t.example.com", Resolvers: []string{"9.9.9.9:53"}, Upstream: "8.8.8.8:53"}
+	if err := p.WriteBundle(dir); err != nil {
+		t.Fatalf("WriteBundle() error = %v", err)
+	}
+
+	// The generated client config loads into the client flags
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	domain := fs.String("domain", "", "")
+	keyFile := fs.String("key-file", "", "")
+	resolvers := fs.String("resolvers", "", "")
+	if err := Apply(fs, filepath.Join(dir, BundleClientFile)); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if *domain != "t.example.com" || *resolvers != "9.9.9.9:53" {
+		t.Errorf("Client config: domain %q, resolvers %q", *domain, *resolvers)
+	}
+	if want := filepath.Join(dir, BundleKeyFile); *keyFile != want {
+		t.Errorf("key-file: got %q, want %q", *keyFile, want)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, BundleServerFile))
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Server config permissions: got %04o, want 0600", perm)
+	}
+}
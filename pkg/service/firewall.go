@@ -0,0 +1,64 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var ErrFirewallUnsupported = errors.New("firewall rule management is not supported on this platform")
+
+// runCommand runs a command and returns its combined output. Tests replace
+// it to see the commands without running them.
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// firewallRuleName returns the name of the inbound rule for a service and
+// protocol.
+func firewallRuleName(name, protocol string) string {
+	return fmt.Sprintf("%s (%s)", name, protocol)
+}
+
+// firewallProtocols returns the protocols to open.
+func firewallProtocols(tcp bool) []string {
+	if tcp {
+		return []string{"UDP", "TCP"}
+	}
+	return []string{"UDP"}
+}
+
+// addNetshRules creates inbound Windows Firewall rules with netsh allowing
+// program to receive on port over UDP and, if tcp is set, TCP.
+func addNetshRules(name string, port int, tcp bool, program string) error {
+	for _, protocol := range firewallProtocols(tcp) {
+		out, err := runCommand("netsh", "advfirewall", "firewall", "add", "rule",
+			"name="+firewallRuleName(name, protocol),
+			"dir=in",
+			"action=allow",
+			"protocol="+protocol,
+			fmt.Sprintf("localport=%d", port),
+			"program="+program,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to add %s firewall rule: %w: %s", protocol, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// deleteNetshRules deletes the rules created by addNetshRules, trying all
+// of them and returning the first error.
+func deleteNetshRules(name string) error {
+	var firstErr error
+	for _, protocol := range firewallProtocols(true) {
+		out, err := runCommand("netsh", "advfirewall", "firewall", "delete", "rule",
+			"name="+firewallRuleName(name, protocol),
+		)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to delete %s firewall rule: %w: %s", protocol, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return firstErr
+}
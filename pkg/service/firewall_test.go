@@ -0,0 +1,94 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeCommands replaces runCommand for the duration of a test, recording
+// the commands run, and failing those whose arguments contain fail.
+func fakeCommands(t *testing.T, fail string) *[]string {
+	t.Helper()
+	var commands []string
+	prev := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		command := strings.Join(append([]string{name}, args...), " ")
+		commands = append(commands, command)
+		if fail != "" && strings.Contains(command, fail) {
+			return []byte("  The object already exists.\n"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+	t.Cleanup(func() { runCommand = prev })
+	return &commands
+}
+
+func TestAddNetshRules(t *testing.T) {
+	const rule = "netsh advfirewall firewall add rule name=dns-as-doh-server (%s) dir=in action=allow protocol=%s localport=53 program=C:\\dns\\server.exe"
+	udp := strings.ReplaceAll(rule, "%s", "UDP")
+	tcp := strings.ReplaceAll(rule, "%s", "TCP")
+
+	tests := []struct {
+		name    string
+		tcp     bool
+		fail    string
+		want    []string
+		wantErr string
+	}{
+		{name: "udp", want: []string{udp}},
+		{name: "udp and tcp", tcp: true, want: []string{udp, tcp}},
+		{name: "stops at failure", tcp: true, fail: "protocol=UDP", want: []string{udp},
+			wantErr: "failed to add UDP firewall rule: exit status 1: The object already exists."},
+		{name: "tcp fails", tcp: true, fail: "protocol=TCP", want: []string{udp, tcp},
+			wantErr: "failed to add TCP firewall rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := fakeCommands(t, tt.fail)
+			err := addNetshRules("dns-as-doh-server", 53, tt.tcp, `C:\dns\server.exe`)
+			if !slices.Equal(*commands, tt.want) {
+				t.Errorf("Commands:\n%s\nwant:\n%s", strings.Join(*commands, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("addNetshRules() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("addNetshRules() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeleteNetshRules(t *testing.T) {
+	udp := "netsh advfirewall firewall delete rule name=dns-as-doh-server-work (UDP)"
+	tcp := "netsh advfirewall firewall delete rule name=dns-as-doh-server-work (TCP)"
+
+	tests := []struct {
+		name    string
+		fail    string
+		wantErr string
+	}{
+		{name: "both"},
+		// A failed delete doesn't stop the next one
+		{name: "keeps going", fail: "(UDP)", wantErr: "failed to delete UDP firewall rule"},
+		// Installs without TCP added no TCP rule
+		{name: "missing tcp rule", fail: "(TCP)", wantErr: "failed to delete TCP firewall rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := fakeCommands(t, tt.fail)
+			err := deleteNetshRules("dns-as-doh-server-work")
+			if want := []string{udp, tcp}; !slices.Equal(*commands, want) {
+				t.Errorf("Commands:\n%s\nwant:\n%s", strings.Join(*commands, "\n"), strings.Join(want, "\n"))
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("deleteNetshRules() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("deleteNetshRules() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrInvalidInstance = errors.New("instance name must contain only letters, digits, '-' and '_'")
+
+// InstanceName returns the service name for a named instance of base. An
+// empty instance returns base unchanged.
+func InstanceName(base, instance string) (string, error) {
+	if instance == "" {
+		return base, nil
+	}
+
+	for _, c := range instance {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", fmt.Errorf("%w: %q", ErrInvalidInstance, instance)
+		}
+	}
+	return base + "-" + instance, nil
+}
+
+// InstanceDisplayName returns the display name for a named instance.
+func InstanceDisplayName(displayName, instance string) string {
+	if instance == "" {
+		return displayName
+	}
+	return fmt.Sprintf("%s (%s)", displayName, instance)
+}
+
+// InstanceArgs returns the command line an installed service runs with:
+// its config file and, for a named instance, the instance, which isn't
+// kept in the config file but picks the service name the service runs,
+// logs and listens for control requests under.
+func InstanceArgs(configPath, instance string) []string {
+	args := []string{"-config", configPath}
+	if instance != "" {
+		args = append(args, "-instance", instance)
+	}
+	return args
+}
+
+// InstanceConfigPath returns the config file of a named instance, or an
+// empty string if the instance has none.
+func InstanceConfigPath(name string) string {
+	path := GetConfigPath(name)
+	if path == "" {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestInstanceName(t *testing.T) {
+	tests := []struct {
+		instance string
+		want     string
+		wantErr  bool
+	}{
+		{instance: "", want: "dns-as-doh-client"},
+		{instance: "work", want: "dns-as-doh-client-work"},
+		{instance: "home_2", want: "dns-as-doh-client-home_2"},
+		{instance: "../etc", wantErr: true},
+		{instance: "a b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.instance, func(t *testing.T) {
+			got, err := InstanceName("dns-as-doh-client", tt.instance)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidInstance) {
+					t.Errorf("InstanceName(%q) error = %v, want %v", tt.instance, err, ErrInvalidInstance)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("InstanceName(%q) = %q, %v, want %q", tt.instance, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceArgs(t *testing.T) {
+	if got := InstanceArgs("/etc/c.conf", ""); !slices.Equal(got, []string{"-config", "/etc/c.conf"}) {
+		t.Errorf("InstanceArgs() = %q", got)
+	}
+	want := []string{"-config", "/etc/c.conf", "-instance", "work"}
+	if got := InstanceArgs("/etc/c.conf", "work"); !slices.Equal(got, want) {
+		t.Errorf("InstanceArgs(work) = %q, want %q", got, want)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
 )
@@ -19,6 +20,7 @@ After=network.target
 [Service]
 Type=simple
 ExecStart={{.ExecPath}} {{.Args}}
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=on-failure
 RestartSec=5
 User=root
@@ -30,19 +32,28 @@ ProtectSystem=strict
 ProtectHome=true
 PrivateTmp=true
 
+# Writable despite ProtectSystem: /run/{{.Name}} for the control socket,
+# /var/lib/{{.Name}} for state and the directories of configured files
+RuntimeDirectory={{.Name}}
+StateDirectory={{.Name}}
+{{range .WritablePaths}}ReadWritePaths=-{{.}}
+{{end}}
 [Install]
 WantedBy=multi-user.target
 `
 
 type serviceConfig struct {
-	Name        string
-	DisplayName string
-	ExecPath    string
-	Args        string
+	Name          string
+	DisplayName   string
+	ExecPath      string
+	Args          string
+	WritablePaths []string
 }
 
-// Install installs the service on Linux using systemd.
-func Install(name, displayName string, args []string) error {
+// Install installs the service on Linux using systemd. The service may
+// write to the directories of the files in writable, such as state files
+// and logs, besides its runtime and state directories.
+func Install(name, displayName string, args, writable []string) error {
 	exePath, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("failed to get executable path: %w", err)
@@ -65,26 +76,21 @@ func Install(name, displayName string, args []string) error {
 
 	// Create service config
 	config := serviceConfig{
-		Name:        name,
-		DisplayName: displayName,
-		ExecPath:    exePath,
-		Args:        strings.Join(serviceArgs, " "),
+		Name:          name,
+		DisplayName:   displayName,
+		ExecPath:      exePath,
+		Args:          strings.Join(serviceArgs, " "),
+		WritablePaths: writableDirs(writable),
 	}
 
 	// Generate service file
-	tmpl, err := template.New("service").Parse(systemdServiceTemplate)
+	unit, err := systemdUnit(config)
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %w", err)
+		return err
 	}
 
 	servicePath := fmt.Sprintf("/etc/systemd/system/%s.service", name)
-	f, err := os.Create(servicePath)
-	if err != nil {
-		return fmt.Errorf("failed to create service file: %w", err)
-	}
-	defer f.Close()
-
-	if err := tmpl.Execute(f, config); err != nil {
+	if err := os.WriteFile(servicePath, []byte(unit), 0644); err != nil {
 		os.Remove(servicePath)
 		return fmt.Errorf("failed to write service file: %w", err)
 	}
@@ -106,6 +112,37 @@ func Install(name, displayName string, args []string) error {
 	return nil
 }
 
+// systemdUnit returns the systemd unit of a service.
+func systemdUnit(config serviceConfig) (string, error) {
+	tmpl, err := template.New("service").Parse(systemdServiceTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, config); err != nil {
+		return "", fmt.Errorf("failed to write service file: %w", err)
+	}
+	return b.String(), nil
+}
+
+// writableDirs returns the absolute directories of the files, once each.
+// Whole directories are needed, as files are replaced by renaming a
+// temporary file next to them.
+func writableDirs(files []string) []string {
+	var dirs []string
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		dir, err := filepath.Abs(filepath.Dir(file))
+		if err != nil || slices.Contains(dirs, dir) {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
 // Uninstall uninstalls the service on Linux.
 func Uninstall(name string) error {
 	// Stop service if running (best-effort; may fail if not running)
@@ -128,6 +165,17 @@ func Uninstall(name string) error {
 	return nil
 }
 
+// AddFirewallRules is not supported on Linux; open the port with the
+// distribution's firewall tool instead.
+func AddFirewallRules(name string, port int, tcp bool) error {
+	return ErrFirewallUnsupported
+}
+
+// RemoveFirewallRules is not supported on Linux.
+func RemoveFirewallRules(name string) error {
+	return ErrFirewallUnsupported
+}
+
 // Run runs the service on Linux.
 // On Linux, the service just runs directly - systemd handles the lifecycle.
 func Run(name string, start func() error, stop func()) error {
@@ -148,12 +196,35 @@ func GetConfigPath(name string) string {
 		return etcPath
 	}
 
-	// Fall back to executable directory
-	exePath, err := os.Executable()
-	if err != nil {
-		return ""
+	// Fall back to an existing file in the executable directory
+	if exePath, err := os.Executable(); err == nil {
+		exeConfig := filepath.Join(filepath.Dir(exePath), name+".conf")
+		if _, err := os.Stat(exeConfig); err == nil {
+			return exeConfig
+		}
 	}
-	return filepath.Join(filepath.Dir(exePath), name+".conf")
+
+	// New config files go to /etc
+	return etcPath
+}
+
+// ControlSocketPath returns the path of the control socket of a running
+// service: in its runtime directory under /run when running as root,
+// otherwise in the user's runtime directory.
+func ControlSocketPath(name string) string {
+	if os.Geteuid() == 0 {
+		return rootControlSocketPath(name)
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, name+".sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d.sock", name, os.Geteuid()))
+}
+
+// rootControlSocketPath returns the control socket path of a service
+// running as root, in the RuntimeDirectory its unit has systemd create.
+func rootControlSocketPath(name string) string {
+	return filepath.Join("/run", name, "control.sock")
 }
 
 // CreateClientServiceFile creates a systemd service file for the client.
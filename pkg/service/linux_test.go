@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// directives returns the values of a directive in a systemd unit.
+func directives(unit, key string) []string {
+	var values []string
+	for _, line := range strings.Split(unit, "\n") {
+		if value, ok := strings.CutPrefix(line, key+"="); ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// checkSandbox checks that a unit lets the service create its control
+// socket despite ProtectSystem=strict.
+func checkSandbox(t *testing.T, unit, name string) {
+	t.Helper()
+	if !slices.Contains(directives(unit, "ProtectSystem"), "strict") {
+		return
+	}
+	runtime := directives(unit, "RuntimeDirectory")
+	if len(runtime) != 1 || filepath.Join("/run", runtime[0]) != filepath.Dir(rootControlSocketPath(name)) {
+		t.Errorf("RuntimeDirectory = %q, but the control socket is %s", runtime, rootControlSocketPath(name))
+	}
+	if state := directives(unit, "StateDirectory"); !slices.Equal(state, []string{name}) {
+		t.Errorf("StateDirectory = %q, want %s", state, name)
+	}
+}
+
+func TestSystemdUnit(t *testing.T) {
+	name := "dns-as-doh-server-work"
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := systemdUnit(serviceConfig{
+		Name:        name,
+		DisplayName: "DNS-as-DoH Server (work)",
+		ExecPath:    "/usr/local/bin/dns-as-doh-server",
+		Args:        strings.Join(InstanceArgs("/etc/x.conf", "work"), " "),
+		WritablePaths: writableDirs([]string{
+			"/var/lib/dns-as-doh/state.json", "", "/var/lib/dns-as-doh/top.jsonl", "audit.log",
+		}),
+	})
+	if err != nil {
+		t.Fatalf("systemdUnit() error = %v", err)
+	}
+
+	checkSandbox(t, unit, name)
+	want := []string{"-/var/lib/dns-as-doh", "-" + cwd}
+	if got := directives(unit, "ReadWritePaths"); !slices.Equal(got, want) {
+		t.Errorf("ReadWritePaths = %q, want %q", got, want)
+	}
+	if got := directives(unit, "ExecStart"); len(got) != 1 || !strings.HasSuffix(got[0], "-instance work") {
+		t.Errorf("ExecStart = %q", got)
+	}
+}
+
+func TestShippedUnits(t *testing.T) {
+	for _, name := range []string{"dns-as-doh-client", "dns-as-doh-server"} {
+		unit, err := os.ReadFile(filepath.Join("..", "..", "install", name+".service"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSandbox(t, string(unit), name)
+	}
+}
+
+func TestFirewallRulesUnsupported(t *testing.T) {
+	commands := fakeCommands(t, "")
+	if err := AddFirewallRules("dns-as-doh-server", 53, true); !errors.Is(err, ErrFirewallUnsupported) {
+		t.Errorf("AddFirewallRules() error = %v, want %v", err, ErrFirewallUnsupported)
+	}
+	if err := RemoveFirewallRules("dns-as-doh-server"); !errors.Is(err, ErrFirewallUnsupported) {
+		t.Errorf("RemoveFirewallRules() error = %v, want %v", err, ErrFirewallUnsupported)
+	}
+	if len(*commands) != 0 {
+		t.Errorf("Ran %q", *commands)
+	}
+}
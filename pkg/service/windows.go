@@ -86,8 +86,9 @@ loop:
 	return false, 0
 }
 
-// Install installs the service on Windows.
-func Install(name, displayName string, args []string) error {
+// Install installs the service on Windows. Windows services aren't
+// sandboxed, so writable is unused.
+func Install(name, displayName string, args, writable []string) error {
 	exePath, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("failed to get executable path: %w", err)
@@ -175,9 +176,28 @@ func Uninstall(name string) error {
 	// Remove event log source
 	eventlog.Remove(name)
 
+	// Remove firewall rules created by AddFirewallRules (best-effort)
+	_ = RemoveFirewallRules(name)
+
 	return nil
 }
 
+// AddFirewallRules creates inbound Windows Firewall rules allowing the
+// service executable to receive DNS on port over UDP and, if tcp is set, TCP.
+func AddFirewallRules(name string, port int, tcp bool) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	return addNetshRules(name, port, tcp, exePath)
+}
+
+// RemoveFirewallRules deletes the inbound rules created by AddFirewallRules.
+func RemoveFirewallRules(name string) error {
+	return deleteNetshRules(name)
+}
+
 // Run runs the service on Windows.
 func Run(name string, start func() error, stop func()) error {
 	// Check if running as service
@@ -215,6 +235,17 @@ func GetConfigPath(name string) string {
 	return filepath.Join(filepath.Dir(exePath), name+".conf")
 }
 
+// ControlSocketPath returns the path of the control socket of a running
+// service, next to the executable like the config file. Windows supports
+// Unix domain sockets since Windows 10 1803.
+func ControlSocketPath(name string) string {
+	exePath, err := os.Executable()
+	if err != nil {
+		return filepath.Join(os.TempDir(), name+".sock")
+	}
+	return filepath.Join(filepath.Dir(exePath), name+".sock")
+}
+
 // parseArgs parses command line arguments from a string.
 func parseArgs(cmdLine string) []string {
 	var args []string
@@ -196,6 +196,8 @@ Group=root
 NoNewPrivileges=true
 ProtectSystem=strict
 ReadWritePaths=/var/log
+RuntimeDirectory=dns-as-doh-client
+StateDirectory=dns-as-doh-client
 ProtectHome=true
 PrivateTmp=true
 
@@ -281,6 +283,8 @@ Group=root
 NoNewPrivileges=true
 ProtectSystem=strict
 ReadWritePaths=/var/log
+RuntimeDirectory=dns-as-doh-server
+StateDirectory=dns-as-doh-server
 ProtectHome=true
 PrivateTmp=true
 
@@ -87,6 +87,8 @@ Group=root
 NoNewPrivileges=true
 ProtectSystem=strict
 ReadWritePaths=/var/log
+RuntimeDirectory=dns-as-doh-client
+StateDirectory=dns-as-doh-client
 ProtectHome=true
 PrivateTmp=true
 
@@ -144,6 +146,8 @@ Group=root
 NoNewPrivileges=true
 ProtectSystem=strict
 ReadWritePaths=/var/log
+RuntimeDirectory=dns-as-doh-server
+StateDirectory=dns-as-doh-server
 ProtectHome=true
 PrivateTmp=true
 
@@ -4,10 +4,14 @@ package helpers
 import (
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -121,10 +125,15 @@ func CreateTestDNSResponse(query *dns.Message, data []byte) *dns.Message {
 
 // MockUpstreamDNS is a mock DNS server for testing.
 type MockUpstreamDNS struct {
-	conn   *net.UDPConn
-	ctx    context.Context
-	cancel context.CancelFunc
-	port   int
+	conn        *net.UDPConn
+	ctx         context.Context
+	cancel      context.CancelFunc
+	port        int
+	answerCount atomic.Int32
+	delay       atomic.Int64
+
+	mu      sync.Mutex
+	records map[uint16][]byte
 }
 
 // NewMockUpstreamDNS creates a new mock DNS server.
@@ -149,6 +158,8 @@ func NewMockUpstreamDNS(t *testing.T, port int) *MockUpstreamDNS {
 		port:   conn.LocalAddr().(*net.UDPAddr).Port,
 	}
 
+	mock.answerCount.Store(1)
+
 	// Start handler
 	go mock.handleQueries()
 
@@ -165,6 +176,35 @@ func (m *MockUpstreamDNS) Address() string {
 	return net.JoinHostPort("127.0.0.1", strconv.Itoa(m.port))
 }
 
+// SetAnswerCount sets the number of answer records in each response.
+func (m *MockUpstreamDNS) SetAnswerCount(n int) {
+	m.answerCount.Store(int32(n))
+}
+
+// SetRecordData sets the record data answered to queries of qtype instead
+// of the default 192.168.1.x addresses.
+func (m *MockUpstreamDNS) SetRecordData(qtype uint16, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.records == nil {
+		m.records = make(map[uint16][]byte)
+	}
+	m.records[qtype] = data
+}
+
+// recordData returns the record data set for qtype, if any.
+func (m *MockUpstreamDNS) recordData(qtype uint16) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.records[qtype]
+	return data, ok
+}
+
+// SetDelay delays each response by d.
+func (m *MockUpstreamDNS) SetDelay(d time.Duration) {
+	m.delay.Store(int64(d))
+}
+
 func (m *MockUpstreamDNS) handleQueries() {
 	buf := make([]byte, 4096)
 	for {
@@ -192,19 +232,31 @@ func (m *MockUpstreamDNS) handleQueries() {
 		// Create response
 		response := dns.CreateResponse(query)
 		if len(query.Question) > 0 {
-			response.Answer = []dns.RR{
-				{
-					Name:  query.Question[0].Name,
-					Type:  query.Question[0].Type,
+			q := query.Question[0]
+			for i := 0; i < int(m.answerCount.Load()); i++ {
+				data, ok := m.recordData(q.Type)
+				if !ok {
+					data = []byte{192, 168, 1, byte(i + 1)} // 192.168.1.x
+				}
+				response.Answer = append(response.Answer, dns.RR{
+					Name:  q.Name,
+					Type:  q.Type,
 					Class: dns.ClassIN,
 					TTL:   300,
-					Data:  []byte{192, 168, 1, 1}, // 192.168.1.1
-				},
+					Data:  data,
+				})
 			}
 		}
 
 		// Send response
 		respData, _ := response.Marshal()
+		if d := time.Duration(m.delay.Load()); d > 0 {
+			go func() {
+				time.Sleep(d)
+				_, _ = m.conn.WriteToUDP(respData, addr)
+			}()
+			continue
+		}
 		_, _ = m.conn.WriteToUDP(respData, addr)
 	}
 }
@@ -243,7 +295,7 @@ func SendQuery(t *testing.T, addr string, query *dns.Message, timeout time.Durat
 	}
 
 	_ = conn.SetReadDeadline(time.Now().Add(timeout))
-	buf := make([]byte, 4096)
+	buf := make([]byte, 65535)
 	n, err := conn.Read(buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read: %w", err)
@@ -251,3 +303,40 @@ func SendQuery(t *testing.T, addr string, query *dns.Message, timeout time.Durat
 
 	return dns.ParseMessage(buf[:n])
 }
+
+// SendTCPQuery sends a DNS query over TCP and returns the response.
+func SendTCPQuery(t *testing.T, addr string, query *dns.Message, timeout time.Duration) (*dns.Message, error) {
+	t.Helper()
+
+	queryData, err := query.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %w", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	msg := make([]byte, 2+len(queryData))
+	binary.BigEndian.PutUint16(msg, uint16(len(queryData)))
+	copy(msg[2:], queryData)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("failed to write: %w", err)
+	}
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("failed to read length: %w", err)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+
+	return dns.ParseMessage(buf)
+}
@@ -1,12 +1,24 @@
 package integration
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"log"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AliRezaBeigy/dns-as-doh/internal/client"
+	"github.com/AliRezaBeigy/dns-as-doh/internal/crypto"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/dns"
 	"github.com/AliRezaBeigy/dns-as-doh/internal/server"
 	"github.com/AliRezaBeigy/dns-as-doh/tests/helpers"
@@ -15,7 +27,9 @@ import (
 // TestEnvironment holds a complete test environment with client, server, and mock upstream.
 type TestEnvironment struct {
 	Client       *client.Resolver
+	ClientConfig *client.Config
 	Server       *server.Handler
+	ServerConfig *server.Config
 	MockUpstream *helpers.MockUpstreamDNS
 	Cleanup      func()
 }
@@ -98,7 +112,9 @@ func SetupTestEnvironment(t *testing.T) *TestEnvironment {
 
 	return &TestEnvironment{
 		Client:       clientResolver,
+		ClientConfig: clientConfig,
 		Server:       serverHandler,
+		ServerConfig: serverConfig,
 		MockUpstream: mockUpstream,
 		Cleanup:      cleanup,
 	}
@@ -205,6 +221,186 @@ func TestClientServerRoundTrip(t *testing.T) {
 	}
 }
 
+// TestClientServerRecordTypes verifies that inner queries of any record type
+// pass through the tunnel with their data intact.
+func TestClientServerRecordTypes(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	mx := dns.MX{Preference: 10, Exchange: helpers.MustParseName("mail.example.com")}
+	srv := dns.SRV{Priority: 1, Weight: 5, Port: 5060, Target: helpers.MustParseName("sip.example.com")}
+	soa := dns.SOA{
+		MName: helpers.MustParseName("ns1.example.com"), RName: helpers.MustParseName("hostmaster.example.com"),
+		Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+	}
+	https := dns.SVCB{Priority: 1, Target: helpers.MustParseName("svc.example.com"), Params: []byte{0, 1, 0, 3, 2, 'h', '2'}}
+	caa := dns.CAA{Tag: "issue", Value: []byte("letsencrypt.org")}
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		data  []byte
+		want  []byte
+	}{
+		{
+			name:  "MX query",
+			qname: "example.com",
+			qtype: dns.RRTypeMX,
+			// Exchange compressed against the question name, as upstream
+			// servers send it
+			data: []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, 12},
+			want: dns.EncodeMXData(mx),
+		},
+		{
+			name:  "SRV query",
+			qname: "_sip._udp.example.com",
+			qtype: dns.RRTypeSRV,
+			data:  dns.EncodeSRVData(srv),
+		},
+		{
+			name:  "PTR query",
+			qname: dns.ReverseName(netip.MustParseAddr("192.0.2.1")).String(),
+			qtype: dns.RRTypePTR,
+			data:  dns.EncodeNameData(helpers.MustParseName("host.example.com")),
+		},
+		{
+			name:  "IPv6 PTR query",
+			qname: dns.ReverseName(netip.MustParseAddr("2001:db8::1")).String(),
+			qtype: dns.RRTypePTR,
+			data:  dns.EncodeNameData(helpers.MustParseName("host6.example.com")),
+		},
+		{
+			name:  "HTTPS query",
+			qname: "example.com",
+			qtype: dns.RRTypeHTTPS,
+			data:  dns.EncodeSVCBData(https),
+		},
+		{
+			name:  "CAA query",
+			qname: "example.com",
+			qtype: dns.RRTypeCAA,
+			data:  dns.EncodeCAAData(caa),
+		},
+		{
+			name:  "NS query",
+			qname: "example.com",
+			qtype: dns.RRTypeNS,
+			data:  dns.EncodeNameData(helpers.MustParseName("ns1.example.com")),
+		},
+		{
+			name:  "SOA query",
+			qname: "example.com",
+			qtype: dns.RRTypeSOA,
+			data:  dns.EncodeSOAData(soa),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env.MockUpstream.SetRecordData(tt.qtype, tt.data)
+			want := tt.want
+			if want == nil {
+				want = tt.data
+			}
+
+			query := helpers.CreateTestDNSQuery(tt.qname, tt.qtype)
+			query.AddEDNS0(4096)
+
+			response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+			if err != nil {
+				t.Fatalf("SendQuery() error = %v", err)
+			}
+			if response.Rcode() != dns.RcodeNoError {
+				t.Fatalf("Response RCODE: got %d, want %d", response.Rcode(), dns.RcodeNoError)
+			}
+			if len(response.Answer) == 0 {
+				t.Fatal("Response should have at least one answer")
+			}
+
+			answer := response.Answer[0]
+			if answer.Type != tt.qtype {
+				t.Errorf("Answer type: got %d, want %d", answer.Type, tt.qtype)
+			}
+			if !bytes.Equal(answer.Data, want) {
+				t.Errorf("Answer data: got %x, want %x", answer.Data, want)
+			}
+		})
+	}
+
+	// Typed helpers decode the passed-through data
+	env.MockUpstream.SetRecordData(dns.RRTypeMX, dns.EncodeMXData(mx))
+	response, err := helpers.SendQuery(t, env.Client.ListenAddr(), helpers.CreateTestDNSQuery("example.com", dns.RRTypeMX), 5*time.Second)
+	if err != nil {
+		t.Fatalf("SendQuery() error = %v", err)
+	}
+	if len(response.Answer) == 0 {
+		t.Fatal("Response should have at least one answer")
+	}
+	got, err := dns.DecodeMXData(response.Answer[0].Data)
+	if err != nil {
+		t.Fatalf("DecodeMXData() error = %v", err)
+	}
+	if got.Preference != mx.Preference || got.Exchange.String() != mx.Exchange.String() {
+		t.Errorf("MX: got %+v, want %+v", got, mx)
+	}
+}
+
+// TestClientServerRawPassthrough verifies that in raw passthrough mode the
+// upstream response reaches the stub byte for byte.
+func TestClientServerRawPassthrough(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	// Upstream MX data with the exchange compressed against the question
+	// name; re-encoding expands the name
+	compressed := []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, 12}
+	env.MockUpstream.SetRecordData(dns.RRTypeMX, compressed)
+
+	exchange := func() []byte {
+		t.Helper()
+		query := helpers.CreateTestDNSQuery("example.com", dns.RRTypeMX)
+		data, err := query.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+
+		conn, err := net.Dial("udp", env.Client.ListenAddr())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := conn.Write(data); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if resp, err := dns.ParseMessage(buf[:n]); err != nil || resp.ID != query.ID {
+			t.Fatalf("Invalid response: %v", err)
+		}
+		return buf[:n]
+	}
+
+	if resp := exchange(); bytes.Contains(resp, compressed) {
+		t.Error("Re-encoded response kept the compressed name")
+	}
+
+	config := *env.ServerConfig
+	config.RawPassthrough = true
+	if err := env.Server.Reload(&config); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if resp := exchange(); !bytes.Contains(resp, compressed) {
+		t.Errorf("Raw response changed: %x", resp)
+	}
+}
+
 // TestClientServerEncryption verifies that encryption works end-to-end.
 func TestClientServerEncryption(t *testing.T) {
 	// Test that encryption is working end-to-end
@@ -276,114 +472,1920 @@ func TestClientServerEncryption(t *testing.T) {
 	}
 }
 
-// TestClientServerMultipleQueries tests handling of multiple sequential queries.
-func TestClientServerMultipleQueries(t *testing.T) {
-	env := SetupTestEnvironment(t)
-	defer env.Cleanup()
+// TestClientServerKeyRotation verifies that clients on the new and the
+// previous key are both served while a key is being rotated.
+func TestClientServerKeyRotation(t *testing.T) {
+	oldSecret := helpers.GenerateTestKey()
+	newSecret := helpers.GenerateTestKey()
 
-	// Send multiple queries
-	queries := []*dns.Message{
-		dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1001),
-		dns.CreateQuery(helpers.MustParseName("google.com"), dns.RRTypeA, 0x1002),
-		dns.CreateQuery(helpers.MustParseName("github.com"), dns.RRTypeA, 0x1003),
-	}
+	serverPort := helpers.PickPort(t)
+	upstreamPort := helpers.PickPort(t)
 
-	for _, q := range queries {
-		q.AddEDNS0(4096)
+	mockUpstream := helpers.NewMockUpstreamDNS(t, upstreamPort)
+	defer mockUpstream.Close()
+
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:           "t.example.com",
+		SharedSecret:     newSecret,
+		PreviousSecrets:  [][]byte{oldSecret},
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
 	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
 
-	// Send queries sequentially
-	for i, query := range queries {
-		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	for name, secret := range map[string][]byte{"new key": newSecret, "previous key": oldSecret} {
+		t.Run(name, func(t *testing.T) {
+			clientResolver, err := client.NewResolver(&client.Config{
+				ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+				ServerDomain:  "t.example.com",
+				Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+				SharedSecret:  secret,
+				Timeout:       5 * time.Second,
+				MaxConcurrent: 100,
+			})
 			if err != nil {
-				t.Errorf("Query %d failed: %v", i, err)
-				return
+				t.Fatalf("Failed to create client: %v", err)
 			}
+			if err := clientResolver.Start(); err != nil {
+				t.Fatalf("Failed to start client: %v", err)
+			}
+			defer clientResolver.Stop()
+
+			time.Sleep(100 * time.Millisecond)
 
+			query := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1234)
+			response, err := helpers.SendQuery(t, clientResolver.ListenAddr(), query, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
 			if response.Rcode() != dns.RcodeNoError {
-				t.Errorf("Query %d RCODE: got %d, want %d", i, response.Rcode(), dns.RcodeNoError)
+				t.Errorf("Response RCODE: got %d, want %d", response.Rcode(), dns.RcodeNoError)
 			}
 		})
 	}
 }
 
-// TestClientServerErrorHandling tests error handling for invalid queries.
-func TestClientServerErrorHandling(t *testing.T) {
-	env := SetupTestEnvironment(t)
-	defer env.Cleanup()
+// TestClientServerPerClientKeys tests that clients are served only with the
+// key registered for their key ID.
+func TestClientServerPerClientKeys(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+	aliceSecret := helpers.GenerateTestKey()
+	bobSecret := helpers.GenerateTestKey()
 
-	// Test invalid query (no questions)
-	query := &dns.Message{
-		ID:    0x1234,
-		Flags: 0x0100,
-		// No questions
-	}
+	serverPort := helpers.PickPort(t)
+	upstreamPort := helpers.PickPort(t)
 
-	response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, time.Second)
+	mockUpstream := helpers.NewMockUpstreamDNS(t, upstreamPort)
+	defer mockUpstream.Close()
+
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:           "t.example.com",
+		SharedSecret:     sharedSecret,
+		ClientKeys:       map[uint16][]crypto.ClientKey{1: {{Secret: aliceSecret}}, 2: {{Secret: bobSecret}}},
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+	})
 	if err != nil {
-		// Expected - client should return error or format error response
-		return
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
 	}
+	defer serverHandler.Stop()
 
-	if response != nil && response.Rcode() != dns.RcodeFormatError {
-		t.Errorf("Error RCODE: got %d, want %d", response.Rcode(), dns.RcodeFormatError)
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name   string
+		secret []byte
+		keyID  uint16
+		wantOK bool
+	}{
+		{name: "shared key", secret: sharedSecret, keyID: 0, wantOK: true},
+		{name: "client key", secret: aliceSecret, keyID: 1, wantOK: true},
+		{name: "wrong key for id", secret: bobSecret, keyID: 1},
+		{name: "unknown id", secret: aliceSecret, keyID: 3},
 	}
-}
 
-// TestClientServerConcurrentQueries tests handling of concurrent queries.
-func TestClientServerConcurrentQueries(t *testing.T) {
-	env := SetupTestEnvironment(t)
-	defer env.Cleanup()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientResolver, err := client.NewResolver(&client.Config{
+				ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+				ServerDomain:  "t.example.com",
+				Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+				SharedSecret:  tt.secret,
+				KeyID:         tt.keyID,
+				Timeout:       2 * time.Second,
+				MaxConcurrent: 100,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			if err := clientResolver.Start(); err != nil {
+				t.Fatalf("Failed to start client: %v", err)
+			}
+			defer clientResolver.Stop()
 
-	// Create multiple queries
-	numQueries := 10
-	queries := make([]*dns.Message, numQueries)
-	for i := 0; i < numQueries; i++ {
-		queries[i] = dns.CreateQuery(
-			helpers.MustParseName("example.com"),
-			dns.RRTypeA,
-			uint16(0x2000+i),
-		)
-		queries[i].AddEDNS0(4096)
+			time.Sleep(100 * time.Millisecond)
+
+			query := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1234)
+			response, err := helpers.SendQuery(t, clientResolver.ListenAddr(), query, 5*time.Second)
+			ok := err == nil && response.Rcode() == dns.RcodeNoError
+			if ok != tt.wantOK {
+				t.Errorf("Query succeeded: got %v, want %v (err %v)", ok, tt.wantOK, err)
+			}
+		})
 	}
+}
 
-	// Send queries concurrently
-	type result struct {
-		response *dns.Message
-		err      error
-		index    int
+// TestClientServerRevokedKey tests that a client using a revoked or expired
+// key is told so by the server.
+func TestClientServerRevokedKey(t *testing.T) {
+	revokedSecret := helpers.GenerateTestKey()
+	expiredSecret := helpers.GenerateTestKey()
+
+	mockUpstream := helpers.NewMockUpstreamDNS(t, helpers.PickPort(t))
+	defer mockUpstream.Close()
+
+	revocations := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(revocations, []byte("1 # lost laptop\n"), 0600); err != nil {
+		t.Fatalf("Failed to write revocation list: %v", err)
 	}
-	results := make(chan result, numQueries)
 
-	for i, query := range queries {
-		go func(idx int, q *dns.Message) {
-			resp, err := helpers.SendQuery(t, env.Client.ListenAddr(), q, 5*time.Second)
-			results <- result{response: resp, err: err, index: idx}
-		}(i, query)
+	serverAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t)))
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:   serverAddr,
+		Domain:       "t.example.com",
+		SharedSecret: helpers.GenerateTestKey(),
+		ClientKeys: map[uint16][]crypto.ClientKey{
+			1: {{Secret: revokedSecret}},
+			2: {{Secret: expiredSecret, Policy: crypto.KeyPolicy{Until: time.Now().Add(-time.Hour)}}},
+		},
+		RevocationFile:   revocations,
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
 	}
+	defer serverHandler.Stop()
 
-	// Collect results
-	responses := make(map[int]*dns.Message)
-	errors := make(map[int]error)
+	tests := []struct {
+		name   string
+		secret []byte
+		keyID  uint16
+		reason string
+	}{
+		{name: "revoked", secret: revokedSecret, keyID: 1, reason: server.ErrKeyRevoked.Error()},
+		{name: "expired", secret: expiredSecret, keyID: 2, reason: crypto.ErrKeyExpired.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientResolver, err := client.NewResolver(&client.Config{
+				ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+				ServerDomain:  "t.example.com",
+				Resolvers:     []string{serverAddr},
+				SharedSecret:  tt.secret,
+				KeyID:         tt.keyID,
+				Timeout:       2 * time.Second,
+				MaxConcurrent: 100,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			if err := clientResolver.Start(); err != nil {
+				t.Fatalf("Failed to start client: %v", err)
+			}
+			defer clientResolver.Stop()
 
-	for i := 0; i < numQueries; i++ {
-		res := <-results
-		responses[res.index] = res.response
-		if res.err != nil {
-			errors[res.index] = res.err
-		}
+			query := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1234)
+			response, err := helpers.SendQuery(t, clientResolver.ListenAddr(), query, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Failed to send query: %v", err)
+			}
+			if response.Rcode() != dns.RcodeRefused {
+				t.Errorf("Rcode: got %d, want REFUSED", response.Rcode())
+			}
+			status := clientResolver.Status()
+			if status.KeyRejected != tt.reason || status.Healthy() {
+				t.Errorf("Status: key rejected %q, healthy %v; want %q, unhealthy", status.KeyRejected, status.Healthy(), tt.reason)
+			}
+		})
 	}
+}
 
-	// Verify all succeeded
-	for i := 0; i < numQueries; i++ {
-		if err, ok := errors[i]; ok {
-			t.Errorf("Query %d failed: %v", i, err)
+// TestClientServerHandshake tests queries over session keys established
+// with a handshake, and a new handshake after the server forgets the session.
+func TestClientServerHandshake(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+
+	serverPort := helpers.PickPort(t)
+	upstreamPort := helpers.PickPort(t)
+
+	mockUpstream := helpers.NewMockUpstreamDNS(t, upstreamPort)
+	defer mockUpstream.Close()
+
+	serverConfig := &server.Config{
+		ListenAddr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:           "t.example.com",
+		SharedSecret:     sharedSecret,
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+	}
+	startServer := func() *server.Handler {
+		h, err := server.NewHandler(serverConfig)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
 		}
-		if resp := responses[i]; resp == nil {
-			t.Errorf("Query %d has nil response", i)
-		} else if resp.Rcode() != dns.RcodeNoError {
-			t.Errorf("Query %d RCODE: got %d, want %d", i, resp.Rcode(), dns.RcodeNoError)
+		if err := h.Start(); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
 		}
+		time.Sleep(100 * time.Millisecond)
+		return h
 	}
+
+	serverHandler := startServer()
+
+	clientResolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+		SharedSecret:  sharedSecret,
+		Timeout:       2 * time.Second,
+		MaxConcurrent: 100,
+		Handshake:     true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := clientResolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer clientResolver.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	query := func(id uint16) (*dns.Message, error) {
+		q := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, id)
+		return helpers.SendQuery(t, clientResolver.ListenAddr(), q, 5*time.Second)
+	}
+
+	// The first query performs the handshake, the second reuses the session
+	for _, id := range []uint16{0x1001, 0x1002} {
+		response, err := query(id)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if response.Rcode() != dns.RcodeNoError {
+			t.Errorf("Response RCODE: got %d, want %d", response.Rcode(), dns.RcodeNoError)
+		}
+	}
+
+	// A restarted server has no session; the failed query makes the client
+	// perform a new handshake
+	serverHandler.Stop()
+	serverHandler = startServer()
+	defer serverHandler.Stop()
+
+	if response, err := query(0x1003); err == nil && response.Rcode() == dns.RcodeNoError {
+		t.Error("Expected query with a forgotten session to fail")
+	}
+	response, err := query(0x1004)
+	if err != nil {
+		t.Fatalf("Query after new handshake failed: %v", err)
+	}
+	if response.Rcode() != dns.RcodeNoError {
+		t.Errorf("Response RCODE after new handshake: got %d, want %d", response.Rcode(), dns.RcodeNoError)
+	}
+	// The restarted server tracks the client from its new handshake on
+	sessions := serverHandler.Sessions()
+	if len(sessions) != 1 || sessions[0].Queries == 0 || sessions[0].BytesUp == 0 || sessions[0].BytesDown == 0 {
+		t.Errorf("Sessions() = %+v, want one client with traffic", sessions)
+	}
+}
+
+// TestClientServerMaintenance tests that maintenance mode refuses new
+// sessions while established ones keep working.
+func TestClientServerMaintenance(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+
+	serverPort := helpers.PickPort(t)
+	upstreamPort := helpers.PickPort(t)
+
+	mockUpstream := helpers.NewMockUpstreamDNS(t, upstreamPort)
+	defer mockUpstream.Close()
+
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:           "t.example.com",
+		SharedSecret:     sharedSecret,
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
+
+	startClient := func() *client.Resolver {
+		r, err := client.NewResolver(&client.Config{
+			ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+			ServerDomain:  "t.example.com",
+			Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+			SharedSecret:  sharedSecret,
+			Timeout:       2 * time.Second,
+			MaxConcurrent: 100,
+			Handshake:     true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		if err := r.Start(); err != nil {
+			t.Fatalf("Failed to start client: %v", err)
+		}
+		return r
+	}
+	established := startClient()
+	defer established.Stop()
+	newcomer := startClient()
+	defer newcomer.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	query := func(r *client.Resolver, id uint16) bool {
+		q := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, id)
+		response, err := helpers.SendQuery(t, r.ListenAddr(), q, 5*time.Second)
+		return err == nil && response.Rcode() == dns.RcodeNoError
+	}
+
+	if !query(established, 0x2001) {
+		t.Fatal("Query before maintenance failed")
+	}
+
+	serverHandler.SetMaintenance(true)
+	if !query(established, 0x2002) {
+		t.Error("Query over an established session failed in maintenance mode")
+	}
+	if query(newcomer, 0x2003) {
+		t.Error("Expected a new session to be refused in maintenance mode")
+	}
+
+	serverHandler.SetMaintenance(false)
+	if !query(newcomer, 0x2004) {
+		t.Error("Query after maintenance failed")
+	}
+}
+
+// TestClientServerSessionResumption tests that a restarted client resumes
+// its session from the session file instead of performing a handshake.
+func TestClientServerSessionResumption(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+
+	serverPort := helpers.PickPort(t)
+	upstreamPort := helpers.PickPort(t)
+
+	mockUpstream := helpers.NewMockUpstreamDNS(t, upstreamPort)
+	defer mockUpstream.Close()
+
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:           "t.example.com",
+		SharedSecret:     sharedSecret,
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
+
+	sessionFile := filepath.Join(t.TempDir(), "session")
+	startClient := func() *client.Resolver {
+		r, err := client.NewResolver(&client.Config{
+			ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+			ServerDomain:  "t.example.com",
+			Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+			SharedSecret:  sharedSecret,
+			Timeout:       2 * time.Second,
+			MaxConcurrent: 100,
+			Handshake:     true,
+			SessionFile:   sessionFile,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		if err := r.Start(); err != nil {
+			t.Fatalf("Failed to start client: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return r
+	}
+	query := func(r *client.Resolver, id uint16) bool {
+		q := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, id)
+		response, err := helpers.SendQuery(t, r.ListenAddr(), q, 5*time.Second)
+		return err == nil && response.Rcode() == dns.RcodeNoError
+	}
+
+	first := startClient()
+	if !query(first, 0x4001) {
+		t.Fatal("Query before restart failed")
+	}
+	first.Stop()
+
+	// Maintenance mode refuses handshakes, so only a resumed session
+	// answers the restarted client
+	serverHandler.SetMaintenance(true)
+	restarted := startClient()
+	defer restarted.Stop()
+	for id := uint16(0x4002); id < 0x4004; id++ {
+		if !query(restarted, id) {
+			t.Fatalf("Query %#x after restart failed", id)
+		}
+	}
+}
+
+// TestClientServerNetworkChange tests that a client keeps its session while
+// queries are lost, as when it changes networks, and replaces a session the
+// server forgot as soon as it migrates.
+func TestClientServerNetworkChange(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+
+	serverPort := helpers.PickPort(t)
+	upstreamPort := helpers.PickPort(t)
+
+	mockUpstream := helpers.NewMockUpstreamDNS(t, upstreamPort)
+	defer mockUpstream.Close()
+
+	startServer := func(stateFile string, maintenance bool) *server.Handler {
+		h, err := server.NewHandler(&server.Config{
+			ListenAddr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+			Domain:           "t.example.com",
+			SharedSecret:     sharedSecret,
+			UpstreamResolver: mockUpstream.Address(),
+			UpstreamType:     "udp",
+			MaxUDPSize:       1232,
+			ResponseTTL:      60,
+			MaxConcurrent:    100,
+			RateLimit:        1000,
+			StateFile:        stateFile,
+			Maintenance:      maintenance,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		if err := h.Start(); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return h
+	}
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	serverHandler := startServer(stateFile, false)
+
+	clientResolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+		SharedSecret:  sharedSecret,
+		Timeout:       500 * time.Millisecond,
+		MaxConcurrent: 100,
+		Handshake:     true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := clientResolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer clientResolver.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	query := func(id uint16) bool {
+		q := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, id)
+		response, err := helpers.SendQuery(t, clientResolver.ListenAddr(), q, 5*time.Second)
+		return err == nil && response.Rcode() == dns.RcodeNoError
+	}
+
+	if !query(0x3001) {
+		t.Fatal("Query before network change failed")
+	}
+
+	// Queries lost while the server can't be reached don't end the
+	// session: the server, refusing new sessions, still serves it
+	serverHandler.Stop()
+	if query(0x3002) {
+		t.Fatal("Expected query to fail while the server is down")
+	}
+	serverHandler = startServer(stateFile, true)
+	if !query(0x3003) {
+		t.Error("Query over the kept session failed")
+	}
+
+	// A session the server forgot is replaced when the client migrates,
+	// so the next query succeeds
+	serverHandler.Stop()
+	serverHandler = startServer("", false)
+	defer serverHandler.Stop()
+	clientResolver.Migrate()
+	if !query(0x3004) {
+		t.Error("Query after migration failed")
+	}
+}
+
+// TestClientServerDiagnose tests the connectivity test through a working
+// and a dead resolver.
+func TestClientServerDiagnose(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	dead := net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t)))
+	resolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{env.ServerConfig.ListenAddr, dead},
+		SharedSecret:  env.ServerConfig.SharedSecret,
+		Timeout:       500 * time.Millisecond,
+		MaxConcurrent: 100,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer resolver.Stop()
+
+	d := resolver.Diagnose(context.Background())
+	if !d.OK() || len(d.Resolvers) != 2 {
+		t.Fatalf("Diagnose() = %+v, want the server reachable", d)
+	}
+	if d.QueryPayload <= 0 {
+		t.Errorf("QueryPayload = %d, want positive", d.QueryPayload)
+	}
+
+	// The server answers with up to its maximum UDP size
+	ok := d.Resolvers[0]
+	if ok.Err != nil || ok.Latency <= 0 || ok.EDNSSize != 1232 || ok.MaxResponse <= 512 || ok.MaxResponse > 1232 {
+		t.Errorf("Working resolver: %+v", ok)
+	}
+	if d.Resolvers[1].Err == nil {
+		t.Errorf("Dead resolver: %+v, want an error", d.Resolvers[1])
+	}
+}
+
+// TestClientServerPathDiscovery tests path discovery through a resolver
+// that drops long query names and large responses: without it, a large
+// exchange fails; with it, fragments are sized to get through.
+func TestClientServerPathDiscovery(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	const maxName, maxResponse = 180, 700
+	proxy := startLossyResolver(t, env.ServerConfig.ListenAddr, maxName, maxResponse)
+	defer proxy.Close()
+
+	resolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{proxy.LocalAddr().String()},
+		SharedSecret:  env.ServerConfig.SharedSecret,
+		Timeout:       300 * time.Millisecond,
+		MaxConcurrent: 100,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := resolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer resolver.Stop()
+
+	env.MockUpstream.SetAnswerCount(60)
+	query := func(id uint16) bool {
+		q := dns.CreateQuery(helpers.MustParseName(strings.Repeat("a", 60)+".example.com"), dns.RRTypeA, id)
+		q.AddEDNS0(4096)
+		response, err := helpers.SendQuery(t, resolver.ListenAddr(), q, 5*time.Second)
+		return err == nil && response.Rcode() == dns.RcodeNoError && len(response.Answer) == 60
+	}
+
+	if query(0x5001) {
+		t.Fatal("Query through the lossy resolver succeeded before path discovery")
+	}
+
+	if err := resolver.DiscoverPaths(context.Background()); err != nil {
+		t.Fatalf("DiscoverPaths() error = %v", err)
+	}
+	if !query(0x5002) {
+		t.Error("Query after path discovery failed")
+	}
+}
+
+// startLossyResolver starts a UDP proxy to server that, like a resolver
+// mangling what it doesn't support, drops queries whose name is longer
+// than maxName bytes and responses larger than maxResponse bytes.
+func startLossyResolver(t *testing.T, server string, maxName, maxResponse int) *net.UDPConn {
+	return startRelay(t, server, func(data []byte) []byte {
+		query, err := dns.ParseMessage(data)
+		if err != nil || len(query.Question) != 1 || len(query.Question[0].Name.String()) > maxName {
+			return nil
+		}
+		return data
+	}, maxResponse)
+}
+
+// startCaseFoldingResolver starts a UDP proxy to server that, like a
+// resolver keeping only hostname characters, drops queries whose name
+// has other bytes and lowercases the rest.
+func startCaseFoldingResolver(t *testing.T, server string) *net.UDPConn {
+	return startRelay(t, server, func(data []byte) []byte {
+		query, err := dns.ParseMessage(data)
+		if err != nil || len(query.Question) != 1 {
+			return nil
+		}
+		for _, label := range query.Question[0].Name {
+			for i, b := range label {
+				if !(b == '-' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z') {
+					return nil
+				}
+				label[i] = b | 0x20
+			}
+		}
+		data, err = query.Marshal()
+		if err != nil {
+			return nil
+		}
+		return data
+	}, dns.MaxEDNSSize)
+}
+
+// startTypeFilteringResolver starts a UDP proxy to server that, like a
+// resolver filtering some record types, drops queries of those types.
+func startTypeFilteringResolver(t *testing.T, server string, types ...uint16) *net.UDPConn {
+	return startRelay(t, server, func(data []byte) []byte {
+		query, err := dns.ParseMessage(data)
+		if err != nil || len(query.Question) != 1 || slices.Contains(types, query.Question[0].Type) {
+			return nil
+		}
+		return data
+	}, dns.MaxEDNSSize)
+}
+
+// startRelay starts a UDP proxy to server that passes each query through
+// rewrite, dropping it if that returns nil, and drops responses larger
+// than maxResponse bytes.
+func startRelay(t *testing.T, server string, rewrite func(query []byte) []byte, maxResponse int) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	upstream, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		t.Fatalf("Invalid server address: %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, dns.MaxEDNSSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			data := rewrite(bytes.Clone(buf[:n]))
+			if data == nil {
+				continue
+			}
+
+			go func(data []byte, addr *net.UDPAddr) {
+				c, err := net.DialUDP("udp", nil, upstream)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+				if _, err := c.Write(data); err != nil {
+					return
+				}
+				resp := make([]byte, dns.MaxEDNSSize)
+				n, err := c.Read(resp)
+				if err != nil || n > maxResponse {
+					return
+				}
+				_, _ = conn.WriteToUDP(resp[:n], addr)
+			}(data, addr)
+		}
+	}()
+	return conn
+}
+
+// TestClientServerCodecNegotiation tests path discovery picking the
+// densest query name codec every resolver carries.
+func TestClientServerCodecNegotiation(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	folding := startCaseFoldingResolver(t, env.ServerConfig.ListenAddr)
+	defer folding.Close()
+
+	tests := []struct {
+		name      string
+		resolvers []string
+		want      dns.Codec
+	}{
+		{"direct", []string{env.ServerConfig.ListenAddr}, dns.CodecBinary},
+		{"case folding", []string{folding.LocalAddr().String()}, dns.CodecBase32},
+		{"mixed", []string{env.ServerConfig.ListenAddr, folding.LocalAddr().String()}, dns.CodecBase32},
+	}
+
+	env.MockUpstream.SetAnswerCount(20)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := client.NewResolver(&client.Config{
+				ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+				ServerDomain:  "t.example.com",
+				Resolvers:     tt.resolvers,
+				SharedSecret:  env.ServerConfig.SharedSecret,
+				Timeout:       500 * time.Millisecond,
+				MaxConcurrent: 100,
+				MaxCodec:      dns.CodecBinary,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			if err := resolver.Start(); err != nil {
+				t.Fatalf("Failed to start client: %v", err)
+			}
+			defer resolver.Stop()
+
+			if err := resolver.DiscoverPaths(context.Background()); err != nil {
+				t.Fatalf("DiscoverPaths() error = %v", err)
+			}
+			if got := resolver.Status().QueryCodec; got != tt.want.String() {
+				t.Errorf("QueryCodec = %s, want %s", got, tt.want)
+			}
+
+			qname := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example.com"
+			query := dns.CreateQuery(helpers.MustParseName(qname), dns.RRTypeA, uint16(0x7000+i))
+			query.AddEDNS0(4096)
+			response, err := helpers.SendQuery(t, resolver.ListenAddr(), query, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Failed to send query: %v", err)
+			}
+			if response.Rcode() != dns.RcodeNoError || len(response.Answer) != 20 {
+				t.Errorf("Response: RCODE %d with %d answers, want 20", response.Rcode(), len(response.Answer))
+			}
+		})
+	}
+}
+
+// TestClientServerCarrierFallback tests path discovery falling back to
+// other response carriers through resolvers filtering record types.
+func TestClientServerCarrierFallback(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	tests := []struct {
+		filtered []uint16
+		want     dns.Carrier
+	}{
+		{[]uint16{dns.RRTypeTXT}, dns.CarrierHTTPS},
+		{[]uint16{dns.RRTypeTXT, dns.RRTypeHTTPS}, dns.CarrierNULL},
+		{[]uint16{dns.RRTypeTXT, dns.RRTypeHTTPS, dns.RRTypeNULL}, dns.CarrierAAAA},
+		{[]uint16{dns.RRTypeTXT, dns.RRTypeHTTPS, dns.RRTypeNULL, dns.RRTypeAAAA}, dns.CarrierCNAME},
+	}
+
+	// A response spanning several fragments
+	env.MockUpstream.SetAnswerCount(40)
+	for i, tt := range tests {
+		t.Run(tt.want.String(), func(t *testing.T) {
+			filtering := startTypeFilteringResolver(t, env.ServerConfig.ListenAddr, tt.filtered...)
+			defer filtering.Close()
+
+			resolver, err := client.NewResolver(&client.Config{
+				ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+				ServerDomain:  "t.example.com",
+				Resolvers:     []string{filtering.LocalAddr().String()},
+				SharedSecret:  env.ServerConfig.SharedSecret,
+				Timeout:       500 * time.Millisecond,
+				MaxConcurrent: 100,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			if err := resolver.Start(); err != nil {
+				t.Fatalf("Failed to start client: %v", err)
+			}
+			defer resolver.Stop()
+
+			if err := resolver.DiscoverPaths(context.Background()); err != nil {
+				t.Fatalf("DiscoverPaths() error = %v", err)
+			}
+			if got := resolver.Status().Carrier; got != tt.want.String() {
+				t.Errorf("Carrier = %s, want %s", got, tt.want)
+			}
+
+			query := dns.CreateQuery(helpers.MustParseName(strings.Repeat("a", 60)+".example.com"), dns.RRTypeA, uint16(0x7100+i))
+			query.AddEDNS0(4096)
+			response, err := helpers.SendQuery(t, resolver.ListenAddr(), query, 10*time.Second)
+			if err != nil {
+				t.Fatalf("Failed to send query: %v", err)
+			}
+			if response.Rcode() != dns.RcodeNoError || len(response.Answer) != 40 {
+				t.Errorf("Response: RCODE %d with %d answers, want 40", response.Rcode(), len(response.Answer))
+			}
+		})
+	}
+}
+
+// TestClientServerCompression tests compression being negotiated and
+// large responses arriving compressed.
+func TestClientServerCompression(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+	env.MockUpstream.SetAnswerCount(40)
+
+	newClient := func(compression bool) *client.Resolver {
+		t.Helper()
+		resolver, err := client.NewResolver(&client.Config{
+			ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+			ServerDomain:  "t.example.com",
+			Resolvers:     []string{env.ServerConfig.ListenAddr},
+			SharedSecret:  env.ServerConfig.SharedSecret,
+			Timeout:       5 * time.Second,
+			MaxConcurrent: 100,
+			Compression:   compression,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		if err := resolver.Start(); err != nil {
+			t.Fatalf("Failed to start client: %v", err)
+		}
+		return resolver
+	}
+	query := func(resolver *client.Resolver, id uint16) {
+		t.Helper()
+		q := dns.CreateQuery(helpers.MustParseName(strings.Repeat("a", 60)+".example.com"), dns.RRTypeA, id)
+		response, err := helpers.SendQuery(t, resolver.ListenAddr(), q, 10*time.Second)
+		if err != nil {
+			t.Fatalf("Failed to send query: %v", err)
+		}
+		if response.Rcode() != dns.RcodeNoError || len(response.Answer) != 40 {
+			t.Errorf("Response: RCODE %d with %d answers, want 40", response.Rcode(), len(response.Answer))
+		}
+	}
+
+	// A server without compression is used as before
+	resolver := newClient(true)
+	defer resolver.Stop()
+	query(resolver, 0x7200)
+	if resolver.Status().Compression {
+		t.Error("Compression negotiated with a server without it")
+	}
+
+	// Once the server compresses replies, both directions are compressed
+	reloaded := *env.ServerConfig
+	reloaded.Compression = true
+	if err := env.Server.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	for i := range 3 {
+		query(resolver, uint16(0x7210+i))
+	}
+	if !resolver.Status().Compression {
+		t.Error("Compression not negotiated")
+	}
+
+	// Clients with compression off still get plain replies
+	plain := newClient(false)
+	defer plain.Stop()
+	query(plain, 0x7220)
+	if plain.Status().Compression {
+		t.Error("Compression used with it off")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, for capturing logs.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestClientServerTraceLog tests client and server logging a tunneled
+// query under the same trace ID.
+func TestClientServerTraceLog(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	reloaded := *env.ServerConfig
+	reloaded.TraceLog = true
+	if err := env.Server.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	resolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{env.ServerConfig.ListenAddr},
+		SharedSecret:  env.ServerConfig.SharedSecret,
+		Timeout:       5 * time.Second,
+		MaxConcurrent: 100,
+		TraceLog:      true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := resolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer resolver.Stop()
+
+	query := dns.CreateQuery(helpers.MustParseName("traced.example.com"), dns.RRTypeA, 0x7300)
+	query.AddEDNS0(4096)
+	if _, err := helpers.SendQuery(t, resolver.ListenAddr(), query, 5*time.Second); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+
+	var traces []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, rest, ok := strings.Cut(line, "trace "); ok && strings.Contains(rest, "traced.example.com") {
+			traces = append(traces, strings.SplitN(rest, ":", 2)[0])
+		}
+	}
+	if len(traces) != 2 || traces[0] != traces[1] {
+		t.Errorf("Trace log lines: %q, want one each from client and server with the same ID", traces)
+	}
+}
+
+// TestClientServerTraceLogSample tests that sampled trace logs keep the
+// same first query on both sides and drop the rest.
+func TestClientServerTraceLogSample(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	reloaded := *env.ServerConfig
+	reloaded.TraceLog = true
+	reloaded.TraceLogSample = 5
+	if err := env.Server.Reload(&reloaded); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	resolver, err := client.NewResolver(&client.Config{
+		ListenAddr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:   "t.example.com",
+		Resolvers:      []string{env.ServerConfig.ListenAddr},
+		SharedSecret:   env.ServerConfig.SharedSecret,
+		Timeout:        5 * time.Second,
+		MaxConcurrent:  100,
+		TraceLog:       true,
+		TraceLogSample: 5,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := resolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer resolver.Stop()
+
+	for i := range 5 {
+		query := dns.CreateQuery(helpers.MustParseName("sampled"+strconv.Itoa(i)+".example.com"), dns.RRTypeA, uint16(0x7400+i))
+		query.AddEDNS0(4096)
+		if _, err := helpers.SendQuery(t, resolver.ListenAddr(), query, 5*time.Second); err != nil {
+			t.Fatalf("Failed to send query: %v", err)
+		}
+	}
+
+	var names []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, rest, ok := strings.Cut(line, "trace "); ok && strings.Contains(rest, "sampled") {
+			names = append(names, strings.Fields(rest)[1])
+		}
+	}
+	if len(names) != 2 || names[0] != "sampled0.example.com" || names[1] != names[0] {
+		t.Errorf("Trace log lines for %q, want one each from client and server for the first query", names)
+	}
+}
+
+// TestClientServerListeners tests extra listeners routing their queries
+// through the tunnel or straight to a resolver.
+func TestClientServerListeners(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	direct := helpers.NewMockUpstreamDNS(t, helpers.PickPort(t))
+	defer direct.Close()
+	direct.SetRecordData(dns.RRTypeA, []byte{10, 0, 0, 1})
+
+	tunnelAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t)))
+	directAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t)))
+	resolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{env.ServerConfig.ListenAddr},
+		SharedSecret:  env.ServerConfig.SharedSecret,
+		Timeout:       2 * time.Second,
+		MaxConcurrent: 100,
+		Listeners: []client.ListenerConfig{
+			{Addr: tunnelAddr, Route: client.RouteTunnel},
+			{Addr: directAddr, Route: client.RouteDirect, Resolvers: []string{direct.Address()}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := resolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer resolver.Stop()
+
+	// The server's upstream answers 192.168.1.1, the direct resolver
+	// 10.0.0.1
+	for i, tt := range []struct {
+		addr string
+		want net.IP
+	}{
+		{resolver.ListenAddr(), net.IPv4(192, 168, 1, 1)},
+		{tunnelAddr, net.IPv4(192, 168, 1, 1)},
+		{directAddr, net.IPv4(10, 0, 0, 1)},
+	} {
+		query := dns.CreateQuery(helpers.MustParseName("app.example.com"), dns.RRTypeA, uint16(0x7000+i))
+		response, err := helpers.SendQuery(t, tt.addr, query, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Query on %s: %v", tt.addr, err)
+		}
+		if response.ID != query.ID || len(response.Answer) != 1 || !net.IP(response.Answer[0].Data).Equal(tt.want) {
+			t.Errorf("Query on %s: ID %#x, answers %v, want %v", tt.addr, response.ID, response.Answer, tt.want)
+		}
+	}
+}
+
+// TestClientServerMultipleQueries tests handling of multiple sequential queries.
+func TestClientServerMultipleQueries(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	// Send multiple queries
+	queries := []*dns.Message{
+		dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1001),
+		dns.CreateQuery(helpers.MustParseName("google.com"), dns.RRTypeA, 0x1002),
+		dns.CreateQuery(helpers.MustParseName("github.com"), dns.RRTypeA, 0x1003),
+	}
+
+	for _, q := range queries {
+		q.AddEDNS0(4096)
+	}
+
+	// Send queries sequentially
+	for i, query := range queries {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+			if err != nil {
+				t.Errorf("Query %d failed: %v", i, err)
+				return
+			}
+
+			if response.Rcode() != dns.RcodeNoError {
+				t.Errorf("Query %d RCODE: got %d, want %d", i, response.Rcode(), dns.RcodeNoError)
+			}
+		})
+	}
+}
+
+// TestClientServerErrorHandling tests error handling for invalid queries.
+func TestClientServerErrorHandling(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	// Test invalid query (no questions)
+	query := &dns.Message{
+		ID:    0x1234,
+		Flags: 0x0100,
+		// No questions
+	}
+
+	response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, time.Second)
+	if err != nil {
+		// Expected - client should return error or format error response
+		return
+	}
+
+	if response != nil && response.Rcode() != dns.RcodeFormatError {
+		t.Errorf("Error RCODE: got %d, want %d", response.Rcode(), dns.RcodeFormatError)
+	}
+}
+
+// TestClientServerConcurrentQueries tests handling of concurrent queries.
+func TestClientServerConcurrentQueries(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	// Create multiple queries
+	numQueries := 10
+	queries := make([]*dns.Message, numQueries)
+	for i := 0; i < numQueries; i++ {
+		queries[i] = dns.CreateQuery(
+			helpers.MustParseName("example.com"),
+			dns.RRTypeA,
+			uint16(0x2000+i),
+		)
+		queries[i].AddEDNS0(4096)
+	}
+
+	// Send queries concurrently
+	type result struct {
+		response *dns.Message
+		err      error
+		index    int
+	}
+	results := make(chan result, numQueries)
+
+	for i, query := range queries {
+		go func(idx int, q *dns.Message) {
+			resp, err := helpers.SendQuery(t, env.Client.ListenAddr(), q, 5*time.Second)
+			results <- result{response: resp, err: err, index: idx}
+		}(i, query)
+	}
+
+	// Collect results
+	responses := make(map[int]*dns.Message)
+	errors := make(map[int]error)
+
+	for i := 0; i < numQueries; i++ {
+		res := <-results
+		responses[res.index] = res.response
+		if res.err != nil {
+			errors[res.index] = res.err
+		}
+	}
+
+	// Verify all succeeded
+	for i := 0; i < numQueries; i++ {
+		if err, ok := errors[i]; ok {
+			t.Errorf("Query %d failed: %v", i, err)
+		}
+		if resp := responses[i]; resp == nil {
+			t.Errorf("Query %d has nil response", i)
+		} else if resp.Rcode() != dns.RcodeNoError {
+			t.Errorf("Query %d RCODE: got %d, want %d", i, resp.Rcode(), dns.RcodeNoError)
+		}
+	}
+}
+
+// TestClientServerFragmentation tests queries and responses that do not fit
+// in a single tunnel query name or TXT answer.
+func TestClientServerFragmentation(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	// Long query name so the encrypted query spans several tunnel queries
+	qname := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + "." +
+		strings.Repeat("c", 60) + ".example.com"
+
+	// Enough answers that the response spans several TXT answers
+	env.MockUpstream.SetAnswerCount(120)
+
+	query := dns.CreateQuery(helpers.MustParseName(qname), dns.RRTypeA, 0x4242)
+	query.AddEDNS0(4096)
+
+	response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+
+	if response.Rcode() != dns.RcodeNoError {
+		t.Errorf("Response RCODE: got %d, want %d", response.Rcode(), dns.RcodeNoError)
+	}
+
+	if len(response.Answer) != 120 {
+		t.Errorf("Answer count: got %d, want 120", len(response.Answer))
+	}
+
+	if len(response.Question) != 1 || response.Question[0].Name.String() != qname {
+		t.Errorf("Question mismatch: got %v", response.Question)
+	}
+}
+
+// TestClientServerStealth tests queries with shaped tunnel names, switched
+// on by reloading the client.
+func TestClientServerStealth(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	for _, level := range []dns.StealthLevel{dns.StealthLow, dns.StealthMedium, dns.StealthHigh} {
+		t.Run(level.String(), func(t *testing.T) {
+			config := *env.ClientConfig
+			config.StealthLevel = level
+			env.Client.Reload(&config)
+
+			// Long enough to span several tunnel queries
+			qname := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example.com"
+			query := helpers.CreateTestDNSQuery(qname, dns.RRTypeA)
+			query.AddEDNS0(4096)
+
+			response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Failed to send query: %v", err)
+			}
+			if response.Rcode() != dns.RcodeNoError {
+				t.Errorf("Response RCODE: got %d, want %d", response.Rcode(), dns.RcodeNoError)
+			}
+			if len(response.Answer) == 0 {
+				t.Error("Response should have at least one answer")
+			}
+		})
+	}
+}
+
+// TestClientServerCaseRandomization tests tunnel query names sent in
+// random case, switched on by reloading the client.
+func TestClientServerCaseRandomization(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	config := *env.ClientConfig
+	config.CaseRandomization = true
+	config.StealthLevel = dns.StealthMedium
+	env.Client.Reload(&config)
+
+	for i := range 5 {
+		qname := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example.com"
+		query := dns.CreateQuery(helpers.MustParseName(qname), dns.RRTypeA, uint16(0x6000+i))
+		query.AddEDNS0(4096)
+
+		response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Failed to send query: %v", err)
+		}
+		if response.Rcode() != dns.RcodeNoError || len(response.Answer) == 0 {
+			t.Errorf("Response: RCODE %d with %d answers, want an answer", response.Rcode(), len(response.Answer))
+		}
+	}
+}
+
+// TestServerTCPListener tests that the server answers tunnel queries over TCP.
+func TestServerTCPListener(t *testing.T) {
+	secret := helpers.GenerateTestKey()
+	serverPort := helpers.PickPort(t)
+	upstreamPort := helpers.PickPort(t)
+
+	mockUpstream := helpers.NewMockUpstreamDNS(t, upstreamPort)
+	defer mockUpstream.Close()
+
+	serverAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:       serverAddr,
+		Domain:           "t.example.com",
+		SharedSecret:     secret,
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+		ListenTCP:        true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
+
+	// Build a tunnel query by hand, as the client would
+	cipher, err := crypto.NewCipher(secret, true)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+
+	domain := helpers.MustParseName("t.example.com")
+	inner, err := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1111).Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal inner query: %v", err)
+	}
+
+	encrypted, err := cipher.Encrypt(inner)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	fragments, err := dns.SplitPayload(encrypted, 1, dns.QueryFragmentSize(domain))
+	if err != nil || len(fragments) != 1 {
+		t.Fatalf("SplitPayload() = %d fragments, %v", len(fragments), err)
+	}
+
+	name, err := dns.EncodePayload(fragments[0].Marshal(), 0, dns.NewClientID(), domain)
+	if err != nil {
+		t.Fatalf("Failed to encode payload: %v", err)
+	}
+
+	query := dns.CreateQuery(name, dns.RRTypeTXT, 0x2222)
+	query.AddEDNS0(4096)
+
+	response, err := helpers.SendTCPQuery(t, serverAddr, query, 5*time.Second)
+	if err != nil {
+		t.Fatalf("TCP query failed: %v", err)
+	}
+
+	payload, err := dns.ExtractResponsePayload(response, domain)
+	if err != nil {
+		t.Fatalf("Failed to extract payload: %v", err)
+	}
+
+	fragment, err := dns.ParseFragment(payload)
+	if err != nil {
+		t.Fatalf("Failed to parse fragment: %v", err)
+	}
+
+	decrypted, err := cipher.DecryptWithoutTimestamp(fragment.Data)
+	if err != nil {
+		t.Fatalf("Failed to decrypt response: %v", err)
+	}
+
+	answer, err := dns.ParseMessage(decrypted)
+	if err != nil {
+		t.Fatalf("Failed to parse inner response: %v", err)
+	}
+
+	if len(answer.Answer) == 0 || answer.Answer[0].Type != dns.RRTypeA {
+		t.Errorf("Unexpected inner answer: %+v", answer.Answer)
+	}
+}
+
+// startTruncatingResolver starts a resolver in front of server that, like
+// one capping its UDP answers, answers every UDP query truncated, and
+// relays TCP queries to the server's TCP listener. It returns its address
+// and the number of TCP connections it relayed.
+func startTruncatingResolver(t *testing.T, server string) (string, *atomic.Int32) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ln, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Skipf("Failed to listen on TCP: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		buf := make([]byte, dns.MaxEDNSSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := dns.CreateResponse(query)
+			resp.Truncate()
+			if data, err := resp.Marshal(); err == nil {
+				_, _ = conn.WriteToUDP(data, addr)
+			}
+		}
+	}()
+
+	var relayed atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			relayed.Add(1)
+			go func() {
+				defer c.Close()
+				upstream, err := net.Dial("tcp", server)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() { _, _ = io.Copy(upstream, c) }()
+				_, _ = io.Copy(c, upstream)
+			}()
+		}
+	}()
+	return conn.LocalAddr().String(), &relayed
+}
+
+// TestClientServerTruncatedRetry tests the client retrying a query over TCP
+// when a resolver truncates the tunnel response.
+func TestClientServerTruncatedRetry(t *testing.T) {
+	secret := helpers.GenerateTestKey()
+	mockUpstream := helpers.NewMockUpstreamDNS(t, helpers.PickPort(t))
+	defer mockUpstream.Close()
+
+	serverAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t)))
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:       serverAddr,
+		Domain:           "t.example.com",
+		SharedSecret:     secret,
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+		ListenTCP:        true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
+
+	resolverAddr, relayed := startTruncatingResolver(t, serverAddr)
+	resolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{resolverAddr},
+		SharedSecret:  secret,
+		Timeout:       5 * time.Second,
+		MaxConcurrent: 100,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := resolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer resolver.Stop()
+
+	query := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x7500)
+	response, err := helpers.SendQuery(t, resolver.ListenAddr(), query, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	if response.Rcode() != dns.RcodeNoError || len(response.Answer) == 0 {
+		t.Errorf("Response: rcode %d, %d answers, want an answer", response.Rcode(), len(response.Answer))
+	}
+	if relayed.Load() == 0 {
+		t.Error("Query not retried over TCP")
+	}
+}
+
+// TestGracefulShutdown tests that in-flight queries are answered while the
+// client and server drain, and new queries are refused.
+func TestGracefulShutdown(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	env.MockUpstream.SetDelay(500 * time.Millisecond)
+
+	query := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1234)
+	query.AddEDNS0(4096)
+
+	type result struct {
+		response *dns.Message
+		err      error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		response, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+		resultCh <- result{response, err}
+	}()
+
+	// Shut down both sides while the query waits for the upstream
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- env.Server.Shutdown(ctx) }()
+	if err := env.Client.Shutdown(ctx); err != nil {
+		t.Errorf("Client Shutdown() error = %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Errorf("Server Shutdown() error = %v", err)
+	}
+
+	res := <-resultCh
+	if res.err != nil {
+		t.Fatalf("In-flight query failed: %v", res.err)
+	}
+	if res.response.Rcode() != dns.RcodeNoError || len(res.response.Answer) == 0 {
+		t.Errorf("In-flight query: rcode %d, %d answers", res.response.Rcode(), len(res.response.Answer))
+	}
+
+	// The client no longer answers
+	if _, err := helpers.SendQuery(t, env.Client.ListenAddr(), query, 500*time.Millisecond); err == nil {
+		t.Error("Query answered after shutdown")
+	}
+}
+
+// TestShutdownDrainTimeout tests that shutdown gives up on queries that
+// outlast the drain timeout.
+func TestShutdownDrainTimeout(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.Cleanup()
+
+	env.MockUpstream.SetDelay(3 * time.Second)
+
+	query := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, 0x1234)
+	query.AddEDNS0(4096)
+	go func() {
+		_, _ = helpers.SendQuery(t, env.Client.ListenAddr(), query, 5*time.Second)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := env.Server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Server Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v", elapsed)
+	}
+}
+
+// TestClientServerSocksProxy tests a TCP connection through the client's
+// SOCKS5 proxy and a tunnel stream.
+func TestClientServerSocksProxy(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+
+	// Echo server as the destination
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	serverPort := helpers.PickPort(t)
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:         net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:             "t.example.com",
+		SharedSecret:       sharedSecret,
+		UpstreamResolver:   "127.0.0.1:1",
+		UpstreamType:       "udp",
+		MaxUDPSize:         1232,
+		ResponseTTL:        60,
+		MaxConcurrent:      100,
+		RateLimit:          100000,
+		AllowStreams:       true,
+		StreamAllowPrivate: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
+
+	socksAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t)))
+	clientResolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+		SharedSecret:  sharedSecret,
+		Timeout:       2 * time.Second,
+		MaxConcurrent: 100,
+		SocksAddr:     socksAddr,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := clientResolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer clientResolver.Stop()
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to SOCKS5 proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// No authentication, then CONNECT to the echo server
+	port := echo.Addr().(*net.TCPAddr).Port
+	request := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Failed to send SOCKS5 request: %v", err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS5 reply: %v", err)
+	}
+	if !bytes.Equal(reply[:2], []byte{5, 0}) || reply[3] != 0 {
+		t.Fatalf("SOCKS5 reply: got %x", reply)
+	}
+
+	// Data larger than a single frame in each direction
+	data := make([]byte, 8192)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go func() {
+		_, _ = conn.Write(data)
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read echoed data: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Echoed %d bytes, want the %d bytes sent", len(got), len(data))
+	}
+}
+
+// TestClientServerInstanceAffinity tests that sessions stick to the
+// instance subdomain from the handshake, and fall back to the server's
+// TestClientServerSocksDownload tests a stream whose destination sends
+// first and much more than it receives, so its data reaches the client
+// through polls.
+func TestClientServerSocksDownload(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+
+	// Destination that sends a download after a pause, then closes
+	download := make([]byte, 96*1024)
+	for i := range download {
+		download[i] = byte(i * 13)
+	}
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer dest.Close()
+	go func() {
+		conn, err := dest.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(300 * time.Millisecond)
+		_, _ = conn.Write(download)
+	}()
+
+	serverPort := helpers.PickPort(t)
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:         net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:             "t.example.com",
+		SharedSecret:       sharedSecret,
+		UpstreamResolver:   "127.0.0.1:1",
+		UpstreamType:       "udp",
+		MaxUDPSize:         1232,
+		ResponseTTL:        60,
+		MaxConcurrent:      100,
+		RateLimit:          100000,
+		AllowStreams:       true,
+		StreamAllowPrivate: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
+
+	socksAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t)))
+	clientResolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))},
+		SharedSecret:  sharedSecret,
+		Timeout:       2 * time.Second,
+		MaxConcurrent: 100,
+		SocksAddr:     socksAddr,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := clientResolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer clientResolver.Stop()
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to SOCKS5 proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	port := dest.Addr().(*net.TCPAddr).Port
+	request := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Failed to send SOCKS5 request: %v", err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS5 reply: %v", err)
+	}
+	if reply[1] != 0 {
+		t.Fatalf("SOCKS5 reply: got %x", reply)
+	}
+
+	got := make([]byte, len(download))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Failed to read download: %v", err)
+	}
+	if !bytes.Equal(got, download) {
+		t.Error("Downloaded data differs from the data sent")
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Failed to read end of stream: %v", err)
+	}
+}
+
+// domain when the subdomain can't be reached.
+func TestClientServerInstanceAffinity(t *testing.T) {
+	sharedSecret := helpers.GenerateTestKey()
+
+	mockUpstream := helpers.NewMockUpstreamDNS(t, helpers.PickPort(t))
+	defer mockUpstream.Close()
+
+	serverPort := helpers.PickPort(t)
+	serverHandler, err := server.NewHandler(&server.Config{
+		ListenAddr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		Domain:           "t.example.com",
+		SharedSecret:     sharedSecret,
+		UpstreamResolver: mockUpstream.Address(),
+		UpstreamType:     "udp",
+		MaxUDPSize:       1232,
+		ResponseTTL:      60,
+		MaxConcurrent:    100,
+		RateLimit:        1000,
+		InstanceLabel:    "ns-a",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := serverHandler.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer serverHandler.Stop()
+
+	// Relay between client and server that counts queries for the instance
+	// subdomain, and can refuse them like a resolver without a delegation
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer relay.Close()
+	instance := helpers.MustParseName("ns-a.t.example.com")
+	var pinned, refuse atomic.Bool
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			if _, ok := query.Question[0].Name.TrimSuffix(instance); ok {
+				pinned.Store(true)
+				if refuse.Load() {
+					resp := dns.CreateResponse(query)
+					resp.SetRcode(dns.RcodeRefused)
+					data, _ := resp.Marshal()
+					_, _ = relay.WriteTo(data, addr)
+					continue
+				}
+			}
+			go func(data []byte, addr net.Addr) {
+				conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)))
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+				resp := make([]byte, 4096)
+				n, err := conn.Read(resp)
+				if err != nil {
+					return
+				}
+				_, _ = relay.WriteTo(resp[:n], addr)
+			}(append([]byte(nil), buf[:n]...), addr)
+		}
+	}()
+
+	clientResolver, err := client.NewResolver(&client.Config{
+		ListenAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(helpers.PickPort(t))),
+		ServerDomain:  "t.example.com",
+		Resolvers:     []string{relay.LocalAddr().String()},
+		SharedSecret:  sharedSecret,
+		Timeout:       2 * time.Second,
+		MaxConcurrent: 100,
+		Handshake:     true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := clientResolver.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer clientResolver.Stop()
+
+	query := func(id uint16) {
+		t.Helper()
+		q := dns.CreateQuery(helpers.MustParseName("example.com"), dns.RRTypeA, id)
+		response, err := helpers.SendQuery(t, clientResolver.ListenAddr(), q, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if response.Rcode() != dns.RcodeNoError {
+			t.Errorf("Response RCODE: got %d, want %d", response.Rcode(), dns.RcodeNoError)
+		}
+	}
+
+	query(0x2001)
+	if !pinned.Load() {
+		t.Error("Session queries weren't sent to the instance subdomain")
+	}
+
+	// Once the subdomain is refused, queries fall back to the domain
+	refuse.Store(true)
+	query(0x2002)
+	query(0x2003)
 }